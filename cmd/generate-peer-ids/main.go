@@ -1,12 +1,35 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// generated is one peer ID, with its registration key pair when -keys is
+// set. Signature is the private key's signature over the peer ID, which is
+// what a register message carries.
+type generated struct {
+	PeerId     string `json:"peerId"`
+	PublicKey  string `json:"publicKey,omitempty"`
+	PrivateKey string `json:"privateKey,omitempty"`
+	Signature  string `json:"signature,omitempty"`
+}
+
 func generatePeerID() string {
 	b := make([]byte, 20)
 	if _, err := rand.Read(b); err != nil {
@@ -15,10 +38,159 @@ func generatePeerID() string {
 	return fmt.Sprintf("%x", b)
 }
 
+// withKeys adds a fresh ed25519 key pair to g.
+func withKeys(g generated) generated {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	g.PublicKey = base64.StdEncoding.EncodeToString(pub)
+	g.PrivateKey = base64.StdEncoding.EncodeToString(priv)
+	g.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(g.PeerId)))
+	return g
+}
+
+// searchPrefix generates count peer IDs starting with prefix, trying random
+// IDs on workers goroutines and reporting progress to stderr every second.
+func searchPrefix(prefix string, count, workers int) []string {
+	var attempts int64
+	found := make(chan string, count)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := make([]byte, 20)
+			id := make([]byte, 40)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for j := 0; j < 1024; j++ {
+					if _, err := rand.Read(b); err != nil {
+						log.Fatal(err)
+					}
+					hex.Encode(id, b)
+					if string(id[:len(prefix)]) == prefix {
+						select {
+						case found <- string(id):
+						default:
+						}
+					}
+				}
+				atomic.AddInt64(&attempts, 1024)
+			}
+		}()
+	}
+
+	expected := math.Pow(16, float64(len(prefix)))
+	fmt.Fprintf(os.Stderr, "🔎 Searching for %d ID(s) starting with %q on %d worker(s), about %.0f attempts per ID\n", count, prefix, workers, expected)
+	start := time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	ids := []string{}
+	for len(ids) < count {
+		select {
+		case id := <-found:
+			ids = append(ids, id)
+			fmt.Fprintf(os.Stderr, "   found %d/%d: %s\n", len(ids), count, id)
+		case <-ticker.C:
+			n := atomic.LoadInt64(&attempts)
+			elapsed := time.Since(start).Seconds()
+			fmt.Fprintf(os.Stderr, "   %d attempts, %.0f/s, %d/%d found, %s elapsed\n", n, float64(n)/elapsed, len(ids), count, time.Since(start).Round(time.Second))
+		}
+	}
+	close(done)
+	wg.Wait()
+	fmt.Fprintf(os.Stderr, "   %d attempts in %s\n", atomic.LoadInt64(&attempts), time.Since(start).Round(time.Millisecond))
+	return ids
+}
+
+// writeFile writes ids to path as JSON or CSV.
+func writeFile(path, format string, ids []generated, keys bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if format == "json" {
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ids)
+	}
+	w := csv.NewWriter(f)
+	header := []string{"peerId"}
+	if keys {
+		header = append(header, "publicKey", "privateKey", "signature")
+	}
+	w.Write(header)
+	for _, g := range ids {
+		row := []string{g.PeerId}
+		if keys {
+			row = append(row, g.PublicKey, g.PrivateKey, g.Signature)
+		}
+		w.Write(row)
+	}
+	w.Flush()
+	return w.Error()
+}
+
 func main() {
 	count := flag.Int("n", 1, "number of peer IDs to generate")
+	keys := flag.Bool("keys", false, "also generate an ed25519 key pair per ID, for register")
+	out := flag.String("out", "", "write the IDs to this file instead of listing them")
+	format := flag.String("format", "", "file format, json or csv (default from the -out extension, else json)")
+	prefix := flag.String("prefix", "", "only keep IDs starting with this hex prefix")
+	workers := flag.Int("workers", runtime.NumCPU(), "goroutines searching for -prefix")
 	flag.Parse()
 
+	if *count < 1 {
+		log.Fatal("-n must be at least 1")
+	}
+	*prefix = strings.ToLower(*prefix)
+	if _, err := hex.DecodeString(*prefix + strings.Repeat("0", len(*prefix)%2)); err != nil || len(*prefix) > 40 {
+		log.Fatal("-prefix must be up to 40 hex digits")
+	}
+	if *workers < 1 {
+		*workers = 1
+	}
+	if *format == "" {
+		*format = "json"
+		if strings.EqualFold(filepath.Ext(*out), ".csv") {
+			*format = "csv"
+		}
+	}
+	if *format != "json" && *format != "csv" {
+		log.Fatal("-format must be json or csv")
+	}
+
+	var peerIds []string
+	if *prefix != "" {
+		peerIds = searchPrefix(*prefix, *count, *workers)
+	} else {
+		for i := 0; i < *count; i++ {
+			peerIds = append(peerIds, generatePeerID())
+		}
+	}
+	ids := make([]generated, len(peerIds))
+	for i, id := range peerIds {
+		ids[i] = generated{PeerId: id}
+		if *keys {
+			ids[i] = withKeys(ids[i])
+		}
+	}
+
+	if *out != "" {
+		if err := writeFile(*out, *format, ids, *keys); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("✅ %d peer ID(s) written to %s (%s).\n", len(ids), *out, *format)
+		return
+	}
+
 	fmt.Printf("🎲 Generating %d random peer ID(s):\n\n", *count)
 
 	urls := []string{
@@ -28,11 +200,15 @@ func main() {
 		"wss://pigeonhub-c.fly.dev/ws",
 	}
 
-	for i := 0; i < *count; i++ {
-		peerId := generatePeerID()
-		fmt.Printf("%d. %s\n", i+1, peerId)
+	for i, g := range ids {
+		fmt.Printf("%d. %s\n", i+1, g.PeerId)
+		if *keys {
+			fmt.Printf("   publicKey:  %s\n", g.PublicKey)
+			fmt.Printf("   privateKey: %s\n", g.PrivateKey)
+			fmt.Printf("   signature:  %s\n", g.Signature)
+		}
 		for _, url := range urls {
-			fmt.Printf("   %s?peerId=%s\n", url, peerId)
+			fmt.Printf("   %s?peerId=%s\n", url, g.PeerId)
 		}
 		fmt.Println()
 	}
@@ -41,4 +217,6 @@ func main() {
 	fmt.Println("Usage:")
 	fmt.Println("  go run cmd/generate-peer-ids/main.go -n 5")
 	fmt.Println("  ./generate-peer-ids -n 10")
+	fmt.Println("  ./generate-peer-ids -n 100 -keys -out ids.csv")
+	fmt.Println("  ./generate-peer-ids -prefix c0de -n 3")
 }
@@ -2,10 +2,14 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
+	"os"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -19,6 +23,13 @@ type LoadTestMetrics struct {
 	PeersDiscovered  int64
 	MessagesReceived int64
 	StartTime        time.Time
+
+	// Adversarial profile
+	AttacksSent       int64
+	AttackDisconnects int64
+	HealthChecksOK    int64
+	HealthChecksFail  int64
+	SpoofedDelivered  int64
 }
 
 func generatePeerID() string {
@@ -85,11 +96,122 @@ func testPeer(hubUrl string, metrics *LoadTestMetrics, wg *sync.WaitGroup, testD
 	}
 }
 
+func dialPeer(hubUrl, peerId string) (*websocket.Conn, error) {
+	u, err := url.Parse(hubUrl)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("peerId", peerId)
+	u.RawQuery = q.Encode()
+	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	return ws, err
+}
+
+// adversarialPeer cycles through malformed and hostile traffic patterns. Each
+// round uses a fresh connection since the hub may legitimately drop abusers.
+func adversarialPeer(hubUrl string, victimId string, metrics *LoadTestMetrics, wg *sync.WaitGroup, testDuration time.Duration) {
+	defer wg.Done()
+
+	giant := strings.Repeat("A", 4<<20)
+	attacks := []func(ws *websocket.Conn) error{
+		func(ws *websocket.Conn) error {
+			return ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"announce","data":`))
+		},
+		func(ws *websocket.Conn) error {
+			return ws.WriteMessage(websocket.TextMessage, []byte(`{"type":42,"networkName":["x"],"data":"not-an-object","targetPeerId":{}}`))
+		},
+		func(ws *websocket.Conn) error {
+			return ws.WriteJSON(map[string]interface{}{"type": "announce", "data": map[string]interface{}{"blob": giant}})
+		},
+		func(ws *websocket.Conn) error {
+			return ws.WriteJSON(map[string]interface{}{"type": "offer", "fromPeerId": victimId, "targetPeerId": victimId, "data": map[string]interface{}{"sdp": "spoofed"}})
+		},
+		func(ws *websocket.Conn) error {
+			return ws.WriteMessage(websocket.BinaryMessage, []byte{0xff, 0x00, 0xfe})
+		},
+	}
+
+	deadline := time.Now().Add(testDuration)
+	for i := 0; time.Now().Before(deadline); i++ {
+		ws, err := dialPeer(hubUrl, generatePeerID())
+		if err != nil {
+			atomic.AddInt64(&metrics.FailedConnects, 1)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if err := attacks[i%len(attacks)](ws); err != nil {
+			atomic.AddInt64(&metrics.AttackDisconnects, 1)
+		}
+		atomic.AddInt64(&metrics.AttacksSent, 1)
+		// Rapid reconnect loop: close immediately and come straight back.
+		ws.Close()
+	}
+}
+
+// victimPeer is a well-behaved peer that counts signaling messages claiming
+// to come from itself, which the hub should never deliver.
+func victimPeer(hubUrl, peerId string, metrics *LoadTestMetrics, stop <-chan struct{}) {
+	ws, err := dialPeer(hubUrl, peerId)
+	if err != nil {
+		atomic.AddInt64(&metrics.FailedConnects, 1)
+		return
+	}
+	defer ws.Close()
+	ws.WriteJSON(map[string]interface{}{"type": "announce", "data": map[string]interface{}{"peerId": peerId}})
+	go func() {
+		<-stop
+		ws.Close()
+	}()
+	for {
+		var msg map[string]interface{}
+		if err := ws.ReadJSON(&msg); err != nil {
+			return
+		}
+		if msg["type"] == "offer" && msg["fromPeerId"] == peerId {
+			atomic.AddInt64(&metrics.SpoofedDelivered, 1)
+		}
+	}
+}
+
+func healthURL(hubUrl string) string {
+	u, err := url.Parse(hubUrl)
+	if err != nil {
+		return ""
+	}
+	if u.Scheme == "wss" {
+		u.Scheme = "https"
+	} else {
+		u.Scheme = "http"
+	}
+	u.Path = strings.TrimSuffix(strings.TrimSuffix(u.Path, "/"), "/ws") + "/health"
+	u.RawQuery = ""
+	return u.String()
+}
+
+func checkHealth(hubUrl string, metrics *LoadTestMetrics) {
+	client := http.Client{Timeout: 2 * time.Second}
+	res, err := client.Get(healthURL(hubUrl))
+	if err != nil {
+		atomic.AddInt64(&metrics.HealthChecksFail, 1)
+		return
+	}
+	defer res.Body.Close()
+	var h map[string]interface{}
+	if res.StatusCode != http.StatusOK || json.NewDecoder(res.Body).Decode(&h) != nil || h["status"] != "healthy" {
+		atomic.AddInt64(&metrics.HealthChecksFail, 1)
+		return
+	}
+	atomic.AddInt64(&metrics.HealthChecksOK, 1)
+}
+
 func main() {
 	hubUrl := flag.String("hub", "ws://localhost:8080", "hub URL")
 	numPeers := flag.Int("peers", 100, "number of peers to simulate")
 	testDurationSeconds := flag.Int("duration", 30, "test duration in seconds")
 	printInterval := flag.Int("interval", 5, "metrics print interval in seconds")
+	profile := flag.String("profile", "normal", "traffic profile: normal or adversarial")
+	numAttackers := flag.Int("attackers", 10, "number of adversarial peers (adversarial profile)")
 	flag.Parse()
 
 	fmt.Printf("🚀 Load Testing PeerPigeon Hub\n")
@@ -97,6 +219,7 @@ func main() {
 	fmt.Printf("Hub URL: %s\n", *hubUrl)
 	fmt.Printf("Peers: %d\n", *numPeers)
 	fmt.Printf("Duration: %d seconds\n", *testDurationSeconds)
+	fmt.Printf("Profile: %s\n", *profile)
 	fmt.Printf("\n")
 
 	metrics := &LoadTestMetrics{
@@ -106,6 +229,29 @@ func main() {
 	testDuration := time.Duration(*testDurationSeconds) * time.Second
 	var wg sync.WaitGroup
 
+	adversarial := *profile == "adversarial"
+	stopVictim := make(chan struct{})
+	if adversarial {
+		victimId := generatePeerID()
+		go victimPeer(*hubUrl, victimId, metrics, stopVictim)
+		for i := 0; i < *numAttackers; i++ {
+			wg.Add(1)
+			go adversarialPeer(*hubUrl, victimId, metrics, &wg, testDuration)
+		}
+		go func() {
+			t := time.NewTicker(time.Second)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					checkHealth(*hubUrl, metrics)
+				case <-stopVictim:
+					return
+				}
+			}
+		}()
+	}
+
 	// Start all peers
 	startTime := time.Now()
 	for i := 0; i < *numPeers; i++ {
@@ -129,6 +275,10 @@ func main() {
 			fmt.Printf("  Failed connects: %d\n", atomic.LoadInt64(&metrics.FailedConnects))
 			fmt.Printf("  Peers discovered: %d\n", atomic.LoadInt64(&metrics.PeersDiscovered))
 			fmt.Printf("  Messages received: %d\n", atomic.LoadInt64(&metrics.MessagesReceived))
+			if adversarial {
+				fmt.Printf("  Attacks sent: %d\n", atomic.LoadInt64(&metrics.AttacksSent))
+				fmt.Printf("  Health checks ok/failed: %d/%d\n", atomic.LoadInt64(&metrics.HealthChecksOK), atomic.LoadInt64(&metrics.HealthChecksFail))
+			}
 
 			if elapsed > testDuration*2 {
 				goto done
@@ -138,6 +288,7 @@ func main() {
 
 done:
 	wg.Wait()
+	close(stopVictim)
 
 	elapsed := time.Since(startTime)
 	fmt.Printf("\n✅ Load Test Complete\n")
@@ -149,4 +300,21 @@ done:
 	fmt.Printf("Peers discovered: %d\n", atomic.LoadInt64(&metrics.PeersDiscovered))
 	fmt.Printf("Messages received: %d\n", atomic.LoadInt64(&metrics.MessagesReceived))
 	fmt.Printf("Msg/sec: %.0f\n", float64(atomic.LoadInt64(&metrics.MessagesReceived))/elapsed.Seconds())
+
+	if adversarial {
+		fmt.Printf("\n🛡️  Robustness\n")
+		fmt.Printf("Attacks sent: %d\n", atomic.LoadInt64(&metrics.AttacksSent))
+		fmt.Printf("Attacker write errors: %d\n", atomic.LoadInt64(&metrics.AttackDisconnects))
+		fmt.Printf("Health checks ok/failed: %d/%d\n", atomic.LoadInt64(&metrics.HealthChecksOK), atomic.LoadInt64(&metrics.HealthChecksFail))
+		fmt.Printf("Spoofed messages delivered to victim: %d\n", atomic.LoadInt64(&metrics.SpoofedDelivered))
+		failed := atomic.LoadInt64(&metrics.HealthChecksFail) > 0 || atomic.LoadInt64(&metrics.SpoofedDelivered) > 0
+		if atomic.LoadInt64(&metrics.ConnectedPeers) < int64(*numPeers) {
+			failed = true
+		}
+		if failed {
+			fmt.Printf("❌ Hub did not stay healthy or isolate peers under adversarial traffic\n")
+			os.Exit(1)
+		}
+		fmt.Printf("✅ Hub stayed healthy and isolated peers\n")
+	}
 }
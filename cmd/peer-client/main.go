@@ -1,130 +1,131 @@
 package main
 
 import (
-	"crypto/rand"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
-	"net/url"
+	"os"
+	"sync"
 	"time"
 
-	"github.com/gorilla/websocket"
+	"peerpigeon/pkg/client"
 )
 
-type Message struct {
-	Type string          `json:"type"`
-	Data json.RawMessage `json:"data,omitempty"`
+// reporter prints progress either as human-readable lines or, with -json,
+// as one JSON object per line for scripts and test harnesses.
+type reporter struct {
+	name string
+	json bool
+	mu   sync.Mutex
+	enc  *json.Encoder
 }
 
-type AnnounceData struct {
-	PeerID string `json:"peerId"`
-	Info   string `json:"info,omitempty"`
+func newReporter(name string, asJSON bool) *reporter {
+	return &reporter{name: name, json: asJSON, enc: json.NewEncoder(os.Stdout)}
 }
 
-type PeerDiscoveredData struct {
-	PeerID string `json:"peerId"`
-	Info   string `json:"info,omitempty"`
+// event reports kind with its fields; text is the human-readable line.
+func (r *reporter) event(kind string, fields map[string]interface{}, text string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.json {
+		fmt.Printf("[%s] %s\n", r.name, text)
+		return
+	}
+	ev := map[string]interface{}{"event": kind, "name": r.name, "timestamp": time.Now().UnixMilli()}
+	for k, v := range fields {
+		ev[k] = v
+	}
+	r.enc.Encode(ev)
 }
 
-func generatePeerID() string {
-	b := make([]byte, 20)
-	if _, err := rand.Read(b); err != nil {
-		log.Fatal(err)
-	}
-	return fmt.Sprintf("%x", b)
+// fatal reports an error event and exits.
+func (r *reporter) fatal(stage string, err error) {
+	r.event("error", map[string]interface{}{"stage": stage, "error": err.Error()}, fmt.Sprintf("%s failed: %v", stage, err))
+	os.Exit(1)
 }
 
 func main() {
 	hubURL := flag.String("hub", "ws://localhost:3000", "hub URL (ws://pigeonhub-b.fly.dev or wss://pigeonhub-b.fly.dev)")
 	name := flag.String("name", "peer-client", "peer name for logging")
+	network := flag.String("network", "global", "network to announce on")
 	listenTime := flag.Duration("listen", 5*time.Second, "how long to listen for peer discoveries")
+	scriptPath := flag.String("script", "", "Lua scenario script to run against the hub (see script.go for hooks and functions)")
+	asJSON := flag.Bool("json", false, "emit newline-delimited JSON events instead of text")
 	flag.Parse()
 
-	peerId := generatePeerID()
-	fmt.Printf("[%s] Generated peer ID: %s\n", *name, peerId)
-
-	// Build connection URL with peerId query parameter
-	u, err := url.Parse(*hubURL)
-	if err != nil {
-		log.Fatalf("Invalid hub URL: %v", err)
-	}
-	q := u.Query()
-	q.Set("peerId", peerId)
-	u.RawQuery = q.Encode()
-
-	fmt.Printf("[%s] Connecting to hub: %s\n", *name, u.String())
+	out := newReporter(*name, *asJSON)
+	out.event("connecting", map[string]interface{}{"hub": *hubURL}, "Connecting to hub: "+*hubURL)
 
-	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	c, err := client.Dial(*hubURL, client.Options{NetworkName: *network, AnnounceData: map[string]interface{}{"info": *name}, DiscardMessages: *scriptPath == ""})
 	if err != nil {
-		log.Fatalf("[%s] Connection failed: %v", *name, err)
+		out.fatal("connect", err)
 	}
-	defer ws.Close()
-
-	fmt.Printf("[%s] ✅ Connected to hub\n", *name)
-
-	// Announce ourselves
-	announceMsg := Message{
-		Type: "announce",
-		Data: func() json.RawMessage {
-			data := AnnounceData{
-				PeerID: peerId,
-				Info:   *name,
+	peerId := c.PeerId()
+	out.event("connected", map[string]interface{}{"hub": *hubURL, "peerId": peerId}, "✅ Connected to hub as "+peerId)
+	out.event("announced", map[string]interface{}{"peerId": peerId, "network": *network}, "📢 Announced self")
+
+	var sc *script
+	if *scriptPath != "" {
+		if sc, err = loadScript(*scriptPath, c, out, *name, *network); err != nil {
+			c.Close()
+			out.fatal("script", err)
+		}
+		out.event("script-loaded", map[string]interface{}{"script": *scriptPath}, "📜 Running "+*scriptPath)
+		sc.start()
+		go func() {
+			for msg := range c.Messages() {
+				sc.message(msg)
 			}
-			b, _ := json.Marshal(data)
-			return b
-		}(),
-	}
-
-	if err := ws.WriteJSON(announceMsg); err != nil {
-		log.Fatalf("[%s] Announce failed: %v", *name, err)
+		}()
 	}
-	fmt.Printf("[%s] 📢 Announced self\n", *name)
 
-	// Listen for peer discoveries
-	done := make(chan struct{})
-	discoveredPeers := make(map[string]bool)
-
-	go func() {
-		defer close(done)
-		for {
-			var msg Message
-			if err := ws.ReadJSON(&msg); err != nil {
-				fmt.Printf("[%s] Read error: %v\n", *name, err)
-				return
-			}
-
-			switch msg.Type {
-			case "peer-discovered":
-				var data PeerDiscoveredData
-				if err := json.Unmarshal(msg.Data, &data); err != nil {
-					fmt.Printf("[%s] Unmarshal error: %v\n", *name, err)
-					continue
-				}
-				if data.PeerID != peerId && !discoveredPeers[data.PeerID] {
-					discoveredPeers[data.PeerID] = true
-					fmt.Printf("[%s] 🔍 Discovered peer: %s (info: %s)\n", *name, data.PeerID[:8], data.Info)
-				}
-			case "hub-stats":
-				fmt.Printf("[%s] Hub stats received\n", *name)
-			default:
-				// Silently ignore other message types
-			}
+	c.OnPeerDiscovered(func(id string, data json.RawMessage) {
+		var d struct {
+			Info string `json:"info"`
 		}
-	}()
-
-	// Wait for discoveries or timeout
-	select {
-	case <-time.After(*listenTime):
-		fmt.Printf("[%s] Timeout - stopping listen\n", *name)
-	case <-done:
+		json.Unmarshal(data, &d)
+		if p, _ := c.Peers().Get(id); p.Seen == 1 {
+			out.event("discovered", map[string]interface{}{"peerId": id, "info": d.Info}, fmt.Sprintf("🔍 Discovered peer: %s (info: %s)", id[:8], d.Info))
+		}
+		if sc != nil {
+			sc.discovered(id, data)
+		}
+	})
+	c.OnPeerDisconnected(func(id string, reason client.DisconnectReason) {
+		out.event("peer-disconnected", map[string]interface{}{"peerId": id, "reason": reason}, fmt.Sprintf("👋 Peer %s left (%s)", id[:8], reason))
+		if sc != nil {
+			sc.disconnected(id, reason)
+		}
+	})
+	c.OnSignal(func(msg client.Message) {
+		out.event("signal-received", map[string]interface{}{"type": msg.Type, "fromPeerId": msg.FromPeerId}, fmt.Sprintf("📨 Received %s from %s", msg.Type, msg.FromPeerId))
+	})
+
+	ok := true
+	if sc != nil {
+		select {
+		case <-sc.done:
+			out.event("script-stopped", nil, "Script stopped")
+		case <-time.After(*listenTime):
+			out.event("listen-timeout", nil, "Timeout - stopping listen")
+		}
+		ok = sc.finish()
+	} else {
+		time.Sleep(*listenTime)
+		out.event("listen-timeout", nil, "Timeout - stopping listen")
 	}
 
-	if len(discoveredPeers) > 0 {
-		fmt.Printf("[%s] 📊 Total peers discovered: %d\n", *name, len(discoveredPeers))
-	} else {
-		fmt.Printf("[%s] ⚠️  No peers discovered (this is OK if you're the first peer)\n", *name)
+	n := c.Peers().Len()
+	text := fmt.Sprintf("📊 Total peers discovered: %d", n)
+	if n == 0 {
+		text = "⚠️  No peers discovered (this is OK if you're the first peer)"
 	}
+	out.event("summary", map[string]interface{}{"discovered": n}, text)
 
-	fmt.Printf("[%s] Disconnecting...\n", *name)
+	out.event("disconnecting", nil, "Disconnecting...")
+	c.Close()
+	if !ok {
+		os.Exit(1)
+	}
 }
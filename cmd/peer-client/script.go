@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+
+	"peerpigeon/pkg/client"
+)
+
+// script runs a Lua scenario against the hub. The script is loaded once
+// after the client has announced and may define any of these hooks:
+//
+//	on_start()                       once, after the script loads
+//	on_discovered(peer_id, data)     a peer was discovered; data is its announce data
+//	on_message(msg)                  any other message: offer, answer, ice-candidate,
+//	                                 peer-message, ...; msg has type, from, to,
+//	                                 network, message_id and data
+//	on_disconnected(peer_id, reason) a discovered peer left
+//	on_stop()                        once, before the client disconnects
+//
+// Scripts act through these globals:
+//
+//	peer_id, network, name           this client
+//	offer(id, data), answer(id, data), ice(id, data)
+//	signal(type, id, data)           any other signal type
+//	send(id, data)                   a peer-message; returns its message ID
+//	peers()                          the discovered peers, as {peer_id, network, data}
+//	log(...)                         print a script-log event
+//	after(seconds, fn)               call fn later
+//	stop()                           end the run before -listen elapses
+//
+// Send functions return nil and an error message on failure. Hooks and
+// timers run one at a time, so scripts need no locking. An error raised by
+// the script is reported and ends the run with exit status 1.
+type script struct {
+	mu     sync.Mutex
+	L      *lua.LState
+	out    *reporter
+	done   chan struct{}
+	once   sync.Once
+	failed bool
+}
+
+func loadScript(path string, c *client.Client, out *reporter, name, network string) (*script, error) {
+	s := &script{L: lua.NewState(), out: out, done: make(chan struct{})}
+	L := s.L
+	L.SetGlobal("peer_id", lua.LString(c.PeerId()))
+	L.SetGlobal("network", lua.LString(network))
+	L.SetGlobal("name", lua.LString(name))
+	for _, t := range []struct{ fn, signal string }{{"offer", "offer"}, {"answer", "answer"}, {"ice", "ice-candidate"}} {
+		t := t
+		L.SetGlobal(t.fn, L.NewFunction(func(L *lua.LState) int {
+			return s.result(L, nil, c.Signal(t.signal, L.CheckString(1), fromLua(L.Get(2))))
+		}))
+	}
+	L.SetGlobal("signal", L.NewFunction(func(L *lua.LState) int {
+		return s.result(L, nil, c.Signal(L.CheckString(1), L.CheckString(2), fromLua(L.Get(3))))
+	}))
+	L.SetGlobal("send", L.NewFunction(func(L *lua.LState) int {
+		id, err := c.SendMessage(L.CheckString(1), fromLua(L.Get(2)), false)
+		return s.result(L, lua.LString(id), err)
+	}))
+	L.SetGlobal("peers", L.NewFunction(func(L *lua.LState) int {
+		t := L.NewTable()
+		for _, p := range c.Peers().All() {
+			e := L.NewTable()
+			e.RawSetString("peer_id", lua.LString(p.PeerId))
+			e.RawSetString("network", lua.LString(p.Network))
+			e.RawSetString("data", rawToLua(L, p.Data))
+			t.Append(e)
+		}
+		L.Push(t)
+		return 1
+	}))
+	L.SetGlobal("log", L.NewFunction(func(L *lua.LState) int {
+		parts := make([]string, L.GetTop())
+		for i := range parts {
+			parts[i] = L.ToStringMeta(L.Get(i + 1)).String()
+		}
+		text := strings.Join(parts, " ")
+		out.event("script-log", map[string]interface{}{"message": text}, "📝 "+text)
+		return 0
+	}))
+	L.SetGlobal("after", L.NewFunction(func(L *lua.LState) int {
+		d := time.Duration(float64(L.CheckNumber(1)) * float64(time.Second))
+		fn := L.CheckFunction(2)
+		time.AfterFunc(d, func() { s.call(fn) })
+		return 0
+	}))
+	L.SetGlobal("stop", L.NewFunction(func(L *lua.LState) int {
+		s.stop()
+		return 0
+	}))
+	if err := L.DoFile(path); err != nil {
+		L.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// result pushes a send function's return values: v (true when nil) on
+// success, nil and the error message on failure.
+func (s *script) result(L *lua.LState, v lua.LValue, err error) int {
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	if v == nil {
+		v = lua.LTrue
+	}
+	L.Push(v)
+	return 1
+}
+
+// hook calls the global function name, if the script defines it.
+func (s *script) hook(name string, args func(L *lua.LState) []lua.LValue) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.L == nil || s.failed {
+		return
+	}
+	if fn, ok := s.L.GetGlobal(name).(*lua.LFunction); ok {
+		s.callLocked(fn, args)
+	}
+}
+
+// call runs fn, a function the script handed to after.
+func (s *script) call(fn *lua.LFunction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.L != nil && !s.failed {
+		s.callLocked(fn, nil)
+	}
+}
+
+func (s *script) callLocked(fn *lua.LFunction, args func(L *lua.LState) []lua.LValue) {
+	var in []lua.LValue
+	if args != nil {
+		in = args(s.L)
+	}
+	if err := s.L.CallByParam(lua.P{Fn: fn, NRet: 0, Protect: true}, in...); err != nil {
+		s.failed = true
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			err = errors.New(apiErr.Object.String())
+		}
+		s.out.event("error", map[string]interface{}{"stage": "script", "error": err.Error()}, fmt.Sprintf("script failed: %v", err))
+		s.stop()
+	}
+}
+
+func (s *script) stop() { s.once.Do(func() { close(s.done) }) }
+
+func (s *script) start() { s.hook("on_start", nil) }
+
+func (s *script) discovered(peerId string, data json.RawMessage) {
+	s.hook("on_discovered", func(L *lua.LState) []lua.LValue {
+		return []lua.LValue{lua.LString(peerId), rawToLua(L, data)}
+	})
+}
+
+func (s *script) disconnected(peerId string, reason client.DisconnectReason) {
+	s.hook("on_disconnected", func(L *lua.LState) []lua.LValue {
+		return []lua.LValue{lua.LString(peerId), lua.LString(reason)}
+	})
+}
+
+// message passes msg to on_message unless another hook covers it.
+func (s *script) message(msg client.Message) {
+	switch msg.Type {
+	case "peer-discovered", "peer-list", "peer-disconnected":
+		return
+	}
+	s.hook("on_message", func(L *lua.LState) []lua.LValue {
+		t := L.NewTable()
+		t.RawSetString("type", lua.LString(msg.Type))
+		t.RawSetString("from", lua.LString(msg.FromPeerId))
+		t.RawSetString("to", lua.LString(msg.TargetPeerId))
+		t.RawSetString("network", lua.LString(msg.NetworkName))
+		t.RawSetString("message_id", lua.LString(msg.MessageId))
+		t.RawSetString("data", rawToLua(L, msg.Data))
+		return []lua.LValue{t}
+	})
+}
+
+// finish runs on_stop and closes the Lua state, reporting whether the
+// script ran without error.
+func (s *script) finish() bool {
+	s.hook("on_stop", nil)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.L.Close()
+	s.L = nil
+	return !s.failed
+}
+
+func rawToLua(L *lua.LState, data json.RawMessage) lua.LValue {
+	var v interface{}
+	if len(data) == 0 || json.Unmarshal(data, &v) != nil {
+		return lua.LNil
+	}
+	return toLua(L, v)
+}
+
+// toLua converts a decoded JSON value to Lua: objects and arrays become
+// tables, null becomes nil.
+func toLua(L *lua.LState, v interface{}) lua.LValue {
+	switch v := v.(type) {
+	case bool:
+		return lua.LBool(v)
+	case float64:
+		return lua.LNumber(v)
+	case string:
+		return lua.LString(v)
+	case []interface{}:
+		t := L.CreateTable(len(v), 0)
+		for _, item := range v {
+			t.Append(toLua(L, item))
+		}
+		return t
+	case map[string]interface{}:
+		t := L.CreateTable(0, len(v))
+		for k, item := range v {
+			t.RawSetString(k, toLua(L, item))
+		}
+		return t
+	}
+	return lua.LNil
+}
+
+// fromLua converts a Lua value to one that encodes as JSON. A table with
+// only the keys 1..n becomes an array, any other table an object.
+func fromLua(v lua.LValue) interface{} {
+	switch v := v.(type) {
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		return float64(v)
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		n := v.MaxN()
+		keys := 0
+		v.ForEach(func(lua.LValue, lua.LValue) { keys++ })
+		if n > 0 && n == keys {
+			arr := make([]interface{}, 0, n)
+			for i := 1; i <= n; i++ {
+				arr = append(arr, fromLua(v.RawGetInt(i)))
+			}
+			return arr
+		}
+		obj := map[string]interface{}{}
+		v.ForEach(func(k, item lua.LValue) { obj[k.String()] = fromLua(item) })
+		return obj
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode"
+    "github.com/pelletier/go-toml/v2"
+    "gopkg.in/yaml.v3"
+)
+
+// Settings come, in order of precedence, from PEERPIGEON_<NAME> environment
+// variables, the bare <NAME> variables the hub has always read, the file
+// given with --config (or PEERPIGEON_CONFIG), and finally the built-in
+// defaults. A config file may be JSON, YAML or TOML, chosen by extension.
+// Its keys are the variable names in any common spelling: "port",
+// "bootstrapHubs", "bootstrap-hubs" and "BOOTSTRAP_HUBS" all set
+// BOOTSTRAP_HUBS. Nested tables join their keys, so reputation: {banAt: 10}
+// sets REPUTATION_BAN_AT, and lists become comma-separated values.
+//
+// Every lookup is recorded, so after main has read its settings checkConfig
+// can report keys in the file that the hub does not know and values that do
+// not parse, instead of silently ignoring them.
+const envPrefix = "PEERPIGEON_"
+
+var (
+    fileSettings   = map[string]string{}
+    knownSettings  = map[string]bool{}
+    configProblems []string
+)
+
+// loadConfig reads a config file into fileSettings.
+func loadConfig(path string) error {
+    b, err := os.ReadFile(path)
+    if err != nil {
+        return err
+    }
+    doc := map[string]interface{}{}
+    switch strings.ToLower(filepath.Ext(path)) {
+    case ".json":
+        err = json.Unmarshal(b, &doc)
+    case ".yaml", ".yml":
+        err = yaml.Unmarshal(b, &doc)
+    case ".toml":
+        err = toml.Unmarshal(b, &doc)
+    default:
+        return fmt.Errorf("%s: config must be .json, .yaml, .yml or .toml", path)
+    }
+    if err != nil {
+        return fmt.Errorf("%s: %v", path, err)
+    }
+    return flattenConfig("", doc)
+}
+
+func flattenConfig(prefix string, doc map[string]interface{}) error {
+    for k, v := range doc {
+        name := prefix + settingName(k)
+        switch v := v.(type) {
+        case map[string]interface{}:
+            if err := flattenConfig(name+"_", v); err != nil {
+                return err
+            }
+        case []interface{}:
+            parts := make([]string, 0, len(v))
+            for _, item := range v {
+                s, ok := scalarSetting(item)
+                if !ok {
+                    return fmt.Errorf("%s: list items must be plain values", name)
+                }
+                parts = append(parts, s)
+            }
+            fileSettings[name] = strings.Join(parts, ",")
+        default:
+            s, ok := scalarSetting(v)
+            if !ok {
+                return fmt.Errorf("%s: unsupported value", name)
+            }
+            fileSettings[name] = s
+        }
+    }
+    return nil
+}
+
+func scalarSetting(v interface{}) (string, bool) {
+    switch v := v.(type) {
+    case string:
+        return v, true
+    case bool:
+        return strconv.FormatBool(v), true
+    case int:
+        return strconv.Itoa(v), true
+    case int64:
+        return strconv.FormatInt(v, 10), true
+    case float64:
+        return strconv.FormatFloat(v, 'f', -1, 64), true
+    case nil:
+        return "", true
+    }
+    return "", false
+}
+
+// settingName turns a config key into its variable name: camelCase,
+// kebab-case and snake_case all map to UPPER_SNAKE_CASE.
+func settingName(key string) string {
+    var b strings.Builder
+    rs := []rune(key)
+    for i, r := range rs {
+        switch {
+        case r == '-' || r == ' ' || r == '.':
+            r = '_'
+        case i > 0 && unicode.IsUpper(r):
+            prev := rs[i-1]
+            nextLower := i+1 < len(rs) && unicode.IsLower(rs[i+1])
+            if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+                b.WriteRune('_')
+            }
+        }
+        b.WriteRune(unicode.ToUpper(r))
+    }
+    return b.String()
+}
+
+func getenv(key, def string) string {
+    knownSettings[key] = true
+    if v := os.Getenv(envPrefix + key); v != "" {
+        return v
+    }
+    if v := os.Getenv(key); v != "" {
+        return v
+    }
+    if v, ok := fileSettings[key]; ok && v != "" {
+        return v
+    }
+    return def
+}
+
+// getint reads a whole-number setting; a value that does not parse is
+// reported by checkConfig.
+func getint(key, def string) int {
+    v := getenv(key, def)
+    n, err := strconv.Atoi(strings.TrimSpace(v))
+    if err != nil {
+        configProblems = append(configProblems, fmt.Sprintf("%s: %q is not a whole number", key, v))
+        n, _ = strconv.Atoi(def)
+    }
+    return n
+}
+
+// getbool reads a true/false setting.
+func getbool(key, def string) bool {
+    v := getenv(key, def)
+    b, err := strconv.ParseBool(strings.TrimSpace(v))
+    if err != nil {
+        configProblems = append(configProblems, fmt.Sprintf("%s: %q is not true or false", key, v))
+        b, _ = strconv.ParseBool(def)
+    }
+    return b
+}
+
+// checkConfig returns everything wrong with the settings read so far.
+func checkConfig() []string {
+    problems := append([]string{}, configProblems...)
+    unknown := []string{}
+    for k := range fileSettings {
+        if !knownSettings[k] {
+            unknown = append(unknown, k)
+        }
+    }
+    sort.Strings(unknown)
+    for _, k := range unknown {
+        problems = append(problems, k+": unknown setting")
+    }
+    return problems
+}
@@ -1,36 +1,189 @@
 package main
 
 import (
+    "encoding/json"
+    "errors"
+    "flag"
     "log"
     "os"
-    "strconv"
+    "os/signal"
     "strings"
+    "syscall"
+    "peerpigeon/internal/logging"
     "peerpigeon/internal/server"
+    "peerpigeon/internal/store"
 )
 
-func getenv(key, def string) string {
-    v := os.Getenv(key)
-    if v == "" {
-        return def
-    }
-    return v
-}
-
 func main() {
-    portStr := getenv("PORT", "3000")
+    configPath := flag.String("config", os.Getenv(envPrefix+"CONFIG"), "JSON, YAML or TOML settings file")
+    flag.Parse()
+    if *configPath != "" {
+        if err := loadConfig(*configPath); err != nil {
+            log.Fatalf("config error: %v", err)
+        }
+    }
+    live := liveSettings()
+    port := getint("PORT", "3000")
     host := getenv("HOST", "localhost")
-    maxConnStr := getenv("MAX_CONNECTIONS", "1000")
+    maxConn := *live.MaxConnections
     cors := getenv("CORS_ORIGIN", "*")
     hubNs := getenv("HUB_MESH_NAMESPACE", "pigeonhub-mesh")
-    isHubStr := getenv("IS_HUB", "false")
+    isHub := getbool("IS_HUB", "false")
     bootstrap := getenv("BOOTSTRAP_HUBS", "")
     authToken := getenv("AUTH_TOKEN", "")
+    adminToken := getenv("ADMIN_TOKEN", "")
+    healthCheck := getbool("BOOTSTRAP_HEALTH_CHECK", "false")
+    identityStore := getenv("IDENTITY_STORE", "")
+    maxUpgrades := *live.MaxUpgradesPerSec
+    compressThreshold := getint("COMPRESS_THRESHOLD_BYTES", "0")
+    blobMax := getint("BLOB_MAX_BYTES", "0")
+    blobQuota := getint("BLOB_QUOTA_BYTES", "0")
+    appBroadcastNets := getenv("APP_BROADCAST_NETWORKS", "")
+    appBroadcastMax := getint("APP_BROADCAST_MAX_BYTES", "16384")
+    appBroadcastRate := *live.AppBroadcastRatePerSec
+    eventReplay := getint("EVENT_REPLAY_SIZE", "0")
+    hubRole := getenv("HUB_ROLE", "full")
+    migrationSecret := getenv("MIGRATION_SECRET", "")
+    signalingTimeout := getint("SIGNALING_TIMEOUT_MS", "30000")
+    signalDeadline := getint("SIGNAL_DEADLINE_MS", "15000")
+    dataRetention := getint("DATA_RETENTION_MS", "0")
+    discoveryRate := getint("CROSS_HUB_DISCOVERY_RATE", "0")
+    integrationsStore := getenv("INTEGRATIONS_STORE", "")
+    hubGossipQuota := getint("HUB_GOSSIP_QUOTA", "0")
+    hubSignalingQuota := getint("HUB_SIGNALING_QUOTA", "0")
+    hubQuotaSuspend := getint("HUB_QUOTA_SUSPEND_MS", "60000")
+    meshToken := getenv("MESH_TOKEN", "")
+    allowUnauthMesh := getbool("ALLOW_UNAUTHENTICATED_MESH", "false")
+    maxMeshConn := getint("MAX_MESH_CONNECTIONS", "0")
+    meshPathOnly := getbool("MESH_PATH_ONLY", "false")
+    meshCompression := getbool("MESH_COMPRESSION", "false")
+    meshAutoDial := getbool("MESH_AUTO_DIAL", "false")
+    meshMaxDialed := getint("MESH_MAX_DIALED", "8")
+    publicURL := getenv("PUBLIC_URL", "")
+    meshMaxHops := getint("MESH_MAX_HOPS", "8")
+    eventBridgeURL := getenv("EVENT_BRIDGE_URL", "")
+    eventBridgeTopic := getenv("EVENT_BRIDGE_TOPIC", "peerpigeon.{event}")
+    eventBridgeTopics := getenv("EVENT_BRIDGE_TOPICS", "")
+    eventBridgeBatchSize := getint("EVENT_BRIDGE_BATCH_SIZE", "100")
+    eventBridgeFlushMs := getint("EVENT_BRIDGE_FLUSH_MS", "1000")
+    eventBridgeQueueSize := getint("EVENT_BRIDGE_QUEUE_SIZE", "10000")
+    eventBridgeDelivery := getenv("EVENT_BRIDGE_DELIVERY", "at-least-once")
+    backplaneURL := getenv("BACKPLANE_URL", "")
+    backplanePrefix := getenv("BACKPLANE_PREFIX", "peerpigeon")
+    backplaneHeartbeatMs := getint("BACKPLANE_HEARTBEAT_MS", "5000")
+    grpcAddr := getenv("GRPC_ADDR", "")
+    grpcCertFile := getenv("GRPC_CERT_FILE", "")
+    grpcKeyFile := getenv("GRPC_KEY_FILE", "")
+    peerIdle := getint("PEER_IDLE_MS", "60000")
+    defaultNetwork := getenv("DEFAULT_NETWORK", "global")
+    allowedNetworks := getenv("ALLOWED_NETWORKS", "")
+    maxNetworks := getint("MAX_NETWORKS", "0")
+    maxPeersPerNetwork := getint("MAX_PEERS_PER_NETWORK", "0")
+    changeFeedSize := getint("CHANGE_FEED_SIZE", "1000")
+    metricsStore := getenv("METRICS_STORE", "")
+    metricsPersistInterval := getint("METRICS_PERSIST_INTERVAL_MS", "60000")
+    metricsMaxSeries := getint("METRICS_MAX_SERIES", "100")
+    disconnectDebounce := getint("DISCONNECT_DEBOUNCE_MS", "0")
+    sameNetworkHints := getbool("SAME_NETWORK_HINTS", "true")
+    legacyEnvelope := getbool("LEGACY_ENVELOPE_DEFAULT", "false")
+    shedCPU := getint("SHED_CPU_PERCENT", "0")
+    shedQueue := getint("SHED_QUEUE_DEPTH", "0")
+    maxRSS := getint("MAX_RSS_MB", "0")
+    maxHeap := getint("MAX_HEAP_MB", "0")
+    maxGoroutines := getint("MAX_GOROUTINES", "0")
+    guardrailWarn := getint("GUARDRAIL_WARN_PERCENT", "90")
+    var networkACL []server.ACLRule
+    if v := getenv("NETWORK_ACL", ""); v != "" {
+        if err := json.Unmarshal([]byte(v), &networkACL); err != nil {
+            configProblems = append(configProblems, "NETWORK_ACL: "+err.Error())
+        }
+    }
+    protectedNetworks := getenv("PROTECTED_NETWORKS", "")
+    reputationWarn := getint("REPUTATION_WARN_AT", "0")
+    reputationThrottle := getint("REPUTATION_THROTTLE_AT", "0")
+    reputationBan := getint("REPUTATION_BAN_AT", "0")
+    reputationBanMs := getint("REPUTATION_BAN_MS", "3600000")
+    reputationStore := getenv("REPUTATION_STORE", "")
+    storeCompactInterval := getint("STORE_COMPACT_INTERVAL_MS", "21600000")
+    storeCompactFragmentation := getint("STORE_COMPACT_FRAGMENTATION_PCT", "20")
+    hubKey := getenv("HUB_KEY", "")
+    hubKeyPins := getenv("HUB_KEY_PINS", "")
+    pinnedHubKeys := getenv("PINNED_HUB_KEYS", "")
+    requireSignedMesh := getbool("REQUIRE_SIGNED_MESH", "false")
+    monitorToken := getenv("MONITOR_TOKEN", "")
+    monitorNetworks := getenv("MONITOR_NETWORKS", "")
+    guestLinkSecret := getenv("GUEST_LINK_SECRET", "")
+    guestRate := *live.GuestRatePerSec
+    signalRouteTTL := getint("SIGNAL_ROUTE_TTL_MS", "600000")
+    transformsStore := getenv("TRANSFORMS_STORE", "")
+    writeQueue := getint("WRITE_QUEUE_SIZE", "1024")
+    writeTimeout := getint("WRITE_TIMEOUT_MS", "10000")
+    slowConsumer := getenv("SLOW_CONSUMER_POLICY", "disconnect")
+    fanoutWorkers := getint("FANOUT_WORKERS", "4")
+    fanoutMinPeers := getint("FANOUT_MIN_PEERS", "64")
+    fanoutQueue := getint("FANOUT_QUEUE_SIZE", "256")
+    peerIdPattern := getenv("PEER_ID_PATTERN", "")
+    peerIdMin := getint("PEER_ID_MIN_LENGTH", "0")
+    peerIdMax := getint("PEER_ID_MAX_LENGTH", "256")
+    pollJournal := getenv("POLL_JOURNAL", "")
+    pollJournalMax := getint("POLL_JOURNAL_MAX_BYTES", "262144")
+    pollJournalRetention := getint("POLL_JOURNAL_RETENTION_MS", "300000")
+    powDifficulty := getint("POW_DIFFICULTY", "0")
+    powTTL := getint("POW_CHALLENGE_TTL_MS", "60000")
+    stateStore := getenv("STATE_STORE", "")
+    statePersist := getint("STATE_PERSIST_INTERVAL_MS", "30000")
+    stateMaxAge := getint("STATE_MAX_AGE_MS", "600000")
+    stateSeeds := getenv("STATE_SEED_KEYS", "")
+    maxRooms := getint("MAX_ROOMS_PER_PEER", "32")
+    peerMessageMax := getint("PEER_MESSAGE_MAX_BYTES", "65536")
+    peerMessageRate := *live.PeerMessageRatePerSec
+    analyticsStore := getenv("ANALYTICS_STORE", "")
+    pingInterval := getint("PING_INTERVAL_MS", "25000")
+    maxMissedPongs := getint("MAX_MISSED_PONGS", "2")
+    peerTimeout := getint("PEER_TIMEOUT_MS", "300000")
+    analyticsRetention := getint("ANALYTICS_RETENTION_MS", "2592000000")
+    requireHubApproval := getbool("REQUIRE_HUB_APPROVAL", "false")
+    hubAutoApproveKeys := getenv("HUB_AUTO_APPROVE_KEYS", "")
+    hubAutoApproveNamespaces := getenv("HUB_AUTO_APPROVE_NAMESPACES", "")
+    hubApprovalStore := getenv("HUB_APPROVAL_STORE", "")
+    iceServers, err := parseICEServers(getenv("ICE_SERVERS", ""))
+    if err != nil {
+        configProblems = append(configProblems, "ICE_SERVERS: "+err.Error())
+    }
+    turnSecret := getenv("TURN_SECRET", "")
+    turnTTL := getint("TURN_CREDENTIAL_TTL_MS", "86400000")
+    jwtSecret := getenv("JWT_SECRET", "")
+    jwtPublicKey := ""
+    if path := getenv("JWT_PUBLIC_KEY_FILE", ""); path != "" {
+        if b, err := os.ReadFile(path); err != nil {
+            configProblems = append(configProblems, "JWT_PUBLIC_KEY_FILE: "+err.Error())
+        } else {
+            jwtPublicKey = string(b)
+        }
+    }
+    jwksURL := getenv("JWKS_URL", "")
+    jwksRefresh := getint("JWKS_REFRESH_MS", "600000")
+    jwtIssuer := getenv("JWT_ISSUER", "")
+    jwtAudience := getenv("JWT_AUDIENCE", "")
+    jwtPeerIdClaim := getenv("JWT_PEER_ID_CLAIM", "sub")
+    jwtNetworksClaim := getenv("JWT_NETWORKS_CLAIM", "networks")
+    storeBackend := getenv("STORE_BACKEND", "file")
+    storeURL := getenv("STORE_URL", "")
+    logLevel, ok := logging.ParseLevel(*live.LogLevel)
+    if ok {
+        logging.SetLevel(logLevel)
+    } else {
+        configProblems = append(configProblems, "LOG_LEVEL: must be debug, info, warn or error")
+    }
+    if problems := checkConfig(); len(problems) > 0 {
+        log.Fatalf("config error:\n  %s", strings.Join(problems, "\n  "))
+    }
+    backend, err := openStore(storeBackend, storeURL)
+    if err != nil {
+        log.Fatalf("store error: %v", err)
+    }
 
-    port, _ := strconv.Atoi(portStr)
-    maxConn, _ := strconv.Atoi(maxConnStr)
-    isHub := strings.ToLower(isHubStr) == "true"
-
-    s := server.NewServer(server.Options{
+    opts := server.Options{
         Port:                port,
         Host:                host,
         MaxConnections:      maxConn,
@@ -39,22 +192,263 @@ func main() {
         HubMeshNamespace:    hubNs,
         BootstrapHubs:       splitNonEmpty(bootstrap, ","),
         CleanupIntervalMs:   30000,
-        PeerTimeoutMs:       300000,
+        PeerTimeoutMs:       peerTimeout,
         MaxMessageBytes:     1048576,
         MaxPortRetries:      10,
-        VerboseLogging:      false,
+        VerboseLogging:      logLevel == logging.DEBUG,
         ReconnectIntervalMs: 5000,
         MaxReconnectAttempts: 10,
         AuthToken:           authToken,
-    })
-
-    if err := s.Start(); err != nil {
-        log.Fatalf("start error: %v", err)
+        AdminToken:          adminToken,
+        BootstrapHealthCheck: healthCheck,
+        IdentityStorePath:   identityStore,
+        MaxUpgradesPerSec:   maxUpgrades,
+        CompressThresholdBytes: compressThreshold,
+        BlobMaxBytes:        blobMax,
+        BlobQuotaBytes:      blobQuota,
+        AppBroadcastNetworks: splitNonEmpty(appBroadcastNets, ","),
+        AppBroadcastMaxBytes: appBroadcastMax,
+        AppBroadcastRatePerSec: appBroadcastRate,
+        EventReplaySize:     eventReplay,
+        HubRole:             hubRole,
+        MigrationSecret:     migrationSecret,
+        SignalingTimeoutMs:  signalingTimeout,
+        SignalDeadlineMs:    signalDeadline,
+        DataRetentionMs:     dataRetention,
+        CrossHubDiscoveryRatePerSec: discoveryRate,
+        IntegrationsStorePath: integrationsStore,
+        HubGossipQuotaPerSec: hubGossipQuota,
+        HubSignalingQuotaPerSec: hubSignalingQuota,
+        HubQuotaSuspendMs:   hubQuotaSuspend,
+        MeshToken:           meshToken,
+        AllowUnauthenticatedMesh: allowUnauthMesh,
+        MaxMeshConnections:  maxMeshConn,
+        MeshPathOnly:        meshPathOnly,
+        MeshCompression:     meshCompression,
+        MeshAutoDial:        meshAutoDial,
+        MeshMaxDialed:       meshMaxDialed,
+        PublicURL:           publicURL,
+        Listeners:           *live.Listeners,
+        MeshMaxHops:         meshMaxHops,
+        EventBridgeURL:      eventBridgeURL,
+        EventBridgeTopic:    eventBridgeTopic,
+        EventBridgeTopics:   splitNonEmpty(eventBridgeTopics, ","),
+        EventBridgeBatchSize: eventBridgeBatchSize,
+        EventBridgeFlushMs:  eventBridgeFlushMs,
+        EventBridgeQueueSize: eventBridgeQueueSize,
+        EventBridgeDelivery: eventBridgeDelivery,
+        BackplaneURL:        backplaneURL,
+        BackplanePrefix:     backplanePrefix,
+        BackplaneHeartbeatMs: backplaneHeartbeatMs,
+        GRPCAddr:            grpcAddr,
+        GRPCCertFile:        grpcCertFile,
+        GRPCKeyFile:         grpcKeyFile,
+        PeerIdleMs:          peerIdle,
+        DefaultNetwork:      defaultNetwork,
+        AllowedNetworks:     splitNonEmpty(allowedNetworks, ","),
+        MaxNetworks:         maxNetworks,
+        MaxPeersPerNetwork:  maxPeersPerNetwork,
+        ChangeFeedSize:      changeFeedSize,
+        MetricsStorePath:    metricsStore,
+        MetricsPersistIntervalMs: metricsPersistInterval,
+        MetricsMaxSeries:    metricsMaxSeries,
+        DisconnectDebounceMs: disconnectDebounce,
+        SameNetworkHints:    sameNetworkHints,
+        LegacyEnvelopeDefault: legacyEnvelope,
+        ShedCPUPercent:      shedCPU,
+        ShedQueueDepth:      shedQueue,
+        ReputationWarnAt:    reputationWarn,
+        ReputationThrottleAt: reputationThrottle,
+        ReputationBanAt:     reputationBan,
+        ReputationBanMs:     reputationBanMs,
+        ReputationStorePath: reputationStore,
+        StoreCompactIntervalMs: storeCompactInterval,
+        StoreCompactFragmentationPct: storeCompactFragmentation,
+        HubKeyPath:          hubKey,
+        HubKeyPinsPath:      hubKeyPins,
+        PinnedHubKeys:       splitNonEmpty(pinnedHubKeys, ","),
+        RequireSignedMesh:   requireSignedMesh,
+        MonitorToken:        monitorToken,
+        MonitorNetworks:     splitNonEmpty(monitorNetworks, ","),
+        GuestLinkSecret:     guestLinkSecret,
+        GuestRatePerSec:     guestRate,
+        SignalRouteTTLMs:    signalRouteTTL,
+        TransformsStorePath: transformsStore,
+        WriteQueueSize:      writeQueue,
+        WriteTimeoutMs:      writeTimeout,
+        SlowConsumerPolicy:  slowConsumer,
+        FanoutWorkers:       fanoutWorkers,
+        FanoutMinPeers:      fanoutMinPeers,
+        FanoutQueueSize:     fanoutQueue,
+        PeerIdPattern:       peerIdPattern,
+        PeerIdMinLength:     peerIdMin,
+        PeerIdMaxLength:     peerIdMax,
+        PollJournalPath:     pollJournal,
+        PollJournalMaxBytes: pollJournalMax,
+        PollJournalRetentionMs: pollJournalRetention,
+        PowDifficulty:       powDifficulty,
+        PowChallengeTTLMs:   powTTL,
+        Store:               backend,
+        StateStorePath:      stateStore,
+        StatePersistIntervalMs: statePersist,
+        StateMaxAgeMs:       stateMaxAge,
+        StateSeedKeys:       splitNonEmpty(stateSeeds, ","),
+        MaxRoomsPerPeer:     maxRooms,
+        PeerMessageMaxBytes: peerMessageMax,
+        PeerMessageRatePerSec: peerMessageRate,
+        AnalyticsStorePath:  analyticsStore,
+        AnalyticsRetentionMs: analyticsRetention,
+        PingIntervalMs:      pingInterval,
+        MaxMissedPongs:      maxMissedPongs,
+        HubApprovalRequired: requireHubApproval,
+        HubAutoApproveKeys:  splitNonEmpty(hubAutoApproveKeys, ","),
+        HubAutoApproveNamespaces: splitNonEmpty(hubAutoApproveNamespaces, ","),
+        HubApprovalStorePath: hubApprovalStore,
+        ICEServers:          iceServers,
+        TURNSecret:          turnSecret,
+        TURNCredentialTTLMs: turnTTL,
+        JWTSecret:           jwtSecret,
+        JWTPublicKey:        jwtPublicKey,
+        JWKSURL:             jwksURL,
+        JWKSRefreshMs:       jwksRefresh,
+        JWTIssuer:           jwtIssuer,
+        JWTAudience:         jwtAudience,
+        JWTPeerIdClaim:      jwtPeerIdClaim,
+        JWTNetworksClaim:    jwtNetworksClaim,
+        MaxRSSMB:            maxRSS,
+        MaxHeapMB:           maxHeap,
+        MaxGoroutines:       maxGoroutines,
+        GuardrailWarnPercent: guardrailWarn,
+        NetworkACL:          networkACL,
+        ProtectedNetworks:   splitNonEmpty(protectedNetworks, ","),
     }
+    if err := opts.Validate(); err != nil {
+        log.Fatalf("config error: %v", err)
+    }
+    s := server.NewServer(opts)
 
+    // Start blocks while serving, so run it aside and stop cleanly (saving
+    // counters and telling peers) on SIGINT or SIGTERM. SIGHUP re-reads the
+    // settings that can change live.
+    errc := make(chan error, 1)
+    go func() { errc <- s.Start() }()
     c := make(chan os.Signal, 1)
-    <-c
-    _ = s.Stop()
+    signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    for {
+        select {
+        case err := <-errc:
+            log.Fatalf("start error: %v", err)
+        case <-hup:
+            reload(s, *configPath)
+        case <-c:
+            _ = s.Stop()
+            return
+        }
+    }
+}
+
+// liveSettings reads the settings the hub can change without a restart.
+func liveSettings() server.ConfigUpdate {
+    maxConn := getint("MAX_CONNECTIONS", "1000")
+    maxUpgrades := getint("MAX_UPGRADES_PER_SEC", "0")
+    appBroadcastRate := getint("APP_BROADCAST_RATE_PER_SEC", "10")
+    peerMessageRate := getint("PEER_MESSAGE_RATE_PER_SEC", "20")
+    guestRate := getint("GUEST_RATE_PER_SEC", "10")
+    logLevel := getenv("LOG_LEVEL", "info")
+    listeners, err := parseListeners(getenv("LISTENERS", ""))
+    if err != nil {
+        configProblems = append(configProblems, "LISTENERS: "+err.Error())
+    }
+    return server.ConfigUpdate{MaxConnections: &maxConn, MaxUpgradesPerSec: &maxUpgrades, AppBroadcastRatePerSec: &appBroadcastRate, PeerMessageRatePerSec: &peerMessageRate, GuestRatePerSec: &guestRate, LogLevel: &logLevel, Listeners: &listeners}
+}
+
+// reload re-reads the config file and applies the live settings. The
+// environment still wins over the file, so a setting fixed by a variable
+// keeps its value. A file that does not load or parse changes nothing.
+func reload(s *server.Server, configPath string) {
+    fileSettings, configProblems = map[string]string{}, nil
+    if configPath != "" {
+        if err := loadConfig(configPath); err != nil {
+            log.Printf("config reload failed: %v", err)
+            return
+        }
+    }
+    live := liveSettings()
+    if problems := checkConfig(); len(problems) > 0 {
+        log.Printf("config reload failed:\n  %s", strings.Join(problems, "\n  "))
+        return
+    }
+    if _, err := s.Reconfigure(live, "sighup", ""); err != nil {
+        log.Printf("config reload failed: %v", err)
+    }
+}
+
+// openStore returns the Store named by STORE_BACKEND, or nil for the
+// default file store.
+func openStore(backend, url string) (server.Store, error) {
+    switch backend {
+    case "", "file":
+        return nil, nil
+    case "bolt":
+        return store.OpenBolt(url)
+    case "redis":
+        return store.DialRedis(url)
+    }
+    return nil, errors.New("unknown STORE_BACKEND " + backend)
+}
+
+// parseICEServers reads ICE_SERVERS: either a JSON array of RTCIceServer
+// objects or comma-separated URLs, one server each.
+func parseICEServers(v string) ([]server.ICEServer, error) {
+    v = strings.TrimSpace(v)
+    if strings.HasPrefix(v, "[") {
+        var list []server.ICEServer
+        err := json.Unmarshal([]byte(v), &list)
+        return list, err
+    }
+    var list []server.ICEServer
+    for _, u := range splitNonEmpty(v, ",") {
+        list = append(list, server.ICEServer{URLs: []string{u}})
+    }
+    return list, nil
+}
+
+// parseListeners reads LISTENERS: either a JSON array of listeners or
+// comma-separated name=addr entries, each optionally followed by
+// ;role=..., ;cert=... and ;key=..., e.g.
+// "tls=:8443;cert=/etc/hub.crt;key=/etc/hub.key,mesh=:9000;role=mesh".
+func parseListeners(v string) ([]server.Listener, error) {
+    v = strings.TrimSpace(v)
+    list := []server.Listener{}
+    if strings.HasPrefix(v, "[") {
+        err := json.Unmarshal([]byte(v), &list)
+        return list, err
+    }
+    for _, entry := range splitNonEmpty(v, ",") {
+        fields := strings.Split(entry, ";")
+        name, addr, ok := strings.Cut(fields[0], "=")
+        if !ok {
+            return nil, errors.New("expected name=addr, got " + fields[0])
+        }
+        l := server.Listener{Name: strings.TrimSpace(name), Addr: strings.TrimSpace(addr)}
+        for _, f := range fields[1:] {
+            k, val, _ := strings.Cut(f, "=")
+            switch strings.TrimSpace(k) {
+            case "role":
+                l.Role = strings.TrimSpace(val)
+            case "cert":
+                l.CertFile = strings.TrimSpace(val)
+            case "key":
+                l.KeyFile = strings.TrimSpace(val)
+            default:
+                return nil, errors.New("unknown listener setting " + f)
+            }
+        }
+        list = append(list, l)
+    }
+    return list, nil
 }
 
 func splitNonEmpty(s, sep string) []string {
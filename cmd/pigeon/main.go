@@ -0,0 +1,783 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const usage = `Usage: pigeon admin [flags] <command> [args]
+
+Commands:
+  peers [network]          list connected peers
+  kick <peerId> [reason]   disconnect a peer
+  debug <peerId> [on|off] [duration]
+                           log one peer's traffic at debug level (10m if
+                           no duration is given)
+  networks [network]       list networks and peer counts, or one network's
+                           local members and cached remote peers
+  topology                 show hub mesh connections
+  members                  list the hubs in this hub's mesh membership table
+  listeners | listeners add <name> <addr> [all|client|mesh] [certFile keyFile]
+  listeners rm <name>      list, open and close the hub's extra listeners
+  maintenance [on|off]     show or toggle maintenance mode
+  rotate-token [token]     replace the peer auth token (random if omitted)
+  audit [-f]               print the audit log; -f keeps following it
+  goroutines               show tracked goroutines and suspected leaks
+  tail [--filter key=value]...
+                           stream live hub logs and events; keys are
+                           level, event, peerId and network
+  drain <url>... [-window 60s] | drain status | drain cancel
+                           hand peers off to other hubs before a restart
+  integrations [network] | integrations add <network> <webhook|bridge|authorizer> <url> [event...]
+  integrations rm <id>     manage per-network integration endpoints
+  erase <peerId> | erase status <eraseId>
+                           purge a peer from every hub and show the report
+  reputation               list peer scores and bans
+  ban <peerId|ip|cidr> [duration] [reason]
+                           ban a peer or address (for duration, e.g. 24h;
+                           forever if omitted)
+  pardon <peerId|ip|cidr>  lift a ban and clear the peer's score
+  store [compact]          show store size and fragmentation, or compact it now
+  hub-keys [unpin <link>]  list pinned hub keys, or forget one learned on first contact
+  hubs [approve|reject|forget <hubPeerId> [note]]
+                           list hubs waiting to join the mesh and decide on them
+  guests | guests add [network] [ttl] [maxPeers] | guests rm <id>
+                           mint, list and revoke time-limited guest links
+  transforms [set <file>]  show per-network message transforms, or replace
+                           them with the JSON list in file
+  bulk disconnect <network> | bulk purge-cache <network> | bulk rotate-guests
+                           act on a whole network or every guest link; add
+                           --dry-run to only list what would be affected
+  analytics <peak-peers|session-duration|signaling-success> [window] [network] [--hourly]
+                           query history, e.g. peak peers over the last 7d
+  config [key=value]...    show the options that can change live, or change
+                           them, e.g. config maxConnections=2000 logLevel=debug
+  cache [network] | cache clear [network]
+                           show or clear remote peers cached from other hubs
+
+Flags:
+`
+
+type client struct {
+	base  string
+	token string
+	http  http.Client
+}
+
+func (c *client) do(method, path string, body interface{}) (map[string]interface{}, error) {
+	var r io.Reader
+	if body != nil {
+		b, _ := json.Marshal(body)
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.base+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var out map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("%s %s: status %d", method, path, res.StatusCode)
+	}
+	if res.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s: %v", method, path, out["error"])
+	}
+	return out, nil
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "admin" {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	hub := fs.String("hub", envOr("PIGEON_HUB", "http://localhost:8080"), "hub base URL")
+	token := fs.String("token", os.Getenv("PIGEON_ADMIN_TOKEN"), "admin token (ADMIN_TOKEN on the hub)")
+	jsonOut := fs.Bool("json", false, "print raw JSON instead of tables")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[2:])
+	args := fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c := &client{base: strings.TrimSuffix(*hub, "/") + "/admin", token: *token, http: http.Client{Timeout: 10 * time.Second}}
+	if err := run(c, args, *jsonOut); err != nil {
+		fmt.Fprintf(os.Stderr, "pigeon: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(c *client, args []string, jsonOut bool) error {
+	var (
+		out map[string]interface{}
+		err error
+	)
+	switch args[0] {
+	case "peers":
+		path := "/peers"
+		if len(args) > 1 {
+			path += "?network=" + url.QueryEscape(args[1])
+		}
+		if out, err = c.do("GET", path, nil); err == nil && !jsonOut {
+			return printTable(out["peers"], "peerId", "networkName", "isHub", "remoteAddress", "clientVersion", "lastActivity")
+		}
+	case "kick":
+		if len(args) < 2 {
+			return fmt.Errorf("kick requires a peerId")
+		}
+		path := "/peers/" + url.PathEscape(args[1])
+		if len(args) > 2 {
+			path += "?reason=" + url.QueryEscape(strings.Join(args[2:], " "))
+		}
+		out, err = c.do("DELETE", path, nil)
+	case "debug":
+		if len(args) < 2 {
+			return fmt.Errorf("debug requires a peerId")
+		}
+		body := map[string]interface{}{"enabled": true}
+		for _, a := range args[2:] {
+			if a == "on" || a == "off" {
+				body["enabled"] = a == "on"
+			} else if d, perr := time.ParseDuration(a); perr == nil {
+				body["durationMs"] = d.Milliseconds()
+			} else {
+				return fmt.Errorf("debug takes on, off or a duration")
+			}
+		}
+		out, err = c.do("PUT", "/peers/"+url.PathEscape(args[1])+"/debug", body)
+	case "networks":
+		if len(args) > 1 {
+			if out, err = c.do("GET", "/networks/"+args[1], nil); err == nil && !jsonOut {
+				if err := printTable(out["local"], "peerId", "isHub", "remoteAddress", "clientVersion", "data"); err != nil {
+					return err
+				}
+				fmt.Println("\nCached from other hubs:")
+				return printMap(out["remote"])
+			}
+			break
+		}
+		if out, err = c.do("GET", "/networks", nil); err == nil && !jsonOut {
+			return printTable(out["networks"], "name", "peers")
+		}
+	case "topology":
+		if out, err = c.do("GET", "/topology", nil); err == nil && !jsonOut {
+			fmt.Printf("hub %v (version %v)\n\nInbound hubs:\n", out["hubPeerId"], out["version"])
+			if err := printTable(out["hubs"], "PeerId", "Version", "SharedFeatures", "LastActivity"); err != nil {
+				return err
+			}
+			fmt.Println("\nBootstrap hubs:")
+			return printTable(out["bootstrapHubs"], "uri", "connected", "version", "sharedFeatures", "incompatible")
+		}
+	case "members":
+		if out, err = c.do("GET", "/mesh-members", nil); err == nil && !jsonOut {
+			fmt.Printf("hub %v (%v)\n\n", out["hubPeerId"], cell(out["url"]))
+			return printTable(out["members"], "hubId", "url", "source", "linked", "dialed", "lastSeen")
+		}
+	case "maintenance":
+		if len(args) < 2 {
+			out, err = c.do("GET", "/maintenance", nil)
+			break
+		}
+		switch args[1] {
+		case "on", "off":
+			out, err = c.do("POST", "/maintenance", map[string]bool{"enabled": args[1] == "on"})
+		default:
+			return fmt.Errorf("maintenance takes on or off")
+		}
+	case "rotate-token":
+		body := map[string]string{}
+		if len(args) > 1 {
+			body["token"] = args[1]
+		}
+		out, err = c.do("POST", "/token", body)
+	case "goroutines":
+		if out, err = c.do("GET", "/goroutines", nil); err == nil && !jsonOut {
+			fmt.Printf("total goroutines: %v\ntracked: %s\n\nSuspected leaks:\n", out["total"], cell(out["tracked"]))
+			return printTable(out["leaks"], "kind", "owner", "reason", "firstSeen")
+		}
+	case "drain":
+		return drain(c, args[1:])
+	case "integrations":
+		return integrations(c, args[1:], jsonOut)
+	case "listeners":
+		return listeners(c, args[1:], jsonOut)
+	case "erase":
+		switch {
+		case len(args) > 2 && args[1] == "status":
+			out, err = c.do("GET", "/erase/"+url.PathEscape(args[2]), nil)
+		case len(args) == 2:
+			out, err = c.do("POST", "/erase/"+url.PathEscape(args[1]), nil)
+		default:
+			return fmt.Errorf("erase requires a peerId")
+		}
+	case "hub-links":
+		if len(args) > 2 && args[1] == "resume" {
+			out, err = c.do("POST", "/hub-links/resume", map[string]string{"link": args[2]})
+			break
+		}
+		if out, err = c.do("GET", "/hub-links", nil); err == nil && !jsonOut {
+			return printTable(out["links"], "link", "suspended", "throttled", "dropped", "suspensions", "lastSeen")
+		}
+	case "reputation":
+		if out, err = c.do("GET", "/reputation", nil); err == nil && !jsonOut {
+			if err := printTable(out["peers"], "peerId", "score", "level", "offences"); err != nil {
+				return err
+			}
+			fmt.Println("\nBans:")
+			return printTable(out["bans"], "peerId", "ip", "reason", "bannedAt", "until")
+		}
+	case "ban":
+		if len(args) < 2 {
+			return fmt.Errorf("ban requires a peerId or address")
+		}
+		body := map[string]interface{}{}
+		rest := args[2:]
+		if len(rest) > 0 {
+			if d, perr := time.ParseDuration(rest[0]); perr == nil {
+				body["durationMs"] = d.Milliseconds()
+				rest = rest[1:]
+			}
+		}
+		if len(rest) > 0 {
+			body["reason"] = strings.Join(rest, " ")
+		}
+		if isAddress(args[1]) {
+			body["ip"] = args[1]
+			out, err = c.do("POST", "/ip-bans", body)
+			break
+		}
+		out, err = c.do("POST", "/reputation/"+url.PathEscape(args[1])+"/ban", body)
+	case "pardon":
+		if len(args) < 2 {
+			return fmt.Errorf("pardon requires a peerId or address")
+		}
+		if isAddress(args[1]) {
+			out, err = c.do("DELETE", "/ip-bans?ip="+url.QueryEscape(args[1]), nil)
+			break
+		}
+		out, err = c.do("DELETE", "/reputation/"+url.PathEscape(args[1]), nil)
+	case "store":
+		if len(args) > 1 && args[1] == "compact" {
+			out, err = c.do("POST", "/store/compact", nil)
+			break
+		}
+		out, err = c.do("GET", "/store", nil)
+	case "guests":
+		if len(args) > 1 && args[1] == "add" {
+			body := map[string]interface{}{}
+			rest := args[2:]
+			if len(rest) > 0 {
+				body["network"] = rest[0]
+			}
+			if len(rest) > 1 {
+				d, perr := time.ParseDuration(rest[1])
+				if perr != nil {
+					return fmt.Errorf("invalid ttl %q", rest[1])
+				}
+				body["ttlMs"] = d.Milliseconds()
+			}
+			if len(rest) > 2 {
+				n, perr := strconv.Atoi(rest[2])
+				if perr != nil {
+					return fmt.Errorf("invalid maxPeers %q", rest[2])
+				}
+				body["maxPeers"] = n
+			}
+			out, err = c.do("POST", "/guest-links", body)
+			break
+		}
+		if len(args) > 2 && args[1] == "rm" {
+			out, err = c.do("DELETE", "/guest-links/"+url.PathEscape(args[2]), nil)
+			break
+		}
+		if out, err = c.do("GET", "/guest-links", nil); err == nil && !jsonOut {
+			return printTable(out["links"], "id", "network", "expiresAt", "maxPeers", "activePeers", "revoked")
+		}
+	case "hub-keys":
+		if len(args) > 2 && args[1] == "unpin" {
+			out, err = c.do("DELETE", "/hub-keys?link="+url.QueryEscape(args[2]), nil)
+			break
+		}
+		if out, err = c.do("GET", "/hub-keys", nil); err == nil && !jsonOut {
+			fmt.Printf("hubPeerId: %v\nhubKey:    %v\n\n", out["hubPeerId"], out["hubKey"])
+			return printTable(out["pins"], "link", "hubKey", "source")
+		}
+	case "hubs":
+		if len(args) > 2 && (args[1] == "approve" || args[1] == "reject") {
+			body := map[string]interface{}{"approve": args[1] == "approve", "note": strings.Join(args[3:], " ")}
+			out, err = c.do("POST", "/hub-approvals/"+url.PathEscape(args[2]), body)
+			break
+		}
+		if len(args) > 2 && args[1] == "forget" {
+			out, err = c.do("DELETE", "/hub-approvals/"+url.PathEscape(args[2]), nil)
+			break
+		}
+		if out, err = c.do("GET", "/hub-approvals", nil); err == nil && !jsonOut {
+			return printTable(out["hubs"], "hubPeerId", "state", "networkName", "hubKey", "requestedAt", "decidedBy")
+		}
+	case "bulk":
+		return bulk(c, args[1:], jsonOut)
+	case "analytics":
+		return analytics(c, args[1:], jsonOut)
+	case "transforms":
+		if len(args) > 2 && args[1] == "set" {
+			b, rerr := os.ReadFile(args[2])
+			if rerr != nil {
+				return rerr
+			}
+			var list []interface{}
+			if rerr := json.Unmarshal(b, &list); rerr != nil {
+				return fmt.Errorf("%s: %v", args[2], rerr)
+			}
+			out, err = c.do("PUT", "/transforms", map[string]interface{}{"transforms": list})
+			break
+		}
+		out, err = c.do("GET", "/transforms", nil)
+	case "config":
+		if len(args) == 1 {
+			out, err = c.do("GET", "/config", nil)
+			break
+		}
+		body := map[string]interface{}{}
+		for _, kv := range args[1:] {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok {
+				return fmt.Errorf("expected key=value, got %q", kv)
+			}
+			if n, nerr := strconv.Atoi(v); nerr == nil {
+				body[k] = n
+			} else {
+				body[k] = v
+			}
+		}
+		out, err = c.do("POST", "/config", body)
+	case "cache":
+		method, rest := "GET", args[1:]
+		if len(rest) > 0 && rest[0] == "clear" {
+			method, rest = "DELETE", rest[1:]
+		}
+		path := "/cache"
+		if len(rest) > 0 {
+			path += "?network=" + url.QueryEscape(rest[0])
+		}
+		if out, err = c.do(method, path, nil); err == nil && !jsonOut && method == "GET" {
+			if len(rest) > 0 {
+				return printMap(out["peers"])
+			}
+			fmt.Printf("%v cached remote peers\n", out["total"])
+			return printMap(out["networks"])
+		}
+	case "tail":
+		return tail(c, args[1:], jsonOut)
+	case "audit":
+		follow := len(args) > 1 && args[1] == "-f"
+		return tailAudit(c, follow, jsonOut)
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(out)
+}
+
+func drain(c *client, args []string) error {
+	if len(args) == 0 || args[0] == "status" {
+		out, err := c.do("GET", "/drain", nil)
+		if err != nil {
+			return err
+		}
+		return printJSON(out)
+	}
+	if args[0] == "cancel" {
+		out, err := c.do("DELETE", "/drain", nil)
+		if err != nil {
+			return err
+		}
+		return printJSON(out)
+	}
+	fs := flag.NewFlagSet("drain", flag.ContinueOnError)
+	window := fs.Duration("window", time.Minute, "spread reconnect instructions over this long")
+	alternates := []string{}
+	for len(args) > 0 {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		alternates = append(alternates, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	out, err := c.do("POST", "/drain", map[string]interface{}{"alternates": alternates, "windowMs": window.Milliseconds()})
+	if err != nil {
+		return err
+	}
+	return printJSON(out)
+}
+
+func integrations(c *client, args []string, jsonOut bool) error {
+	var (
+		out map[string]interface{}
+		err error
+	)
+	switch {
+	case len(args) > 0 && args[0] == "add":
+		if len(args) < 4 {
+			return fmt.Errorf("integrations add requires <network> <kind> <url>")
+		}
+		out, err = c.do("POST", "/integrations", map[string]interface{}{"networkName": args[1], "kind": args[2], "url": args[3], "events": args[4:]})
+	case len(args) > 0 && args[0] == "rm":
+		if len(args) < 2 {
+			return fmt.Errorf("integrations rm requires an id")
+		}
+		out, err = c.do("DELETE", "/integrations/"+url.PathEscape(args[1]), nil)
+	default:
+		path := "/integrations"
+		if len(args) > 0 {
+			path += "?network=" + url.QueryEscape(args[0])
+		}
+		if out, err = c.do("GET", path, nil); err == nil && !jsonOut {
+			return printTable(out["integrations"], "id", "networkName", "kind", "url", "events")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(out)
+}
+
+func listeners(c *client, args []string, jsonOut bool) error {
+	var (
+		out map[string]interface{}
+		err error
+	)
+	switch {
+	case len(args) > 0 && args[0] == "add":
+		if len(args) < 3 || len(args) == 5 || len(args) > 6 {
+			return fmt.Errorf("listeners add requires <name> <addr> [role] [certFile keyFile]")
+		}
+		body := map[string]string{"name": args[1], "addr": args[2]}
+		if len(args) > 3 {
+			body["role"] = args[3]
+		}
+		if len(args) == 6 {
+			body["certFile"], body["keyFile"] = args[4], args[5]
+		}
+		out, err = c.do("POST", "/listeners", body)
+	case len(args) > 0 && args[0] == "rm":
+		if len(args) < 2 {
+			return fmt.Errorf("listeners rm requires a name")
+		}
+		out, err = c.do("DELETE", "/listeners/"+url.PathEscape(args[1]), nil)
+	default:
+		if out, err = c.do("GET", "/listeners", nil); err == nil && !jsonOut {
+			return printTable(out["listeners"], "name", "addr", "role", "tls", "source", "requests", "upgrades")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(out)
+}
+
+func bulk(c *client, args []string, jsonOut bool) error {
+	dryRun := false
+	rest := []string{}
+	for _, a := range args {
+		if a == "--dry-run" || a == "-n" {
+			dryRun = true
+			continue
+		}
+		rest = append(rest, a)
+	}
+	if len(rest) == 0 {
+		return fmt.Errorf("bulk requires disconnect, purge-cache or rotate-guests")
+	}
+	var path string
+	body := map[string]interface{}{}
+	switch rest[0] {
+	case "disconnect", "purge-cache":
+		if len(rest) < 2 {
+			return fmt.Errorf("bulk %s requires a network", rest[0])
+		}
+		path, body["network"] = "/bulk/"+rest[0], rest[1]
+		if len(rest) > 2 {
+			body["reason"] = strings.Join(rest[2:], " ")
+		}
+	case "rotate-guests":
+		path = "/bulk/rotate-guest-links"
+	default:
+		return fmt.Errorf("unknown bulk action %q", rest[0])
+	}
+	if dryRun {
+		path += "?dryRun=true"
+	}
+	out, err := c.do("POST", path, body)
+	if err != nil {
+		return err
+	}
+	if !jsonOut && rest[0] != "rotate-guests" {
+		verb := "affected"
+		if dryRun {
+			verb = "would be affected"
+		}
+		fmt.Printf("%v %s:\n", out["count"], verb)
+		if ids, ok := out["affected"].([]interface{}); ok {
+			for _, id := range ids {
+				fmt.Println("  " + cell(id))
+			}
+		}
+		return nil
+	}
+	return printJSON(out)
+}
+
+func analytics(c *client, args []string, jsonOut bool) error {
+	q := url.Values{}
+	rest := []string{}
+	for _, a := range args {
+		if a == "--hourly" {
+			q.Set("step", "hour")
+			continue
+		}
+		rest = append(rest, a)
+	}
+	if len(rest) == 0 {
+		return fmt.Errorf("analytics requires peak-peers, session-duration or signaling-success")
+	}
+	if len(rest) > 1 {
+		q.Set("window", rest[1])
+	}
+	if len(rest) > 2 {
+		q.Set("network", rest[2])
+	}
+	out, err := c.do("GET", "/analytics/"+url.PathEscape(rest[0])+"?"+q.Encode(), nil)
+	if err != nil || jsonOut {
+		if err == nil {
+			err = printJSON(out)
+		}
+		return err
+	}
+	// Readable times and percentages; cell prints bare numbers.
+	series, _ := out["series"].([]interface{})
+	for _, r := range series {
+		m, _ := r.(map[string]interface{})
+		if start, ok := m["start"].(float64); ok {
+			m["start"] = time.UnixMilli(int64(start)).Format("2006-01-02 15:04")
+		}
+		if rate, ok := m["rate"].(float64); ok {
+			m["rate"] = fmt.Sprintf("%.1f%%", rate*100)
+		}
+	}
+	switch rest[0] {
+	case "peak-peers":
+		return printTable(series, "start", "peaks")
+	case "session-duration":
+		return printTable(series, "start", "sessions", "avgMs")
+	default:
+		return printTable(series, "start", "completed", "failed", "rate")
+	}
+}
+
+func tailAudit(c *client, follow, jsonOut bool) error {
+	var since int64
+	for {
+		out, err := c.do("GET", fmt.Sprintf("/audit?since=%d", since), nil)
+		if err != nil {
+			return err
+		}
+		entries, _ := out["entries"].([]interface{})
+		for _, e := range entries {
+			m, _ := e.(map[string]interface{})
+			if seq, ok := m["seq"].(float64); ok {
+				since = int64(seq)
+			}
+			if jsonOut {
+				b, _ := json.Marshal(m)
+				fmt.Println(string(b))
+				continue
+			}
+			ts, _ := m["timestamp"].(float64)
+			details, _ := json.Marshal(m["details"])
+			fmt.Printf("%s  %-14v %-16v %s\n", time.UnixMilli(int64(ts)).Format(time.RFC3339), m["action"], m["remote"], details)
+		}
+		if !follow {
+			return nil
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// tail streams /admin/tail until the hub closes the connection or the user
+// interrupts. Filters are applied on the hub.
+func tail(c *client, args []string, jsonOut bool) error {
+	q := url.Values{}
+	for i := 0; i < len(args); i++ {
+		kv := strings.TrimPrefix(strings.TrimPrefix(args[i], "--filter="), "-filter=")
+		if args[i] == "--filter" || args[i] == "-filter" {
+			if i+1 >= len(args) {
+				return fmt.Errorf("--filter needs key=value")
+			}
+			i++
+			kv = args[i]
+		}
+		k, v, ok := strings.Cut(kv, "=")
+		switch {
+		case !ok:
+			return fmt.Errorf("filter %q is not key=value", kv)
+		case k != "level" && k != "event" && k != "peerId" && k != "network":
+			return fmt.Errorf("unknown filter %q (want level, event, peerId or network)", k)
+		case k == "event" && q.Get("event") != "":
+			q.Set("event", q.Get("event")+","+v)
+		default:
+			q.Set(k, v)
+		}
+	}
+	u := "ws" + strings.TrimPrefix(c.base, "http") + "/tail"
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	conn, res, err := websocket.DefaultDialer.Dial(u, http.Header{"Authorization": {"Bearer " + c.token}})
+	if err != nil {
+		if res != nil {
+			return fmt.Errorf("tail: status %d", res.StatusCode)
+		}
+		return err
+	}
+	defer conn.Close()
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return nil
+			}
+			return err
+		}
+		if jsonOut {
+			fmt.Println(string(data))
+			continue
+		}
+		var e struct {
+			Timestamp int64                  `json:"timestamp"`
+			Level     string                 `json:"level"`
+			Message   string                 `json:"message"`
+			Fields    map[string]interface{} `json:"fields"`
+		}
+		if json.Unmarshal(data, &e) != nil {
+			continue
+		}
+		keys := make([]string, 0, len(e.Fields))
+		for k := range e.Fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var b strings.Builder
+		for _, k := range keys {
+			fmt.Fprintf(&b, " %s=%s", k, cell(e.Fields[k]))
+		}
+		fmt.Printf("%s %-5s %s%s\n", time.UnixMilli(e.Timestamp).Format("15:04:05.000"), e.Level, e.Message, b.String())
+	}
+}
+
+func printTable(rows interface{}, cols ...string) error {
+	list, _ := rows.([]interface{})
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join(cols, "\t")))
+	for _, r := range list {
+		m, _ := r.(map[string]interface{})
+		vals := make([]string, len(cols))
+		for i, col := range cols {
+			vals[i] = cell(m[col])
+		}
+		fmt.Fprintln(w, strings.Join(vals, "\t"))
+	}
+	return w.Flush()
+}
+
+// printMap prints an object as two columns, key and value, sorted by key.
+func printMap(v interface{}) error {
+	m, _ := v.(map[string]interface{})
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s\t%s\n", k, cell(m[k]))
+	}
+	return w.Flush()
+}
+
+// isAddress reports whether s is an IP address or CIDR range rather than a
+// peer ID.
+func isAddress(s string) bool {
+	if _, _, err := net.ParseCIDR(s); err == nil {
+		return true
+	}
+	return net.ParseIP(s) != nil
+}
+
+func cell(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "-"
+	case float64:
+		return fmt.Sprintf("%.0f", t)
+	case map[string]interface{}:
+		parts := make([]string, 0, len(t))
+		for k, n := range t {
+			parts = append(parts, k+"="+cell(n))
+		}
+		sort.Strings(parts)
+		return strings.Join(parts, " ")
+	case []interface{}:
+		parts := make([]string, len(t))
+		for i, p := range t {
+			parts[i] = fmt.Sprint(p)
+		}
+		sort.Strings(parts)
+		return strings.Join(parts, ",")
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
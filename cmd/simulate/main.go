@@ -0,0 +1,425 @@
+// Command simulate runs a virtual PeerPigeon mesh in one process: N hubs in
+// a chosen topology and M SDK peers with churn and signaling workloads. It
+// reports end-to-end discovery and signaling latencies so topology changes
+// can be tried without deploying anything.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"peerpigeon/internal/server"
+	"peerpigeon/pkg/client"
+)
+
+type config struct {
+	hubs       int
+	topology   string
+	peers      int
+	duration   time.Duration
+	settle     time.Duration
+	churn      float64
+	signalRate float64
+	network    string
+	asJSON     bool
+	faults     *server.FaultOptions
+}
+
+// bootstrapsFor returns the hub indexes hub i dials for a topology.
+func bootstrapsFor(topology string, i, n int) []int {
+	switch topology {
+	case "chain":
+		if i > 0 {
+			return []int{i - 1}
+		}
+	case "ring":
+		if n > 2 || i > 0 {
+			return []int{(i + 1) % n}
+		}
+	case "full":
+		out := []int{}
+		for j := 0; j < i; j++ {
+			out = append(out, j)
+		}
+		return out
+	default: // star
+		if i > 0 {
+			return []int{0}
+		}
+	}
+	return nil
+}
+
+// latencies collects samples and summarizes them.
+type latencies struct {
+	samples []time.Duration
+}
+
+func (l *latencies) add(d time.Duration) { l.samples = append(l.samples, d) }
+
+func (l *latencies) summary() map[string]interface{} {
+	out := map[string]interface{}{"count": len(l.samples)}
+	if len(l.samples) == 0 {
+		return out
+	}
+	s := append([]time.Duration(nil), l.samples...)
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	pct := func(p float64) float64 {
+		return float64(s[int(p*float64(len(s)-1))].Microseconds()) / 1000
+	}
+	out["p50_ms"] = pct(0.50)
+	out["p90_ms"] = pct(0.90)
+	out["p99_ms"] = pct(0.99)
+	out["max_ms"] = float64(s[len(s)-1].Microseconds()) / 1000
+	return out
+}
+
+type simPeer struct {
+	id       string
+	hub      int
+	joinedAt time.Time
+	c        *client.Client
+
+	mu    sync.Mutex
+	known map[string]bool
+}
+
+// sim holds the mesh, the live peers and the measurements.
+type sim struct {
+	cfg     config
+	hubURLs []string
+
+	mu          sync.Mutex
+	peers       map[string]*simPeer
+	announcedAt map[string]time.Time
+	hubOf       map[string]int
+	discLocal   latencies
+	discCross   latencies
+	signal      latencies
+	offersSent  int
+	joins       int
+	leaves      int
+	joinErrors  int
+}
+
+type probe struct {
+	Probe  string `json:"probe"`
+	SentAt int64  `json:"sentAt"`
+}
+
+func (s *sim) startHubs() {
+	lns := make([]net.Listener, s.cfg.hubs)
+	for i := range lns {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			log.Fatalf("listen: %v", err)
+		}
+		lns[i] = ln
+		s.hubURLs = append(s.hubURLs, fmt.Sprintf("ws://%s/ws", ln.Addr()))
+	}
+	for i, ln := range lns {
+		bootstrap := []string{}
+		for _, j := range bootstrapsFor(s.cfg.topology, i, s.cfg.hubs) {
+			bootstrap = append(bootstrap, s.hubURLs[j])
+		}
+		hub := server.NewServer(server.Options{
+			Host:                 "127.0.0.1",
+			MaxConnections:       s.cfg.peers*2 + s.cfg.hubs + 100,
+			CORSOrigin:           "*",
+			IsHub:                true,
+			HubMeshNamespace:     "pigeonhub-mesh",
+			BootstrapHubs:        bootstrap,
+			CleanupIntervalMs:    30000,
+			PeerTimeoutMs:        300000,
+			MaxMessageBytes:      1 << 20,
+			ReconnectIntervalMs:  1000,
+			MaxReconnectAttempts: 10,
+			SignalingTimeoutMs:   30000,
+			Faults:               s.cfg.faults,
+		})
+		go func(ln net.Listener) {
+			if err := hub.Serve(ln); err != nil {
+				log.Printf("hub stopped: %v", err)
+			}
+		}(ln)
+	}
+}
+
+// join connects a new peer to hub and starts reading its messages.
+func (s *sim) join(hub int) {
+	p := &simPeer{id: client.NewPeerId(), hub: hub, known: map[string]bool{}}
+	s.mu.Lock()
+	p.joinedAt = time.Now()
+	s.announcedAt[p.id] = p.joinedAt
+	s.hubOf[p.id] = hub
+	s.mu.Unlock()
+	c, err := client.Dial(s.hubURLs[hub], client.Options{PeerId: p.id, NetworkName: s.cfg.network})
+	if err != nil {
+		s.mu.Lock()
+		s.joinErrors++
+		s.mu.Unlock()
+		return
+	}
+	p.c = c
+	s.mu.Lock()
+	s.peers[p.id] = p
+	s.joins++
+	s.mu.Unlock()
+	go s.read(p)
+}
+
+func (s *sim) leave(p *simPeer) {
+	s.mu.Lock()
+	delete(s.peers, p.id)
+	s.leaves++
+	s.mu.Unlock()
+	p.c.Close()
+}
+
+func (s *sim) read(p *simPeer) {
+	for msg := range p.c.Messages() {
+		switch msg.Type {
+		case "peer-discovered":
+			var d struct {
+				PeerId string `json:"peerId"`
+			}
+			if json.Unmarshal(msg.Data, &d) == nil {
+				s.discovered(p, d.PeerId)
+			}
+		case "peer-list":
+			var d struct {
+				Peers []struct {
+					PeerId string `json:"peerId"`
+				} `json:"peers"`
+			}
+			if json.Unmarshal(msg.Data, &d) == nil {
+				for _, e := range d.Peers {
+					s.discovered(p, e.PeerId)
+				}
+			}
+		case "peer-disconnected":
+			if id, _, ok := msg.PeerDisconnected(); ok {
+				p.mu.Lock()
+				delete(p.known, id)
+				p.mu.Unlock()
+			}
+		case "offer":
+			var pr probe
+			if json.Unmarshal(msg.Data, &pr) == nil && pr.Probe != "" {
+				p.c.Signal("answer", msg.FromPeerId, pr)
+			}
+		case "answer":
+			var pr probe
+			if json.Unmarshal(msg.Data, &pr) == nil && pr.Probe != "" {
+				s.mu.Lock()
+				s.signal.add(time.Since(time.Unix(0, pr.SentAt)))
+				s.mu.Unlock()
+			}
+		}
+	}
+}
+
+// discovered records that p learned about id. Only peers that announced
+// after p joined count toward latency; the rest arrive in p's initial list.
+func (s *sim) discovered(p *simPeer, id string) {
+	if id == "" || id == p.id {
+		return
+	}
+	p.mu.Lock()
+	seen := p.known[id]
+	p.known[id] = true
+	p.mu.Unlock()
+	if seen {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	at, ok := s.announcedAt[id]
+	if !ok || at.Before(p.joinedAt) {
+		return
+	}
+	if s.hubOf[id] == p.hub {
+		s.discLocal.add(time.Since(at))
+	} else {
+		s.discCross.add(time.Since(at))
+	}
+}
+
+func (s *sim) randomPeer() *simPeer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.peers) == 0 {
+		return nil
+	}
+	n := rand.Intn(len(s.peers))
+	for _, p := range s.peers {
+		if n == 0 {
+			return p
+		}
+		n--
+	}
+	return nil
+}
+
+// sendOffer has a random peer send a probe offer to a peer it knows about.
+func (s *sim) sendOffer() {
+	p := s.randomPeer()
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	targets := make([]string, 0, len(p.known))
+	for id := range p.known {
+		targets = append(targets, id)
+	}
+	p.mu.Unlock()
+	if len(targets) == 0 {
+		return
+	}
+	target := targets[rand.Intn(len(targets))]
+	if p.c.Signal("offer", target, probe{Probe: client.NewPeerId()[:16], SentAt: time.Now().UnixNano()}) == nil {
+		s.mu.Lock()
+		s.offersSent++
+		s.mu.Unlock()
+	}
+}
+
+// every calls fn perSec times a second until done closes.
+func every(perSec float64, done <-chan struct{}, fn func()) {
+	if perSec <= 0 {
+		return
+	}
+	t := time.NewTicker(time.Duration(float64(time.Second) / perSec))
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			fn()
+		}
+	}
+}
+
+func (s *sim) run() map[string]interface{} {
+	s.startHubs()
+	time.Sleep(s.cfg.settle)
+	for i := 0; i < s.cfg.peers; i++ {
+		s.join(i % s.cfg.hubs)
+	}
+	done := make(chan struct{})
+	go every(s.cfg.churn, done, func() {
+		if p := s.randomPeer(); p != nil {
+			s.leave(p)
+		}
+		s.join(rand.Intn(s.cfg.hubs))
+	})
+	go every(s.cfg.signalRate, done, s.sendOffer)
+	time.Sleep(s.cfg.duration)
+	close(done)
+	// Give in-flight answers a moment before reporting.
+	time.Sleep(500 * time.Millisecond)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"hubs":     s.cfg.hubs,
+		"topology": s.cfg.topology,
+		"peers":    map[string]interface{}{"initial": s.cfg.peers, "live": len(s.peers), "joins": s.joins, "leaves": s.leaves, "joinErrors": s.joinErrors},
+		"discovery": map[string]interface{}{
+			"sameHub":  s.discLocal.summary(),
+			"crossHub": s.discCross.summary(),
+		},
+		"signaling": map[string]interface{}{
+			"offers":    s.offersSent,
+			"answered":  len(s.signal.samples),
+			"roundTrip": s.signal.summary(),
+		},
+	}
+}
+
+func printSummary(name string, v interface{}) {
+	m := v.(map[string]interface{})
+	if m["count"] == 0 {
+		fmt.Printf("  %-10s no samples\n", name)
+		return
+	}
+	fmt.Printf("  %-10s n=%-6v p50=%.1fms p90=%.1fms p99=%.1fms max=%.1fms\n", name, m["count"], m["p50_ms"], m["p90_ms"], m["p99_ms"], m["max_ms"])
+}
+
+func main() {
+	var cfg config
+	flag.IntVar(&cfg.hubs, "hubs", 3, "number of hubs")
+	flag.StringVar(&cfg.topology, "topology", "star", "hub topology: star, chain, ring or full")
+	flag.IntVar(&cfg.peers, "peers", 30, "initial number of peers, spread across hubs")
+	flag.DurationVar(&cfg.duration, "duration", 20*time.Second, "how long to run the workload")
+	flag.DurationVar(&cfg.settle, "settle", 3*time.Second, "time for hubs to mesh before peers join")
+	flag.Float64Var(&cfg.churn, "churn", 1, "peers replaced per second (0 disables churn)")
+	flag.Float64Var(&cfg.signalRate, "signal-rate", 5, "probe offers per second across all peers")
+	flag.StringVar(&cfg.network, "network", "sim", "network the peers join")
+	flag.BoolVar(&cfg.asJSON, "json", false, "print the report as JSON")
+	faults := flag.String("faults", "", "fault injection rules for every hub, as JSON or @file")
+	flag.Parse()
+	if cfg.hubs < 1 || cfg.peers < 0 {
+		log.Fatal("need at least one hub")
+	}
+	if *faults != "" {
+		var err error
+		if cfg.faults, err = loadFaults(*faults); err != nil {
+			log.Fatalf("faults: %v", err)
+		}
+	}
+	gin.SetMode(gin.ReleaseMode)
+
+	s := &sim{cfg: cfg, peers: map[string]*simPeer{}, announcedAt: map[string]time.Time{}, hubOf: map[string]int{}}
+	report := s.run()
+	if cfg.asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return
+	}
+	fmt.Printf("%d hubs (%s), peers %v\n", cfg.hubs, cfg.topology, report["peers"])
+	disc := report["discovery"].(map[string]interface{})
+	fmt.Println("discovery latency:")
+	printSummary("same hub", disc["sameHub"])
+	printSummary("cross hub", disc["crossHub"])
+	sig := report["signaling"].(map[string]interface{})
+	fmt.Printf("signaling: %v offers, %v answered\n", sig["offers"], sig["answered"])
+	printSummary("round trip", sig["roundTrip"])
+}
+
+// loadFaults reads -faults: a FaultOptions object, or a bare list of
+// rules, inline or from the file named after "@".
+func loadFaults(v string) (*server.FaultOptions, error) {
+	b := []byte(v)
+	if strings.HasPrefix(v, "@") {
+		var err error
+		if b, err = os.ReadFile(v[1:]); err != nil {
+			return nil, err
+		}
+	}
+	var opts server.FaultOptions
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		if err := json.Unmarshal(b, &opts.Rules); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(b, &opts); err != nil {
+		return nil, err
+	}
+	if err := (server.Options{Faults: &opts}).Validate(); err != nil {
+		return nil, err
+	}
+	return &opts, nil
+}
@@ -10,6 +10,11 @@ export PATH="/Users/danraeder/.fly/bin:$PATH"
 PIGEONHUB_B="${PIGEONHUB_B:-pigeonhub-b}"
 PIGEONHUB_C="${PIGEONHUB_C:-pigeonhub-c}"
 
+if [ -z "$MESH_TOKEN" ]; then
+    MESH_TOKEN="$(openssl rand -hex 32)"
+    echo "Generated MESH_TOKEN for the hub mesh (export it to reuse it for more hubs)"
+fi
+
 echo "Target apps:"
 echo "  Hub B (Bootstrap): $PIGEONHUB_B"
 echo "  Hub C (Secondary): $PIGEONHUB_C"
@@ -20,6 +25,7 @@ echo "Step 1: Deploying Bootstrap Hub ($PIGEONHUB_B)"
 echo "================================================"
 echo ""
 
+flyctl secrets set MESH_TOKEN="$MESH_TOKEN" --app "$PIGEONHUB_B" --stage
 flyctl deploy --app "$PIGEONHUB_B" --env IS_HUB=true --env HOST=0.0.0.0 --env PORT=8080
 
 echo ""
@@ -38,6 +44,7 @@ BOOTSTRAP_URL="ws://$PIGEONHUB_B.fly.dev:8080"
 echo "Bootstrap URL: $BOOTSTRAP_URL"
 echo ""
 
+flyctl secrets set MESH_TOKEN="$MESH_TOKEN" --app "$PIGEONHUB_C" --stage
 flyctl deploy --app "$PIGEONHUB_C" --env IS_HUB=true --env HOST=0.0.0.0 --env PORT=8080 --env BOOTSTRAP_HUBS="$BOOTSTRAP_URL"
 
 echo ""
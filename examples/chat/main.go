@@ -0,0 +1,231 @@
+// Command chat is a terminal chat room relayed entirely by a hub: members
+// join a room with subscribe, talk to it with room-broadcast and whisper to
+// one member with peer-message, so it works where WebRTC cannot connect.
+//
+//	go run ./examples/chat -hub ws://localhost:3000/ws -name alice
+//
+// Lines typed are sent to the room. "/msg <name> <text>" sends privately,
+// "/who" lists the room and "/quit" leaves.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"peerpigeon/pkg/client"
+)
+
+// chat is one member's connection to a room.
+type chat struct {
+	c    *client.Client
+	name string
+	room string
+
+	mu    sync.Mutex
+	out   io.Writer
+	names map[string]string
+}
+
+// chatLine is the payload of a room-broadcast or peer-message.
+type chatLine struct {
+	Name string `json:"name"`
+	Text string `json:"text"`
+}
+
+// join connects to hubURL as name, announces on network and subscribes to
+// room. Everything the room says is written to out until the chat is
+// closed.
+func join(hubURL, network, room, name string, out io.Writer) (*chat, error) {
+	c, err := client.Dial(hubURL, client.Options{NetworkName: network, AnnounceData: map[string]interface{}{"presence": map[string]interface{}{"displayName": name}}})
+	if err != nil {
+		return nil, err
+	}
+	ch := &chat{c: c, name: name, room: room, out: out, names: map[string]string{}}
+	if err := c.Send(client.Message{Type: "subscribe", NetworkName: network}, map[string]interface{}{"rooms": []string{room}}); err != nil {
+		c.Close()
+		return nil, err
+	}
+	go ch.receive()
+	return ch, nil
+}
+
+func (ch *chat) close() error { return ch.c.Close() }
+
+func (ch *chat) printf(format string, args ...interface{}) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	fmt.Fprintf(ch.out, format+"\n", args...)
+}
+
+// say sends text to everyone else in the room.
+func (ch *chat) say(text string) error {
+	return ch.c.Send(client.Message{Type: "room-broadcast"}, map[string]interface{}{"room": ch.room, "payload": chatLine{Name: ch.name, Text: text}})
+}
+
+// whisper sends text to the member called to, by display name or peer ID.
+func (ch *chat) whisper(to, text string) error {
+	peerId, ok := ch.lookup(to)
+	if !ok {
+		return fmt.Errorf("no one called %s here", to)
+	}
+	_, err := ch.c.SendMessage(peerId, chatLine{Name: ch.name, Text: text}, false)
+	return err
+}
+
+// lookup finds a discovered peer by display name or peer ID.
+func (ch *chat) lookup(who string) (string, bool) {
+	for _, p := range ch.c.Peers().All() {
+		if p.PeerId == who || p.Presence.DisplayName == who {
+			return p.PeerId, true
+		}
+	}
+	return "", false
+}
+
+// handle acts on one line of input and reports false on /quit.
+func (ch *chat) handle(line string) (bool, error) {
+	line = strings.TrimSpace(line)
+	switch {
+	case line == "":
+		return true, nil
+	case line == "/quit":
+		return false, nil
+	case line == "/who":
+		return true, ch.c.Send(client.Message{Type: "room-members"}, map[string]interface{}{"room": ch.room})
+	case strings.HasPrefix(line, "/msg "):
+		parts := strings.SplitN(strings.TrimPrefix(line, "/msg "), " ", 2)
+		if len(parts) < 2 {
+			return true, errors.New("usage: /msg <name> <text>")
+		}
+		return true, ch.whisper(parts[0], parts[1])
+	}
+	return true, ch.say(line)
+}
+
+// receive prints what arrives from the hub until the connection closes.
+func (ch *chat) receive() {
+	for msg := range ch.c.Messages() {
+		if line, ok := ch.format(msg); ok {
+			ch.printf("%s", line)
+		}
+	}
+}
+
+// format renders a hub message for the terminal; ok is false for messages
+// the chat does not show.
+func (ch *chat) format(msg client.Message) (string, bool) {
+	switch msg.Type {
+	case "room-broadcast":
+		var d struct {
+			Room    string   `json:"room"`
+			Payload chatLine `json:"payload"`
+		}
+		if json.Unmarshal(msg.Data, &d) != nil {
+			return "", false
+		}
+		return fmt.Sprintf("[%s] %s: %s", d.Room, d.Payload.Name, d.Payload.Text), true
+	case "peer-message":
+		var d chatLine
+		if json.Unmarshal(msg.Data, &d) != nil {
+			return "", false
+		}
+		return fmt.Sprintf("(private) %s: %s", d.Name, d.Text), true
+	case "peer-discovered":
+		var d struct {
+			PeerId   string          `json:"peerId"`
+			Room     string          `json:"room"`
+			Presence client.Presence `json:"presence"`
+		}
+		if json.Unmarshal(msg.Data, &d) != nil || d.Room != ch.room {
+			return "", false
+		}
+		if d.Presence.DisplayName != "" {
+			ch.mu.Lock()
+			ch.names[d.PeerId] = d.Presence.DisplayName
+			ch.mu.Unlock()
+		}
+		return fmt.Sprintf("* %s is in %s", ch.display(d.PeerId), d.Room), true
+	case "room-left":
+		var d struct {
+			PeerId string `json:"peerId"`
+			Room   string `json:"room"`
+		}
+		if json.Unmarshal(msg.Data, &d) != nil {
+			return "", false
+		}
+		return fmt.Sprintf("* %s left %s", ch.display(d.PeerId), d.Room), true
+	case "room-members":
+		var d struct {
+			Members []string `json:"members"`
+		}
+		if json.Unmarshal(msg.Data, &d) != nil {
+			return "", false
+		}
+		names := make([]string, len(d.Members))
+		for i, id := range d.Members {
+			names[i] = ch.display(id)
+		}
+		sort.Strings(names)
+		return fmt.Sprintf("* in %s: %s", ch.room, strings.Join(names, ", ")), true
+	case "error":
+		return fmt.Sprintf("! %s", msg.Data), true
+	}
+	return "", false
+}
+
+// display names a peer by the display name it joined the room with, or
+// the start of its peer ID. Names are remembered here rather than read from
+// the directory, which forgets a peer before its room-left arrives.
+func (ch *chat) display(peerId string) string {
+	if peerId == ch.c.PeerId() {
+		return ch.name
+	}
+	ch.mu.Lock()
+	name := ch.names[peerId]
+	ch.mu.Unlock()
+	if name == "" && len(peerId) > 8 {
+		return peerId[:8]
+	}
+	if name == "" {
+		return peerId
+	}
+	return name
+}
+
+func main() {
+	hubURL := flag.String("hub", "ws://localhost:3000/ws", "hub WebSocket URL")
+	network := flag.String("network", "chat", "network to announce on")
+	room := flag.String("room", "lobby", "room to join")
+	name := flag.String("name", "", "display name (default: the start of the peer ID)")
+	flag.Parse()
+
+	if *name == "" {
+		*name = client.NewPeerId()[:8]
+	}
+	ch, err := join(*hubURL, *network, *room, *name, os.Stdout)
+	if err != nil {
+		log.Fatalf("join: %v", err)
+	}
+	defer ch.close()
+	ch.printf("* %s joined %s on %s; /msg <name> <text>, /who, /quit", *name, *room, *hubURL)
+
+	in := bufio.NewScanner(os.Stdin)
+	for in.Scan() {
+		more, err := ch.handle(in.Text())
+		if err != nil {
+			ch.printf("! %v", err)
+		}
+		if !more {
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"peerpigeon/examples/hubfixture"
+	"peerpigeon/internal/server"
+)
+
+// lines collects what a chat prints, one line per write.
+type lines chan string
+
+func (l lines) Write(p []byte) (int, error) {
+	l <- strings.TrimSuffix(string(p), "\n")
+	return len(p), nil
+}
+
+func (l lines) expect(t *testing.T, want string) {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case got := <-l:
+			if got == want {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("never printed %q", want)
+		}
+	}
+}
+
+func TestChatRelaysRoomAndPrivateMessagesThroughHub(t *testing.T) {
+	hub := hubfixture.New(t, server.Options{})
+	aliceOut, bobOut, carolOut := make(lines, 64), make(lines, 64), make(lines, 64)
+	alice, err := join(hub.URL, "chat", "lobby", "alice", aliceOut)
+	if err != nil {
+		t.Fatalf("alice: %v", err)
+	}
+	defer alice.close()
+	bob, err := join(hub.URL, "chat", "lobby", "bob", bobOut)
+	if err != nil {
+		t.Fatalf("bob: %v", err)
+	}
+	defer bob.close()
+	carol, err := join(hub.URL, "chat", "kitchen", "carol", carolOut)
+	if err != nil {
+		t.Fatalf("carol: %v", err)
+	}
+	defer carol.close()
+	aliceOut.expect(t, "* bob is in lobby")
+	bobOut.expect(t, "* alice is in lobby")
+
+	alice.handle("hello room")
+	bobOut.expect(t, "[lobby] alice: hello room")
+	bob.handle("/msg alice just you")
+	aliceOut.expect(t, "(private) bob: just you")
+	alice.handle("/who")
+	aliceOut.expect(t, "* in lobby: alice, bob")
+	if _, err := bob.handle("/msg dave hi"); err == nil {
+		t.Fatalf("whispering to an unknown name should fail")
+	}
+	select {
+	case line := <-carolOut:
+		t.Fatalf("carol is in another room but printed %q", line)
+	default:
+	}
+
+	if more, _ := bob.handle("/quit"); more {
+		t.Fatalf("/quit should end the session")
+	}
+	bob.close()
+	aliceOut.expect(t, "* bob left lobby")
+}
@@ -0,0 +1,394 @@
+// Command filetransfer sends a file straight to another peer over a WebRTC
+// data channel. The hub only carries the offer, answer and ICE candidates;
+// the file itself never passes through it. Negotiating the data channel is
+// left to pkg/client/rtc.
+//
+// This example is its own module, so that the hub does not depend on pion.
+// Start a receiver, which prints its peer ID:
+//
+//	go run . -hub ws://localhost:3000/ws -receive ./downloads
+//
+// and send it a file from another terminal or machine:
+//
+//	go run . -hub ws://localhost:3000/ws -send photo.jpg -to <peer-id>
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"peerpigeon/pkg/client"
+	"peerpigeon/pkg/client/rtc"
+)
+
+const (
+	chunkSize = 16 << 10
+	// A sender stops queueing chunks while more than highWater bytes wait
+	// in the data channel, and resumes once they drain below lowWater.
+	highWater = 1 << 20
+	lowWater  = 256 << 10
+)
+
+// header starts each transfer on a peer's data channel. The receiver
+// answers the last chunk with "ok", or "error: " and the reason.
+type header struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// peer sends and receives files over the data channels its
+// PeerConnectionManager keeps to other peers.
+type peer struct {
+	c *client.Client
+	m *rtc.PeerConnectionManager
+
+	// Files offered to a receiver are saved in dir and reported to onFile.
+	dir    string
+	onFile func(path string, err error)
+
+	mu       sync.Mutex
+	waiting  map[string][]chan struct{}
+	replies  map[string]chan error
+	incoming map[string]*incoming
+}
+
+// incoming is a transfer being received from one peer. It is written to a
+// temporary file and renamed once its size and hash check out.
+type incoming struct {
+	hdr header
+	tmp *os.File
+	h   hash.Hash
+	got int64
+}
+
+// newPeer connects to peers only when sending to them; offers from other
+// peers are always answered. With dir set, the peer accepts files offered
+// to it.
+func newPeer(c *client.Client, config webrtc.Configuration, dir string, onFile func(path string, err error)) *peer {
+	p := &peer{c: c, dir: dir, onFile: onFile, waiting: map[string][]chan struct{}{}, replies: map[string]chan error{}, incoming: map[string]*incoming{}}
+	p.m = rtc.NewPeerConnectionManager(c, rtc.Options{Config: config, Manual: true})
+	p.m.OnPeerConnected(p.connected)
+	p.m.OnPeerDisconnected(p.disconnected)
+	p.m.OnDataChannelMessage(p.message)
+	return p
+}
+
+// close tears down every link.
+func (p *peer) close() {
+	p.m.Close()
+}
+
+func (p *peer) connected(remote string) {
+	p.mu.Lock()
+	waiting := p.waiting[remote]
+	delete(p.waiting, remote)
+	p.mu.Unlock()
+	for _, ch := range waiting {
+		close(ch)
+	}
+}
+
+// disconnected fails a send to remote and drops what it was sending us.
+func (p *peer) disconnected(remote string) {
+	p.mu.Lock()
+	reply := p.replies[remote]
+	in := p.incoming[remote]
+	delete(p.incoming, remote)
+	p.mu.Unlock()
+	if reply != nil {
+		select {
+		case reply <- errors.New("peer disconnected"):
+		default:
+		}
+	}
+	if in != nil {
+		in.tmp.Close()
+		os.Remove(in.tmp.Name())
+	}
+}
+
+// await connects to remote and returns once its data channel is open.
+func (p *peer) await(ctx context.Context, remote string) error {
+	ready := make(chan struct{})
+	p.mu.Lock()
+	p.waiting[remote] = append(p.waiting[remote], ready)
+	p.mu.Unlock()
+	if err := p.m.Connect(remote); err != nil {
+		return err
+	}
+	for _, id := range p.m.Peers() {
+		if id == remote {
+			return nil
+		}
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// send offers the file at path to remote and returns once the receiver has
+// checked its hash, or ctx is done.
+func (p *peer) send(ctx context.Context, remote, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	hdr := header{Name: filepath.Base(path), Size: size, SHA256: hex.EncodeToString(h.Sum(nil))}
+
+	result := make(chan error, 1)
+	p.mu.Lock()
+	if p.replies[remote] != nil {
+		p.mu.Unlock()
+		return errors.New("already sending to " + remote)
+	}
+	p.replies[remote] = result
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.replies, remote)
+		p.mu.Unlock()
+	}()
+
+	if err := p.await(ctx, remote); err != nil {
+		return err
+	}
+	go func() {
+		if err := p.stream(ctx, remote, f, hdr); err != nil {
+			select {
+			case result <- err:
+			default:
+			}
+		}
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stream writes hdr and then the file to remote, pausing while its data
+// channel holds more than highWater bytes.
+func (p *peer) stream(ctx context.Context, remote string, f *os.File, hdr header) error {
+	b, _ := json.Marshal(hdr)
+	if err := p.m.SendText(remote, string(b)); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := p.drain(ctx, remote); err != nil {
+				return err
+			}
+			if err := p.m.Send(remote, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// drain waits while more than highWater bytes are queued for remote, until
+// they fall below lowWater.
+func (p *peer) drain(ctx context.Context, remote string) error {
+	queued, err := p.m.BufferedAmount(remote)
+	if err != nil || queued <= highWater {
+		return err
+	}
+	for queued > lowWater {
+		select {
+		case <-time.After(5 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if queued, err = p.m.BufferedAmount(remote); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// message handles what remote sends on its data channel: the receiver's
+// reply to a send, or a transfer to us.
+func (p *peer) message(remote string, msg webrtc.DataChannelMessage) {
+	p.mu.Lock()
+	reply := p.replies[remote]
+	receiving := p.incoming[remote] != nil
+	p.mu.Unlock()
+	if text := string(msg.Data); msg.IsString && !receiving && !strings.HasPrefix(text, "{") {
+		if reply != nil {
+			var err error
+			if text != "ok" {
+				err = errors.New(strings.TrimPrefix(text, "error: "))
+			}
+			select {
+			case reply <- err:
+			default:
+			}
+		}
+		return
+	}
+	p.receive(remote, msg)
+}
+
+// receive adds msg to the transfer from remote, starting one on a header.
+// Chunks of a transfer that was refused are ignored.
+func (p *peer) receive(remote string, msg webrtc.DataChannelMessage) {
+	p.mu.Lock()
+	in := p.incoming[remote]
+	p.mu.Unlock()
+	if in == nil {
+		if !msg.IsString {
+			return
+		}
+		if p.dir == "" {
+			p.m.SendText(remote, "error: not receiving files")
+			return
+		}
+		var hdr header
+		if json.Unmarshal(msg.Data, &hdr) != nil || hdr.Size < 0 {
+			p.finish(remote, nil, "", errors.New("bad header"))
+			return
+		}
+		tmp, err := os.CreateTemp(p.dir, ".incoming-*")
+		if err != nil {
+			p.finish(remote, nil, "", err)
+			return
+		}
+		in = &incoming{hdr: hdr, tmp: tmp, h: sha256.New()}
+		p.mu.Lock()
+		p.incoming[remote] = in
+		p.mu.Unlock()
+	} else if _, err := in.tmp.Write(msg.Data); err != nil {
+		p.finish(remote, in, "", err)
+		return
+	} else {
+		in.h.Write(msg.Data)
+		in.got += int64(len(msg.Data))
+	}
+	switch {
+	case in.got > in.hdr.Size:
+		p.finish(remote, in, "", fmt.Errorf("received more than the %d bytes announced", in.hdr.Size))
+	case in.got == in.hdr.Size:
+		if sum := hex.EncodeToString(in.h.Sum(nil)); sum != in.hdr.SHA256 {
+			p.finish(remote, in, "", fmt.Errorf("sha256 mismatch: got %s, want %s", sum, in.hdr.SHA256))
+			return
+		}
+		path := filepath.Join(p.dir, filepath.Base(in.hdr.Name))
+		if err := in.tmp.Close(); err != nil {
+			p.finish(remote, in, "", err)
+			return
+		}
+		if err := os.Rename(in.tmp.Name(), path); err != nil {
+			p.finish(remote, in, "", err)
+			return
+		}
+		p.finish(remote, in, path, nil)
+	}
+}
+
+// finish ends the transfer from remote, answers the sender and reports the
+// file. A failed transfer's temporary file is removed.
+func (p *peer) finish(remote string, in *incoming, path string, err error) {
+	if in != nil {
+		p.mu.Lock()
+		delete(p.incoming, remote)
+		p.mu.Unlock()
+		if err != nil {
+			in.tmp.Close()
+			os.Remove(in.tmp.Name())
+		}
+	}
+	if err != nil {
+		p.m.SendText(remote, "error: "+err.Error())
+	} else {
+		p.m.SendText(remote, "ok")
+	}
+	if p.onFile != nil {
+		p.onFile(path, err)
+	}
+}
+
+func main() {
+	hubURL := flag.String("hub", "ws://localhost:3000/ws", "hub WebSocket URL")
+	network := flag.String("network", "files", "network to announce on")
+	send := flag.String("send", "", "file to send")
+	to := flag.String("to", "", "peer ID to send the file to")
+	receive := flag.String("receive", "", "directory to save received files in")
+	stun := flag.String("stun", "stun:stun.l.google.com:19302", "STUN server (empty for none)")
+	timeout := flag.Duration("timeout", 5*time.Minute, "give up sending after this long")
+	flag.Parse()
+
+	if (*send == "") == (*receive == "") || (*send != "" && *to == "") {
+		log.Fatal("use either -receive <dir>, or -send <file> -to <peer-id>")
+	}
+	config := webrtc.Configuration{}
+	if *stun != "" {
+		config.ICEServers = []webrtc.ICEServer{{URLs: []string{*stun}}}
+	}
+	c, err := client.Dial(*hubURL, client.Options{NetworkName: *network, AutoReconnect: true, DiscardMessages: true})
+	if err != nil {
+		log.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+
+	if *receive != "" {
+		if err := os.MkdirAll(*receive, 0o755); err != nil {
+			log.Fatal(err)
+		}
+		p := newPeer(c, config, *receive, func(path string, err error) {
+			if err != nil {
+				log.Printf("❌ transfer failed: %v", err)
+				return
+			}
+			log.Printf("✅ received %s", path)
+		})
+		defer p.close()
+		log.Printf("📥 receiving into %s as %s", *receive, c.PeerId())
+		select {}
+	}
+
+	p := newPeer(c, config, "", nil)
+	defer p.close()
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	start := time.Now()
+	if err := p.send(ctx, *to, *send); err != nil {
+		log.Fatalf("❌ send: %v", err)
+	}
+	log.Printf("✅ sent %s to %s in %s", *send, *to, time.Since(start).Round(time.Millisecond))
+}
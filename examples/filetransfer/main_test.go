@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"peerpigeon/examples/hubfixture"
+	"peerpigeon/internal/server"
+	"peerpigeon/pkg/client"
+)
+
+func TestFileCrossesDataChannelNegotiatedThroughHub(t *testing.T) {
+	hub := hubfixture.New(t, server.Options{})
+	sendDir, recvDir := t.TempDir(), t.TempDir()
+	want := make([]byte, 3<<20+123)
+	rand.Read(want)
+	src := filepath.Join(sendDir, "blob.bin")
+	if err := os.WriteFile(src, want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 1)
+	receiver := newPeer(hub.Dial(t, client.Options{NetworkName: "files", DiscardMessages: true}), webrtc.Configuration{}, recvDir, func(path string, err error) {
+		if err != nil {
+			t.Errorf("receive: %v", err)
+		}
+		received <- path
+	})
+	defer receiver.close()
+	sender := newPeer(hub.Dial(t, client.Options{NetworkName: "files", DiscardMessages: true}), webrtc.Configuration{}, "", nil)
+	defer sender.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := sender.send(ctx, receiver.c.PeerId(), src); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	select {
+	case path := <-received:
+		got, err := os.ReadFile(path)
+		if err != nil || !bytes.Equal(got, want) || filepath.Base(path) != "blob.bin" {
+			t.Fatalf("received %s (%d bytes, %v), want blob.bin with the sent bytes", path, len(got), err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("receiver never reported the file")
+	}
+}
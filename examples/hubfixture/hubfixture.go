@@ -0,0 +1,108 @@
+// Package hubfixture runs a PeerPigeon hub inside the calling process on a
+// loopback port, so tests and examples can talk to a real hub without
+// building or starting the binary:
+//
+//	hub := hubfixture.New(t, server.Options{})
+//	a := hub.Dial(t, client.Options{NetworkName: "demo"})
+//
+// Options left zero get values suited to tests: a short-lived hub on
+// 127.0.0.1 that never times peers out on its own.
+package hubfixture
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"peerpigeon/internal/server"
+	"peerpigeon/pkg/client"
+)
+
+// Hub is an embedded hub listening on a loopback port.
+type Hub struct {
+	Server *server.Server
+	// URL is the hub's WebSocket endpoint, ws://127.0.0.1:<port>/ws.
+	URL string
+	// HTTP is the hub's base URL for /health, /stats and the admin API.
+	HTTP string
+
+	ln   net.Listener
+	done chan struct{}
+}
+
+// Start runs a hub with opts and returns once it answers /health.
+func Start(opts server.Options) (*Hub, error) {
+	gin.SetMode(gin.ReleaseMode)
+	if opts.Host == "" {
+		opts.Host = "127.0.0.1"
+	}
+	if opts.MaxConnections == 0 {
+		opts.MaxConnections = 100
+	}
+	if opts.CleanupIntervalMs == 0 {
+		opts.CleanupIntervalMs = 30000
+	}
+	if opts.PeerTimeoutMs == 0 {
+		opts.PeerTimeoutMs = 300000
+	}
+	if opts.MaxMessageBytes == 0 {
+		opts.MaxMessageBytes = 1 << 20
+	}
+	ln, err := net.Listen("tcp", net.JoinHostPort(opts.Host, "0"))
+	if err != nil {
+		return nil, err
+	}
+	h := &Hub{Server: server.NewServer(opts), URL: fmt.Sprintf("ws://%s/ws", ln.Addr()), HTTP: fmt.Sprintf("http://%s", ln.Addr()), ln: ln, done: make(chan struct{})}
+	go func() {
+		h.Server.Serve(ln)
+		close(h.done)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(h.HTTP + "/health")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return h, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			ln.Close()
+			return nil, fmt.Errorf("hub on %s did not come up", ln.Addr())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// New starts a hub for t and stops it when the test ends.
+func New(t testing.TB, opts server.Options) *Hub {
+	t.Helper()
+	h, err := Start(opts)
+	if err != nil {
+		t.Fatalf("start hub: %v", err)
+	}
+	t.Cleanup(h.Close)
+	return h
+}
+
+// Dial connects a client to the hub for t and closes it when the test ends.
+func (h *Hub) Dial(t testing.TB, opts client.Options) *client.Client {
+	t.Helper()
+	c, err := client.Dial(h.URL, opts)
+	if err != nil {
+		t.Fatalf("dial hub: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// Close stops the hub, disconnecting its peers, and waits for it to stop
+// serving.
+func (h *Hub) Close() {
+	h.Server.Stop()
+	h.ln.Close()
+	<-h.done
+}
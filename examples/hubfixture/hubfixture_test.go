@@ -0,0 +1,50 @@
+package hubfixture
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"peerpigeon/internal/server"
+	"peerpigeon/pkg/client"
+)
+
+func TestFixtureServesDiscoveryAndSignaling(t *testing.T) {
+	hub := New(t, server.Options{})
+	resp, err := http.Get(hub.HTTP + "/health")
+	if err != nil {
+		t.Fatalf("health: %v", err)
+	}
+	var health map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&health)
+	resp.Body.Close()
+	if health["status"] == nil {
+		t.Fatalf("unexpected health: %v", health)
+	}
+
+	a := hub.Dial(t, client.Options{NetworkName: "fixture", DiscardMessages: true})
+	found := make(chan string, 4)
+	a.OnPeerDiscovered(func(peerId string, data json.RawMessage) { found <- peerId })
+	b := hub.Dial(t, client.Options{NetworkName: "fixture", DiscardMessages: true})
+	signals := make(chan client.Message, 4)
+	b.OnSignal(func(msg client.Message) { signals <- msg })
+
+	select {
+	case id := <-found:
+		if id != b.PeerId() {
+			t.Fatalf("discovered %s, want %s", id, b.PeerId())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("a never discovered b")
+	}
+	a.SendOffer(b.PeerId(), map[string]interface{}{"type": "offer", "sdp": "v=0"})
+	select {
+	case msg := <-signals:
+		if msg.Type != "offer" || msg.FromPeerId != a.PeerId() {
+			t.Fatalf("unexpected signal %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("b never received the offer")
+	}
+}
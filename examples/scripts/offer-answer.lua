@@ -0,0 +1,43 @@
+-- Offers to every peer it discovers and answers every offer it receives.
+-- Run two copies on the same network:
+--
+--   go run ./cmd/peer-client -name alice -listen 30s -script examples/scripts/offer-answer.lua
+--   go run ./cmd/peer-client -name bob -listen 30s -script examples/scripts/offer-answer.lua
+--
+-- Each stops once it has both answered an offer and had its own answered.
+
+local answered, got_answer = false, false
+
+local function maybe_stop()
+  if answered and got_answer then
+    log("handshake complete")
+    stop()
+  end
+end
+
+function on_start()
+  log(name, "is", peer_id, "on", network)
+end
+
+function on_discovered(id, data)
+  log("offering to", id, "(" .. tostring(data and data.info) .. ")")
+  local ok, err = offer(id, {type = "offer", sdp = "v=0 fake offer from " .. name})
+  if not ok then
+    log("offer failed:", err)
+  end
+end
+
+function on_message(msg)
+  if msg.type == "offer" then
+    answer(msg.from, {type = "answer", sdp = "v=0 fake answer from " .. name})
+    answered = true
+  elseif msg.type == "answer" then
+    log("answer from", msg.from .. ":", msg.data.sdp)
+    got_answer = true
+  end
+  maybe_stop()
+end
+
+function on_stop()
+  log(#peers(), "peers known")
+end
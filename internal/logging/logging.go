@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,22 +25,38 @@ type LogEntry struct {
 	Fields    map[string]interface{} `json:"fields,omitempty"`
 }
 
-var (
-	minLevel = INFO
-)
+var levels = map[LogLevel]int{
+	DEBUG: 0,
+	INFO:  1,
+	WARN:  2,
+	ERROR: 3,
+}
+
+// minLevel holds the current LogLevel; it may change while the hub runs.
+var minLevel atomic.Value
+
+func init() {
+	minLevel.Store(INFO)
+}
 
 func SetLevel(level LogLevel) {
-	minLevel = level
+	minLevel.Store(level)
+}
+
+// Level returns the current minimum level.
+func Level() LogLevel {
+	return minLevel.Load().(LogLevel)
+}
+
+// ParseLevel reads a level name in any case.
+func ParseLevel(name string) (LogLevel, bool) {
+	level := LogLevel(strings.ToUpper(strings.TrimSpace(name)))
+	_, ok := levels[level]
+	return level, ok
 }
 
 func shouldLog(level LogLevel) bool {
-	levels := map[LogLevel]int{
-		DEBUG: 0,
-		INFO:  1,
-		WARN:  2,
-		ERROR: 3,
-	}
-	return levels[level] >= levels[minLevel]
+	return levels[level] >= levels[Level()]
 }
 
 func log(level LogLevel, message string, fields map[string]interface{}) {
@@ -74,6 +92,15 @@ func Error(message string, fields map[string]interface{}) {
 	log(ERROR, message, fields)
 }
 
+// Std forwards to the package-level functions, for code that takes a
+// logger value.
+type Std struct{}
+
+func (Std) Debug(message string, fields map[string]interface{}) { Debug(message, fields) }
+func (Std) Info(message string, fields map[string]interface{})  { Info(message, fields) }
+func (Std) Warn(message string, fields map[string]interface{})  { Warn(message, fields) }
+func (Std) Error(message string, fields map[string]interface{}) { Error(message, fields) }
+
 // Convenience functions for common patterns
 func PeerConnected(peerId string) {
 	Info("peer_connected", map[string]interface{}{
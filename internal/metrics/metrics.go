@@ -31,12 +31,19 @@ type Metrics struct {
 	// Timing
 	StartTime            time.Time
 	LastCleanup          time.Time
+	// TotalsSince is when the cumulative counters started counting; it
+	// predates StartTime once counters have been restored.
+	TotalsSince          time.Time
 
 	mu sync.RWMutex
 }
 
-var globalMetrics = &Metrics{
-	StartTime: time.Now(),
+var globalMetrics = New()
+
+// New returns an independent set of counters, e.g. one per embedded server.
+func New() *Metrics {
+	now := time.Now()
+	return &Metrics{StartTime: now, TotalsSince: now}
 }
 
 func GetMetrics() *Metrics {
@@ -148,5 +155,47 @@ func (m *Metrics) Snapshot() map[string]interface{} {
 			"errors":     m.MessageErrors,
 			"broadcast":  m.MessagesBroadcast,
 		},
+		"totals_since": m.TotalsSince.Format(time.RFC3339),
+	}
+}
+
+// Cumulative returns the counters that only ever grow, for persisting
+// across restarts. Gauges such as active connections are left out.
+func (m *Metrics) Cumulative() map[string]int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return map[string]int64{
+		"total_connections":   m.TotalConnections,
+		"connections_created": m.ConnectionsCreated,
+		"connections_closed":  m.ConnectionsClosed,
+		"total_peers":         m.TotalPeers,
+		"peers_announced":     m.PeersAnnounced,
+		"peers_discovered":    m.PeersDiscovered,
+		"bootstrap_connected": m.BootstrapConnected,
+		"cross_hub_messages":  m.CrossHubMessages,
+		"messages_processed":  m.MessagesProcessed,
+		"message_errors":      m.MessageErrors,
+		"messages_broadcast":  m.MessagesBroadcast,
+		"totals_since_ms":     m.TotalsSince.UnixMilli(),
+	}
+}
+
+// Restore adds counters saved by Cumulative to the current ones.
+func (m *Metrics) Restore(saved map[string]int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.TotalConnections += saved["total_connections"]
+	m.ConnectionsCreated += saved["connections_created"]
+	m.ConnectionsClosed += saved["connections_closed"]
+	m.TotalPeers += saved["total_peers"]
+	m.PeersAnnounced += saved["peers_announced"]
+	m.PeersDiscovered += saved["peers_discovered"]
+	m.BootstrapConnected += saved["bootstrap_connected"]
+	m.CrossHubMessages += saved["cross_hub_messages"]
+	m.MessagesProcessed += saved["messages_processed"]
+	m.MessageErrors += saved["message_errors"]
+	m.MessagesBroadcast += saved["messages_broadcast"]
+	if ms := saved["totals_since_ms"]; ms > 0 && time.UnixMilli(ms).Before(m.TotalsSince) {
+		m.TotalsSince = time.UnixMilli(ms)
 	}
 }
@@ -0,0 +1,45 @@
+package msgpack
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	in := []byte(`{"type":"ice-candidate","timestamp":1760600000000,"hops":-3,"ratio":0.25,"ok":true,"none":null,"list":[1,"two",{"three":3}],"long":"` + string(bytes.Repeat([]byte("x"), 300)) + `"}`)
+	b, err := FromJSON(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) >= len(in) {
+		t.Fatalf("MessagePack should be smaller than JSON: %d >= %d", len(b), len(in))
+	}
+	out, err := ToJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want, got interface{}
+	json.Unmarshal(in, &want)
+	json.Unmarshal(out, &got)
+	w, _ := json.Marshal(want)
+	g, _ := json.Marshal(got)
+	if !bytes.Equal(w, g) {
+		t.Fatalf("round trip changed the document:\n%s\n%s", w, g)
+	}
+}
+
+func TestUnmarshalRejectsBadInput(t *testing.T) {
+	deep := bytes.Repeat([]byte{0x91}, maxDepth+2)
+	for name, b := range map[string][]byte{
+		"truncated string": {0xa5, 'a', 'b'},
+		"huge array":       {0xdd, 0xff, 0xff, 0xff, 0xff},
+		"trailing data":    {0xc0, 0xc0},
+		"extension":        {0xd4, 0x01, 0x00},
+		"too deep":         append(deep, 0xc0),
+	} {
+		if _, err := Unmarshal(b); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCommandEncodesBulkStrings(t *testing.T) {
+	got := string(Command("SET", "k", "two\r\nlines"))
+	want := "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$10\r\ntwo\r\nlines\r\n"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadDecodesReplies(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("+OK\r\n:42\r\n$5\r\nhello\r\n$-1\r\n*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$0\r\n\r\n-ERR wrong type\r\n"))
+	for _, want := range []interface{}{"OK", int64(42), "hello", nil, []interface{}{"message", "ch", ""}} {
+		got, err := Read(r)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %#v (%v), want %#v", got, err, want)
+		}
+	}
+	var re Error
+	if _, err := Read(r); !errors.As(err, &re) || string(re) != "ERR wrong type" {
+		t.Fatalf("expected an error reply, got %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+    "errors"
+    "fmt"
+    "path"
+    "strings"
+    "sync"
+)
+
+// Network access control. NetworkACL is a list of allow/deny rules, each
+// for the networks matching its pattern ("team-*", "*"). When a peer
+// announces, or sends a routed message (see routedTypes), the rules for that network are tried in order and the first
+// whose conditions all hold decides; a rule without conditions matches every
+// peer. A network that has rules but where none matches is denied, and a
+// network without rules is open as before. Conditions are:
+//
+//     peerIdPrefix  the peer ID starts with it
+//     claim         "name=value": the peer's JWT has that claim, or a list
+//                   claim containing the value
+//     apiKey        the peer connected with ?apiKey= or X-API-Key set to it
+//
+// ProtectedNetworks lists networks (patterns again) that only hub links may
+// announce into. Listing HubMeshNamespace stops ordinary peers from
+// impersonating hubs: on a protected mesh namespace an isHub announce is
+// refused too, wherever it is sent. A connection counts as a hub link when
+// it came in on /mesh or presented MeshToken as ?meshToken=; hubs send it
+// when dialing a /ws bootstrap URI. Refusals get {"type": "error", "data": {"code": "network-acl-denied"}}
+// and are counted under "network_acl" in /metrics by the rule's network
+// pattern, or "protected", so the counts stay bounded.
+const (
+    errNetworkACLDenied = "network-acl-denied"
+
+    aclAllow = "allow"
+    aclDeny  = "deny"
+)
+
+// ACLRule is one network access rule.
+type ACLRule struct {
+    Network      string `json:"network"`
+    Action       string `json:"action"`
+    PeerIdPrefix string `json:"peerIdPrefix,omitempty"`
+    Claim        string `json:"claim,omitempty"`
+    APIKey       string `json:"apiKey,omitempty"`
+}
+
+// aclIdentity is what a peer presented when it connected.
+type aclIdentity struct {
+    apiKey  string
+    hubLink bool
+}
+
+type networkACL struct {
+    mu         sync.Mutex
+    identities map[string]aclIdentity
+    denied     map[string]int64
+}
+
+func newNetworkACL() *networkACL {
+    return &networkACL{identities: map[string]aclIdentity{}, denied: map[string]int64{}}
+}
+
+func validateACL(rules []ACLRule, protected []string) error {
+    for _, r := range rules {
+        if _, err := path.Match(r.Network, ""); err != nil || r.Network == "" {
+            return errors.New("ACL rule network " + r.Network + " is not a valid pattern")
+        }
+        if r.Action != aclAllow && r.Action != aclDeny {
+            return errors.New("ACL rule action must be allow or deny")
+        }
+        if r.Claim != "" && !strings.Contains(r.Claim, "=") {
+            return errors.New("ACL rule claim " + r.Claim + " is not name=value")
+        }
+    }
+    for _, p := range protected {
+        if _, err := path.Match(p, ""); err != nil {
+            return errors.New("protected network " + p + " is not a valid pattern")
+        }
+    }
+    return nil
+}
+
+// attachACL records the credentials a peer connected with.
+func (s *Server) attachACL(r *connRequest, peerId string) {
+    if len(s.opts.NetworkACL) == 0 && len(s.opts.ProtectedNetworks) == 0 {
+        return
+    }
+    id := aclIdentity{apiKey: firstNonEmpty(r.GetHeader("X-API-Key"), r.Query("apiKey")), hubLink: s.hubLinkRequest(r)}
+    s.acl.mu.Lock()
+    s.acl.identities[peerId] = id
+    s.acl.mu.Unlock()
+}
+
+func (s *Server) forgetACL(peerId string) {
+    s.acl.mu.Lock()
+    delete(s.acl.identities, peerId)
+    s.acl.mu.Unlock()
+}
+
+// checkNetworkACL returns why peerId may not announce into netName, or send
+// signaling and relayed messages there, or "" when it may.
+func (s *Server) checkNetworkACL(peerId, netName string, isHub bool) string {
+    if len(s.opts.NetworkACL) == 0 && len(s.opts.ProtectedNetworks) == 0 {
+        return ""
+    }
+    s.acl.mu.Lock()
+    id := s.acl.identities[peerId]
+    s.acl.mu.Unlock()
+    reason, counter := "", "protected"
+    switch {
+    case id.hubLink:
+    case matchesAny(s.opts.ProtectedNetworks, netName):
+        reason = "network " + netName + " is reserved for hubs"
+    case isHub && matchesAny(s.opts.ProtectedNetworks, s.opts.HubMeshNamespace):
+        reason = "only hub links may announce as a hub"
+    default:
+        reason, counter = s.evalACL(peerId, netName, id)
+    }
+    if reason != "" {
+        s.acl.mu.Lock()
+        s.acl.denied[counter]++
+        s.acl.mu.Unlock()
+    }
+    return reason
+}
+
+// evalACL applies NetworkACL, returning the refusal and the pattern of the
+// rules that refused.
+func (s *Server) evalACL(peerId, netName string, id aclIdentity) (string, string) {
+    governed := ""
+    for _, r := range s.opts.NetworkACL {
+        if ok, _ := path.Match(r.Network, netName); !ok {
+            continue
+        }
+        governed = r.Network
+        if r.PeerIdPrefix != "" && !strings.HasPrefix(peerId, r.PeerIdPrefix) {
+            continue
+        }
+        if r.APIKey != "" && id.apiKey != r.APIKey {
+            continue
+        }
+        if r.Claim != "" && !s.hasClaim(peerId, r.Claim) {
+            continue
+        }
+        if r.Action == aclAllow {
+            return "", ""
+        }
+        return "network " + netName + " denies this peer", r.Network
+    }
+    if governed != "" {
+        return "network " + netName + " does not admit this peer", governed
+    }
+    return "", ""
+}
+
+// hasClaim reports whether peerId's JWT carries claim, "name=value".
+func (s *Server) hasClaim(peerId, claim string) bool {
+    name, want, _ := strings.Cut(claim, "=")
+    s.jwt.mu.Lock()
+    sess := s.jwt.sessions[peerId]
+    s.jwt.mu.Unlock()
+    if sess == nil {
+        return false
+    }
+    switch v := sess.claims[name].(type) {
+    case []interface{}:
+        for _, item := range v {
+            if fmt.Sprint(item) == want {
+                return true
+            }
+        }
+        return false
+    case nil:
+        return false
+    default:
+        return fmt.Sprint(v) == want
+    }
+}
+
+// rejectACL tells a peer its announce was refused.
+func (s *Server) rejectACL(peerId, netName, reason string) {
+    s.connLog(peerId).Warn("network_acl_denied", map[string]interface{}{"networkName": netName, "reason": reason})
+    s.sendToConn(s.getConn(peerId), outboundMessage{Type: "error", Data: map[string]interface{}{"code": errNetworkACLDenied, "message": reason, "networkName": netName}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+}
+
+func (s *Server) aclSnapshot() map[string]interface{} {
+    s.acl.mu.Lock()
+    defer s.acl.mu.Unlock()
+    denied := make(map[string]int64, len(s.acl.denied))
+    for k, v := range s.acl.denied {
+        denied[k] = v
+    }
+    return map[string]interface{}{"rules": len(s.opts.NetworkACL), "protected": len(s.opts.ProtectedNetworks), "denied": denied}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestNetworkACLAndProtectedNetworks(t *testing.T) {
+    s := NewServer(Options{MaxConnections: 10, MeshToken: "mesh-secret", HubMeshNamespace: "pigeonhub-mesh", ProtectedNetworks: []string{"pigeonhub-mesh"}, NetworkACL: []ACLRule{
+        {Network: "team-*", Action: "deny", PeerIdPrefix: "dead"},
+        {Network: "team-*", Action: "allow", APIKey: "team-key"},
+        {Network: "admin", Action: "allow", Claim: "roles=admin"},
+    }})
+    gin.SetMode(gin.TestMode)
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    dial := func(id, query string) *websocket.Conn {
+        ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?peerId="+id+query, nil)
+        if err != nil {
+            t.Fatalf("dial: %v", err)
+        }
+        ws.SetReadDeadline(time.Now().Add(time.Second))
+        var greeting map[string]interface{}
+        ws.ReadJSON(&greeting)
+        return ws
+    }
+    plain, keyed, banned, hub := randomPeerId(), randomPeerId(), "dead"+randomPeerId()[4:], randomPeerId()
+    for id, query := range map[string]string{plain: "", keyed: "&apiKey=team-key", banned: "&apiKey=team-key", hub: "&meshToken=mesh-secret"} {
+        defer dial(id, query).Close()
+    }
+    s.jwt.mu.Lock()
+    s.jwt.sessions[plain] = &jwtSession{claims: map[string]interface{}{"roles": []interface{}{"user", "admin"}}, timer: time.NewTimer(time.Hour)}
+    s.jwt.mu.Unlock()
+    cases := []struct {
+        peer, network string
+        isHub, allowed bool
+    }{
+        {plain, "team-a", false, false},
+        {keyed, "team-a", false, true},
+        {banned, "team-a", false, false},
+        {plain, "open", false, true},
+        {plain, "admin", false, true},
+        {keyed, "admin", false, false},
+        {plain, "pigeonhub-mesh", true, false},
+        {plain, "global", true, false},
+        {hub, "pigeonhub-mesh", true, true},
+    }
+    for _, c := range cases {
+        if reason := s.checkNetworkACL(c.peer, c.network, c.isHub); (reason == "") != c.allowed {
+            t.Fatalf("%s on %s (hub %v): allowed %v, reason %q", c.peer[:8], c.network, c.isHub, c.allowed, reason)
+        }
+    }
+
+    // End to end: a refused announce answers with a typed error and leaves
+    // the peer where it was.
+    ws := dial(randomPeerId(), "")
+    defer ws.Close()
+    ws.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "pigeonhub-mesh", "data": map[string]interface{}{"isHub": true}})
+    var msg struct {
+        Type string                 `json:"type"`
+        Data map[string]interface{} `json:"data"`
+    }
+    if err := ws.ReadJSON(&msg); err != nil || msg.Type != "error" || msg.Data["code"] != errNetworkACLDenied {
+        t.Fatalf("expected network-acl-denied, got %+v (%v)", msg, err)
+    }
+    if snap := s.aclSnapshot(); snap["denied"].(map[string]int64)["protected"] != 3 || snap["denied"].(map[string]int64)["team-*"] != 2 {
+        t.Fatalf("unexpected ACL metrics: %v", snap)
+    }
+}
+
+func TestNetworkACLAppliesToSignalingAndRelay(t *testing.T) {
+    s := NewServer(Options{MaxConnections: 10, NetworkACL: []ACLRule{{Network: "team-*", Action: "allow", APIKey: "team-key"}}})
+    outsider, member, target := randomPeerId(), randomPeerId(), randomPeerId()
+    conns := attachTestPeers(t, s, outsider, member, target)
+    s.peersMu.Lock()
+    for _, id := range []string{outsider, member, target} {
+        s.peerData[id].Announced, s.peerData[id].NetworkName = true, "team-a"
+    }
+    s.peersMu.Unlock()
+    s.acl.mu.Lock()
+    s.acl.identities[member] = aclIdentity{apiKey: "team-key"}
+    s.acl.identities[target] = aclIdentity{apiKey: "team-key"}
+    s.acl.mu.Unlock()
+
+    for _, typ := range []string{"offer", "ice-candidate", "peer-message", "blob-start"} {
+        s.handleMessage(outsider, []byte(`{"type":"`+typ+`","networkName":"team-a","targetPeerId":"`+target+`","data":{"sdp":"x"}}`))
+        if msgs, _ := conns[target].take(20 * time.Millisecond); len(msgs) != 0 {
+            t.Fatalf("%s from a peer the ACL refuses should not be delivered, got %s", typ, msgs)
+        }
+        if msgs, _ := conns[outsider].take(time.Second); len(msgs) != 1 || !strings.Contains(string(msgs[0]), errNetworkACLDenied) {
+            t.Fatalf("%s should be refused with %s, got %s", typ, errNetworkACLDenied, msgs)
+        }
+    }
+    s.handleMessage(member, []byte(`{"type":"offer","networkName":"team-a","targetPeerId":"`+target+`","data":{"sdp":"x"}}`))
+    if msgs, _ := conns[target].take(time.Second); len(msgs) != 1 || !strings.Contains(string(msgs[0]), `"type":"offer"`) {
+        t.Fatalf("offer from an admitted peer should be delivered, got %s", msgs)
+    }
+    if denied := s.aclSnapshot()["denied"].(map[string]int64)["team-*"]; denied != 4 {
+        t.Fatalf("expected 4 refusals counted, got %d", denied)
+    }
+}
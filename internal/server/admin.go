@@ -0,0 +1,362 @@
+package server
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+const maxAuditEntries = 1000
+
+type auditEntry struct {
+    Seq       int64                  `json:"seq"`
+    Timestamp int64                  `json:"timestamp"`
+    Action    string                 `json:"action"`
+    Remote    string                 `json:"remote"`
+    Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// registerAdminRoutes mounts the operator REST API under /admin. It is only
+// enabled when an admin token is configured.
+func (s *Server) registerAdminRoutes() {
+    if s.opts.AdminToken == "" {
+        return
+    }
+    g := s.engine.Group("/admin", s.requireAdmin)
+    g.GET("/peers", s.adminListPeers)
+    g.DELETE("/peers/:peerId", s.adminKickPeer)
+    g.PUT("/peers/:peerId/debug", s.adminSetPeerDebug)
+    g.GET("/networks", s.adminListNetworks)
+    g.GET("/networks/*network", s.adminNetwork)
+    g.GET("/topology", s.adminTopology)
+    g.GET("/maintenance", s.adminGetMaintenance)
+    g.POST("/maintenance", s.adminSetMaintenance)
+    g.POST("/token", s.adminRotateToken)
+    g.GET("/audit", s.adminAudit)
+    g.GET("/goroutines", s.adminGoroutines)
+    g.GET("/drain", s.adminDrainStatus)
+    g.POST("/drain", s.adminStartDrain)
+    g.DELETE("/drain", s.adminCancelDrain)
+    g.POST("/erase/:peerId", s.adminErasePeer)
+    g.GET("/erase/:eraseId", s.adminEraseStatus)
+    g.GET("/integrations", s.adminListIntegrations)
+    g.POST("/integrations", s.adminAddIntegration)
+    g.DELETE("/integrations/:id", s.adminRemoveIntegration)
+    g.GET("/hub-links", s.adminHubLinks)
+    g.POST("/hub-links/resume", s.adminResumeHubLink)
+    g.GET("/changes", s.adminChangeFeed)
+    g.GET("/tail", s.adminTail)
+    g.GET("/reputation", s.adminReputation)
+    g.POST("/reputation/:peerId/ban", s.adminBanPeer)
+    g.DELETE("/reputation/:peerId", s.adminPardonPeer)
+    g.GET("/store", s.adminStore)
+    g.POST("/store/compact", s.adminCompactStore)
+    g.GET("/listeners", s.adminListListeners)
+    g.POST("/listeners", s.adminAddListener)
+    g.DELETE("/listeners/:name", s.adminRemoveListener)
+    g.GET("/hub-keys", s.adminHubKeys)
+    g.DELETE("/hub-keys", s.adminUnpinHubKey)
+    g.GET("/hub-approvals", s.adminListHubApprovals)
+    g.POST("/hub-approvals/:hubPeerId", s.adminDecideHub)
+    g.DELETE("/hub-approvals/:hubPeerId", s.adminForgetHubDecision)
+    g.GET("/guest-links", s.adminListGuestLinks)
+    g.POST("/guest-links", s.adminMintGuestLink)
+    g.DELETE("/guest-links/:id", s.adminRevokeGuestLink)
+    g.GET("/transforms", s.adminListTransforms)
+    g.PUT("/transforms", s.adminReplaceTransforms)
+    g.POST("/bulk/disconnect", s.adminBulkDisconnect)
+    g.POST("/bulk/purge-cache", s.adminBulkPurgeCache)
+    g.POST("/bulk/rotate-guest-links", s.adminBulkRotateGuestLinks)
+    g.GET("/analytics/peak-peers", s.adminPeakPeers)
+    g.GET("/analytics/session-duration", s.adminSessionDuration)
+    g.GET("/analytics/signaling-success", s.adminSignalingSuccess)
+    g.GET("/config", s.adminGetConfig)
+    g.POST("/config", s.adminSetConfig)
+    g.POST("/ip-bans", s.adminBanIP)
+    g.DELETE("/ip-bans", s.adminPardonIP)
+    g.GET("/cache", s.adminGetCache)
+    g.DELETE("/cache", s.adminClearCache)
+    g.GET("/mesh-members", s.adminMeshMembers)
+    g.GET("/presence-summary", s.adminPresenceSummary)
+}
+
+func (s *Server) requireAdmin(c *gin.Context) {
+    auth := c.GetHeader("Authorization")
+    if !strings.HasPrefix(auth, "Bearer ") || strings.TrimPrefix(auth, "Bearer ") != s.opts.AdminToken {
+        writeJSON(c.Writer, http.StatusUnauthorized, map[string]interface{}{"error": "unauthorized"}, s.opts.CORSOrigin)
+        c.Abort()
+        return
+    }
+    c.Next()
+}
+
+func (s *Server) audit(c *gin.Context, action string, details map[string]interface{}) {
+    s.recordAudit(c.ClientIP(), action, details)
+}
+
+// recordAudit appends to the audit log; remote is empty for actions that
+// did not come through the admin API.
+func (s *Server) recordAudit(remote, action string, details map[string]interface{}) {
+    s.adminMu.Lock()
+    s.auditSeq++
+    s.auditLog = append(s.auditLog, auditEntry{Seq: s.auditSeq, Timestamp: nowMs(), Action: action, Remote: remote, Details: details})
+    if len(s.auditLog) > maxAuditEntries {
+        s.auditLog = s.auditLog[len(s.auditLog)-maxAuditEntries:]
+    }
+    s.adminMu.Unlock()
+    s.emitEvent("admin_action", func() map[string]interface{} {
+        fields := map[string]interface{}{"action": action, "remote": remote}
+        for k, v := range details {
+            fields[k] = v
+        }
+        return fields
+    })
+}
+
+func (s *Server) adminListPeers(c *gin.Context) {
+    netName := c.Query("network")
+    s.peersMu.Lock()
+    peers := make([]map[string]interface{}, 0, len(s.peerData))
+    for id, pi := range s.peerData {
+        if netName != "" && pi.NetworkName != netName {
+            continue
+        }
+        peers = append(peers, adminPeerEntry(id, pi, s.connDebug.enabled(id)))
+    }
+    s.peersMu.Unlock()
+    sort.Slice(peers, func(i, j int) bool { return peers[i]["peerId"].(string) < peers[j]["peerId"].(string) })
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"peers": peers}, s.opts.CORSOrigin)
+}
+
+// adminPeerEntry describes a connected peer, including the data it
+// announced.
+func adminPeerEntry(id string, pi *peerInfo, debug bool) map[string]interface{} {
+    return map[string]interface{}{"peerId": id, "networkName": pi.NetworkName, "isHub": pi.IsHub, "announced": pi.Announced, "connectedAt": pi.ConnectedAt, "lastActivity": pi.LastActivity, "remoteAddress": pi.RemoteAddress, "clientVersion": pi.ClientVersion, "protocolVersion": pi.ProtocolVersion, "debug": debug, "data": pi.Data}
+}
+
+func (s *Server) adminKickPeer(c *gin.Context) {
+    peerId := c.Param("peerId")
+    conn := s.getConn(peerId)
+    if conn == nil {
+        writeJSON(c.Writer, http.StatusNotFound, map[string]interface{}{"error": "peer not connected"}, s.opts.CORSOrigin)
+        return
+    }
+    reason := firstNonEmpty(c.Query("reason"), "kicked by operator")
+    // Disconnect first so the closing transport finds nothing left to
+    // report under a different reason.
+    s.handleDisconnect(peerId, reasonKicked, reason)
+    closeWithReason(conn, websocket.ClosePolicyViolation, reasonKicked)
+    s.audit(c, "kick", map[string]interface{}{"peerId": peerId, "reason": reason})
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"kicked": peerId}, s.opts.CORSOrigin)
+}
+
+func (s *Server) adminListNetworks(c *gin.Context) {
+    s.networkMu.Lock()
+    networks := make([]map[string]interface{}, 0, len(s.networkPeers))
+    for name, set := range s.networkPeers {
+        networks = append(networks, map[string]interface{}{"name": name, "peers": len(set)})
+    }
+    s.networkMu.Unlock()
+    sort.Slice(networks, func(i, j int) bool { return networks[i]["name"].(string) < networks[j]["name"].(string) })
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"networks": networks}, s.opts.CORSOrigin)
+}
+
+// adminNetwork shows one network's membership: the peers announced on it
+// here and the remote peers cached for it from other hubs.
+func (s *Server) adminNetwork(c *gin.Context) {
+    netName := strings.TrimPrefix(c.Param("network"), "/")
+    if !validNetworkName(netName) {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "a valid network is required"}, s.opts.CORSOrigin)
+        return
+    }
+    s.peersMu.Lock()
+    local := []map[string]interface{}{}
+    for id, pi := range s.peerData {
+        if pi.Announced && pi.NetworkName == netName {
+            local = append(local, adminPeerEntry(id, pi, s.connDebug.enabled(id)))
+        }
+    }
+    s.peersMu.Unlock()
+    sort.Slice(local, func(i, j int) bool { return local[i]["peerId"].(string) < local[j]["peerId"].(string) })
+    remote := s.cachedPeers(netName)
+    if len(local) == 0 && len(remote) == 0 {
+        writeJSON(c.Writer, http.StatusNotFound, map[string]interface{}{"error": "no peers on that network"}, s.opts.CORSOrigin)
+        return
+    }
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"networkName": netName, "local": local, "remote": remote}, s.opts.CORSOrigin)
+}
+
+// cachedPeers copies the remote peers cached for netName.
+func (s *Server) cachedPeers(netName string) map[string]map[string]interface{} {
+    s.bootstrapMu.Lock()
+    defer s.bootstrapMu.Unlock()
+    out := make(map[string]map[string]interface{}, len(s.crossHubCache[netName]))
+    for id, data := range s.crossHubCache[netName] {
+        out[id] = data
+    }
+    return out
+}
+
+// purgeCrossHubCache drops every remote peer cached for netName, returning
+// their IDs; they are learned again from gossip.
+func (s *Server) purgeCrossHubCache(netName string) []string {
+    s.bootstrapMu.Lock()
+    ids := make([]string, 0, len(s.crossHubCache[netName]))
+    for id := range s.crossHubCache[netName] {
+        ids = append(ids, id)
+    }
+    delete(s.crossHubCache, netName)
+    s.bootstrapMu.Unlock()
+    sort.Strings(ids)
+    s.remoteIndex.dropNetwork(netName)
+    for _, id := range ids {
+        s.signalRoutes.forget(id)
+    }
+    return ids
+}
+
+// adminGetCache shows the cross-hub cache: remote peer counts per network,
+// or with ?network= that network's cached peers and their data.
+func (s *Server) adminGetCache(c *gin.Context) {
+    if netName := c.Query("network"); netName != "" {
+        writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"networkName": netName, "peers": s.cachedPeers(netName)}, s.opts.CORSOrigin)
+        return
+    }
+    s.bootstrapMu.Lock()
+    networks := make(map[string]int, len(s.crossHubCache))
+    total := 0
+    for name, peers := range s.crossHubCache {
+        networks[name] = len(peers)
+        total += len(peers)
+    }
+    s.bootstrapMu.Unlock()
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"networks": networks, "total": total}, s.opts.CORSOrigin)
+}
+
+// adminClearCache empties the cross-hub cache, or with ?network= just that
+// network's entries.
+func (s *Server) adminClearCache(c *gin.Context) {
+    names := []string{c.Query("network")}
+    if names[0] == "" {
+        s.bootstrapMu.Lock()
+        names = names[:0]
+        for name := range s.crossHubCache {
+            names = append(names, name)
+        }
+        s.bootstrapMu.Unlock()
+    }
+    purged := 0
+    for _, name := range names {
+        purged += len(s.purgeCrossHubCache(name))
+    }
+    s.audit(c, "clear-cache", map[string]interface{}{"networkName": c.Query("network"), "purged": purged})
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"purged": purged}, s.opts.CORSOrigin)
+}
+
+func (s *Server) adminTopology(c *gin.Context) {
+    stats := s.getHubStats()
+    stats["hubPeerId"] = s.hubPeerId
+    stats["version"] = Version
+    writeJSON(c.Writer, http.StatusOK, stats, s.opts.CORSOrigin)
+}
+
+func (s *Server) adminGetMaintenance(c *gin.Context) {
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"maintenance": s.inMaintenance()}, s.opts.CORSOrigin)
+}
+
+func (s *Server) adminSetMaintenance(c *gin.Context) {
+    var body struct {
+        Enabled bool `json:"enabled"`
+    }
+    if err := json.NewDecoder(c.Request.Body).Decode(&body); err != nil {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "invalid JSON body"}, s.opts.CORSOrigin)
+        return
+    }
+    s.adminMu.Lock()
+    s.maintenance = body.Enabled
+    s.adminMu.Unlock()
+    s.audit(c, "maintenance", map[string]interface{}{"enabled": body.Enabled})
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"maintenance": body.Enabled}, s.opts.CORSOrigin)
+}
+
+// adminRotateToken replaces the peer AuthToken. An empty request generates a
+// random token. Existing connections are not affected.
+func (s *Server) adminRotateToken(c *gin.Context) {
+    var body struct {
+        Token string `json:"token"`
+    }
+    json.NewDecoder(c.Request.Body).Decode(&body)
+    if body.Token == "" {
+        b := make([]byte, 24)
+        if _, err := rand.Read(b); err != nil {
+            writeJSON(c.Writer, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()}, s.opts.CORSOrigin)
+            return
+        }
+        body.Token = hex.EncodeToString(b)
+    }
+    s.adminMu.Lock()
+    s.authToken = body.Token
+    s.adminMu.Unlock()
+    s.audit(c, "rotate-token", nil)
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"token": body.Token}, s.opts.CORSOrigin)
+}
+
+// adminAudit returns audit entries newer than ?since=<seq>, so clients can
+// tail the log by polling with the last sequence number they saw.
+func (s *Server) adminAudit(c *gin.Context) {
+    since, _ := strconv.ParseInt(c.Query("since"), 10, 64)
+    s.adminMu.Lock()
+    out := []auditEntry{}
+    for _, e := range s.auditLog {
+        if e.Seq > since {
+            out = append(out, e)
+        }
+    }
+    s.adminMu.Unlock()
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"entries": out}, s.opts.CORSOrigin)
+}
+
+func (s *Server) adminGoroutines(c *gin.Context) {
+    writeJSON(c.Writer, http.StatusOK, s.goroutineSnapshot(), s.opts.CORSOrigin)
+}
+
+func (s *Server) adminHubLinks(c *gin.Context) {
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"links": s.hubQuotas.snapshot(time.Now())}, s.opts.CORSOrigin)
+}
+
+// adminResumeHubLink lifts a quota suspension. Links are named by bootstrap
+// URI or hub peer ID, so the name travels in the body rather than the path.
+func (s *Server) adminResumeHubLink(c *gin.Context) {
+    var body struct {
+        Link string `json:"link"`
+    }
+    if err := json.NewDecoder(c.Request.Body).Decode(&body); err != nil || body.Link == "" {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "link required"}, s.opts.CORSOrigin)
+        return
+    }
+    if !s.hubQuotas.resume(body.Link) {
+        writeJSON(c.Writer, http.StatusNotFound, map[string]interface{}{"error": "unknown link"}, s.opts.CORSOrigin)
+        return
+    }
+    s.audit(c, "resume-hub-link", map[string]interface{}{"link": body.Link})
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"resumed": body.Link}, s.opts.CORSOrigin)
+}
+
+func (s *Server) inMaintenance() bool {
+    s.adminMu.Lock()
+    defer s.adminMu.Unlock()
+    return s.maintenance
+}
+
+func (s *Server) currentAuthToken() string {
+    s.adminMu.Lock()
+    defer s.adminMu.Unlock()
+    return s.authToken
+}
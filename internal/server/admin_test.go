@@ -0,0 +1,111 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestAdminMaintenanceRequiresTokenAndIsAudited(t *testing.T) {
+    s := NewServer(Options{AdminToken: "admin-secret", CORSOrigin: "*"})
+    s.engine = gin.New()
+    s.registerAdminRoutes()
+
+    req := httptest.NewRequest("POST", "/admin/maintenance", strings.NewReader(`{"enabled":true}`))
+    rec := httptest.NewRecorder()
+    s.engine.ServeHTTP(rec, req)
+    if rec.Code != http.StatusUnauthorized || s.inMaintenance() {
+        t.Fatalf("expected unauthorized request to be rejected, got %d", rec.Code)
+    }
+
+    req = httptest.NewRequest("POST", "/admin/maintenance", strings.NewReader(`{"enabled":true}`))
+    req.Header.Set("Authorization", "Bearer admin-secret")
+    rec = httptest.NewRecorder()
+    s.engine.ServeHTTP(rec, req)
+    if rec.Code != http.StatusOK || !s.inMaintenance() {
+        t.Fatalf("expected maintenance enabled, got %d", rec.Code)
+    }
+    if len(s.auditLog) != 1 || s.auditLog[0].Action != "maintenance" {
+        t.Fatalf("expected one audit entry, got %v", s.auditLog)
+    }
+}
+
+func TestAdminManagesIPBansNetworksAndCache(t *testing.T) {
+    s := NewServer(Options{AdminToken: "adm", MaxConnections: 10})
+    gin.SetMode(gin.TestMode)
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    admin := func(method, path, body string) (int, map[string]interface{}) {
+        req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+        req.Header.Set("Authorization", "Bearer adm")
+        res, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatalf("%s %s: %v", method, path, err)
+        }
+        defer res.Body.Close()
+        var out map[string]interface{}
+        json.NewDecoder(res.Body).Decode(&out)
+        return res.StatusCode, out
+    }
+
+    inRange, outside := randomPeerId(), randomPeerId()
+    for id, addr := range map[string]string{inRange: "10.1.2.3", outside: "10.2.0.1"} {
+        attachTestPeer(t, s, id)
+        s.peerData[id].RemoteAddress = addr
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"team/a","data":{"name":"`+addr+`"}}`))
+    }
+    remote := randomPeerId()
+    s.cacheCrossHubPeer("team/a", remote, map[string]interface{}{"name": "remote"})
+
+    code, out := admin("GET", "/admin/networks/team/a", "")
+    local, _ := out["local"].([]interface{})
+    cached, _ := out["remote"].(map[string]interface{})
+    if code != http.StatusOK || len(local) != 2 || cached[remote] == nil || local[0].(map[string]interface{})["data"] == nil {
+        t.Fatalf("unexpected network membership %d %v", code, out)
+    }
+    if code, _ := admin("GET", "/admin/networks/nobody", ""); code != http.StatusNotFound {
+        t.Fatalf("an empty network should be 404, got %d", code)
+    }
+
+    if code, _ := admin("POST", "/admin/ip-bans", `{"ip":"not-an-ip"}`); code != http.StatusBadRequest {
+        t.Fatalf("an invalid address should be refused, got %d", code)
+    }
+    code, out = admin("POST", "/admin/ip-bans", `{"ip":"10.1.9.9/16","reason":"abuse"}`)
+    if code != http.StatusOK || fmt.Sprint(out["disconnected"]) != "["+inRange+"]" || s.getConn(inRange) != nil || s.getConn(outside) == nil {
+        t.Fatalf("the ban should drop only peers in range, got %d %v", code, out)
+    }
+    if !s.isIPBanned("10.1.200.1") || s.isIPBanned("10.2.0.1") {
+        t.Fatalf("range ban should cover the /16 and nothing else")
+    }
+    admin("POST", "/admin/ip-bans", `{"ip":"127.0.0.1"}`)
+    base := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?peerId="
+    if _, resp, err := websocket.DefaultDialer.Dial(base+randomPeerId(), nil); err == nil || resp.StatusCode != http.StatusForbidden {
+        t.Fatalf("a banned address should be refused, err=%v", err)
+    }
+    if code, _ := admin("DELETE", "/admin/ip-bans?ip=127.0.0.1", ""); code != http.StatusOK || s.isIPBanned("127.0.0.1") {
+        t.Fatalf("pardon should lift the ban, got %d", code)
+    }
+    ws, _, err := websocket.DefaultDialer.Dial(base+randomPeerId(), nil)
+    if err != nil {
+        t.Fatalf("a pardoned address should connect: %v", err)
+    }
+    ws.Close()
+
+    s.cacheCrossHubPeer("team-b", randomPeerId(), map[string]interface{}{})
+    if _, out := admin("GET", "/admin/cache", ""); out["total"] != float64(2) {
+        t.Fatalf("unexpected cache view %v", out)
+    }
+    if _, out := admin("DELETE", "/admin/cache?network=team-b", ""); out["purged"] != float64(1) || len(s.cachedPeers("team/a")) != 1 {
+        t.Fatalf("clearing one network should leave the rest, got %v", out)
+    }
+    if _, out := admin("DELETE", "/admin/cache", ""); out["purged"] != float64(1) || len(s.crossHubCache) != 0 {
+        t.Fatalf("clearing everything should empty the cache, got %v", out)
+    }
+}
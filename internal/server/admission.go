@@ -0,0 +1,93 @@
+package server
+
+import (
+    "math/rand"
+    "sync"
+    "time"
+)
+
+// admissionController caps WebSocket upgrades per second so a mass reconnect
+// after a restart cannot overwhelm the hub. Rejected clients are told to come
+// back after a jittered delay so the retries spread out.
+type admissionController struct {
+    rate        int
+    mu          sync.Mutex
+    windowStart int64
+    windowCount int
+    admitted    int64
+    rejected    int64
+    storms      int64
+    inStorm     bool
+    lastStormAt int64
+}
+
+func newAdmissionController(rate int) *admissionController {
+    return &admissionController{rate: rate}
+}
+
+// admit reports whether an upgrade may proceed; when it may not, it returns
+// the suggested retry delay.
+func (a *admissionController) admit() (bool, time.Duration) {
+    if a == nil {
+        return true, 0
+    }
+    now := nowMs()
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    if a.rate <= 0 {
+        return true, 0
+    }
+    if now-a.windowStart >= 1000 {
+        if a.inStorm && a.windowCount <= a.rate {
+            a.inStorm = false
+        }
+        a.windowStart = now
+        a.windowCount = 0
+    }
+    a.windowCount++
+    if a.windowCount <= a.rate {
+        a.admitted++
+        return true, 0
+    }
+    a.rejected++
+    if !a.inStorm {
+        a.inStorm = true
+        a.storms++
+        a.lastStormAt = now
+    }
+    // Spread retries over a window proportional to the backlog.
+    backlog := (a.windowCount - a.rate) / a.rate
+    base := time.Duration(1+backlog) * time.Second
+    jitter := time.Duration(rand.Int63n(int64(base)))
+    return false, base + jitter
+}
+
+// setRate changes the cap; the current window keeps its count.
+func (a *admissionController) setRate(rate int) {
+    a.mu.Lock()
+    a.rate = rate
+    a.mu.Unlock()
+}
+
+func (a *admissionController) currentRate() int {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    return a.rate
+}
+
+func (a *admissionController) snapshot() map[string]interface{} {
+    if a == nil {
+        return map[string]interface{}{"enabled": false}
+    }
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    return map[string]interface{}{
+        "enabled":        a.rate > 0,
+        "max_per_second": a.rate,
+        "admitted":       a.admitted,
+        "rejected":       a.rejected,
+        "storms":         a.storms,
+        "in_storm":       a.inStorm,
+        "last_storm_at":  a.lastStormAt,
+    }
+}
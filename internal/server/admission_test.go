@@ -0,0 +1,22 @@
+package server
+
+import (
+    "testing"
+    "time"
+)
+
+func TestAdmissionControllerShedsExcess(t *testing.T) {
+    a := newAdmissionController(2)
+    for i := 0; i < 2; i++ {
+        if ok, _ := a.admit(); !ok {
+            t.Fatalf("upgrade %d should be admitted", i)
+        }
+    }
+    ok, retry := a.admit()
+    if ok || retry < time.Second {
+        t.Fatalf("expected rejection with retry >= 1s, got %v %v", ok, retry)
+    }
+    if snap := a.snapshot(); snap["storms"].(int64) != 1 {
+        t.Fatalf("expected one storm, got %v", snap["storms"])
+    }
+}
@@ -0,0 +1,156 @@
+package server
+
+import "sync"
+
+// Signal route affinity. When a signal from a remote peer arrives over a hub
+// link for a local peer, that link evidently reaches the remote peer, so the
+// hub remembers it. Offers, answers and candidates for that peer then go down
+// the remembered link alone instead of to every hub link. The mesh is still
+// flooded when no route is known, the link is gone or the write fails, and a
+// route is forgotten when a signal sent down it misses its deadline
+// (SignalDeadlineMs), when the peer's disconnect arrives, or after
+// SignalRouteTTLMs without being refreshed. A SignalRouteTTLMs of 0 turns
+// affinity off. Counters are under "signal_routes" in /metrics.
+
+// signalRoute is the link a remote peer was last heard from: a bootstrap
+// link by URI or an inbound hub link by its peer ID.
+type signalRoute struct {
+    uri       string
+    hubPeerId string
+    learnedAt int64
+}
+
+type signalRoutes struct {
+    mu        sync.Mutex
+    routes    map[string]signalRoute
+    learned   int64
+    hits      int64
+    misses    int64
+    fallbacks int64
+    evicted   int64
+}
+
+func newSignalRoutes() *signalRoutes {
+    return &signalRoutes{routes: map[string]signalRoute{}}
+}
+
+func (r *signalRoutes) learn(peerId string, route signalRoute) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if old, ok := r.routes[peerId]; !ok || old.uri != route.uri || old.hubPeerId != route.hubPeerId {
+        r.learned++
+    }
+    r.routes[peerId] = route
+}
+
+func (r *signalRoutes) lookup(peerId string) (signalRoute, bool) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    route, ok := r.routes[peerId]
+    if !ok {
+        r.misses++
+    }
+    return route, ok
+}
+
+// forget drops the route to peerId and reports whether there was one.
+func (r *signalRoutes) forget(peerId string) bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if _, ok := r.routes[peerId]; !ok {
+        return false
+    }
+    delete(r.routes, peerId)
+    r.evicted++
+    return true
+}
+
+func (r *signalRoutes) expire(now, ttl int64) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for id, route := range r.routes {
+        if now-route.learnedAt > ttl {
+            delete(r.routes, id)
+            r.evicted++
+        }
+    }
+}
+
+func (r *signalRoutes) count(hit bool) {
+    r.mu.Lock()
+    if hit {
+        r.hits++
+    } else {
+        r.fallbacks++
+    }
+    r.mu.Unlock()
+}
+
+// learnSignalRoute records that remote peer from reached this hub over the
+// given link.
+func (s *Server) learnSignalRoute(from string, route signalRoute) {
+    if s.opts.SignalRouteTTLMs <= 0 || from == "" || s.getConn(from) != nil {
+        return
+    }
+    route.learnedAt = nowMs()
+    s.signalRoutes.learn(from, route)
+}
+
+// routeLink returns the connection and shared features of a route's link,
+// or nil when the link is down.
+func (s *Server) routeLink(route signalRoute) (peerConn, []string, string) {
+    if route.uri != "" {
+        s.bootstrapMu.Lock()
+        defer s.bootstrapMu.Unlock()
+        if b := s.bootstrapConns[route.uri]; b != nil && b.connected && b.ws != nil {
+            return b.ws, b.features, b.hubId
+        }
+        return nil, nil, ""
+    }
+    s.hubsMu.Lock()
+    h := s.hubs[route.hubPeerId]
+    var features []string
+    if h != nil {
+        features = h.SharedFeatures
+    }
+    s.hubsMu.Unlock()
+    if h == nil {
+        return nil, nil, ""
+    }
+    return s.getConn(route.hubPeerId), features, route.hubPeerId
+}
+
+// sendSignalRouted sends a signal for a remote target down its remembered
+// link and reports whether it did; on false the caller floods the mesh.
+func (s *Server) sendSignalRouted(target string, msg outboundMessage) bool {
+    if s.opts.SignalRouteTTLMs <= 0 {
+        return false
+    }
+    route, ok := s.signalRoutes.lookup(target)
+    if !ok {
+        return false
+    }
+    if msg.OriginHub == "" {
+        msg.OriginHub = s.hubPeerId
+    }
+    msg.SeenHubs = stampSeen(msg.SeenHubs, s.hubPeerId)
+    conn, features, hubId := s.routeLink(route)
+    if conn == nil || containsHub(msg.SeenHubs, hubId) || !s.sendToHub(conn, features, msg) {
+        s.signalRoutes.forget(target)
+        s.signalRoutes.count(false)
+        return false
+    }
+    s.signalRoutes.count(true)
+    return true
+}
+
+func (s *Server) signalRouteSnapshot() map[string]interface{} {
+    r := s.signalRoutes
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    rate := 0.0
+    if total := r.hits + r.misses + r.fallbacks; total > 0 {
+        rate = float64(r.hits) / float64(total)
+    }
+    return map[string]interface{}{"enabled": s.opts.SignalRouteTTLMs > 0, "routes": len(r.routes), "learned": r.learned, "hits": r.hits, "misses": r.misses, "fallbacks": r.fallbacks, "evicted": r.evicted, "hit_rate": rate, "ttl_ms": s.opts.SignalRouteTTLMs}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+    "testing"
+    "time"
+)
+
+func TestSignalRoutesPreferTheLinkThatReachedThePeer(t *testing.T) {
+    s := NewServer(Options{IsHub: true, SignalRouteTTLMs: 60000})
+    local, remote := randomPeerId(), randomPeerId()
+    h1, h2 := randomPeerId(), randomPeerId()
+    conns := attachTestPeers(t, s, local, h1, h2)
+    for _, id := range []string{local, h1, h2} {
+        s.peerData[id].Announced = true
+        s.peerData[id].IsHub = id != local
+        if id != local {
+            s.hubs[id] = &hubInfo{PeerId: id}
+        }
+    }
+    received := func(id string) int {
+        msgs, _ := conns[id].take(20 * time.Millisecond)
+        return len(msgs)
+    }
+
+    s.handleMessage(local, []byte(`{"type":"offer","targetPeerId":"`+remote+`","data":{"sdp":"o"}}`))
+    if received(h1) != 1 || received(h2) != 1 {
+        t.Fatalf("without a route the offer should be flooded to every hub")
+    }
+    s.handleMessage(h1, []byte(`{"type":"answer","fromPeerId":"`+remote+`","targetPeerId":"`+local+`","data":{"sdp":"a"}}`))
+    if received(local) != 1 {
+        t.Fatalf("answer should reach the local peer")
+    }
+    s.handleMessage(local, []byte(`{"type":"ice-candidate","targetPeerId":"`+remote+`","data":{"candidate":"c1"}}`))
+    if received(h1) != 1 || received(h2) != 0 {
+        t.Fatalf("candidate should follow the learned route only")
+    }
+
+    // The routed link goes away: flood again and forget the route.
+    s.wsMu.Lock()
+    delete(s.wsConns, h1)
+    s.wsMu.Unlock()
+    s.handleMessage(local, []byte(`{"type":"ice-candidate","targetPeerId":"`+remote+`","data":{"candidate":"c2"}}`))
+    if received(h2) != 1 {
+        t.Fatalf("a dead route should fall back to flooding")
+    }
+    snap := s.signalRouteSnapshot()
+    if snap["hits"] != int64(1) || snap["misses"] != int64(1) || snap["fallbacks"] != int64(1) || snap["routes"] != 0 || snap["learned"] != int64(1) {
+        t.Fatalf("unexpected route counters %v", snap)
+    }
+}
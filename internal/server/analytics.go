@@ -0,0 +1,402 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+// Historical analytics. Each cleanup pass folds the hub's live numbers into
+// hourly buckets per network: the peak number of announced peers seen, the
+// sessions that ended and their total length, and the signaling sessions
+// that completed or failed. Buckets older than AnalyticsRetentionMs are
+// dropped. With AnalyticsStorePath set they are saved to the Store every few
+// minutes and on shutdown and read back at startup, so the admin queries
+// below can look back over days rather than the current process:
+//
+//     GET /admin/analytics/peak-peers
+//     GET /admin/analytics/session-duration
+//     GET /admin/analytics/signaling-success
+//
+// each taking ?window= (a duration such as 24h or 7d, default 7d), ?step=
+// (hour or day, default day) and an optional ?network=.
+
+const (
+    analyticsBucketMs      = int64(time.Hour / time.Millisecond)
+    analyticsSaveMs        = int64(5 * time.Minute / time.Millisecond)
+    defaultAnalyticsWindow = 7 * 24 * time.Hour
+)
+
+type analyticsBucket struct {
+    Start    int64                       `json:"start"`
+    Networks map[string]*analyticsCounts `json:"networks"`
+}
+
+type analyticsCounts struct {
+    PeakPeers          int   `json:"peakPeers"`
+    Sessions           int64 `json:"sessions"`
+    SessionMs          int64 `json:"sessionMs"`
+    SignalingCompleted int64 `json:"signalingCompleted"`
+    SignalingFailed    int64 `json:"signalingFailed"`
+}
+
+// analyticsTotals are cumulative per-network counters a sample is diffed
+// against.
+type analyticsTotals struct {
+    sessions, sessionMs, completed, failed int64
+}
+
+type analyticsHistory struct {
+    mu      sync.Mutex
+    buckets []*analyticsBucket
+    last    map[string]analyticsTotals
+    savedAt int64
+}
+
+func newAnalyticsHistory() *analyticsHistory {
+    return &analyticsHistory{last: map[string]analyticsTotals{}}
+}
+
+func (h *analyticsHistory) bucket(now int64) *analyticsBucket {
+    start := now - now%analyticsBucketMs
+    if n := len(h.buckets); n > 0 && h.buckets[n-1].Start == start {
+        return h.buckets[n-1]
+    }
+    b := &analyticsBucket{Start: start, Networks: map[string]*analyticsCounts{}}
+    h.buckets = append(h.buckets, b)
+    return b
+}
+
+func (b *analyticsBucket) network(netName string) *analyticsCounts {
+    c := b.Networks[netName]
+    if c == nil {
+        c = &analyticsCounts{}
+        b.Networks[netName] = c
+    }
+    return c
+}
+
+// sessionTotals returns each network's cumulative ended sessions and their
+// total length in milliseconds.
+func (c *churnTracker) sessionTotals() map[string][2]int64 {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    out := map[string][2]int64{}
+    for name, n := range c.nets {
+        var count int64
+        for _, v := range n.counts {
+            count += v
+        }
+        out[name] = [2]int64{count, n.sumMs}
+    }
+    return out
+}
+
+// outcomeTotals returns each network's cumulative completed and failed
+// signaling sessions.
+func (t *signalingTracker) outcomeTotals() map[string][2]int64 {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    out := map[string][2]int64{}
+    for name, st := range t.stats {
+        out[name] = [2]int64{st.Completed, st.Failed}
+    }
+    return out
+}
+
+// sampleAnalytics folds the current peer counts and the session and
+// signaling outcomes since the last sample into the current bucket, and
+// saves the history when it is due.
+func (s *Server) sampleAnalytics(now int64) {
+    peers := map[string]int{}
+    s.peersMu.Lock()
+    s.networkMu.Lock()
+    for netName, set := range s.networkPeers {
+        for id := range set {
+            if pi := s.peerData[id]; pi != nil && !pi.IsHub {
+                peers[netName]++
+            }
+        }
+    }
+    s.networkMu.Unlock()
+    s.peersMu.Unlock()
+    sessions := s.churn.sessionTotals()
+    outcomes := s.signaling.outcomeTotals()
+
+    h := s.analytics
+    h.mu.Lock()
+    b := h.bucket(now)
+    for netName, n := range peers {
+        if c := b.network(netName); n > c.PeakPeers {
+            c.PeakPeers = n
+        }
+    }
+    cur := map[string]analyticsTotals{}
+    for netName, v := range sessions {
+        t := cur[netName]
+        t.sessions, t.sessionMs = v[0], v[1]
+        cur[netName] = t
+    }
+    for netName, v := range outcomes {
+        t := cur[netName]
+        t.completed, t.failed = v[0], v[1]
+        cur[netName] = t
+    }
+    for netName, t := range cur {
+        prev := h.last[netName]
+        if t == prev {
+            continue
+        }
+        c := b.network(netName)
+        c.Sessions += t.sessions - prev.sessions
+        c.SessionMs += t.sessionMs - prev.sessionMs
+        c.SignalingCompleted += t.completed - prev.completed
+        c.SignalingFailed += t.failed - prev.failed
+    }
+    h.last = cur
+    cutoff := now - int64(s.opts.AnalyticsRetentionMs)
+    i := 0
+    for i < len(h.buckets) && h.buckets[i].Start+analyticsBucketMs <= cutoff {
+        i++
+    }
+    h.buckets = h.buckets[i:]
+    due := s.opts.AnalyticsStorePath != "" && now-h.savedAt >= analyticsSaveMs
+    h.mu.Unlock()
+    if due {
+        s.saveAnalytics()
+    }
+}
+
+func (s *Server) saveAnalytics() {
+    if s.opts.AnalyticsStorePath == "" {
+        return
+    }
+    h := s.analytics
+    h.mu.Lock()
+    b, err := json.Marshal(h.buckets)
+    h.savedAt = nowMs()
+    h.mu.Unlock()
+    if err == nil {
+        err = s.opts.Store.Save(s.opts.AnalyticsStorePath, b)
+    }
+    if err != nil {
+        s.log.Warn("analytics_save_failed", map[string]interface{}{"key": s.opts.AnalyticsStorePath, "error": err.Error()})
+    }
+}
+
+// restoreAnalytics loads the buckets saved by a previous run.
+func (s *Server) restoreAnalytics() {
+    if s.opts.AnalyticsStorePath == "" {
+        return
+    }
+    b, err := s.opts.Store.Load(s.opts.AnalyticsStorePath)
+    if err != nil || b == nil {
+        if err != nil {
+            s.log.Warn("analytics_restore_failed", map[string]interface{}{"key": s.opts.AnalyticsStorePath, "error": err.Error()})
+        }
+        return
+    }
+    var buckets []*analyticsBucket
+    if err := json.Unmarshal(b, &buckets); err != nil {
+        s.log.Warn("analytics_restore_failed", map[string]interface{}{"key": s.opts.AnalyticsStorePath, "error": err.Error()})
+        return
+    }
+    cutoff := nowMs() - int64(s.opts.AnalyticsRetentionMs)
+    kept := buckets[:0]
+    for _, bk := range buckets {
+        if bk != nil && bk.Networks != nil && bk.Start+analyticsBucketMs > cutoff {
+            kept = append(kept, bk)
+        }
+    }
+    sort.Slice(kept, func(i, j int) bool { return kept[i].Start < kept[j].Start })
+    s.analytics.mu.Lock()
+    s.analytics.buckets = kept
+    s.analytics.mu.Unlock()
+}
+
+// parseWindow reads a duration, also accepting whole days such as "7d".
+func parseWindow(v string) (time.Duration, bool) {
+    if v == "" {
+        return defaultAnalyticsWindow, true
+    }
+    if days := strings.TrimSuffix(v, "d"); days != v {
+        n, err := strconv.Atoi(days)
+        return time.Duration(n) * 24 * time.Hour, err == nil && n > 0
+    }
+    d, err := time.ParseDuration(v)
+    return d, err == nil && d > 0
+}
+
+// analyticsRange is one query's view of the history: the buckets inside the
+// window, grouped by step.
+type analyticsRange struct {
+    from, to, step int64
+    network        string
+    steps          []int64
+    grouped        map[int64][]*analyticsBucket
+}
+
+// analyticsQuery parses the common parameters and selects the buckets,
+// answering 400 when they are malformed.
+func (s *Server) analyticsQuery(c *gin.Context) (*analyticsRange, bool) {
+    window, ok := parseWindow(c.Query("window"))
+    step := analyticsBucketMs
+    switch c.DefaultQuery("step", "day") {
+    case "hour":
+    case "day":
+        step *= 24
+    default:
+        ok = false
+    }
+    if !ok {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "window must be a duration such as 24h or 7d and step hour or day"}, s.opts.CORSOrigin)
+        return nil, false
+    }
+    now := nowMs()
+    r := &analyticsRange{from: now - window.Milliseconds(), to: now, step: step, network: c.Query("network"), grouped: map[int64][]*analyticsBucket{}}
+    h := s.analytics
+    h.mu.Lock()
+    for _, b := range h.buckets {
+        if b.Start+analyticsBucketMs <= r.from {
+            continue
+        }
+        cp := &analyticsBucket{Start: b.Start, Networks: map[string]*analyticsCounts{}}
+        for netName, counts := range b.Networks {
+            if r.network == "" || netName == r.network {
+                v := *counts
+                cp.Networks[netName] = &v
+            }
+        }
+        key := b.Start - b.Start%step
+        if _, seen := r.grouped[key]; !seen {
+            r.steps = append(r.steps, key)
+        }
+        r.grouped[key] = append(r.grouped[key], cp)
+    }
+    h.mu.Unlock()
+    return r, true
+}
+
+func (r *analyticsRange) respond(s *Server, c *gin.Context, query string, networks map[string]interface{}, series []map[string]interface{}) {
+    stepName := "day"
+    if r.step == analyticsBucketMs {
+        stepName = "hour"
+    }
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"query": query, "from": r.from, "to": r.to, "step": stepName, "network": r.network, "networks": networks, "series": series}, s.opts.CORSOrigin)
+}
+
+func ratio(num, den int64) float64 {
+    if den == 0 {
+        return 0
+    }
+    return float64(num) / float64(den)
+}
+
+// adminPeakPeers answers the highest number of peers announced at once on
+// each network over the window, when it happened, and the peak per step.
+func (s *Server) adminPeakPeers(c *gin.Context) {
+    r, ok := s.analyticsQuery(c)
+    if !ok {
+        return
+    }
+    type peak struct {
+        Peak int   `json:"peak"`
+        At   int64 `json:"at"`
+    }
+    overall := map[string]*peak{}
+    series := []map[string]interface{}{}
+    for _, start := range r.steps {
+        peaks := map[string]int{}
+        for _, b := range r.grouped[start] {
+            for netName, counts := range b.Networks {
+                if counts.PeakPeers > peaks[netName] {
+                    peaks[netName] = counts.PeakPeers
+                }
+                if p := overall[netName]; p == nil || counts.PeakPeers > p.Peak {
+                    overall[netName] = &peak{counts.PeakPeers, b.Start}
+                }
+            }
+        }
+        series = append(series, map[string]interface{}{"start": start, "peaks": peaks})
+    }
+    networks := map[string]interface{}{}
+    for netName, p := range overall {
+        networks[netName] = p
+    }
+    r.respond(s, c, "peak-peers", networks, series)
+}
+
+// adminSessionDuration answers how many peer sessions ended on each network
+// over the window and how long they lasted on average.
+func (s *Server) adminSessionDuration(c *gin.Context) {
+    r, ok := s.analyticsQuery(c)
+    if !ok {
+        return
+    }
+    totals := map[string]*analyticsCounts{}
+    series := []map[string]interface{}{}
+    for _, start := range r.steps {
+        var sessions, ms int64
+        for _, b := range r.grouped[start] {
+            for netName, counts := range b.Networks {
+                sessions += counts.Sessions
+                ms += counts.SessionMs
+                t := totals[netName]
+                if t == nil {
+                    t = &analyticsCounts{}
+                    totals[netName] = t
+                }
+                t.Sessions += counts.Sessions
+                t.SessionMs += counts.SessionMs
+            }
+        }
+        series = append(series, map[string]interface{}{"start": start, "sessions": sessions, "avgMs": int64(ratio(ms, sessions))})
+    }
+    networks := map[string]interface{}{}
+    for netName, t := range totals {
+        if t.Sessions > 0 {
+            networks[netName] = map[string]interface{}{"sessions": t.Sessions, "avgMs": int64(ratio(t.SessionMs, t.Sessions))}
+        }
+    }
+    r.respond(s, c, "session-duration", networks, series)
+}
+
+// adminSignalingSuccess answers the share of signaling sessions that
+// completed, per network over the window and per step as a trend.
+func (s *Server) adminSignalingSuccess(c *gin.Context) {
+    r, ok := s.analyticsQuery(c)
+    if !ok {
+        return
+    }
+    totals := map[string]*analyticsCounts{}
+    series := []map[string]interface{}{}
+    for _, start := range r.steps {
+        var completed, failed int64
+        for _, b := range r.grouped[start] {
+            for netName, counts := range b.Networks {
+                completed += counts.SignalingCompleted
+                failed += counts.SignalingFailed
+                t := totals[netName]
+                if t == nil {
+                    t = &analyticsCounts{}
+                    totals[netName] = t
+                }
+                t.SignalingCompleted += counts.SignalingCompleted
+                t.SignalingFailed += counts.SignalingFailed
+            }
+        }
+        series = append(series, map[string]interface{}{"start": start, "completed": completed, "failed": failed, "rate": ratio(completed, completed+failed)})
+    }
+    networks := map[string]interface{}{}
+    for netName, t := range totals {
+        if done := t.SignalingCompleted + t.SignalingFailed; done > 0 {
+            networks[netName] = map[string]interface{}{"completed": t.SignalingCompleted, "failed": t.SignalingFailed, "rate": ratio(t.SignalingCompleted, done)}
+        }
+    }
+    r.respond(s, c, "signaling-success", networks, series)
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+func TestAnalyticsHistorySurvivesRestartAndAnswersQueries(t *testing.T) {
+    st := &memStore{docs: map[string][]byte{}}
+    s := NewServer(Options{AdminToken: "adm", Store: st, AnalyticsStorePath: "analytics"})
+    a, b := randomPeerId(), randomPeerId()
+    for _, id := range []string{a, b} {
+        attachTestPeer(t, s, id)
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"lobby","data":{}}`))
+    }
+    now := nowMs()
+    s.sampleAnalytics(now)
+    s.churn.disconnected("lobby", 4*time.Second, time.Now())
+    s.churn.disconnected("lobby", 6*time.Second, time.Now())
+    s.signaling.stats["lobby"] = &sessionStats{Started: 4, Completed: 3, Failed: 1}
+    s.sampleAnalytics(now)
+    // A bucket from two days ago, as if recorded by an earlier run.
+    s.analytics.buckets = append([]*analyticsBucket{{Start: now - now%analyticsBucketMs - 48*analyticsBucketMs, Networks: map[string]*analyticsCounts{"lobby": {PeakPeers: 9, SignalingFailed: 3}}}}, s.analytics.buckets...)
+    s.saveAnalytics()
+
+    r := NewServer(Options{AdminToken: "adm", Store: st, AnalyticsStorePath: "analytics"})
+    r.engine = gin.New()
+    r.registerAdminRoutes()
+    query := func(path string) (int, map[string]interface{}) {
+        req := httptest.NewRequest("GET", "/admin/analytics/"+path, nil)
+        req.Header.Set("Authorization", "Bearer adm")
+        rec := httptest.NewRecorder()
+        r.engine.ServeHTTP(rec, req)
+        var out map[string]interface{}
+        json.Unmarshal(rec.Body.Bytes(), &out)
+        return rec.Code, out
+    }
+    _, out := query("peak-peers?window=7d")
+    lobby := out["networks"].(map[string]interface{})["lobby"].(map[string]interface{})
+    if lobby["peak"] != float64(9) || len(out["series"].([]interface{})) != 2 {
+        t.Fatalf("restored history should report the older peak, got %v", out)
+    }
+    _, out = query("peak-peers?window=24h&step=hour")
+    lobby = out["networks"].(map[string]interface{})["lobby"].(map[string]interface{})
+    if lobby["peak"] != float64(2) || out["step"] != "hour" {
+        t.Fatalf("a 24h window should only see today's peak, got %v", out)
+    }
+    _, out = query("session-duration")
+    lobby = out["networks"].(map[string]interface{})["lobby"].(map[string]interface{})
+    if lobby["sessions"] != float64(2) || lobby["avgMs"] != float64(5000) {
+        t.Fatalf("unexpected session durations: %v", out)
+    }
+    _, out = query("signaling-success?network=lobby")
+    lobby = out["networks"].(map[string]interface{})["lobby"].(map[string]interface{})
+    if lobby["completed"] != float64(3) || lobby["failed"] != float64(4) {
+        t.Fatalf("unexpected signaling totals: %v", out)
+    }
+    if series := out["series"].([]interface{}); series[1].(map[string]interface{})["rate"] != 0.75 {
+        t.Fatalf("today's success rate should be 0.75, got %v", series)
+    }
+    if code, _ := query("peak-peers?window=soon"); code != http.StatusBadRequest {
+        t.Fatalf("a malformed window should be rejected, got %d", code)
+    }
+}
@@ -0,0 +1,405 @@
+package server
+
+import (
+    "fmt"
+    "reflect"
+    "time"
+)
+
+// Announce pipeline. handleAnnounce runs in three phases. checkAnnounce
+// validates the announce without touching any state. commitAnnounce then
+// applies it through announceSteps: peer info and network membership, the
+// local discovery index, the hub registry and hub admission, and a final
+// check that the peer did not disconnect meanwhile. Each step registers an
+// undo as it applies, and when a step fails the steps already applied are
+// undone in reverse order, so the peer is left as it was before the
+// announce (or, if it disconnected, fully removed) instead of, say, listed
+// in networkPeers but missing from the hub registry. Only once every step
+// has committed does publishAnnounce tell anyone: the change feed, churn,
+// events, discovery broadcasts, integrations and the mesh.
+
+// announceCapError is a refusal under MaxNetworks or MaxPeersPerNetwork.
+type announceCapError struct {
+    code  string
+    limit int
+}
+
+func (e *announceCapError) Error() string {
+    return fmt.Sprintf("%s (limit %d)", e.code, e.limit)
+}
+
+type announceError string
+
+func (e announceError) Error() string { return string(e) }
+
+const (
+    errAnnouncePeerGone    = announceError("peer disconnected during announce")
+    errAnnounceHubRejected = announceError("hub rejected")
+)
+
+// announceTxn is one announce on its way through the pipeline.
+type announceTxn struct {
+    peerId  string
+    netName string
+    isHub   bool
+    msg     inboundMessage
+
+    pi            *peerInfo
+    prev          peerInfo
+    prevNet       string
+    firstAnnounce bool
+    peerIsHub     bool
+    hidden        bool
+    data          map[string]interface{}
+    approval      string
+    undo          []func()
+}
+
+// announceSteps are the state changes an announce makes, in order.
+var announceSteps = []struct {
+    name  string
+    apply func(*Server, *announceTxn) error
+}{
+    {"membership", (*Server).commitMembership},
+    {"index", (*Server).commitIndex},
+    {"hub-registry", (*Server).commitHubRegistry},
+    {"hub-admission", (*Server).commitHubAdmission},
+    {"confirm", (*Server).confirmAnnounce},
+}
+
+func (s *Server) handleAnnounce(peerId string, msg inboundMessage, resp outboundMessage) {
+    t, ok := s.checkAnnounce(peerId, msg)
+    if !ok {
+        return
+    }
+    if m, _ := msg.Data.(map[string]interface{}); !t.isHub && hasFeature(featureList(m["features"]), featureCompression) {
+        markGzip(s.getConn(peerId))
+    }
+    if err := s.commitAnnounce(t); err != nil {
+        s.failAnnounce(t, err)
+        return
+    }
+    s.publishAnnounce(t)
+}
+
+// checkAnnounce validates an announce, answering the peer when it is
+// refused.
+func (s *Server) checkAnnounce(peerId string, msg inboundMessage) (*announceTxn, bool) {
+    t := &announceTxn{peerId: peerId, netName: firstNonEmpty(msg.NetworkName, s.opts.DefaultNetwork), msg: msg}
+    m, isMap := msg.Data.(map[string]interface{})
+    claimed, _ := m["isHub"].(bool)
+    claimed = claimed || t.netName == s.opts.HubMeshNamespace
+    if pi := s.getPeerInfo(peerId); pi != nil && pi.IsHub {
+        t.isHub = true
+    } else if claimed && s.opts.MeshPathOnly {
+        s.sendError(s.getConn(peerId), peerId, "hub links must connect on /mesh")
+        return nil, false
+    }
+    if reason := s.checkNetworkACL(peerId, t.netName, t.isHub || claimed); reason != "" {
+        s.rejectACL(peerId, t.netName, reason)
+        return nil, false
+    }
+    // Hub status comes only from how the link was verified, never from
+    // the announce itself.
+    if claimed && !t.isHub {
+        s.sendError(s.getConn(peerId), peerId, "hub links must present the mesh token or a pinned hub key")
+        return nil, false
+    }
+    // Verified hub links skip the authorizers and the checks on what a
+    // client announces about itself.
+    if !s.jwtAllowsNetwork(peerId, t.netName) || (!t.isHub && !s.authorizeAnnounce(peerId, t.netName, msg.Data)) {
+        s.sendError(s.getConn(peerId), peerId, "announce not authorized for network "+t.netName)
+        return nil, false
+    }
+    if isMap && !t.isHub && (!s.normalizeServices(peerId, m) || !s.normalizePresence(peerId, m)) {
+        return nil, false
+    }
+    if isMap && !t.isHub && !s.checkDiscoveryFilter(peerId, m) {
+        return nil, false
+    }
+    if isMap && !s.checkVisibility(peerId, t.isHub, m) {
+        return nil, false
+    }
+    return t, true
+}
+
+// commitAnnounce runs announceSteps, undoing the applied ones when a step
+// fails.
+func (s *Server) commitAnnounce(t *announceTxn) error {
+    for _, step := range announceSteps {
+        err := step.apply(s, t)
+        if err == nil && s.announceFault != nil {
+            err = s.announceFault(step.name)
+        }
+        if err != nil {
+            for i := len(t.undo) - 1; i >= 0; i-- {
+                t.undo[i]()
+            }
+            if log := s.connLog(t.peerId); log.debugging() {
+                log.Debug("announce_rolled_back", map[string]interface{}{"networkName": t.netName, "step": step.name, "error": err.Error()})
+            }
+            return err
+        }
+    }
+    return nil
+}
+
+// failAnnounce answers an announce that was rolled back.
+func (s *Server) failAnnounce(t *announceTxn, err error) {
+    if err == errAnnounceHubRejected {
+        s.rejectHub(t.peerId)
+        return
+    }
+    if e, ok := err.(*announceCapError); ok {
+        s.connLog(t.peerId).Warn("network_cap_reached", map[string]interface{}{"networkName": t.netName, "code": e.code, "limit": e.limit})
+        message := "network " + t.netName + " is full"
+        if e.code == errNetworkLimit {
+            message = "hub network limit reached"
+        }
+        s.sendToConn(s.getConn(t.peerId), outboundMessage{Type: "error", Data: map[string]interface{}{"code": e.code, "message": message, "networkName": t.netName, "limit": e.limit}, FromPeerId: "system", TargetPeer: t.peerId, NetworkName: "global", Timestamp: nowMs()})
+    }
+}
+
+// announceGone reports whether the peer disconnected after the announce
+// started.
+func (s *Server) announceGone(t *announceTxn) bool {
+    s.peersMu.Lock()
+    defer s.peersMu.Unlock()
+    return s.peerData[t.peerId] != t.pi
+}
+
+// commitMembership updates the peer's info and moves it into the network.
+// peerData and networkPeers are updated together so a concurrent
+// cleanupPeer either runs first (and the announce is dropped) or sees the
+// final membership.
+func (s *Server) commitMembership(t *announceTxn) error {
+    s.peersMu.Lock()
+    pi := s.peerData[t.peerId]
+    if pi == nil {
+        s.peersMu.Unlock()
+        return errAnnouncePeerGone
+    }
+    if code, limit := s.checkNetworkCaps(t.peerId, t.netName, t.isHub || pi.IsHub); code != "" {
+        s.peersMu.Unlock()
+        return &announceCapError{code: code, limit: limit}
+    }
+    t.pi, t.prev = pi, *pi
+    if pi.Announced && pi.NetworkName != t.netName {
+        t.prevNet = pi.NetworkName
+    }
+    t.firstAnnounce = !pi.Announced
+    pi.Announced = true
+    pi.AnnouncedAt = nowMs()
+    pi.NetworkName = t.netName
+    pi.IsHub = t.isHub
+    if m, ok := t.msg.Data.(map[string]interface{}); ok {
+        pi.Data = m
+        pi.Filter, _ = parseDiscoveryFilter(m)
+        if v, ok := m["clientVersion"].(string); ok && v != "" {
+            pi.ClientVersion = v
+        }
+    }
+    t.data, t.peerIsHub = pi.Data, pi.IsHub
+    t.hidden = hiddenPeer(t.data)
+    s.networkMu.Lock()
+    if t.prevNet != "" {
+        s.leaveNetworkLocked(t.prevNet, t.peerId)
+    }
+    s.joinNetworkLocked(t.netName, t.peerId)
+    s.networkMu.Unlock()
+    s.peersMu.Unlock()
+    if t.firstAnnounce {
+        s.metrics.PeerAnnounced()
+    }
+    t.undo = append(t.undo, func() { s.undoMembership(t) })
+    return nil
+}
+
+// undoMembership puts the peer back where it was. A peer that disconnected
+// meanwhile was already counted out by cleanupPeer and is only removed from
+// the network it joined.
+func (s *Server) undoMembership(t *announceTxn) {
+    s.peersMu.Lock()
+    present := s.peerData[t.peerId] == t.pi
+    pi, prev := t.pi, t.prev
+    pi.Announced, pi.AnnouncedAt, pi.NetworkName, pi.IsHub, pi.Data, pi.ClientVersion = prev.Announced, prev.AnnouncedAt, prev.NetworkName, prev.IsHub, prev.Data, prev.ClientVersion
+    s.networkMu.Lock()
+    s.leaveNetworkLocked(t.netName, t.peerId)
+    if present && prev.Announced {
+        s.joinNetworkLocked(prev.NetworkName, t.peerId)
+    }
+    s.networkMu.Unlock()
+    s.peersMu.Unlock()
+    if present && t.firstAnnounce {
+        s.metrics.PeerRemoved()
+    }
+}
+
+// joinNetworkLocked and leaveNetworkLocked change networkPeers; the caller
+// holds networkMu.
+func (s *Server) joinNetworkLocked(netName, peerId string) {
+    if _, ok := s.networkPeers[netName]; !ok {
+        s.networkPeers[netName] = map[string]struct{}{}
+    }
+    s.networkPeers[netName][peerId] = struct{}{}
+}
+
+func (s *Server) leaveNetworkLocked(netName, peerId string) {
+    if set, ok := s.networkPeers[netName]; ok {
+        delete(set, peerId)
+        if len(set) == 0 {
+            delete(s.networkPeers, netName)
+        }
+    }
+}
+
+// indexAnnounced puts a peer in the local discovery index, or takes it out
+// when it is a hub or hidden.
+func (s *Server) indexAnnounced(netName, peerId string, isHub bool, data map[string]interface{}) {
+    if isHub || hiddenPeer(data) {
+        s.localIndex.drop("", peerId)
+    } else {
+        s.localIndex.put(netName, peerId, data)
+    }
+}
+
+func (s *Server) commitIndex(t *announceTxn) error {
+    s.indexAnnounced(t.netName, t.peerId, t.peerIsHub, t.data)
+    t.undo = append(t.undo, func() {
+        if !t.prev.Announced || s.announceGone(t) {
+            s.localIndex.drop("", t.peerId)
+            return
+        }
+        s.indexAnnounced(t.prev.NetworkName, t.peerId, t.prev.IsHub, t.prev.Data)
+    })
+    return nil
+}
+
+func (s *Server) commitHubRegistry(t *announceTxn) error {
+    if !t.peerIsHub {
+        return nil
+    }
+    s.hubsMu.Lock()
+    prev, had := s.hubs[t.peerId]
+    s.hubsMu.Unlock()
+    s.registerHub(t.peerId, t.netName, t.data)
+    t.undo = append(t.undo, func() {
+        restore := had && !s.announceGone(t)
+        s.hubsMu.Lock()
+        if restore {
+            s.hubs[t.peerId] = prev
+        } else {
+            delete(s.hubs, t.peerId)
+        }
+        s.hubsMu.Unlock()
+    })
+    return nil
+}
+
+// commitHubAdmission fails the announce of a hub an operator has rejected.
+// A hub awaiting approval stays registered but is not announced further.
+func (s *Server) commitHubAdmission(t *announceTxn) error {
+    if !t.peerIsHub {
+        return nil
+    }
+    if t.approval = s.admitHub(t.peerId, t.netName, t.data); t.approval == hubApprovalRejected {
+        return errAnnounceHubRejected
+    }
+    return nil
+}
+
+// confirmAnnounce fails the announce when the peer disconnected while it
+// was being applied, so the steps above do not leave it behind in the index
+// or the hub registry after cleanupPeer has run.
+func (s *Server) confirmAnnounce(t *announceTxn) error {
+    if s.announceGone(t) {
+        return errAnnouncePeerGone
+    }
+    return nil
+}
+
+// publishAnnounce tells the network, the mesh and everyone watching about a
+// committed announce.
+func (s *Server) publishAnnounce(t *announceTxn) {
+    peerId, netName, data, peerIsHub, hidden := t.peerId, t.netName, t.data, t.peerIsHub, t.hidden
+    firstAnnounce, prevNet, prevData := t.firstAnnounce, t.prevNet, t.prev.Data
+    // A peer back within the disconnect debounce window never left as far
+    // as anyone else knows.
+    resumed := false
+    if firstAnnounce && !peerIsHub {
+        var pendingData map[string]interface{}
+        if pendingData, resumed = s.resumeDisconnect(peerId, netName); resumed {
+            prevData = pendingData
+        }
+    }
+    if !peerIsHub && (firstAnnounce || prevNet != "") {
+        now := time.Now()
+        if prevNet != "" {
+            s.churn.disconnected(prevNet, now.Sub(time.UnixMilli(t.prev.AnnouncedAt)), now)
+            s.changes.publish(changeRemoved, prevNet, peerId, nil, reasonNetworkSwitch)
+        }
+        s.churn.connected(netName, now)
+        if !resumed {
+            s.changes.publish(changeAdded, netName, peerId, data, "")
+        } else if !reflect.DeepEqual(prevData, data) {
+            s.changes.publish(changeUpdated, netName, peerId, data, "")
+        }
+    } else if !peerIsHub && !reflect.DeepEqual(prevData, data) {
+        s.changes.publish(changeUpdated, netName, peerId, data, "")
+    }
+    s.emitEvent("peer_announced", func() map[string]interface{} {
+        return map[string]interface{}{"peerId": peerId, "networkName": netName, "isHub": peerIsHub, "first": firstAnnounce, "previousNetwork": prevNet}
+    })
+    if prevNet != "" {
+        s.forgetRooms(peerId, reasonNetworkSwitch)
+        if !hiddenPeer(prevData) {
+            s.forwardToLocalPeers(prevNet, outboundMessage{Type: "peer-disconnected", Data: map[string]interface{}{"peerId": peerId, "isHub": peerIsHub, "reason": reasonNetworkSwitch, "timestamp": nowMs()}, FromPeerId: "system", NetworkName: prevNet, Timestamp: nowMs()})
+            s.recordEvent(prevNet, "peer-disconnected", peerId, map[string]interface{}{"reason": reasonNetworkSwitch})
+        }
+        if !peerIsHub {
+            s.announceDisconnectToMesh(peerId, prevNet, reasonNetworkSwitch)
+        }
+    } else if hidden && !firstAnnounce && !hiddenPeer(prevData) {
+        s.forwardToLocalPeers(netName, outboundMessage{Type: "peer-disconnected", Data: map[string]interface{}{"peerId": peerId, "isHub": false, "reason": reasonUnlisted, "timestamp": nowMs()}, FromPeerId: "system", NetworkName: netName, Timestamp: nowMs()})
+        s.recordEvent(netName, "peer-disconnected", peerId, map[string]interface{}{"reason": reasonUnlisted})
+        s.announceDisconnectToMesh(peerId, netName, reasonUnlisted)
+    }
+    if peerIsHub && netName == s.opts.HubMeshNamespace {
+        s.learnMember(peerId, memberURL(data), memberSourceLink)
+    }
+    if t.approval == hubApprovalPending {
+        s.notifyHubApproval(peerId, hubApprovalPending)
+        return
+    }
+    if !s.servesSignaling() && !peerIsHub {
+        // Relay hubs track the peer for relay targeting but leave discovery
+        // to the signaling hubs it is announced to.
+        if !hidden {
+            s.announceToBootstrap(peerId, netName, t.isHub, data)
+        }
+        return
+    }
+    // Under load a same-network re-announce only updates this hub; peers
+    // already know about it.
+    if !firstAnnounce && prevNet == "" && !peerIsHub && s.shedding(shedDiscovery) {
+        return
+    }
+    if !hidden {
+        s.broadcastPeerDiscovered(peerId, netName, t.isHub, data)
+        s.recordEvent(netName, "peer-discovered", peerId, mergeMap(data, map[string]interface{}{"isHub": t.isHub}))
+    }
+    s.notifyIntegrations(integrationWebhook, netName, "peer-announced", mergeMap(data, map[string]interface{}{"peerId": peerId}))
+    // A reconnecting client that still holds a cursor inside the replay
+    // window only needs the delta, not the full peer list.
+    m, _ := t.msg.Data.(map[string]interface{})
+    since, resume := m["eventsSince"].(float64)
+    if !resume || !s.sendEventsSince(peerId, netName, int64(since)) {
+        s.sendPeersToNew(peerId, netName)
+        if s.opts.EventReplaySize > 0 {
+            s.forwardToLocalTarget(peerId, outboundMessage{Type: "event-cursor", Data: map[string]interface{}{"cursor": s.events.cursor(netName)}, FromPeerId: "system", TargetPeer: peerId, NetworkName: netName, Timestamp: nowMs()})
+        }
+    }
+    if !hidden {
+        s.announceToBootstrap(peerId, netName, t.isHub, data)
+    }
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+    "errors"
+    "fmt"
+    "testing"
+    "time"
+)
+
+func TestAnnounceRollsBackOnPartialFailure(t *testing.T) {
+    s := NewServer(Options{})
+    watcher, peer, hub := randomPeerId(), randomPeerId(), randomPeerId()
+    conns := attachTestPeers(t, s, watcher, peer, hub)
+    s.handleMessage(watcher, []byte(`{"type":"announce","networkName":"a","data":{}}`))
+    conns[watcher].take(20 * time.Millisecond)
+    failAt := func(want string) func(string) error {
+        return func(step string) error {
+            if step == want {
+                return errors.New("injected")
+            }
+            return nil
+        }
+    }
+    members := func(netName string) int {
+        s.networkMu.Lock()
+        defer s.networkMu.Unlock()
+        return len(s.networkPeers[netName])
+    }
+    indexed := func(id string) string {
+        s.localIndex.mu.Lock()
+        defer s.localIndex.mu.Unlock()
+        return s.localIndex.peers[id].network
+    }
+
+    // A first announce that fails midway leaves no trace and tells no one.
+    s.announceFault = failAt("hub-registry")
+    s.handleMessage(peer, []byte(`{"type":"announce","networkName":"a","data":{"capabilities":["relay"]}}`))
+    if pi := s.getPeerInfo(peer); pi.Announced || pi.NetworkName != "" || members("a") != 1 || indexed(peer) != "" {
+        t.Fatalf("failed first announce should be undone, got %+v", pi)
+    }
+    if msgs, _ := conns[watcher].take(20 * time.Millisecond); len(msgs) != 0 {
+        t.Fatalf("nothing should be published for a rolled back announce, got %d messages", len(msgs))
+    }
+
+    s.announceFault = nil
+    s.handleMessage(peer, []byte(`{"type":"announce","networkName":"a","data":{"capabilities":["relay"]}}`))
+    conns[watcher].take(20 * time.Millisecond)
+    if indexed(peer) != "a" || members("a") != 2 {
+        t.Fatalf("announce should commit once the fault is gone")
+    }
+
+    // A failed network switch keeps the peer where it was, with its old data.
+    s.announceFault = failAt("confirm")
+    s.handleMessage(peer, []byte(`{"type":"announce","networkName":"b","data":{"capabilities":["storage"]}}`))
+    pi := s.getPeerInfo(peer)
+    if pi.NetworkName != "a" || fmt.Sprint(pi.Data["capabilities"]) != "[relay]" || members("a") != 2 || members("b") != 0 || indexed(peer) != "a" {
+        t.Fatalf("failed switch should restore the previous membership, got %+v", pi)
+    }
+    if msgs, _ := conns[watcher].take(20 * time.Millisecond); len(msgs) != 0 {
+        t.Fatalf("a rolled back switch should not be broadcast, got %d messages", len(msgs))
+    }
+
+    // A hub that fails after registering is not left in the hub registry.
+    s.announceFault = failAt("hub-admission")
+    s.handleMessage(hub, []byte(`{"type":"announce","networkName":"`+s.opts.HubMeshNamespace+`","data":{"isHub":true}}`))
+    s.hubsMu.Lock()
+    _, registered := s.hubs[hub]
+    s.hubsMu.Unlock()
+    if registered || members(s.opts.HubMeshNamespace) != 0 || s.getPeerInfo(hub).IsHub {
+        t.Fatalf("failed hub announce should leave the registry untouched")
+    }
+
+    // A peer that disconnects while its announce is applied is not left in
+    // the index or the registry after cleanup.
+    s.announceFault = func(step string) error {
+        if step == "membership" {
+            s.cleanupPeer(hub)
+        }
+        return nil
+    }
+    s.handleMessage(hub, []byte(`{"type":"announce","networkName":"`+s.opts.HubMeshNamespace+`","data":{"isHub":true}}`))
+    s.hubsMu.Lock()
+    _, registered = s.hubs[hub]
+    s.hubsMu.Unlock()
+    if registered || members(s.opts.HubMeshNamespace) != 0 {
+        t.Fatalf("announce racing a disconnect should be undone")
+    }
+}
@@ -0,0 +1,618 @@
+package server
+
+import (
+    "bufio"
+    "crypto/tls"
+    "encoding/json"
+    "errors"
+    "net"
+    "net/url"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "peerpigeon/internal/resp"
+)
+
+// Backplane. Replicas of one hub behind a load balancer each hold only the
+// peers whose sockets they accept. With BackplaneURL set they share those
+// peers over Redis pub/sub (redis://[user:pass@]host:6379, rediss:// for
+// TLS) or NATS (nats://[user:pass@]host:4222, tls:// for TLS):
+//
+//     <prefix>.net.<network>     announces and departures, keyed by network
+//     <prefix>.replica.<id>      signals for peers on replica <id>
+//     <prefix>.control           hello, heartbeat and bye
+//
+// Every replica subscribes to all network channels, its own replica channel
+// and the control channel. A peer announced on one replica reaches the
+// others' peers on its network as peer-discovered, is in the peer lists they
+// send, and is dropped with peer-disconnected when it leaves. An offer,
+// answer or ice-candidate for a peer on another replica is published to that
+// replica's channel and delivered to the socket there. A replica that starts
+// or reconnects says hello and the others answer with their peers. Replicas
+// publish a heartbeat every BackplaneHeartbeatMs (5000); the peers of one
+// that says bye on shutdown, or misses three heartbeats, are dropped. Dots in network names become underscores in
+// channel names. Delivery is at most once: what the bus cannot take is
+// dropped and counted, and the next hello repairs the directory. Counters
+// are under "backplane" in /metrics.
+const (
+    backplaneQueueSize   = 4096
+    backplaneMaxBackoff  = 30 * time.Second
+    backplaneMissedBeats = 3
+
+    backplaneAnnounce  = "announce"
+    backplaneLeave     = "leave"
+    backplaneSignal    = "signal"
+    backplaneHello     = "hello"
+    backplaneHeartbeat = "heartbeat"
+    backplaneBye       = "bye"
+)
+
+// backplaneEnvelope is the JSON published on every backplane channel.
+type backplaneEnvelope struct {
+    Kind        string                 `json:"kind"`
+    Replica     string                 `json:"replica"`
+    NetworkName string                 `json:"networkName,omitempty"`
+    PeerId      string                 `json:"peerId,omitempty"`
+    Reason      string                 `json:"reason,omitempty"`
+    Data        map[string]interface{} `json:"data,omitempty"`
+    Signal      *outboundMessage       `json:"signal,omitempty"`
+}
+
+// backplaneTransport is a pub/sub connection. subscribe blocks, passing
+// each message on channels, or on a channel matching pattern (a prefix
+// followed by "*"), to deliver until the connection fails or close is
+// called; ready runs once the subscriptions are in place.
+type backplaneTransport interface {
+    publish(channel string, payload []byte) error
+    subscribe(channels []string, pattern string, ready func(), deliver func(channel string, payload []byte)) error
+    close()
+}
+
+func newBackplaneTransport(raw, name string) (backplaneTransport, string, error) {
+    u, err := url.Parse(raw)
+    if err != nil {
+        return nil, "", err
+    }
+    if u.Host == "" {
+        return nil, "", errors.New("BackplaneURL needs a host")
+    }
+    switch u.Scheme {
+    case "redis", "rediss":
+        return &redisBackplane{u: u}, "redis", nil
+    case "nats", "tls":
+        return &natsBackplane{u: u, name: name}, "nats", nil
+    }
+    return nil, "", errors.New("BackplaneURL must be redis://, rediss://, nats:// or tls://")
+}
+
+type backplaneOut struct {
+    channel string
+    env     backplaneEnvelope
+}
+
+type backplaneOwner struct {
+    replica string
+    network string
+}
+
+type backplane struct {
+    s         *Server
+    t         backplaneTransport
+    transport string
+    replica   string
+    prefix    string
+    heartbeat time.Duration
+    queue     chan backplaneOut
+    quit      chan struct{}
+    done      chan struct{}
+    closeOnce sync.Once
+
+    mu       sync.Mutex
+    owners   map[string]backplaneOwner
+    replicas map[string]int64
+
+    connected     int32
+    published     int64
+    received      int64
+    dropped       int64
+    errors        int64
+    reconnects    int64
+    signalsRouted int64
+    signalsIn     int64
+    expired       int64
+}
+
+func newBackplane(s *Server, o Options) (*backplane, error) {
+    replica := firstNonEmpty(s.hubPeerId, s.generatePeerId())
+    t, kind, err := newBackplaneTransport(o.BackplaneURL, "peerpigeon-"+replica)
+    if err != nil {
+        return nil, err
+    }
+    return &backplane{s: s, t: t, transport: kind, replica: replica, prefix: o.BackplanePrefix, heartbeat: time.Duration(o.BackplaneHeartbeatMs) * time.Millisecond, queue: make(chan backplaneOut, backplaneQueueSize), quit: make(chan struct{}), done: make(chan struct{}), owners: map[string]backplaneOwner{}, replicas: map[string]int64{}}, nil
+}
+
+func (b *backplane) networkChannel(netName string) string {
+    return b.prefix + ".net." + strings.ReplaceAll(netName, ".", "_")
+}
+
+func (b *backplane) replicaChannel(replica string) string {
+    return b.prefix + ".replica." + replica
+}
+
+func (b *backplane) controlChannel() string { return b.prefix + ".control" }
+
+// send queues env for channel, dropping it when the queue is full.
+func (b *backplane) send(channel string, env backplaneEnvelope) bool {
+    env.Replica = b.replica
+    select {
+    case b.queue <- backplaneOut{channel: channel, env: env}:
+        return true
+    default:
+        atomic.AddInt64(&b.dropped, 1)
+        return false
+    }
+}
+
+// PublishChange shares a local peer change with the other replicas. A
+// peer that turns hidden leaves them.
+func (b *backplane) PublishChange(c PeerChange) error {
+    env := backplaneEnvelope{Kind: backplaneAnnounce, NetworkName: c.NetworkName, PeerId: c.PeerId, Data: c.Data}
+    if c.Op == changeRemoved {
+        env = backplaneEnvelope{Kind: backplaneLeave, NetworkName: c.NetworkName, PeerId: c.PeerId, Reason: c.Reason}
+    } else if hiddenPeer(c.Data) {
+        env = backplaneEnvelope{Kind: backplaneLeave, NetworkName: c.NetworkName, PeerId: c.PeerId, Reason: reasonUnlisted}
+    }
+    b.send(b.networkChannel(c.NetworkName), env)
+    return nil
+}
+
+// route publishes a signal for target to the replica holding its socket
+// and reports whether one does.
+func (b *backplane) route(target, netName string, msg outboundMessage) bool {
+    b.mu.Lock()
+    owner, ok := b.owners[target]
+    b.mu.Unlock()
+    if !ok || owner.network != netName {
+        return false
+    }
+    if !b.send(b.replicaChannel(owner.replica), backplaneEnvelope{Kind: backplaneSignal, NetworkName: netName, PeerId: target, Signal: &msg}) {
+        return false
+    }
+    atomic.AddInt64(&b.signalsRouted, 1)
+    return true
+}
+
+// runWriter publishes queued envelopes and the heartbeat, and drops the
+// peers of replicas that stopped beating.
+func (b *backplane) runWriter() {
+    defer close(b.done)
+    ticker := time.NewTicker(b.heartbeat)
+    defer ticker.Stop()
+    for {
+        select {
+        case out := <-b.queue:
+            b.write(out)
+        case <-ticker.C:
+            b.write(backplaneOut{channel: b.controlChannel(), env: backplaneEnvelope{Kind: backplaneHeartbeat, Replica: b.replica}})
+            b.expireReplicas()
+        case <-b.quit:
+            for {
+                select {
+                case out := <-b.queue:
+                    b.write(out)
+                default:
+                    return
+                }
+            }
+        }
+    }
+}
+
+func (b *backplane) write(out backplaneOut) {
+    payload, err := json.Marshal(out.env)
+    if err != nil {
+        atomic.AddInt64(&b.dropped, 1)
+        return
+    }
+    if err := b.t.publish(out.channel, payload); err != nil {
+        atomic.AddInt64(&b.errors, 1)
+        atomic.AddInt64(&b.dropped, 1)
+        b.s.log.Warn("backplane_publish_failed", map[string]interface{}{"channel": out.channel, "error": err.Error()})
+        return
+    }
+    atomic.AddInt64(&b.published, 1)
+}
+
+// runReader keeps the subscription up, redialing with backoff, and says
+// hello each time it is in place.
+func (b *backplane) runReader() {
+    backoff := time.Second
+    for {
+        err := b.t.subscribe([]string{b.replicaChannel(b.replica), b.controlChannel()}, b.prefix+".net.*", func() {
+            atomic.StoreInt32(&b.connected, 1)
+            backoff = time.Second
+            b.send(b.controlChannel(), backplaneEnvelope{Kind: backplaneHello})
+            b.s.log.Info("backplane_connected", map[string]interface{}{"transport": b.transport, "replica": b.replica})
+        }, b.receive)
+        atomic.StoreInt32(&b.connected, 0)
+        select {
+        case <-b.quit:
+            return
+        default:
+        }
+        atomic.AddInt64(&b.reconnects, 1)
+        if err != nil {
+            b.s.log.Warn("backplane_disconnected", map[string]interface{}{"error": err.Error(), "retryIn": backoff.String()})
+        }
+        select {
+        case <-time.After(backoff):
+        case <-b.quit:
+            return
+        }
+        if backoff *= 2; backoff > backplaneMaxBackoff {
+            backoff = backplaneMaxBackoff
+        }
+    }
+}
+
+// receive applies an envelope from another replica.
+func (b *backplane) receive(channel string, payload []byte) {
+    defer b.s.recoverPanic("backplane", "reader")
+    var env backplaneEnvelope
+    if json.Unmarshal(payload, &env) != nil || env.Replica == "" || env.Replica == b.replica {
+        return
+    }
+    atomic.AddInt64(&b.received, 1)
+    // A heartbeat from a replica that has not answered a hello, such as one
+    // that expired and came back, asks it for its peers directly.
+    b.mu.Lock()
+    _, known := b.replicas[env.Replica]
+    b.replicas[env.Replica] = nowMs()
+    b.mu.Unlock()
+    if !known && env.Kind == backplaneHeartbeat {
+        b.send(b.replicaChannel(env.Replica), backplaneEnvelope{Kind: backplaneHello})
+    }
+    switch env.Kind {
+    case backplaneHello:
+        b.sendPeers(env.Replica)
+    case backplaneAnnounce:
+        b.applyAnnounce(env)
+    case backplaneBye:
+        b.dropReplica(env.Replica)
+    case backplaneLeave:
+        b.applyLeave(env.Replica, env.NetworkName, env.PeerId, firstNonEmpty(env.Reason, reasonError))
+    case backplaneSignal:
+        if env.Signal != nil && env.Signal.TargetPeer != "" {
+            atomic.AddInt64(&b.signalsIn, 1)
+            b.s.deliverSignal(env.Signal.TargetPeer, *env.Signal)
+        }
+    }
+}
+
+// sendPeers answers a hello with this replica's visible peers.
+func (b *backplane) sendPeers(replica string) {
+    s := b.s
+    type peer struct {
+        id, net string
+        data    map[string]interface{}
+    }
+    peers := []peer{}
+    s.peersMu.Lock()
+    for id, pi := range s.peerData {
+        if pi.Announced && !pi.IsHub && !hiddenPeer(pi.Data) {
+            peers = append(peers, peer{id: id, net: firstNonEmpty(pi.NetworkName, s.opts.DefaultNetwork), data: pi.Data})
+        }
+    }
+    s.peersMu.Unlock()
+    for _, p := range peers {
+        b.send(b.replicaChannel(replica), backplaneEnvelope{Kind: backplaneAnnounce, NetworkName: p.net, PeerId: p.id, Data: p.data})
+    }
+}
+
+func (b *backplane) applyAnnounce(env backplaneEnvelope) {
+    s := b.s
+    id, netName := env.PeerId, firstNonEmpty(env.NetworkName, s.opts.DefaultNetwork)
+    if id == "" || s.getConn(id) != nil {
+        return
+    }
+    b.mu.Lock()
+    prev, known := b.owners[id]
+    b.owners[id] = backplaneOwner{replica: env.Replica, network: netName}
+    b.mu.Unlock()
+    if known && prev.network != netName {
+        b.forget(prev.network, id, reasonNetworkSwitch)
+    }
+    data := mergeMap(env.Data, map[string]interface{}{"peerId": id})
+    s.cacheCrossHubPeer(netName, id, data)
+    s.recordEvent(netName, "peer-discovered", id, data)
+    s.deliverCrossHubDiscovery(netName, id, data)
+}
+
+// applyLeave drops a peer that replica announced, unless it has since
+// been announced by another.
+func (b *backplane) applyLeave(replica, netName, id, reason string) {
+    b.mu.Lock()
+    owner, ok := b.owners[id]
+    if !ok || owner.replica != replica || (netName != "" && owner.network != netName) {
+        b.mu.Unlock()
+        return
+    }
+    delete(b.owners, id)
+    b.mu.Unlock()
+    b.forget(owner.network, id, reason)
+}
+
+// forget removes a peer from the cross-hub cache and tells local peers it
+// has gone.
+func (b *backplane) forget(netName, id, reason string) {
+    s := b.s
+    s.bootstrapMu.Lock()
+    _, cached := s.crossHubCache[netName][id]
+    delete(s.crossHubCache[netName], id)
+    s.bootstrapMu.Unlock()
+    if !cached {
+        return
+    }
+    s.remoteIndex.drop(netName, id)
+    if s.getConn(id) == nil {
+        s.forwardToLocalPeers(netName, outboundMessage{Type: "peer-disconnected", Data: map[string]interface{}{"peerId": id, "isHub": false, "reason": reason, "timestamp": nowMs()}, FromPeerId: "system", NetworkName: netName, Timestamp: nowMs()})
+        s.recordEvent(netName, "peer-disconnected", id, map[string]interface{}{"reason": reason})
+    }
+}
+
+// expireReplicas drops the peers of replicas not heard from for
+// backplaneMissedBeats heartbeats.
+func (b *backplane) expireReplicas() {
+    cutoff := nowMs() - int64(backplaneMissedBeats)*b.heartbeat.Milliseconds()
+    silent := []string{}
+    b.mu.Lock()
+    for replica, seen := range b.replicas {
+        if seen < cutoff {
+            silent = append(silent, replica)
+        }
+    }
+    b.mu.Unlock()
+    for _, replica := range silent {
+        atomic.AddInt64(&b.expired, 1)
+        b.dropReplica(replica)
+    }
+}
+
+// dropReplica forgets a replica and every peer it announced.
+func (b *backplane) dropReplica(replica string) {
+    owned := map[string]string{}
+    b.mu.Lock()
+    delete(b.replicas, replica)
+    for id, owner := range b.owners {
+        if owner.replica == replica {
+            delete(b.owners, id)
+            owned[id] = owner.network
+        }
+    }
+    b.mu.Unlock()
+    for id, netName := range owned {
+        b.forget(netName, id, reasonHubShutdown)
+    }
+}
+
+// close says bye, publishes what is queued, within bridgeCloseTimeout, and
+// drops the connection.
+func (b *backplane) close() {
+    b.closeOnce.Do(func() {
+        b.send(b.controlChannel(), backplaneEnvelope{Kind: backplaneBye})
+        close(b.quit)
+        select {
+        case <-b.done:
+        case <-time.After(bridgeCloseTimeout):
+        }
+        b.t.close()
+    })
+}
+
+func (s *Server) startBackplane() {
+    s.spawn("backplane", "writer", s.backplane.runWriter)
+    s.spawn("backplane", "reader", s.backplane.runReader)
+}
+
+func (s *Server) backplaneSnapshot() map[string]interface{} {
+    b := s.backplane
+    if b == nil {
+        return map[string]interface{}{"enabled": false}
+    }
+    b.mu.Lock()
+    replicas, peers := len(b.replicas), len(b.owners)
+    b.mu.Unlock()
+    return map[string]interface{}{
+        "enabled":          true,
+        "transport":        b.transport,
+        "replica":          b.replica,
+        "connected":        atomic.LoadInt32(&b.connected) == 1,
+        "replicas":         replicas,
+        "remote_peers":     peers,
+        "queued":           len(b.queue),
+        "published":        atomic.LoadInt64(&b.published),
+        "received":         atomic.LoadInt64(&b.received),
+        "dropped":          atomic.LoadInt64(&b.dropped),
+        "errors":           atomic.LoadInt64(&b.errors),
+        "reconnects":       atomic.LoadInt64(&b.reconnects),
+        "signals_routed":   atomic.LoadInt64(&b.signalsRouted),
+        "signals_received": atomic.LoadInt64(&b.signalsIn),
+        "replicas_expired": atomic.LoadInt64(&b.expired),
+    }
+}
+
+// redisBackplane speaks RESP: PUBLISH on one connection, SUBSCRIBE and
+// PSUBSCRIBE on another, since a subscribed connection takes no other
+// commands.
+type redisBackplane struct {
+    u *url.URL
+
+    mu   sync.Mutex
+    pub  net.Conn
+    pubR *bufio.Reader
+    sub  net.Conn
+}
+
+func (t *redisBackplane) dial() (net.Conn, *bufio.Reader, error) {
+    host := t.u.Host
+    if t.u.Port() == "" {
+        host = net.JoinHostPort(t.u.Hostname(), "6379")
+    }
+    conn, err := net.DialTimeout("tcp", host, integrationTimeout)
+    if err != nil {
+        return nil, nil, err
+    }
+    if t.u.Scheme == "rediss" {
+        tc := tls.Client(conn, &tls.Config{ServerName: t.u.Hostname()})
+        if err := tc.Handshake(); err != nil {
+            conn.Close()
+            return nil, nil, err
+        }
+        conn = tc
+    }
+    r := bufio.NewReader(conn)
+    if t.u.User != nil {
+        args := []string{"AUTH", t.u.User.Username()}
+        if pass, ok := t.u.User.Password(); ok {
+            if args[1] == "" {
+                args = args[:1]
+            }
+            args = append(args, pass)
+        }
+        conn.SetDeadline(time.Now().Add(integrationTimeout))
+        if _, err := conn.Write(resp.Command(args...)); err != nil {
+            conn.Close()
+            return nil, nil, err
+        }
+        if _, err := resp.Read(r); err != nil {
+            conn.Close()
+            return nil, nil, err
+        }
+        conn.SetDeadline(time.Time{})
+    }
+    return conn, r, nil
+}
+
+func (t *redisBackplane) publish(channel string, payload []byte) error {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.pub == nil {
+        conn, r, err := t.dial()
+        if err != nil {
+            return err
+        }
+        t.pub, t.pubR = conn, r
+    }
+    t.pub.SetDeadline(time.Now().Add(integrationTimeout))
+    if _, err := t.pub.Write(resp.Command("PUBLISH", channel, string(payload))); err != nil {
+        t.pub.Close()
+        t.pub = nil
+        return err
+    }
+    if _, err := resp.Read(t.pubR); err != nil {
+        t.pub.Close()
+        t.pub = nil
+        return err
+    }
+    return nil
+}
+
+func (t *redisBackplane) subscribe(channels []string, pattern string, ready func(), deliver func(channel string, payload []byte)) error {
+    conn, r, err := t.dial()
+    if err != nil {
+        return err
+    }
+    t.mu.Lock()
+    t.sub = conn
+    t.mu.Unlock()
+    defer conn.Close()
+    cmd := resp.Command(append([]string{"SUBSCRIBE"}, channels...)...)
+    cmd = append(cmd, resp.Command("PSUBSCRIBE", pattern)...)
+    if _, err := conn.Write(cmd); err != nil {
+        return err
+    }
+    pending := len(channels) + 1
+    for {
+        v, err := resp.Read(r)
+        if err != nil {
+            return err
+        }
+        parts, _ := v.([]interface{})
+        if len(parts) < 3 {
+            continue
+        }
+        kind, _ := parts[0].(string)
+        switch kind {
+        case "subscribe", "psubscribe":
+            if pending--; pending == 0 {
+                ready()
+            }
+        case "message":
+            channel, _ := parts[1].(string)
+            payload, _ := parts[2].(string)
+            deliver(channel, []byte(payload))
+        case "pmessage":
+            if len(parts) == 4 {
+                channel, _ := parts[2].(string)
+                payload, _ := parts[3].(string)
+                deliver(channel, []byte(payload))
+            }
+        }
+    }
+}
+
+func (t *redisBackplane) close() {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.pub != nil {
+        t.pub.Close()
+        t.pub = nil
+    }
+    if t.sub != nil {
+        t.sub.Close()
+        t.sub = nil
+    }
+}
+
+// natsBackplane publishes on the connection its current subscription
+// opened.
+type natsBackplane struct {
+    u    *url.URL
+    name string
+
+    mu   sync.Mutex
+    nats *natsTransport
+}
+
+func (t *natsBackplane) publish(channel string, payload []byte) error {
+    t.mu.Lock()
+    n := t.nats
+    t.mu.Unlock()
+    if n == nil {
+        return errors.New("nats: not connected")
+    }
+    return n.pub(channel, payload)
+}
+
+func (t *natsBackplane) subscribe(channels []string, pattern string, ready func(), deliver func(channel string, payload []byte)) error {
+    n := &natsTransport{u: t.u, name: t.name}
+    if err := n.connect(); err != nil {
+        return err
+    }
+    t.mu.Lock()
+    t.nats = n
+    t.mu.Unlock()
+    defer n.close()
+    // NATS wildcards match whole tokens; ">" takes the rest of the subject.
+    subjects := append(append([]string{}, channels...), strings.TrimSuffix(pattern, "*")+">")
+    return n.subscribe(subjects, ready, deliver)
+}
+
+func (t *natsBackplane) close() {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.nats != nil {
+        t.nats.close()
+    }
+}
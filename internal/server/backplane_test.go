@@ -0,0 +1,308 @@
+package server
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "net/url"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    "peerpigeon/internal/resp"
+)
+
+// fakeRedis is enough of a Redis server for the backplane: AUTH, SUBSCRIBE,
+// PSUBSCRIBE and PUBLISH.
+type fakeRedis struct {
+    ln   net.Listener
+    mu   sync.Mutex
+    subs map[net.Conn][]string
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    f := &fakeRedis{ln: ln, subs: map[net.Conn][]string{}}
+    t.Cleanup(func() { ln.Close() })
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go f.serve(conn)
+        }
+    }()
+    return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+    defer func() {
+        f.mu.Lock()
+        delete(f.subs, conn)
+        f.mu.Unlock()
+        conn.Close()
+    }()
+    r := bufio.NewReader(conn)
+    for {
+        v, err := resp.Read(r)
+        if err != nil {
+            return
+        }
+        parts, _ := v.([]interface{})
+        args := make([]string, len(parts))
+        for i, p := range parts {
+            args[i], _ = p.(string)
+        }
+        if len(args) == 0 {
+            continue
+        }
+        f.mu.Lock()
+        switch strings.ToUpper(args[0]) {
+        case "AUTH":
+            if args[len(args)-1] == "secret" {
+                conn.Write([]byte("+OK\r\n"))
+            } else {
+                conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+            }
+        case "SUBSCRIBE", "PSUBSCRIBE":
+            for _, name := range args[1:] {
+                if args[0] == "PSUBSCRIBE" {
+                    name = "pattern:" + name
+                }
+                f.subs[conn] = append(f.subs[conn], name)
+                conn.Write([]byte(fmt.Sprintf("*3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n:%d\r\n", len(args[0]), strings.ToLower(args[0]), len(name), strings.TrimPrefix(name, "pattern:"), len(f.subs[conn]))))
+            }
+        case "PUBLISH":
+            channel, payload := args[1], args[2]
+            n := 0
+            for sub, names := range f.subs {
+                for _, name := range names {
+                    if name == channel {
+                        sub.Write(resp.Command("message", channel, payload))
+                        n++
+                    } else if pattern := strings.TrimPrefix(name, "pattern:"); pattern != name && strings.HasPrefix(channel, strings.TrimSuffix(pattern, "*")) {
+                        sub.Write(resp.Command("pmessage", pattern, channel, payload))
+                        n++
+                    }
+                }
+            }
+            conn.Write([]byte(fmt.Sprintf(":%d\r\n", n)))
+        }
+        f.mu.Unlock()
+    }
+}
+
+func TestBackplaneSharesPeersAndSignalsBetweenReplicas(t *testing.T) {
+    redis := startFakeRedis(t)
+    if _, _, err := (&redisBackplane{u: &url.URL{Scheme: "redis", Host: redis.ln.Addr().String(), User: url.UserPassword("", "wrong")}}).dial(); err == nil {
+        t.Fatalf("a wrong password should fail the dial")
+    }
+    conns := map[string]*pollConn{}
+    var connsMu sync.Mutex
+    replica := func() *Server {
+        s := NewServer(Options{BackplaneURL: "redis://:secret@" + redis.ln.Addr().String(), BackplaneHeartbeatMs: 50})
+        s.spawn("change-sinks", "test", s.runChangeSinks)
+        s.startBackplane()
+        t.Cleanup(s.backplane.close)
+        waitFor(t, "the backplane to subscribe", func() bool { return s.backplaneSnapshot()["connected"] == true })
+        return s
+    }
+    connect := func(s *Server, net string) string {
+        id := randomPeerId()
+        c := attachTestPeer(t, s, id)
+        connsMu.Lock()
+        conns[id] = c
+        connsMu.Unlock()
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"`+net+`","data":{"name":"`+id[:6]+`"}}`))
+        return id
+    }
+    // expect waits for a message of type typ about peer (the sender for
+    // signals) to reach id; other messages are kept for later calls.
+    backlog := map[string][]map[string]interface{}{}
+    expect := func(id, typ, peer string) map[string]interface{} {
+        t.Helper()
+        deadline := time.Now().Add(5 * time.Second)
+        for {
+            for i, m := range backlog[id] {
+                data, _ := m["data"].(map[string]interface{})
+                peers := []interface{}{data}
+                if m["type"] == "peer-list" {
+                    peers, _ = data["peers"].([]interface{})
+                }
+                for _, p := range peers {
+                    d, _ := p.(map[string]interface{})
+                    if (m["type"] == typ || (m["type"] == "peer-list" && typ == "peer-discovered")) && (d["peerId"] == peer || m["fromPeerId"] == peer) {
+                        backlog[id] = append(backlog[id][:i:i], backlog[id][i+1:]...)
+                        return m
+                    }
+                }
+            }
+            if time.Now().After(deadline) {
+                t.Fatalf("%s never received %s about %s", id[:6], typ, peer[:6])
+            }
+            msgs, _ := conns[id].take(20 * time.Millisecond)
+            for _, raw := range msgs {
+                var m map[string]interface{}
+                json.Unmarshal(raw, &m)
+                backlog[id] = append(backlog[id], m)
+            }
+        }
+    }
+
+    one, two := replica(), replica()
+    b := connect(two, "n")
+    a := connect(one, "n")
+    other := connect(one, "elsewhere")
+    expect(b, "peer-discovered", a)
+    c := connect(two, "n")
+    expect(c, "peer-discovered", a)
+    expect(c, "peer-discovered", b)
+
+    two.handleMessage(b, []byte(`{"type":"offer","targetPeerId":"`+a+`","networkName":"n","data":{"type":"offer","sdp":"v=0"}}`))
+    if offer := expect(a, "offer", b); offer["targetPeerId"] != a {
+        t.Fatalf("the offer should reach a on the other replica, got %v", offer)
+    }
+    two.handleMessage(b, []byte(`{"type":"offer","targetPeerId":"`+other+`","networkName":"n","data":{"type":"offer","sdp":"v=0"}}`))
+    if two.backplaneSnapshot()["signals_routed"] != int64(1) {
+        t.Fatalf("a signal for a peer on another network should not be routed, got %v", two.backplaneSnapshot())
+    }
+
+    one.handleDisconnect(a, reasonClientGoodbye, "")
+    if left := expect(b, "peer-disconnected", a); left["data"].(map[string]interface{})["reason"] != reasonClientGoodbye {
+        t.Fatalf("unexpected departure %v", left)
+    }
+    waitFor(t, "a to leave the cache", func() bool {
+        two.bootstrapMu.Lock()
+        defer two.bootstrapMu.Unlock()
+        _, cached := two.crossHubCache["n"][a]
+        return !cached
+    })
+
+    // A replica that joins late learns the others' peers from its hello.
+    three := replica()
+    d := connect(three, "n")
+    expect(d, "peer-discovered", b)
+    expect(d, "peer-discovered", c)
+
+    // A replica that stops says bye; one that goes silent expires.
+    two.backplane.close()
+    expect(d, "peer-disconnected", b)
+    expect(d, "peer-disconnected", c)
+    e := connect(one, "n")
+    expect(d, "peer-discovered", e)
+    three.backplane.mu.Lock()
+    three.backplane.replicas[one.backplane.replica] = 0
+    three.backplane.mu.Unlock()
+    three.backplane.expireReplicas()
+    if left := expect(d, "peer-disconnected", e); left["data"].(map[string]interface{})["reason"] != reasonHubShutdown {
+        t.Fatalf("unexpected expiry %v", left)
+    }
+    if snap := three.backplaneSnapshot(); snap["replicas_expired"] != int64(1) {
+        t.Fatalf("unexpected backplane metrics %v", snap)
+    }
+    // Its next heartbeat shows it is back, and it is asked for its peers.
+    expect(d, "peer-discovered", e)
+}
+
+// TestNATSBackplaneSubscribesAndPublishes drives the NATS backplane
+// against a fake server that routes PUB to matching SUBs.
+func TestNATSBackplaneSubscribesAndPublishes(t *testing.T) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    type sub struct {
+        conn    net.Conn
+        subject string
+        sid     string
+    }
+    var mu sync.Mutex
+    subs := []sub{}
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                conn.Write([]byte("INFO {\"server_id\":\"test\"}\r\n"))
+                r := bufio.NewReader(conn)
+                for {
+                    line, err := r.ReadString('\n')
+                    if err != nil {
+                        return
+                    }
+                    f := strings.Fields(line)
+                    mu.Lock()
+                    switch {
+                    case len(f) == 0:
+                    case f[0] == "PING":
+                        conn.Write([]byte("PONG\r\n"))
+                    case f[0] == "SUB" && len(f) == 3:
+                        subs = append(subs, sub{conn, f[1], f[2]})
+                    case f[0] == "PUB" && len(f) == 3:
+                        var n int
+                        fmt.Sscan(f[2], &n)
+                        payload := make([]byte, n+2)
+                        if _, err := io.ReadFull(r, payload); err != nil {
+                            mu.Unlock()
+                            return
+                        }
+                        for _, s := range subs {
+                            if s.subject == f[1] || (strings.HasSuffix(s.subject, ">") && strings.HasPrefix(f[1], strings.TrimSuffix(s.subject, ">"))) {
+                                fmt.Fprintf(s.conn, "MSG %s %s %d\r\n%s", f[1], s.sid, n, payload)
+                            }
+                        }
+                    }
+                    mu.Unlock()
+                }
+            }()
+        }
+    }()
+    bp := &natsBackplane{u: &url.URL{Scheme: "nats", Host: ln.Addr().String()}, name: "test"}
+    if err := bp.publish("bp.control", []byte("{}")); err == nil {
+        t.Fatalf("publishing before the subscription is up should fail")
+    }
+    ready := make(chan struct{})
+    got := make(chan string, 10)
+    done := make(chan error, 1)
+    go func() {
+        done <- bp.subscribe([]string{"bp.replica.x", "bp.control"}, "bp.net.*", func() { close(ready) }, func(channel string, payload []byte) {
+            got <- channel + " " + string(payload)
+        })
+    }()
+    select {
+    case <-ready:
+    case <-time.After(5 * time.Second):
+        t.Fatal("timed out waiting for the subscriptions")
+    }
+    for _, channel := range []string{"bp.elsewhere", "bp.net.lobby", "bp.replica.x"} {
+        if err := bp.publish(channel, []byte(`{"n":1}`)); err != nil {
+            t.Fatalf("publish %s: %v", channel, err)
+        }
+    }
+    for _, want := range []string{`bp.net.lobby {"n":1}`, `bp.replica.x {"n":1}`} {
+        select {
+        case m := <-got:
+            if m != want {
+                t.Fatalf("got %q, want %q", m, want)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatalf("timed out waiting for %q", want)
+        }
+    }
+    bp.close()
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("subscribe should return once the backplane is closed")
+    }
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+    "encoding/json"
+    "strings"
+    "sync/atomic"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+    "peerpigeon/internal/msgpack"
+)
+
+// Binary framing. A WebSocket client that connects with ?proto=msgpack, or
+// offers the "peerpigeon.msgpack" subprotocol, gets every message as a
+// binary frame holding the usual envelope encoded as MessagePack instead of
+// JSON text, which roughly halves the size of ICE candidate storms. It may
+// send binary MessagePack frames too; text frames are still read as JSON.
+// The choice is fixed for the life of the connection. JSON stays the
+// default, and legacy (protocol version 0) clients and long-polling sessions
+// always use JSON; hub links negotiate their own (see meshencoding.go).
+// Client frame counts are under "binary_framing" in /metrics.
+const (
+    protoMsgpack       = "msgpack"
+    subprotocolMsgpack = "peerpigeon.msgpack"
+)
+
+type binaryStats struct {
+    conns   int64
+    sent    int64
+    recv    int64
+    invalid int64
+}
+
+// negotiateBinary reports whether a new WebSocket connection asked for
+// MessagePack framing, and the subprotocol to confirm in the upgrade
+// response, if it asked with one.
+func (s *Server) negotiateBinary(c *gin.Context) (bool, string) {
+    if connPath(c) == pathMesh {
+        return false, ""
+    }
+    for _, p := range websocket.Subprotocols(c.Request) {
+        if strings.EqualFold(p, subprotocolMsgpack) {
+            return true, subprotocolMsgpack
+        }
+    }
+    return strings.EqualFold(c.Query("proto"), protoMsgpack), ""
+}
+
+func isBinaryConn(conn peerConn) bool {
+    wc, ok := conn.(*wsPeerConn)
+    return ok && atomic.LoadInt32(&wc.binary) == 1
+}
+
+// writeBinary sends msg to conn as a MessagePack frame.
+func (s *Server) writeBinary(conn peerConn, msg outboundMessage) bool {
+    b, err := msgpack.Marshal(msg)
+    if err != nil {
+        return false
+    }
+    if !isMeshLink(conn) {
+        atomic.AddInt64(&s.binary.sent, 1)
+    }
+    return s.deliver(conn, msg.Type, websocket.BinaryMessage, b)
+}
+
+// readFrame turns a frame read from conn into the JSON handleMessage
+// expects, reporting false for an undecodable binary frame.
+func (s *Server) readFrame(conn *wsPeerConn, messageType int, data []byte) ([]byte, bool) {
+    mesh := isMeshLink(conn)
+    if mesh {
+        s.countMeshFrame(false, messageType, len(data))
+    }
+    if messageType != websocket.BinaryMessage || !mesh && !isBinaryConn(conn) {
+        return data, true
+    }
+    b, err := msgpack.ToJSON(data)
+    if err != nil || !json.Valid(b) {
+        atomic.AddInt64(&s.binary.invalid, 1)
+        return nil, false
+    }
+    if !mesh {
+        atomic.AddInt64(&s.binary.recv, 1)
+    }
+    return b, true
+}
+
+func (s *Server) binarySnapshot() map[string]interface{} {
+    return map[string]interface{}{"connections": atomic.LoadInt64(&s.binary.conns), "sent": atomic.LoadInt64(&s.binary.sent), "received": atomic.LoadInt64(&s.binary.recv), "invalid": atomic.LoadInt64(&s.binary.invalid)}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+    "peerpigeon/internal/msgpack"
+)
+
+func TestBinaryFramingIsNegotiatedPerConnection(t *testing.T) {
+    s := NewServer(Options{MaxConnections: 10})
+    gin.SetMode(gin.TestMode)
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    base := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?peerId="
+    a, b := randomPeerId(), randomPeerId()
+    ca, _, err := websocket.DefaultDialer.Dial(base+a+"&proto=msgpack", nil)
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    defer ca.Close()
+    dialer := websocket.Dialer{Subprotocols: []string{subprotocolMsgpack}}
+    cb, res, err := dialer.Dial(base+b, nil)
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    defer cb.Close()
+    if res.Header.Get("Sec-WebSocket-Protocol") != subprotocolMsgpack {
+        t.Fatalf("subprotocol should be confirmed, got %q", res.Header.Get("Sec-WebSocket-Protocol"))
+    }
+    next := func(c *websocket.Conn, typ string) map[string]interface{} {
+        c.SetReadDeadline(time.Now().Add(2 * time.Second))
+        for {
+            kind, data, err := c.ReadMessage()
+            if err != nil {
+                t.Fatalf("waiting for %s: %v", typ, err)
+            }
+            if kind != websocket.BinaryMessage {
+                t.Fatalf("expected a binary frame, got %s", data)
+            }
+            v, err := msgpack.Unmarshal(data)
+            if err != nil {
+                t.Fatalf("decode: %v", err)
+            }
+            if m := v.(map[string]interface{}); m["type"] == typ {
+                return m
+            }
+        }
+    }
+    next(ca, "connected")
+    next(cb, "connected")
+
+    // Binary and text frames are both accepted from a binary client.
+    announce, _ := msgpack.FromJSON([]byte(`{"type":"announce","networkName":"bin","data":{"name":"a"}}`))
+    ca.WriteMessage(websocket.BinaryMessage, announce)
+    waitFor(t, "binary announce", func() bool { pi := s.getPeerInfo(a); return pi != nil && pi.Announced })
+    cb.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "bin", "data": map[string]interface{}{"name": "b"}})
+    m := next(cb, "peer-discovered")
+    if d, _ := m["data"].(map[string]interface{}); d["peerId"] != a || d["name"] != "a" {
+        t.Fatalf("unexpected peer-discovered: %v", m)
+    }
+    ca.WriteMessage(websocket.BinaryMessage, []byte{0xa5, 'x'})
+    waitFor(t, "invalid frame counted", func() bool { return atomic.LoadInt64(&s.binary.invalid) == 1 })
+
+    // A plain client still gets JSON text.
+    plain := randomPeerId()
+    cp, _, err := websocket.DefaultDialer.Dial(base+plain, nil)
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    defer cp.Close()
+    cp.SetReadDeadline(time.Now().Add(2 * time.Second))
+    if kind, data, err := cp.ReadMessage(); err != nil || kind != websocket.TextMessage || !json.Valid(data) {
+        t.Fatalf("plain client should get JSON text: %v %v", kind, err)
+    }
+    if n := atomic.LoadInt64(&s.binary.conns); n != 2 {
+        t.Fatalf("expected 2 binary connections, got %d", n)
+    }
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "hash"
+    "sync"
+)
+
+const (
+    blobChunkSize   = 64 * 1024
+    blobIdleTimeout = 5 * 60 * 1000
+)
+
+// blobRelay stores blobs pushed by peers that cannot open a WebRTC channel
+// and forwards them to the target once complete and verified. Transfers are
+// keyed by sender and blobId so a sender can reconnect and resume.
+type blobRelay struct {
+    mu        sync.Mutex
+    transfers map[string]*blobTransfer
+    usage     map[string]int64
+}
+
+type blobTransfer struct {
+    id          string
+    from        string
+    target      string
+    networkName string
+    size        int64
+    sha256      string
+    buf         []byte
+    hasher      hash.Hash
+    lastActive  int64
+}
+
+func newBlobRelay() *blobRelay {
+    return &blobRelay{transfers: map[string]*blobTransfer{}, usage: map[string]int64{}}
+}
+
+func (s *Server) handleBlob(peerId string, msg inboundMessage) {
+    conn := s.getConn(peerId)
+    m, _ := msg.Data.(map[string]interface{})
+    blobId, _ := m["blobId"].(string)
+    if s.opts.BlobMaxBytes <= 0 {
+        s.sendBlobError(peerId, blobId, "blob relay disabled")
+        return
+    }
+    if blobId == "" {
+        s.sendError(conn, peerId, "blobId required")
+        return
+    }
+    key := peerId + ":" + blobId
+    switch msg.Type {
+    case "blob-start":
+        s.startBlob(peerId, key, blobId, msg, m)
+    case "blob-chunk":
+        s.appendBlobChunk(peerId, key, blobId, m)
+    case "blob-end":
+        s.finishBlob(peerId, key, blobId)
+    }
+}
+
+func (s *Server) startBlob(peerId, key, blobId string, msg inboundMessage, m map[string]interface{}) {
+    r := s.blobs
+    r.mu.Lock()
+    if t := r.transfers[key]; t != nil {
+        // Resume: tell the sender where to continue from.
+        t.lastActive = nowMs()
+        offset := len(t.buf)
+        r.mu.Unlock()
+        s.sendBlobAck(peerId, blobId, offset, false)
+        return
+    }
+    size, _ := m["size"].(float64)
+    sum, _ := m["sha256"].(string)
+    if msg.TargetPeer == "" || size <= 0 || len(sum) != 64 {
+        r.mu.Unlock()
+        s.sendBlobError(peerId, blobId, "blob-start requires targetPeerId, size and sha256")
+        return
+    }
+    if int64(size) > int64(s.opts.BlobMaxBytes) {
+        r.mu.Unlock()
+        s.sendBlobError(peerId, blobId, "blob exceeds maximum size")
+        return
+    }
+    if s.opts.BlobQuotaBytes > 0 && r.usage[peerId]+int64(size) > int64(s.opts.BlobQuotaBytes) {
+        r.mu.Unlock()
+        s.sendBlobError(peerId, blobId, "blob quota exceeded")
+        s.penalize(peerId, offenceRateLimit, "blob quota")
+        return
+    }
+    r.usage[peerId] += int64(size)
+    r.transfers[key] = &blobTransfer{id: blobId, from: peerId, target: msg.TargetPeer, networkName: firstNonEmpty(msg.NetworkName, s.opts.DefaultNetwork), size: int64(size), sha256: sum, hasher: sha256.New(), lastActive: nowMs()}
+    r.mu.Unlock()
+    s.sendBlobAck(peerId, blobId, 0, false)
+}
+
+func (s *Server) appendBlobChunk(peerId, key, blobId string, m map[string]interface{}) {
+    offset, _ := m["offset"].(float64)
+    enc, _ := m["chunk"].(string)
+    chunk, err := base64.StdEncoding.DecodeString(enc)
+    if err != nil || len(chunk) == 0 {
+        s.sendBlobError(peerId, blobId, "chunk must be non-empty base64")
+        return
+    }
+    r := s.blobs
+    r.mu.Lock()
+    t := r.transfers[key]
+    if t == nil {
+        r.mu.Unlock()
+        s.sendBlobError(peerId, blobId, "unknown blob")
+        return
+    }
+    if int(offset) != len(t.buf) {
+        have := len(t.buf)
+        r.mu.Unlock()
+        s.sendBlobAck(peerId, blobId, have, false)
+        return
+    }
+    if int64(len(t.buf)+len(chunk)) > t.size {
+        r.mu.Unlock()
+        s.sendBlobError(peerId, blobId, "chunk exceeds declared size")
+        return
+    }
+    t.buf = append(t.buf, chunk...)
+    t.hasher.Write(chunk)
+    t.lastActive = nowMs()
+    r.mu.Unlock()
+}
+
+// finishBlob verifies the assembled blob and delivers it to the target in
+// blob-start/blob-chunk/blob-end messages. The quota is released either way.
+func (s *Server) finishBlob(peerId, key, blobId string) {
+    r := s.blobs
+    r.mu.Lock()
+    t := r.transfers[key]
+    if t == nil {
+        r.mu.Unlock()
+        s.sendBlobError(peerId, blobId, "unknown blob")
+        return
+    }
+    if int64(len(t.buf)) != t.size {
+        have := len(t.buf)
+        r.mu.Unlock()
+        s.sendBlobAck(peerId, blobId, have, false)
+        return
+    }
+    r.releaseLocked(key, t)
+    r.mu.Unlock()
+    if hex.EncodeToString(t.hasher.Sum(nil)) != t.sha256 {
+        s.sendBlobError(peerId, blobId, "sha256 mismatch")
+        return
+    }
+    if !s.deliverBlob(t) {
+        s.sendBlobError(peerId, blobId, "target peer not connected")
+        return
+    }
+    s.sendBlobAck(peerId, blobId, len(t.buf), true)
+}
+
+func (s *Server) deliverBlob(t *blobTransfer) bool {
+    conn := s.getConn(t.target)
+    if conn == nil {
+        return false
+    }
+    base := outboundMessage{FromPeerId: t.from, TargetPeer: t.target, NetworkName: t.networkName}
+    start := base
+    start.Type, start.Timestamp = "blob-start", nowMs()
+    start.Data = map[string]interface{}{"blobId": t.id, "size": t.size, "sha256": t.sha256}
+    s.sendToConn(conn, start)
+    for off := 0; off < len(t.buf); off += blobChunkSize {
+        end := off + blobChunkSize
+        if end > len(t.buf) {
+            end = len(t.buf)
+        }
+        chunk := base
+        chunk.Type, chunk.Timestamp = "blob-chunk", nowMs()
+        chunk.Data = map[string]interface{}{"blobId": t.id, "offset": off, "chunk": base64.StdEncoding.EncodeToString(t.buf[off:end])}
+        s.sendToConn(conn, chunk)
+    }
+    done := base
+    done.Type, done.Timestamp = "blob-end", nowMs()
+    done.Data = map[string]interface{}{"blobId": t.id}
+    return s.sendToConn(conn, done)
+}
+
+func (r *blobRelay) releaseLocked(key string, t *blobTransfer) {
+    delete(r.transfers, key)
+    r.usage[t.from] -= t.size
+    if r.usage[t.from] <= 0 {
+        delete(r.usage, t.from)
+    }
+}
+
+// expire drops transfers that have been idle too long, freeing their quota.
+func (r *blobRelay) expire(now int64) {
+    r.mu.Lock()
+    for key, t := range r.transfers {
+        if now-t.lastActive > blobIdleTimeout {
+            r.releaseLocked(key, t)
+        }
+    }
+    r.mu.Unlock()
+}
+
+func (s *Server) sendBlobAck(peerId, blobId string, offset int, complete bool) {
+    s.forwardToLocalTarget(peerId, outboundMessage{Type: "blob-ack", Data: map[string]interface{}{"blobId": blobId, "offset": offset, "complete": complete}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+}
+
+func (s *Server) sendBlobError(peerId, blobId, message string) {
+    s.forwardToLocalTarget(peerId, outboundMessage{Type: "blob-error", Data: map[string]interface{}{"blobId": blobId, "message": message}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+}
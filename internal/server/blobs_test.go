@@ -0,0 +1,32 @@
+package server
+
+import (
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "strings"
+    "testing"
+)
+
+func TestBlobRelayAssemblesAndReleasesQuota(t *testing.T) {
+    s := NewServer(Options{BlobMaxBytes: 1 << 20, BlobQuotaBytes: 1000})
+    from := "0123456789abcdef0123456789abcdef01234567"
+    payload := []byte(strings.Repeat("x", 600))
+    sum := sha256.Sum256(payload)
+    start := inboundMessage{Type: "blob-start", TargetPeer: "target", Data: map[string]interface{}{"blobId": "b1", "size": float64(len(payload)), "sha256": hex.EncodeToString(sum[:])}}
+    s.handleBlob(from, start)
+    over := start
+    over.Data = map[string]interface{}{"blobId": "b2", "size": float64(600), "sha256": hex.EncodeToString(sum[:])}
+    s.handleBlob(from, over)
+    if _, ok := s.blobs.transfers[from+":b2"]; ok {
+        t.Fatalf("second blob should exceed the quota")
+    }
+    s.handleBlob(from, inboundMessage{Type: "blob-chunk", Data: map[string]interface{}{"blobId": "b1", "offset": float64(0), "chunk": base64.StdEncoding.EncodeToString(payload)}})
+    if got := len(s.blobs.transfers[from+":b1"].buf); got != len(payload) {
+        t.Fatalf("expected %d buffered bytes, got %d", len(payload), got)
+    }
+    s.handleBlob(from, inboundMessage{Type: "blob-end", Data: map[string]interface{}{"blobId": "b1"}})
+    if len(s.blobs.transfers) != 0 || s.blobs.usage[from] != 0 {
+        t.Fatalf("completed transfer should release its quota")
+    }
+}
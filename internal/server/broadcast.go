@@ -0,0 +1,141 @@
+package server
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "sync"
+)
+
+// appBroadcastLimiter enforces the per-peer app-broadcast rate in fixed
+// one-second windows.
+type appBroadcastLimiter struct {
+    mu      sync.Mutex
+    windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+    start int64
+    count int
+}
+
+func newAppBroadcastLimiter() *appBroadcastLimiter {
+    return &appBroadcastLimiter{windows: map[string]*rateWindow{}}
+}
+
+func (l *appBroadcastLimiter) allow(peerId string, perSec int) bool {
+    if perSec <= 0 {
+        return true
+    }
+    now := nowMs()
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    w := l.windows[peerId]
+    if w == nil || now-w.start >= 1000 {
+        w = &rateWindow{start: now}
+        l.windows[peerId] = w
+    }
+    w.count++
+    return w.count <= perSec
+}
+
+func (l *appBroadcastLimiter) forget(peerId string) {
+    l.mu.Lock()
+    delete(l.windows, peerId)
+    l.mu.Unlock()
+}
+
+func (s *Server) appBroadcastEnabled(netName string) bool {
+    for _, n := range s.opts.AppBroadcastNetworks {
+        if n == "*" || n == netName {
+            return true
+        }
+    }
+    return false
+}
+
+// handleAppBroadcast relays application data from a peer to every other
+// peer in the network it announced into, on this hub and across the mesh.
+// Only verified hub links may relay broadcasts from elsewhere.
+func (s *Server) handleAppBroadcast(peerId string, msg inboundMessage, resp outboundMessage) {
+    conn := s.getConn(peerId)
+    pi := s.getPeerInfo(peerId)
+    if pi != nil && pi.IsHub {
+        s.relayAppBroadcast(peerId, "", msg)
+        return
+    }
+    if pi == nil || !pi.Announced {
+        s.sendToConn(conn, outboundMessage{Type: "error", Data: map[string]interface{}{"code": errNotAnnounced, "message": "announce before broadcasting"}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+        return
+    }
+    netName := firstNonEmpty(pi.NetworkName, s.opts.DefaultNetwork)
+    if msg.NetworkName != netName {
+        s.sendError(conn, peerId, "app-broadcast networkName does not match the announced network "+netName)
+        return
+    }
+    if s.shedding(shedAppBroadcast) {
+        s.rejectShed(peerId, msg.Type)
+        return
+    }
+    resp.NetworkName = netName
+    if !s.appBroadcastEnabled(netName) {
+        s.sendError(conn, peerId, "app-broadcast disabled for network "+netName)
+        return
+    }
+    if b, _ := json.Marshal(msg.Data); s.opts.AppBroadcastMaxBytes > 0 && len(b) > s.opts.AppBroadcastMaxBytes {
+        s.sendError(conn, peerId, "app-broadcast payload too large")
+        return
+    }
+    if !s.appBroadcasts.allow(peerId, s.appBroadcastRate()) {
+        s.sendError(conn, peerId, "app-broadcast rate limit exceeded")
+        s.penalize(peerId, offenceRateLimit, "app-broadcast")
+        return
+    }
+    resp.FromPeerId = peerId
+    resp.MessageId = newMessageId()
+    s.markRelayed("app-broadcast:" + resp.MessageId)
+    s.deliverAppBroadcast(peerId, resp)
+    s.notifyIntegrations(integrationBridge, netName, "app-broadcast", map[string]interface{}{"fromPeerId": peerId, "messageId": resp.MessageId, "payload": msg.Data})
+    s.forwardToMesh(resp, "", "")
+}
+
+// relayAppBroadcast handles an app-broadcast arriving from another hub,
+// either over a bootstrap link (fromUri) or an inbound hub connection.
+func (s *Server) relayAppBroadcast(fromHub, fromUri string, msg inboundMessage) {
+    netName := firstNonEmpty(msg.NetworkName, s.opts.DefaultNetwork)
+    if msg.MessageId == "" || s.alreadyVisited(msg) || !s.appBroadcastEnabled(netName) || !s.markRelayed("app-broadcast:"+msg.MessageId) {
+        return
+    }
+    resp := outboundMessage{Type: "app-broadcast", Data: msg.Data, FromPeerId: msg.FromPeerId, NetworkName: netName, Timestamp: nowMs(), MessageId: msg.MessageId, OriginHub: msg.OriginHub, SeenHubs: msg.SeenHubs, Hops: msg.Hops}
+    s.deliverAppBroadcast(msg.FromPeerId, resp)
+    s.forwardToMesh(resp, fromUri, fromHub)
+}
+
+func (s *Server) deliverAppBroadcast(sender string, msg outboundMessage) {
+    for _, id := range s.getActivePeers(sender, msg.NetworkName) {
+        if pi := s.getPeerInfo(id); pi != nil && pi.IsHub {
+            continue
+        }
+        m := msg
+        m.TargetPeer = id
+        s.forwardToLocalTarget(id, m)
+    }
+}
+
+// markRelayed records id in the relay dedupe table and reports whether it
+// was new.
+func (s *Server) markRelayed(id string) bool {
+    s.relayMu.Lock()
+    defer s.relayMu.Unlock()
+    if _, ok := s.relayed[id]; ok {
+        return false
+    }
+    s.relayed[id] = nowMs()
+    return true
+}
+
+func newMessageId() string {
+    b := make([]byte, 16)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
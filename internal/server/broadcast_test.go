@@ -0,0 +1,57 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "testing"
+    "time"
+)
+
+func TestAppBroadcastNetworkFlagAndRateLimit(t *testing.T) {
+    s := NewServer(Options{AppBroadcastNetworks: []string{"lobby"}})
+    if !s.appBroadcastEnabled("lobby") || s.appBroadcastEnabled("global") {
+        t.Fatalf("app-broadcast should only be enabled for lobby")
+    }
+    l := newAppBroadcastLimiter()
+    if !l.allow("p", 2) || !l.allow("p", 2) || l.allow("p", 2) {
+        t.Fatalf("third broadcast within a second should be limited")
+    }
+    if !l.allow("q", 2) {
+        t.Fatalf("limits should be per peer")
+    }
+}
+
+func TestAppBroadcastStaysInTheAnnouncedNetwork(t *testing.T) {
+    s := NewServer(Options{AppBroadcastNetworks: []string{"*"}})
+    sender, lobby, other, quiet := randomPeerId(), randomPeerId(), randomPeerId(), randomPeerId()
+    conns := attachTestPeers(t, s, sender, lobby, other, quiet)
+    s.handleMessage(sender, []byte(`{"type":"announce","networkName":"lobby","data":{}}`))
+    s.handleMessage(lobby, []byte(`{"type":"announce","networkName":"lobby","data":{}}`))
+    s.handleMessage(other, []byte(`{"type":"announce","networkName":"other","data":{}}`))
+    types := func(id string) []string {
+        msgs, _ := conns[id].take(20 * time.Millisecond)
+        var out []string
+        for _, raw := range msgs {
+            var m outboundMessage
+            json.Unmarshal(raw, &m)
+            out = append(out, m.Type)
+        }
+        return out
+    }
+    for _, id := range []string{sender, lobby, other} {
+        types(id)
+    }
+
+    s.handleMessage(sender, []byte(`{"type":"app-broadcast","networkName":"other","data":{"x":1}}`))
+    if got := types(sender); fmt.Sprint(got) != "[error]" || len(types(other)) != 0 {
+        t.Fatalf("broadcast into another network should be refused, got %v", got)
+    }
+    s.handleMessage(quiet, []byte(`{"type":"app-broadcast","networkName":"lobby","data":{"x":1}}`))
+    if got := types(quiet); fmt.Sprint(got) != "[error]" || len(types(lobby)) != 0 {
+        t.Fatalf("broadcast before announcing should be refused, got %v", got)
+    }
+    s.handleMessage(sender, []byte(`{"type":"app-broadcast","networkName":"lobby","data":{"x":1}}`))
+    if got := types(lobby); fmt.Sprint(got) != "[app-broadcast]" || len(types(other)) != 0 {
+        t.Fatalf("broadcast should reach only the sender's network, got %v", got)
+    }
+}
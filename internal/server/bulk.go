@@ -0,0 +1,165 @@
+package server
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "net/http"
+    "sort"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+// Bulk admin operations act on everything matching a network, or on every
+// guest link, in one call. With ?dryRun=true they only report what they
+// would affect, so an operator can check the blast radius first; only real
+// runs are written to the audit log. Each answers
+//
+//     {"action": "...", "dryRun": false, "count": 3, "affected": [...]}
+
+func (s *Server) writeBulk(c *gin.Context, action string, dryRun bool, affected interface{}, count int, details map[string]interface{}) {
+    if !dryRun {
+        details["count"] = count
+        s.audit(c, action, details)
+    }
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"action": action, "dryRun": dryRun, "count": count, "affected": affected}, s.opts.CORSOrigin)
+}
+
+// bulkBody decodes an optional JSON body into v.
+func bulkBody(c *gin.Context, v interface{}) bool {
+    if c.Request.ContentLength == 0 {
+        return true
+    }
+    return json.NewDecoder(c.Request.Body).Decode(v) == nil
+}
+
+// bulkNetwork resolves the network a bulk request names, answering 400 when
+// it is missing or not permitted.
+func (s *Server) bulkNetwork(c *gin.Context, name string) (string, bool) {
+    netName, ok := s.resolveNetwork(name)
+    if name == "" || !ok {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "a valid network is required"}, s.opts.CORSOrigin)
+        return "", false
+    }
+    return netName, true
+}
+
+// adminBulkDisconnect disconnects every local peer announced on a network:
+// {"network": "...", "reason": "..."}. Hub links are never included.
+func (s *Server) adminBulkDisconnect(c *gin.Context) {
+    var body struct {
+        Network string `json:"network"`
+        Reason  string `json:"reason"`
+    }
+    if !bulkBody(c, &body) {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "invalid JSON body"}, s.opts.CORSOrigin)
+        return
+    }
+    netName, ok := s.bulkNetwork(c, body.Network)
+    if !ok {
+        return
+    }
+    dryRun := c.Query("dryRun") == "true"
+    s.peersMu.Lock()
+    s.networkMu.Lock()
+    ids := []string{}
+    for id := range s.networkPeers[netName] {
+        if pi := s.peerData[id]; pi != nil && !pi.IsHub {
+            ids = append(ids, id)
+        }
+    }
+    s.networkMu.Unlock()
+    s.peersMu.Unlock()
+    sort.Strings(ids)
+    reason := firstNonEmpty(body.Reason, "bulk disconnect by operator")
+    if !dryRun {
+        for _, id := range ids {
+            if conn := s.getConn(id); conn != nil {
+                s.handleDisconnect(id, reasonKicked, reason)
+                closeWithReason(conn, websocket.ClosePolicyViolation, reasonKicked)
+            }
+        }
+    }
+    s.writeBulk(c, "bulk-disconnect", dryRun, ids, len(ids), map[string]interface{}{"networkName": netName, "reason": reason})
+}
+
+// adminBulkPurgeCache drops every remote peer this hub has cached for a
+// network, e.g. after a partition left stale entries; they are learned again
+// from gossip.
+func (s *Server) adminBulkPurgeCache(c *gin.Context) {
+    var body struct {
+        Network string `json:"network"`
+    }
+    if !bulkBody(c, &body) {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "invalid JSON body"}, s.opts.CORSOrigin)
+        return
+    }
+    netName, ok := s.bulkNetwork(c, body.Network)
+    if !ok {
+        return
+    }
+    dryRun := c.Query("dryRun") == "true"
+    ids := []string{}
+    if dryRun {
+        for id := range s.cachedPeers(netName) {
+            ids = append(ids, id)
+        }
+        sort.Strings(ids)
+    } else {
+        ids = s.purgeCrossHubCache(netName)
+    }
+    s.writeBulk(c, "bulk-purge-cache", dryRun, ids, len(ids), map[string]interface{}{"networkName": netName})
+}
+
+// adminBulkRotateGuestLinks replaces every listed guest link with a fresh
+// one carrying the same network, expiry and quotas, and revokes the old one,
+// disconnecting its guests: {"hubUrl": "..."}. The new tokens are in the
+// response and nowhere else.
+func (s *Server) adminBulkRotateGuestLinks(c *gin.Context) {
+    if s.opts.GuestLinkSecret == "" {
+        writeJSON(c.Writer, http.StatusNotImplemented, map[string]interface{}{"error": "guest links disabled"}, s.opts.CORSOrigin)
+        return
+    }
+    var body struct {
+        HubURL string `json:"hubUrl"`
+    }
+    if !bulkBody(c, &body) {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "invalid JSON body"}, s.opts.CORSOrigin)
+        return
+    }
+    dryRun := c.Query("dryRun") == "true"
+    now := nowMs()
+    r := s.guests
+    r.mu.Lock()
+    active := map[string]int{}
+    for _, g := range r.sessions {
+        active[g.link.Id]++
+    }
+    old := []GuestLink{}
+    for id, l := range r.links {
+        if _, revoked := r.revoked[id]; !revoked && l.ExpiresAt > now {
+            old = append(old, *l)
+        }
+    }
+    sort.Slice(old, func(i, j int) bool { return old[i].CreatedAt < old[j].CreatedAt })
+    affected := make([]map[string]interface{}, 0, len(old))
+    for _, l := range old {
+        entry := map[string]interface{}{"id": l.Id, "network": l.Network, "expiresAt": l.ExpiresAt, "activePeers": active[l.Id]}
+        if !dryRun {
+            b := make([]byte, 8)
+            rand.Read(b)
+            n := GuestLink{Id: hex.EncodeToString(b), Network: l.Network, ExpiresAt: l.ExpiresAt, MaxPeers: l.MaxPeers, RatePerSec: l.RatePerSec, CreatedAt: now}
+            r.links[n.Id] = &n
+            r.revoked[l.Id] = l.ExpiresAt
+            delete(r.links, l.Id)
+            token := s.guestToken(n)
+            entry["replacement"] = map[string]interface{}{"link": n, "token": token, "url": guestHubURL(c, body.HubURL) + "?guestToken=" + token}
+        }
+        affected = append(affected, entry)
+    }
+    r.mu.Unlock()
+    if !dryRun {
+        s.expireGuests(now)
+    }
+    s.writeBulk(c, "bulk-rotate-guest-links", dryRun, affected, len(affected), map[string]interface{}{})
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/gin-gonic/gin"
+)
+
+func TestBulkAdminOperationsSupportDryRun(t *testing.T) {
+    s := NewServer(Options{AdminToken: "adm", GuestLinkSecret: "guest-secret"})
+    gin.SetMode(gin.TestMode)
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    admin := func(path, body string) map[string]interface{} {
+        req, _ := http.NewRequest("POST", ts.URL+path, strings.NewReader(body))
+        req.Header.Set("Authorization", "Bearer adm")
+        res, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatalf("POST %s: %v", path, err)
+        }
+        defer res.Body.Close()
+        var out map[string]interface{}
+        json.NewDecoder(res.Body).Decode(&out)
+        if res.StatusCode/100 != 2 {
+            t.Fatalf("POST %s failed with %d: %v", path, res.StatusCode, out)
+        }
+        return out
+    }
+    auditCount := func() int {
+        s.adminMu.Lock()
+        defer s.adminMu.Unlock()
+        return len(s.auditLog)
+    }
+
+    ids := []string{randomPeerId(), randomPeerId(), randomPeerId()}
+    for i, id := range ids {
+        attachTestPeer(t, s, id)
+        netName := "team-a"
+        if i == 2 {
+            netName = "team-b"
+        }
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"`+netName+`","data":{}}`))
+    }
+    if out := admin("/admin/bulk/disconnect?dryRun=true", `{"network":"team-a"}`); out["count"] != float64(2) || out["dryRun"] != true || s.getConn(ids[0]) == nil || auditCount() != 0 {
+        t.Fatalf("dry run should only report, got %v", out)
+    }
+    if out := admin("/admin/bulk/disconnect", `{"network":"team-a"}`); out["count"] != float64(2) {
+        t.Fatalf("unexpected bulk disconnect result %v", out)
+    }
+    if s.getConn(ids[0]) != nil || s.getConn(ids[1]) != nil || s.getConn(ids[2]) == nil || auditCount() != 1 {
+        t.Fatalf("only team-a should be disconnected, and the run audited")
+    }
+
+    s.cacheCrossHubPeer("team-b", randomPeerId(), map[string]interface{}{})
+    s.cacheCrossHubPeer("team-b", randomPeerId(), map[string]interface{}{})
+    if out := admin("/admin/bulk/purge-cache?dryRun=true", `{"network":"team-b"}`); out["count"] != float64(2) || len(s.crossHubCache["team-b"]) != 2 {
+        t.Fatalf("dry run should leave the cache alone, got %v", out)
+    }
+    admin("/admin/bulk/purge-cache", `{"network":"team-b"}`)
+    if len(s.crossHubCache["team-b"]) != 0 {
+        t.Fatalf("cache should be purged")
+    }
+
+    minted := admin("/admin/guest-links", `{"network":"team-b"}`)
+    oldToken := minted["token"].(string)
+    if out := admin("/admin/bulk/rotate-guest-links?dryRun=true", ``); out["count"] != float64(1) {
+        t.Fatalf("unexpected rotation dry run %v", out)
+    }
+    if _, reason := s.parseGuestToken(oldToken); reason != "" {
+        t.Fatalf("dry run must not revoke links: %s", reason)
+    }
+    out := admin("/admin/bulk/rotate-guest-links", ``)
+    entry := out["affected"].([]interface{})[0].(map[string]interface{})
+    newToken := entry["replacement"].(map[string]interface{})["token"].(string)
+    if _, reason := s.parseGuestToken(oldToken); reason != "guest link revoked" {
+        t.Fatalf("old token should be revoked, got %q", reason)
+    }
+    if l, reason := s.parseGuestToken(newToken); reason != "" || l.Network != "team-b" {
+        t.Fatalf("replacement token should be valid for the same network, got %q %+v", reason, l)
+    }
+}
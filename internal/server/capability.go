@@ -0,0 +1,66 @@
+package server
+
+import "strings"
+
+const capabilityPrefix = "capability:"
+
+func hasCapability(data map[string]interface{}, capability string) bool {
+    for _, c := range peerCapabilities(data) {
+        if c == capability {
+            return true
+        }
+    }
+    return false
+}
+
+// handleCapabilitySignal delivers a signaling message addressed to
+// "capability:<name>" instead of a peerId. Strategy "any" (the default) picks
+// the single matching peer closest to the sender, preferring local peers;
+// "all" fans out to every match on this hub and across the mesh.
+func (s *Server) handleCapabilitySignal(peerId string, msg inboundMessage, resp outboundMessage) {
+    capability := strings.TrimPrefix(msg.TargetPeer, capabilityPrefix)
+    netName := firstNonEmpty(msg.NetworkName, s.opts.DefaultNetwork)
+    strategy := firstNonEmpty(msg.Strategy, "any")
+
+    local := []string{}
+    for _, id := range s.localIndex.query(netName, []string{capability}, nil) {
+        if pi := s.getPeerInfo(id); id != peerId && pi != nil && pi.Announced && pi.NetworkName == netName && s.getConn(id) != nil {
+            local = append(local, id)
+        }
+    }
+    remoteTargets := []string{}
+    for _, id := range s.remoteIndex.query(netName, []string{capability}, nil) {
+        if id != peerId && s.getConn(id) == nil {
+            remoteTargets = append(remoteTargets, id)
+        }
+    }
+
+    var localTargets []string
+    switch strategy {
+    case "all":
+        localTargets = local
+    default:
+        strategy = "any"
+        if len(local) > 0 {
+            localTargets, remoteTargets = findClosestPeers(peerId, local, 1), nil
+        } else {
+            remoteTargets = findClosestPeers(peerId, remoteTargets, 1)
+        }
+    }
+
+    recipients := []string{}
+    for _, id := range localTargets {
+        m := resp
+        m.TargetPeer = id
+        if s.forwardToLocalTarget(id, m) {
+            recipients = append(recipients, id)
+        }
+    }
+    for _, id := range remoteTargets {
+        m := resp
+        m.TargetPeer = id
+        s.forwardSignalToBootstrap(id, m)
+        recipients = append(recipients, id)
+    }
+    s.forwardToLocalTarget(peerId, outboundMessage{Type: "signal-delivered", Data: map[string]interface{}{"target": msg.TargetPeer, "strategy": strategy, "signalType": msg.Type, "recipients": recipients}, FromPeerId: "system", TargetPeer: peerId, NetworkName: netName, Timestamp: nowMs()})
+}
@@ -0,0 +1,13 @@
+package server
+
+import "testing"
+
+func TestHasCapability(t *testing.T) {
+    data := map[string]interface{}{"capabilities": []interface{}{"relay", "transcoder"}}
+    if !hasCapability(data, "transcoder") {
+        t.Fatalf("expected capability match")
+    }
+    if hasCapability(data, "storage") || hasCapability(nil, "relay") {
+        t.Fatalf("unexpected capability match")
+    }
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+    "fmt"
+    "io"
+    "net/http"
+    "sort"
+    "strings"
+    "github.com/gin-gonic/gin"
+)
+
+// Metrics cardinality. Network names and client versions come from peers,
+// so a hostile client can mint as many as it likes. Every labeled family in
+// /metrics (peers per network, clients per version, churn per network) keeps
+// at most MetricsMaxSeries series, the largest ones, and folds the long tail
+// into a single "other" series. Label values are sanitized first: anything
+// outside letters, digits and . _ - : @ / becomes _, and values are cut to
+// 64 bytes, so they are safe as Prometheus labels and never collide with the
+// exposition syntax.
+const (
+    otherSeries    = "other"
+    maxLabelLength = 64
+)
+
+// sanitizeLabel makes a peer-supplied string safe to use as a label value.
+func sanitizeLabel(v string) string {
+    if v == "" {
+        return "unknown"
+    }
+    if len(v) > maxLabelLength {
+        v = v[:maxLabelLength]
+    }
+    b := []byte(v)
+    for i, c := range b {
+        switch {
+        case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+        case c == '.', c == '_', c == '-', c == ':', c == '@', c == '/':
+        default:
+            b[i] = '_'
+        }
+    }
+    return string(b)
+}
+
+// rankSeries sanitizes names and returns them largest first, merging names
+// that sanitize to the same label.
+func rankSeries(series map[string]int) ([]string, map[string]int) {
+    clean := make(map[string]int, len(series))
+    for name, n := range series {
+        clean[sanitizeLabel(name)] += n
+    }
+    names := make([]string, 0, len(clean))
+    for name := range clean {
+        names = append(names, name)
+    }
+    sort.Slice(names, func(i, j int) bool {
+        if clean[names[i]] != clean[names[j]] {
+            return clean[names[i]] > clean[names[j]]
+        }
+        return names[i] < names[j]
+    })
+    return names, clean
+}
+
+// capSeries keeps the max largest series and sums the rest into "other". It
+// returns the capped map and how many series were folded.
+func capSeries(series map[string]int, max int) (map[string]int, int) {
+    names, clean := rankSeries(series)
+    if max <= 0 || len(names) <= max {
+        return clean, 0
+    }
+    out := make(map[string]int, max+1)
+    for _, name := range names[:max] {
+        out[name] = clean[name]
+    }
+    for _, name := range names[max:] {
+        out[otherSeries] += clean[name]
+    }
+    return out, len(names) - max
+}
+
+// capChurn applies the same limit to the per-network churn snapshot, ranking
+// networks by sessions plus recent connects and merging the tail's rates and
+// session histograms into "other".
+func capChurn(churn map[string]interface{}, max int) (map[string]interface{}, int) {
+    weight := make(map[string]int, len(churn))
+    byLabel := make(map[string][]map[string]interface{}, len(churn))
+    for name, v := range churn {
+        m, _ := v.(map[string]interface{})
+        sessions, _ := m["sessions"].(map[string]interface{})
+        count, _ := sessions["count"].(int64)
+        connects, _ := m["connects_per_min"].(float64)
+        label := sanitizeLabel(name)
+        weight[label] += int(count) + int(connects*churnWindow)
+        byLabel[label] = append(byLabel[label], m)
+    }
+    names, _ := rankSeries(weight)
+    folded := 0
+    out := make(map[string]interface{}, len(names))
+    var tail []map[string]interface{}
+    for i, name := range names {
+        if max > 0 && i >= max {
+            tail = append(tail, byLabel[name]...)
+            folded++
+            continue
+        }
+        if len(byLabel[name]) == 1 {
+            out[name] = byLabel[name][0]
+        } else {
+            out[name] = mergeChurn(byLabel[name])
+        }
+    }
+    if len(tail) > 0 {
+        out[otherSeries] = mergeChurn(tail)
+    }
+    return out, folded
+}
+
+func mergeChurn(parts []map[string]interface{}) map[string]interface{} {
+    var connects, disconnects float64
+    var count, sumMs int64
+    buckets := map[string]int64{}
+    for _, m := range parts {
+        c, _ := m["connects_per_min"].(float64)
+        d, _ := m["disconnects_per_min"].(float64)
+        connects += c
+        disconnects += d
+        sessions, _ := m["sessions"].(map[string]interface{})
+        n, _ := sessions["count"].(int64)
+        avg, _ := sessions["avg_ms"].(int64)
+        count += n
+        sumMs += n * avg
+        b, _ := sessions["buckets"].(map[string]int64)
+        for k, v := range b {
+            buckets[k] += v
+        }
+    }
+    avg := int64(0)
+    if count > 0 {
+        avg = sumMs / count
+    }
+    return map[string]interface{}{
+        "sessions":            map[string]interface{}{"count": count, "avg_ms": avg, "buckets": buckets},
+        "connects_per_min":    connects,
+        "disconnects_per_min": disconnects,
+    }
+}
+
+// handleMetrics serves /metrics as JSON, or in the Prometheus text format
+// with ?format=prometheus.
+func (s *Server) handleMetrics(c *gin.Context) {
+    m := s.getMetrics()
+    if c.Query("format") != "prometheus" {
+        writeJSON(c.Writer, 200, m, s.opts.CORSOrigin)
+        return
+    }
+    c.Writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    c.Writer.WriteHeader(http.StatusOK)
+    writePrometheus(c.Writer, m)
+}
+
+// writePrometheus renders the scalar gauges and the capped labeled families
+// of a getMetrics snapshot. Labels are already sanitized, so %q quoting is
+// valid exposition syntax.
+func writePrometheus(w io.Writer, m map[string]interface{}) {
+    sub := func(k string) map[string]interface{} {
+        v, _ := m[k].(map[string]interface{})
+        return v
+    }
+    gauge := func(name string, v interface{}) {
+        switch v.(type) {
+        case int, int64, float64:
+            fmt.Fprintf(w, "peerpigeon_%s %v\n", name, v)
+        }
+    }
+    labeled := func(name, label string, series map[string]interface{}, key func(interface{}) interface{}) {
+        names := make([]string, 0, len(series))
+        for n := range series {
+            names = append(names, n)
+        }
+        sort.Strings(names)
+        for _, n := range names {
+            fmt.Fprintf(w, "peerpigeon_%s{%s=%q} %v\n", name, label, n, key(series[n]))
+        }
+    }
+    same := func(v interface{}) interface{} { return v }
+
+    gauge("uptime_ms", m["uptime_ms"])
+    gauge("connections_active", sub("connections")["active"])
+    gauge("connections_max", sub("connections")["max"])
+    gauge("peers", sub("peers")["total"])
+    gauge("networks", m["networks"])
+    gauge("hubs_discovered", sub("hubs")["discovered"])
+    gauge("bootstrap_connected", sub("hubs")["bootstrap_connected"])
+    gauge("panics_total", m["panics"])
+    gauge("store_size_bytes", sub("store")["size_bytes"])
+    gauge("store_free_bytes", sub("store")["free_bytes"])
+    counters := sub("counters")
+    keys := make([]string, 0, len(counters))
+    for k := range counters {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+    for _, k := range keys {
+        gauge("counter_"+strings.ToLower(sanitizeLabel(k)), counters[k])
+    }
+    if peers, ok := sub("peers")["networks"].(map[string]int); ok {
+        labeled("network_peers", "network", intSeries(peers), same)
+    }
+    if versions, ok := sub("clients")["versions"].(map[string]int); ok {
+        labeled("client_version_peers", "version", intSeries(versions), same)
+    }
+    churn := sub("churn")
+    labeled("network_connects_per_min", "network", churn, func(v interface{}) interface{} {
+        return v.(map[string]interface{})["connects_per_min"]
+    })
+    labeled("network_disconnects_per_min", "network", churn, func(v interface{}) interface{} {
+        return v.(map[string]interface{})["disconnects_per_min"]
+    })
+    if folded, ok := sub("cardinality")["folded"].(map[string]int); ok {
+        labeled("metrics_series_folded", "family", intSeries(folded), same)
+    }
+}
+
+func intSeries(m map[string]int) map[string]interface{} {
+    out := make(map[string]interface{}, len(m))
+    for k, v := range m {
+        out[k] = v
+    }
+    return out
+}
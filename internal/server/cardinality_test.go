@@ -0,0 +1,48 @@
+package server
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/gin-gonic/gin"
+)
+
+func TestMetricsCapSeriesAndSanitizeLabels(t *testing.T) {
+    s := NewServer(Options{MetricsMaxSeries: 3})
+    gin.SetMode(gin.TestMode)
+    s.routes()
+    sizes := map[string]int{"lobby": 5, "game": 4, "evil\"} 1\nfake_metric{x=\"": 3, "tail-a": 1, "tail-b": 1}
+    for name, n := range sizes {
+        s.networkPeers[name] = map[string]struct{}{}
+        for i := 0; i < n; i++ {
+            id := randomPeerId()
+            s.networkPeers[name][id] = struct{}{}
+            s.peerData[id] = &peerInfo{PeerId: id, NetworkName: name, ClientVersion: "v" + name}
+        }
+    }
+    m := s.getMetrics()
+    nets := m["peers"].(map[string]interface{})["networks"].(map[string]int)
+    if len(nets) != 4 || nets["lobby"] != 5 || nets["game"] != 4 || nets[`evil___1_fake_metric_x__`] != 3 || nets[otherSeries] != 2 {
+        t.Fatalf("networks should keep the three largest plus other, got %v", nets)
+    }
+    if folded := m["cardinality"].(map[string]interface{})["folded"].(map[string]int); folded["networks"] != 2 || folded["client_versions"] != 2 {
+        t.Fatalf("unexpected folded counts %v", folded)
+    }
+
+    w := httptest.NewRecorder()
+    s.engine.ServeHTTP(w, httptest.NewRequest("GET", "/metrics?format=prometheus", nil))
+    body := w.Body.String()
+    for _, want := range []string{`peerpigeon_network_peers{network="lobby"} 5`, `peerpigeon_network_peers{network="other"} 2`, `peerpigeon_network_peers{network="evil___1_fake_metric_x__"} 3`, `peerpigeon_client_version_peers{version="vgame"} 4`, `peerpigeon_metrics_series_folded{family="networks"} 2`} {
+        if !strings.Contains(body, want) {
+            t.Fatalf("prometheus output missing %s:\n%s", want, body)
+        }
+    }
+    for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+        if !strings.HasPrefix(line, "peerpigeon_") {
+            t.Fatalf("hostile label leaked into the exposition as %q", line)
+        }
+    }
+    if got := sanitizeLabel("evil\"} 1\nfake"); got != "evil___1_fake" {
+        t.Fatalf("sanitizeLabel = %q", got)
+    }
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+    "encoding/json"
+    "strconv"
+    "sync"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+// Change feed operations. A peer is added on its first announce (or on
+// joining a new network), updated when it re-announces with new data and
+// removed when it leaves, switches away or is erased.
+const (
+    changeAdded   = "added"
+    changeUpdated = "updated"
+    changeRemoved = "removed"
+
+    changeReasonErased = "erased"
+
+    changeSubBuffer  = 1024
+    changeSinkBuffer = 4096
+)
+
+// PeerChange is one entry in the hub's peer change feed. Seq is assigned in
+// publish order across all networks, so a consumer that applies changes in
+// Seq order ends up with the hub's current peer directory.
+type PeerChange struct {
+    Seq         int64                  `json:"seq"`
+    Op          string                 `json:"op"`
+    NetworkName string                 `json:"networkName"`
+    PeerId      string                 `json:"peerId"`
+    Data        map[string]interface{} `json:"data,omitempty"`
+    Reason      string                 `json:"reason,omitempty"`
+    Timestamp   int64                  `json:"timestamp"`
+}
+
+// ChangeSink receives every peer change in order, e.g. to publish it to a
+// Kafka topic or NATS subject. Sinks run on a single goroutine; a slow sink
+// delays the others but never the hub. Changes that overflow the sink queue
+// are dropped and counted in /metrics.
+type ChangeSink interface {
+    PublishChange(PeerChange) error
+}
+
+type changeSub struct {
+    network string
+    ch      chan PeerChange
+}
+
+// changeFeed keeps the last size changes for cursor resumes and fans new
+// ones out to firehose subscribers and the sink queue.
+type changeFeed struct {
+    mu    sync.Mutex
+    seq   int64
+    size  int
+    buf   []PeerChange
+    subs  map[*changeSub]struct{}
+    sinkQ chan PeerChange
+
+    published   int64
+    sinkDropped int64
+    subsDropped int64
+}
+
+func newChangeFeed(size int) *changeFeed {
+    if size <= 0 {
+        size = 1000
+    }
+    return &changeFeed{size: size, subs: map[*changeSub]struct{}{}, sinkQ: make(chan PeerChange, changeSinkBuffer)}
+}
+
+func (f *changeFeed) publish(op, netName, peerId string, data map[string]interface{}, reason string) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.seq++
+    f.published++
+    c := PeerChange{Seq: f.seq, Op: op, NetworkName: netName, PeerId: peerId, Data: data, Reason: reason, Timestamp: nowMs()}
+    f.buf = append(f.buf, c)
+    if len(f.buf) > f.size {
+        f.buf = f.buf[len(f.buf)-f.size:]
+    }
+    // A subscriber that cannot keep up is cut off rather than shown a gap;
+    // it reconnects with its last seq.
+    for sub := range f.subs {
+        if sub.network != "" && sub.network != netName {
+            continue
+        }
+        select {
+        case sub.ch <- c:
+        default:
+            delete(f.subs, sub)
+            close(sub.ch)
+            f.subsDropped++
+        }
+    }
+    select {
+    case f.sinkQ <- c:
+    default:
+        f.sinkDropped++
+    }
+}
+
+// subscribe registers a subscriber for network ("" for all) and returns the
+// buffered changes after since plus the current cursor. ok is false when
+// since is zero or has fallen out of the window, in which case the caller
+// sends a snapshot instead. Registering under the same lock as the backlog
+// copy means nothing published in between is missed.
+func (f *changeFeed) subscribe(network string, since int64) (*changeSub, []PeerChange, int64, bool) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    sub := &changeSub{network: network, ch: make(chan PeerChange, changeSubBuffer)}
+    f.subs[sub] = struct{}{}
+    ok := since > 0 && since <= f.seq && (len(f.buf) == 0 && since == f.seq || len(f.buf) > 0 && since >= f.buf[0].Seq-1)
+    if !ok {
+        return sub, nil, f.seq, false
+    }
+    backlog := []PeerChange{}
+    for _, c := range f.buf {
+        if c.Seq > since && (network == "" || c.NetworkName == network) {
+            backlog = append(backlog, c)
+        }
+    }
+    return sub, backlog, f.seq, true
+}
+
+func (f *changeFeed) unsubscribe(sub *changeSub) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    if _, ok := f.subs[sub]; ok {
+        delete(f.subs, sub)
+        close(sub.ch)
+    }
+}
+
+// forget drops a peer's buffered changes so an erased peer's data cannot be
+// replayed.
+func (f *changeFeed) forget(peerId string) int {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    kept := f.buf[:0]
+    n := 0
+    for _, c := range f.buf {
+        if c.PeerId == peerId {
+            n++
+            continue
+        }
+        kept = append(kept, c)
+    }
+    f.buf = kept
+    return n
+}
+
+func (f *changeFeed) snapshot() map[string]interface{} {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return map[string]interface{}{"cursor": f.seq, "published": f.published, "buffered": len(f.buf), "subscribers": len(f.subs), "subscribersDropped": f.subsDropped, "sinkDropped": f.sinkDropped}
+}
+
+// runChangeSinks hands every change to the configured sinks in order.
+func (s *Server) runChangeSinks() {
+    for c := range s.changes.sinkQ {
+        for _, sink := range s.opts.ChangeSinks {
+            if err := sink.PublishChange(c); err != nil {
+                s.log.Warn("change_sink_failed", map[string]interface{}{"seq": c.Seq, "error": err.Error()})
+            }
+        }
+    }
+}
+
+// changeFrame is what the firehose writes: a snapshot of current peers
+// (when the subscriber has no usable cursor) or a single change.
+type changeFrame struct {
+    Type   string       `json:"type"`
+    Cursor int64        `json:"cursor,omitempty"`
+    Peers  []PeerChange `json:"peers,omitempty"`
+    Change *PeerChange  `json:"change,omitempty"`
+}
+
+// localDirectory lists the announced non-hub peers in network ("" for all)
+// as added changes.
+func (s *Server) localDirectory(network string) []PeerChange {
+    s.peersMu.Lock()
+    defer s.peersMu.Unlock()
+    out := []PeerChange{}
+    for id, pi := range s.peerData {
+        if !pi.Announced || pi.IsHub || (network != "" && pi.NetworkName != network) {
+            continue
+        }
+        out = append(out, PeerChange{Op: changeAdded, NetworkName: pi.NetworkName, PeerId: id, Data: pi.Data, Timestamp: pi.AnnouncedAt})
+    }
+    return out
+}
+
+// adminChangeFeed upgrades to a WebSocket that streams peer changes.
+// ?network= limits it to one network; ?since= resumes after a seq the
+// consumer already applied. Without a usable cursor the stream starts with a
+// snapshot frame of the current peers, and changes follow from its cursor.
+func (s *Server) adminChangeFeed(c *gin.Context) {
+    network := c.Query("network")
+    since, _ := strconv.ParseInt(c.Query("since"), 10, 64)
+    conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
+    if err != nil {
+        return
+    }
+    defer conn.Close()
+    // Subscribe before taking the snapshot: a change racing the snapshot is
+    // then delivered again afterwards, which consumers apply as an upsert.
+    sub, backlog, cursor, ok := s.changes.subscribe(network, since)
+    defer s.changes.unsubscribe(sub)
+    write := func(f changeFrame) bool {
+        b, _ := json.Marshal(f)
+        conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+        return conn.WriteMessage(websocket.TextMessage, b) == nil
+    }
+    if !ok {
+        if !write(changeFrame{Type: "snapshot", Cursor: cursor, Peers: s.localDirectory(network)}) {
+            return
+        }
+    }
+    for i := range backlog {
+        if !write(changeFrame{Type: "change", Change: &backlog[i]}) {
+            return
+        }
+    }
+    closed := make(chan struct{})
+    s.spawn("change-feed-reader", c.ClientIP(), func() {
+        defer close(closed)
+        for {
+            if _, _, err := conn.ReadMessage(); err != nil {
+                return
+            }
+        }
+    })
+    for {
+        select {
+        case <-closed:
+            return
+        case ch, open := <-sub.ch:
+            if !open {
+                conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "change feed subscriber fell behind"), time.Now().Add(time.Second))
+                return
+            }
+            if !write(changeFrame{Type: "change", Change: &ch}) {
+                return
+            }
+        }
+    }
+}
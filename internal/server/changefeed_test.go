@@ -0,0 +1,88 @@
+package server
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+type recordingSink struct {
+    mu      sync.Mutex
+    changes []PeerChange
+}
+
+func (r *recordingSink) PublishChange(c PeerChange) error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.changes = append(r.changes, c)
+    return nil
+}
+
+func TestPeerChangeFeedFirehoseAndSink(t *testing.T) {
+    sink := &recordingSink{}
+    s := NewServer(Options{AdminToken: "adm", ChangeFeedSize: 2, ChangeSinks: []ChangeSink{sink}})
+    gin.SetMode(gin.TestMode)
+    s.running = true
+    s.routes()
+    s.spawn("change-sinks", "test", s.runChangeSinks)
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    id := "0123456789abcdef0123456789abcdef01234567"
+    s.peerData[id] = &peerInfo{PeerId: id, Connected: true}
+    s.handleMessage(id, []byte(`{"type":"announce","networkName":"lobby","data":{"name":"a"}}`))
+    s.handleMessage(id, []byte(`{"type":"announce","networkName":"lobby","data":{"name":"a"}}`))
+    s.handleMessage(id, []byte(`{"type":"announce","networkName":"lobby","data":{"name":"b"}}`))
+    s.handleMessage(id, []byte(`{"type":"announce","networkName":"game","data":{"name":"b"}}`))
+
+    dial := func(query string) *websocket.Conn {
+        c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/admin/changes"+query, http.Header{"Authorization": {"Bearer adm"}})
+        if err != nil {
+            t.Fatalf("dial change feed: %v", err)
+        }
+        return c
+    }
+    read := func(c *websocket.Conn) changeFrame {
+        var f changeFrame
+        c.SetReadDeadline(time.Now().Add(time.Second))
+        if err := c.ReadJSON(&f); err != nil {
+            t.Fatalf("read change frame: %v", err)
+        }
+        return f
+    }
+    fresh := dial("")
+    defer fresh.Close()
+    if f := read(fresh); f.Type != "snapshot" || f.Cursor != 4 || len(f.Peers) != 1 || f.Peers[0].NetworkName != "game" {
+        t.Fatalf("unexpected snapshot %+v", f)
+    }
+    s.handleDisconnect(id, reasonClientGoodbye, "")
+    if f := read(fresh); f.Change == nil || f.Change.Seq != 5 || f.Change.Op != changeRemoved || f.Change.Reason != reasonClientGoodbye {
+        t.Fatalf("unexpected live change %+v", f)
+    }
+    stale := dial("?since=1")
+    defer stale.Close()
+    if f := read(stale); f.Type != "snapshot" || f.Cursor != 5 || len(f.Peers) != 0 {
+        t.Fatalf("a cursor outside the window should get a snapshot, got %+v", f)
+    }
+    resumed := dial("?since=4")
+    defer resumed.Close()
+    if f := read(resumed); f.Change == nil || f.Change.Seq != 5 {
+        t.Fatalf("resume should replay seq 5, got %+v", f)
+    }
+
+    waitFor(t, "sink to receive every change", func() bool {
+        sink.mu.Lock()
+        defer sink.mu.Unlock()
+        return len(sink.changes) == 5
+    })
+    want := []string{changeAdded, changeUpdated, changeRemoved, changeAdded, changeRemoved}
+    for i, c := range sink.changes {
+        if c.Seq != int64(i+1) || c.Op != want[i] {
+            t.Fatalf("sink change %d = %+v, want op %s", i, c, want[i])
+        }
+    }
+}
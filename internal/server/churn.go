@@ -0,0 +1,127 @@
+package server
+
+import (
+    "sync"
+    "time"
+)
+
+// Session duration histogram bounds; the last bucket is open-ended.
+var sessionBuckets = []struct {
+    label string
+    max   time.Duration
+}{
+    {"10s", 10 * time.Second},
+    {"30s", 30 * time.Second},
+    {"1m", time.Minute},
+    {"5m", 5 * time.Minute},
+    {"15m", 15 * time.Minute},
+    {"1h", time.Hour},
+    {"6h", 6 * time.Hour},
+    {"+Inf", 0},
+}
+
+// churnWindow is how many whole minutes the connect/disconnect rates cover.
+const churnWindow = 5
+
+// churnTracker records per-network session lifetimes and connect/disconnect
+// counts per minute. High churn drives discovery traffic, so operators
+// watch it alongside peer counts.
+type churnTracker struct {
+    mu   sync.Mutex
+    nets map[string]*networkChurn
+}
+
+type networkChurn struct {
+    counts  []int64
+    sumMs   int64
+    minutes map[int64]*churnMinute
+}
+
+type churnMinute struct {
+    connects    int64
+    disconnects int64
+}
+
+func newChurnTracker() *churnTracker {
+    return &churnTracker{nets: map[string]*networkChurn{}}
+}
+
+func (c *churnTracker) network(netName string) *networkChurn {
+    n := c.nets[netName]
+    if n == nil {
+        n = &networkChurn{counts: make([]int64, len(sessionBuckets)), minutes: map[int64]*churnMinute{}}
+        c.nets[netName] = n
+    }
+    return n
+}
+
+func (n *networkChurn) minute(now time.Time) *churnMinute {
+    key := now.Unix() / 60
+    m := n.minutes[key]
+    if m == nil {
+        m = &churnMinute{}
+        n.minutes[key] = m
+        for k := range n.minutes {
+            if k <= key-churnWindow-1 {
+                delete(n.minutes, k)
+            }
+        }
+    }
+    return m
+}
+
+func (c *churnTracker) connected(netName string, now time.Time) {
+    c.mu.Lock()
+    c.network(netName).minute(now).connects++
+    c.mu.Unlock()
+}
+
+// disconnected records a session of the given length ending now.
+func (c *churnTracker) disconnected(netName string, session time.Duration, now time.Time) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    n := c.network(netName)
+    n.minute(now).disconnects++
+    i := len(sessionBuckets) - 1
+    for j, b := range sessionBuckets[:i] {
+        if session <= b.max {
+            i = j
+            break
+        }
+    }
+    n.counts[i]++
+    n.sumMs += session.Milliseconds()
+}
+
+// snapshot reports, per network, the session histogram and the average
+// connects and disconnects per minute over the last churnWindow full minutes.
+func (c *churnTracker) snapshot(now time.Time) map[string]interface{} {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    cur := now.Unix() / 60
+    out := map[string]interface{}{}
+    for name, n := range c.nets {
+        var connects, disconnects, total int64
+        for k, m := range n.minutes {
+            if k < cur && k >= cur-churnWindow {
+                connects += m.connects
+                disconnects += m.disconnects
+            }
+        }
+        buckets := map[string]int64{}
+        for i, b := range sessionBuckets {
+            buckets[b.label] = n.counts[i]
+            total += n.counts[i]
+        }
+        avg := int64(0)
+        if total > 0 {
+            avg = n.sumMs / total
+        }
+        out[name] = map[string]interface{}{
+            "sessions":            map[string]interface{}{"count": total, "avg_ms": avg, "buckets": buckets},
+            "connects_per_min":    float64(connects) / churnWindow,
+            "disconnects_per_min": float64(disconnects) / churnWindow,
+        }
+    }
+    return out
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+    "testing"
+    "time"
+)
+
+func TestChurnHistogramAndRates(t *testing.T) {
+    c := newChurnTracker()
+    base := time.Unix(1_000_000_020, 0)
+    for i := 0; i < 10; i++ {
+        c.connected("lobby", base)
+    }
+    c.disconnected("lobby", 5*time.Second, base.Add(time.Minute))
+    c.disconnected("lobby", 7*time.Hour, base.Add(time.Minute))
+    snap := c.snapshot(base.Add(2 * time.Minute))["lobby"].(map[string]interface{})
+    if snap["connects_per_min"] != 2.0 || snap["disconnects_per_min"] != 0.4 {
+        t.Fatalf("unexpected rates %v", snap)
+    }
+    buckets := snap["sessions"].(map[string]interface{})["buckets"].(map[string]int64)
+    if buckets["10s"] != 1 || buckets["+Inf"] != 1 || buckets["1m"] != 0 {
+        t.Fatalf("unexpected histogram %v", buckets)
+    }
+    if old := c.snapshot(base.Add(time.Hour))["lobby"].(map[string]interface{}); old["connects_per_min"] != 0.0 {
+        t.Fatalf("rates should age out of the window, got %v", old)
+    }
+
+    s := NewServer(Options{})
+    id := "0123456789abcdef0123456789abcdef01234567"
+    s.peerData[id] = &peerInfo{PeerId: id, Connected: true}
+    s.handleMessage(id, []byte(`{"type":"announce","networkName":"lobby","data":{}}`))
+    s.handleMessage(id, []byte(`{"type":"announce","networkName":"game","data":{}}`))
+    s.cleanupPeer(id)
+    got := s.churn.snapshot(time.Now())
+    for _, name := range []string{"lobby", "game"} {
+        if got[name].(map[string]interface{})["sessions"].(map[string]interface{})["count"] != int64(1) {
+            t.Fatalf("expected one finished session in %s, got %v", name, got[name])
+        }
+    }
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+    "errors"
+    "net/http"
+    "sync"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+// StoreStats is a Store's on-disk footprint. FreeBytes is space the backend
+// holds but no longer uses, such as bbolt free pages or SQLite freelist
+// pages, which compaction gives back.
+type StoreStats struct {
+    SizeBytes int64 `json:"sizeBytes"`
+    FreeBytes int64 `json:"freeBytes"`
+}
+
+// Compactor is implemented by Stores whose files only grow until they are
+// compacted, e.g. a bbolt store that rewrites its database or a SQLite store
+// that runs VACUUM. The hub reports their size and fragmentation under
+// "store" in /metrics and compacts them every StoreCompactIntervalMs when
+// fragmentation reaches StoreCompactFragmentationPct, or on demand through
+// POST /admin/store/compact. Compact may block the store while it runs; the
+// hub never runs two at once.
+type Compactor interface {
+    StoreStats() (StoreStats, error)
+    Compact() error
+}
+
+type storeCompaction struct {
+    mu            sync.Mutex
+    running       bool
+    runs          int64
+    failures      int64
+    lastRunAt     int64
+    lastDuration  int64
+    lastReclaimed int64
+    lastError     string
+}
+
+var errCompactionRunning = errors.New("a compaction is already running")
+
+func fragmentation(st StoreStats) float64 {
+    if st.SizeBytes <= 0 {
+        return 0
+    }
+    return float64(st.FreeBytes) / float64(st.SizeBytes)
+}
+
+// compactStore runs one compaction and reports the bytes it reclaimed.
+// trigger ("schedule" or "admin") is logged with the result.
+func (s *Server) compactStore(c Compactor, trigger string) (int64, error) {
+    sc := s.compaction
+    sc.mu.Lock()
+    if sc.running {
+        sc.mu.Unlock()
+        return 0, errCompactionRunning
+    }
+    sc.running = true
+    sc.mu.Unlock()
+
+    before, _ := c.StoreStats()
+    start := time.Now()
+    err := c.Compact()
+    after, _ := c.StoreStats()
+    reclaimed := before.SizeBytes - after.SizeBytes
+    if reclaimed < 0 {
+        reclaimed = 0
+    }
+
+    sc.mu.Lock()
+    sc.running = false
+    sc.runs++
+    sc.lastRunAt = nowMs()
+    sc.lastDuration = time.Since(start).Milliseconds()
+    sc.lastReclaimed = reclaimed
+    sc.lastError = ""
+    if err != nil {
+        sc.failures++
+        sc.lastError = err.Error()
+    }
+    sc.mu.Unlock()
+    if err != nil {
+        s.log.Warn("store_compaction_failed", map[string]interface{}{"trigger": trigger, "error": err.Error()})
+        return 0, err
+    }
+    s.log.Info("store_compacted", map[string]interface{}{"trigger": trigger, "reclaimedBytes": reclaimed, "sizeBytes": after.SizeBytes, "durationMs": time.Since(start).Milliseconds()})
+    return reclaimed, nil
+}
+
+// runStoreCompaction compacts the store on schedule when it is fragmented
+// enough to be worth it.
+func (s *Server) runStoreCompaction() {
+    c, ok := s.opts.Store.(Compactor)
+    if !ok {
+        return
+    }
+    ticker := time.NewTicker(time.Duration(s.opts.StoreCompactIntervalMs) * time.Millisecond)
+    defer ticker.Stop()
+    for range ticker.C {
+        if !s.running {
+            return
+        }
+        st, err := c.StoreStats()
+        if err != nil || fragmentation(st)*100 < float64(s.opts.StoreCompactFragmentationPct) {
+            continue
+        }
+        s.compactStore(c, "schedule")
+    }
+}
+
+func (s *Server) storeSnapshot() map[string]interface{} {
+    c, ok := s.opts.Store.(Compactor)
+    if !ok {
+        return map[string]interface{}{"compactable": false}
+    }
+    out := map[string]interface{}{"compactable": true}
+    if st, err := c.StoreStats(); err == nil {
+        out["size_bytes"] = st.SizeBytes
+        out["free_bytes"] = st.FreeBytes
+        out["fragmentation"] = fragmentation(st)
+    } else {
+        out["stats_error"] = err.Error()
+    }
+    sc := s.compaction
+    sc.mu.Lock()
+    out["compaction"] = map[string]interface{}{
+        "running":               sc.running,
+        "runs":                  sc.runs,
+        "failures":              sc.failures,
+        "last_run_at":           sc.lastRunAt,
+        "last_duration_ms":      sc.lastDuration,
+        "last_reclaimed_bytes":  sc.lastReclaimed,
+        "last_error":            sc.lastError,
+        "interval_ms":           s.opts.StoreCompactIntervalMs,
+        "min_fragmentation_pct": s.opts.StoreCompactFragmentationPct,
+    }
+    sc.mu.Unlock()
+    return out
+}
+
+func (s *Server) adminStore(c *gin.Context) {
+    writeJSON(c.Writer, http.StatusOK, s.storeSnapshot(), s.opts.CORSOrigin)
+}
+
+// adminCompactStore compacts the store now, whatever its fragmentation, and
+// answers once it is done.
+func (s *Server) adminCompactStore(c *gin.Context) {
+    comp, ok := s.opts.Store.(Compactor)
+    if !ok {
+        writeJSON(c.Writer, http.StatusNotImplemented, map[string]interface{}{"error": "store does not support compaction"}, s.opts.CORSOrigin)
+        return
+    }
+    reclaimed, err := s.compactStore(comp, "admin")
+    if err == errCompactionRunning {
+        writeJSON(c.Writer, http.StatusConflict, map[string]interface{}{"error": err.Error()}, s.opts.CORSOrigin)
+        return
+    }
+    if err != nil {
+        writeJSON(c.Writer, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()}, s.opts.CORSOrigin)
+        return
+    }
+    s.audit(c, "compact-store", map[string]interface{}{"reclaimedBytes": reclaimed})
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"reclaimedBytes": reclaimed, "store": s.storeSnapshot()}, s.opts.CORSOrigin)
+}
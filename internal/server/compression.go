@@ -0,0 +1,110 @@
+package server
+
+import (
+    "bytes"
+    "compress/gzip"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "io"
+    "strings"
+    "sync/atomic"
+)
+
+const encodingGzip = "gzip"
+
+// acceptsGzip reports whether conn's far end advertised the compression
+// feature, on its connect query, in its announce or in a hub handshake.
+// Only those links get compressed payloads. gRPC streams never do; they can
+// negotiate gRPC compression instead.
+func acceptsGzip(conn peerConn) bool {
+    switch c := conn.(type) {
+    case *wsPeerConn:
+        return atomic.LoadInt32(&c.gzip) == 1
+    case *pollConn:
+        return atomic.LoadInt32(&c.gzip) == 1
+    }
+    return false
+}
+
+// markGzip records that conn's far end decodes compressed payloads.
+func markGzip(conn peerConn) {
+    switch c := conn.(type) {
+    case *wsPeerConn:
+        atomic.StoreInt32(&c.gzip, 1)
+    case *pollConn:
+        atomic.StoreInt32(&c.gzip, 1)
+    }
+}
+
+// queryFeatures splits the comma-separated features connect parameter.
+func queryFeatures(v string) []string {
+    out := []string{}
+    for _, f := range strings.Split(v, ",") {
+        if f = strings.TrimSpace(f); f != "" {
+            out = append(out, f)
+        }
+    }
+    return out
+}
+
+// clientThreshold is the compression threshold for writes to conn: the
+// configured one when its far end accepts gzip, otherwise zero.
+func (s *Server) clientThreshold(conn peerConn) int {
+    if !acceptsGzip(conn) {
+        return 0
+    }
+    return s.opts.CompressThresholdBytes
+}
+
+// compressData gzips the JSON form of data when it reaches threshold bytes,
+// returning the base64 payload and the envelope encoding. Smaller payloads
+// and a zero threshold are passed through untouched.
+func compressData(data interface{}, threshold int) (interface{}, string) {
+    if threshold <= 0 || data == nil {
+        return data, ""
+    }
+    raw, err := json.Marshal(data)
+    if err != nil || len(raw) < threshold {
+        return data, ""
+    }
+    var buf bytes.Buffer
+    zw := gzip.NewWriter(&buf)
+    zw.Write(raw)
+    if err := zw.Close(); err != nil || buf.Len() >= len(raw) {
+        return data, ""
+    }
+    return base64.StdEncoding.EncodeToString(buf.Bytes()), encodingGzip
+}
+
+// decompressData reverses compressData for an envelope carrying encoding.
+func decompressData(data interface{}, encoding string) (interface{}, error) {
+    if encoding == "" {
+        return data, nil
+    }
+    if encoding != encodingGzip {
+        return nil, errors.New("unsupported encoding " + encoding)
+    }
+    enc, ok := data.(string)
+    if !ok {
+        return nil, errors.New("compressed data must be a base64 string")
+    }
+    b, err := base64.StdEncoding.DecodeString(enc)
+    if err != nil {
+        return nil, err
+    }
+    zr, err := gzip.NewReader(bytes.NewReader(b))
+    if err != nil {
+        return nil, err
+    }
+    defer zr.Close()
+    raw, err := io.ReadAll(zr)
+    if err != nil {
+        return nil, err
+    }
+    var out interface{}
+    if err := json.Unmarshal(raw, &out); err != nil {
+        return nil, err
+    }
+    return out, nil
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestCompressDataRoundTrip(t *testing.T) {
+    sdp := map[string]interface{}{"sdp": strings.Repeat("a=candidate:1 1 udp 2122260223 10.0.0.1 54321 typ host\r\n", 50)}
+    if _, enc := compressData(sdp, 0); enc != "" {
+        t.Fatalf("zero threshold should disable compression")
+    }
+    packed, enc := compressData(sdp, 256)
+    if enc != encodingGzip {
+        t.Fatalf("expected gzip encoding, got %q", enc)
+    }
+    out, err := decompressData(packed, enc)
+    if err != nil {
+        t.Fatalf("decompress: %v", err)
+    }
+    if out.(map[string]interface{})["sdp"] != sdp["sdp"] {
+        t.Fatalf("round trip mismatch")
+    }
+}
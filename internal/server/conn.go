@@ -0,0 +1,253 @@
+package server
+
+import (
+    "errors"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/gorilla/websocket"
+)
+
+// peerConn is what the hub needs from a peer connection. WebSocket
+// connections satisfy it through wsPeerConn; long-polling sessions implement it over
+// HTTP.
+type peerConn interface {
+    WriteMessage(messageType int, data []byte) error
+    WriteControl(messageType int, data []byte, deadline time.Time) error
+    Close() error
+}
+
+// Slow consumer policies: what a WebSocket whose outbound queue is full
+// does with the next message.
+const (
+    slowConsumerDisconnect = "disconnect"
+    slowConsumerDrop       = "drop"
+)
+
+var (
+    errConnClosed     = errors.New("connection closed")
+    errWriteQueueFull = errors.New("outbound queue full")
+)
+
+// writeStats counts outbound queue activity across all WebSockets.
+type writeStats struct {
+    queued          int64
+    written         int64
+    dropped         int64
+    slowDisconnects int64
+    writeErrors     int64
+}
+
+type outFrame struct {
+    messageType int
+    data        []byte
+}
+
+// wsPeerConn gives each WebSocket, peer or hub link, its own writer
+// goroutine. WriteMessage only queues, so delivering to many peers never
+// waits on a slow one; the pump writes frames in order, each under
+// WriteTimeoutMs. When the queue (WriteQueueSize frames) is full,
+// SlowConsumerPolicy either drops the new message or closes the connection
+// with reason slow-consumer. Close flushes what is queued first, so a close
+// frame still follows the messages sent before it.
+//
+// With PingIntervalMs set the pump also pings the other end. Pongs, pings
+// and messages from it all count as signs of life; after MaxMissedPongs
+// intervals without one the connection is marked stale and closed, and its
+// reader reports reason ping-timeout.
+type wsPeerConn struct {
+    *websocket.Conn
+    s     *Server
+    owner string
+    // legacy is set for clients that negotiated protocol version 0.
+    legacy bool
+    // binary is 1 for clients that negotiated MessagePack framing and hub
+    // links that upgraded to it.
+    binary int32
+    // bootstrap is set for links this hub dialed to a bootstrap hub.
+    bootstrap bool
+    // gzip is 1 once the other end has advertised compression support.
+    gzip int32
+    // hub is 1 once the other end is known to be a hub.
+    hub int32
+    // alive is when the other end was last heard from, in milliseconds.
+    alive int64
+
+    mu     sync.Mutex
+    out    chan outFrame
+    done   chan struct{}
+    closed bool
+    slow   bool
+    stale  bool
+}
+
+// newWSPeerConn wraps conn and starts its pump, labelled kind/owner.
+func (s *Server) newWSPeerConn(conn *websocket.Conn, kind, owner string) *wsPeerConn {
+    c := &wsPeerConn{Conn: conn, s: s, owner: owner, bootstrap: kind == "bootstrap-writer", alive: nowMs(), out: make(chan outFrame, s.opts.WriteQueueSize), done: make(chan struct{})}
+    conn.SetPongHandler(func(string) error {
+        c.touch()
+        return nil
+    })
+    conn.SetPingHandler(func(data string) error {
+        c.touch()
+        // As the default handler: a failed pong surfaces on the next write.
+        conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+        return nil
+    })
+    s.spawn(kind, owner, c.pump)
+    return c
+}
+
+// touch records that the other end is alive.
+func (c *wsPeerConn) touch() {
+    atomic.StoreInt64(&c.alive, nowMs())
+}
+
+func (c *wsPeerConn) WriteMessage(messageType int, data []byte) error {
+    return c.enqueue(outFrame{messageType, data}, false)
+}
+
+// WriteControl queues close frames behind pending messages; other control
+// frames are written at once, which gorilla/websocket allows alongside the
+// pump.
+func (c *wsPeerConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+    if messageType == websocket.CloseMessage {
+        if err := c.enqueue(outFrame{messageType, data}, true); err != errWriteQueueFull {
+            return err
+        }
+    }
+    return c.Conn.WriteControl(messageType, data, deadline)
+}
+
+func (c *wsPeerConn) enqueue(f outFrame, control bool) error {
+    c.mu.Lock()
+    if c.closed {
+        c.mu.Unlock()
+        return errConnClosed
+    }
+    select {
+    case c.out <- f:
+        c.mu.Unlock()
+        atomic.AddInt64(&c.s.writes.queued, 1)
+        return nil
+    default:
+    }
+    if control || c.s.opts.SlowConsumerPolicy == slowConsumerDrop {
+        c.mu.Unlock()
+        if !control {
+            atomic.AddInt64(&c.s.writes.dropped, 1)
+        }
+        return errWriteQueueFull
+    }
+    c.slow, c.closed = true, true
+    close(c.done)
+    c.mu.Unlock()
+    atomic.AddInt64(&c.s.writes.slowDisconnects, 1)
+    c.s.log.Warn("slow_consumer", map[string]interface{}{"owner": c.owner, "queued": cap(c.out)})
+    c.Conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reasonSlowConsumer), time.Now().Add(time.Second))
+    c.Conn.Close()
+    return errWriteQueueFull
+}
+
+// Close stops accepting messages; the pump closes the socket once the queue
+// has been written.
+func (c *wsPeerConn) Close() error {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if !c.closed {
+        c.closed = true
+        close(c.out)
+    }
+    return nil
+}
+
+// isSlow reports whether the connection was closed for falling behind.
+func (c *wsPeerConn) isSlow() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.slow
+}
+
+// isStale reports whether the connection was closed for missing pongs.
+func (c *wsPeerConn) isStale() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.stale
+}
+
+func (c *wsPeerConn) pump() {
+    var tick <-chan time.Time
+    if c.s.opts.PingIntervalMs > 0 {
+        t := time.NewTicker(time.Duration(c.s.opts.PingIntervalMs) * time.Millisecond)
+        defer t.Stop()
+        tick = t.C
+    }
+    var pingedAt int64
+    missed := 0
+    for {
+        select {
+        case <-tick:
+            if pingedAt > 0 && atomic.LoadInt64(&c.alive) < pingedAt {
+                missed++
+            } else {
+                missed = 0
+            }
+            if missed >= c.s.opts.MaxMissedPongs {
+                c.mu.Lock()
+                c.stale = true
+                if !c.closed {
+                    c.closed = true
+                    close(c.done)
+                }
+                c.mu.Unlock()
+                atomic.AddInt64(&c.s.keepalive.timeouts, 1)
+                c.s.log.Warn("ping_timeout", map[string]interface{}{"owner": c.owner, "missed": missed})
+                c.Conn.Close()
+                return
+            }
+            pingedAt = nowMs()
+            if err := c.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Duration(c.s.opts.WriteTimeoutMs)*time.Millisecond)); err != nil {
+                atomic.AddInt64(&c.s.writes.writeErrors, 1)
+                c.Conn.Close()
+                return
+            }
+            atomic.AddInt64(&c.s.keepalive.pings, 1)
+        case f, ok := <-c.out:
+            if !ok {
+                c.Conn.Close()
+                return
+            }
+            if err := c.write(f); err != nil {
+                atomic.AddInt64(&c.s.writes.writeErrors, 1)
+                c.Conn.Close()
+                return
+            }
+            atomic.AddInt64(&c.s.writes.written, 1)
+        case <-c.done:
+            return
+        }
+    }
+}
+
+func (c *wsPeerConn) write(f outFrame) error {
+    timeout := time.Duration(c.s.opts.WriteTimeoutMs) * time.Millisecond
+    if f.messageType == websocket.CloseMessage {
+        return c.Conn.WriteControl(f.messageType, f.data, time.Now().Add(timeout))
+    }
+    c.Conn.SetWriteDeadline(time.Now().Add(timeout))
+    return c.Conn.WriteMessage(f.messageType, f.data)
+}
+
+func (s *Server) writeQueueSnapshot() map[string]interface{} {
+    w := s.writes
+    return map[string]interface{}{
+        "queue_size":       s.opts.WriteQueueSize,
+        "timeout_ms":       s.opts.WriteTimeoutMs,
+        "policy":           s.opts.SlowConsumerPolicy,
+        "queued":           atomic.LoadInt64(&w.queued),
+        "written":          atomic.LoadInt64(&w.written),
+        "dropped":          atomic.LoadInt64(&w.dropped),
+        "slow_disconnects": atomic.LoadInt64(&w.slowDisconnects),
+        "write_errors":     atomic.LoadInt64(&w.writeErrors),
+    }
+}
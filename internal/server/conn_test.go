@@ -0,0 +1,59 @@
+package server
+
+import (
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestSlowConsumerCannotStallBroadcast(t *testing.T) {
+    s := NewServer(Options{MaxConnections: 10, WriteQueueSize: 8, WriteTimeoutMs: 200})
+    gin.SetMode(gin.TestMode)
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    base := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?peerId="
+
+    // stalled never reads; fast reads everything.
+    stalled, fast := randomPeerId(), randomPeerId()
+    sc, _, err := websocket.DefaultDialer.Dial(base+stalled, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer sc.Close()
+    fc, _, err := websocket.DefaultDialer.Dial(base+fast, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer fc.Close()
+    var got int64
+    go func() {
+        for {
+            if _, _, err := fc.ReadMessage(); err != nil {
+                return
+            }
+            atomic.AddInt64(&got, 1)
+        }
+    }()
+    waitFor(t, "both peers registered", func() bool { return s.getConn(stalled) != nil && s.getConn(fast) != nil })
+
+    payload := strings.Repeat("x", 64*1024)
+    start := time.Now()
+    for i := 0; i < 200; i++ {
+        s.broadcastToOthers("system", outboundMessage{Type: "app-broadcast", Data: map[string]interface{}{"n": i, "blob": payload}, FromPeerId: "system", NetworkName: "global", Timestamp: nowMs()})
+        time.Sleep(time.Millisecond)
+    }
+    if elapsed := time.Since(start); elapsed > 3*time.Second {
+        t.Fatalf("broadcast blocked on the stalled peer for %v", elapsed)
+    }
+    waitFor(t, "the stalled peer to be disconnected", func() bool { return s.getConn(stalled) == nil })
+    waitFor(t, "the fast peer to read every broadcast", func() bool { return atomic.LoadInt64(&got) >= 201 })
+    if snap := s.writeQueueSnapshot(); snap["slow_disconnects"] != int64(1) || snap["policy"] != slowConsumerDisconnect {
+        t.Fatalf("unexpected write queue counters %v", snap)
+    }
+}
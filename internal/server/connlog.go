@@ -0,0 +1,134 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http"
+    "sync"
+    "github.com/gin-gonic/gin"
+)
+
+// defaultConnDebugMs is how long a per-peer debug toggle lasts when the
+// operator does not say.
+const defaultConnDebugMs = 10 * 60 * 1000
+
+// connLogger is a Logger bound to one peer connection. Every line carries
+// the peer's ID, network, remote address and client version as they are
+// when it is written, so lines from the read loop, message handling and
+// cleanup correlate. Debug lines are dropped unless VerboseLogging is on or
+// an operator has turned debugging on for the peer with
+// PUT /admin/peers/:peerId/debug; those are written at INFO with
+// "debug": true so they pass the hub-wide level filter.
+type connLogger struct {
+    s      *Server
+    peerId string
+}
+
+// connDebug holds the peers with debug logging on, until a deadline.
+type connDebug struct {
+    mu    sync.Mutex
+    until map[string]int64
+}
+
+func newConnDebug() *connDebug {
+    return &connDebug{until: map[string]int64{}}
+}
+
+func (d *connDebug) enabled(peerId string) bool {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return d.until[peerId] > nowMs()
+}
+
+func (d *connDebug) expire(now int64) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    for id, until := range d.until {
+        if until <= now {
+            delete(d.until, id)
+        }
+    }
+}
+
+// connLog returns the logger for peerId's connection.
+func (s *Server) connLog(peerId string) connLogger {
+    return connLogger{s: s, peerId: peerId}
+}
+
+// debugging reports whether Debug lines for this peer are written, so
+// callers can skip building their fields.
+func (l connLogger) debugging() bool {
+    return l.s.verbose() || l.s.connDebug.enabled(l.peerId)
+}
+
+func (l connLogger) with(fields map[string]interface{}) map[string]interface{} {
+    out := map[string]interface{}{"peerId": l.peerId}
+    if pi := l.s.getPeerInfo(l.peerId); pi != nil {
+        out["networkName"] = pi.NetworkName
+        out["remoteAddress"] = pi.RemoteAddress
+        if pi.ClientVersion != "" {
+            out["clientVersion"] = pi.ClientVersion
+        }
+    }
+    for k, v := range fields {
+        out[k] = v
+    }
+    return out
+}
+
+func (l connLogger) Debug(message string, fields map[string]interface{}) {
+    if l.s.connDebug.enabled(l.peerId) {
+        f := l.with(fields)
+        f["debug"] = true
+        l.s.log.Info(message, f)
+    } else if l.s.verbose() {
+        l.s.log.Debug(message, l.with(fields))
+    }
+}
+
+func (l connLogger) Info(message string, fields map[string]interface{}) {
+    l.s.log.Info(message, l.with(fields))
+}
+
+func (l connLogger) Warn(message string, fields map[string]interface{}) {
+    l.s.log.Warn(message, l.with(fields))
+}
+
+func (l connLogger) Error(message string, fields map[string]interface{}) {
+    l.s.log.Error(message, l.with(fields))
+}
+
+// adminSetPeerDebug turns debug logging for one peer on or off:
+// {"enabled": true, "durationMs": 600000}. The toggle outlives the
+// connection, so a peer that reconnects is still traced, and lapses after
+// durationMs (10 minutes by default).
+func (s *Server) adminSetPeerDebug(c *gin.Context) {
+    peerId := c.Param("peerId")
+    body := struct {
+        Enabled    *bool `json:"enabled"`
+        DurationMs int64 `json:"durationMs"`
+    }{}
+    if c.Request.ContentLength != 0 && json.NewDecoder(c.Request.Body).Decode(&body) != nil {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "invalid JSON body"}, s.opts.CORSOrigin)
+        return
+    }
+    if !s.validPeerId(peerId) {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "invalid peerId"}, s.opts.CORSOrigin)
+        return
+    }
+    enabled := body.Enabled == nil || *body.Enabled
+    if body.DurationMs <= 0 {
+        body.DurationMs = defaultConnDebugMs
+    }
+    var until int64
+    s.connDebug.mu.Lock()
+    if enabled {
+        until = nowMs() + body.DurationMs
+        s.connDebug.until[peerId] = until
+    } else {
+        delete(s.connDebug.until, peerId)
+    }
+    s.connDebug.mu.Unlock()
+    s.audit(c, "peer-debug", map[string]interface{}{"peerId": peerId, "enabled": enabled, "until": until})
+    s.connLog(peerId).Info("peer_debug_toggled", map[string]interface{}{"enabled": enabled, "until": until})
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"peerId": peerId, "debug": enabled, "until": until}, s.opts.CORSOrigin)
+}
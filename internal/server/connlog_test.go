@@ -0,0 +1,90 @@
+package server
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "github.com/gin-gonic/gin"
+)
+
+type fieldLogger struct {
+    mu    sync.Mutex
+    lines []map[string]interface{}
+}
+
+func (l *fieldLogger) record(level, message string, fields map[string]interface{}) {
+    line := map[string]interface{}{"level": level, "message": message}
+    for k, v := range fields {
+        line[k] = v
+    }
+    l.mu.Lock()
+    l.lines = append(l.lines, line)
+    l.mu.Unlock()
+}
+
+func (l *fieldLogger) find(message string) map[string]interface{} {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    for _, line := range l.lines {
+        if line["message"] == message {
+            return line
+        }
+    }
+    return nil
+}
+
+func (l *fieldLogger) Debug(message string, fields map[string]interface{}) { l.record("DEBUG", message, fields) }
+func (l *fieldLogger) Info(message string, fields map[string]interface{})  { l.record("INFO", message, fields) }
+func (l *fieldLogger) Warn(message string, fields map[string]interface{})  { l.record("WARN", message, fields) }
+func (l *fieldLogger) Error(message string, fields map[string]interface{}) { l.record("ERROR", message, fields) }
+
+func TestConnLoggerCarriesPeerContextAndPerPeerDebug(t *testing.T) {
+    lg := &fieldLogger{}
+    s := NewServer(Options{AdminToken: "adm", Logger: lg, ReputationWarnAt: 5})
+    s.engine = gin.New()
+    s.registerAdminRoutes()
+    a, b := randomPeerId(), randomPeerId()
+    for _, id := range []string{a, b} {
+        attachTestPeer(t, s, id)
+        s.peerData[id].RemoteAddress = "203.0.113.7"
+        s.peerData[id].ClientVersion = "go-sdk/1.2"
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"lobby","data":{}}`))
+    }
+    if lg.find("message_received") != nil {
+        t.Fatalf("debug lines should be off by default")
+    }
+
+    s.handleMessage(a, []byte(`{not json`))
+    line := lg.find("peer_offence")
+    if line == nil || line["peerId"] != a || line["networkName"] != "lobby" || line["remoteAddress"] != "203.0.113.7" || line["clientVersion"] != "go-sdk/1.2" {
+        t.Fatalf("offence line should carry the peer's context, got %v", line)
+    }
+
+    put := func(id, body string) int {
+        req := httptest.NewRequest("PUT", "/admin/peers/"+id+"/debug", strings.NewReader(body))
+        req.Header.Set("Authorization", "Bearer adm")
+        rec := httptest.NewRecorder()
+        s.engine.ServeHTTP(rec, req)
+        return rec.Code
+    }
+    if code := put(a, `{"enabled":true,"durationMs":60000}`); code != http.StatusOK {
+        t.Fatalf("enable debug: %d", code)
+    }
+    s.handleMessage(b, []byte(`{"type":"ping"}`))
+    if lg.find("message_received") != nil {
+        t.Fatalf("only the toggled peer should log debug lines")
+    }
+    s.handleMessage(a, []byte(`{"type":"ping"}`))
+    line = lg.find("message_received")
+    if line == nil || line["level"] != "INFO" || line["debug"] != true || line["peerId"] != a || line["type"] != "ping" {
+        t.Fatalf("toggled peer should log its messages at info, got %v", line)
+    }
+    if code := put(a, `{"enabled":false}`); code != http.StatusOK || s.connDebug.enabled(a) {
+        t.Fatalf("disable debug: %d", code)
+    }
+    if len(s.auditLog) != 2 || s.auditLog[0].Action != "peer-debug" {
+        t.Fatalf("toggles should be audited, got %v", s.auditLog)
+    }
+}
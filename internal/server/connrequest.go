@@ -0,0 +1,84 @@
+package server
+
+import (
+    "net/http"
+    "net/url"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+// connRequest is a connection attempt as admission and registerConn see
+// it, whichever transport carried it: the path, the connection parameters,
+// the headers and the client address. Admission records a refusal on it for
+// the transport to answer in its own terms, and stashes what it granted (a
+// guest link, a JWT session) for registerConn.
+type connRequest struct {
+    path     string
+    query    url.Values
+    header   http.Header
+    clientIP string
+    grants   map[string]interface{}
+    refusal  *connRefusal
+}
+
+// connRefusal is why admission turned a request away: an HTTP status with
+// a plain-text message or a JSON body, and how long to wait before retrying.
+type connRefusal struct {
+    status     int
+    message    string
+    body       map[string]interface{}
+    retryAfter time.Duration
+}
+
+// httpConnRequest reads a connection request from an HTTP request.
+func httpConnRequest(c *gin.Context) *connRequest {
+    return &connRequest{path: connPath(c), query: c.Request.URL.Query(), header: c.Request.Header, clientIP: c.ClientIP()}
+}
+
+func (r *connRequest) Query(key string) string {
+    return r.query.Get(key)
+}
+
+func (r *connRequest) GetHeader(key string) string {
+    return r.header.Get(key)
+}
+
+func (r *connRequest) ClientIP() string {
+    return r.clientIP
+}
+
+func (r *connRequest) Set(key string, v interface{}) {
+    if r.grants == nil {
+        r.grants = map[string]interface{}{}
+    }
+    r.grants[key] = v
+}
+
+func (r *connRequest) Get(key string) (interface{}, bool) {
+    v, ok := r.grants[key]
+    return v, ok
+}
+
+// refuse turns the request away with a plain-text message.
+func (r *connRequest) refuse(status int, message string) {
+    r.refusal = &connRefusal{status: status, message: message}
+}
+
+// refuseJSON turns the request away with a JSON body whose "error" is the
+// message.
+func (r *connRequest) refuseJSON(status int, body map[string]interface{}, retryAfter time.Duration) {
+    message, _ := body["error"].(string)
+    r.refusal = &connRefusal{status: status, message: message, body: body, retryAfter: retryAfter}
+}
+
+// writeRefusal answers an HTTP connection request that admission refused.
+func (s *Server) writeRefusal(w http.ResponseWriter, f *connRefusal) {
+    if f.retryAfter > 0 {
+        w.Header().Set("Retry-After", itoa(int((f.retryAfter+time.Second-1)/time.Second)))
+    }
+    if f.body != nil {
+        writeJSON(w, f.status, f.body, s.opts.CORSOrigin)
+        return
+    }
+    http.Error(w, f.message, f.status)
+}
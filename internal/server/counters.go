@@ -0,0 +1,60 @@
+package server
+
+import (
+    "encoding/json"
+    "time"
+)
+
+// persistentCounters is implemented by recorders whose cumulative counters
+// can be saved and restored, such as *metrics.Metrics.
+type persistentCounters interface {
+    Cumulative() map[string]int64
+    Restore(saved map[string]int64)
+}
+
+// restoreCounters loads the counters saved under MetricsStorePath into the
+// recorder, so totals carry over from the previous run.
+func (s *Server) restoreCounters() {
+    pc, ok := s.metrics.(persistentCounters)
+    if !ok || s.opts.MetricsStorePath == "" {
+        return
+    }
+    b, err := s.opts.Store.Load(s.opts.MetricsStorePath)
+    if err != nil {
+        s.log.Warn("metrics_restore_failed", map[string]interface{}{"key": s.opts.MetricsStorePath, "error": err.Error()})
+        return
+    }
+    if b == nil {
+        return
+    }
+    saved := map[string]int64{}
+    if err := json.Unmarshal(b, &saved); err != nil {
+        s.log.Warn("metrics_restore_failed", map[string]interface{}{"key": s.opts.MetricsStorePath, "error": err.Error()})
+        return
+    }
+    pc.Restore(saved)
+}
+
+func (s *Server) saveCounters() {
+    pc, ok := s.metrics.(persistentCounters)
+    if !ok || s.opts.MetricsStorePath == "" {
+        return
+    }
+    b, _ := json.Marshal(pc.Cumulative())
+    if err := s.opts.Store.Save(s.opts.MetricsStorePath, b); err != nil {
+        s.log.Warn("metrics_save_failed", map[string]interface{}{"key": s.opts.MetricsStorePath, "error": err.Error()})
+    }
+}
+
+// runCounterPersistence saves the counters every MetricsPersistIntervalMs;
+// Stop saves them once more on shutdown.
+func (s *Server) runCounterPersistence() {
+    ticker := time.NewTicker(time.Duration(s.opts.MetricsPersistIntervalMs) * time.Millisecond)
+    defer ticker.Stop()
+    for range ticker.C {
+        if !s.running {
+            return
+        }
+        s.saveCounters()
+    }
+}
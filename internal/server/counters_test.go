@@ -0,0 +1,24 @@
+package server
+
+import "testing"
+
+func TestMetricsCountersPersistAcrossRestarts(t *testing.T) {
+    st := &memStore{docs: map[string][]byte{}}
+    first := NewServer(Options{Store: st, MetricsStorePath: "counters"})
+    first.metrics.ConnectionOpened()
+    first.metrics.MessageProcessed()
+    first.metrics.MessageProcessed()
+    first.Stop()
+    if len(st.docs["counters"]) == 0 {
+        t.Fatalf("Stop should save counters to the store")
+    }
+    second := NewServer(Options{Store: st, MetricsStorePath: "counters"})
+    second.metrics.MessageProcessed()
+    counters := second.metricsCounters()
+    if counters["messages"].(map[string]interface{})["processed"] != int64(3) || counters["connections"].(map[string]interface{})["total"] != int64(1) {
+        t.Fatalf("totals should carry over from the previous run, got %v", counters)
+    }
+    if counters["connections"].(map[string]interface{})["active"] != int64(0) {
+        t.Fatalf("gauges should not be restored, got %v", counters["connections"])
+    }
+}
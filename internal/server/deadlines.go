@@ -0,0 +1,218 @@
+package server
+
+import (
+    "bytes"
+    "encoding/json"
+    "sync"
+    "time"
+)
+
+// Signal deadlines. With SignalDeadlineMs set, the hub a peer sends an offer
+// or answer to stamps it with a messageId and an absolute deadline. Every
+// hub drops a copy that arrives after its deadline instead of relaying it,
+// and a long-polling target never receives a queued copy that has expired.
+// Whichever hub delivers the signal acks it back to the origin hub with a
+// signal-ack; if no ack arrives by the deadline the origin peer gets a typed
+// error:
+//
+//     {"type": "error", "data": {"code": "signal-deadline-exceeded",
+//      "message": "...", "signalType": "offer", "targetPeerId": "...",
+//      "messageId": "...", "deadline": 1700000000000}}
+//
+// Deadlines are wall-clock milliseconds, so hub clocks need to be roughly in
+// sync; the origin waits signalAckGraceMs past the deadline for acks still
+// in flight.
+const (
+    errSignalDeadline = "signal-deadline-exceeded"
+    signalAckGraceMs  = 1000
+)
+
+type pendingSignal struct {
+    from        string
+    target      string
+    signalType  string
+    networkName string
+    deadline    int64
+}
+
+// signalDeadlines tracks offers and answers sent by local peers that have
+// not been delivered yet.
+type signalDeadlines struct {
+    mu      sync.Mutex
+    pending map[string]*pendingSignal
+
+    tracked   int64
+    delivered int64
+    expired   int64
+    dropped   int64
+}
+
+func newSignalDeadlines() *signalDeadlines {
+    return &signalDeadlines{pending: map[string]*pendingSignal{}}
+}
+
+func (d *signalDeadlines) track(id string, p *pendingSignal) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    d.pending[id] = p
+    d.tracked++
+}
+
+// clear marks id delivered and reports whether this hub was waiting for it.
+func (d *signalDeadlines) clear(id string) bool {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if _, ok := d.pending[id]; !ok {
+        return false
+    }
+    delete(d.pending, id)
+    d.delivered++
+    return true
+}
+
+// expire removes and returns the signals whose deadline (plus grace) passed.
+func (d *signalDeadlines) expire(now int64) map[string]*pendingSignal {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    out := map[string]*pendingSignal{}
+    for id, p := range d.pending {
+        if now > p.deadline+signalAckGraceMs {
+            out[id] = p
+            delete(d.pending, id)
+            d.expired++
+        }
+    }
+    return out
+}
+
+func (d *signalDeadlines) droppedLate() {
+    d.mu.Lock()
+    d.dropped++
+    d.mu.Unlock()
+}
+
+func (d *signalDeadlines) snapshot() map[string]interface{} {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return map[string]interface{}{"pending": len(d.pending), "tracked": d.tracked, "delivered": d.delivered, "expired": d.expired, "dropped_late": d.dropped}
+}
+
+// signalMeta is the part of a queued message a long-polling session needs to
+// expire and ack it.
+type signalMeta struct {
+    Type        string `json:"type"`
+    FromPeerId  string `json:"fromPeerId"`
+    NetworkName string `json:"networkName"`
+    MessageId   string `json:"messageId"`
+    Deadline    int64  `json:"deadline"`
+}
+
+// parseSignalMeta extracts deadline metadata from an encoded message, or
+// returns false for the common case of a message without one.
+func parseSignalMeta(data []byte) (signalMeta, bool) {
+    var m signalMeta
+    if !bytes.Contains(data, []byte(`"deadline":`)) || json.Unmarshal(data, &m) != nil || m.Deadline == 0 || m.MessageId == "" {
+        return signalMeta{}, false
+    }
+    return m, true
+}
+
+// stampSignalDeadline gives an offer or answer from a local peer a messageId
+// and deadline. It returns false when deadlines are disabled.
+func (s *Server) stampSignalDeadline(msg inboundMessage, resp *outboundMessage) bool {
+    if s.opts.SignalDeadlineMs <= 0 || (msg.Type != "offer" && msg.Type != "answer") {
+        return false
+    }
+    resp.MessageId = firstNonEmpty(msg.MessageId, newMessageId())
+    resp.Deadline = nowMs() + int64(s.opts.SignalDeadlineMs)
+    return true
+}
+
+// deliverSignal hands a signal to a local target. A copy that has outlived
+// its deadline is dropped; one written straight to a WebSocket is acked
+// immediately, while a long-polling session acks when the client collects it.
+func (s *Server) deliverSignal(target string, msg outboundMessage) bool {
+    conn := s.getConn(target)
+    if conn == nil {
+        return false
+    }
+    if msg.Deadline > 0 && nowMs() > msg.Deadline {
+        s.signalDeadlines.droppedLate()
+        return false
+    }
+    if !s.sendToConn(conn, msg) {
+        return false
+    }
+    if _, polling := conn.(*pollConn); !polling && msg.Deadline > 0 {
+        s.ackSignal(signalMeta{Type: msg.Type, FromPeerId: msg.FromPeerId, NetworkName: msg.NetworkName, MessageId: msg.MessageId, Deadline: msg.Deadline})
+    }
+    return true
+}
+
+// ackSignal reports a delivered signal to its origin: directly when the
+// origin peer is on this hub, otherwise across the mesh.
+func (s *Server) ackSignal(m signalMeta) {
+    if m.MessageId == "" || s.signalDeadlines.clear(m.MessageId) {
+        return
+    }
+    if s.getConn(m.FromPeerId) != nil {
+        return
+    }
+    s.markRelayed("signal-ack:" + m.MessageId)
+    s.forwardToMesh(outboundMessage{Type: "signal-ack", Data: map[string]interface{}{"messageId": m.MessageId}, FromPeerId: "system", TargetPeer: m.FromPeerId, NetworkName: m.NetworkName, Timestamp: nowMs()}, "", "")
+}
+
+// handleSignalAck clears a pending signal on the origin hub, or passes the
+// ack on through the mesh.
+func (s *Server) handleSignalAck(fromHub, fromUri string, msg inboundMessage) {
+    m, _ := msg.Data.(map[string]interface{})
+    id, _ := m["messageId"].(string)
+    if id == "" || s.alreadyVisited(msg) || !s.markRelayed("signal-ack:"+id) {
+        return
+    }
+    if s.signalDeadlines.clear(id) || s.getConn(msg.TargetPeer) != nil {
+        return
+    }
+    s.forwardToMesh(outboundMessage{Type: "signal-ack", Data: m, FromPeerId: "system", TargetPeer: msg.TargetPeer, NetworkName: msg.NetworkName, Timestamp: nowMs(), OriginHub: msg.OriginHub, SeenHubs: msg.SeenHubs, Hops: msg.Hops}, fromUri, fromHub)
+}
+
+// runSignalDeadlines tells origin peers about signals nobody delivered in
+// time.
+func (s *Server) runSignalDeadlines() {
+    ticker := time.NewTicker(250 * time.Millisecond)
+    defer ticker.Stop()
+    for range ticker.C {
+        if !s.running {
+            return
+        }
+        s.expireSignals(nowMs())
+    }
+}
+
+func (s *Server) expireSignals(now int64) {
+    for id, p := range s.signalDeadlines.expire(now) {
+        s.signalRoutes.forget(p.target)
+        s.forwardToLocalTarget(p.from, outboundMessage{Type: "error", Data: map[string]interface{}{"code": errSignalDeadline, "message": p.signalType + " to " + p.target + " was not delivered before its deadline", "signalType": p.signalType, "targetPeerId": p.target, "messageId": id, "deadline": p.deadline}, FromPeerId: "system", TargetPeer: p.from, NetworkName: p.networkName, Timestamp: nowMs()})
+    }
+}
+
+// settleSignals drops queued signals that expired before a long-polling
+// client collected them and acks the rest.
+func (s *Server) settleSignals(queue []json.RawMessage, signals []*signalMeta) []json.RawMessage {
+    now := nowMs()
+    out := queue[:0]
+    for i, raw := range queue {
+        m := signals[i]
+        if m == nil {
+            out = append(out, raw)
+            continue
+        }
+        if now > m.Deadline {
+            s.signalDeadlines.droppedLate()
+            continue
+        }
+        s.ackSignal(*m)
+        out = append(out, raw)
+    }
+    return out
+}
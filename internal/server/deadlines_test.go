@@ -0,0 +1,69 @@
+package server
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestSignalDeadlinesExpireAndAck(t *testing.T) {
+    s := NewServer(Options{SignalDeadlineMs: 50})
+    a, b := randomPeerId(), randomPeerId()
+    conns := attachTestPeers(t, s, a, b)
+    for _, id := range []string{a, b} {
+        s.peerData[id].Announced = true
+    }
+    deadlineError := func() map[string]interface{} {
+        msgs, _ := conns[a].take(100 * time.Millisecond)
+        if len(msgs) != 1 {
+            t.Fatalf("expected one error for the sender, got %s", msgs)
+        }
+        var out outboundMessage
+        json.Unmarshal(msgs[0], &out)
+        data, _ := out.Data.(map[string]interface{})
+        if out.Type != "error" || data["code"] != errSignalDeadline {
+            t.Fatalf("expected a %s error, got %s", errSignalDeadline, msgs[0])
+        }
+        return data
+    }
+
+    // Remote target: nobody acks, so the origin hub reports the timeout.
+    remote := randomPeerId()
+    s.handleMessage(a, []byte(`{"type":"offer","targetPeerId":"`+remote+`","data":{"sdp":"x"}}`))
+    s.expireSignals(nowMs() + 2000)
+    if data := deadlineError(); data["targetPeerId"] != remote || data["signalType"] != "offer" {
+        t.Fatalf("unexpected deadline error %v", data)
+    }
+
+    // Long-polling target that does not collect in time: the queued copy is
+    // purged and the sender is told.
+    s.handleMessage(a, []byte(`{"type":"offer","targetPeerId":"`+b+`","data":{"sdp":"y"}}`))
+    time.Sleep(80 * time.Millisecond)
+    if msgs, _ := conns[b].take(20 * time.Millisecond); len(msgs) != 0 {
+        t.Fatalf("expired offer should have been purged, got %s", msgs)
+    }
+    s.expireSignals(nowMs() + 2000)
+    deadlineError()
+
+    // Collected in time: acked, no error.
+    s.handleMessage(a, []byte(`{"type":"offer","targetPeerId":"`+b+`","messageId":"m1","data":{"sdp":"z"}}`))
+    if msgs, _ := conns[b].take(time.Second); len(msgs) != 1 || !strings.Contains(string(msgs[0]), `"deadline":`) {
+        t.Fatalf("expected the offer with its deadline, got %s", msgs)
+    }
+    s.expireSignals(nowMs() + 2000)
+    if msgs, _ := conns[a].take(20 * time.Millisecond); len(msgs) != 0 {
+        t.Fatalf("delivered offer should not time out, got %s", msgs)
+    }
+
+    // A copy relayed by another hub after its deadline is dropped.
+    late, _ := json.Marshal(map[string]interface{}{"type": "offer", "targetPeerId": b, "fromPeerId": remote, "messageId": "m2", "deadline": nowMs() - 1, "data": map[string]interface{}{}})
+    s.handleBootstrapMessage("ws://hub-b.invalid", late)
+    if msgs, _ := conns[b].take(20 * time.Millisecond); len(msgs) != 0 {
+        t.Fatalf("late relayed offer should be dropped, got %s", msgs)
+    }
+    snap := s.signalDeadlines.snapshot()
+    if snap["expired"] != int64(2) || snap["delivered"] != int64(1) || snap["dropped_late"] != int64(2) {
+        t.Fatalf("unexpected deadline counters %v", snap)
+    }
+}
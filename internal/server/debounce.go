@@ -0,0 +1,128 @@
+package server
+
+import (
+    "sync"
+    "time"
+)
+
+// Disconnect debouncing. With DisconnectDebounceMs set, a peer whose
+// connection drops unexpectedly (reasonError) or is replaced by a reconnect
+// is removed from this hub at once, but the peer-disconnected sent to its
+// network, the mesh, webhooks, the event log and the change feed is held for
+// the window. If the peer announces again on the same network before it
+// expires the disconnect is never sent; other hubs still have the peer
+// cached, so its re-announce stops at the first hop instead of rippling
+// through the mesh. Goodbyes, kicks, idle timeouts and shutdowns are sent
+// immediately.
+type pendingDisconnect struct {
+    netName string
+    data    map[string]interface{}
+    reason  string
+    detail  string
+    timer   *time.Timer
+}
+
+type disconnectDebouncer struct {
+    mu      sync.Mutex
+    pending map[string]*pendingDisconnect
+
+    deferred  int64
+    cancelled int64
+    published int64
+}
+
+func newDisconnectDebouncer() *disconnectDebouncer {
+    return &disconnectDebouncer{pending: map[string]*pendingDisconnect{}}
+}
+
+// take removes and returns peerId's pending disconnect, stopping its timer.
+func (d *disconnectDebouncer) take(peerId string) *pendingDisconnect {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    p := d.pending[peerId]
+    if p != nil {
+        delete(d.pending, peerId)
+        p.timer.Stop()
+    }
+    return p
+}
+
+func (d *disconnectDebouncer) snapshot() map[string]interface{} {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    return map[string]interface{}{"pending": len(d.pending), "deferred": d.deferred, "cancelled": d.cancelled, "published": d.published}
+}
+
+func debouncedReason(reason string) bool {
+    return reason == reasonError || reason == reasonReplaced
+}
+
+// deferDisconnect holds the disconnect of an announced client for the
+// debounce window. It reports false when the disconnect should go out now.
+func (s *Server) deferDisconnect(peerId string, pi *peerInfo, reason, detail string) bool {
+    if s.opts.DisconnectDebounceMs <= 0 || pi == nil || !pi.Announced || pi.IsHub || !debouncedReason(reason) {
+        return false
+    }
+    p := &pendingDisconnect{netName: firstNonEmpty(pi.NetworkName, s.opts.DefaultNetwork), data: pi.Data, reason: reason, detail: detail}
+    d := s.debouncer
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if old := d.pending[peerId]; old != nil {
+        old.timer.Stop()
+    }
+    d.pending[peerId] = p
+    d.deferred++
+    p.timer = time.AfterFunc(time.Duration(s.opts.DisconnectDebounceMs)*time.Millisecond, func() {
+        d.mu.Lock()
+        if d.pending[peerId] != p {
+            d.mu.Unlock()
+            return
+        }
+        delete(d.pending, peerId)
+        d.published++
+        d.mu.Unlock()
+        // The peer may have reconnected without announcing yet; it is still
+        // gone as far as its network knows.
+        s.publishDisconnect(peerId, p.netName, false, true, hiddenPeer(p.data), p.reason, p.detail)
+    })
+    return true
+}
+
+// resumeDisconnect is called when a peer announces for the first time on
+// this connection. A pending disconnect on the same network is cancelled and
+// its data returned, so the announce can be treated as an update; one on
+// another network is sent now. ok is false when nothing was pending.
+func (s *Server) resumeDisconnect(peerId, netName string) (map[string]interface{}, bool) {
+    p := s.debouncer.take(peerId)
+    if p == nil {
+        return nil, false
+    }
+    s.debouncer.mu.Lock()
+    if p.netName == netName {
+        s.debouncer.cancelled++
+        s.debouncer.mu.Unlock()
+        return p.data, true
+    }
+    s.debouncer.published++
+    s.debouncer.mu.Unlock()
+    s.publishDisconnect(peerId, p.netName, false, true, hiddenPeer(p.data), p.reason, p.detail)
+    return nil, false
+}
+
+// flushDisconnects sends every pending disconnect, e.g. on shutdown.
+func (s *Server) flushDisconnects() {
+    s.debouncer.mu.Lock()
+    ids := make([]string, 0, len(s.debouncer.pending))
+    for id := range s.debouncer.pending {
+        ids = append(ids, id)
+    }
+    s.debouncer.mu.Unlock()
+    for _, id := range ids {
+        if p := s.debouncer.take(id); p != nil {
+            s.debouncer.mu.Lock()
+            s.debouncer.published++
+            s.debouncer.mu.Unlock()
+            s.publishDisconnect(id, p.netName, false, true, hiddenPeer(p.data), p.reason, p.detail)
+        }
+    }
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestDisconnectDebounceCancelsOnReturn(t *testing.T) {
+    s := NewServer(Options{DisconnectDebounceMs: 150})
+    a, b := randomPeerId(), randomPeerId()
+    conns := map[string]*pollConn{}
+    join := func(id string) {
+        conns[id] = attachTestPeer(t, s, id)
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"lobby","data":{"v":1}}`))
+    }
+    disconnects := func(wait time.Duration) int {
+        msgs, _ := conns[a].take(wait)
+        n := 0
+        for _, raw := range msgs {
+            if strings.Contains(string(raw), `"type":"peer-disconnected"`) || strings.Contains(string(raw), `"type":"goodbye"`) {
+                n++
+            }
+        }
+        return n
+    }
+    join(a)
+    join(b)
+    conns[a].take(20 * time.Millisecond)
+
+    s.handleDisconnect(b, reasonError, "connection reset")
+    if n := disconnects(20 * time.Millisecond); n != 0 {
+        t.Fatalf("a dropped connection should not be broadcast inside the window")
+    }
+    join(b)
+    time.Sleep(200 * time.Millisecond)
+    if n := disconnects(20 * time.Millisecond); n != 0 {
+        t.Fatalf("a peer back inside the window should never be reported gone, got %d", n)
+    }
+    if snap := s.debouncer.snapshot(); snap["cancelled"] != int64(1) || snap["pending"] != 0 {
+        t.Fatalf("unexpected debounce counters %v", snap)
+    }
+
+    s.handleDisconnect(b, reasonError, "connection reset")
+    if n := disconnects(time.Second); n != 1 {
+        t.Fatalf("a peer that stays away should be reported once the window expires, got %d", n)
+    }
+    join(b)
+    s.handleMessage(b, []byte(`{"type":"goodbye"}`))
+    if n := disconnects(20 * time.Millisecond); n != 1 {
+        t.Fatalf("a goodbye should be broadcast immediately, got %d", n)
+    }
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+    "os"
+    "peerpigeon/internal/logging"
+    "peerpigeon/internal/metrics"
+)
+
+// Logger receives the hub's structured log events. The default writes JSON
+// lines to stderr through the logging package.
+type Logger interface {
+    Debug(message string, fields map[string]interface{})
+    Info(message string, fields map[string]interface{})
+    Warn(message string, fields map[string]interface{})
+    Error(message string, fields map[string]interface{})
+}
+
+// MetricsRecorder counts hub activity. *metrics.Metrics implements it; if a
+// recorder also has a Snapshot() map[string]interface{} method, the snapshot
+// is served under "counters" in /metrics.
+type MetricsRecorder interface {
+    ConnectionOpened()
+    ConnectionClosed()
+    PeerAnnounced()
+    PeerRemoved()
+    PeerDiscovered()
+    HubConnected()
+    CrossHubMessageSent()
+    MessageProcessed()
+    MessageFailed()
+    MessageBroadcast(count int64)
+    CleanupPerformed()
+}
+
+// Store persists the hub's small state documents. Keys are the configured
+// IdentityStorePath, IntegrationsStorePath and MetricsStorePath; the default
+// Store treats them as file paths. Load returns nil data and no error for a missing key.
+// Stores backed by a database file can also implement Compactor.
+type Store interface {
+    Load(key string) ([]byte, error)
+    Save(key string, data []byte) error
+}
+
+type fileStore struct{}
+
+func (fileStore) Load(path string) ([]byte, error) {
+    b, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    return b, err
+}
+
+// Save writes through a temporary file so a crash never leaves a torn file.
+func (fileStore) Save(path string, data []byte) error {
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, data, 0600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
+
+// Append adds data to the end of the file, creating it if needed.
+func (fileStore) Append(path string, data []byte) error {
+    f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+    if _, err := f.Write(data); err != nil {
+        f.Close()
+        return err
+    }
+    return f.Close()
+}
+
+// withDefaults fills in the injectable dependencies an embedder left nil and
+// the default network name.
+func (o Options) withDefaults() Options {
+    if o.DefaultNetwork == "" {
+        o.DefaultNetwork = "global"
+    }
+    if o.Logger == nil {
+        o.Logger = logging.Std{}
+    }
+    if o.Metrics == nil {
+        o.Metrics = metrics.New()
+    }
+    if o.Store == nil {
+        o.Store = fileStore{}
+    }
+    if o.WriteQueueSize <= 0 {
+        o.WriteQueueSize = 1024
+    }
+    if o.WriteTimeoutMs <= 0 {
+        o.WriteTimeoutMs = 10000
+    }
+    if o.SlowConsumerPolicy != slowConsumerDrop {
+        o.SlowConsumerPolicy = slowConsumerDisconnect
+    }
+    if o.FanoutWorkers == 0 {
+        o.FanoutWorkers = 4
+    }
+    if o.FanoutMinPeers <= 0 {
+        o.FanoutMinPeers = 64
+    }
+    if o.FanoutQueueSize <= 0 {
+        o.FanoutQueueSize = 256
+    }
+    if o.PeerIdMaxLength <= 0 {
+        o.PeerIdMaxLength = defaultPeerIdMaxLength
+    }
+    if o.PollJournalMaxBytes <= 0 {
+        o.PollJournalMaxBytes = 256 << 10
+    }
+    if o.PollJournalRetentionMs <= 0 {
+        o.PollJournalRetentionMs = 300000
+    }
+    if o.PowChallengeTTLMs <= 0 {
+        o.PowChallengeTTLMs = 60000
+    }
+    if o.StateMaxAgeMs <= 0 {
+        o.StateMaxAgeMs = 600000
+    }
+    if o.MaxRoomsPerPeer <= 0 {
+        o.MaxRoomsPerPeer = 32
+    }
+    if o.MaxMissedPongs <= 0 {
+        o.MaxMissedPongs = 2
+    }
+    if o.TURNCredentialTTLMs <= 0 {
+        o.TURNCredentialTTLMs = 24 * 3600 * 1000
+    }
+    if o.MeshMaxDialed <= 0 {
+        o.MeshMaxDialed = 8
+    }
+    if o.MeshMaxHops <= 0 {
+        o.MeshMaxHops = 8
+    }
+    if o.EventBridgeTopic == "" {
+        o.EventBridgeTopic = "peerpigeon.{event}"
+    }
+    if o.EventBridgeBatchSize <= 0 {
+        o.EventBridgeBatchSize = 100
+    }
+    if o.EventBridgeFlushMs <= 0 {
+        o.EventBridgeFlushMs = 1000
+    }
+    if o.EventBridgeQueueSize <= 0 {
+        o.EventBridgeQueueSize = 10000
+    }
+    if o.EventBridgeDelivery == "" {
+        o.EventBridgeDelivery = deliveryAtLeastOnce
+    }
+    if o.BackplanePrefix == "" {
+        o.BackplanePrefix = "peerpigeon"
+    }
+    if o.BackplaneHeartbeatMs <= 0 {
+        o.BackplaneHeartbeatMs = 5000
+    }
+    if o.GuardrailWarnPercent <= 0 {
+        o.GuardrailWarnPercent = 90
+    }
+    if o.JWKSRefreshMs <= 0 {
+        o.JWKSRefreshMs = 600000
+    }
+    if o.JWTPeerIdClaim == "" {
+        o.JWTPeerIdClaim = "sub"
+    }
+    if o.JWTNetworksClaim == "" {
+        o.JWTNetworksClaim = "networks"
+    }
+    if o.AnalyticsRetentionMs <= 0 {
+        o.AnalyticsRetentionMs = 30 * 24 * 3600 * 1000
+    }
+    return o
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+    "encoding/json"
+    "sync/atomic"
+)
+
+// Discovery filters. In a network of thousands, a new peer need not hear of
+// every other one. A peer narrows what it discovers with "discoveryFilter"
+// in its announce data:
+//
+//     {"type": "announce", "data": {"discoveryFilter": {
+//      "capabilities": ["relay"], "labels": {"region": "eu"}, "maxPeers": 50}}}
+//
+// Only peers with every listed capability and label, matched as find-peers
+// does, are in the peer list it gets on announce, local peers first, and at
+// most maxPeers of them. Later peer-discovered and peer-list messages about
+// other peers, from this hub or the mesh, are held to the same capabilities
+// and labels. Hubs always pass, and peer-disconnected, event replay and
+// find-peers are not filtered. A filter is kept until the next announce, so
+// re-announcing without one restores full discovery. Discoveries withheld
+// are counted under "discovery_filter" in /metrics.
+const maxFilterPeers = 10000
+
+type discoveryFilter struct {
+    caps     []string
+    labels   []string
+    maxPeers int
+}
+
+type discoveryFilterStats struct {
+    withheld int64
+}
+
+// parseDiscoveryFilter reads data["discoveryFilter"]. It returns nil when
+// there is none, and a problem when it is unusable.
+func parseDiscoveryFilter(data map[string]interface{}) (*discoveryFilter, string) {
+    raw, ok := data["discoveryFilter"]
+    if !ok || raw == nil {
+        return nil, ""
+    }
+    m, ok := raw.(map[string]interface{})
+    if !ok {
+        return nil, "discoveryFilter must be an object"
+    }
+    var shape struct {
+        Capabilities []string               `json:"capabilities"`
+        Labels       map[string]interface{} `json:"labels"`
+        MaxPeers     int                    `json:"maxPeers"`
+    }
+    b, _ := json.Marshal(m)
+    if json.Unmarshal(b, &shape) != nil {
+        return nil, "discoveryFilter takes capabilities (strings), labels (an object) and maxPeers (a number)"
+    }
+    if shape.MaxPeers < 0 || shape.MaxPeers > maxFilterPeers {
+        return nil, "discoveryFilter maxPeers must be between 0 and 10000"
+    }
+    f := &discoveryFilter{caps: peerCapabilities(m), labels: peerLabels(m), maxPeers: shape.MaxPeers}
+    if len(f.labels) != len(shape.Labels) {
+        return nil, "discoveryFilter labels must be strings, numbers or booleans"
+    }
+    return f, ""
+}
+
+// checkDiscoveryFilter validates data["discoveryFilter"], sending the peer
+// an error and reporting false when it is unusable.
+func (s *Server) checkDiscoveryFilter(peerId string, data map[string]interface{}) bool {
+    if _, problem := parseDiscoveryFilter(data); problem != "" {
+        s.sendError(s.getConn(peerId), peerId, problem)
+        return false
+    }
+    return true
+}
+
+// matches reports whether a peer with announce data passes the filter. A
+// nil filter passes everything.
+func (f *discoveryFilter) matches(data map[string]interface{}) bool {
+    if f == nil {
+        return true
+    }
+    if isHub, _ := data["isHub"].(bool); isHub {
+        return true
+    }
+    if len(f.caps) > 0 {
+        have := map[string]bool{}
+        for _, c := range peerCapabilities(data) {
+            have[c] = true
+        }
+        for _, c := range f.caps {
+            if !have[c] {
+                return false
+            }
+        }
+    }
+    if len(f.labels) > 0 {
+        have := map[string]bool{}
+        for _, l := range peerLabels(data) {
+            have[l] = true
+        }
+        for _, l := range f.labels {
+            if !have[l] {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+// wants reports whether recipient should hear of a peer with data, counting
+// the discoveries it does not.
+func (s *Server) wants(recipient *peerInfo, data map[string]interface{}) bool {
+    if recipient == nil || recipient.Filter.matches(data) {
+        return true
+    }
+    atomic.AddInt64(&s.discoveryFilter.withheld, 1)
+    return false
+}
+
+// full reports whether a peer list of sent peers has reached maxPeers.
+func (f *discoveryFilter) full(sent int) bool {
+    return f != nil && f.maxPeers > 0 && sent >= f.maxPeers
+}
+
+// forwardDiscovery sends peer-discovered about peers, or a peer-list when
+// there are several, to each local peer on netName, leaving out the peers
+// its filter does not match.
+func (s *Server) forwardDiscovery(netName string, peers []map[string]interface{}) {
+    for _, id := range s.getActivePeers("", netName) {
+        recipient := s.getPeerInfo(id)
+        matched := make([]map[string]interface{}, 0, len(peers))
+        for _, p := range peers {
+            if s.wants(recipient, p) {
+                matched = append(matched, p)
+            }
+        }
+        switch len(matched) {
+        case 0:
+        case 1:
+            s.sendToConn(s.getConn(id), outboundMessage{Type: "peer-discovered", Data: matched[0], FromPeerId: "system", NetworkName: netName, Timestamp: nowMs()})
+        default:
+            s.sendToConn(s.getConn(id), outboundMessage{Type: "peer-list", Data: map[string]interface{}{"peers": matched}, FromPeerId: "system", NetworkName: netName, Timestamp: nowMs()})
+        }
+    }
+}
+
+func (s *Server) discoveryFilterSnapshot() map[string]interface{} {
+    filtered := 0
+    s.peersMu.Lock()
+    for _, pi := range s.peerData {
+        if pi.Filter != nil {
+            filtered++
+        }
+    }
+    s.peersMu.Unlock()
+    return map[string]interface{}{"peers": filtered, "withheld": atomic.LoadInt64(&s.discoveryFilter.withheld)}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+    "encoding/json"
+    "testing"
+    "time"
+)
+
+func TestDiscoveryFilterNarrowsPeerListAndBroadcasts(t *testing.T) {
+    s := NewServer(Options{IsHub: true})
+    conns := map[string]*pollConn{}
+    connect := func() string {
+        id := randomPeerId()
+        conns[id] = attachTestPeer(t, s, id)
+        return id
+    }
+    discovered := func(id string) []string {
+        msgs, _ := conns[id].take(20 * time.Millisecond)
+        out := []string{}
+        for _, raw := range msgs {
+            var m struct {
+                Type string
+                Data map[string]interface{}
+            }
+            json.Unmarshal(raw, &m)
+            peers := []interface{}{m.Data}
+            if m.Type == "peer-list" {
+                peers, _ = m.Data["peers"].([]interface{})
+            } else if m.Type != "peer-discovered" {
+                continue
+            }
+            for _, p := range peers {
+                out = append(out, p.(map[string]interface{})["peerId"].(string))
+            }
+        }
+        return out
+    }
+    relayEU, plain, relayUS := connect(), connect(), connect()
+    s.handleMessage(relayEU, []byte(`{"type":"announce","networkName":"n","data":{"capabilities":["relay"],"labels":{"region":"eu"}}}`))
+    s.handleMessage(plain, []byte(`{"type":"announce","networkName":"n","data":{}}`))
+    s.handleMessage(relayUS, []byte(`{"type":"announce","networkName":"n","data":{"capabilities":["relay"],"labels":{"region":"us"}}}`))
+
+    bad := connect()
+    s.handleMessage(bad, []byte(`{"type":"announce","networkName":"n","data":{"discoveryFilter":{"maxPeers":-1}}}`))
+    if s.getPeerInfo(bad).Announced {
+        t.Fatalf("a bad filter should refuse the announce")
+    }
+
+    eu := connect()
+    s.handleMessage(eu, []byte(`{"type":"announce","networkName":"n","data":{"discoveryFilter":{"capabilities":["relay"],"labels":{"region":"eu"}}}}`))
+    if got := discovered(eu); len(got) != 1 || got[0] != relayEU {
+        t.Fatalf("the peer list should hold only the matching peer, got %v", got)
+    }
+    capped := connect()
+    s.handleMessage(capped, []byte(`{"type":"announce","networkName":"n","data":{"discoveryFilter":{"capabilities":["relay"],"maxPeers":1}}}`))
+    if got := discovered(capped); len(got) != 1 || (got[0] != relayEU && got[0] != relayUS) {
+        t.Fatalf("maxPeers should cap the peer list, got %v", got)
+    }
+    for _, c := range conns {
+        c.take(20 * time.Millisecond)
+    }
+
+    // Live discoveries, local and from the mesh, are filtered per recipient.
+    late := connect()
+    s.handleMessage(late, []byte(`{"type":"announce","networkName":"n","data":{"capabilities":["relay"],"labels":{"region":"eu"}}}`))
+    s.deliverCrossHubDiscovery("n", "remote-plain", map[string]interface{}{"peerId": "remote-plain"})
+    s.deliverCrossHubDiscovery("n", "remote-relay", map[string]interface{}{"peerId": "remote-relay", "capabilities": []interface{}{"relay"}})
+    if got := discovered(eu); len(got) != 1 || got[0] != late {
+        t.Fatalf("eu should only hear of late, got %v", got)
+    }
+    if got := discovered(capped); len(got) != 2 || got[1] != "remote-relay" {
+        t.Fatalf("maxPeers should not limit live discovery, got %v", got)
+    }
+    if got := discovered(plain); len(got) != 3 {
+        t.Fatalf("peers without a filter should hear of everyone, got %v", got)
+    }
+    if m := s.discoveryFilterSnapshot(); m["peers"] != 2 || m["withheld"].(int64) == 0 {
+        t.Fatalf("unexpected discovery filter metrics %v", m)
+    }
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+const migrationTokenTTL = 10 * 60 * 1000
+
+type drainState struct {
+    Active     bool     `json:"active"`
+    StartedAt  int64    `json:"startedAt"`
+    WindowMs   int64    `json:"windowMs"`
+    Alternates []string `json:"alternates"`
+    Total      int      `json:"total"`
+    Notified   int      `json:"notified"`
+    peers      []string
+    // wasMaintenance is the maintenance mode before the drain, restored
+    // when it is cancelled.
+    wasMaintenance bool
+    restored       bool
+}
+
+// adminStartDrain puts the hub into maintenance and, over windowMs, tells
+// each connected peer to reconnect to one of the alternate hubs so a planned
+// restart does not cause a reconnect herd.
+func (s *Server) adminStartDrain(c *gin.Context) {
+    var body struct {
+        Alternates []string `json:"alternates"`
+        WindowMs   int64    `json:"windowMs"`
+    }
+    if err := json.NewDecoder(c.Request.Body).Decode(&body); err != nil || len(body.Alternates) == 0 {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "alternates required"}, s.opts.CORSOrigin)
+        return
+    }
+    if body.WindowMs <= 0 {
+        body.WindowMs = 60000
+    }
+    peers := []string{}
+    s.peersMu.Lock()
+    for id, pi := range s.peerData {
+        if !pi.IsHub {
+            peers = append(peers, id)
+        }
+    }
+    s.peersMu.Unlock()
+    sort.Strings(peers)
+
+    s.adminMu.Lock()
+    if s.drain != nil && s.drain.Active {
+        s.adminMu.Unlock()
+        writeJSON(c.Writer, http.StatusConflict, map[string]interface{}{"error": "drain already in progress"}, s.opts.CORSOrigin)
+        return
+    }
+    s.drain = &drainState{Active: true, StartedAt: nowMs(), WindowMs: body.WindowMs, Alternates: body.Alternates, Total: len(peers), peers: peers, wasMaintenance: s.maintenance}
+    s.maintenance = true
+    d := s.drain
+    s.adminMu.Unlock()
+    s.audit(c, "drain", map[string]interface{}{"alternates": body.Alternates, "windowMs": body.WindowMs, "peers": len(peers)})
+    s.spawn("drain", "server", func() { s.runDrain(d) })
+    writeJSON(c.Writer, http.StatusAccepted, s.drainProgress(), s.opts.CORSOrigin)
+}
+
+func (s *Server) runDrain(d *drainState) {
+    interval := time.Duration(0)
+    if len(d.peers) > 0 {
+        interval = time.Duration(d.WindowMs) * time.Millisecond / time.Duration(len(d.peers))
+    }
+    for i, id := range d.peers {
+        s.adminMu.Lock()
+        active := d.Active
+        s.adminMu.Unlock()
+        if !active {
+            return
+        }
+        alt := d.Alternates[i%len(d.Alternates)]
+        s.forwardToLocalTarget(id, outboundMessage{Type: "reconnect-to", Data: map[string]interface{}{"url": alt, "alternates": d.Alternates, "migrationToken": s.migrationToken(id)}, FromPeerId: "system", TargetPeer: id, NetworkName: "global", Timestamp: nowMs()})
+        s.adminMu.Lock()
+        d.Notified++
+        s.adminMu.Unlock()
+        time.Sleep(interval)
+    }
+    s.adminMu.Lock()
+    d.Active = false
+    s.adminMu.Unlock()
+}
+
+func (s *Server) adminDrainStatus(c *gin.Context) {
+    writeJSON(c.Writer, http.StatusOK, s.drainProgress(), s.opts.CORSOrigin)
+}
+
+// adminCancelDrain stops a drain and puts maintenance mode back the way it
+// was before the drain started.
+func (s *Server) adminCancelDrain(c *gin.Context) {
+    s.adminMu.Lock()
+    if d := s.drain; d != nil && !d.restored {
+        d.Active = false
+        d.restored = true
+        s.maintenance = d.wasMaintenance
+    }
+    s.adminMu.Unlock()
+    s.audit(c, "drain-cancel", nil)
+    writeJSON(c.Writer, http.StatusOK, s.drainProgress(), s.opts.CORSOrigin)
+}
+
+func (s *Server) drainProgress() map[string]interface{} {
+    s.adminMu.Lock()
+    d := s.drain
+    if d == nil {
+        s.adminMu.Unlock()
+        return map[string]interface{}{"active": false}
+    }
+    out := map[string]interface{}{"active": d.Active, "startedAt": d.StartedAt, "windowMs": d.WindowMs, "alternates": d.Alternates, "total": d.Total, "notified": d.Notified}
+    peers := d.peers
+    s.adminMu.Unlock()
+    remaining := 0
+    for _, id := range peers {
+        if s.getConn(id) != nil {
+            remaining++
+        }
+    }
+    out["remaining"] = remaining
+    return out
+}
+
+// migrationToken lets a drained peer skip admission control on a hub sharing
+// the same MigrationSecret. Format: base64(peerId|expiry|hmac).
+func (s *Server) migrationToken(peerId string) string {
+    if s.opts.MigrationSecret == "" {
+        return ""
+    }
+    payload := peerId + "|" + strconv.FormatInt(nowMs()+migrationTokenTTL, 10)
+    return base64.RawURLEncoding.EncodeToString([]byte(payload + "|" + s.signMigration(payload)))
+}
+
+func (s *Server) validMigrationToken(token, peerId string) bool {
+    if s.opts.MigrationSecret == "" || token == "" {
+        return false
+    }
+    raw, err := base64.RawURLEncoding.DecodeString(token)
+    if err != nil {
+        return false
+    }
+    parts := strings.Split(string(raw), "|")
+    if len(parts) != 3 || parts[0] != peerId {
+        return false
+    }
+    expiry, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil || nowMs() > expiry {
+        return false
+    }
+    return hmac.Equal([]byte(parts[2]), []byte(s.signMigration(parts[0]+"|"+parts[1])))
+}
+
+func (s *Server) signMigration(payload string) string {
+    mac := hmac.New(sha256.New, []byte(s.opts.MigrationSecret))
+    mac.Write([]byte(payload))
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/gin-gonic/gin"
+)
+
+func TestCancelDrainRestoresMaintenanceMode(t *testing.T) {
+    s := NewServer(Options{AdminToken: "admin-secret", CORSOrigin: "*"})
+    s.engine = gin.New()
+    s.registerAdminRoutes()
+    do := func(method, path, body string) int {
+        req := httptest.NewRequest(method, path, strings.NewReader(body))
+        req.Header.Set("Authorization", "Bearer admin-secret")
+        rec := httptest.NewRecorder()
+        s.engine.ServeHTTP(rec, req)
+        return rec.Code
+    }
+    for _, before := range []bool{false, true} {
+        do("POST", "/admin/maintenance", fmt.Sprintf(`{"enabled":%v}`, before))
+        if code := do("POST", "/admin/drain", `{"alternates":["wss://hub-b.example.com/ws"],"windowMs":60000}`); code != http.StatusAccepted || !s.inMaintenance() {
+            t.Fatalf("drain should start in maintenance, got %d", code)
+        }
+        do("DELETE", "/admin/drain", "")
+        if s.inMaintenance() != before {
+            t.Fatalf("cancelling the drain should restore maintenance %v", before)
+        }
+    }
+}
+
+func TestMigrationTokenBoundToPeerAndSecret(t *testing.T) {
+    a := NewServer(Options{MigrationSecret: "shared"})
+    b := NewServer(Options{MigrationSecret: "shared"})
+    other := NewServer(Options{MigrationSecret: "different"})
+    id := "0123456789abcdef0123456789abcdef01234567"
+    tok := a.migrationToken(id)
+    if !b.validMigrationToken(tok, id) {
+        t.Fatalf("hub sharing the secret should accept the token")
+    }
+    if other.validMigrationToken(tok, id) || b.validMigrationToken(tok, strings.Repeat("f", 40)) {
+        t.Fatalf("token accepted with wrong secret or peerId")
+    }
+}
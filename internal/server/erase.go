@@ -0,0 +1,281 @@
+package server
+
+import (
+    "net/http"
+    "sort"
+    "github.com/gin-gonic/gin"
+)
+
+const maxEraseReports = 100
+
+// eraseReport collects what each hub removed for one erase request. Reports
+// hold only the eraseId so the log itself does not retain the erased peerId.
+type eraseReport struct {
+    EraseId     string                    `json:"eraseId"`
+    RequestedAt int64                     `json:"requestedAt"`
+    Hubs        map[string]map[string]int `json:"hubs"`
+}
+
+// adminErasePeer purges every trace of a peerId held by this hub and floods
+// an erase-peer request through the mesh. Remote hubs answer with
+// erase-report messages that accumulate under GET /admin/erase/:eraseId.
+func (s *Server) adminErasePeer(c *gin.Context) {
+    peerId := c.Param("peerId")
+    if !s.validPeerId(peerId) {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "invalid peerId"}, s.opts.CORSOrigin)
+        return
+    }
+    eraseId := newMessageId()
+    removed := s.erasePeer(peerId)
+    rep := &eraseReport{EraseId: eraseId, RequestedAt: nowMs(), Hubs: map[string]map[string]int{firstNonEmpty(s.hubPeerId, "local"): removed}}
+    s.adminMu.Lock()
+    s.erasures = append(s.erasures, rep)
+    if len(s.erasures) > maxEraseReports {
+        s.erasures = s.erasures[len(s.erasures)-maxEraseReports:]
+    }
+    s.adminMu.Unlock()
+    s.markRelayed("erase:" + eraseId)
+    s.forwardToMesh(outboundMessage{Type: "erase-peer", Data: map[string]interface{}{"peerId": peerId}, FromPeerId: "system", Timestamp: nowMs(), MessageId: eraseId}, "", "")
+    s.audit(c, "erase", map[string]interface{}{"eraseId": eraseId})
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"eraseId": eraseId, "removed": removed}, s.opts.CORSOrigin)
+}
+
+func (s *Server) adminEraseStatus(c *gin.Context) {
+    id := c.Param("eraseId")
+    s.adminMu.Lock()
+    defer s.adminMu.Unlock()
+    for _, rep := range s.erasures {
+        if rep.EraseId == id {
+            hubs := make([]string, 0, len(rep.Hubs))
+            for h := range rep.Hubs {
+                hubs = append(hubs, h)
+            }
+            sort.Strings(hubs)
+            writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"eraseId": rep.EraseId, "requestedAt": rep.RequestedAt, "hubsReported": hubs, "hubs": rep.Hubs}, s.opts.CORSOrigin)
+            return
+        }
+    }
+    writeJSON(c.Writer, http.StatusNotFound, map[string]interface{}{"error": "unknown eraseId"}, s.opts.CORSOrigin)
+}
+
+// handleMeshErase applies an erase-peer request from another hub, reports
+// back to the originating hub and passes the request on.
+func (s *Server) handleMeshErase(fromHub, fromUri string, msg inboundMessage) {
+    m, _ := msg.Data.(map[string]interface{})
+    peerId, _ := m["peerId"].(string)
+    if msg.MessageId == "" || !s.validPeerId(peerId) || s.alreadyVisited(msg) || !s.markRelayed("erase:"+msg.MessageId) {
+        return
+    }
+    removed := s.erasePeer(peerId)
+    s.forwardToMesh(outboundMessage{Type: "erase-peer", Data: msg.Data, FromPeerId: "system", Timestamp: nowMs(), MessageId: msg.MessageId, OriginHub: msg.OriginHub, SeenHubs: msg.SeenHubs, Hops: msg.Hops}, fromUri, fromHub)
+    report := map[string]interface{}{"eraseId": msg.MessageId, "targetHub": msg.OriginHub, "hubId": s.hubPeerId, "removed": removed}
+    s.markRelayed("erase-report:" + msg.MessageId + ":" + s.hubPeerId)
+    s.forwardToMesh(outboundMessage{Type: "erase-report", Data: report, FromPeerId: "system", Timestamp: nowMs(), MessageId: newMessageId()}, "", "")
+}
+
+// handleMeshEraseReport records a remote hub's erase result if this hub
+// started the request, and otherwise relays it toward the rest of the mesh.
+func (s *Server) handleMeshEraseReport(fromHub, fromUri string, msg inboundMessage) {
+    m, _ := msg.Data.(map[string]interface{})
+    eraseId, _ := m["eraseId"].(string)
+    target, _ := m["targetHub"].(string)
+    hubId, _ := m["hubId"].(string)
+    if eraseId == "" || hubId == "" || s.alreadyVisited(msg) || !s.markRelayed("erase-report:"+eraseId+":"+hubId) {
+        return
+    }
+    if target != s.hubPeerId {
+        s.forwardToMesh(outboundMessage{Type: "erase-report", Data: msg.Data, FromPeerId: "system", Timestamp: nowMs(), MessageId: msg.MessageId, OriginHub: msg.OriginHub, SeenHubs: msg.SeenHubs, Hops: msg.Hops}, fromUri, fromHub)
+        return
+    }
+    removed := map[string]int{}
+    if r, ok := m["removed"].(map[string]interface{}); ok {
+        for k, v := range r {
+            if n, ok := v.(float64); ok {
+                removed[k] = int(n)
+            }
+        }
+    }
+    s.adminMu.Lock()
+    for _, rep := range s.erasures {
+        if rep.EraseId == eraseId {
+            rep.Hubs[hubId] = removed
+        }
+    }
+    s.adminMu.Unlock()
+}
+
+// erasePeer disconnects peerId if it is connected here and removes it from
+// every store the hub keeps, returning how many records each store dropped.
+func (s *Server) erasePeer(peerId string) map[string]int {
+    removed := map[string]int{}
+    conn := s.getConn(peerId)
+    pi := s.getPeerInfo(peerId)
+    if pi != nil {
+        removed["peerInfo"] = 1
+    }
+    // Clean up before closing so the disconnect path finds nothing to record.
+    s.cleanupPeer(peerId)
+    if conn != nil {
+        conn.Close()
+        removed["connections"] = 1
+    }
+    s.bootstrapMu.Lock()
+    for _, cache := range s.crossHubCache {
+        if _, ok := cache[peerId]; ok {
+            delete(cache, peerId)
+            removed["crossHubCache"]++
+        }
+    }
+    s.bootstrapMu.Unlock()
+    s.remoteIndex.drop("", peerId)
+    removed["events"] = s.events.forget(peerId)
+    removed["changes"] = s.changes.forget(peerId)
+    if pi != nil && pi.Announced && !pi.IsHub {
+        s.changes.publish(changeRemoved, firstNonEmpty(pi.NetworkName, s.opts.DefaultNetwork), peerId, nil, changeReasonErased)
+    }
+    removed["blobs"] = s.blobs.forget(peerId)
+    removed["signalingSessions"] = s.signaling.forget(peerId)
+    removed["pollSessions"] = s.forgetPollSessions(peerId)
+    if s.journal != nil {
+        n, err := s.journal.forget(peerId)
+        if err != nil {
+            s.log.Warn("poll_journal_compact_failed", map[string]interface{}{"path": s.journal.key, "error": err.Error()})
+        }
+        removed["pollJournal"] = n
+    }
+    removed["reputation"] = s.forgetReputation(peerId)
+    removed["auditEntries"] = s.forgetAudit(peerId)
+    if s.identities != nil && s.identities.forget(peerId) {
+        removed["identities"] = 1
+    }
+    for k, v := range removed {
+        if v == 0 {
+            delete(removed, k)
+        }
+    }
+    return removed
+}
+
+// applyRetention drops audit entries, replay events and erase reports older
+// than DataRetentionMs. Zero keeps them until they age out of their buffers.
+func (s *Server) applyRetention(now int64) {
+    if s.opts.DataRetentionMs <= 0 {
+        return
+    }
+    cutoff := now - int64(s.opts.DataRetentionMs)
+    s.events.pruneBefore(cutoff)
+    s.adminMu.Lock()
+    for len(s.auditLog) > 0 && s.auditLog[0].Timestamp < cutoff {
+        s.auditLog = s.auditLog[1:]
+    }
+    for len(s.erasures) > 0 && s.erasures[0].RequestedAt < cutoff {
+        s.erasures = s.erasures[1:]
+    }
+    s.adminMu.Unlock()
+}
+
+func (s *Server) forgetAudit(peerId string) int {
+    s.adminMu.Lock()
+    defer s.adminMu.Unlock()
+    kept := s.auditLog[:0]
+    n := 0
+    for _, e := range s.auditLog {
+        if e.Details["peerId"] == peerId {
+            n++
+            continue
+        }
+        kept = append(kept, e)
+    }
+    s.auditLog = kept
+    return n
+}
+
+func (s *Server) forgetPollSessions(peerId string) int {
+    s.pollMu.Lock()
+    var closing []*pollConn
+    for tok, p := range s.pollSessions {
+        if p.peerId == peerId {
+            delete(s.pollSessions, tok)
+            closing = append(closing, p)
+        }
+    }
+    s.pollMu.Unlock()
+    for _, p := range closing {
+        p.Close()
+    }
+    return len(closing)
+}
+
+func (l *eventLog) forget(peerId string) int {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    n := 0
+    for _, ne := range l.nets {
+        kept := ne.events[:0]
+        for _, e := range ne.events {
+            if e.PeerId == peerId {
+                n++
+                continue
+            }
+            kept = append(kept, e)
+        }
+        ne.events = kept
+    }
+    return n
+}
+
+func (l *eventLog) pruneBefore(cutoff int64) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    for _, ne := range l.nets {
+        i := 0
+        for i < len(ne.events) && ne.events[i].Timestamp < cutoff {
+            i++
+        }
+        ne.events = ne.events[i:]
+    }
+}
+
+func (r *blobRelay) forget(peerId string) int {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    n := 0
+    for key, t := range r.transfers {
+        if t.from == peerId || t.target == peerId {
+            r.releaseLocked(key, t)
+            n++
+        }
+    }
+    return n
+}
+
+func (t *signalingTracker) forget(peerId string) int {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    n := 0
+    for key, ss := range t.sessions {
+        if ss.a == peerId || ss.b == peerId {
+            delete(t.sessions, key)
+            n++
+        }
+    }
+    for key, ss := range t.ended {
+        if ss.a == peerId || ss.b == peerId {
+            delete(t.ended, key)
+            n++
+        }
+    }
+    return n
+}
+
+// forget drops the key binding for peerId and rewrites the store.
+func (st *identityStore) forget(peerId string) bool {
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    if _, ok := st.keys[peerId]; !ok {
+        return false
+    }
+    delete(st.keys, peerId)
+    st.saveLocked()
+    return true
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+func TestAdminErasePurgesPeerTraces(t *testing.T) {
+    dir := t.TempDir()
+    opts := Options{AdminToken: "admin-secret", CORSOrigin: "*", EventReplaySize: 10, PollJournalPath: filepath.Join(dir, "poll.journal"), ReputationStorePath: filepath.Join(dir, "bans.json"), ReputationBanAt: 100}
+    s := NewServer(opts)
+    s.engine = gin.New()
+    s.registerAdminRoutes()
+    id := "0123456789abcdef0123456789abcdef01234567"
+    s.journal.append(id, []byte(`{"type":"peer-message","data":{"n":1},"fromPeerId":"x","networkName":"global","timestamp":1}`))
+    s.peerData[id] = &peerInfo{PeerId: id, Connected: true}
+    s.penalize(id, offenceProtocol, "test")
+    s.reputation.reports["other>"+id] = nowMs()
+    s.banPeer(id, "test", 0, time.Hour)
+    s.events.record("global", "peer-discovered", id, nil)
+    s.cacheCrossHubPeer("global", id, map[string]interface{}{})
+    s.signaling.observe("offer", id, "other", "global")
+    s.auditLog = append(s.auditLog, auditEntry{Seq: 1, Action: "kick", Details: map[string]interface{}{"peerId": id}})
+
+    req := httptest.NewRequest("POST", "/admin/erase/"+id, nil)
+    req.Header.Set("Authorization", "Bearer admin-secret")
+    rec := httptest.NewRecorder()
+    s.engine.ServeHTTP(rec, req)
+    var out struct {
+        EraseId string         `json:"eraseId"`
+        Removed map[string]int `json:"removed"`
+    }
+    if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &out) != nil {
+        t.Fatalf("erase failed: %d %s", rec.Code, rec.Body.String())
+    }
+    for _, k := range []string{"events", "crossHubCache", "signalingSessions", "auditEntries", "pollJournal"} {
+        if out.Removed[k] != 1 {
+            t.Fatalf("expected one %s record removed, got %v", k, out.Removed)
+        }
+    }
+    if out.Removed["reputation"] != 3 {
+        t.Fatalf("expected the score, the ban and the report removed, got %v", out.Removed)
+    }
+    if strings.Contains(fmt.Sprint(s.auditLog), id) {
+        t.Fatalf("audit log still mentions erased peer: %v", s.auditLog)
+    }
+    for _, path := range []string{opts.PollJournalPath, opts.ReputationStorePath} {
+        if data, _ := os.ReadFile(path); strings.Contains(string(data), id) {
+            t.Fatalf("%s still mentions erased peer:\n%s", path, data)
+        }
+    }
+    // A restart finds nothing to replay and no ban.
+    again := NewServer(opts)
+    if msgs := again.journal.take(id); len(msgs) != 0 || again.isBanned(id) {
+        t.Fatalf("erased peer came back after a restart: %d journaled, banned %v", len(msgs), again.isBanned(id))
+    }
+
+    req = httptest.NewRequest("GET", "/admin/erase/"+out.EraseId, nil)
+    req.Header.Set("Authorization", "Bearer admin-secret")
+    rec = httptest.NewRecorder()
+    s.engine.ServeHTTP(rec, req)
+    if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), out.EraseId) {
+        t.Fatalf("expected erase report, got %d %s", rec.Code, rec.Body.String())
+    }
+}
@@ -0,0 +1,409 @@
+package server
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "path"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Event bridge. With EventBridgeURL set, the hub publishes its peer
+// lifecycle and mesh events to a message bus, for platforms that feed hub
+// activity into their own event pipelines:
+//
+//     peer.added, peer.updated, peer.removed   every change feed entry
+//     mesh.member-joined, mesh.member-left     the mesh membership table
+//     mesh.link-up, mesh.link-down             links this hub dials
+//
+// nats://[user:pass@]host:4222 (or tls:// for TLS) publishes to NATS core
+// subjects. kafka+http://proxy:8082 (or kafka+https://) produces to Kafka
+// through a REST proxy (Confluent REST Proxy, Redpanda's HTTP proxy) with
+// v2 JSON records keyed by peer or hub ID, so each peer's events stay in
+// order on one partition. EventBridgeTopics maps events to topics with
+// "pattern=template" rules ("peer.*=peers.{network}"), tried in order; the
+// template may use {event}, {network} and {hub}, an empty template drops the
+// event, and events no rule matches go to EventBridgeTopic.
+//
+// Events are queued (EventBridgeQueueSize, overflow is dropped and counted)
+// and sent in batches of EventBridgeBatchSize, at least every
+// EventBridgeFlushMs. With at-least-once delivery, the default, a failed
+// batch is retried with backoff until the bus confirms it, so a retry after
+// a lost confirmation can publish duplicates; NATS batches are confirmed
+// with a PING round trip. at-most-once drops a failed batch. On shutdown the
+// hub makes one last attempt to flush the queue. Counters are under
+// "event_bridge" in /metrics.
+const (
+    deliveryAtLeastOnce = "at-least-once"
+    deliveryAtMostOnce  = "at-most-once"
+
+    bridgeMaxBackoff   = 30 * time.Second
+    bridgeCloseTimeout = 5 * time.Second
+)
+
+// BridgeEvent is the JSON value published for each event.
+type BridgeEvent struct {
+    Event       string                 `json:"event"`
+    HubPeerId   string                 `json:"hubPeerId"`
+    NetworkName string                 `json:"networkName,omitempty"`
+    PeerId      string                 `json:"peerId,omitempty"`
+    Seq         int64                  `json:"seq,omitempty"`
+    Reason      string                 `json:"reason,omitempty"`
+    Data        map[string]interface{} `json:"data,omitempty"`
+    Timestamp   int64                  `json:"timestamp"`
+}
+
+// bridgeRecord is an encoded event addressed to a topic.
+type bridgeRecord struct {
+    topic string
+    key   string
+    value []byte
+}
+
+// bridgeTransport publishes a batch, returning nil only once the bus has
+// accepted all of it.
+type bridgeTransport interface {
+    publish(batch []bridgeRecord) error
+    close()
+}
+
+type topicRule struct {
+    pattern  string
+    template string
+}
+
+type eventBridge struct {
+    transport bridgeTransport
+    kind      string
+    rules     []topicRule
+    fallback  string
+    hubPeerId string
+    batchSize int
+    flush     time.Duration
+    queueSize int
+    delivery  string
+
+    mu        sync.Mutex
+    queue     []bridgeRecord
+    started   bool
+    wake      chan struct{}
+    done      chan struct{}
+    closeOnce sync.Once
+    finished  chan struct{}
+    published int64
+    failed    int64
+    dropped   int64
+    retries   int64
+    lastError string
+}
+
+func newEventBridge(o Options, hubPeerId string) (*eventBridge, error) {
+    transport, kind, err := newBridgeTransport(o.EventBridgeURL, hubPeerId)
+    if err != nil {
+        return nil, err
+    }
+    rules, err := parseTopicRules(o.EventBridgeTopics)
+    if err != nil {
+        return nil, err
+    }
+    return &eventBridge{transport: transport, kind: kind, rules: rules, fallback: o.EventBridgeTopic, hubPeerId: hubPeerId, batchSize: o.EventBridgeBatchSize, flush: time.Duration(o.EventBridgeFlushMs) * time.Millisecond, queueSize: o.EventBridgeQueueSize, delivery: o.EventBridgeDelivery, wake: make(chan struct{}, 1), done: make(chan struct{}), finished: make(chan struct{})}, nil
+}
+
+func newBridgeTransport(raw, hubPeerId string) (bridgeTransport, string, error) {
+    u, err := url.Parse(raw)
+    if err != nil || u.Host == "" {
+        return nil, "", errors.New("EventBridgeURL " + raw + " is not a URL")
+    }
+    switch u.Scheme {
+    case "nats", "tls":
+        return &natsTransport{u: u, name: "peerpigeon-" + hubPeerId}, "nats", nil
+    case "kafka+http", "kafka+https":
+        base := *u
+        base.Scheme = strings.TrimPrefix(u.Scheme, "kafka+")
+        base.User = nil
+        return &kafkaRESTTransport{base: strings.TrimSuffix(base.String(), "/"), user: u.User, client: http.Client{Timeout: integrationTimeout}}, "kafka", nil
+    }
+    return nil, "", errors.New("EventBridgeURL must be nats://, tls://, kafka+http:// or kafka+https://")
+}
+
+func parseTopicRules(entries []string) ([]topicRule, error) {
+    rules := make([]topicRule, 0, len(entries))
+    for _, e := range entries {
+        pattern, template, ok := strings.Cut(e, "=")
+        if _, err := path.Match(pattern, ""); !ok || pattern == "" || err != nil {
+            return nil, errors.New("event bridge topic rule " + e + " is not pattern=topic")
+        }
+        rules = append(rules, topicRule{pattern: pattern, template: template})
+    }
+    return rules, nil
+}
+
+// topic returns where ev goes, or "" when a rule drops it.
+func (b *eventBridge) topic(ev BridgeEvent) string {
+    template := b.fallback
+    for _, r := range b.rules {
+        if ok, _ := path.Match(r.pattern, ev.Event); ok {
+            template = r.template
+            break
+        }
+    }
+    return strings.NewReplacer("{event}", ev.Event, "{network}", ev.NetworkName, "{hub}", ev.HubPeerId).Replace(template)
+}
+
+// emit queues ev without blocking.
+func (b *eventBridge) emit(ev BridgeEvent) {
+    ev.HubPeerId = b.hubPeerId
+    if ev.Timestamp == 0 {
+        ev.Timestamp = nowMs()
+    }
+    topic := b.topic(ev)
+    if topic == "" {
+        return
+    }
+    value, err := json.Marshal(ev)
+    if err != nil {
+        return
+    }
+    b.mu.Lock()
+    if len(b.queue) >= b.queueSize {
+        b.dropped++
+        b.mu.Unlock()
+        return
+    }
+    b.queue = append(b.queue, bridgeRecord{topic: topic, key: firstNonEmpty(ev.PeerId, ev.HubPeerId), value: value})
+    full := len(b.queue) >= b.batchSize
+    b.mu.Unlock()
+    if full {
+        select {
+        case b.wake <- struct{}{}:
+        default:
+        }
+    }
+}
+
+// PublishChange makes the bridge a change sink, so peer events arrive in
+// change feed order.
+func (b *eventBridge) PublishChange(c PeerChange) error {
+    b.emit(BridgeEvent{Event: "peer." + c.Op, NetworkName: c.NetworkName, PeerId: c.PeerId, Seq: c.Seq, Reason: c.Reason, Data: c.Data, Timestamp: c.Timestamp})
+    return nil
+}
+
+// run sends batches until close is called, then flushes what is left.
+func (b *eventBridge) run() {
+    b.mu.Lock()
+    b.started = true
+    b.mu.Unlock()
+    defer close(b.finished)
+    defer b.transport.close()
+    backoff := b.flush
+    timer := time.NewTimer(b.flush)
+    defer timer.Stop()
+    var retryAt time.Time
+    for {
+        select {
+        case <-b.done:
+            b.drain()
+            return
+        case <-b.wake:
+            // A full batch does not cut a retry backoff short.
+            if time.Now().Before(retryAt) {
+                continue
+            }
+        case <-timer.C:
+        }
+        more, err := b.sendBatch()
+        for more && err == nil {
+            more, err = b.sendBatch()
+        }
+        wait := b.flush
+        if err != nil && b.delivery == deliveryAtLeastOnce {
+            b.mu.Lock()
+            b.retries++
+            b.mu.Unlock()
+            wait, backoff = backoff, minDuration(backoff*2, bridgeMaxBackoff)
+            retryAt = time.Now().Add(wait)
+        } else {
+            backoff = b.flush
+        }
+        if !timer.Stop() {
+            select {
+            case <-timer.C:
+            default:
+            }
+        }
+        timer.Reset(wait)
+    }
+}
+
+// sendBatch publishes the oldest batch and reports whether more is waiting.
+// A failed batch stays queued for at-least-once delivery and is dropped for
+// at-most-once.
+func (b *eventBridge) sendBatch() (bool, error) {
+    b.mu.Lock()
+    n := len(b.queue)
+    if n > b.batchSize {
+        n = b.batchSize
+    }
+    batch := append([]bridgeRecord(nil), b.queue[:n]...)
+    b.mu.Unlock()
+    if n == 0 {
+        return false, nil
+    }
+    err := b.transport.publish(batch)
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    if err != nil {
+        b.failed++
+        b.lastError = err.Error()
+        if b.delivery != deliveryAtMostOnce {
+            return true, err
+        }
+        b.dropped += int64(n)
+    } else {
+        b.published += int64(n)
+    }
+    b.queue = b.queue[n:]
+    return len(b.queue) > 0, err
+}
+
+// drain sends what is left once, dropping the rest at the first failure.
+func (b *eventBridge) drain() {
+    more, err := b.sendBatch()
+    for more && err == nil {
+        more, err = b.sendBatch()
+    }
+    if err != nil {
+        b.mu.Lock()
+        b.dropped += int64(len(b.queue))
+        b.queue = nil
+        b.mu.Unlock()
+    }
+}
+
+func (b *eventBridge) pending() int {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return len(b.queue)
+}
+
+// close flushes the queue and closes the transport, giving up after
+// bridgeCloseTimeout.
+func (b *eventBridge) close() {
+    b.closeOnce.Do(func() { close(b.done) })
+    b.mu.Lock()
+    started := b.started
+    b.mu.Unlock()
+    if !started {
+        return
+    }
+    select {
+    case <-b.finished:
+    case <-time.After(bridgeCloseTimeout):
+    }
+}
+
+func (b *eventBridge) snapshot() map[string]interface{} {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return map[string]interface{}{"transport": b.kind, "delivery": b.delivery, "queued": len(b.queue), "published": b.published, "failed": b.failed, "dropped": b.dropped, "retries": b.retries, "last_error": b.lastError}
+}
+
+// emitMeshEvent hands an event about the hub mesh to the bridge, if there
+// is one.
+func (s *Server) emitMeshEvent(event string, data map[string]interface{}) {
+    if s.bridge != nil {
+        s.bridge.emit(BridgeEvent{Event: event, NetworkName: s.opts.HubMeshNamespace, Data: data})
+    }
+}
+
+func (s *Server) bridgeSnapshot() map[string]interface{} {
+    if s.bridge == nil {
+        return map[string]interface{}{"enabled": false}
+    }
+    snap := s.bridge.snapshot()
+    snap["enabled"] = true
+    return snap
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+    if a < b {
+        return a
+    }
+    return b
+}
+
+// kafkaRESTTransport produces through a Kafka REST proxy, one request per
+// topic in the batch.
+type kafkaRESTTransport struct {
+    base   string
+    user   *url.Userinfo
+    client http.Client
+}
+
+type kafkaRESTRecord struct {
+    Key   string          `json:"key"`
+    Value json.RawMessage `json:"value"`
+}
+
+func (t *kafkaRESTTransport) publish(batch []bridgeRecord) error {
+    order := []string{}
+    byTopic := map[string][]kafkaRESTRecord{}
+    for _, rec := range batch {
+        if _, ok := byTopic[rec.topic]; !ok {
+            order = append(order, rec.topic)
+        }
+        byTopic[rec.topic] = append(byTopic[rec.topic], kafkaRESTRecord{Key: rec.key, Value: rec.value})
+    }
+    for _, topic := range order {
+        if err := t.produce(topic, byTopic[topic]); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (t *kafkaRESTTransport) produce(topic string, records []kafkaRESTRecord) error {
+    b, err := json.Marshal(map[string]interface{}{"records": records})
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequest("POST", t.base+"/topics/"+url.PathEscape(topic), bytes.NewReader(b))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+    req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+    if t.user != nil {
+        pass, _ := t.user.Password()
+        req.SetBasicAuth(t.user.Username(), pass)
+    }
+    resp, err := t.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+    if resp.StatusCode < 200 || resp.StatusCode > 299 {
+        return fmt.Errorf("kafka: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+    }
+    var out struct {
+        Offsets []struct {
+            Error string `json:"error"`
+        } `json:"offsets"`
+    }
+    json.Unmarshal(body, &out)
+    for _, o := range out.Offsets {
+        if o.Error != "" {
+            return errors.New("kafka: " + o.Error)
+        }
+    }
+    return nil
+}
+
+func (t *kafkaRESTTransport) close() {}
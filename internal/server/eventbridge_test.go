@@ -0,0 +1,118 @@
+package server
+
+import (
+    "bufio"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestEventBridgePublishesToKafkaAndNATS(t *testing.T) {
+    // Kafka REST proxy: the first produce fails, the retry delivers.
+    var mu sync.Mutex
+    calls := 0
+    got := map[string][]map[string]interface{}{}
+    proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        mu.Lock()
+        defer mu.Unlock()
+        calls++
+        if calls == 1 {
+            http.Error(w, "leader not available", http.StatusServiceUnavailable)
+            return
+        }
+        if r.Header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" {
+            t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+        }
+        var body struct {
+            Records []map[string]interface{} `json:"records"`
+        }
+        json.NewDecoder(r.Body).Decode(&body)
+        topic := strings.TrimPrefix(r.URL.Path, "/topics/")
+        got[topic] = append(got[topic], body.Records...)
+        w.Write([]byte(`{"offsets":[{"partition":0,"offset":1}]}`))
+    }))
+    defer proxy.Close()
+    s := NewServer(Options{EventBridgeURL: "kafka+" + proxy.URL, EventBridgeFlushMs: 10, EventBridgeTopics: []string{"mesh.*=", "peer.*=peers.{network}"}})
+    s.spawn("change-sinks", "test", s.runChangeSinks)
+    s.spawn("event-bridge", "test", s.bridge.run)
+    peer := randomPeerId()
+    attachTestPeer(t, s, peer)
+    s.handleMessage(peer, []byte(`{"type":"announce","networkName":"a","data":{"name":"x"}}`))
+    s.emitMeshEvent("mesh.link-up", map[string]interface{}{"uri": "ws://example/mesh"})
+    waitFor(t, "peer.added on peers.a", func() bool {
+        mu.Lock()
+        defer mu.Unlock()
+        return len(got["peers.a"]) == 1
+    })
+    mu.Lock()
+    rec := got["peers.a"][0]
+    mu.Unlock()
+    value, _ := rec["value"].(map[string]interface{})
+    if rec["key"] != peer || value["event"] != "peer.added" || value["peerId"] != peer || value["networkName"] != "a" {
+        t.Fatalf("unexpected record %v", rec)
+    }
+    s.bridge.close()
+    snap := s.bridgeSnapshot()
+    if snap["published"] != int64(1) || snap["failed"] != int64(1) || snap["retries"] != int64(1) || snap["queued"] != 0 || len(got) != 1 {
+        t.Fatalf("the failed batch should be retried once and the mesh event dropped by its rule, got %v and topics %v", snap, got)
+    }
+
+    // NATS: each event is a PUB on its subject, confirmed by PING/PONG.
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ln.Close()
+    subjects := make(chan string, 10)
+    go func() {
+        conn, err := ln.Accept()
+        if err != nil {
+            return
+        }
+        defer conn.Close()
+        conn.Write([]byte("INFO {\"server_id\":\"test\"}\r\n"))
+        r := bufio.NewReader(conn)
+        for {
+            line, err := r.ReadString('\n')
+            if err != nil {
+                return
+            }
+            f := strings.Fields(line)
+            switch {
+            case len(f) == 0:
+            case f[0] == "PING":
+                conn.Write([]byte("PONG\r\n"))
+            case f[0] == "PUB" && len(f) == 3:
+                var n int
+                fmt.Sscan(f[2], &n)
+                payload := make([]byte, n+2)
+                if _, err := io.ReadFull(r, payload); err != nil {
+                    return
+                }
+                var ev BridgeEvent
+                json.Unmarshal(payload[:n], &ev)
+                subjects <- f[1] + " " + ev.Event
+            }
+        }
+    }()
+    s2 := NewServer(Options{IsHub: true, EventBridgeURL: "nats://" + ln.Addr().String(), EventBridgeFlushMs: 10})
+    s2.spawn("event-bridge", "test", s2.bridge.run)
+    s2.learnMember(randomPeerId(), "", memberSourceGossip)
+    select {
+    case got := <-subjects:
+        if got != "peerpigeon.mesh.member-joined mesh.member-joined" {
+            t.Fatalf("unexpected NATS publish %q", got)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("timed out waiting for the NATS publish")
+    }
+    waitFor(t, "the NATS batch to be confirmed", func() bool { return s2.bridgeSnapshot()["published"] == int64(1) })
+    s2.bridge.close()
+}
@@ -0,0 +1,112 @@
+package server
+
+import "sync"
+
+// discoveryEvent is one entry in a network's replay window.
+type discoveryEvent struct {
+    Seq       int64                  `json:"seq"`
+    Type      string                 `json:"type"`
+    PeerId    string                 `json:"peerId"`
+    Data      map[string]interface{} `json:"data,omitempty"`
+    Timestamp int64                  `json:"timestamp"`
+}
+
+// eventLog keeps the most recent discovery and disconnect events per network
+// so a reconnecting client can fetch only what changed since its cursor.
+type eventLog struct {
+    mu   sync.Mutex
+    size int
+    nets map[string]*networkEvents
+}
+
+type networkEvents struct {
+    seq    int64
+    events []discoveryEvent
+}
+
+func newEventLog(size int) *eventLog {
+    return &eventLog{size: size, nets: map[string]*networkEvents{}}
+}
+
+func (l *eventLog) record(netName, typ, peerId string, data map[string]interface{}) {
+    if l.size <= 0 {
+        return
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    n := l.nets[netName]
+    if n == nil {
+        n = &networkEvents{}
+        l.nets[netName] = n
+    }
+    n.seq++
+    n.events = append(n.events, discoveryEvent{Seq: n.seq, Type: typ, PeerId: peerId, Data: data, Timestamp: nowMs()})
+    if len(n.events) > l.size {
+        n.events = n.events[len(n.events)-l.size:]
+    }
+}
+
+func (l *eventLog) cursor(netName string) int64 {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if n := l.nets[netName]; n != nil {
+        return n.seq
+    }
+    return 0
+}
+
+// since returns the events after cursor and the current cursor. ok is false
+// when the window no longer reaches back to cursor and the caller needs a
+// full peer list instead.
+func (l *eventLog) since(netName string, cursor int64) ([]discoveryEvent, int64, bool) {
+    if l.size <= 0 {
+        return nil, 0, false
+    }
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    n := l.nets[netName]
+    if n == nil {
+        return []discoveryEvent{}, 0, cursor == 0
+    }
+    if cursor > n.seq || (len(n.events) > 0 && cursor < n.events[0].Seq-1) || (len(n.events) == 0 && cursor < n.seq) {
+        return nil, n.seq, false
+    }
+    out := []discoveryEvent{}
+    for _, e := range n.events {
+        if e.Seq > cursor {
+            out = append(out, e)
+        }
+    }
+    return out, n.seq, true
+}
+
+// sendEventsSince answers an events-since request. It reports false when the
+// cursor has fallen out of the window.
+func (s *Server) sendEventsSince(peerId, netName string, cursor int64) bool {
+    events, current, ok := s.events.since(netName, cursor)
+    if !ok {
+        return false
+    }
+    delta := make([]discoveryEvent, 0, len(events))
+    for _, e := range events {
+        if e.PeerId != peerId {
+            delta = append(delta, e)
+        }
+    }
+    s.forwardToLocalTarget(peerId, outboundMessage{Type: "events", Data: map[string]interface{}{"events": delta, "cursor": current}, FromPeerId: "system", TargetPeer: peerId, NetworkName: netName, Timestamp: nowMs()})
+    return true
+}
+
+func (s *Server) handleEventsSince(peerId string, msg inboundMessage) {
+    if s.shedding(shedDiscovery) {
+        s.rejectShed(peerId, msg.Type)
+        return
+    }
+    netName := firstNonEmpty(msg.NetworkName, s.opts.DefaultNetwork)
+    m, _ := msg.Data.(map[string]interface{})
+    cursor, _ := m["cursor"].(float64)
+    if !s.sendEventsSince(peerId, netName, int64(cursor)) {
+        s.forwardToLocalTarget(peerId, outboundMessage{Type: "events-reset", Data: map[string]interface{}{"cursor": s.events.cursor(netName)}, FromPeerId: "system", TargetPeer: peerId, NetworkName: netName, Timestamp: nowMs()})
+        s.sendPeersToNew(peerId, netName)
+    }
+}
@@ -0,0 +1,17 @@
+package server
+
+import "testing"
+
+func TestEventLogSinceWindow(t *testing.T) {
+    l := newEventLog(3)
+    for _, id := range []string{"a", "b", "c", "d"} {
+        l.record("global", "peer-discovered", id, nil)
+    }
+    events, cursor, ok := l.since("global", 2)
+    if !ok || cursor != 4 || len(events) != 2 || events[0].PeerId != "c" {
+        t.Fatalf("unexpected delta %v cursor=%d ok=%v", events, cursor, ok)
+    }
+    if _, _, ok := l.since("global", 0); ok {
+        t.Fatalf("cursor older than the window should require a full resync")
+    }
+}
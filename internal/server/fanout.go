@@ -0,0 +1,287 @@
+package server
+
+import (
+    "encoding/json"
+    "hash/fnv"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/gorilla/websocket"
+)
+
+// Broadcast fanout. broadcastToOthers and forwardToLocalPeers send one
+// message to many peers. The fanout compresses and marshals it once and
+// splices each recipient's targetPeerId into the encoded frame; only legacy
+// and MessagePack connections get their own encoding. A fanout to fewer than
+// FanoutMinPeers (64) peers is sent on the caller's goroutine. A larger one
+// is split across FanoutWorkers (4) worker goroutines, each owning the peers
+// whose ID hashes to it, so the read loop that set off a discovery storm
+// returns at once and broadcasts still reach each peer in the order they
+// were made. Each worker queues up to FanoutQueueSize (256) broadcasts; when
+// its queue is full the caller waits for room, so a storm slows its sender
+// instead of losing messages. Negative FanoutWorkers sends everything on the
+// caller. How long handing a frame to each peer took, the slowest peers,
+// sends a peer's write queue refused and waits on full queues are under
+// "fanout" in /metrics.
+const (
+    fanoutSlowSend   = 10 * time.Millisecond
+    fanoutSlowestTop = 10
+)
+
+// fanoutFrame is a broadcast encoded for every recipient that takes plain
+// JSON. A targeted frame names each recipient in targetPeerId and counts
+// toward messagesBroadcast.
+type fanoutFrame struct {
+    msg      outboundMessage
+    text     []byte
+    targeted bool
+    // compressed is set when text carries gzip data the hub added, which
+    // only peers that accept gzip may get.
+    compressed bool
+}
+
+type fanoutJob struct {
+    frame *fanoutFrame
+    ids   []string
+}
+
+type fanoutPool struct {
+    mu      sync.Mutex
+    queues  []chan fanoutJob
+    quit    chan struct{}
+    latency map[string]time.Duration
+
+    broadcasts int64
+    pooled     int64
+    sends      int64
+    dropped    int64
+    waits      int64
+    slow       int64
+    sendNanos  int64
+    maxNanos   int64
+}
+
+func newFanoutPool() *fanoutPool {
+    return &fanoutPool{latency: map[string]time.Duration{}}
+}
+
+// encodeFanout encodes msg once. A targeted frame leaves targetPeerId out
+// for sendFanout to splice in.
+func (s *Server) encodeFanout(msg outboundMessage, targeted bool) *fanoutFrame {
+    if targeted {
+        msg.TargetPeer = ""
+    }
+    plain := msg
+    if plain.Encoding == "" && plain.MeshSignature == "" {
+        plain.Data, plain.Encoding = compressData(plain.Data, s.opts.CompressThresholdBytes)
+    }
+    b, err := json.Marshal(plain)
+    if err != nil || len(b) < 2 {
+        return &fanoutFrame{msg: msg, targeted: targeted}
+    }
+    return &fanoutFrame{msg: msg, text: b, targeted: targeted, compressed: plain.Encoding == encodingGzip && msg.Encoding == ""}
+}
+
+// sendFanout delivers f to one peer and reports whether its write queue
+// took it.
+func (s *Server) sendFanout(f *fanoutFrame, id string) bool {
+    conn := s.getConn(id)
+    if conn == nil {
+        return false
+    }
+    p := s.fanout
+    start := time.Now()
+    var ok bool
+    if f.text == nil || isLegacyConn(conn) || isBinaryConn(conn) || (f.compressed && !acceptsGzip(conn)) {
+        m := f.msg
+        if f.targeted {
+            m.TargetPeer = id
+        }
+        ok = s.sendToConn(conn, m)
+    } else if !f.targeted {
+        ok = s.deliver(conn, f.msg.Type, websocket.TextMessage, f.text)
+    } else {
+        quoted, _ := json.Marshal(id)
+        b := make([]byte, 0, len(f.text)+len(quoted)+17)
+        b = append(b, `{"targetPeerId":`...)
+        b = append(b, quoted...)
+        if len(f.text) > 2 {
+            b = append(b, ',')
+        }
+        b = append(b, f.text[1:]...)
+        ok = s.deliver(conn, f.msg.Type, websocket.TextMessage, b)
+    }
+    took := time.Since(start)
+    atomic.AddInt64(&p.sends, 1)
+    atomic.AddInt64(&p.sendNanos, int64(took))
+    for {
+        max := atomic.LoadInt64(&p.maxNanos)
+        if int64(took) <= max || atomic.CompareAndSwapInt64(&p.maxNanos, max, int64(took)) {
+            break
+        }
+    }
+    if took >= fanoutSlowSend {
+        atomic.AddInt64(&p.slow, 1)
+    }
+    if !ok {
+        atomic.AddInt64(&p.dropped, 1)
+    }
+    p.mu.Lock()
+    if prev, seen := p.latency[id]; seen {
+        p.latency[id] = (prev*7 + took) / 8
+    } else {
+        p.latency[id] = took
+    }
+    p.mu.Unlock()
+    return ok
+}
+
+// fanoutTo sends msg to ids and returns how many peers it was handed to:
+// delivered, when sent on the caller, or queued for the workers.
+func (s *Server) fanoutTo(ids []string, msg outboundMessage, targeted bool) int {
+    p := s.fanout
+    atomic.AddInt64(&p.broadcasts, 1)
+    f := s.encodeFanout(msg, targeted)
+    if s.opts.FanoutWorkers < 0 || len(ids) < s.opts.FanoutMinPeers {
+        count := 0
+        for _, id := range ids {
+            if s.sendFanout(f, id) {
+                count++
+            }
+        }
+        if targeted {
+            s.metrics.MessageBroadcast(int64(count))
+        }
+        return count
+    }
+    queues, quit := s.fanoutQueues()
+    shards := make([][]string, len(queues))
+    for _, id := range ids {
+        h := fnv.New32a()
+        h.Write([]byte(id))
+        i := int(h.Sum32() % uint32(len(queues)))
+        shards[i] = append(shards[i], id)
+    }
+    atomic.AddInt64(&p.pooled, 1)
+    for i, shard := range shards {
+        if len(shard) == 0 {
+            continue
+        }
+        job := fanoutJob{frame: f, ids: shard}
+        select {
+        case queues[i] <- job:
+            continue
+        default:
+        }
+        atomic.AddInt64(&p.waits, 1)
+        select {
+        case queues[i] <- job:
+        case <-quit:
+            return 0
+        }
+    }
+    return len(ids)
+}
+
+// fanoutQueues returns the workers' queues, starting the workers on first
+// use.
+func (s *Server) fanoutQueues() ([]chan fanoutJob, chan struct{}) {
+    p := s.fanout
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.queues == nil {
+        p.quit = make(chan struct{})
+        p.queues = make([]chan fanoutJob, s.opts.FanoutWorkers)
+        for i := range p.queues {
+            q, quit := make(chan fanoutJob, s.opts.FanoutQueueSize), p.quit
+            p.queues[i] = q
+            s.spawn("fanout", "worker", func() { s.runFanoutWorker(q, quit) })
+        }
+    }
+    return p.queues, p.quit
+}
+
+func (s *Server) runFanoutWorker(q chan fanoutJob, quit chan struct{}) {
+    for {
+        select {
+        case job := <-q:
+            count := 0
+            for _, id := range job.ids {
+                if s.sendFanout(job.frame, id) {
+                    count++
+                }
+            }
+            if job.frame.targeted {
+                s.metrics.MessageBroadcast(int64(count))
+            }
+        case <-quit:
+            return
+        }
+    }
+}
+
+// stopFanout stops the workers; broadcasts still queued are dropped.
+func (s *Server) stopFanout() {
+    p := s.fanout
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.quit != nil {
+        close(p.quit)
+    }
+    p.queues, p.quit = nil, nil
+}
+
+// forgetFanout drops a departed peer's send latency.
+func (s *Server) forgetFanout(peerId string) {
+    p := s.fanout
+    p.mu.Lock()
+    delete(p.latency, peerId)
+    p.mu.Unlock()
+}
+
+func (s *Server) fanoutSnapshot() map[string]interface{} {
+    p := s.fanout
+    type slowPeer struct {
+        PeerId string  `json:"peerId"`
+        Ms     float64 `json:"ms"`
+    }
+    p.mu.Lock()
+    slowest := make([]slowPeer, 0, len(p.latency))
+    for id, d := range p.latency {
+        slowest = append(slowest, slowPeer{PeerId: id, Ms: float64(d) / float64(time.Millisecond)})
+    }
+    queued := 0
+    for _, q := range p.queues {
+        queued += len(q)
+    }
+    p.mu.Unlock()
+    sort.Slice(slowest, func(i, j int) bool {
+        if slowest[i].Ms != slowest[j].Ms {
+            return slowest[i].Ms > slowest[j].Ms
+        }
+        return slowest[i].PeerId < slowest[j].PeerId
+    })
+    if len(slowest) > fanoutSlowestTop {
+        slowest = slowest[:fanoutSlowestTop]
+    }
+    sends := atomic.LoadInt64(&p.sends)
+    avg := 0.0
+    if sends > 0 {
+        avg = float64(atomic.LoadInt64(&p.sendNanos)) / float64(sends) / float64(time.Millisecond)
+    }
+    return map[string]interface{}{
+        "workers":      s.opts.FanoutWorkers,
+        "min_peers":    s.opts.FanoutMinPeers,
+        "broadcasts":   atomic.LoadInt64(&p.broadcasts),
+        "pooled":       atomic.LoadInt64(&p.pooled),
+        "queued":       queued,
+        "sends":        sends,
+        "dropped":      atomic.LoadInt64(&p.dropped),
+        "queue_waits":  atomic.LoadInt64(&p.waits),
+        "slow_sends":   atomic.LoadInt64(&p.slow),
+        "avg_send_ms":  avg,
+        "max_send_ms":  float64(atomic.LoadInt64(&p.maxNanos)) / float64(time.Millisecond),
+        "slowest":      slowest,
+    }
+}
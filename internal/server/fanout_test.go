@@ -0,0 +1,66 @@
+package server
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestBroadcastFanoutSplitsLargeAudiencesAcrossWorkers(t *testing.T) {
+    s := NewServer(Options{FanoutWorkers: 3, FanoutMinPeers: 8})
+    defer s.stopFanout()
+    conns := map[string]*pollConn{}
+    for i := 0; i < 30; i++ {
+        id := randomPeerId()
+        conns[id] = attachTestPeer(t, s, id)
+    }
+    closed := &pollConn{s: s, peerId: "closed", notify: make(chan struct{}, 1), lastPoll: nowMs(), closed: true}
+    s.wsConns["closed"] = closed
+    for i := 0; i < 5; i++ {
+        if n := s.broadcastToOthers("system", outboundMessage{Type: "app-broadcast", Data: map[string]interface{}{"n": i}, FromPeerId: "system", NetworkName: "global", Timestamp: nowMs()}); n != 31 {
+            t.Fatalf("broadcast should be handed to 31 peers, got %d", n)
+        }
+    }
+    for id, c := range conns {
+        got := []float64{}
+        waitFor(t, "every broadcast to arrive", func() bool {
+            msgs, _ := c.take(10 * time.Millisecond)
+            for _, raw := range msgs {
+                var m struct {
+                    TargetPeerId string `json:"targetPeerId"`
+                    Type         string `json:"type"`
+                    Data         map[string]float64
+                }
+                if err := json.Unmarshal(raw, &m); err != nil || m.TargetPeerId != id || m.Type != "app-broadcast" {
+                    t.Fatalf("unexpected frame %s", raw)
+                }
+                got = append(got, m.Data["n"])
+            }
+            return len(got) == 5
+        })
+        for i, n := range got {
+            if int(n) != i {
+                t.Fatalf("broadcasts arrived out of order: %v", got)
+            }
+        }
+    }
+    waitFor(t, "sends to the closed peer to fail", func() bool { return s.fanoutSnapshot()["dropped"] == int64(5) })
+    if snap := s.fanoutSnapshot(); snap["pooled"] != int64(5) || snap["sends"] != int64(155) {
+        t.Fatalf("unexpected fanout counters %v", snap)
+    }
+
+    // Small audiences are delivered on the caller.
+    small := NewServer(Options{})
+    c := &pollConn{s: small, peerId: "p", notify: make(chan struct{}, 1), lastPoll: nowMs()}
+    small.wsConns["p"] = c
+    if n := small.broadcastToOthers("system", outboundMessage{Type: "peer-disconnected", Data: map[string]interface{}{"peerId": "x"}, FromPeerId: "system", NetworkName: "global", Timestamp: nowMs()}); n != 1 {
+        t.Fatalf("expected one delivery, got %d", n)
+    }
+    if msgs, _ := c.take(0); len(msgs) != 1 || !strings.Contains(string(msgs[0]), `"targetPeerId":"p"`) {
+        t.Fatalf("unexpected inline delivery %s", msgs)
+    }
+    if snap := small.fanoutSnapshot(); snap["pooled"] != int64(0) {
+        t.Fatalf("a small broadcast should not use the workers: %v", snap)
+    }
+}
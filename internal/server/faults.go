@@ -0,0 +1,193 @@
+package server
+
+import (
+    "math/rand"
+    "sync"
+    "time"
+)
+
+// Fault injection, for tests only. Options.Faults makes the hub misbehave
+// on purpose, so client retry logic and mesh resilience can be exercised
+// in-process (see cmd/simulate -faults) without network shaping tools. Each
+// outgoing message is matched against the rules in order, by link ("local"
+// for peer connections, "mesh" for hub links, empty for both) and message
+// type, and the first match decides its fate: dropped with DropPercent
+// probability, held back to go out after the next message on the same
+// connection with ReorderPercent probability, and otherwise delayed by
+// DelayMs plus up to JitterMs. Dropped messages still count as sent to the
+// caller. Seed makes a run repeatable. Never set Faults in production;
+// counts are under "faults" in /metrics so a stray config is visible.
+
+// FaultRule is one fault injection rule.
+type FaultRule struct {
+    Link           string   `json:"link,omitempty"`
+    Types          []string `json:"types,omitempty"`
+    DropPercent    float64  `json:"dropPercent,omitempty"`
+    ReorderPercent float64  `json:"reorderPercent,omitempty"`
+    DelayMs        int      `json:"delayMs,omitempty"`
+    JitterMs       int      `json:"jitterMs,omitempty"`
+}
+
+// FaultOptions configures fault injection.
+type FaultOptions struct {
+    Seed  int64       `json:"seed,omitempty"`
+    Rules []FaultRule `json:"rules"`
+}
+
+const (
+    faultLinkLocal = "local"
+    faultLinkMesh  = "mesh"
+
+    // reorderHold is how long a held-back message waits for another one to
+    // overtake it before it is sent anyway.
+    reorderHold = 200 * time.Millisecond
+)
+
+type heldFrame struct {
+    messageType int
+    data        []byte
+    timer       *time.Timer
+}
+
+type faultInjector struct {
+    rules []FaultRule
+
+    mu        sync.Mutex
+    rng       *rand.Rand
+    held      map[peerConn]*heldFrame
+    dropped   int64
+    delayed   int64
+    reordered int64
+}
+
+func newFaultInjector(o *FaultOptions) *faultInjector {
+    if o == nil || len(o.Rules) == 0 {
+        return nil
+    }
+    seed := o.Seed
+    if seed == 0 {
+        seed = time.Now().UnixNano()
+    }
+    return &faultInjector{rules: o.Rules, rng: rand.New(rand.NewSource(seed)), held: map[peerConn]*heldFrame{}}
+}
+
+func validateFaults(o *FaultOptions) string {
+    if o == nil {
+        return ""
+    }
+    for _, r := range o.Rules {
+        switch {
+        case r.Link != "" && r.Link != faultLinkLocal && r.Link != faultLinkMesh:
+            return "fault rule link must be local or mesh"
+        case r.DropPercent < 0 || r.DropPercent > 100 || r.ReorderPercent < 0 || r.ReorderPercent > 100:
+            return "fault rule percentages must be between 0 and 100"
+        case r.DelayMs < 0 || r.JitterMs < 0:
+            return "fault rule delays must not be negative"
+        }
+    }
+    return ""
+}
+
+func (f *faultInjector) match(link, msgType string) *FaultRule {
+    for i := range f.rules {
+        r := &f.rules[i]
+        if r.Link != "" && r.Link != link {
+            continue
+        }
+        if len(r.Types) == 0 {
+            return r
+        }
+        for _, t := range r.Types {
+            if t == msgType {
+                return r
+            }
+        }
+    }
+    return nil
+}
+
+// faultLink says whether conn is a hub link or a peer connection.
+func (s *Server) faultLink(conn peerConn) string {
+    if c, ok := conn.(*wsPeerConn); ok {
+        if c.bootstrap {
+            return faultLinkMesh
+        }
+        if pi := s.getPeerInfo(c.owner); pi != nil && pi.IsHub {
+            return faultLinkMesh
+        }
+    }
+    return faultLinkLocal
+}
+
+// deliver writes a message frame to conn, through the fault injector when
+// one is configured.
+func (s *Server) deliver(conn peerConn, msgType string, messageType int, data []byte) bool {
+    if isMeshLink(conn) {
+        s.countMeshFrame(true, messageType, len(data))
+    }
+    f := s.faults
+    if f == nil {
+        return conn.WriteMessage(messageType, data) == nil
+    }
+    r := f.match(s.faultLink(conn), msgType)
+    f.mu.Lock()
+    var roll, reorderRoll, jitter float64
+    if r != nil {
+        roll, reorderRoll, jitter = f.rng.Float64()*100, f.rng.Float64()*100, f.rng.Float64()
+    }
+    switch {
+    case r != nil && roll < r.DropPercent:
+        f.dropped++
+        f.mu.Unlock()
+        return true
+    case r != nil && reorderRoll < r.ReorderPercent && f.held[conn] == nil:
+        h := &heldFrame{messageType: messageType, data: data}
+        h.timer = time.AfterFunc(reorderHold, func() { f.release(conn, h) })
+        f.held[conn] = h
+        f.reordered++
+        f.mu.Unlock()
+        return true
+    }
+    held := f.held[conn]
+    delete(f.held, conn)
+    delay := time.Duration(0)
+    if r != nil {
+        delay = time.Duration(r.DelayMs)*time.Millisecond + time.Duration(jitter*float64(r.JitterMs))*time.Millisecond
+    }
+    if delay > 0 {
+        f.delayed++
+    }
+    f.mu.Unlock()
+    write := func() bool {
+        ok := conn.WriteMessage(messageType, data) == nil
+        if held != nil && held.timer.Stop() {
+            conn.WriteMessage(held.messageType, held.data)
+        }
+        return ok
+    }
+    if delay > 0 {
+        time.AfterFunc(delay, func() { write() })
+        return true
+    }
+    return write()
+}
+
+// release sends a held-back message that nothing overtook in time.
+func (f *faultInjector) release(conn peerConn, h *heldFrame) {
+    f.mu.Lock()
+    if f.held[conn] == h {
+        delete(f.held, conn)
+    }
+    f.mu.Unlock()
+    conn.WriteMessage(h.messageType, h.data)
+}
+
+func (s *Server) faultSnapshot() map[string]interface{} {
+    f := s.faults
+    if f == nil {
+        return map[string]interface{}{"enabled": false}
+    }
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    return map[string]interface{}{"enabled": true, "rules": len(f.rules), "dropped": f.dropped, "delayed": f.delayed, "reordered": f.reordered, "held": len(f.held)}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "testing"
+    "time"
+)
+
+func TestFaultInjectionDropsDelaysAndReorders(t *testing.T) {
+    s := NewServer(Options{Faults: &FaultOptions{Seed: 1, Rules: []FaultRule{
+        {Link: "mesh", DropPercent: 100},
+        {Types: []string{"drop-me"}, DropPercent: 100},
+        {Types: []string{"late"}, DelayMs: 60},
+        {Link: "local", Types: []string{"first"}, ReorderPercent: 100},
+    }}})
+    id := randomPeerId()
+    conn := attachTestPeer(t, s, id)
+    types := func(msgs []json.RawMessage) []string {
+        out := []string{}
+        for _, raw := range msgs {
+            var m struct{ Type string `json:"type"` }
+            json.Unmarshal(raw, &m)
+            out = append(out, m.Type)
+        }
+        return out
+    }
+    for _, typ := range []string{"drop-me", "first", "second"} {
+        if !s.sendToConn(conn, outboundMessage{Type: typ, FromPeerId: "system", TargetPeer: id}) {
+            t.Fatalf("%s should look delivered to the caller", typ)
+        }
+    }
+    if got, _ := conn.take(100 * time.Millisecond); fmt.Sprint(types(got)) != "[second first]" {
+        t.Fatalf("expected the held message after the next one and the dropped one gone, got %v", types(got))
+    }
+    s.sendToConn(conn, outboundMessage{Type: "late", FromPeerId: "system", TargetPeer: id})
+    if got, _ := conn.take(20 * time.Millisecond); len(got) != 0 {
+        t.Fatalf("delayed message arrived early: %v", types(got))
+    }
+    if got, _ := conn.take(time.Second); fmt.Sprint(types(got)) != "[late]" {
+        t.Fatalf("delayed message never arrived: %v", types(got))
+    }
+    s.sendToConn(conn, outboundMessage{Type: "first", FromPeerId: "system", TargetPeer: id})
+    if got, _ := conn.take(time.Second); fmt.Sprint(types(got)) != "[first]" {
+        t.Fatalf("a held message with nothing behind it should still be sent: %v", types(got))
+    }
+    if snap := s.faultSnapshot(); snap["dropped"] != int64(1) || snap["delayed"] != int64(1) || snap["reordered"] != int64(2) {
+        t.Fatalf("unexpected fault metrics: %v", snap)
+    }
+    if err := (Options{Faults: &FaultOptions{Rules: []FaultRule{{Link: "wan", DropPercent: 150}}}}).Validate(); err == nil {
+        t.Fatalf("invalid fault rules accepted")
+    }
+}
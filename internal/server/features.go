@@ -0,0 +1,109 @@
+package server
+
+import "sort"
+
+// Version is the hub build version, set at link time with
+// -ldflags "-X peerpigeon/internal/server.Version=...".
+var Version = "dev"
+
+const (
+    featureSignaling    = "signaling"
+    featureRelay        = "relay"
+    featureCompression  = "compression"
+    featureIdentity     = "identity"
+    featureCapability   = "capability-routing"
+    featureBlobRelay    = "blob-relay"
+    featureAppBroadcast = "app-broadcast"
+    featureLongPolling  = "long-polling"
+    featureFindPeers    = "find-peers"
+)
+
+// features lists the optional behaviours this hub has enabled. Hubs exchange
+// the list in their handshake and only use what both sides support.
+func (s *Server) features() []string {
+    out := []string{featureLongPolling, featureGossipDelta}
+    if s.servesSignaling() {
+        out = append(out, featureSignaling, featureCapability, featureFindPeers)
+    }
+    if s.opts.CompressThresholdBytes > 0 {
+        out = append(out, featureCompression)
+    }
+    if s.identities != nil {
+        out = append(out, featureIdentity)
+    }
+    if s.hubKeys.priv != nil {
+        out = append(out, featureSignedMesh)
+    } else {
+        out = append(out, featureMsgpackMesh)
+    }
+    if s.servesRelay() {
+        out = append(out, featureRelay)
+        if s.opts.BlobMaxBytes > 0 {
+            out = append(out, featureBlobRelay)
+        }
+        if len(s.opts.AppBroadcastNetworks) > 0 {
+            out = append(out, featureAppBroadcast)
+        }
+    }
+    sort.Strings(out)
+    return out
+}
+
+// sharedFeatures intersects our feature list with the one a remote hub
+// advertised.
+func (s *Server) sharedFeatures(remote []string) []string {
+    theirs := map[string]bool{}
+    for _, f := range remote {
+        theirs[f] = true
+    }
+    out := []string{}
+    for _, f := range s.features() {
+        if theirs[f] {
+            out = append(out, f)
+        }
+    }
+    return out
+}
+
+func hasFeature(features []string, f string) bool {
+    for _, v := range features {
+        if v == f {
+            return true
+        }
+    }
+    return false
+}
+
+// featureList decodes a JSON "features" array.
+func featureList(v interface{}) []string {
+    out := []string{}
+    switch fs := v.(type) {
+    case []interface{}:
+        for _, f := range fs {
+            if str, ok := f.(string); ok {
+                out = append(out, str)
+            }
+        }
+    case []string:
+        out = append(out, fs...)
+    }
+    return out
+}
+
+// sendToHub writes msg to another hub, compressing and delta encoding only
+// when the link has negotiated those features, and signs it when this hub
+// has an identity key.
+func (s *Server) sendToHub(conn peerConn, shared []string, msg outboundMessage) bool {
+    threshold := 0
+    if hasFeature(shared, featureCompression) {
+        threshold = s.opts.CompressThresholdBytes
+    }
+    if hasFeature(shared, featureGossipDelta) {
+        msg = s.gossipDelta.encode(conn, msg)
+    }
+    if !s.writeMessage(conn, s.signMesh(msg, threshold), threshold) {
+        return false
+    }
+    s.metrics.CrossHubMessageSent()
+    return true
+}
@@ -0,0 +1,14 @@
+package server
+
+import "testing"
+
+func TestSharedFeaturesIntersects(t *testing.T) {
+    s := NewServer(Options{CompressThresholdBytes: 1024})
+    shared := s.sharedFeatures([]string{featureCompression, featureSignaling, "kv-store"})
+    if !hasFeature(shared, featureCompression) || !hasFeature(shared, featureSignaling) {
+        t.Fatalf("expected common features, got %v", shared)
+    }
+    if hasFeature(shared, "kv-store") || hasFeature(shared, featureRelay) {
+        t.Fatalf("unexpected feature in intersection %v", shared)
+    }
+}
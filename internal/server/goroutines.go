@@ -0,0 +1,142 @@
+package server
+
+import (
+    "runtime"
+    "sort"
+    "sync"
+)
+
+// goroutineTracker labels the long-lived goroutines the hub starts so the
+// admin API can show who owns them and the watchdog can spot state that
+// outlived its reader.
+type goroutineTracker struct {
+    mu       sync.Mutex
+    next     int64
+    live     map[int64]goroutineLabel
+    suspects map[string]leakSuspect
+}
+
+type goroutineLabel struct {
+    Kind      string `json:"kind"`
+    Owner     string `json:"owner"`
+    StartedAt int64  `json:"startedAt"`
+}
+
+type leakSuspect struct {
+    Kind      string `json:"kind"`
+    Owner     string `json:"owner"`
+    Reason    string `json:"reason"`
+    FirstSeen int64  `json:"firstSeen"`
+    Passes    int    `json:"passes"`
+}
+
+func newGoroutineTracker() *goroutineTracker {
+    return &goroutineTracker{live: map[int64]goroutineLabel{}, suspects: map[string]leakSuspect{}}
+}
+
+// spawn runs fn in a goroutine labelled kind/owner for as long as it runs.
+// A panic in fn is recovered by recoverPanic.
+func (s *Server) spawn(kind, owner string, fn func()) {
+    t := s.goroutines
+    t.mu.Lock()
+    t.next++
+    id := t.next
+    t.live[id] = goroutineLabel{Kind: kind, Owner: owner, StartedAt: nowMs()}
+    t.mu.Unlock()
+    go func() {
+        defer func() {
+            t.mu.Lock()
+            delete(t.live, id)
+            t.mu.Unlock()
+        }()
+        defer s.recoverPanic(kind, owner)
+        fn()
+    }()
+}
+
+func (t *goroutineTracker) owners(kind string) map[string]bool {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    out := map[string]bool{}
+    for _, l := range t.live {
+        if l.Kind == kind {
+            out[l.Owner] = true
+        }
+    }
+    return out
+}
+
+// checkLeaks is the watchdog pass run from performCleanup. A connection or
+// bootstrap link whose reader goroutine has gone away but which is still
+// registered is a leak; it is reported once it survives two passes so the
+// window between registration and spawning the reader is not flagged.
+func (s *Server) checkLeaks() {
+    readers := s.goroutines.owners("conn-reader")
+    bootstrapReaders := s.goroutines.owners("bootstrap-reader")
+    found := map[string]leakSuspect{}
+
+    // Long-polling sessions have no reader goroutine; they expire instead.
+    s.wsMu.Lock()
+    for id, conn := range s.wsConns {
+        if _, ok := conn.(*pollConn); ok {
+            readers[id] = true
+            continue
+        }
+        if !readers[id] {
+            found["conn:"+id] = leakSuspect{Kind: "conn", Owner: id, Reason: "reader exited but connection is still registered"}
+        }
+    }
+    s.wsMu.Unlock()
+    s.peersMu.Lock()
+    for id := range s.peerData {
+        if !readers[id] {
+            found["peer:"+id] = leakSuspect{Kind: "peer", Owner: id, Reason: "reader exited but peer state remains"}
+        }
+    }
+    s.peersMu.Unlock()
+    s.bootstrapMu.Lock()
+    for uri, b := range s.bootstrapConns {
+        if b.connected && !bootstrapReaders[uri] {
+            found["bootstrap:"+uri] = leakSuspect{Kind: "bootstrap", Owner: uri, Reason: "reader exited but link is marked connected"}
+        }
+    }
+    s.bootstrapMu.Unlock()
+
+    t := s.goroutines
+    now := nowMs()
+    t.mu.Lock()
+    for key, l := range found {
+        if prev, ok := t.suspects[key]; ok {
+            l.FirstSeen = prev.FirstSeen
+            l.Passes = prev.Passes + 1
+        } else {
+            l.FirstSeen = now
+            l.Passes = 1
+        }
+        found[key] = l
+    }
+    t.suspects = found
+    t.mu.Unlock()
+}
+
+func (s *Server) goroutineSnapshot() map[string]interface{} {
+    t := s.goroutines
+    t.mu.Lock()
+    byKind := map[string]int{}
+    for _, l := range t.live {
+        byKind[l.Kind]++
+    }
+    leaks := []leakSuspect{}
+    for _, l := range t.suspects {
+        if l.Passes >= 2 {
+            leaks = append(leaks, l)
+        }
+    }
+    t.mu.Unlock()
+    sort.Slice(leaks, func(i, j int) bool { return leaks[i].Owner < leaks[j].Owner })
+    return map[string]interface{}{
+        "total":   runtime.NumGoroutine(),
+        "tracked": byKind,
+        "leaks":   leaks,
+    }
+}
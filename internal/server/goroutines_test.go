@@ -0,0 +1,18 @@
+package server
+
+import "testing"
+
+func TestCheckLeaksFlagsStateWithoutReader(t *testing.T) {
+    s := NewServer(Options{})
+    id := "0123456789abcdef0123456789abcdef01234567"
+    s.peerData[id] = &peerInfo{PeerId: id}
+    s.checkLeaks()
+    if leaks := s.goroutineSnapshot()["leaks"].([]leakSuspect); len(leaks) != 0 {
+        t.Fatalf("suspect should not be reported after a single pass, got %v", leaks)
+    }
+    s.checkLeaks()
+    leaks := s.goroutineSnapshot()["leaks"].([]leakSuspect)
+    if len(leaks) != 1 || leaks[0].Owner != id {
+        t.Fatalf("expected orphaned peer state to be flagged, got %v", leaks)
+    }
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+    "encoding/hex"
+    "encoding/json"
+    "hash/fnv"
+    "reflect"
+    "sync"
+)
+
+// Gossip delta encoding. Hubs re-send a peer's whole metadata map every time
+// it is announced or relayed. On links that negotiated featureGossipDelta the
+// sender remembers what it last sent for each (network, peer) and sends only
+// the changed fields, keyed by a hash of the previous and resulting maps:
+//
+//     {"type": "peer-discovered", "encoding": "delta",
+//      "data": {"peerId": "...", "base": "<hash>", "hash": "<hash>",
+//               "set": {"changed": "fields"}, "unset": ["removed"]}}
+//
+// A receiver whose stored map does not hash to base (it restarted, or two
+// sends raced) answers with gossip-resync and the sender re-sends the full
+// map. Link state is dropped when the peer disconnects or the link closes.
+const (
+    encodingDelta      = "delta"
+    featureGossipDelta = "gossip-delta"
+
+    maxDeltaPeersPerLink = 50000
+)
+
+type sentGossip struct {
+    msg  outboundMessage
+    data map[string]interface{}
+    hash string
+}
+
+type gossipDelta struct {
+    mu   sync.Mutex
+    sent map[peerConn]map[string]*sentGossip
+    recv map[string]map[string]map[string]interface{}
+
+    fullSent   int64
+    deltasSent int64
+    bytesSaved int64
+    resyncs    int64
+}
+
+func newGossipDelta() *gossipDelta {
+    return &gossipDelta{sent: map[peerConn]map[string]*sentGossip{}, recv: map[string]map[string]map[string]interface{}{}}
+}
+
+func gossipKey(netName, peerId string) string {
+    return netName + "\x00" + peerId
+}
+
+// metadataHash hashes the JSON form of m. encoding/json sorts map keys, so
+// both ends agree as long as they hold the same values.
+func metadataHash(m map[string]interface{}) string {
+    b, _ := json.Marshal(m)
+    h := fnv.New64a()
+    h.Write(b)
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+// encode rewrites a peer-discovered bound for conn as a delta against what
+// was last sent on that link. Other messages pass through, except that a
+// peer-disconnected clears the peer's entry.
+func (g *gossipDelta) encode(conn peerConn, msg outboundMessage) outboundMessage {
+    if msg.Encoding != "" {
+        return msg
+    }
+    data, _ := msg.Data.(map[string]interface{})
+    id, _ := data["peerId"].(string)
+    if id == "" {
+        return msg
+    }
+    key := gossipKey(msg.NetworkName, id)
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    link := g.sent[conn]
+    if msg.Type == "peer-disconnected" {
+        delete(link, key)
+        return msg
+    }
+    if msg.Type != "peer-discovered" {
+        return msg
+    }
+    if link == nil {
+        link = map[string]*sentGossip{}
+        g.sent[conn] = link
+    }
+    prev := link[key]
+    hash := metadataHash(data)
+    if prev == nil && len(link) >= maxDeltaPeersPerLink {
+        g.fullSent++
+        return msg
+    }
+    link[key] = &sentGossip{msg: msg, data: data, hash: hash}
+    if prev == nil {
+        g.fullSent++
+        return msg
+    }
+    set := map[string]interface{}{}
+    for k, v := range data {
+        if old, ok := prev.data[k]; !ok || !reflect.DeepEqual(old, v) {
+            set[k] = v
+        }
+    }
+    unset := []string{}
+    for k := range prev.data {
+        if _, ok := data[k]; !ok {
+            unset = append(unset, k)
+        }
+    }
+    delta := map[string]interface{}{"peerId": id, "base": prev.hash, "hash": hash, "set": set, "unset": unset}
+    full, _ := json.Marshal(data)
+    small, _ := json.Marshal(delta)
+    if len(small) >= len(full) {
+        g.fullSent++
+        return msg
+    }
+    g.deltasSent++
+    g.bytesSaved += int64(len(full) - len(small))
+    msg.Data = delta
+    msg.Encoding = encodingDelta
+    return msg
+}
+
+// decode expands a delta received on link into the full metadata map and
+// remembers full peer-discovered maps as the base for later deltas. It
+// returns the peerId and false when a delta does not apply.
+func (g *gossipDelta) decode(link string, msg *inboundMessage) (string, bool) {
+    data, _ := msg.Data.(map[string]interface{})
+    id, _ := data["peerId"].(string)
+    if id == "" {
+        return "", msg.Encoding != encodingDelta
+    }
+    key := gossipKey(msg.NetworkName, id)
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    peers := g.recv[link]
+    if msg.Type == "peer-disconnected" {
+        delete(peers, key)
+        return id, true
+    }
+    if msg.Type != "peer-discovered" {
+        return id, msg.Encoding != encodingDelta
+    }
+    if peers == nil {
+        peers = map[string]map[string]interface{}{}
+        g.recv[link] = peers
+    }
+    if msg.Encoding != encodingDelta {
+        if _, ok := peers[key]; ok || len(peers) < maxDeltaPeersPerLink {
+            peers[key] = data
+        }
+        return id, true
+    }
+    base := peers[key]
+    want, _ := data["base"].(string)
+    if base == nil || metadataHash(base) != want {
+        delete(peers, key)
+        return id, false
+    }
+    out := make(map[string]interface{}, len(base))
+    for k, v := range base {
+        out[k] = v
+    }
+    if set, ok := data["set"].(map[string]interface{}); ok {
+        for k, v := range set {
+            out[k] = v
+        }
+    }
+    if unset, ok := data["unset"].([]interface{}); ok {
+        for _, k := range unset {
+            if ks, ok := k.(string); ok {
+                delete(out, ks)
+            }
+        }
+    }
+    if hash, _ := data["hash"].(string); metadataHash(out) != hash {
+        delete(peers, key)
+        return id, false
+    }
+    peers[key] = out
+    msg.Data = out
+    msg.Encoding = ""
+    return id, true
+}
+
+// takeFull returns the last full message sent to conn for a peer and forgets
+// it, so the next send on the link is full again.
+func (g *gossipDelta) takeFull(conn peerConn, netName, peerId string) (outboundMessage, bool) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    key := gossipKey(netName, peerId)
+    prev := g.sent[conn][key]
+    if prev == nil {
+        return outboundMessage{}, false
+    }
+    delete(g.sent[conn], key)
+    g.resyncs++
+    return prev.msg, true
+}
+
+func (g *gossipDelta) forgetLink(conn peerConn, link string) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    if conn != nil {
+        delete(g.sent, conn)
+    }
+    delete(g.recv, link)
+}
+
+func (g *gossipDelta) snapshot() map[string]interface{} {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    return map[string]interface{}{"full_sent": g.fullSent, "deltas_sent": g.deltasSent, "bytes_saved": g.bytesSaved, "resyncs": g.resyncs, "links": len(g.sent)}
+}
+
+// expandMeshGossip applies delta decoding to a message that arrived on a hub
+// link (a bootstrap URI or inbound hub peer ID). When a delta cannot be
+// applied it asks the sender for the full map and reports false.
+func (s *Server) expandMeshGossip(link string, conn peerConn, msg *inboundMessage) bool {
+    id, ok := s.gossipDelta.decode(link, msg)
+    if ok {
+        return true
+    }
+    if id != "" && conn != nil {
+        s.writeMessage(conn, s.signMesh(outboundMessage{Type: "gossip-resync", Data: map[string]interface{}{"peerId": id}, FromPeerId: "system", NetworkName: msg.NetworkName, Timestamp: nowMs()}, 0), 0)
+    }
+    return false
+}
+
+// handleGossipResync re-sends the full peer-discovered a hub could not apply
+// a delta to.
+func (s *Server) handleGossipResync(conn peerConn, features []string, msg inboundMessage) {
+    m, _ := msg.Data.(map[string]interface{})
+    id, _ := m["peerId"].(string)
+    if conn == nil || id == "" {
+        return
+    }
+    if full, ok := s.gossipDelta.takeFull(conn, msg.NetworkName, id); ok {
+        s.sendToHub(conn, features, full)
+    }
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestGossipDeltaEncodingAndResync(t *testing.T) {
+    s := NewServer(Options{})
+    link := &pollConn{s: s, peerId: "hub-b", notify: make(chan struct{}, 1), lastPoll: nowMs()}
+    shared := []string{featureGossipDelta}
+    receiver := newGossipDelta()
+    id := "0123456789abcdef0123456789abcdef01234567"
+    send := func(data map[string]interface{}) inboundMessage {
+        s.sendToHub(link, shared, outboundMessage{Type: "peer-discovered", Data: data, FromPeerId: "system", NetworkName: "lobby", Timestamp: nowMs()})
+        msgs, _ := link.take(time.Second)
+        if len(msgs) != 1 {
+            t.Fatalf("expected one message on the link, got %d", len(msgs))
+        }
+        var in inboundMessage
+        json.Unmarshal(msgs[0], &in)
+        return in
+    }
+    profile := strings.Repeat("p", 200)
+    first := send(map[string]interface{}{"peerId": id, "isHub": false, "name": "a", "profile": profile})
+    if first.Encoding != "" {
+        t.Fatalf("first send should carry the full map, got encoding %q", first.Encoding)
+    }
+    if _, ok := receiver.decode("hub-a", &first); !ok {
+        t.Fatalf("full map should always decode")
+    }
+    second := send(map[string]interface{}{"peerId": id, "isHub": false, "name": "b", "profile": profile})
+    if second.Encoding != encodingDelta || strings.Contains(fmt.Sprint(second.Data), profile) {
+        t.Fatalf("second send should be a delta without unchanged fields, got %+v", second)
+    }
+    fresh := newGossipDelta()
+    stale := second
+    if _, ok := fresh.decode("hub-a", &stale); ok {
+        t.Fatalf("a delta without a base should not apply")
+    }
+    if _, ok := receiver.decode("hub-a", &second); !ok {
+        t.Fatalf("delta should apply to the stored base")
+    }
+    if m := second.Data.(map[string]interface{}); m["name"] != "b" || m["profile"] != profile || second.Encoding != "" {
+        t.Fatalf("unexpected expanded map %+v", second)
+    }
+
+    s.handleGossipResync(link, shared, inboundMessage{Type: "gossip-resync", NetworkName: "lobby", Data: map[string]interface{}{"peerId": id}})
+    msgs, _ := link.take(time.Second)
+    var full inboundMessage
+    if len(msgs) != 1 || json.Unmarshal(msgs[0], &full) != nil || full.Encoding != "" || full.Data.(map[string]interface{})["name"] != "b" {
+        t.Fatalf("resync should re-send the full map, got %s", msgs)
+    }
+    if snap := s.gossipDelta.snapshot(); snap["deltas_sent"] != int64(1) || snap["resyncs"] != int64(1) {
+        t.Fatalf("unexpected gossip delta counters %v", snap)
+    }
+}
@@ -0,0 +1,512 @@
+package server
+
+import (
+    "context"
+    "crypto/tls"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/gorilla/websocket"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/credentials"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/peer"
+    "google.golang.org/grpc/status"
+    "google.golang.org/protobuf/encoding/protowire"
+)
+
+// gRPC transport. With GRPCAddr set the hub also serves the Signaling
+// service from proto/signaling.proto there: a peer opens one bidirectional
+// SignalStream and exchanges the usual protocol envelopes as Frames. The
+// stream is admitted like a WebSocket, with the peer ID, token and other
+// connection parameters taken from request metadata, and registered in the
+// same peer table, so gRPC and WebSocket peers discover and signal each
+// other as if they shared a transport. With GRPCCertFile and GRPCKeyFile
+// set the listener serves TLS. Outbound frames queue up to
+// WriteQueueSize under SlowConsumerPolicy. Data is sent uncompressed; gRPC
+// compression can be negotiated instead. Reserved peer IDs need the
+// WebSocket ownership challenge and are refused. Streams are counted under
+// the "grpc" path in /metrics, and frame counts under "grpc".
+const (
+    grpcMethod      = "SignalStream"
+    grpcService     = "peerpigeon.Signaling"
+    grpcStopTimeout = 2 * time.Second
+)
+
+// grpcParams maps metadata keys, with dashes removed, to the query
+// parameters admission reads.
+var grpcParams = map[string]string{
+    "peerid":         "peerId",
+    "token":          "token",
+    "clientversion":  "clientVersion",
+    "guesttoken":     "guestToken",
+    "pow":            "pow",
+    "pownonce":       "powNonce",
+    "migrationtoken": "migrationToken",
+    "monitortoken":   "monitorToken",
+    "apikey":         "apiKey",
+}
+
+type grpcTransport struct {
+    srv *grpc.Server
+    ln  net.Listener
+
+    sent     int64
+    received int64
+    invalid  int64
+    rejected int64
+}
+
+// grpcFrame is the Frame message of proto/signaling.proto.
+type grpcFrame struct {
+    Type         string
+    FromPeerId   string
+    TargetPeerId string
+    NetworkName  string
+    Data         []byte
+    Timestamp    int64
+    MessageId    string
+    Extra        []byte
+}
+
+func (f *grpcFrame) marshal() []byte {
+    var b []byte
+    str := func(num protowire.Number, v string) {
+        if v != "" {
+            b = protowire.AppendTag(b, num, protowire.BytesType)
+            b = protowire.AppendString(b, v)
+        }
+    }
+    raw := func(num protowire.Number, v []byte) {
+        if len(v) > 0 {
+            b = protowire.AppendTag(b, num, protowire.BytesType)
+            b = protowire.AppendBytes(b, v)
+        }
+    }
+    str(1, f.Type)
+    str(2, f.FromPeerId)
+    str(3, f.TargetPeerId)
+    str(4, f.NetworkName)
+    raw(5, f.Data)
+    if f.Timestamp != 0 {
+        b = protowire.AppendTag(b, 6, protowire.VarintType)
+        b = protowire.AppendVarint(b, uint64(f.Timestamp))
+    }
+    str(7, f.MessageId)
+    raw(8, f.Extra)
+    return b
+}
+
+func (f *grpcFrame) unmarshal(b []byte) error {
+    *f = grpcFrame{}
+    for len(b) > 0 {
+        num, typ, n := protowire.ConsumeTag(b)
+        if n < 0 {
+            return protowire.ParseError(n)
+        }
+        b = b[n:]
+        if num == 6 && typ == protowire.VarintType {
+            v, n := protowire.ConsumeVarint(b)
+            if n < 0 {
+                return protowire.ParseError(n)
+            }
+            f.Timestamp, b = int64(v), b[n:]
+            continue
+        }
+        if typ != protowire.BytesType || num < 1 || num > 8 {
+            n = protowire.ConsumeFieldValue(num, typ, b)
+            if n < 0 {
+                return protowire.ParseError(n)
+            }
+            b = b[n:]
+            continue
+        }
+        v, n := protowire.ConsumeBytes(b)
+        if n < 0 {
+            return protowire.ParseError(n)
+        }
+        b = b[n:]
+        switch num {
+        case 1:
+            f.Type = string(v)
+        case 2:
+            f.FromPeerId = string(v)
+        case 3:
+            f.TargetPeerId = string(v)
+        case 4:
+            f.NetworkName = string(v)
+        case 5:
+            f.Data = append([]byte(nil), v...)
+        case 7:
+            f.MessageId = string(v)
+        case 8:
+            f.Extra = append([]byte(nil), v...)
+        }
+    }
+    return nil
+}
+
+// envelope is the JSON envelope handleMessage reads.
+func (f *grpcFrame) envelope() ([]byte, error) {
+    env := map[string]json.RawMessage{}
+    if len(f.Extra) > 0 {
+        if err := json.Unmarshal(f.Extra, &env); err != nil {
+            return nil, errors.New("extra is not a JSON object")
+        }
+    }
+    set := func(key, v string) {
+        if v != "" {
+            env[key], _ = json.Marshal(v)
+        }
+    }
+    set("type", f.Type)
+    set("fromPeerId", f.FromPeerId)
+    set("targetPeerId", f.TargetPeerId)
+    set("networkName", f.NetworkName)
+    set("messageId", f.MessageId)
+    if f.Timestamp != 0 {
+        env["timestamp"], _ = json.Marshal(f.Timestamp)
+    }
+    if len(f.Data) > 0 {
+        if !json.Valid(f.Data) {
+            return nil, errors.New("data is not JSON")
+        }
+        env["data"] = f.Data
+    }
+    return json.Marshal(env)
+}
+
+// frameFromEnvelope converts an outbound JSON envelope into a Frame,
+// decompressing its data.
+func frameFromEnvelope(b []byte) (*grpcFrame, error) {
+    var env map[string]json.RawMessage
+    if err := json.Unmarshal(b, &env); err != nil {
+        return nil, err
+    }
+    take := func(key string) string {
+        var v string
+        json.Unmarshal(env[key], &v)
+        delete(env, key)
+        return v
+    }
+    f := &grpcFrame{Type: take("type"), FromPeerId: take("fromPeerId"), TargetPeerId: take("targetPeerId"), NetworkName: take("networkName"), MessageId: take("messageId")}
+    json.Unmarshal(env["timestamp"], &f.Timestamp)
+    f.Data = env["data"]
+    delete(env, "timestamp")
+    delete(env, "data")
+    if encoding := take("encoding"); encoding != "" {
+        var v interface{}
+        json.Unmarshal(f.Data, &v)
+        plain, err := decompressData(v, encoding)
+        if err != nil {
+            return nil, err
+        }
+        if f.Data, err = json.Marshal(plain); err != nil {
+            return nil, err
+        }
+    }
+    if len(env) > 0 {
+        f.Extra, _ = json.Marshal(env)
+    }
+    return f, nil
+}
+
+// grpcCodec encodes Frames in the protobuf wire format, so stubs generated
+// from proto/signaling.proto work without the hub linking generated code.
+type grpcCodec struct{}
+
+func (grpcCodec) Marshal(v interface{}) ([]byte, error) {
+    f, ok := v.(*grpcFrame)
+    if !ok {
+        return nil, fmt.Errorf("grpc: cannot encode %T", v)
+    }
+    return f.marshal(), nil
+}
+
+func (grpcCodec) Unmarshal(b []byte, v interface{}) error {
+    f, ok := v.(*grpcFrame)
+    if !ok {
+        return fmt.Errorf("grpc: cannot decode into %T", v)
+    }
+    return f.unmarshal(b)
+}
+
+func (grpcCodec) Name() string { return "proto" }
+
+// grpcConn is a peer connected over SignalStream. Its stream handler sends
+// what WriteMessage queues.
+type grpcConn struct {
+    s      *Server
+    peerId string
+    out    chan []byte
+
+    mu     sync.Mutex
+    closed bool
+    reason string
+    done   chan struct{}
+}
+
+func (g *grpcConn) WriteMessage(messageType int, data []byte) error {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    if g.closed {
+        return errConnClosed
+    }
+    select {
+    case g.out <- data:
+        atomic.AddInt64(&g.s.writes.queued, 1)
+        return nil
+    default:
+    }
+    if g.s.opts.SlowConsumerPolicy == slowConsumerDrop {
+        atomic.AddInt64(&g.s.writes.dropped, 1)
+        return errWriteQueueFull
+    }
+    atomic.AddInt64(&g.s.writes.slowDisconnects, 1)
+    g.closeLocked(reasonSlowConsumer)
+    return errWriteQueueFull
+}
+
+// WriteControl ends the stream on a close frame, reporting its reason.
+func (g *grpcConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+    if messageType == websocket.CloseMessage {
+        reason := reasonError
+        if len(data) > 2 {
+            reason = string(data[2:])
+        }
+        g.closeWith(reason)
+    }
+    return nil
+}
+
+func (g *grpcConn) Close() error {
+    g.closeWith(reasonError)
+    return nil
+}
+
+func (g *grpcConn) closeWith(reason string) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    g.closeLocked(reason)
+}
+
+func (g *grpcConn) closeLocked(reason string) {
+    if !g.closed {
+        g.closed, g.reason = true, reason
+        close(g.done)
+    }
+}
+
+func (g *grpcConn) closeReason() string {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    return g.reason
+}
+
+// startGRPC serves the Signaling service on ln, over TLS when creds is set.
+func (s *Server) startGRPC(ln net.Listener, creds credentials.TransportCredentials) {
+    opts := []grpc.ServerOption{grpc.ForceServerCodec(grpcCodec{})}
+    if creds != nil {
+        opts = append(opts, grpc.Creds(creds))
+    }
+    if s.opts.MaxMessageBytes > 0 {
+        opts = append(opts, grpc.MaxRecvMsgSize(s.opts.MaxMessageBytes))
+    }
+    srv := grpc.NewServer(opts...)
+    srv.RegisterService(&grpc.ServiceDesc{
+        ServiceName: grpcService,
+        HandlerType: (*interface{})(nil),
+        Streams: []grpc.StreamDesc{{
+            StreamName:    grpcMethod,
+            Handler:       func(_ interface{}, stream grpc.ServerStream) error { return s.serveGRPCStream(stream) },
+            ServerStreams: true,
+            ClientStreams: true,
+        }},
+        Metadata: "proto/signaling.proto",
+    }, s)
+    s.grpc.srv, s.grpc.ln = srv, ln
+    s.spawn("grpc", "server", func() { srv.Serve(ln) })
+}
+
+// stopGRPC ends every stream and stops the gRPC server.
+func (s *Server) stopGRPC() {
+    srv := s.grpc.srv
+    if srv == nil {
+        return
+    }
+    done := make(chan struct{})
+    go func() {
+        srv.GracefulStop()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(grpcStopTimeout):
+        srv.Stop()
+    }
+}
+
+// grpcRequest reads the connection request admission checks from a
+// stream's metadata.
+func grpcRequest(ctx context.Context) *connRequest {
+    md, _ := metadata.FromIncomingContext(ctx)
+    r := &connRequest{path: pathGRPC, query: url.Values{}, header: http.Header{}}
+    for k, vs := range md {
+        if len(vs) == 0 {
+            continue
+        }
+        switch k {
+        case "authorization", "user-agent", "x-api-key":
+            r.header.Set(k, vs[0])
+        default:
+            if name, ok := grpcParams[strings.ReplaceAll(k, "-", "")]; ok {
+                r.query.Set(name, vs[0])
+            }
+        }
+    }
+    if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+        r.clientIP = p.Addr.String()
+        if host, _, err := net.SplitHostPort(r.clientIP); err == nil {
+            r.clientIP = host
+        }
+    }
+    return r
+}
+
+// grpcRefusal turns a refused admission into a status.
+func grpcRefusal(f *connRefusal) error {
+    code := codes.Unavailable
+    switch f.status {
+    case http.StatusUnauthorized:
+        code = codes.Unauthenticated
+    case http.StatusForbidden:
+        code = codes.PermissionDenied
+    case http.StatusTooManyRequests:
+        code = codes.ResourceExhausted
+    }
+    return status.Error(code, f.message)
+}
+
+// grpcCredentials loads GRPCCertFile and GRPCKeyFile, when set, so the
+// gRPC listener serves TLS. Without them tokens in metadata travel in
+// plaintext.
+func (s *Server) grpcCredentials() (credentials.TransportCredentials, error) {
+    if s.opts.GRPCCertFile == "" {
+        return nil, nil
+    }
+    cert, err := tls.LoadX509KeyPair(s.opts.GRPCCertFile, s.opts.GRPCKeyFile)
+    if err != nil {
+        return nil, fmt.Errorf("gRPC certificate: %v", err)
+    }
+    return credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}}), nil
+}
+
+// serveGRPCStream admits and registers a SignalStream peer, reads its
+// frames on another goroutine and sends its queue until it is closed.
+func (s *Server) serveGRPCStream(stream grpc.ServerStream) error {
+    r := grpcRequest(stream.Context())
+    peerId := r.Query("peerId")
+    if !s.admitPeer(r, peerId) {
+        atomic.AddInt64(&s.grpc.rejected, 1)
+        return grpcRefusal(r.refusal)
+    }
+    if s.identities != nil && s.identities.lookup(peerId) != nil {
+        atomic.AddInt64(&s.grpc.rejected, 1)
+        return status.Error(codes.PermissionDenied, "reserved peerId requires WebSocket")
+    }
+    g := &grpcConn{s: s, peerId: peerId, out: make(chan []byte, s.opts.WriteQueueSize), done: make(chan struct{})}
+    if !s.registerConn(r, peerId, g) {
+        atomic.AddInt64(&s.grpc.rejected, 1)
+        return status.Error(codes.ResourceExhausted, "max connections")
+    }
+    s.spawn("grpc-reader", peerId, func() { s.readGRPCStream(g, stream) })
+    send := func(b []byte) bool {
+        f, err := frameFromEnvelope(b)
+        if err != nil {
+            return true
+        }
+        if err := stream.SendMsg(f); err != nil {
+            atomic.AddInt64(&s.writes.writeErrors, 1)
+            g.closeWith(reasonError)
+            return false
+        }
+        atomic.AddInt64(&s.writes.written, 1)
+        atomic.AddInt64(&s.grpc.sent, 1)
+        return true
+    }
+    for open := true; open; {
+        select {
+        case b := <-g.out:
+            open = send(b)
+        case <-g.done:
+            open = false
+            // Flush what was queued before the close, as a WebSocket does.
+            for flushing := true; flushing; {
+                select {
+                case b := <-g.out:
+                    flushing = send(b)
+                default:
+                    flushing = false
+                }
+            }
+        case <-stream.Context().Done():
+            g.closeWith(reasonError)
+            open = false
+        }
+    }
+    reason := g.closeReason()
+    if s.getConn(peerId) == peerConn(g) {
+        s.handleDisconnect(peerId, reason, "")
+    }
+    switch reason {
+    case reasonClientGoodbye:
+        return nil
+    case reasonHubShutdown:
+        return status.Error(codes.Unavailable, reason)
+    }
+    return status.Error(codes.Aborted, reason)
+}
+
+func (s *Server) readGRPCStream(g *grpcConn, stream grpc.ServerStream) {
+    for {
+        f := &grpcFrame{}
+        if err := stream.RecvMsg(f); err != nil {
+            reason := reasonError
+            if err == io.EOF {
+                reason = reasonClientGoodbye
+            }
+            g.closeWith(reason)
+            return
+        }
+        if s.getConn(g.peerId) != peerConn(g) {
+            g.closeWith(reasonReplaced)
+            return
+        }
+        data, err := f.envelope()
+        if err != nil {
+            atomic.AddInt64(&s.grpc.invalid, 1)
+            s.metrics.MessageFailed()
+            s.penalize(g.peerId, offenceProtocol, "malformed gRPC frame")
+            continue
+        }
+        atomic.AddInt64(&s.grpc.received, 1)
+        s.handleMessage(g.peerId, data)
+    }
+}
+
+func (s *Server) grpcSnapshot() map[string]interface{} {
+    addr := ""
+    if s.grpc.ln != nil {
+        addr = s.grpc.ln.Addr().String()
+    }
+    return map[string]interface{}{"addr": addr, "frames_sent": atomic.LoadInt64(&s.grpc.sent), "frames_received": atomic.LoadInt64(&s.grpc.received), "invalid": atomic.LoadInt64(&s.grpc.invalid), "rejected": atomic.LoadInt64(&s.grpc.rejected)}
+}
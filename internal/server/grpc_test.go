@@ -0,0 +1,196 @@
+package server
+
+import (
+    "context"
+    "crypto/tls"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+    "google.golang.org/grpc"
+    "google.golang.org/grpc/codes"
+    "google.golang.org/grpc/credentials"
+    "google.golang.org/grpc/credentials/insecure"
+    "google.golang.org/grpc/metadata"
+    "google.golang.org/grpc/status"
+)
+
+func TestGRPCPeersShareRegistryWithWebSocketPeers(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    s := NewServer(Options{MaxConnections: 10})
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("listen: %v", err)
+    }
+    s.startGRPC(ln, nil)
+    defer s.stopGRPC()
+
+    cc, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithDefaultCallOptions(grpc.ForceCodec(grpcCodec{})))
+    if err != nil {
+        t.Fatalf("grpc client: %v", err)
+    }
+    defer cc.Close()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    open := func(id string) grpc.ClientStream {
+        st, err := cc.NewStream(metadata.AppendToOutgoingContext(ctx, "peer-id", id), &grpc.StreamDesc{StreamName: grpcMethod, ServerStreams: true, ClientStreams: true}, "/"+grpcService+"/"+grpcMethod)
+        if err != nil {
+            t.Fatalf("open stream: %v", err)
+        }
+        return st
+    }
+    recv := func(st grpc.ClientStream, typ string) *grpcFrame {
+        for {
+            f := &grpcFrame{}
+            if err := st.RecvMsg(f); err != nil {
+                t.Fatalf("waiting for %s: %v", typ, err)
+            }
+            if f.Type == typ {
+                return f
+            }
+        }
+    }
+
+    if err := open("not a peer id").RecvMsg(&grpcFrame{}); status.Code(err) != codes.PermissionDenied {
+        t.Fatalf("an invalid peer ID should be refused, got %v", err)
+    }
+
+    g, w := randomPeerId(), randomPeerId()
+    st := open(g)
+    if f := recv(st, "connected"); !strings.Contains(string(f.Data), g) {
+        t.Fatalf("greeting should name the peer: %s", f.Data)
+    }
+    ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?peerId="+w, nil)
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    defer ws.Close()
+    ws.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "lobby", "data": map[string]interface{}{"nick": "web"}})
+    waitFor(t, "websocket peer to announce", func() bool { pi := s.getPeerInfo(w); return pi != nil && pi.Announced })
+    wsRecv := func(typ string) map[string]interface{} {
+        ws.SetReadDeadline(time.Now().Add(3 * time.Second))
+        for {
+            var m map[string]interface{}
+            if err := ws.ReadJSON(&m); err != nil {
+                t.Fatalf("websocket waiting for %s: %v", typ, err)
+            }
+            if m["type"] == typ {
+                return m
+            }
+        }
+    }
+
+    st.SendMsg(&grpcFrame{Type: "announce", NetworkName: "lobby", Data: []byte(`{"nick":"backend"}`)})
+    if f := recv(st, "peer-discovered"); !strings.Contains(string(f.Data), w) {
+        t.Fatalf("gRPC peer should discover the websocket peer: %s", f.Data)
+    }
+    if m := wsRecv("peer-discovered"); m["data"].(map[string]interface{})["peerId"] != g {
+        t.Fatalf("websocket peer should discover the gRPC peer: %v", m)
+    }
+
+    st.SendMsg(&grpcFrame{Type: "offer", TargetPeerId: w, NetworkName: "lobby", Data: []byte(`{"sdp":"v=0 offer"}`)})
+    if m := wsRecv("offer"); m["fromPeerId"] != g || m["data"].(map[string]interface{})["sdp"] != "v=0 offer" {
+        t.Fatalf("offer should reach the websocket peer: %v", m)
+    }
+    ws.WriteJSON(map[string]interface{}{"type": "answer", "targetPeerId": g, "networkName": "lobby", "data": map[string]interface{}{"sdp": "v=0 answer"}})
+    if f := recv(st, "answer"); f.FromPeerId != w || string(f.Data) != `{"sdp":"v=0 answer"}` {
+        t.Fatalf("answer should reach the gRPC peer: %+v", f)
+    }
+
+    st.CloseSend()
+    if m := wsRecv("peer-disconnected"); m["data"].(map[string]interface{})["peerId"] != g {
+        t.Fatalf("websocket peer should see the gRPC peer leave: %v", m)
+    }
+    waitFor(t, "the gRPC stream to end", func() bool { return atomic.LoadInt64(&s.paths[pathGRPC].active) == 0 })
+    snap := s.grpcSnapshot()
+    if snap["rejected"] != int64(1) || snap["frames_received"].(int64) < 2 || snap["frames_sent"].(int64) < 3 {
+        t.Fatalf("unexpected grpc stats %v", snap)
+    }
+}
+
+func TestGRPCServesTLSWithCertificate(t *testing.T) {
+    if err := (Options{GRPCAddr: "127.0.0.1:0", GRPCCertFile: "hub.crt"}).Validate(); err == nil {
+        t.Fatalf("a certificate without a key should be refused")
+    }
+    certFile, keyFile := writeTestCert(t)
+    s := NewServer(Options{MaxConnections: 10, GRPCCertFile: certFile, GRPCKeyFile: keyFile})
+    s.running = true
+    creds, err := s.grpcCredentials()
+    if err != nil || creds == nil {
+        t.Fatalf("credentials: %v", err)
+    }
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatalf("listen: %v", err)
+    }
+    s.startGRPC(ln, creds)
+    defer s.stopGRPC()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    stream := func(c credentials.TransportCredentials) error {
+        cc, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(c), grpc.WithDefaultCallOptions(grpc.ForceCodec(grpcCodec{})))
+        if err != nil {
+            return err
+        }
+        defer cc.Close()
+        st, err := cc.NewStream(metadata.AppendToOutgoingContext(ctx, "peer-id", randomPeerId()), &grpc.StreamDesc{StreamName: grpcMethod, ServerStreams: true, ClientStreams: true}, "/"+grpcService+"/"+grpcMethod)
+        if err != nil {
+            return err
+        }
+        f := &grpcFrame{}
+        if err := st.RecvMsg(f); err != nil {
+            return err
+        }
+        if f.Type != "connected" {
+            return fmt.Errorf("expected the greeting, got %s", f.Type)
+        }
+        return nil
+    }
+    if err := stream(credentials.NewTLS(&tls.Config{InsecureSkipVerify: true})); err != nil {
+        t.Fatalf("a TLS client should connect: %v", err)
+    }
+    if err := stream(insecure.NewCredentials()); err == nil {
+        t.Fatalf("a plaintext client should not get through a TLS listener")
+    }
+}
+
+func TestGRPCFrameRoundTripsEnvelope(t *testing.T) {
+    env := []byte(`{"type":"offer","data":{"sdp":"x"},"fromPeerId":"a","targetPeerId":"b","networkName":"lobby","timestamp":42,"messageId":"m1","deadline":99}`)
+    f, err := frameFromEnvelope(env)
+    if err != nil {
+        t.Fatalf("frameFromEnvelope: %v", err)
+    }
+    var back grpcFrame
+    if err := back.unmarshal(f.marshal()); err != nil {
+        t.Fatalf("unmarshal: %v", err)
+    }
+    if back.Type != "offer" || back.Timestamp != 42 || string(back.Extra) != `{"deadline":99}` {
+        t.Fatalf("unexpected frame %+v", back)
+    }
+    out, err := back.envelope()
+    if err != nil {
+        t.Fatalf("envelope: %v", err)
+    }
+    var a, b map[string]interface{}
+    json.Unmarshal(env, &a)
+    json.Unmarshal(out, &b)
+    if fmt.Sprint(a) != fmt.Sprint(b) {
+        t.Fatalf("envelope changed: %s", out)
+    }
+
+    data, encoding := compressData(map[string]interface{}{"blob": strings.Repeat("a", 2000)}, 100)
+    packed, _ := json.Marshal(outboundMessage{Type: "peer-message", Data: data, Encoding: encoding})
+    if f, err := frameFromEnvelope(packed); err != nil || encoding == "" || !strings.HasPrefix(string(f.Data), `{"blob":"aaa`) || f.Extra != nil {
+        t.Fatalf("compressed data should be sent plain: %v %+v", err, f)
+    }
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+    "net/http"
+    "os"
+    "runtime"
+    "runtime/debug"
+    "runtime/metrics"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Resource guardrails. With MaxRSSMB, MaxHeapMB or MaxGoroutines set, the
+// hub samples its resident memory, live heap and goroutine count once a
+// second. When any reading reaches GuardrailWarnPercent of its ceiling the
+// hub is under pressure until every reading falls below 80% of that level:
+// new peer connections get 503 with Retry-After (hub links on /mesh are
+// still accepted, so the mesh can heal), low-priority work is shed as in
+// load shedding, /health reports status "degraded" with the resources over
+// the line, and the transition is logged as a warning. A ceiling crossed on
+// memory also returns freed memory to the OS once. The point is to stop
+// growth before the kernel's OOM killer drops every connected peer at
+// once. Readings and counts are under "guardrails" in /metrics.
+const (
+    guardRSS        = "rss"
+    guardHeap       = "heap"
+    guardGoroutines = "goroutines"
+
+    guardRetryAfter = 5 * time.Second
+)
+
+type guardReadings struct {
+    rss        uint64
+    heap       uint64
+    goroutines int
+}
+
+type guardrails struct {
+    pressure int32
+
+    mu       sync.Mutex
+    last     guardReadings
+    tripped  []string
+    since    int64
+    episodes int64
+    refused  int64
+}
+
+func (s *Server) guardrailsEnabled() bool {
+    return s.opts.MaxRSSMB > 0 || s.opts.MaxHeapMB > 0 || s.opts.MaxGoroutines > 0
+}
+
+// readResources samples the process. RSS comes from /proc where there is
+// one, and otherwise from the memory the Go runtime has mapped and not
+// released.
+func readResources() guardReadings {
+    samples := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}, {Name: "/memory/classes/total:bytes"}, {Name: "/memory/classes/heap/released:bytes"}}
+    metrics.Read(samples)
+    r := guardReadings{goroutines: runtime.NumGoroutine()}
+    if samples[0].Value.Kind() == metrics.KindUint64 {
+        r.heap = samples[0].Value.Uint64()
+    }
+    if b, err := os.ReadFile("/proc/self/statm"); err == nil {
+        if fields := strings.Fields(string(b)); len(fields) > 1 {
+            pages, _ := strconv.ParseUint(fields[1], 10, 64)
+            r.rss = pages * uint64(os.Getpagesize())
+        }
+    }
+    if r.rss == 0 && samples[1].Value.Kind() == metrics.KindUint64 && samples[2].Value.Kind() == metrics.KindUint64 {
+        r.rss = samples[1].Value.Uint64() - samples[2].Value.Uint64()
+    }
+    return r
+}
+
+// updateGuardrails records a reading and moves the hub in or out of
+// resource pressure.
+func (s *Server) updateGuardrails(r guardReadings) {
+    g := s.guard
+    warn := float64(s.opts.GuardrailWarnPercent) / 100
+    over, clear := []string{}, true
+    check := func(name string, value, ceiling float64) {
+        if ceiling <= 0 {
+            return
+        }
+        if value >= ceiling*warn {
+            over = append(over, name)
+        }
+        if value >= ceiling*warn*shedRecoverRatio {
+            clear = false
+        }
+    }
+    check(guardRSS, float64(r.rss), float64(s.opts.MaxRSSMB)*(1<<20))
+    check(guardHeap, float64(r.heap), float64(s.opts.MaxHeapMB)*(1<<20))
+    check(guardGoroutines, float64(r.goroutines), float64(s.opts.MaxGoroutines))
+    g.mu.Lock()
+    g.last = r
+    pressured := atomic.LoadInt32(&g.pressure) == 1
+    switch {
+    case len(over) > 0:
+        g.tripped = over
+        if pressured {
+            g.mu.Unlock()
+            return
+        }
+        atomic.StoreInt32(&g.pressure, 1)
+        g.since = nowMs()
+        g.episodes++
+    case clear && pressured:
+        atomic.StoreInt32(&g.pressure, 0)
+        g.since, g.tripped = 0, nil
+    default:
+        g.mu.Unlock()
+        return
+    }
+    g.mu.Unlock()
+    fields := map[string]interface{}{"rssBytes": r.rss, "heapBytes": r.heap, "goroutines": r.goroutines}
+    if len(over) == 0 {
+        s.log.Info("resource_pressure_cleared", fields)
+        return
+    }
+    fields["tripped"] = over
+    s.log.Warn("resource_pressure", fields)
+    for _, name := range over {
+        if name == guardRSS || name == guardHeap {
+            debug.FreeOSMemory()
+            break
+        }
+    }
+}
+
+func (s *Server) runGuardrails() {
+    ticker := time.NewTicker(shedSampleInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        if !s.running {
+            return
+        }
+        s.updateGuardrails(readResources())
+    }
+}
+
+func (s *Server) underPressure() bool {
+    return atomic.LoadInt32(&s.guard.pressure) == 1
+}
+
+// refusePressure answers a new peer connection while the hub is under
+// resource pressure.
+func (s *Server) refusePressure(r *connRequest) bool {
+    if !s.underPressure() {
+        return false
+    }
+    s.guard.mu.Lock()
+    s.guard.refused++
+    s.guard.mu.Unlock()
+    r.refuseJSON(http.StatusServiceUnavailable, map[string]interface{}{"error": "hub at resource limit", "retryAfterMs": guardRetryAfter.Milliseconds()}, guardRetryAfter)
+    return true
+}
+
+// healthStatus is /health's status: degraded while under resource
+// pressure, with the resources over the line.
+func (s *Server) healthStatus() (string, []string) {
+    if !s.underPressure() {
+        return "healthy", nil
+    }
+    s.guard.mu.Lock()
+    defer s.guard.mu.Unlock()
+    return "degraded", append([]string{}, s.guard.tripped...)
+}
+
+func (s *Server) guardrailSnapshot() map[string]interface{} {
+    g := s.guard
+    g.mu.Lock()
+    defer g.mu.Unlock()
+    return map[string]interface{}{
+        "enabled":        s.guardrailsEnabled(),
+        "pressure":       atomic.LoadInt32(&g.pressure) == 1,
+        "pressure_since": g.since,
+        "tripped":        append([]string{}, g.tripped...),
+        "episodes":       g.episodes,
+        "refused":        g.refused,
+        "rss_bytes":      g.last.rss,
+        "heap_bytes":     g.last.heap,
+        "goroutines":     g.last.goroutines,
+        "max_rss_mb":     s.opts.MaxRSSMB,
+        "max_heap_mb":    s.opts.MaxHeapMB,
+        "max_goroutines": s.opts.MaxGoroutines,
+        "warn_percent":   s.opts.GuardrailWarnPercent,
+    }
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestResourceGuardrailsRefusePeersUnderPressure(t *testing.T) {
+    s := NewServer(Options{MaxConnections: 10, MaxGoroutines: 100, MaxHeapMB: 64})
+    gin.SetMode(gin.TestMode)
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    health := func() map[string]interface{} {
+        res, err := http.Get(ts.URL + "/health")
+        if err != nil {
+            t.Fatalf("health: %v", err)
+        }
+        defer res.Body.Close()
+        var h map[string]interface{}
+        json.NewDecoder(res.Body).Decode(&h)
+        return h
+    }
+    dial := func() (int, error) {
+        ws, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?peerId="+randomPeerId(), nil)
+        if err != nil {
+            return res.StatusCode, err
+        }
+        ws.Close()
+        return http.StatusSwitchingProtocols, nil
+    }
+    s.updateGuardrails(guardReadings{goroutines: 95, heap: 10 << 20})
+    if h := health(); h["status"] != "degraded" || fmt.Sprint(h["guardrails"]) != "[goroutines]" {
+        t.Fatalf("health should report the goroutine ceiling: %v", h)
+    }
+    if code, _ := dial(); code != http.StatusServiceUnavailable {
+        t.Fatalf("new peers should be refused under pressure, got %d", code)
+    }
+    if !s.shedding(shedAppBroadcast) {
+        t.Fatalf("low-priority work should be shed under pressure")
+    }
+    // Below the warning level but above the recovery level: still pressured.
+    s.updateGuardrails(guardReadings{goroutines: 80, heap: 10 << 20})
+    if !s.underPressure() {
+        t.Fatalf("pressure should not clear until readings fall well below the line")
+    }
+    s.updateGuardrails(guardReadings{goroutines: 50, heap: 60 << 20})
+    if h := health(); h["status"] != "degraded" || fmt.Sprint(h["guardrails"]) != "[heap]" {
+        t.Fatalf("health should report the heap ceiling: %v", h)
+    }
+    s.updateGuardrails(guardReadings{goroutines: 50, heap: 10 << 20})
+    if h := health(); h["status"] != "healthy" || h["degraded"] != false {
+        t.Fatalf("hub should recover: %v", h)
+    }
+    if _, err := dial(); err != nil {
+        t.Fatalf("peers should be accepted after recovery: %v", err)
+    }
+    if snap := s.guardrailSnapshot(); snap["episodes"] != int64(1) || snap["refused"] != int64(1) {
+        t.Fatalf("unexpected guardrail metrics: %v", snap)
+    }
+    if r := readResources(); r.heap == 0 || r.rss == 0 || r.goroutines == 0 {
+        t.Fatalf("resource readings should not be empty: %+v", r)
+    }
+}
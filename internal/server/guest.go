@@ -0,0 +1,346 @@
+package server
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+// Guest links. With GuestLinkSecret set, operators mint expiring URLs that
+// let a peer connect without the hub's AuthToken:
+//
+//     wss://hub.example.com/ws?guestToken=<token>   (the client adds &peerId=)
+//
+// The token is signed with GuestLinkSecret and carries the link ID, an
+// optional network, its expiry and its quotas, so any hub sharing the secret
+// accepts it. A guest may only announce, signal, ping, send peer messages and
+// fetch discovery; with a network it can use no other, and messages that
+// leave the network empty are sent to it. Each guest gets GuestRatePerSec
+// messages a second, or the link's own rate, and a link with maxPeers admits
+// that many guests at once. When the link expires or is revoked its guests
+// are disconnected.
+const (
+    errGuestNotPermitted = "guest-not-permitted"
+    errGuestRateLimited  = "guest-rate-limited"
+
+    defaultGuestLinkTTL = time.Hour
+    guestGrantKey       = "guestGrant"
+)
+
+// guestTypes are the messages a guest may send.
+var guestTypes = map[string]bool{
+    "announce": true, "goodbye": true, "ping": true,
+    "offer": true, "answer": true, "ice-candidate": true,
+    "peer-message": true, "message-receipt": true,
+    "events-since": true, "resolve-service": true,
+}
+
+// GuestLink is a minted link as listed by the admin API. Links minted
+// before a restart stay valid but are not listed.
+type GuestLink struct {
+    Id         string `json:"id"`
+    Network    string `json:"network,omitempty"`
+    ExpiresAt  int64  `json:"expiresAt"`
+    MaxPeers   int    `json:"maxPeers,omitempty"`
+    RatePerSec int    `json:"ratePerSec"`
+    CreatedAt  int64  `json:"createdAt,omitempty"`
+}
+
+type guestSession struct {
+    link   GuestLink
+    window int64
+    sent   int
+}
+
+type guestRegistry struct {
+    mu       sync.Mutex
+    links    map[string]*GuestLink
+    revoked  map[string]int64
+    sessions map[string]*guestSession
+    refused  int64
+}
+
+func newGuestRegistry() *guestRegistry {
+    return &guestRegistry{links: map[string]*GuestLink{}, revoked: map[string]int64{}, sessions: map[string]*guestSession{}}
+}
+
+// guestToken encodes a link. Format: base64(id|network|expiry|maxPeers|rate|hmac).
+func (s *Server) guestToken(l GuestLink) string {
+    payload := strings.Join([]string{l.Id, l.Network, strconv.FormatInt(l.ExpiresAt, 10), itoa(l.MaxPeers), itoa(l.RatePerSec)}, "|")
+    return base64.RawURLEncoding.EncodeToString([]byte(payload + "|" + s.signGuest(payload)))
+}
+
+func (s *Server) signGuest(payload string) string {
+    mac := hmac.New(sha256.New, []byte(s.opts.GuestLinkSecret))
+    mac.Write([]byte("guest|" + payload))
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseGuestToken returns the link a token grants and, when it grants
+// nothing, the reason why.
+func (s *Server) parseGuestToken(token string) (GuestLink, string) {
+    var l GuestLink
+    if s.opts.GuestLinkSecret == "" {
+        return l, "guest links disabled"
+    }
+    raw, err := base64.RawURLEncoding.DecodeString(token)
+    if err != nil {
+        return l, "invalid guest link"
+    }
+    parts := strings.Split(string(raw), "|")
+    if len(parts) != 6 || !hmac.Equal([]byte(parts[5]), []byte(s.signGuest(strings.Join(parts[:5], "|")))) {
+        return l, "invalid guest link"
+    }
+    l.Id, l.Network = parts[0], parts[1]
+    l.ExpiresAt, _ = strconv.ParseInt(parts[2], 10, 64)
+    l.MaxPeers, _ = strconv.Atoi(parts[3])
+    l.RatePerSec, _ = strconv.Atoi(parts[4])
+    if nowMs() > l.ExpiresAt {
+        return l, "guest link expired"
+    }
+    s.guests.mu.Lock()
+    _, revoked := s.guests.revoked[l.Id]
+    s.guests.mu.Unlock()
+    if revoked {
+        return l, "guest link revoked"
+    }
+    return l, ""
+}
+
+// admitGuest checks ?guestToken= for a peer connecting without the
+// AuthToken and stashes the link for registerConn.
+func (s *Server) admitGuest(r *connRequest, peerId string) bool {
+    l, reason := s.parseGuestToken(r.Query("guestToken"))
+    if reason == "" && l.MaxPeers > 0 && s.guestCount(l.Id, peerId) >= l.MaxPeers {
+        reason = "guest link full"
+    }
+    if reason != "" {
+        s.guests.mu.Lock()
+        s.guests.refused++
+        s.guests.mu.Unlock()
+        r.refuse(http.StatusUnauthorized, reason)
+        return false
+    }
+    r.Set(guestGrantKey, l)
+    return true
+}
+
+// guestCount is the number of guests connected through link, not counting
+// a reconnect of peerId.
+func (s *Server) guestCount(linkId, peerId string) int {
+    s.guests.mu.Lock()
+    defer s.guests.mu.Unlock()
+    n := 0
+    for id, g := range s.guests.sessions {
+        if g.link.Id == linkId && id != peerId {
+            n++
+        }
+    }
+    return n
+}
+
+func (s *Server) attachGuest(r *connRequest, peerId string) {
+    v, ok := r.Get(guestGrantKey)
+    if !ok {
+        return
+    }
+    s.guests.mu.Lock()
+    s.guests.sessions[peerId] = &guestSession{link: v.(GuestLink)}
+    s.guests.mu.Unlock()
+}
+
+func (s *Server) forgetGuest(peerId string) {
+    s.guests.mu.Lock()
+    delete(s.guests.sessions, peerId)
+    s.guests.mu.Unlock()
+}
+
+// guestNetwork is the network peerId is confined to, if it is a guest on
+// a link with one.
+func (s *Server) guestNetwork(peerId string) string {
+    s.guests.mu.Lock()
+    defer s.guests.mu.Unlock()
+    if g := s.guests.sessions[peerId]; g != nil {
+        return g.link.Network
+    }
+    return ""
+}
+
+// allowGuest applies a guest's permissions and rate to msg, answering with
+// a typed error when it is refused. Other peers always pass.
+func (s *Server) allowGuest(peerId string, msg inboundMessage) bool {
+    now := nowMs()
+    s.guests.mu.Lock()
+    g := s.guests.sessions[peerId]
+    if g == nil {
+        s.guests.mu.Unlock()
+        return true
+    }
+    code, message := "", ""
+    switch {
+    case !guestTypes[msg.Type]:
+        code, message = errGuestNotPermitted, "guests may not send "+msg.Type
+    case s.isHubAnnounce(msg):
+        code, message = errGuestNotPermitted, "guests may not announce as a hub"
+    case g.link.Network != "" && msg.NetworkName != g.link.Network && msg.Type != "ping" && msg.Type != "goodbye":
+        code, message = errGuestNotPermitted, "guest link is limited to network "+g.link.Network
+    default:
+        if now-g.window >= 1000 {
+            g.window, g.sent = now, 0
+        }
+        g.sent++
+        if g.link.RatePerSec > 0 && g.sent > g.link.RatePerSec {
+            code, message = errGuestRateLimited, "guest message rate exceeded"
+        }
+    }
+    s.guests.mu.Unlock()
+    if code == "" {
+        return true
+    }
+    s.sendToConn(s.getConn(peerId), outboundMessage{Type: "error", Data: map[string]interface{}{"code": code, "message": message, "type": msg.Type}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+    return false
+}
+
+// expireGuests disconnects guests whose link has expired or been revoked,
+// and drops revocations and listed links once they have expired anyway.
+func (s *Server) expireGuests(now int64) {
+    r := s.guests
+    r.mu.Lock()
+    gone := map[string]string{}
+    for id, g := range r.sessions {
+        if _, revoked := r.revoked[g.link.Id]; revoked || now > g.link.ExpiresAt {
+            gone[id] = g.link.Id
+        }
+    }
+    for id, until := range r.revoked {
+        if now > until {
+            delete(r.revoked, id)
+        }
+    }
+    for id, l := range r.links {
+        if now > l.ExpiresAt {
+            delete(r.links, id)
+        }
+    }
+    r.mu.Unlock()
+    for peerId, linkId := range gone {
+        if conn := s.getConn(peerId); conn != nil {
+            s.handleDisconnect(peerId, reasonGuestExpired, "guest link "+linkId)
+            closeWithReason(conn, websocket.ClosePolicyViolation, reasonGuestExpired)
+        }
+        s.forgetGuest(peerId)
+    }
+}
+
+func (s *Server) guestSnapshot() map[string]interface{} {
+    r := s.guests
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return map[string]interface{}{"enabled": s.opts.GuestLinkSecret != "", "active": len(r.sessions), "links": len(r.links), "revoked": len(r.revoked), "refused": r.refused}
+}
+
+// guestHubURL is the WebSocket URL guests are sent to: hubUrl when given,
+// otherwise this hub's /ws as the admin request reached it.
+func guestHubURL(c *gin.Context, hubUrl string) string {
+    if hubUrl != "" {
+        return hubUrl
+    }
+    scheme := "ws"
+    if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+        scheme = "wss"
+    }
+    return scheme + "://" + c.Request.Host + "/ws"
+}
+
+// adminMintGuestLink creates a guest link: {"network", "ttlMs", "maxPeers",
+// "ratePerSec", "hubUrl"}, all optional.
+func (s *Server) adminMintGuestLink(c *gin.Context) {
+    if s.opts.GuestLinkSecret == "" {
+        writeJSON(c.Writer, http.StatusNotImplemented, map[string]interface{}{"error": "guest links disabled"}, s.opts.CORSOrigin)
+        return
+    }
+    var body struct {
+        Network    string `json:"network"`
+        TTLMs      int64  `json:"ttlMs"`
+        MaxPeers   int    `json:"maxPeers"`
+        RatePerSec int    `json:"ratePerSec"`
+        HubURL     string `json:"hubUrl"`
+    }
+    json.NewDecoder(c.Request.Body).Decode(&body)
+    if body.Network != "" {
+        if _, ok := s.resolveNetwork(body.Network); !ok {
+            writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "invalid or unpermitted network"}, s.opts.CORSOrigin)
+            return
+        }
+    }
+    if body.TTLMs < 0 || body.MaxPeers < 0 || body.RatePerSec < 0 {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "ttlMs, maxPeers and ratePerSec must not be negative"}, s.opts.CORSOrigin)
+        return
+    }
+    ttl := defaultGuestLinkTTL.Milliseconds()
+    if body.TTLMs > 0 {
+        ttl = body.TTLMs
+    }
+    b := make([]byte, 8)
+    rand.Read(b)
+    l := GuestLink{Id: hex.EncodeToString(b), Network: body.Network, ExpiresAt: nowMs() + ttl, MaxPeers: body.MaxPeers, RatePerSec: body.RatePerSec, CreatedAt: nowMs()}
+    if l.RatePerSec == 0 {
+        l.RatePerSec = s.guestRate()
+    }
+    token := s.guestToken(l)
+    s.guests.mu.Lock()
+    s.guests.links[l.Id] = &l
+    s.guests.mu.Unlock()
+    s.audit(c, "mint-guest-link", map[string]interface{}{"id": l.Id, "network": l.Network, "expiresAt": l.ExpiresAt})
+    writeJSON(c.Writer, http.StatusCreated, map[string]interface{}{"link": l, "token": token, "url": guestHubURL(c, body.HubURL) + "?guestToken=" + token}, s.opts.CORSOrigin)
+}
+
+func (s *Server) adminListGuestLinks(c *gin.Context) {
+    r := s.guests
+    r.mu.Lock()
+    active := map[string]int{}
+    for _, g := range r.sessions {
+        active[g.link.Id]++
+    }
+    links := make([]map[string]interface{}, 0, len(r.links))
+    for id, l := range r.links {
+        _, revoked := r.revoked[id]
+        links = append(links, map[string]interface{}{"id": id, "network": l.Network, "expiresAt": l.ExpiresAt, "maxPeers": l.MaxPeers, "ratePerSec": l.RatePerSec, "createdAt": l.CreatedAt, "revoked": revoked, "activePeers": active[id]})
+    }
+    r.mu.Unlock()
+    sort.Slice(links, func(i, j int) bool { return links[i]["createdAt"].(int64) < links[j]["createdAt"].(int64) })
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"links": links}, s.opts.CORSOrigin)
+}
+
+// adminRevokeGuestLink stops a link from admitting anyone and disconnects
+// its guests. ?expiresAt= revokes a link minted before a restart.
+func (s *Server) adminRevokeGuestLink(c *gin.Context) {
+    id := c.Param("id")
+    r := s.guests
+    r.mu.Lock()
+    until, _ := strconv.ParseInt(c.Query("expiresAt"), 10, 64)
+    if l := r.links[id]; l != nil {
+        until = l.ExpiresAt
+    }
+    if until <= nowMs() {
+        r.mu.Unlock()
+        writeJSON(c.Writer, http.StatusNotFound, map[string]interface{}{"error": "unknown or expired guest link"}, s.opts.CORSOrigin)
+        return
+    }
+    r.revoked[id] = until
+    r.mu.Unlock()
+    s.expireGuests(nowMs())
+    s.audit(c, "revoke-guest-link", map[string]interface{}{"id": id})
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"revoked": id}, s.opts.CORSOrigin)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestGuestLinksConstrainAndExpire(t *testing.T) {
+    s := NewServer(Options{MaxConnections: 10, AuthToken: "secret", AdminToken: "adm", GuestLinkSecret: "guest-secret", GuestRatePerSec: 10})
+    gin.SetMode(gin.TestMode)
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    admin := func(method, path, body string) (int, map[string]interface{}) {
+        req, _ := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+        req.Header.Set("Authorization", "Bearer adm")
+        res, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatalf("%s %s: %v", method, path, err)
+        }
+        defer res.Body.Close()
+        var out map[string]interface{}
+        json.NewDecoder(res.Body).Decode(&out)
+        return res.StatusCode, out
+    }
+    code, minted := admin("POST", "/admin/guest-links", `{"network": "session-1", "maxPeers": 1, "ratePerSec": 3}`)
+    if code != http.StatusCreated {
+        t.Fatalf("mint failed with %d: %v", code, minted)
+    }
+    link := minted["link"].(map[string]interface{})
+    guestURL := minted["url"].(string)
+    if !strings.HasPrefix(guestURL, "ws://") || !strings.Contains(guestURL, "/ws?guestToken=") {
+        t.Fatalf("unexpected guest url %q", guestURL)
+    }
+
+    g1, g2 := randomPeerId(), randomPeerId()
+    base := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?peerId="
+    if _, res, err := websocket.DefaultDialer.Dial(base+g1, nil); err == nil || res.StatusCode != http.StatusUnauthorized {
+        t.Fatalf("a peer without token or guest link should be refused")
+    }
+    if _, res, err := websocket.DefaultDialer.Dial(base+g1+"&guestToken=x"+minted["token"].(string), nil); err == nil || res.StatusCode != http.StatusUnauthorized {
+        t.Fatalf("a forged guest token should be refused")
+    }
+    c, _, err := websocket.DefaultDialer.Dial(guestURL+"&peerId="+g1, nil)
+    if err != nil {
+        t.Fatalf("guest dial: %v", err)
+    }
+    defer c.Close()
+    if _, res, err := websocket.DefaultDialer.Dial(guestURL+"&peerId="+g2, nil); err == nil || res.StatusCode != http.StatusUnauthorized {
+        t.Fatalf("a link with maxPeers 1 should refuse a second guest")
+    }
+
+    errorCodes := func(n int) []string {
+        var out []string
+        c.SetReadDeadline(time.Now().Add(2 * time.Second))
+        for len(out) < n {
+            var m map[string]interface{}
+            if err := c.ReadJSON(&m); err != nil {
+                t.Fatalf("reading guest errors: %v (have %v)", err, out)
+            }
+            if d, ok := m["data"].(map[string]interface{}); ok && m["type"] == "error" {
+                out = append(out, fmt.Sprint(d["code"]))
+            }
+        }
+        return out
+    }
+    c.WriteJSON(map[string]interface{}{"type": "announce", "data": map[string]interface{}{}})
+    waitFor(t, "guest announce on the link's network", func() bool {
+        pi := s.getPeerInfo(g1)
+        return pi != nil && pi.Announced && pi.NetworkName == "session-1"
+    })
+    c.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "elsewhere", "data": map[string]interface{}{}})
+    c.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "session-1", "data": map[string]interface{}{"isHub": true}})
+    c.WriteJSON(map[string]interface{}{"type": "monitor-subscribe", "networkName": "session-1", "data": map[string]interface{}{"patterns": []string{"*"}}})
+    if got := errorCodes(3); fmt.Sprint(got) != fmt.Sprint([]string{errGuestNotPermitted, errGuestNotPermitted, errGuestNotPermitted}) {
+        t.Fatalf("guest should be confined to its network and message types, got %v", got)
+    }
+    for i := 0; i < 5; i++ {
+        c.WriteJSON(map[string]interface{}{"type": "ping"})
+    }
+    if got := errorCodes(1); got[0] != errGuestRateLimited {
+        t.Fatalf("guest should be rate limited, got %v", got)
+    }
+
+    if code, _ := admin("DELETE", "/admin/guest-links/"+link["id"].(string), ""); code != http.StatusOK {
+        t.Fatalf("revoke failed with %d", code)
+    }
+    c.SetReadDeadline(time.Now().Add(2 * time.Second))
+    for {
+        if _, _, err := c.ReadMessage(); err != nil {
+            if ce, ok := err.(*websocket.CloseError); !ok || ce.Text != reasonGuestExpired {
+                t.Fatalf("revoked guest should be closed with %s, got %v", reasonGuestExpired, err)
+            }
+            break
+        }
+    }
+    if _, res, err := websocket.DefaultDialer.Dial(guestURL+"&peerId="+g2, nil); err == nil || res.StatusCode != http.StatusUnauthorized {
+        t.Fatalf("a revoked link should admit nobody")
+    }
+    if snap := s.guestSnapshot(); snap["active"] != 0 || snap["revoked"] != 1 || snap["refused"] != int64(3) {
+        t.Fatalf("unexpected guest counts %v", snap)
+    }
+}
@@ -0,0 +1,331 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http"
+    "path"
+    "sort"
+    "sync"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+// Hub join approval. With HubApprovalRequired, a hub that connects to this
+// one and announces itself is held as pending: it is registered, but it gets
+// no peer gossip and its own gossip is dropped until an operator approves it
+// with POST /admin/hub-approvals/:hubPeerId, or it matches the auto-approval
+// policy: a hub key listed in HubAutoApproveKeys, or a mesh namespace
+// matching one of the HubAutoApproveNamespaces globs. A rejected hub is
+// disconnected with reason hub-rejected and refused whenever it comes back.
+// A decision is tied to the hub key the hub presented, so a hub returning
+// under another key is pending again. Decisions are saved under
+// HubApprovalStorePath when set. Hubs this one dials are chosen by its
+// operator and need no approval.
+//
+// The joining hub is told hub-pending and, once approved, hub-approved, on
+// which it announces its local peers again, since the first round was
+// dropped.
+const (
+    hubApprovalPending  = "pending"
+    hubApprovalApproved = "approved"
+    hubApprovalRejected = "rejected"
+)
+
+// HubApproval is the join state of one inbound hub. DecidedBy is "operator",
+// "key" or "namespace".
+type HubApproval struct {
+    HubPeerId   string `json:"hubPeerId"`
+    State       string `json:"state"`
+    HubKey      string `json:"hubKey,omitempty"`
+    NetworkName string `json:"networkName,omitempty"`
+    Version     string `json:"version,omitempty"`
+    RequestedAt int64  `json:"requestedAt,omitempty"`
+    DecidedAt   int64  `json:"decidedAt,omitempty"`
+    DecidedBy   string `json:"decidedBy,omitempty"`
+    Note        string `json:"note,omitempty"`
+}
+
+type hubApprovals struct {
+    store   Store
+    key     string
+    mu      sync.Mutex
+    hubs    map[string]*HubApproval
+    held    int64
+    refused int64
+}
+
+func newHubApprovals(store Store, key string) *hubApprovals {
+    a := &hubApprovals{store: store, key: key, hubs: map[string]*HubApproval{}}
+    if key != "" {
+        var saved []*HubApproval
+        if b, err := store.Load(key); err == nil && b != nil && json.Unmarshal(b, &saved) == nil {
+            for _, h := range saved {
+                a.hubs[h.HubPeerId] = h
+            }
+        }
+    }
+    return a
+}
+
+// save writes every decision; pending hubs are not kept across restarts.
+// Callers hold a.mu.
+func (a *hubApprovals) save() error {
+    if a.key == "" {
+        return nil
+    }
+    list := []*HubApproval{}
+    for _, h := range a.hubs {
+        if h.State != hubApprovalPending {
+            list = append(list, h)
+        }
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].HubPeerId < list[j].HubPeerId })
+    b, err := json.MarshalIndent(list, "", "  ")
+    if err != nil {
+        return err
+    }
+    return a.store.Save(a.key, b)
+}
+
+// autoApproval reports which policy, if any, admits a hub.
+func (s *Server) autoApproval(hubKey, netName string) string {
+    for _, k := range s.opts.HubAutoApproveKeys {
+        if hubKey != "" && k == hubKey {
+            return "key"
+        }
+    }
+    for _, pattern := range s.opts.HubAutoApproveNamespaces {
+        if ok, _ := path.Match(pattern, netName); ok {
+            return "namespace"
+        }
+    }
+    return ""
+}
+
+// admitHub records a hub's announce and returns its state. A decision made
+// before the hub presented a key binds to the first key it presents; a hub
+// whose decision was made for another key starts over as pending.
+func (s *Server) admitHub(peerId, netName string, data map[string]interface{}) string {
+    if !s.opts.HubApprovalRequired {
+        return hubApprovalApproved
+    }
+    hubKey, _ := data["hubKey"].(string)
+    version, _ := data["version"].(string)
+    a := s.hubApprovals
+    a.mu.Lock()
+    h := a.hubs[peerId]
+    if h != nil && h.State != hubApprovalPending && (h.HubKey == hubKey || h.HubKey == "") {
+        if h.HubKey == "" && hubKey != "" {
+            h.HubKey = hubKey
+            a.save()
+        }
+        state := h.State
+        if state == hubApprovalRejected {
+            a.refused++
+        }
+        a.mu.Unlock()
+        return state
+    }
+    now := nowMs()
+    h = &HubApproval{HubPeerId: peerId, State: hubApprovalPending, HubKey: hubKey, NetworkName: netName, Version: version, RequestedAt: now}
+    if by := s.autoApproval(hubKey, netName); by != "" {
+        h.State, h.DecidedAt, h.DecidedBy = hubApprovalApproved, now, by
+    }
+    a.hubs[peerId] = h
+    if h.State == hubApprovalApproved {
+        a.save()
+    }
+    a.mu.Unlock()
+    if h.State == hubApprovalApproved {
+        s.log.Info("hub_auto_approved", map[string]interface{}{"hubPeerId": peerId, "networkName": netName, "policy": h.DecidedBy})
+    } else {
+        s.log.Warn("hub_pending_approval", map[string]interface{}{"hubPeerId": peerId, "networkName": netName, "hubKey": hubKey})
+    }
+    return h.State
+}
+
+// hubApproved reports whether an inbound hub may exchange gossip.
+func (s *Server) hubApproved(peerId string) bool {
+    if !s.opts.HubApprovalRequired {
+        return true
+    }
+    a := s.hubApprovals
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    h := a.hubs[peerId]
+    return h != nil && h.State == hubApprovalApproved
+}
+
+// holdPendingHub drops a message from a hub that is not approved, keeping
+// only its announce and keepalives.
+func (s *Server) holdPendingHub(peerId, msgType string) bool {
+    if msgType == "announce" || msgType == "ping" || msgType == "pong" || s.hubApproved(peerId) {
+        return false
+    }
+    s.hubApprovals.mu.Lock()
+    s.hubApprovals.held++
+    s.hubApprovals.mu.Unlock()
+    return true
+}
+
+// forgetPendingHub drops the pending entry of a hub that disconnected.
+func (s *Server) forgetPendingHub(peerId string) {
+    a := s.hubApprovals
+    a.mu.Lock()
+    if h := a.hubs[peerId]; h != nil && h.State == hubApprovalPending {
+        delete(a.hubs, peerId)
+    }
+    a.mu.Unlock()
+}
+
+// notifyHubApproval tells a joining hub where it stands.
+func (s *Server) notifyHubApproval(peerId, state string) {
+    if conn := s.getConn(peerId); conn != nil {
+        s.writeMessage(conn, s.signMesh(outboundMessage{Type: "hub-" + state, Data: map[string]interface{}{"hubPeerId": s.hubPeerId}, FromPeerId: "system", TargetPeer: peerId, NetworkName: s.opts.HubMeshNamespace, Timestamp: nowMs()}, 0), 0)
+    }
+}
+
+// completeHubJoin does for a newly approved hub what its announce would
+// have done: introduce it to the hub namespace and ask for its peers.
+func (s *Server) completeHubJoin(peerId string) {
+    pi := s.getPeerInfo(peerId)
+    if pi == nil || !pi.Announced {
+        return
+    }
+    s.notifyHubApproval(peerId, hubApprovalApproved)
+    s.broadcastPeerDiscovered(peerId, pi.NetworkName, true, pi.Data)
+    s.sendPeersToNew(peerId, pi.NetworkName)
+}
+
+// rejectHub closes a rejected hub's link.
+func (s *Server) rejectHub(peerId string) {
+    if conn := s.getConn(peerId); conn != nil {
+        s.handleDisconnect(peerId, reasonHubRejected, "")
+        closeWithReason(conn, websocket.ClosePolicyViolation, reasonHubRejected)
+    }
+}
+
+// handleHubApprovalNotice handles hub-pending and hub-approved from a
+// bootstrap hub that requires approval.
+func (s *Server) handleHubApprovalNotice(uri string, msg inboundMessage) {
+    s.bootstrapMu.Lock()
+    b := s.bootstrapConns[uri]
+    var ws *wsPeerConn
+    if b != nil {
+        b.pending = msg.Type == "hub-pending"
+        ws = b.ws
+    }
+    s.bootstrapMu.Unlock()
+    if ws == nil {
+        return
+    }
+    if msg.Type == "hub-pending" {
+        s.log.Warn("bootstrap_pending_approval", map[string]interface{}{"uri": uri})
+        return
+    }
+    s.log.Info("bootstrap_approved", map[string]interface{}{"uri": uri})
+    s.announceLocalPeersToBootstrap(ws)
+}
+
+func (s *Server) hubApprovalSnapshot() map[string]interface{} {
+    a := s.hubApprovals
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    counts := map[string]int{hubApprovalPending: 0, hubApprovalApproved: 0, hubApprovalRejected: 0}
+    for _, h := range a.hubs {
+        counts[h.State]++
+    }
+    return map[string]interface{}{"required": s.opts.HubApprovalRequired, "pending": counts[hubApprovalPending], "approved": counts[hubApprovalApproved], "rejected": counts[hubApprovalRejected], "held_messages": a.held, "refused": a.refused}
+}
+
+// adminListHubApprovals lists pending hubs and recorded decisions, oldest
+// request first.
+func (s *Server) adminListHubApprovals(c *gin.Context) {
+    a := s.hubApprovals
+    a.mu.Lock()
+    list := make([]HubApproval, 0, len(a.hubs))
+    for _, h := range a.hubs {
+        list = append(list, *h)
+    }
+    a.mu.Unlock()
+    sort.Slice(list, func(i, j int) bool { return list[i].RequestedAt < list[j].RequestedAt })
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"required": s.opts.HubApprovalRequired, "hubs": list}, s.opts.CORSOrigin)
+}
+
+// adminDecideHub approves or rejects a hub: {"approve": true, "note": "..."}.
+// A hub can be decided before it first connects; its decision then applies
+// to whatever key it presents.
+func (s *Server) adminDecideHub(c *gin.Context) {
+    peerId := c.Param("hubPeerId")
+    var body struct {
+        Approve *bool  `json:"approve"`
+        Note    string `json:"note"`
+    }
+    if err := json.NewDecoder(c.Request.Body).Decode(&body); err != nil || body.Approve == nil || !s.validPeerId(peerId) {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "a valid hubPeerId and approve are required"}, s.opts.CORSOrigin)
+        return
+    }
+    state := hubApprovalRejected
+    if *body.Approve {
+        state = hubApprovalApproved
+    }
+    pi := s.getPeerInfo(peerId)
+    a := s.hubApprovals
+    a.mu.Lock()
+    h := a.hubs[peerId]
+    if h == nil {
+        h = &HubApproval{HubPeerId: peerId}
+        if pi != nil && pi.IsHub {
+            h.HubKey, _ = pi.Data["hubKey"].(string)
+            h.NetworkName = pi.NetworkName
+        }
+        a.hubs[peerId] = h
+    }
+    prev := h.State
+    h.State, h.DecidedAt, h.DecidedBy, h.Note = state, nowMs(), "operator", body.Note
+    decided := *h
+    err := a.save()
+    a.mu.Unlock()
+    if err != nil {
+        writeJSON(c.Writer, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()}, s.opts.CORSOrigin)
+        return
+    }
+    s.audit(c, "hub-"+state, map[string]interface{}{"hubPeerId": peerId, "note": body.Note})
+    if state == hubApprovalRejected {
+        s.rejectHub(peerId)
+    } else if prev != hubApprovalApproved {
+        s.completeHubJoin(peerId)
+    }
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"hub": decided}, s.opts.CORSOrigin)
+}
+
+// adminForgetHubDecision drops a recorded decision. A connected hub that
+// was approved is held as pending again; a rejected hub may ask again.
+func (s *Server) adminForgetHubDecision(c *gin.Context) {
+    peerId := c.Param("hubPeerId")
+    pi := s.getPeerInfo(peerId)
+    a := s.hubApprovals
+    a.mu.Lock()
+    h := a.hubs[peerId]
+    if h == nil || h.State == hubApprovalPending {
+        a.mu.Unlock()
+        writeJSON(c.Writer, http.StatusNotFound, map[string]interface{}{"error": "no decision for hub"}, s.opts.CORSOrigin)
+        return
+    }
+    if pi != nil && pi.IsHub {
+        a.hubs[peerId] = &HubApproval{HubPeerId: peerId, State: hubApprovalPending, HubKey: h.HubKey, NetworkName: pi.NetworkName, Version: h.Version, RequestedAt: nowMs()}
+    } else {
+        delete(a.hubs, peerId)
+    }
+    err := a.save()
+    a.mu.Unlock()
+    if err != nil {
+        writeJSON(c.Writer, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()}, s.opts.CORSOrigin)
+        return
+    }
+    s.audit(c, "hub-decision-forget", map[string]interface{}{"hubPeerId": peerId})
+    if s.getConn(peerId) != nil {
+        s.notifyHubApproval(peerId, hubApprovalPending)
+    }
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"forgotten": peerId}, s.opts.CORSOrigin)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+func TestHubApprovalHoldsGossipUntilApproved(t *testing.T) {
+    st := &memStore{docs: map[string][]byte{}}
+    opts := Options{IsHub: true, AdminToken: "admin-secret", CORSOrigin: "*", HubApprovalRequired: true, HubAutoApproveNamespaces: []string{"trusted-*"}, HubApprovalStorePath: "approvals", Store: st}
+    s := NewServer(opts)
+    s.engine = gin.New()
+    s.registerAdminRoutes()
+    hub, peer, auto := randomPeerId(), randomPeerId(), randomPeerId()
+    conns := attachTestPeers(t, s, hub, peer, auto)
+    for _, id := range []string{hub, peer, auto} {
+        s.peerData[id].IsHub = id != peer
+    }
+    types := func(id string) []string {
+        msgs, _ := conns[id].take(20 * time.Millisecond)
+        var out []string
+        for _, raw := range msgs {
+            var m outboundMessage
+            json.Unmarshal(raw, &m)
+            out = append(out, m.Type)
+        }
+        return out
+    }
+    s.handleMessage(hub, []byte(`{"type":"announce","networkName":"pigeonhub-mesh","data":{"isHub":true}}`))
+    if got := types(hub); len(got) != 1 || got[0] != "hub-pending" {
+        t.Fatalf("joining hub should be told it is pending, got %v", got)
+    }
+    s.handleMessage(peer, []byte(`{"type":"announce","networkName":"global","data":{}}`))
+    if got := types(hub); len(got) != 0 {
+        t.Fatalf("pending hub must not receive gossip, got %v", got)
+    }
+    s.handleMessage(hub, []byte(`{"type":"peer-discovered","networkName":"global","data":{"peerId":"remote-1"}}`))
+    if s.isCrossHubPeerCached("global", "remote-1") || s.hubApprovalSnapshot()["held_messages"].(int64) != 1 {
+        t.Fatalf("gossip from a pending hub should be held, got %v", s.hubApprovalSnapshot())
+    }
+
+    w := httptest.NewRecorder()
+    req := httptest.NewRequest("POST", "/admin/hub-approvals/"+hub, strings.NewReader(`{"approve":true,"note":"eu replica"}`))
+    req.Header.Set("Authorization", "Bearer admin-secret")
+    s.engine.ServeHTTP(w, req)
+    if w.Code != 200 {
+        t.Fatalf("approve failed: %d %s", w.Code, w.Body.String())
+    }
+    if got := types(hub); len(got) == 0 || got[0] != "hub-approved" {
+        t.Fatalf("approved hub should be told so, got %v", got)
+    }
+    types(peer)
+    s.handleMessage(hub, []byte(`{"type":"peer-discovered","networkName":"global","data":{"peerId":"remote-1"}}`))
+    if !s.isCrossHubPeerCached("global", "remote-1") {
+        t.Fatalf("gossip from an approved hub should be accepted")
+    }
+
+    s.handleMessage(auto, []byte(`{"type":"announce","networkName":"trusted-mesh","data":{"isHub":true}}`))
+    if got := types(auto); containsType(got, "hub-pending") || !s.hubApproved(auto) {
+        t.Fatalf("namespace policy should approve on sight, got %v", got)
+    }
+
+    w = httptest.NewRecorder()
+    req = httptest.NewRequest("POST", "/admin/hub-approvals/"+hub, strings.NewReader(`{"approve":false}`))
+    req.Header.Set("Authorization", "Bearer admin-secret")
+    s.engine.ServeHTTP(w, req)
+    if w.Code != 200 || s.getConn(hub) != nil {
+        t.Fatalf("rejected hub should be disconnected: %d %s", w.Code, w.Body.String())
+    }
+
+    restarted := NewServer(opts)
+    if got := restarted.admitHub(hub, "pigeonhub-mesh", map[string]interface{}{}); got != hubApprovalRejected {
+        t.Fatalf("rejection should survive a restart, got %s", got)
+    }
+    if got := restarted.admitHub(auto, "trusted-mesh", map[string]interface{}{"hubKey": "other"}); got != hubApprovalApproved {
+        t.Fatalf("policy still applies to a new key, got %s", got)
+    }
+}
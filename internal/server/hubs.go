@@ -1,18 +1,29 @@
 package server
 
 import (
+    "encoding/json"
+    "fmt"
+    "net/http"
     "net/url"
+    "strings"
     "time"
     "github.com/gorilla/websocket"
 )
 
+const ProtocolVersion = 1
+
 type bootstrapConn struct {
     uri        string
-    ws         *websocket.Conn
+    ws         *wsPeerConn
     connected  bool
     lastAttempt int64
     attemptNum int
     reconnectTimer *time.Timer
+    incompatible string
+    version    string
+    features   []string
+    hubId      string
+    pending    bool
 }
 
 type hubInfo struct {
@@ -21,6 +32,10 @@ type hubInfo struct {
     LastActivity int64
     NetworkName  string
     Data         map[string]interface{}
+    Version        string   `json:",omitempty"`
+    Features       []string `json:",omitempty"`
+    SharedFeatures []string `json:",omitempty"`
+    Encoding       string   `json:",omitempty"`
 }
 
 func (s *Server) connectToBootstrapHubs() {
@@ -61,6 +76,7 @@ func (s *Server) scheduleBootstrapReconnect(uri string, attempt int) {
     b.attemptNum = attempt
     interval := time.Duration(s.opts.ReconnectIntervalMs) * time.Millisecond
     b.reconnectTimer = time.AfterFunc(interval, func() {
+        defer s.recoverPanic("bootstrap-reconnect", uri)
         s.connectToHub(uri, attempt+1)
     })
     s.bootstrapMu.Unlock()
@@ -74,13 +90,33 @@ func (s *Server) connectToHub(uri string, attempt int) {
     if u.Host == s.opts.Host && u.Port() == itoa(s.port) {
         return
     }
-    ws, _, err := websocket.DefaultDialer.Dial(uri+"?peerId="+s.hubPeerId, nil)
+    if s.opts.BootstrapHealthCheck {
+        fatal, reason := s.probeBootstrapHealth(u)
+        if reason != "" {
+            s.markBootstrapIncompatible(uri, attempt, reason)
+            if !fatal {
+                s.scheduleBootstrapReconnect(uri, attempt)
+            }
+            return
+        }
+    }
+    var header http.Header
+    query := "?peerId=" + s.hubPeerId
+    if token := s.meshToken(); token != "" && isMeshURI(u) {
+        header = http.Header{"Authorization": {"Bearer " + token}}
+    } else if token != "" {
+        // Lets a /ws bootstrap with protected networks know this is a hub.
+        query += "&meshToken=" + url.QueryEscape(token)
+    }
+    dialer := *websocket.DefaultDialer
+    dialer.EnableCompression = s.opts.MeshCompression
+    ws, _, err := dialer.Dial(uri+query, header)
     if err != nil {
         s.scheduleBootstrapReconnect(uri, attempt)
         return
     }
 
-    info := &bootstrapConn{uri: uri, ws: ws, connected: true, lastAttempt: nowMs(), attemptNum: attempt}
+    info := &bootstrapConn{uri: uri, ws: s.newWSPeerConn(ws, "bootstrap-writer", uri), connected: true, lastAttempt: nowMs(), attemptNum: attempt}
     s.bootstrapMu.Lock()
     if existing := s.bootstrapConns[uri]; existing != nil {
         if existing.reconnectTimer != nil {
@@ -92,27 +128,95 @@ func (s *Server) connectToHub(uri string, attempt int) {
     s.handleBootstrapOpen(info)
 }
 
+// probeBootstrapHealth fetches the remote hub's /health document before
+// dialing. A fatal result means the hub can never be meshed with (protocol or
+// namespace mismatch); otherwise the reason is transient, e.g. the hub is full.
+func (s *Server) probeBootstrapHealth(u *url.URL) (bool, string) {
+    hu := *u
+    switch hu.Scheme {
+    case "wss":
+        hu.Scheme = "https"
+    default:
+        hu.Scheme = "http"
+    }
+    hu.Path = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(hu.Path, "/"), "/ws"), "/mesh") + "/health"
+    hu.RawQuery = ""
+    client := http.Client{Timeout: 5 * time.Second}
+    res, err := client.Get(hu.String())
+    if err != nil {
+        return false, "health probe failed: " + err.Error()
+    }
+    defer res.Body.Close()
+    if res.StatusCode != http.StatusOK {
+        return false, fmt.Sprintf("health probe returned status %d", res.StatusCode)
+    }
+    var h struct {
+        ProtocolVersion  *int   `json:"protocolVersion"`
+        HubMeshNamespace string `json:"hubMeshNamespace"`
+        IsHub            bool   `json:"isHub"`
+        Connections      int    `json:"connections"`
+        MaxConnections   int    `json:"maxConnections"`
+    }
+    if err := json.NewDecoder(res.Body).Decode(&h); err != nil {
+        return false, "health probe returned invalid JSON"
+    }
+    // Hubs that predate the field do not report it and are assumed to
+    // speak this version.
+    if h.ProtocolVersion != nil && *h.ProtocolVersion != ProtocolVersion {
+        return true, fmt.Sprintf("protocol version %d, want %d", *h.ProtocolVersion, ProtocolVersion)
+    }
+    if h.HubMeshNamespace != "" && h.HubMeshNamespace != s.opts.HubMeshNamespace {
+        return true, fmt.Sprintf("hub mesh namespace %q, want %q", h.HubMeshNamespace, s.opts.HubMeshNamespace)
+    }
+    if h.MaxConnections > 0 && h.Connections >= h.MaxConnections {
+        return false, "hub at capacity"
+    }
+    return false, ""
+}
+
+func (s *Server) markBootstrapIncompatible(uri string, attempt int, reason string) {
+    s.bootstrapMu.Lock()
+    b := s.bootstrapConns[uri]
+    if b == nil {
+        b = &bootstrapConn{uri: uri}
+        s.bootstrapConns[uri] = b
+    }
+    b.connected = false
+    b.lastAttempt = nowMs()
+    b.attemptNum = attempt
+    b.incompatible = reason
+    s.bootstrapMu.Unlock()
+}
+
 func (s *Server) handleBootstrapOpen(b *bootstrapConn) {
     s.emitBootstrapConnected(b.uri)
+    s.emitMeshEvent("mesh.link-up", map[string]interface{}{"uri": b.uri})
     s.sendAnnouncementToBootstrap(b.ws)
-    go func() {
+    s.gossipHubSummary()
+    s.spawn("bootstrap-reader", b.uri, func() {
         for {
-            _, data, err := b.ws.ReadMessage()
+            messageType, data, err := b.ws.ReadMessage()
             if err != nil {
                 break
             }
-            s.handleBootstrapMessage(b.uri, data)
+            if data, ok := s.readFrame(b.ws, messageType, data); ok {
+                s.handleBootstrapMessage(b.uri, data)
+            }
         }
+        b.ws.Close()
         s.handleBootstrapClose(b)
-    }()
+    })
 }
 
 func (s *Server) handleBootstrapClose(b *bootstrapConn) {
     s.bootstrapMu.Lock()
-    b.connected = false
+    b.connected, b.pending = false, false
     s.bootstrapMu.Unlock()
+    s.gossipDelta.forgetLink(b.ws, b.uri)
+    s.emitMeshEvent("mesh.link-down", map[string]interface{}{"uri": b.uri})
     if s.running && b.attemptNum < s.opts.MaxReconnectAttempts {
         b.reconnectTimer = time.AfterFunc(time.Duration(s.opts.ReconnectIntervalMs)*time.Millisecond, func() {
+            defer s.recoverPanic("bootstrap-reconnect", b.uri)
             s.connectToHub(b.uri, b.attemptNum+1)
         })
     } else {
@@ -136,44 +240,71 @@ func (s *Server) disconnectBootstrap() {
     s.bootstrapMu.Unlock()
 }
 
-func (s *Server) sendAnnouncementToBootstrap(ws *websocket.Conn) {
-    msg := map[string]interface{}{
-        "type": "announce",
-        "networkName": s.opts.HubMeshNamespace,
-        "data": map[string]interface{}{
-            "isHub": true,
-            "port": s.port,
-            "host": s.opts.Host,
-            "capabilities": []string{"signaling", "relay"},
-            "timestamp": nowMs(),
-        },
-    }
-    ws.WriteJSON(msg)
+func (s *Server) sendAnnouncementToBootstrap(ws *wsPeerConn) {
+    capabilities := []string{}
+    if s.servesSignaling() {
+        capabilities = append(capabilities, "signaling")
+    }
+    if s.servesRelay() {
+        capabilities = append(capabilities, "relay")
+    }
+    data := map[string]interface{}{
+        "isHub": true,
+        "port": s.port,
+        "host": s.opts.Host,
+        "capabilities": capabilities,
+        "role": s.role(),
+        "version": Version,
+        "protocolVersion": ProtocolVersion,
+        "features": s.features(),
+        "timestamp": nowMs(),
+    }
+    if key := s.hubKeys.publicKey(); key != "" {
+        data["hubKey"] = key
+    }
+    if u := s.advertisedURL(); u != "" {
+        data["url"] = u
+    }
+    s.writeMessage(ws, s.signMesh(outboundMessage{Type: "announce", Data: data, FromPeerId: s.hubPeerId, NetworkName: s.opts.HubMeshNamespace, Timestamp: nowMs()}, 0), 0)
     s.announceLocalPeersToBootstrap(ws)
 }
 
-func (s *Server) announceLocalPeersToBootstrap(ws *websocket.Conn) {
+func (s *Server) announceLocalPeersToBootstrap(ws *wsPeerConn) {
+    payloads := []outboundMessage{}
+    s.peersMu.Lock()
     s.networkMu.Lock()
     for netName, set := range s.networkPeers {
         for peerId := range set {
             pi := s.peerData[peerId]
-            if pi == nil || !pi.Announced {
+            if pi == nil || !pi.Announced || hiddenPeer(pi.Data) {
                 continue
             }
-            payload := map[string]interface{}{
-                "type": "peer-discovered",
-                "data": map[string]interface{}{
-                    "peerId": peerId,
-                    "isHub": netName == s.opts.HubMeshNamespace,
-                },
-                "networkName": netName,
-                "fromPeerId": "system",
-                "timestamp": nowMs(),
+            data := map[string]interface{}{
+                "peerId": peerId,
+                "isHub": netName == s.opts.HubMeshNamespace,
+            }
+            if !pi.IsHub {
+                s.stampClaim(data, pi)
             }
-            ws.WriteJSON(payload)
+            payloads = append(payloads, outboundMessage{
+                Type: "peer-discovered",
+                Data: data,
+                NetworkName: netName,
+                FromPeerId: "system",
+                Timestamp: nowMs(),
+                MessageId: newMessageId(),
+                OriginHub: s.hubPeerId,
+                SeenHubs: stampSeen(nil, s.hubPeerId),
+                Hops: 1,
+            })
         }
     }
     s.networkMu.Unlock()
+    s.peersMu.Unlock()
+    for _, payload := range payloads {
+        s.markRelayed("peer-discovered:" + payload.MessageId)
+        s.writeMessage(ws, s.signMesh(payload, 0), 0)
+    }
 }
 
 func (s *Server) handleBootstrapMessage(uri string, data []byte) {
@@ -181,8 +312,28 @@ func (s *Server) handleBootstrapMessage(uri string, data []byte) {
     if err := decodeJSON(data, &msg); err != nil {
         return
     }
+    if msg.Encoding != encodingDelta {
+        d, err := decompressData(msg.Data, msg.Encoding)
+        if err != nil {
+            return
+        }
+        msg.Data = d
+    }
+    if !s.verifyBootstrapLink(uri, data, msg) || !s.admitFromHub(uri, msg.Type) {
+        return
+    }
+    netName, ok := s.resolveNetwork(msg.NetworkName)
+    if !ok {
+        return
+    }
+    msg.NetworkName = netName
+    conn, features := s.bootstrapLink(uri)
+    if !s.expandMeshGossip(uri, conn, &msg) {
+        return
+    }
     switch msg.Type {
     case "connected":
+        s.recordBootstrapFeatures(uri, msg.Data)
     case "peer-discovered":
         if m, ok := msg.Data.(map[string]interface{}); ok {
             id, _ := m["peerId"].(string)
@@ -191,144 +342,153 @@ func (s *Server) handleBootstrapMessage(uri string, data []byte) {
                 isHub = v
             }
             netName := msg.NetworkName
-            if netName == "" {
-                netName = "global"
-            }
             if isHub {
                 s.emitHubDiscovered(id, uri)
+                s.learnMember(id, memberURL(m), memberSourceDiscovered)
                 return
             }
-            if id == "" {
+            if id == "" || hiddenPeer(m) || s.alreadyVisited(msg) || !s.firstSighting("peer-discovered", msg) {
                 return
             }
-            // Deduplicate to avoid mesh loops.
-            if s.isCrossHubPeerCached(netName, id) {
+            // Deduplicate to avoid mesh loops; a winning claim on a peer
+            // from another hub replaces the cached one.
+            if !s.resolvePresence(netName, id, m) {
                 return
             }
             s.cacheCrossHubPeer(netName, id, m)
-            s.forwardToLocalPeers(netName, outboundMessage{Type: "peer-discovered", Data: m, FromPeerId: "system", NetworkName: netName, Timestamp: nowMs()})
-            
-            // Forward to all OTHER bootstrap hubs (mesh mesh)
-            s.announceToBootstrapExcept(id, netName, false, m, uri, "")
-            
-            // ALSO echo back to the originating hub so it knows the peer was received
-            s.bootstrapMu.Lock()
-            for origUri, b := range s.bootstrapConns {
-                if origUri == uri && b.connected && b.ws != nil {
-                    payload := map[string]interface{}{
-                        "type": "peer-discovered",
-                        "data": mergeMap(m, map[string]interface{}{
-                            "peerId": id,
-                            "isHub": false,
-                        }),
-                        "networkName": netName,
-                        "fromPeerId": "system",
-                        "timestamp": nowMs(),
-                    }
-                    b.ws.WriteJSON(payload)
-                    break
-                }
-            }
-            s.bootstrapMu.Unlock()
+            s.recordEvent(netName, "peer-discovered", id, m)
+            s.deliverCrossHubDiscovery(netName, id, m)
+
+            // Forward to the rest of the mesh, never back along the path.
+            s.announceToBootstrapExcept(id, netName, false, m, uri, "", msg)
         }
+    case "app-broadcast":
+        s.relayAppBroadcast("", uri, msg)
+    case "peer-disconnected":
+        s.handleRemoteDisconnect("", uri, msg)
+    case "erase-peer":
+        s.handleMeshErase("", uri, msg)
+    case "erase-report":
+        s.handleMeshEraseReport("", uri, msg)
+    case "hub-summary":
+        s.handleHubSummary("", uri, msg)
+    case "gossip-resync":
+        s.handleGossipResync(conn, features, msg)
+    case "presence-update":
+        s.relayPresenceUpdate("", uri, msg)
+    case "mesh-leave":
+        s.handleMeshLeave("", uri, msg)
+    case "hub-pending", "hub-approved":
+        s.handleHubApprovalNotice(uri, msg)
+    case "signal-ack":
+        s.handleSignalAck("", uri, msg)
+    case "peer-message", "message-receipt":
+        s.handleMeshPeerMessage("", uri, msg)
     case "offer", "answer", "ice-candidate":
         if msg.TargetPeer != "" {
-            s.forwardToLocalTarget(msg.TargetPeer, outboundMessage{Type: msg.Type, Data: msg.Data, FromPeerId: msg.FromPeerId, TargetPeer: msg.TargetPeer, NetworkName: msg.NetworkName, Timestamp: nowMs()})
+            if s.opts.SignalingTimeoutMs > 0 && s.getConn(msg.TargetPeer) != nil {
+                s.signaling.observe(msg.Type, msg.FromPeerId, msg.TargetPeer, firstNonEmpty(msg.NetworkName, s.opts.DefaultNetwork))
+            }
+            if s.getConn(msg.TargetPeer) != nil {
+                s.learnSignalRoute(msg.FromPeerId, signalRoute{uri: uri})
+            }
+            s.deliverSignal(msg.TargetPeer, outboundMessage{Type: msg.Type, Data: msg.Data, FromPeerId: msg.FromPeerId, TargetPeer: msg.TargetPeer, NetworkName: msg.NetworkName, Timestamp: nowMs(), MessageId: msg.MessageId, Deadline: msg.Deadline})
         }
     }
 }
 
-func (s *Server) getHubStats() map[string]interface{} {
+// bootstrapLink returns the connection and shared features of a connected
+// bootstrap link.
+func (s *Server) bootstrapLink(uri string) (peerConn, []string) {
     s.bootstrapMu.Lock()
-    bs := make([]map[string]interface{}, 0, len(s.bootstrapConns))
-    for uri, info := range s.bootstrapConns {
-        bs = append(bs, map[string]interface{}{"uri": uri, "connected": info.connected, "lastAttempt": info.lastAttempt, "attemptNumber": info.attemptNum})
+    defer s.bootstrapMu.Unlock()
+    if b := s.bootstrapConns[uri]; b != nil && b.ws != nil {
+        return b.ws, b.features
     }
-    s.bootstrapMu.Unlock()
-    hubs := s.getConnectedHubs()
-    return map[string]interface{}{"totalHubs": len(hubs), "connectedHubs": len(hubs), "hubs": hubs, "bootstrapHubs": bs}
+    return nil, nil
 }
 
-func (s *Server) announceToBootstrap(peerId, netName string, isHub bool, data map[string]interface{}) {
+// recordBootstrapFeatures stores the hub ID, version and feature set the remote hub
+// reported in its "connected" greeting. Hubs that predate feature negotiation
+// send none, so the link falls back to the common baseline.
+func (s *Server) recordBootstrapFeatures(uri string, data interface{}) {
+    m, _ := data.(map[string]interface{})
+    version, _ := m["hubVersion"].(string)
+    hubId, _ := m["hubPeerId"].(string)
+    shared := s.sharedFeatures(featureList(m["features"]))
     s.bootstrapMu.Lock()
-    conns := make([]*websocket.Conn, 0, len(s.bootstrapConns))
-    for _, b := range s.bootstrapConns {
-        if b.connected && b.ws != nil {
-            conns = append(conns, b.ws)
+    if b := s.bootstrapConns[uri]; b != nil {
+        b.version = version
+        b.features = shared
+        b.hubId = hubId
+        if b.ws != nil {
+            s.upgradeMeshLink(b.ws, shared)
         }
     }
     s.bootstrapMu.Unlock()
-
-    hubPeerConns := s.getHubPeerConns("")
-    
-    payload := map[string]interface{}{
-        "type": "peer-discovered",
-        "data": map[string]interface{}{
-            "peerId": peerId,
-            "isHub": isHub,
-        },
-        "networkName": netName,
-        "fromPeerId": "system",
-        "timestamp": nowMs(),
-    }
-    
-    if data != nil {
-        if m, ok := payload["data"].(map[string]interface{}); ok {
-            for k, v := range data {
-                m[k] = v
-            }
-        }
-    }
-    
-    for _, ws := range conns {
-        ws.WriteJSON(payload)
-    }
-    // Also send to hubs that are connected inbound (not represented in bootstrapConns).
-    out := outboundMessage{Type: "peer-discovered", Data: payload["data"], FromPeerId: "system", NetworkName: netName, Timestamp: nowMs()}
-    for _, conn := range hubPeerConns {
-        s.sendToConn(conn, out)
+    s.learnMember(hubId, uri, memberSourceBootstrap)
+    if s.verbose() {
+        s.log.Info("bootstrap_features", map[string]interface{}{"uri": uri, "version": version, "sharedFeatures": shared})
     }
 }
 
-func (s *Server) announceToBootstrapExcept(peerId, netName string, isHub bool, data map[string]interface{}, excludeUri string, excludeHubPeerId string) {
+func (s *Server) getHubStats() map[string]interface{} {
     s.bootstrapMu.Lock()
-    conns := make([]*websocket.Conn, 0, len(s.bootstrapConns))
-    for uri, b := range s.bootstrapConns {
-        if uri != excludeUri && b.connected && b.ws != nil {
-            conns = append(conns, b.ws)
+    bs := make([]map[string]interface{}, 0, len(s.bootstrapConns))
+    for uri, info := range s.bootstrapConns {
+        entry := map[string]interface{}{"uri": uri, "connected": info.connected, "lastAttempt": info.lastAttempt, "attemptNumber": info.attemptNum}
+        if info.incompatible != "" {
+            entry["incompatible"] = info.incompatible
         }
+        if info.version != "" {
+            entry["version"] = info.version
+        }
+        if info.features != nil {
+            entry["sharedFeatures"] = info.features
+        }
+        if info.connected && info.ws != nil {
+            entry["encoding"] = linkEncoding(info.ws)
+        }
+        if info.pending {
+            entry["pendingApproval"] = true
+        }
+        bs = append(bs, entry)
     }
     s.bootstrapMu.Unlock()
+    hubs := s.getConnectedHubs()
+    for i := range hubs {
+        if conn := s.getConn(hubs[i].PeerId); conn != nil {
+            hubs[i].Encoding = linkEncoding(conn)
+        }
+    }
+    return map[string]interface{}{"totalHubs": len(hubs), "connectedHubs": len(hubs), "hubs": hubs, "bootstrapHubs": bs}
+}
 
-    hubPeerConns := s.getHubPeerConns(excludeHubPeerId)
-    
+func (s *Server) announceToBootstrap(peerId, netName string, isHub bool, data map[string]interface{}) {
+    s.announceToBootstrapExcept(peerId, netName, isHub, data, "", "", inboundMessage{})
+}
+
+// announceToBootstrapExcept forwards a peer-discovered across the mesh. via is
+// the mesh message being relayed, if any, whose origin and path are kept.
+func (s *Server) announceToBootstrapExcept(peerId, netName string, isHub bool, data map[string]interface{}, excludeUri string, excludeHubPeerId string, via inboundMessage) {
     payload := map[string]interface{}{
-        "type": "peer-discovered",
-        "data": map[string]interface{}{
-            "peerId": peerId,
-            "isHub": isHub,
-        },
-        "networkName": netName,
-        "fromPeerId": "system",
-        "timestamp": nowMs(),
+        "peerId": peerId,
+        "isHub": isHub,
     }
-    
-    if data != nil {
-        if m, ok := payload["data"].(map[string]interface{}); ok {
-            for k, v := range data {
-                m[k] = v
-            }
-        }
+    for k, v := range data {
+        payload[k] = v
     }
-    
-    for _, ws := range conns {
-        ws.WriteJSON(payload)
+    if via.MessageId == "" && !isHub {
+        if pi := s.getPeerInfo(peerId); pi != nil && pi.Announced {
+            s.stampClaim(payload, pi)
+        }
     }
-    // Also send to hubs that are connected inbound (not represented in bootstrapConns).
-    out := outboundMessage{Type: "peer-discovered", Data: payload["data"], FromPeerId: "system", NetworkName: netName, Timestamp: nowMs()}
-    for _, conn := range hubPeerConns {
-        s.sendToConn(conn, out)
+    out := outboundMessage{Type: "peer-discovered", Data: payload, FromPeerId: "system", NetworkName: netName, Timestamp: nowMs(), MessageId: via.MessageId, OriginHub: via.OriginHub, SeenHubs: via.SeenHubs, Hops: via.Hops}
+    if out.MessageId == "" {
+        out.MessageId = newMessageId()
+        s.markRelayed("peer-discovered:" + out.MessageId)
     }
+    s.forwardToMesh(out, excludeUri, excludeHubPeerId)
 }
 
 func (s *Server) getConnectedHubs() []hubInfo {
@@ -0,0 +1,32 @@
+package server
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+)
+
+func TestProbeBootstrapHealthRejectsProtocolMismatch(t *testing.T) {
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        writeJSON(w, 200, map[string]interface{}{"protocolVersion": ProtocolVersion + 1, "hubMeshNamespace": "pigeonhub-mesh"}, "*")
+    }))
+    defer ts.Close()
+    s := NewServer(Options{HubMeshNamespace: "pigeonhub-mesh"})
+    u, _ := url.Parse("ws" + strings.TrimPrefix(ts.URL, "http") + "/ws")
+    fatal, reason := s.probeBootstrapHealth(u)
+    if !fatal || reason == "" {
+        t.Fatalf("expected fatal incompatibility, got %v %q", fatal, reason)
+    }
+
+    // A hub that does not report a protocol version is assumed compatible.
+    old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        writeJSON(w, 200, map[string]interface{}{"status": "healthy", "isHub": true}, "*")
+    }))
+    defer old.Close()
+    u, _ = url.Parse("ws" + strings.TrimPrefix(old.URL, "http") + "/ws")
+    if fatal, reason := s.probeBootstrapHealth(u); fatal || reason != "" {
+        t.Fatalf("a health response without protocolVersion should pass, got %v %q", fatal, reason)
+    }
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+    "crypto/hmac"
+    "crypto/sha1"
+    "encoding/base64"
+    "errors"
+    "strconv"
+    "strings"
+    "sync/atomic"
+)
+
+// ICE server distribution. The connected greeting carries ICEServers as
+// "iceServers", shaped like WebRTC's RTCIceServer, so clients need no STUN or
+// TURN configuration of their own. With TURNSecret set, every turn: or
+// turns: server listed without a username gets time-limited credentials for
+// each peer, as TURN servers with a shared secret (coturn's
+// use-auth-secret) expect: the username is "<expiry>:<peerId>", expiry in
+// Unix seconds TURNCredentialTTLMs from now, and the credential is the
+// base64 HMAC-SHA1 of the username under the secret. The greeting's
+// "iceServersExpireAt" tells the client when to reconnect for fresh ones.
+// Hub links get no ICE servers.
+
+// ICEServer is one STUN or TURN server offered to peers.
+type ICEServer struct {
+    URLs       []string `json:"urls"`
+    Username   string   `json:"username,omitempty"`
+    Credential string   `json:"credential,omitempty"`
+}
+
+type iceStats struct {
+    greetings int64
+    issued    int64
+}
+
+func isTURN(url string) bool {
+    return strings.HasPrefix(url, "turn:") || strings.HasPrefix(url, "turns:")
+}
+
+func validateICEServers(list []ICEServer) error {
+    for _, srv := range list {
+        if len(srv.URLs) == 0 {
+            return errors.New("each ICE server needs at least one URL")
+        }
+        for _, u := range srv.URLs {
+            if !isTURN(u) && !strings.HasPrefix(u, "stun:") && !strings.HasPrefix(u, "stuns:") {
+                return errors.New("ICE server URL " + u + " must start with stun:, stuns:, turn: or turns:")
+            }
+        }
+    }
+    return nil
+}
+
+// turnCredential derives the shared-secret TURN credential for peerId,
+// valid until expiry (Unix seconds).
+func turnCredential(secret, peerId string, expiry int64) (string, string) {
+    username := strconv.FormatInt(expiry, 10) + ":" + peerId
+    mac := hmac.New(sha1.New, []byte(secret))
+    mac.Write([]byte(username))
+    return username, base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// iceServersFor returns the ICE servers to give peerId and, when any carry
+// generated credentials, when those expire in milliseconds.
+func (s *Server) iceServersFor(peerId string) ([]ICEServer, int64) {
+    if len(s.opts.ICEServers) == 0 {
+        return nil, 0
+    }
+    atomic.AddInt64(&s.ice.greetings, 1)
+    out := make([]ICEServer, 0, len(s.opts.ICEServers))
+    var expiresAt int64
+    for _, srv := range s.opts.ICEServers {
+        srv.URLs = append([]string{}, srv.URLs...)
+        if s.opts.TURNSecret != "" && srv.Username == "" && len(srv.URLs) > 0 && isTURN(srv.URLs[0]) {
+            expiresAt = nowMs() + int64(s.opts.TURNCredentialTTLMs)
+            srv.Username, srv.Credential = turnCredential(s.opts.TURNSecret, peerId, expiresAt/1000)
+            atomic.AddInt64(&s.ice.issued, 1)
+        }
+        out = append(out, srv)
+    }
+    return out, expiresAt
+}
+
+func (s *Server) iceSnapshot() map[string]interface{} {
+    return map[string]interface{}{"servers": len(s.opts.ICEServers), "turn_secret": s.opts.TURNSecret != "", "greetings": atomic.LoadInt64(&s.ice.greetings), "credentials_issued": atomic.LoadInt64(&s.ice.issued)}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+    "crypto/hmac"
+    "crypto/sha1"
+    "encoding/base64"
+    "fmt"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestConnectedGreetingCarriesICEServers(t *testing.T) {
+    s := NewServer(Options{MaxConnections: 10, ICEServers: []ICEServer{{URLs: []string{"stun:stun.example.com:3478"}}, {URLs: []string{"turn:turn.example.com:3478", "turns:turn.example.com:5349"}}}, TURNSecret: "turn-secret", TURNCredentialTTLMs: 60000})
+    gin.SetMode(gin.TestMode)
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    id := randomPeerId()
+    ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?peerId="+id, nil)
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    defer ws.Close()
+    var greeting struct {
+        Type string `json:"type"`
+        Data struct {
+            ICEServers []ICEServer `json:"iceServers"`
+            ExpiresAt  int64       `json:"iceServersExpireAt"`
+        } `json:"data"`
+    }
+    ws.SetReadDeadline(time.Now().Add(time.Second))
+    if err := ws.ReadJSON(&greeting); err != nil || greeting.Type != "connected" {
+        t.Fatalf("expected connected greeting, got %+v (%v)", greeting, err)
+    }
+    servers := greeting.Data.ICEServers
+    if len(servers) != 2 || servers[0].Username != "" || servers[0].Credential != "" {
+        t.Fatalf("STUN server should be passed through unchanged: %+v", servers)
+    }
+    if greeting.Data.ExpiresAt < nowMs()+50000 || greeting.Data.ExpiresAt > nowMs()+60000 {
+        t.Fatalf("credentials should expire about a minute from now, got %d", greeting.Data.ExpiresAt)
+    }
+    turn := servers[1]
+    if turn.Username != fmt.Sprintf("%d:%s", greeting.Data.ExpiresAt/1000, id) {
+        t.Fatalf("unexpected TURN username %q", turn.Username)
+    }
+    mac := hmac.New(sha1.New, []byte("turn-secret"))
+    mac.Write([]byte(turn.Username))
+    if turn.Credential != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+        t.Fatalf("TURN credential is not the HMAC of the username")
+    }
+    if err := (Options{ICEServers: []ICEServer{{URLs: []string{"http://turn.example.com"}}}}).Validate(); err == nil {
+        t.Fatalf("non-ICE URL should fail validation")
+    }
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "strconv"
+    "sync"
+    "time"
+    "github.com/gorilla/websocket"
+)
+
+const errSenderMismatch = "sender-mismatch"
+
+// identityStore binds peer IDs to ed25519 public keys on first registration
+// and persists the bindings so reservations survive hub restarts.
+type identityStore struct {
+    store Store
+    key   string
+    mu    sync.Mutex
+    keys  map[string]string
+}
+
+func newIdentityStore(store Store, key string) *identityStore {
+    st := &identityStore{store: store, key: key, keys: map[string]string{}}
+    if b, err := store.Load(key); err == nil && b != nil {
+        json.Unmarshal(b, &st.keys)
+    }
+    return st
+}
+
+func (st *identityStore) lookup(peerId string) ed25519.PublicKey {
+    st.mu.Lock()
+    enc := st.keys[peerId]
+    st.mu.Unlock()
+    if enc == "" {
+        return nil
+    }
+    k, err := base64.StdEncoding.DecodeString(enc)
+    if err != nil || len(k) != ed25519.PublicKeySize {
+        return nil
+    }
+    return ed25519.PublicKey(k)
+}
+
+func (st *identityStore) bind(peerId string, pub ed25519.PublicKey) error {
+    enc := base64.StdEncoding.EncodeToString(pub)
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    if cur, ok := st.keys[peerId]; ok {
+        if cur != enc {
+            return errors.New("peerId already reserved by another key")
+        }
+        return nil
+    }
+    st.keys[peerId] = enc
+    return st.saveLocked()
+}
+
+func (st *identityStore) saveLocked() error {
+    b, err := json.MarshalIndent(st.keys, "", "  ")
+    if err != nil {
+        return err
+    }
+    return st.store.Save(st.key, b)
+}
+
+// verifyPeerOwnership challenges a connection claiming a reserved peerId to
+// sign a random nonce with the bound key. Unreserved IDs pass unchallenged.
+func (s *Server) verifyPeerOwnership(peerId string, conn *websocket.Conn) bool {
+    if s.identities == nil {
+        return true
+    }
+    pub := s.identities.lookup(peerId)
+    if pub == nil {
+        return true
+    }
+    nb := make([]byte, 32)
+    if _, err := rand.Read(nb); err != nil {
+        return false
+    }
+    nonce := hex.EncodeToString(nb)
+    s.sendToConn(conn, outboundMessage{Type: "challenge", Data: map[string]interface{}{"nonce": nonce}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+    conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+    defer conn.SetReadDeadline(time.Time{})
+    _, data, err := conn.ReadMessage()
+    if err != nil {
+        return false
+    }
+    var msg inboundMessage
+    if err := json.Unmarshal(data, &msg); err != nil || msg.Type != "challenge-response" {
+        return false
+    }
+    sig := decodeSignature(msg.Data)
+    return sig != nil && ed25519.Verify(pub, []byte(nonce), sig)
+}
+
+// handleRegister binds the sender's peerId to the supplied public key. The
+// request must carry a signature over the peerId to prove key possession.
+func (s *Server) handleRegister(peerId string, msg inboundMessage) {
+    conn := s.getConn(peerId)
+    if s.identities == nil {
+        s.sendError(conn, peerId, "registration disabled")
+        return
+    }
+    m, _ := msg.Data.(map[string]interface{})
+    enc, _ := m["publicKey"].(string)
+    k, err := base64.StdEncoding.DecodeString(enc)
+    if err != nil || len(k) != ed25519.PublicKeySize {
+        s.sendError(conn, peerId, "invalid publicKey")
+        return
+    }
+    pub := ed25519.PublicKey(k)
+    sig := decodeSignature(msg.Data)
+    if sig == nil || !ed25519.Verify(pub, []byte(peerId), sig) {
+        s.sendError(conn, peerId, "invalid signature")
+        return
+    }
+    if err := s.identities.bind(peerId, pub); err != nil {
+        s.sendError(conn, peerId, err.Error())
+        return
+    }
+    s.sendToConn(conn, outboundMessage{Type: "registered", Data: map[string]interface{}{"peerId": peerId}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+}
+
+func (s *Server) sendError(conn peerConn, peerId, message string) {
+    s.sendToConn(conn, outboundMessage{Type: "error", Data: map[string]interface{}{"message": message}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+}
+
+func decodeSignature(data interface{}) []byte {
+    m, ok := data.(map[string]interface{})
+    if !ok {
+        return nil
+    }
+    enc, _ := m["signature"].(string)
+    sig, err := base64.StdEncoding.DecodeString(enc)
+    if err != nil || len(sig) != ed25519.SignatureSize {
+        return nil
+    }
+    return sig
+}
+
+// envelopeWindow is how far a signed envelope's timestamp may be from the
+// hub's clock. Older envelopes are refused outright, so a messageId only has
+// to be remembered until its envelope would be refused anyway.
+const envelopeWindow = 30 * time.Second
+
+// signedEnvelopes remembers the signed envelopes accepted within
+// envelopeWindow, by fromPeerId and messageId.
+type signedEnvelopes struct {
+    mu   sync.Mutex
+    seen map[string]int64
+}
+
+func newSignedEnvelopes() *signedEnvelopes {
+    return &signedEnvelopes{seen: map[string]int64{}}
+}
+
+// accept reports whether key has not been seen, remembering it until expires.
+func (e *signedEnvelopes) accept(key string, expires int64) bool {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if _, ok := e.seen[key]; ok {
+        return false
+    }
+    e.seen[key] = expires
+    return true
+}
+
+// expire forgets envelopes whose timestamp is now outside the window.
+func (e *signedEnvelopes) expire(now int64) {
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    for key, expires := range e.seen {
+        if now > expires {
+            delete(e.seen, key)
+        }
+    }
+}
+
+// envelopeSigningInput is what a peer signs to send a message on behalf of
+// another registered peer ID: type, fromPeerId, targetPeerId, messageId,
+// networkName and timestamp on separate lines, followed by the exact bytes of
+// the "data" field.
+func envelopeSigningInput(msg inboundMessage, timestamp int64, rawData []byte) []byte {
+    head := msg.Type + "\n" + msg.FromPeerId + "\n" + msg.TargetPeer + "\n" + msg.MessageId + "\n" + msg.NetworkName + "\n" + strconv.FormatInt(timestamp, 10) + "\n"
+    return append([]byte(head), rawData...)
+}
+
+// verifyEnvelope checks the top-level signature of a message whose
+// fromPeerId differs from the connection's peer against the key registered
+// for fromPeerId. A messageId is required, the timestamp must be within
+// envelopeWindow of now, and each messageId is accepted once.
+func (s *Server) verifyEnvelope(raw []byte, msg inboundMessage) bool {
+    if s.identities == nil || msg.Signature == "" || msg.MessageId == "" {
+        return false
+    }
+    pub := s.identities.lookup(msg.FromPeerId)
+    if pub == nil {
+        return false
+    }
+    sig, err := base64.StdEncoding.DecodeString(msg.Signature)
+    if err != nil || len(sig) != ed25519.SignatureSize {
+        return false
+    }
+    // The network is checked as sent, before the hub defaults or resolves it.
+    var env struct {
+        Data        json.RawMessage `json:"data"`
+        NetworkName string          `json:"networkName"`
+        Timestamp   int64           `json:"timestamp"`
+    }
+    if json.Unmarshal(raw, &env) != nil {
+        return false
+    }
+    now, window := nowMs(), envelopeWindow.Milliseconds()
+    if env.Timestamp < now-window || env.Timestamp > now+window {
+        return false
+    }
+    signed := msg
+    signed.NetworkName = env.NetworkName
+    if !ed25519.Verify(pub, envelopeSigningInput(signed, env.Timestamp, env.Data), sig) {
+        return false
+    }
+    return s.envelopes.accept(msg.FromPeerId+":"+msg.MessageId, env.Timestamp+window)
+}
+
+// checkSender enforces that a client only speaks as its own peer ID. A
+// mismatched fromPeerId is accepted only with a valid envelope signature;
+// otherwise the message is refused with a sender-mismatch error and counted.
+func (s *Server) checkSender(peerId string, raw []byte, msg inboundMessage) bool {
+    if msg.FromPeerId == "" || msg.FromPeerId == peerId || s.verifyEnvelope(raw, msg) {
+        return true
+    }
+    s.spoofMu.Lock()
+    s.spoofAttempts[msg.Type]++
+    s.spoofMu.Unlock()
+    s.log.Warn("sender_mismatch", map[string]interface{}{"peerId": peerId, "claimedFromPeerId": msg.FromPeerId, "type": msg.Type})
+    s.sendToConn(s.getConn(peerId), outboundMessage{Type: "error", Data: map[string]interface{}{"code": errSenderMismatch, "message": "fromPeerId does not match this connection's peerId", "type": msg.Type, "fromPeerId": msg.FromPeerId}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+    s.penalize(peerId, offenceSpoof, msg.Type)
+    return false
+}
+
+func (s *Server) spoofSnapshot() map[string]interface{} {
+    s.spoofMu.Lock()
+    defer s.spoofMu.Unlock()
+    total := int64(0)
+    byType := map[string]int64{}
+    for t, n := range s.spoofAttempts {
+        total += n
+        byType[t] = n
+    }
+    return map[string]interface{}{"total": total, "by_type": byType}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+    "crypto/ed25519"
+    "encoding/base64"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestIdentityStorePersistsFirstBinding(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "identities.json")
+    pub, _, _ := ed25519.GenerateKey(nil)
+    other, _, _ := ed25519.GenerateKey(nil)
+    id := "0123456789abcdef0123456789abcdef01234567"
+    if err := newIdentityStore(fileStore{}, path).bind(id, pub); err != nil {
+        t.Fatalf("bind: %v", err)
+    }
+    st := newIdentityStore(fileStore{}, path)
+    if !st.lookup(id).Equal(pub) {
+        t.Fatalf("binding not persisted")
+    }
+    if err := st.bind(id, other); err == nil {
+        t.Fatalf("expected rebinding to a different key to fail")
+    }
+}
+
+func TestSenderMismatchRejectedUnlessSigned(t *testing.T) {
+    s := NewServer(Options{IdentityStorePath: "identities", Store: &memStore{docs: map[string][]byte{}}})
+    a, b, victim := randomPeerId(), randomPeerId(), randomPeerId()
+    conns := attachTestPeers(t, s, a, b)
+    for _, id := range []string{a, b} {
+        s.peerData[id].Announced = true
+    }
+    s.handleMessage(a, []byte(`{"type":"offer","fromPeerId":"`+victim+`","targetPeerId":"`+b+`","data":{"sdp":"spoofed"}}`))
+    if msgs, _ := conns[b].take(20 * time.Millisecond); len(msgs) != 0 {
+        t.Fatalf("spoofed offer should not be delivered, got %s", msgs)
+    }
+    if msgs, _ := conns[a].take(time.Second); len(msgs) != 1 || !strings.Contains(string(msgs[0]), errSenderMismatch) {
+        t.Fatalf("spoofer should get a %s error, got %s", errSenderMismatch, msgs)
+    }
+
+    // A registered peer can authorize another connection to send for it.
+    pub, priv, _ := ed25519.GenerateKey(nil)
+    s.identities.bind(victim, pub)
+    data := `{"sdp":"delegated"}`
+    envelope := func(messageId, netName string, ts int64, signedNet string) string {
+        msg := inboundMessage{Type: "offer", FromPeerId: victim, TargetPeer: b, MessageId: messageId, NetworkName: signedNet}
+        sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, envelopeSigningInput(msg, ts, []byte(data))))
+        return `{"type":"offer","fromPeerId":"` + victim + `","targetPeerId":"` + b + `","networkName":"` + netName + `","messageId":"` + messageId + `","timestamp":` + strconv.FormatInt(ts, 10) + `,"signature":"` + sig + `","data":` + data + `}`
+    }
+    signed := envelope("m1", "global", nowMs(), "global")
+    s.handleMessage(a, []byte(signed))
+    if msgs, _ := conns[b].take(time.Second); len(msgs) != 1 || !strings.Contains(string(msgs[0]), `"fromPeerId":"`+victim+`"`) {
+        t.Fatalf("signed envelope should be delivered as %s, got %s", victim[:8], msgs)
+    }
+    s.handleMessage(a, []byte(signed))
+    if msgs, _ := conns[b].take(20 * time.Millisecond); len(msgs) != 0 {
+        t.Fatalf("replayed signed envelope should be refused, got %s", msgs)
+    }
+
+    // A replay stays refused after the short-lived relay cache is pruned,
+    // and stale or re-addressed envelopes never verify.
+    s.relayMu.Lock()
+    s.relayed = map[string]int64{}
+    s.relayMu.Unlock()
+    s.performCleanup()
+    refused := map[string]string{
+        "replay after pruning": signed,
+        "stale timestamp":      envelope("m2", "global", nowMs()-2*envelopeWindow.Milliseconds(), "global"),
+        "future timestamp":     envelope("m3", "global", nowMs()+2*envelopeWindow.Milliseconds(), "global"),
+        "changed network":      envelope("m4", "global", nowMs(), "other"),
+    }
+    for name, raw := range refused {
+        s.handleMessage(a, []byte(raw))
+        if msgs, _ := conns[b].take(20 * time.Millisecond); len(msgs) != 0 {
+            t.Fatalf("%s: envelope should be refused, got %s", name, msgs)
+        }
+    }
+    if snap := s.spoofSnapshot(); snap["total"] != int64(2+len(refused)) || snap["by_type"].(map[string]int64)["offer"] != int64(2+len(refused)) {
+        t.Fatalf("unexpected spoof counters %v", snap)
+    }
+}
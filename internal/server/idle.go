@@ -0,0 +1,284 @@
+package server
+
+import (
+    "sort"
+    "sync"
+    "sync/atomic"
+    "time"
+)
+
+// Peer inactivity. An announced peer that has sent nothing but keepalive
+// pings for PeerIdleMs is marked idle, without being disconnected; a peer
+// watching it gets peer-idle, and peer-active as soon as it sends anything
+// again. Watchers name the peers they follow:
+//
+//     {"type": "watch-peers", "data": {"peerIds": ["<peer-id>", ...]}}
+//     {"type": "unwatch-peers", "data": {"peerIds": ["<peer-id>"]}}
+//
+// and are answered with "watching" listing every peer they watch. Only
+// peers on this hub and on the watcher's network are reported, hidden peers
+// never are, and a watch outlives the watched peer's disconnects but not the
+// watcher's.
+const (
+    errWatchDisabled = "watch-disabled"
+    errWatchPeer     = "invalid-peer-id"
+    errWatchLimit    = "watch-limit"
+
+    maxWatchedPeers = 256
+)
+
+type watchRegistry struct {
+    mu sync.Mutex
+    // watching maps a watcher to the peers it watches; watchers is the
+    // reverse.
+    watching map[string]map[string]struct{}
+    watchers map[string]map[string]struct{}
+    idle     int64
+    active   int64
+}
+
+func newWatchRegistry() *watchRegistry {
+    return &watchRegistry{watching: map[string]map[string]struct{}{}, watchers: map[string]map[string]struct{}{}}
+}
+
+// watch adds ids to watcher's watches and returns those that were new, or
+// ok false when that would exceed the limit.
+func (r *watchRegistry) watch(watcher string, ids []string) (added []string, ok bool) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    cur := r.watching[watcher]
+    if cur == nil {
+        cur = map[string]struct{}{}
+    }
+    for _, id := range ids {
+        if _, have := cur[id]; !have {
+            added = append(added, id)
+        }
+    }
+    if len(cur)+len(added) > maxWatchedPeers {
+        return nil, false
+    }
+    r.watching[watcher] = cur
+    for _, id := range added {
+        cur[id] = struct{}{}
+        set := r.watchers[id]
+        if set == nil {
+            set = map[string]struct{}{}
+            r.watchers[id] = set
+        }
+        set[watcher] = struct{}{}
+    }
+    return added, true
+}
+
+// unwatch drops ids from watcher's watches, or all of them when ids is
+// empty.
+func (r *watchRegistry) unwatch(watcher string, ids []string) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    cur := r.watching[watcher]
+    if len(ids) == 0 {
+        for id := range cur {
+            ids = append(ids, id)
+        }
+    }
+    for _, id := range ids {
+        delete(cur, id)
+        if set := r.watchers[id]; set != nil {
+            delete(set, watcher)
+            if len(set) == 0 {
+                delete(r.watchers, id)
+            }
+        }
+    }
+    if len(cur) == 0 {
+        delete(r.watching, watcher)
+    }
+}
+
+func (r *watchRegistry) watchedBy(watcher string) []string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    out := make([]string, 0, len(r.watching[watcher]))
+    for id := range r.watching[watcher] {
+        out = append(out, id)
+    }
+    sort.Strings(out)
+    return out
+}
+
+func (r *watchRegistry) watchersOf(id string) []string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    out := make([]string, 0, len(r.watchers[id]))
+    for w := range r.watchers[id] {
+        out = append(out, w)
+    }
+    return out
+}
+
+func (s *Server) rejectWatch(peerId, code, message string) {
+    s.sendToConn(s.getConn(peerId), outboundMessage{Type: "error", Data: map[string]interface{}{"code": code, "message": message}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+}
+
+func (s *Server) sendWatching(peerId, netName string) {
+    s.sendToConn(s.getConn(peerId), outboundMessage{Type: "watching", Data: map[string]interface{}{"peerIds": s.watches.watchedBy(peerId)}, FromPeerId: "system", TargetPeer: peerId, NetworkName: netName, Timestamp: nowMs()})
+}
+
+// handleWatchPeers adds to an announced peer's watches and sends peer-idle
+// at once for watched peers that are already idle.
+func (s *Server) handleWatchPeers(peerId string, msg inboundMessage) {
+    if s.opts.PeerIdleMs <= 0 {
+        s.rejectWatch(peerId, errWatchDisabled, "peer idle tracking is disabled")
+        return
+    }
+    pi := s.getPeerInfo(peerId)
+    if pi == nil || !pi.Announced || pi.IsHub {
+        s.rejectWatch(peerId, errNotAnnounced, "announce before watching peers")
+        return
+    }
+    m, _ := msg.Data.(map[string]interface{})
+    ids := featureList(m["peerIds"])
+    if len(ids) == 0 {
+        s.rejectWatch(peerId, errWatchPeer, "peerIds required")
+        return
+    }
+    for _, id := range ids {
+        if !validatePeerId(id) || id == peerId {
+            s.rejectWatch(peerId, errWatchPeer, "invalid peer ID "+id)
+            return
+        }
+    }
+    added, ok := s.watches.watch(peerId, ids)
+    if !ok {
+        s.rejectWatch(peerId, errWatchLimit, "watch limit reached")
+        return
+    }
+    netName := firstNonEmpty(pi.NetworkName, s.opts.DefaultNetwork)
+    s.sendWatching(peerId, netName)
+    for _, id := range added {
+        if wp := s.getPeerInfo(id); wp != nil && wp.Idle {
+            s.notifyWatcher(peerId, netName, wp, "peer-idle", nowMs())
+        }
+    }
+}
+
+// handleUnwatchPeers drops the given watches, or all of them when none are
+// given.
+func (s *Server) handleUnwatchPeers(peerId string, msg inboundMessage) {
+    m, _ := msg.Data.(map[string]interface{})
+    s.watches.unwatch(peerId, featureList(m["peerIds"]))
+    netName := msg.NetworkName
+    if pi := s.getPeerInfo(peerId); pi != nil {
+        netName = firstNonEmpty(pi.NetworkName, netName)
+    }
+    s.sendWatching(peerId, firstNonEmpty(netName, s.opts.DefaultNetwork))
+}
+
+// notifyWatcher sends watcher a peer-idle or peer-active about wp when both
+// are on netName and wp is visible.
+func (s *Server) notifyWatcher(watcher, netName string, wp *peerInfo, event string, now int64) {
+    if wp.IsHub || !wp.Announced || hiddenPeer(wp.Data) || firstNonEmpty(wp.NetworkName, s.opts.DefaultNetwork) != netName {
+        return
+    }
+    data := map[string]interface{}{"peerId": wp.PeerId, "lastActivity": wp.LastActivity, "idleMs": now - wp.LastActivity}
+    if s.sendToConn(s.getConn(watcher), outboundMessage{Type: event, Data: data, FromPeerId: "system", TargetPeer: watcher, NetworkName: netName, Timestamp: now}) {
+        if event == "peer-idle" {
+            atomic.AddInt64(&s.watches.idle, 1)
+        } else {
+            atomic.AddInt64(&s.watches.active, 1)
+        }
+    }
+}
+
+// notifyWatchers tells peerId's watchers it went idle or became active
+// again. For peer-active, wp.LastActivity is still the time it went quiet.
+func (s *Server) notifyWatchers(wp *peerInfo, event string) {
+    watchers := s.watches.watchersOf(wp.PeerId)
+    if len(watchers) == 0 {
+        return
+    }
+    now := nowMs()
+    for _, w := range watchers {
+        if pi := s.getPeerInfo(w); pi != nil && pi.Announced {
+            s.notifyWatcher(w, firstNonEmpty(pi.NetworkName, s.opts.DefaultNetwork), wp, event, now)
+        }
+    }
+}
+
+// markActive clears a peer's idle mark when it sends something other than a
+// keepalive ping, and tells its watchers if it was idle. Called with
+// peersMu held; the notification goes out after it is released.
+func (s *Server) markActive(pi *peerInfo, msgType string) func() {
+    if msgType == "ping" {
+        return nil
+    }
+    if !pi.Idle {
+        pi.LastActivity = nowMs()
+        return nil
+    }
+    was := *pi
+    pi.Idle = false
+    pi.LastActivity = nowMs()
+    return func() { s.notifyWatchers(&was, "peer-active") }
+}
+
+// sweepIdle marks announced peers quiet for PeerIdleMs as idle and tells
+// their watchers.
+func (s *Server) sweepIdle(now int64) {
+    idle := []peerInfo{}
+    s.peersMu.Lock()
+    for _, pi := range s.peerData {
+        if pi.Announced && !pi.IsHub && !pi.Idle && now-pi.LastActivity >= int64(s.opts.PeerIdleMs) {
+            pi.Idle = true
+            idle = append(idle, *pi)
+        }
+    }
+    s.peersMu.Unlock()
+    for i := range idle {
+        s.notifyWatchers(&idle[i], "peer-idle")
+    }
+}
+
+// runIdleSweeper checks for idle peers every quarter of PeerIdleMs, and at
+// least once a second.
+func (s *Server) runIdleSweeper() {
+    interval := time.Duration(s.opts.PeerIdleMs/4) * time.Millisecond
+    if interval > time.Second {
+        interval = time.Second
+    }
+    if interval < 10*time.Millisecond {
+        interval = 10 * time.Millisecond
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for range ticker.C {
+        if !s.running {
+            return
+        }
+        s.sweepIdle(nowMs())
+    }
+}
+
+func (s *Server) idleSnapshot() map[string]interface{} {
+    idle := 0
+    s.peersMu.Lock()
+    for _, pi := range s.peerData {
+        if pi.Idle {
+            idle++
+        }
+    }
+    s.peersMu.Unlock()
+    r := s.watches
+    r.mu.Lock()
+    watchers, watched := len(r.watching), len(r.watchers)
+    r.mu.Unlock()
+    return map[string]interface{}{
+        "idle_ms":       s.opts.PeerIdleMs,
+        "idle_peers":    idle,
+        "watchers":      watchers,
+        "watched_peers": watched,
+        "idle_sent":     atomic.LoadInt64(&r.idle),
+        "active_sent":   atomic.LoadInt64(&r.active),
+    }
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestIdlePeersAreReapedOnCleanup(t *testing.T) {
+    s := NewServer(Options{MaxConnections: 10, PeerTimeoutMs: 1000})
+    gin.SetMode(gin.TestMode)
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    id := randomPeerId()
+    c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?peerId="+id, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer c.Close()
+    waitFor(t, "the peer to register", func() bool { return s.getConn(id) != nil })
+    s.performCleanup()
+    if s.getConn(id) == nil {
+        t.Fatalf("a fresh connection should not be reaped")
+    }
+    atomic.StoreInt64(&s.getConn(id).(*wsPeerConn).alive, nowMs()-2000)
+    s.performCleanup()
+    if s.getConn(id) != nil || s.keepaliveSnapshot()["idle_reaped"] != int64(1) {
+        t.Fatalf("a silent connection should be reaped")
+    }
+}
+
+func TestWatchersHearPeerIdleAndActive(t *testing.T) {
+    s := NewServer(Options{PeerIdleMs: 60000})
+    a, b, c := randomPeerId(), randomPeerId(), randomPeerId()
+    conns := map[string]*pollConn{}
+    for id, netName := range map[string]string{a: "game", b: "game", c: "other"} {
+        conns[id] = attachTestPeer(t, s, id)
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"`+netName+`","data":{}}`))
+    }
+    received := func(id string) []outboundMessage {
+        msgs, _ := conns[id].take(20 * time.Millisecond)
+        var out []outboundMessage
+        for _, raw := range msgs {
+            var m outboundMessage
+            json.Unmarshal(raw, &m)
+            if m.Type != "peer-discovered" {
+                out = append(out, m)
+            }
+        }
+        return out
+    }
+    for _, id := range []string{a, b, c} {
+        received(id)
+    }
+
+    s.handleMessage(a, []byte(`{"type":"watch-peers","data":{"peerIds":["`+b+`","`+c+`"]}}`))
+    if got := received(a); len(got) != 1 || got[0].Type != "watching" || len(got[0].Data.(map[string]interface{})["peerIds"].([]interface{})) != 2 {
+        t.Fatalf("a should be watching b and c, got %+v", got)
+    }
+    s.handleMessage(a, []byte(`{"type":"watch-peers","data":{"peerIds":["`+a+`"]}}`))
+    if got := received(a); len(got) != 1 || got[0].Data.(map[string]interface{})["code"] != errWatchPeer {
+        t.Fatalf("watching yourself should be refused, got %+v", got)
+    }
+
+    last := s.getPeerInfo(b).LastActivity
+    time.Sleep(2 * time.Millisecond)
+    s.handleMessage(b, []byte(`{"type":"ping"}`))
+    if pi := s.getPeerInfo(b); pi.LastActivity != last {
+        t.Fatalf("a keepalive ping should not count as activity")
+    }
+    s.sweepIdle(nowMs() + 60000)
+    if got := received(a); len(got) != 1 || got[0].Type != "peer-idle" || got[0].Data.(map[string]interface{})["peerId"] != b {
+        t.Fatalf("a should hear b go idle, and nothing of c on another network, got %+v", got)
+    }
+    s.sweepIdle(nowMs() + 60000)
+    if got := received(a); len(got) != 0 {
+        t.Fatalf("an idle peer should be reported once, got %+v", got)
+    }
+    received(b)
+    s.handleMessage(b, []byte(`{"type":"room-members","data":{"room":"lobby"}}`))
+    if got := received(a); len(got) != 1 || got[0].Type != "peer-active" || got[0].Data.(map[string]interface{})["peerId"] != b {
+        t.Fatalf("a should hear b become active, got %+v", got)
+    }
+
+    s.sweepIdle(nowMs() + 60000)
+    received(a)
+    s.handleMessage(a, []byte(`{"type":"unwatch-peers","data":{}}`))
+    s.handleMessage(a, []byte(`{"type":"watch-peers","data":{"peerIds":["`+b+`"]}}`))
+    if got := received(a); len(got) != 3 || got[1].Type != "watching" || got[2].Type != "peer-idle" {
+        t.Fatalf("watching an idle peer should report it at once, got %+v", got)
+    }
+    if snap := s.idleSnapshot(); snap["watchers"] != 1 || snap["watched_peers"] != 1 || snap["idle_sent"] != int64(3) || snap["active_sent"] != int64(1) {
+        t.Fatalf("unexpected idle stats: %v", snap)
+    }
+    s.handleDisconnect(a, reasonClientGoodbye, "")
+    if snap := s.idleSnapshot(); snap["watchers"] != 0 || snap["watched_peers"] != 0 {
+        t.Fatalf("a's watches should be gone, got %v", snap)
+    }
+
+    off := NewServer(Options{})
+    off.wsConns[a] = conns[a]
+    off.peerData[a] = &peerInfo{PeerId: a, Connected: true}
+    off.handleMessage(a, []byte(`{"type":"watch-peers","data":{"peerIds":["`+b+`"]}}`))
+    if got := received(a); len(got) != 1 || got[0].Data.(map[string]interface{})["code"] != errWatchDisabled {
+        t.Fatalf("watching should be refused when idle tracking is off, got %+v", got)
+    }
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/url"
+    "sort"
+    "sync"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+// Integration kinds.
+const (
+    integrationWebhook    = "webhook"
+    integrationBridge     = "bridge"
+    integrationAuthorizer = "authorizer"
+)
+
+const integrationTimeout = 3 * time.Second
+
+// integration is an HTTP endpoint attached to one network. Webhooks receive
+// peer lifecycle events, bridges receive the network's app-broadcasts, and
+// authorizers are asked to approve each announce.
+type integration struct {
+    Id          string   `json:"id"`
+    NetworkName string   `json:"networkName"`
+    Kind        string   `json:"kind"`
+    URL         string   `json:"url"`
+    Events      []string `json:"events,omitempty"`
+    Secret      string   `json:"secret,omitempty"`
+    CreatedAt   int64    `json:"createdAt"`
+}
+
+// integrationRegistry holds integrations by id and, when key is set,
+// persists them to the Store so they survive hub restarts.
+type integrationRegistry struct {
+    store Store
+    key   string
+    mu    sync.Mutex
+    items map[string]*integration
+}
+
+func newIntegrationRegistry(store Store, key string) *integrationRegistry {
+    r := &integrationRegistry{store: store, key: key, items: map[string]*integration{}}
+    if key != "" {
+        if b, err := store.Load(key); err == nil && b != nil {
+            json.Unmarshal(b, &r.items)
+        }
+    }
+    return r
+}
+
+func (r *integrationRegistry) saveLocked() error {
+    if r.key == "" {
+        return nil
+    }
+    b, err := json.MarshalIndent(r.items, "", "  ")
+    if err != nil {
+        return err
+    }
+    return r.store.Save(r.key, b)
+}
+
+func (r *integrationRegistry) add(in *integration) error {
+    switch in.Kind {
+    case integrationWebhook, integrationBridge, integrationAuthorizer:
+    default:
+        return errors.New("kind must be webhook, bridge or authorizer")
+    }
+    if u, err := url.Parse(in.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+        return errors.New("url must be an absolute http(s) URL")
+    }
+    in.NetworkName = firstNonEmpty(in.NetworkName, "global")
+    in.Id = newMessageId()
+    in.CreatedAt = nowMs()
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.items[in.Id] = in
+    return r.saveLocked()
+}
+
+func (r *integrationRegistry) remove(id string) (bool, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if _, ok := r.items[id]; !ok {
+        return false, nil
+    }
+    delete(r.items, id)
+    return true, r.saveLocked()
+}
+
+// list returns integrations for netName (all networks when empty) and kind
+// (all kinds when empty), sorted by creation time.
+func (r *integrationRegistry) list(netName, kind string) []integration {
+    r.mu.Lock()
+    out := []integration{}
+    for _, in := range r.items {
+        if (netName == "" || in.NetworkName == netName) && (kind == "" || in.Kind == kind) {
+            out = append(out, *in)
+        }
+    }
+    r.mu.Unlock()
+    sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt < out[j].CreatedAt })
+    return out
+}
+
+func (in integration) wants(event string) bool {
+    if len(in.Events) == 0 {
+        return true
+    }
+    for _, e := range in.Events {
+        if e == event {
+            return true
+        }
+    }
+    return false
+}
+
+// post sends body to the integration, signing it with HMAC-SHA256 of the
+// secret in X-PeerPigeon-Signature when one is configured.
+func (in integration) post(body map[string]interface{}) (*http.Response, error) {
+    b, err := json.Marshal(body)
+    if err != nil {
+        return nil, err
+    }
+    req, err := http.NewRequest("POST", in.URL, bytes.NewReader(b))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if in.Secret != "" {
+        mac := hmac.New(sha256.New, []byte(in.Secret))
+        mac.Write(b)
+        req.Header.Set("X-PeerPigeon-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+    }
+    client := http.Client{Timeout: integrationTimeout}
+    return client.Do(req)
+}
+
+// notifyIntegrations delivers event to every webhook (or bridge) registered
+// for netName without blocking the caller.
+func (s *Server) notifyIntegrations(kind, netName, event string, data map[string]interface{}) {
+    for _, in := range s.integrations.list(netName, kind) {
+        if !in.wants(event) {
+            continue
+        }
+        in := in
+        body := map[string]interface{}{"event": event, "networkName": netName, "hubPeerId": s.hubPeerId, "timestamp": nowMs(), "data": data}
+        s.spawn("integration", in.Id, func() {
+            resp, err := in.post(body)
+            if err != nil {
+                s.log.Warn("integration_failed", map[string]interface{}{"integration": in.Id, "event": event, "error": err.Error()})
+                return
+            }
+            resp.Body.Close()
+        })
+    }
+}
+
+// authorizeAnnounce asks the network's authorizers whether peerId may join.
+// Every authorizer must answer 2xx; an unreachable authorizer denies.
+func (s *Server) authorizeAnnounce(peerId, netName string, data interface{}) bool {
+    for _, in := range s.integrations.list(netName, integrationAuthorizer) {
+        resp, err := in.post(map[string]interface{}{"event": "announce", "networkName": netName, "peerId": peerId, "timestamp": nowMs(), "data": data})
+        if err != nil {
+            s.log.Warn("integration_failed", map[string]interface{}{"integration": in.Id, "event": "announce", "error": err.Error()})
+            return false
+        }
+        resp.Body.Close()
+        if resp.StatusCode < 200 || resp.StatusCode > 299 {
+            return false
+        }
+    }
+    return true
+}
+
+func (s *Server) adminListIntegrations(c *gin.Context) {
+    items := s.integrations.list(c.Query("network"), c.Query("kind"))
+    for i := range items {
+        items[i].Secret = ""
+    }
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"integrations": items}, s.opts.CORSOrigin)
+}
+
+func (s *Server) adminAddIntegration(c *gin.Context) {
+    var in integration
+    if err := json.NewDecoder(c.Request.Body).Decode(&in); err != nil {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "invalid JSON body"}, s.opts.CORSOrigin)
+        return
+    }
+    netName, ok := s.resolveNetwork(in.NetworkName)
+    if !ok {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "invalid or unpermitted networkName"}, s.opts.CORSOrigin)
+        return
+    }
+    in.NetworkName = netName
+    if err := s.integrations.add(&in); err != nil {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": err.Error()}, s.opts.CORSOrigin)
+        return
+    }
+    s.audit(c, "integration-add", map[string]interface{}{"id": in.Id, "networkName": in.NetworkName, "kind": in.Kind, "url": in.URL})
+    writeJSON(c.Writer, http.StatusOK, in, s.opts.CORSOrigin)
+}
+
+func (s *Server) adminRemoveIntegration(c *gin.Context) {
+    id := c.Param("id")
+    ok, err := s.integrations.remove(id)
+    if err != nil {
+        writeJSON(c.Writer, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()}, s.opts.CORSOrigin)
+        return
+    }
+    if !ok {
+        writeJSON(c.Writer, http.StatusNotFound, map[string]interface{}{"error": "unknown integration"}, s.opts.CORSOrigin)
+        return
+    }
+    s.audit(c, "integration-remove", map[string]interface{}{"id": id})
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"removed": id}, s.opts.CORSOrigin)
+}
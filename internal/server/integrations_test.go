@@ -0,0 +1,49 @@
+package server
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "testing"
+)
+
+func TestIntegrationsPersistAndAuthorize(t *testing.T) {
+    deny := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("X-PeerPigeon-Signature") == "" {
+            t.Errorf("expected signed request")
+        }
+        w.WriteHeader(http.StatusForbidden)
+    }))
+    defer deny.Close()
+    path := filepath.Join(t.TempDir(), "integrations.json")
+    s := NewServer(Options{IntegrationsStorePath: path})
+    if err := s.integrations.add(&integration{NetworkName: "team-a", Kind: integrationAuthorizer, URL: deny.URL, Secret: "k"}); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.integrations.add(&integration{Kind: "ftp", URL: deny.URL}); err == nil {
+        t.Fatalf("unknown kind should be rejected")
+    }
+    if s.authorizeAnnounce("peer", "team-a", nil) {
+        t.Fatalf("authorizer returning 403 should deny")
+    }
+    if !s.authorizeAnnounce("peer", "team-b", nil) {
+        t.Fatalf("networks without authorizers should allow")
+    }
+    if got := newIntegrationRegistry(fileStore{}, path).list("team-a", ""); len(got) != 1 || got[0].URL != deny.URL {
+        t.Fatalf("expected integration to persist, got %v", got)
+    }
+
+    // Claiming to be a hub does not get a client past the authorizer; only
+    // a verified hub link skips it.
+    client, hub := randomPeerId(), randomPeerId()
+    attachTestPeers(t, s, client, hub)
+    for _, id := range []string{client, hub} {
+        s.peerData[id].IsHub = id == hub
+    }
+    for _, id := range []string{client, hub} {
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"team-a","data":{"isHub":true}}`))
+    }
+    if s.getPeerInfo(client).Announced || !s.getPeerInfo(hub).Announced {
+        t.Fatalf("only the verified hub link should skip the authorizer")
+    }
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+    "bytes"
+    "encoding/json"
+    "sync"
+)
+
+// The poll journal is a write-ahead log of the messages queued for
+// long-polling sessions, which otherwise live only in memory. With
+// PollJournalPath set, every message is appended to the journal as it is
+// queued, and a "done" record follows once the client collects the queue or
+// says goodbye. After a crash or restart the hub replays the journal, and
+// messages still pending are delivered when their peer connects again,
+// over polling or WebSocket. Queued signals whose deadline has passed are
+// skipped. Each peer may hold at most PollJournalMaxBytes of pending
+// messages; older ones are dropped first. Entries older than
+// PollJournalRetentionMs are discarded. Recovery skips records that do not
+// parse, such as a line torn by the crash, and rewrites the journal without
+// them. The Store must implement Appender; the default file Store does.
+// Counters are under "poll_journal" in /metrics.
+
+// Appender is implemented by Stores that can append to a document without
+// rewriting it, which the poll journal needs.
+type Appender interface {
+    Append(key string, data []byte) error
+}
+
+const (
+    journalQueue = "queue"
+    journalDone  = "done"
+    // journalCompactAfter is how many dead records the journal may carry
+    // before it is rewritten with only the live ones.
+    journalCompactAfter = 256
+)
+
+// journalRecord is one line of the journal. A done record settles every
+// entry for the peer up to and including Seq.
+type journalRecord struct {
+    Op     string          `json:"op"`
+    Seq    int64           `json:"seq"`
+    PeerId string          `json:"peerId"`
+    At     int64           `json:"at,omitempty"`
+    Msg    json.RawMessage `json:"msg,omitempty"`
+}
+
+type journalEntry struct {
+    seq int64
+    at  int64
+    msg json.RawMessage
+}
+
+type pollJournal struct {
+    store     Store
+    app       Appender
+    key       string
+    maxBytes  int
+    retention int64
+
+    mu          sync.Mutex
+    seq         int64
+    peers       map[string][]journalEntry
+    bytes       map[string]int
+    dead        int
+    recovered   int64
+    replayed    int64
+    corrupt     int64
+    dropped     int64
+    compactions int64
+    writeErrors int64
+}
+
+// newPollJournal recovers the journal at key, or returns nil when the Store
+// cannot append.
+func (s *Server) newPollJournal() *pollJournal {
+    o := s.opts
+    app, ok := o.Store.(Appender)
+    if !ok {
+        s.log.Warn("poll_journal_unsupported", map[string]interface{}{"path": o.PollJournalPath})
+        return nil
+    }
+    j := &pollJournal{store: o.Store, app: app, key: o.PollJournalPath, maxBytes: o.PollJournalMaxBytes, retention: int64(o.PollJournalRetentionMs), peers: map[string][]journalEntry{}, bytes: map[string]int{}}
+    b, err := o.Store.Load(j.key)
+    if err != nil {
+        s.log.Warn("poll_journal_load_failed", map[string]interface{}{"path": j.key, "error": err.Error()})
+    }
+    now := nowMs()
+    for _, line := range bytes.Split(b, []byte("\n")) {
+        if len(bytes.TrimSpace(line)) == 0 {
+            continue
+        }
+        var r journalRecord
+        if json.Unmarshal(line, &r) != nil || r.PeerId == "" || (r.Op != journalQueue && r.Op != journalDone) {
+            j.corrupt++
+            continue
+        }
+        if r.Seq > j.seq {
+            j.seq = r.Seq
+        }
+        if r.Op == journalDone {
+            j.settleLocked(r.PeerId, r.Seq)
+            continue
+        }
+        if now-r.At <= j.retention {
+            j.addLocked(r.PeerId, journalEntry{seq: r.Seq, at: r.At, msg: r.Msg})
+        }
+    }
+    for _, entries := range j.peers {
+        j.recovered += int64(len(entries))
+    }
+    if len(b) > 0 {
+        if err := j.compactLocked(); err != nil {
+            s.log.Warn("poll_journal_compact_failed", map[string]interface{}{"path": j.key, "error": err.Error()})
+        }
+        s.log.Info("poll_journal_recovered", map[string]interface{}{"path": j.key, "pending": j.recovered, "peers": len(j.peers), "corrupt": j.corrupt})
+    }
+    return j
+}
+
+func (j *pollJournal) addLocked(peerId string, e journalEntry) {
+    j.peers[peerId] = append(j.peers[peerId], e)
+    j.bytes[peerId] += len(e.msg)
+    for j.bytes[peerId] > j.maxBytes {
+        old := j.peers[peerId][0]
+        j.peers[peerId] = j.peers[peerId][1:]
+        j.bytes[peerId] -= len(old.msg)
+        j.dropped++
+        j.dead++
+    }
+}
+
+// settleLocked drops a peer's entries up to seq.
+func (j *pollJournal) settleLocked(peerId string, seq int64) {
+    entries := j.peers[peerId]
+    i := 0
+    for i < len(entries) && entries[i].seq <= seq {
+        j.bytes[peerId] -= len(entries[i].msg)
+        i++
+    }
+    j.dead += i
+    if i == len(entries) {
+        delete(j.peers, peerId)
+        delete(j.bytes, peerId)
+        return
+    }
+    j.peers[peerId] = entries[i:]
+}
+
+func (j *pollJournal) write(r journalRecord) {
+    b, _ := json.Marshal(r)
+    if err := j.app.Append(j.key, append(b, '\n')); err != nil {
+        j.writeErrors++
+    }
+}
+
+// append journals a message queued for peerId. A message larger than the
+// per-peer cap is not journaled.
+func (j *pollJournal) append(peerId string, msg []byte) {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    if len(msg) > j.maxBytes {
+        j.dropped++
+        return
+    }
+    j.seq++
+    e := journalEntry{seq: j.seq, at: nowMs(), msg: json.RawMessage(append([]byte(nil), msg...))}
+    j.write(journalRecord{Op: journalQueue, Seq: e.seq, PeerId: peerId, At: e.at, Msg: e.msg})
+    before := j.dropped
+    j.addLocked(peerId, e)
+    if j.dropped > before {
+        j.write(journalRecord{Op: journalDone, Seq: j.peers[peerId][0].seq - 1, PeerId: peerId})
+    }
+}
+
+// done settles everything journaled for peerId so far.
+func (j *pollJournal) done(peerId string) {
+    j.take(peerId)
+}
+
+// take settles and returns the messages pending for peerId.
+func (j *pollJournal) take(peerId string) []json.RawMessage {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    entries := j.peers[peerId]
+    if len(entries) == 0 {
+        return nil
+    }
+    seq := entries[len(entries)-1].seq
+    j.settleLocked(peerId, seq)
+    j.write(journalRecord{Op: journalDone, Seq: seq, PeerId: peerId})
+    out := make([]json.RawMessage, 0, len(entries))
+    for _, e := range entries {
+        out = append(out, e.msg)
+    }
+    return out
+}
+
+// forget drops everything journaled for peerId and rewrites the journal, so
+// its messages are gone from the Store and not just settled. It returns how
+// many pending entries were dropped.
+func (j *pollJournal) forget(peerId string) (int, error) {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    n := len(j.peers[peerId])
+    if n > 0 {
+        j.settleLocked(peerId, j.peers[peerId][n-1].seq)
+    }
+    return n, j.compactLocked()
+}
+
+// expire drops entries past the retention window and rewrites the journal
+// once dead records dominate it.
+func (j *pollJournal) expire(now int64) error {
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    for peerId, entries := range j.peers {
+        i := 0
+        for i < len(entries) && now-entries[i].at > j.retention {
+            i++
+        }
+        if i > 0 {
+            j.settleLocked(peerId, entries[i-1].seq)
+        }
+    }
+    live := 0
+    for _, entries := range j.peers {
+        live += len(entries)
+    }
+    if j.dead < journalCompactAfter || j.dead < live {
+        return nil
+    }
+    return j.compactLocked()
+}
+
+// compactLocked rewrites the journal with only the live entries.
+func (j *pollJournal) compactLocked() error {
+    var buf bytes.Buffer
+    for peerId, entries := range j.peers {
+        for _, e := range entries {
+            b, _ := json.Marshal(journalRecord{Op: journalQueue, Seq: e.seq, PeerId: peerId, At: e.at, Msg: e.msg})
+            buf.Write(b)
+            buf.WriteByte('\n')
+        }
+    }
+    if err := j.store.Save(j.key, buf.Bytes()); err != nil {
+        return err
+    }
+    j.dead = 0
+    j.compactions++
+    return nil
+}
+
+// replayJournal delivers messages journaled for peerId before a restart to
+// its new connection, skipping signals whose deadline has passed.
+func (s *Server) replayJournal(peerId string, conn peerConn) {
+    if s.journal == nil {
+        return
+    }
+    msgs := s.journal.take(peerId)
+    now := nowMs()
+    n := 0
+    for _, raw := range msgs {
+        if m, ok := parseSignalMeta(raw); ok && now > m.Deadline {
+            s.signalDeadlines.droppedLate()
+            continue
+        }
+        var msg outboundMessage
+        if json.Unmarshal(raw, &msg) == nil && s.writeMessage(conn, msg, s.clientThreshold(conn)) {
+            n++
+        }
+    }
+    if len(msgs) > 0 {
+        s.journal.mu.Lock()
+        s.journal.replayed += int64(n)
+        s.journal.mu.Unlock()
+        s.log.Info("poll_journal_replayed", map[string]interface{}{"peerId": peerId, "messages": n})
+    }
+}
+
+func (s *Server) pollJournalSnapshot() map[string]interface{} {
+    j := s.journal
+    if j == nil {
+        return map[string]interface{}{"enabled": false}
+    }
+    j.mu.Lock()
+    defer j.mu.Unlock()
+    pending := 0
+    for _, entries := range j.peers {
+        pending += len(entries)
+    }
+    return map[string]interface{}{"enabled": true, "pending": pending, "peers": len(j.peers), "dead_records": j.dead, "recovered": j.recovered, "replayed": j.replayed, "corrupt": j.corrupt, "dropped": j.dropped, "compactions": j.compactions, "write_errors": j.writeErrors, "max_bytes_per_peer": j.maxBytes, "retention_ms": j.retention}
+}
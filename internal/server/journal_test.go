@@ -0,0 +1,76 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestPollJournalSurvivesRestart(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "poll.journal")
+    a := NewServer(Options{MaxConnections: 10, PollJournalPath: path, PollJournalMaxBytes: 400})
+    peer, capped := randomPeerId(), randomPeerId()
+    p := &pollConn{s: a, peerId: peer, notify: make(chan struct{}, 1), lastPoll: nowMs()}
+    p.WriteMessage(websocket.TextMessage, []byte(`{"type":"peer-message","data":{"n":1},"fromPeerId":"x","networkName":"global","timestamp":1}`))
+    if msgs, _ := p.take(time.Second); len(msgs) != 1 {
+        t.Fatalf("expected the first message collected, got %d", len(msgs))
+    }
+    p.WriteMessage(websocket.TextMessage, []byte(`{"type":"peer-message","data":{"n":2},"fromPeerId":"x","networkName":"global","timestamp":2}`))
+    expired := outboundMessage{Type: "offer", Data: map[string]interface{}{"sdp": "v=0"}, FromPeerId: "x", NetworkName: "global", MessageId: "m1", Deadline: nowMs() + 50}
+    b, _ := json.Marshal(expired)
+    p.WriteMessage(websocket.TextMessage, b)
+    c := &pollConn{s: a, peerId: capped, notify: make(chan struct{}, 1), lastPoll: nowMs()}
+    for i := 0; i < 5; i++ {
+        c.WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"type":"peer-message","data":{"n":%d,"pad":"%s"}}`, i, strings.Repeat("p", 120))))
+    }
+    if snap := a.pollJournalSnapshot(); snap["pending"].(int) != 4 || snap["dropped"].(int64) != 3 {
+        t.Fatalf("expected 2 pending for each peer after the cap, got %v", snap)
+    }
+
+    // A crash tears the last record.
+    f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+    f.WriteString(`{"op":"queue","seq":99,"peerId":"` + peer + `","msg":{"ty`)
+    f.Close()
+    time.Sleep(60 * time.Millisecond)
+
+    b2 := NewServer(Options{MaxConnections: 10, PollJournalPath: path, PollJournalMaxBytes: 400})
+    if snap := b2.pollJournalSnapshot(); snap["recovered"].(int64) != 4 || snap["corrupt"].(int64) != 1 {
+        t.Fatalf("unexpected recovery: %v", snap)
+    }
+    if data, _ := os.ReadFile(path); strings.Count(string(data), "\n") != 4 {
+        t.Fatalf("recovery should rewrite the journal with the live records only:\n%s", data)
+    }
+
+    gin.SetMode(gin.TestMode)
+    b2.running = true
+    b2.routes()
+    ts := httptest.NewServer(b2.engine)
+    defer ts.Close()
+    ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?peerId="+peer, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer ws.Close()
+    var greeting, replayed outboundMessage
+    ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+    if ws.ReadJSON(&greeting) != nil || ws.ReadJSON(&replayed) != nil || greeting.Type != "connected" {
+        t.Fatalf("expected the greeting then the replayed message")
+    }
+    if d, _ := replayed.Data.(map[string]interface{}); replayed.Type != "peer-message" || d["n"] != float64(2) {
+        t.Fatalf("unexpected replay %+v", replayed)
+    }
+    ws.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+    if ws.ReadJSON(&replayed) == nil && replayed.Type == "offer" {
+        t.Fatalf("an expired signal should not be replayed")
+    }
+    if snap := b2.pollJournalSnapshot(); snap["replayed"].(int64) != 1 || snap["peers"].(int) != 1 {
+        t.Fatalf("unexpected journal after replay: %v", snap)
+    }
+}
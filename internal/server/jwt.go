@@ -0,0 +1,400 @@
+package server
+
+import (
+    "crypto"
+    "crypto/hmac"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "math/big"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gorilla/websocket"
+)
+
+// JWT authentication. With JWTSecret (HS256), JWTPublicKey (RS256, PEM) or
+// JWKSURL (RS256, keys chosen by "kid") set, a peer connects with a signed
+// token instead of the shared AuthToken, in the same places:
+//
+//     Authorization: Bearer <jwt>     or     /ws?peerId=...&token=<jwt>
+//
+// The token must carry "exp", be signed with an accepted key and, when
+// JWTIssuer or JWTAudience are set, name them in "iss" and "aud". The claim
+// named by JWTPeerIdClaim ("sub" by default) must equal the peerId being
+// connected, so a token cannot be replayed under another identity. The
+// claim named by JWTNetworksClaim ("networks"), a list or a space-separated
+// string, confines the peer to those networks ("*" allows any); a token
+// without it may announce anywhere the hub allows. When the token lapses
+// the connection is closed with reason token-expired, and the client must
+// reconnect with a fresh one. AuthToken, when also set, is still accepted,
+// so hub links and existing clients keep working during a migration.
+// JWKS keys are fetched on first use, refreshed every JWKSRefreshMs and
+// refetched, at most every jwksMinRefetch, when a token names an unknown
+// kid. Counts are under "jwt" in /metrics.
+const (
+    jwtGrantKey    = "jwtGrant"
+    jwksMinRefetch = 30 * time.Second
+    jwksTimeout    = 5 * time.Second
+)
+
+type jwtSession struct {
+    claims    map[string]interface{}
+    networks  []string
+    expiresAt int64
+    timer     *time.Timer
+}
+
+type jwtAuth struct {
+    static *rsa.PublicKey
+
+    // fetchMu serializes JWKS fetches; mu guards everything below.
+    fetchMu  sync.Mutex
+    mu       sync.Mutex
+    jwks     map[string]*rsa.PublicKey
+    fetched  time.Time
+    sessions map[string]*jwtSession
+    accepted int64
+    rejected int64
+    expired  int64
+    fetches  int64
+    fetchErr string
+}
+
+func newJWTAuth(o Options) *jwtAuth {
+    a := &jwtAuth{jwks: map[string]*rsa.PublicKey{}, sessions: map[string]*jwtSession{}}
+    if o.JWTPublicKey != "" {
+        a.static, _ = parseRSAPublicKey(o.JWTPublicKey)
+    }
+    return a
+}
+
+func (s *Server) jwtEnabled() bool {
+    return s.opts.JWTSecret != "" || s.opts.JWTPublicKey != "" || s.opts.JWKSURL != ""
+}
+
+// parseRSAPublicKey reads a PEM public key, PKIX or PKCS#1, or a
+// certificate carrying one.
+func parseRSAPublicKey(pemText string) (*rsa.PublicKey, error) {
+    block, _ := pem.Decode([]byte(pemText))
+    if block == nil {
+        return nil, errors.New("JWTPublicKey is not PEM")
+    }
+    var key interface{}
+    var err error
+    switch block.Type {
+    case "CERTIFICATE":
+        var cert *x509.Certificate
+        if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+            key = cert.PublicKey
+        }
+    case "RSA PUBLIC KEY":
+        key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+    default:
+        key, err = x509.ParsePKIXPublicKey(block.Bytes)
+    }
+    if err != nil {
+        return nil, errors.New("JWTPublicKey: " + err.Error())
+    }
+    rsaKey, ok := key.(*rsa.PublicKey)
+    if !ok {
+        return nil, errors.New("JWTPublicKey is not an RSA key")
+    }
+    return rsaKey, nil
+}
+
+// jwtKey returns the RSA key for kid, from the JWKS when one is configured
+// and otherwise JWTPublicKey.
+func (s *Server) jwtKey(kid string) *rsa.PublicKey {
+    a := s.jwt
+    if s.opts.JWKSURL == "" {
+        return a.static
+    }
+    refresh := time.Duration(s.opts.JWKSRefreshMs) * time.Millisecond
+    if key, stale := a.lookup(kid); key != nil && time.Since(stale) < refresh {
+        return key
+    }
+    a.fetchMu.Lock()
+    defer a.fetchMu.Unlock()
+    key, fetched := a.lookup(kid)
+    if since := time.Since(fetched); (key == nil && since >= jwksMinRefetch) || since >= refresh {
+        s.fetchJWKS()
+        key, _ = a.lookup(kid)
+    }
+    if key == nil {
+        return a.static
+    }
+    return key
+}
+
+// lookup finds kid in the cached JWKS, or its only key when the token names
+// none, and reports when the JWKS was fetched.
+func (a *jwtAuth) lookup(kid string) (*rsa.PublicKey, time.Time) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    if kid == "" && len(a.jwks) == 1 {
+        for _, key := range a.jwks {
+            return key, a.fetched
+        }
+    }
+    return a.jwks[kid], a.fetched
+}
+
+func (s *Server) fetchJWKS() {
+    a := s.jwt
+    keys, err := loadJWKS(s.opts.JWKSURL)
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    a.fetched = time.Now()
+    a.fetches++
+    if err != nil {
+        a.fetchErr = err.Error()
+        s.log.Warn("jwks_fetch_failed", map[string]interface{}{"url": s.opts.JWKSURL, "error": err.Error()})
+        return
+    }
+    a.jwks, a.fetchErr = keys, ""
+}
+
+func loadJWKS(uri string) (map[string]*rsa.PublicKey, error) {
+    resp, err := (&http.Client{Timeout: jwksTimeout}).Get(uri)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, errors.New("JWKS answered " + resp.Status)
+    }
+    var doc struct {
+        Keys []struct {
+            Kty string `json:"kty"`
+            Kid string `json:"kid"`
+            Use string `json:"use"`
+            N   string `json:"n"`
+            E   string `json:"e"`
+        } `json:"keys"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+        return nil, err
+    }
+    keys := map[string]*rsa.PublicKey{}
+    for _, k := range doc.Keys {
+        if k.Kty != "RSA" || k.Use == "enc" {
+            continue
+        }
+        n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+        e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+        if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+            continue
+        }
+        keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+    }
+    return keys, nil
+}
+
+// verifyJWT checks token for peerId and returns the session it grants or,
+// when it grants nothing, the reason why.
+func (s *Server) verifyJWT(token, peerId string) (*jwtSession, string) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return nil, "invalid token"
+    }
+    var header struct {
+        Alg string `json:"alg"`
+        Kid string `json:"kid"`
+    }
+    claims := map[string]interface{}{}
+    rawHeader, err1 := base64.RawURLEncoding.DecodeString(parts[0])
+    rawClaims, err2 := base64.RawURLEncoding.DecodeString(parts[1])
+    sig, err3 := base64.RawURLEncoding.DecodeString(parts[2])
+    if err1 != nil || err2 != nil || err3 != nil || json.Unmarshal(rawHeader, &header) != nil || json.Unmarshal(rawClaims, &claims) != nil {
+        return nil, "invalid token"
+    }
+    signed := []byte(parts[0] + "." + parts[1])
+    switch header.Alg {
+    case "HS256":
+        if s.opts.JWTSecret == "" {
+            return nil, "token algorithm not accepted"
+        }
+        mac := hmac.New(sha256.New, []byte(s.opts.JWTSecret))
+        mac.Write(signed)
+        if !hmac.Equal(sig, mac.Sum(nil)) {
+            return nil, "invalid token signature"
+        }
+    case "RS256":
+        key := s.jwtKey(header.Kid)
+        if key == nil {
+            return nil, "token algorithm not accepted"
+        }
+        sum := sha256.Sum256(signed)
+        if rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig) != nil {
+            return nil, "invalid token signature"
+        }
+    default:
+        return nil, "token algorithm not accepted"
+    }
+    now := nowMs()
+    exp, ok := claims["exp"].(float64)
+    if !ok {
+        return nil, "token has no expiry"
+    }
+    if now >= int64(exp*1000) {
+        return nil, "token expired"
+    }
+    if nbf, ok := claims["nbf"].(float64); ok && now < int64(nbf*1000) {
+        return nil, "token not yet valid"
+    }
+    if iss, _ := claims["iss"].(string); s.opts.JWTIssuer != "" && iss != s.opts.JWTIssuer {
+        return nil, "token issuer not accepted"
+    }
+    if s.opts.JWTAudience != "" && !containsString(claimStrings(claims["aud"]), s.opts.JWTAudience) {
+        return nil, "token audience not accepted"
+    }
+    if id, _ := claims[s.opts.JWTPeerIdClaim].(string); id != peerId {
+        return nil, "token is for another peer"
+    }
+    return &jwtSession{claims: claims, networks: claimStrings(claims[s.opts.JWTNetworksClaim]), expiresAt: int64(exp * 1000)}, ""
+}
+
+// claimStrings reads a claim that is a string list, or a single string of
+// space-separated values as OAuth scopes are written.
+func claimStrings(v interface{}) []string {
+    switch v := v.(type) {
+    case string:
+        return strings.Fields(v)
+    case []interface{}:
+        out := make([]string, 0, len(v))
+        for _, item := range v {
+            if s, ok := item.(string); ok {
+                out = append(out, s)
+            }
+        }
+        return out
+    }
+    return nil
+}
+
+func containsString(list []string, v string) bool {
+    for _, item := range list {
+        if item == v {
+            return true
+        }
+    }
+    return false
+}
+
+// bearerToken is the token a request presents, from the Authorization
+// header or ?token=.
+func bearerToken(r *connRequest) string {
+    if auth := r.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+        return strings.TrimPrefix(auth, "Bearer ")
+    }
+    return r.Query("token")
+}
+
+// admitJWT checks the token of a peer connecting to a hub with JWT
+// authentication and stashes its session for registerConn. The AuthToken,
+// if set, is accepted as before.
+func (s *Server) admitJWT(r *connRequest, peerId string) bool {
+    token := bearerToken(r)
+    if authToken := s.currentAuthToken(); authToken != "" && (token == authToken || r.Query("token") == authToken) {
+        return true
+    }
+    reason := "unauthorized"
+    var sess *jwtSession
+    if token != "" {
+        sess, reason = s.verifyJWT(token, peerId)
+    }
+    s.jwt.mu.Lock()
+    if sess == nil {
+        s.jwt.rejected++
+    } else {
+        s.jwt.accepted++
+    }
+    s.jwt.mu.Unlock()
+    if sess == nil {
+        r.refuse(http.StatusUnauthorized, reason)
+        return false
+    }
+    r.Set(jwtGrantKey, sess)
+    return true
+}
+
+// attachJWT starts the session admitJWT granted, closing the connection
+// when its token lapses.
+func (s *Server) attachJWT(r *connRequest, peerId string) {
+    v, ok := r.Get(jwtGrantKey)
+    if !ok {
+        return
+    }
+    sess := v.(*jwtSession)
+    s.jwt.mu.Lock()
+    if old := s.jwt.sessions[peerId]; old != nil {
+        old.timer.Stop()
+    }
+    s.jwt.sessions[peerId] = sess
+    sess.timer = time.AfterFunc(time.Duration(sess.expiresAt-nowMs())*time.Millisecond, func() { s.expireJWT(peerId, sess) })
+    s.jwt.mu.Unlock()
+}
+
+func (s *Server) expireJWT(peerId string, sess *jwtSession) {
+    s.jwt.mu.Lock()
+    if s.jwt.sessions[peerId] != sess {
+        s.jwt.mu.Unlock()
+        return
+    }
+    delete(s.jwt.sessions, peerId)
+    s.jwt.expired++
+    s.jwt.mu.Unlock()
+    if conn := s.getConn(peerId); conn != nil {
+        s.handleDisconnect(peerId, reasonTokenExpired, "")
+        closeWithReason(conn, websocket.ClosePolicyViolation, reasonTokenExpired)
+    }
+}
+
+func (s *Server) forgetJWT(peerId string) {
+    s.jwt.mu.Lock()
+    if sess := s.jwt.sessions[peerId]; sess != nil {
+        sess.timer.Stop()
+        delete(s.jwt.sessions, peerId)
+    }
+    s.jwt.mu.Unlock()
+}
+
+// routedTypes are the messages the hub delivers to other peers in the
+// sender's network. A token limited to some networks, and the network ACL,
+// must allow the network they are sent in, as they must for announces.
+var routedTypes = map[string]bool{
+    "offer": true, "answer": true, "ice-candidate": true,
+    "peer-message": true, "message-receipt": true,
+    "blob-start": true, "blob-chunk": true, "blob-end": true,
+}
+
+// jwtAllowsNetwork reports whether peerId's token lets it use netName.
+// Peers without a token session are not restricted here.
+func (s *Server) jwtAllowsNetwork(peerId, netName string) bool {
+    s.jwt.mu.Lock()
+    defer s.jwt.mu.Unlock()
+    sess := s.jwt.sessions[peerId]
+    if sess == nil || sess.networks == nil {
+        return true
+    }
+    return containsString(sess.networks, netName) || containsString(sess.networks, "*")
+}
+
+func (s *Server) jwtSnapshot() map[string]interface{} {
+    a := s.jwt
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    out := map[string]interface{}{"enabled": s.jwtEnabled(), "active": len(a.sessions), "accepted": a.accepted, "rejected": a.rejected, "expired": a.expired}
+    if s.opts.JWKSURL != "" {
+        out["jwks_keys"] = len(a.jwks)
+        out["jwks_fetches"] = a.fetches
+        out["jwks_error"] = a.fetchErr
+    }
+    return out
+}
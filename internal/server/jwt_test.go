@@ -0,0 +1,161 @@
+package server
+
+import (
+    "crypto"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func signTestJWT(header, claims map[string]interface{}, sign func([]byte) []byte) string {
+    h, _ := json.Marshal(header)
+    c, _ := json.Marshal(claims)
+    signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+    return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func TestJWTAuthenticatesPeersAndExpiresTokens(t *testing.T) {
+    hs256 := func(b []byte) []byte {
+        mac := hmac.New(sha256.New, []byte("jwt-secret"))
+        mac.Write(b)
+        return mac.Sum(nil)
+    }
+    s := NewServer(Options{MaxConnections: 10, AuthToken: "static", JWTSecret: "jwt-secret", JWTAudience: "pigeon"})
+    gin.SetMode(gin.TestMode)
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    base := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?peerId="
+    id := randomPeerId()
+    exp := float64(nowMs()+60000) / 1000
+    for name, token := range map[string]string{
+        "no token":      "",
+        "other peer":    signTestJWT(map[string]interface{}{"alg": "HS256"}, map[string]interface{}{"sub": randomPeerId(), "aud": "pigeon", "exp": exp}, hs256),
+        "expired":       signTestJWT(map[string]interface{}{"alg": "HS256"}, map[string]interface{}{"sub": id, "aud": "pigeon", "exp": exp - 120}, hs256),
+        "wrong audience": signTestJWT(map[string]interface{}{"alg": "HS256"}, map[string]interface{}{"sub": id, "aud": "other", "exp": exp}, hs256),
+        "alg none":      signTestJWT(map[string]interface{}{"alg": "none"}, map[string]interface{}{"sub": id, "aud": "pigeon", "exp": exp}, func([]byte) []byte { return nil }),
+    } {
+        if _, res, err := websocket.DefaultDialer.Dial(base+id+"&token="+token, nil); err == nil || res.StatusCode != http.StatusUnauthorized {
+            t.Fatalf("%s: expected 401", name)
+        }
+    }
+    static, _, err := websocket.DefaultDialer.Dial(base+randomPeerId()+"&token=static", nil)
+    if err != nil {
+        t.Fatalf("the AuthToken should still be accepted: %v", err)
+    }
+    static.Close()
+
+    token := signTestJWT(map[string]interface{}{"alg": "HS256", "typ": "JWT"}, map[string]interface{}{"sub": id, "aud": []string{"pigeon"}, "networks": "room-a", "exp": float64(nowMs()+400) / 1000}, hs256)
+    ws, _, err := websocket.DefaultDialer.Dial(base+id, http.Header{"Authorization": {"Bearer " + token}})
+    if err != nil {
+        t.Fatalf("dial with JWT: %v", err)
+    }
+    defer ws.Close()
+    ws.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "room-b", "data": map[string]interface{}{}})
+    ws.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "room-a", "data": map[string]interface{}{}})
+    waitFor(t, "announce on the token's network", func() bool {
+        pi := s.getPeerInfo(id)
+        return pi != nil && pi.Announced && pi.NetworkName == "room-a"
+    })
+    refused := false
+    ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+    for {
+        var msg map[string]interface{}
+        if err := ws.ReadJSON(&msg); err != nil {
+            if ce, ok := err.(*websocket.CloseError); !ok || ce.Text != reasonTokenExpired {
+                t.Fatalf("expected close with token-expired, got %v", err)
+            }
+            break
+        }
+        if data, _ := msg["data"].(map[string]interface{}); msg["type"] == "error" && strings.Contains(fmt.Sprint(data), "room-b") {
+            refused = true
+        }
+    }
+    if !refused {
+        t.Fatalf("announce outside the token's networks should be refused")
+    }
+    if snap := s.jwtSnapshot(); snap["expired"] != int64(1) || snap["rejected"] != int64(5) {
+        t.Fatalf("unexpected jwt metrics: %v", snap)
+    }
+}
+
+func TestJWTVerifiesRS256AgainstJWKS(t *testing.T) {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    fetches := int64(0)
+    jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt64(&fetches, 1)
+        e := big.NewInt(int64(key.E)).Bytes()
+        json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]interface{}{{"kty": "RSA", "kid": "k1", "use": "sig", "n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()), "e": base64.RawURLEncoding.EncodeToString(e)}}})
+    }))
+    defer jwks.Close()
+    s := NewServer(Options{JWKSURL: jwks.URL, JWTIssuer: "https://issuer.example.com"})
+    rs256 := func(b []byte) []byte {
+        sum := sha256.Sum256(b)
+        sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+        return sig
+    }
+    id := randomPeerId()
+    claims := map[string]interface{}{"sub": id, "iss": "https://issuer.example.com", "exp": float64(nowMs()+60000) / 1000, "networks": []string{"a", "b"}}
+    sess, reason := s.verifyJWT(signTestJWT(map[string]interface{}{"alg": "RS256", "kid": "k1"}, claims, rs256), id)
+    if sess == nil || len(sess.networks) != 2 {
+        t.Fatalf("RS256 token rejected: %s", reason)
+    }
+    if _, reason := s.verifyJWT(signTestJWT(map[string]interface{}{"alg": "RS256", "kid": "k2"}, claims, rs256), id); reason == "" {
+        t.Fatalf("unknown kid should be rejected")
+    }
+    if _, reason := s.verifyJWT(signTestJWT(map[string]interface{}{"alg": "HS256", "kid": "k1"}, claims, func([]byte) []byte { return nil }), id); reason == "" {
+        t.Fatalf("HS256 should be refused without a JWTSecret")
+    }
+    if n := atomic.LoadInt64(&fetches); n != 1 {
+        t.Fatalf("an unknown kid should not refetch right after a fetch, got %d fetches", n)
+    }
+}
+
+func TestJWTNetworksLimitSignaling(t *testing.T) {
+    s := NewServer(Options{MaxConnections: 10})
+    a, b := randomPeerId(), randomPeerId()
+    conns := attachTestPeers(t, s, a, b)
+    s.peersMu.Lock()
+    s.peerData[a].Announced, s.peerData[a].NetworkName = true, "room-a"
+    s.peerData[b].Announced, s.peerData[b].NetworkName = true, "room-b"
+    s.peersMu.Unlock()
+    s.jwt.mu.Lock()
+    s.jwt.sessions[a] = &jwtSession{networks: []string{"room-a"}}
+    s.jwt.mu.Unlock()
+
+    // A token for room-a cannot reach peers in room-b, whatever it sends.
+    for _, typ := range []string{"offer", "answer", "ice-candidate", "peer-message", "message-receipt"} {
+        s.handleMessage(a, []byte(`{"type":"`+typ+`","networkName":"room-b","targetPeerId":"`+b+`","messageId":"m-`+typ+`","data":{"sdp":"x","status":"delivered"}}`))
+        if msgs, _ := conns[b].take(20 * time.Millisecond); len(msgs) != 0 {
+            t.Fatalf("%s outside the token's networks should not be delivered, got %s", typ, msgs)
+        }
+        if msgs, _ := conns[a].take(time.Second); len(msgs) != 1 || !strings.Contains(string(msgs[0]), "not authorized for network room-b") {
+            t.Fatalf("%s outside the token's networks should be refused, got %s", typ, msgs)
+        }
+    }
+
+    s.jwt.mu.Lock()
+    s.jwt.sessions[a].networks = []string{"room-a", "room-b"}
+    s.jwt.mu.Unlock()
+    s.handleMessage(a, []byte(`{"type":"offer","networkName":"room-b","targetPeerId":"`+b+`","data":{"sdp":"x"}}`))
+    if msgs, _ := conns[b].take(time.Second); len(msgs) != 1 || !strings.Contains(string(msgs[0]), `"type":"offer"`) {
+        t.Fatalf("offer within the token's networks should be delivered, got %s", msgs)
+    }
+}
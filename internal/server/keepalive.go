@@ -0,0 +1,57 @@
+package server
+
+import (
+    "sync/atomic"
+    "github.com/gorilla/websocket"
+)
+
+// keepaliveStats counts WebSocket pings and the connections dropped for
+// going quiet. The pings themselves are sent by each connection's pump.
+type keepaliveStats struct {
+    pings      int64
+    timeouts   int64
+    idleReaped int64
+}
+
+// reapIdle disconnects WebSocket peers that have sent nothing, not even a
+// pong or ping, for PeerTimeoutMs. It catches dead connections when pings
+// are off, or a peer whose socket is open but whose reader has stalled.
+// Long-polling sessions expire on their own.
+func (s *Server) reapIdle(now int64) {
+    if s.opts.PeerTimeoutMs <= 0 {
+        return
+    }
+    type idle struct {
+        id   string
+        conn *wsPeerConn
+    }
+    var reap []idle
+    s.wsMu.Lock()
+    for id, conn := range s.wsConns {
+        if ws, ok := conn.(*wsPeerConn); ok && now-atomic.LoadInt64(&ws.alive) > int64(s.opts.PeerTimeoutMs) {
+            reap = append(reap, idle{id, ws})
+        }
+    }
+    s.wsMu.Unlock()
+    for _, r := range reap {
+        if s.getConn(r.id) != peerConn(r.conn) {
+            continue
+        }
+        atomic.AddInt64(&s.keepalive.idleReaped, 1)
+        s.connLog(r.id).Info("peer_idle_reaped", map[string]interface{}{"idleMs": now - atomic.LoadInt64(&r.conn.alive)})
+        s.handleDisconnect(r.id, reasonIdleTimeout, "no traffic")
+        closeWithReason(r.conn, websocket.CloseGoingAway, reasonIdleTimeout)
+    }
+}
+
+func (s *Server) keepaliveSnapshot() map[string]interface{} {
+    k := s.keepalive
+    return map[string]interface{}{
+        "ping_interval_ms": s.opts.PingIntervalMs,
+        "max_missed_pongs": s.opts.MaxMissedPongs,
+        "peer_timeout_ms":  s.opts.PeerTimeoutMs,
+        "pings_sent":       atomic.LoadInt64(&k.pings),
+        "ping_timeouts":    atomic.LoadInt64(&k.timeouts),
+        "idle_reaped":      atomic.LoadInt64(&k.idleReaped),
+    }
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestPingTimeoutReapsDeadConnections(t *testing.T) {
+    s := NewServer(Options{MaxConnections: 10, PingIntervalMs: 40, MaxMissedPongs: 2})
+    gin.SetMode(gin.TestMode)
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    base := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?peerId="
+    dead, live := randomPeerId(), randomPeerId()
+    d, _, err := websocket.DefaultDialer.Dial(base+dead, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer d.Close()
+    l, _, err := websocket.DefaultDialer.Dial(base+live, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer l.Close()
+    for _, c := range []*websocket.Conn{d, l} {
+        c.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "lobby", "data": map[string]interface{}{}})
+    }
+    waitFor(t, "both peers to announce", func() bool { return len(s.getActivePeers("", "lobby")) == 2 })
+
+    // The live peer keeps reading, which answers pings; the dead one never
+    // reads again.
+    l.SetReadDeadline(time.Now().Add(5 * time.Second))
+    for {
+        var m outboundMessage
+        if err := l.ReadJSON(&m); err != nil {
+            t.Fatalf("live peer should stay connected: %v", err)
+        }
+        if m.Type == "peer-disconnected" {
+            data := m.Data.(map[string]interface{})
+            if data["peerId"] != dead || data["reason"] != reasonPingTimeout {
+                t.Fatalf("unexpected disconnect %v", data)
+            }
+            break
+        }
+    }
+    if s.getConn(dead) != nil || s.getConn(live) == nil {
+        t.Fatalf("only the silent peer should be removed")
+    }
+    if k := s.keepaliveSnapshot(); k["ping_timeouts"] != int64(1) || k["pings_sent"].(int64) < 2 {
+        t.Fatalf("unexpected keepalive stats %v", k)
+    }
+}
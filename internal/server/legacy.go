@@ -0,0 +1,94 @@
+package server
+
+import (
+    "encoding/json"
+    "strconv"
+    "github.com/gin-gonic/gin"
+)
+
+// Legacy envelope. Clients written for the JavaScript pigeonhub speak
+// protocol version 0: the same {type, data, fromPeerId, targetPeerId,
+// networkName, timestamp} envelope, but without compression, deadlines,
+// receipts or mesh routing fields, and with a few messages shaped
+// differently:
+//
+//     connected  {"type": "connected", "peerId": "<id>", "timestamp": ...}
+//     error      {"type": "error", "error": "<message>", "code": "..."}
+//
+// A client picks its version with ?protocolVersion= on connect. Without it
+// a client gets the current protocol, or version 0 when
+// LegacyEnvelopeDefault is set so an unmodified pigeonhub deployment can
+// point at a Go hub. The version is fixed for the life of the connection;
+// legacy connections are translated here on the way in and out and the rest
+// of the hub only ever sees the typed envelope. Hub links always use the
+// current protocol.
+const legacyProtocolVersion = 0
+
+// negotiateProtocol returns the envelope version for a new connection.
+// Versions newer than this hub's are served as the newest it knows.
+func (s *Server) negotiateProtocol(c *gin.Context) int {
+    if connPath(c) == pathMesh {
+        return ProtocolVersion
+    }
+    v, err := strconv.Atoi(c.Query("protocolVersion"))
+    switch {
+    case err != nil && s.opts.LegacyEnvelopeDefault:
+        return legacyProtocolVersion
+    case err != nil, v > ProtocolVersion:
+        return ProtocolVersion
+    case v <= legacyProtocolVersion:
+        return legacyProtocolVersion
+    }
+    return v
+}
+
+func isLegacyConn(conn peerConn) bool {
+    wc, ok := conn.(*wsPeerConn)
+    return ok && wc.legacy
+}
+
+// connProtocol is the envelope version conn was accepted with. Long-polling
+// sessions are a current-protocol feature.
+func connProtocol(conn peerConn) int {
+    if isLegacyConn(conn) {
+        return legacyProtocolVersion
+    }
+    return ProtocolVersion
+}
+
+// fromLegacyEnvelope clears the fields a version 0 client cannot mean. A
+// pigeonhub client never compresses, stamps deadlines or routes through the
+// mesh, so whatever it put in those fields is application data.
+func fromLegacyEnvelope(msg *inboundMessage) {
+    msg.Encoding = ""
+    msg.Receipts = false
+    msg.OriginHub = ""
+    msg.SeenHubs = nil
+    msg.Deadline = 0
+}
+
+// legacyEnvelope renders msg for a version 0 client: payloads are sent
+// uncompressed, fields it does not know are left out and connected and
+// error use the pigeonhub layout. data is kept on both so clients that
+// already read it keep working.
+func legacyEnvelope(msg outboundMessage) ([]byte, error) {
+    d, err := decompressData(msg.Data, msg.Encoding)
+    if err != nil {
+        return nil, err
+    }
+    out := map[string]interface{}{"type": msg.Type, "data": d, "fromPeerId": msg.FromPeerId, "networkName": msg.NetworkName, "timestamp": msg.Timestamp}
+    if msg.TargetPeer != "" {
+        out["targetPeerId"] = msg.TargetPeer
+    }
+    m, _ := d.(map[string]interface{})
+    switch msg.Type {
+    case "connected":
+        out["peerId"] = m["peerId"]
+    case "error":
+        out["error"] = m["message"]
+        if code, ok := m["code"]; ok {
+            out["code"] = code
+        }
+    }
+    return json.Marshal(out)
+}
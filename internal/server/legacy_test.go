@@ -0,0 +1,106 @@
+package server
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+// TestLegacyEnvelopeConformance drives a hub the way pigeonhub JS clients
+// do and checks every frame they receive has the layout they expect, while a
+// current-protocol client on the same hub keeps the typed envelope.
+func TestLegacyEnvelopeConformance(t *testing.T) {
+    s := NewServer(Options{MaxConnections: 10, LegacyEnvelopeDefault: true, CompressThresholdBytes: 64})
+    gin.SetMode(gin.TestMode)
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    base := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?peerId="
+    dial := func(id, query string) *websocket.Conn {
+        c, _, err := websocket.DefaultDialer.Dial(base+id+query, nil)
+        if err != nil {
+            t.Fatalf("dial: %v", err)
+        }
+        return c
+    }
+    next := func(c *websocket.Conn, typ string) map[string]interface{} {
+        c.SetReadDeadline(time.Now().Add(2 * time.Second))
+        for {
+            var m map[string]interface{}
+            if err := c.ReadJSON(&m); err != nil {
+                t.Fatalf("waiting for %s: %v", typ, err)
+            }
+            if m["type"] == typ {
+                return m
+            }
+        }
+    }
+    a, b, typed, plain := randomPeerId(), randomPeerId(), randomPeerId(), randomPeerId()
+    ca, cb, ct, cp := dial(a, ""), dial(b, "&protocolVersion=0"), dial(typed, "&protocolVersion=1&features=compression"), dial(plain, "&protocolVersion=1")
+    defer ca.Close()
+    defer cb.Close()
+    defer ct.Close()
+    defer cp.Close()
+
+    for id, c := range map[string]*websocket.Conn{a: ca, b: cb} {
+        m := next(c, "connected")
+        if m["peerId"] != id {
+            t.Fatalf("legacy connected should carry peerId at the top level: %v", m)
+        }
+    }
+    m := next(ct, "connected")
+    enc, _ := m["encoding"].(string)
+    if d, _ := decompressData(m["data"], enc); m["peerId"] != nil || d.(map[string]interface{})["peerId"] != typed {
+        t.Fatalf("typed connected should keep peerId in data: %v", m)
+    }
+
+    info := strings.Repeat("pigeon ", 40)
+    ca.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "compat", "data": map[string]interface{}{"info": info}})
+    waitFor(t, "legacy announce", func() bool { pi := s.getPeerInfo(a); return pi != nil && pi.Announced })
+    cb.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "compat", "data": map[string]interface{}{}})
+    m = next(cb, "peer-discovered")
+    d, ok := m["data"].(map[string]interface{})
+    if !ok || d["peerId"] != a || d["info"] != info || m["targetPeerId"] != b || m["encoding"] != nil || m["fromPeerId"] != "system" || m["networkName"] != "compat" {
+        t.Fatalf("legacy peer-discovered should be uncompressed pigeonhub layout: %v", m)
+    }
+    ct.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "compat", "data": map[string]interface{}{}})
+    // ct hears about a and b in either order; only a's data is large.
+    if m1, m2 := next(ct, "peer-discovered"), next(ct, "peer-discovered"); m1["encoding"] != encodingGzip && m2["encoding"] != encodingGzip {
+        t.Fatalf("typed client should still get compressed payloads: %v %v", m1, m2)
+    }
+    // A client that never advertised compression gets plain payloads.
+    cp.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "compat", "data": map[string]interface{}{}})
+    for i := 0; i < 3; i++ {
+        if m := next(cp, "peer-discovered"); m["encoding"] != nil {
+            t.Fatalf("client without the compression feature got a compressed payload: %v", m)
+        }
+    }
+
+    // Go-only envelope fields from a legacy client are ignored, not acted on.
+    ca.WriteJSON(map[string]interface{}{"type": "offer", "targetPeerId": b, "networkName": "compat", "encoding": "gzip", "deadline": 1, "data": map[string]interface{}{"type": "offer", "sdp": "v=0"}})
+    m = next(cb, "offer")
+    if d, _ := m["data"].(map[string]interface{}); d["sdp"] != "v=0" || m["fromPeerId"] != a || m["deadline"] != nil || m["messageId"] != nil {
+        t.Fatalf("legacy offer should relay untouched without typed fields: %v", m)
+    }
+
+    cb.WriteJSON(map[string]interface{}{"type": "ping", "data": map[string]interface{}{"timestamp": 1}})
+    if m := next(cb, "pong"); m["timestamp"] == nil || m["targetPeerId"] != b {
+        t.Fatalf("unexpected legacy pong %v", m)
+    }
+    cb.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "not a network!", "data": map[string]interface{}{}})
+    if m := next(cb, "error"); m["error"] != "invalid or unpermitted networkName" {
+        t.Fatalf("legacy error should carry the message at the top level: %v", m)
+    }
+
+    clients := s.getMetrics()["clients"].(map[string]interface{})
+    if clients["legacy_envelope"] != 2 {
+        t.Fatalf("expected two legacy clients, got %v", clients)
+    }
+    if pi := s.getPeerInfo(typed); pi.ProtocolVersion != ProtocolVersion {
+        t.Fatalf("typed client negotiated %d", pi.ProtocolVersion)
+    }
+}
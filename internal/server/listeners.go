@@ -0,0 +1,384 @@
+package server
+
+import (
+    "context"
+    "crypto/tls"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+// Extra listeners. Besides its main port the hub can serve on any number of
+// named listeners, each with its own address, an optional TLS certificate
+// and a role: "all" (the default) serves every endpoint, "client" all but
+// /mesh, and "mesh" only /mesh and /health. They come from Options.Listeners
+// (LISTENERS), can be added and removed at /admin/listeners, and are
+// reconciled whenever Reconfigure is given a list: listeners that appear are
+// opened, ones that are gone are closed and ones that changed are updated. A
+// new certificate or role takes effect in place; a new address is bound
+// before the old one is closed, and if any listener fails to bind nothing
+// changes. Switching an address between TLS and plaintext needs a new name.
+// No other listener is touched, so clients can be moved to a TLS port or a
+// new address gradually. Closing a listener only stops it accepting:
+// WebSocket peers that came in through it stay connected, and in-flight HTTP
+// requests get listenerDrainTimeout to finish. Reloads leave listeners added
+// through the admin API alone. Request and upgrade counts per listener are
+// under "listeners" in /metrics.
+const (
+    listenerRoleAll    = "all"
+    listenerRoleClient = "client"
+    listenerRoleMesh   = "mesh"
+
+    listenerSourceConfig = "config"
+    listenerSourceAdmin  = "admin"
+
+    mainListenerName     = "main"
+    listenerDrainTimeout = 5 * time.Second
+)
+
+var errListenerExists = errors.New("a listener with that name already exists")
+
+// Listener is an extra address the hub serves on. CertFile and KeyFile, set
+// together, make it serve TLS.
+type Listener struct {
+    Name     string `json:"name"`
+    Addr     string `json:"addr"`
+    Role     string `json:"role,omitempty"`
+    CertFile string `json:"certFile,omitempty"`
+    KeyFile  string `json:"keyFile,omitempty"`
+}
+
+func (l Listener) tls() bool { return l.CertFile != "" }
+
+func (l Listener) role() string { return firstNonEmpty(l.Role, listenerRoleAll) }
+
+type liveListener struct {
+    source   string
+    ln       net.Listener
+    srv      *http.Server
+    since    int64
+    requests int64
+    upgrades int64
+
+    mu   sync.Mutex
+    cfg  Listener
+    cert *tls.Certificate
+}
+
+func (ll *liveListener) config() Listener {
+    ll.mu.Lock()
+    defer ll.mu.Unlock()
+    return ll.cfg
+}
+
+type listenerSet struct {
+    mu    sync.Mutex
+    items map[string]*liveListener
+}
+
+func newListenerSet() *listenerSet {
+    return &listenerSet{items: map[string]*liveListener{}}
+}
+
+// checkListener validates one listener's settings.
+func checkListener(l Listener) error {
+    if l.Name == "" || l.Name == mainListenerName || strings.ContainsAny(l.Name, "/ ") {
+        return fmt.Errorf("listener name %q is not allowed", l.Name)
+    }
+    if _, _, err := net.SplitHostPort(l.Addr); err != nil {
+        return fmt.Errorf("listener %s: addr %q is not host:port", l.Name, l.Addr)
+    }
+    switch l.role() {
+    case listenerRoleAll, listenerRoleClient, listenerRoleMesh:
+    default:
+        return fmt.Errorf("listener %s: role must be all, client or mesh", l.Name)
+    }
+    if (l.CertFile == "") != (l.KeyFile == "") {
+        return fmt.Errorf("listener %s: certFile and keyFile must be set together", l.Name)
+    }
+    return nil
+}
+
+// validateListeners checks every listener and that names are unique.
+func validateListeners(list []Listener) error {
+    seen := map[string]bool{}
+    for _, l := range list {
+        if err := checkListener(l); err != nil {
+            return err
+        }
+        if seen[l.Name] {
+            return fmt.Errorf("listener %s is listed twice", l.Name)
+        }
+        seen[l.Name] = true
+    }
+    return nil
+}
+
+func loadListenerCert(l Listener) (*tls.Certificate, error) {
+    if !l.tls() {
+        return nil, nil
+    }
+    cert, err := tls.LoadX509KeyPair(l.CertFile, l.KeyFile)
+    if err != nil {
+        return nil, fmt.Errorf("listener %s: %v", l.Name, err)
+    }
+    return &cert, nil
+}
+
+// listenerServes reports whether a listener with role serves path.
+func listenerServes(role, path string) bool {
+    switch role {
+    case listenerRoleMesh:
+        return path == "/mesh" || path == "/health"
+    case listenerRoleClient:
+        return path != "/mesh"
+    }
+    return true
+}
+
+// openListener binds l without serving on it yet.
+func (s *Server) openListener(l Listener, source string) (*liveListener, error) {
+    if err := checkListener(l); err != nil {
+        return nil, err
+    }
+    cert, err := loadListenerCert(l)
+    if err != nil {
+        return nil, err
+    }
+    ln, err := net.Listen("tcp", l.Addr)
+    if err != nil {
+        return nil, fmt.Errorf("listener %s: %v", l.Name, err)
+    }
+    ll := &liveListener{source: source, since: nowMs(), cfg: l, cert: cert}
+    if cert != nil {
+        ln = tls.NewListener(ln, &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+            ll.mu.Lock()
+            defer ll.mu.Unlock()
+            return ll.cert, nil
+        }})
+    }
+    ll.ln = ln
+    ll.srv = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        atomic.AddInt64(&ll.requests, 1)
+        if !listenerServes(ll.config().role(), r.URL.Path) {
+            writeJSON(w, http.StatusNotFound, map[string]interface{}{"error": "not served on this listener"}, s.opts.CORSOrigin)
+            return
+        }
+        if websocket.IsWebSocketUpgrade(r) {
+            atomic.AddInt64(&ll.upgrades, 1)
+        }
+        s.engine.ServeHTTP(w, r)
+    })}
+    return ll, nil
+}
+
+func (s *Server) startListener(ll *liveListener) {
+    cfg := ll.config()
+    s.spawn("listener", cfg.Name, func() { ll.srv.Serve(ll.ln) })
+    s.log.Info("listener_opened", map[string]interface{}{"name": cfg.Name, "addr": ll.ln.Addr().String(), "role": cfg.role(), "tls": cfg.tls()})
+}
+
+// closeListener stops ll accepting at once and gives its in-flight HTTP
+// requests listenerDrainTimeout to finish.
+func (s *Server) closeListener(ll *liveListener) {
+    ll.ln.Close()
+    cfg := ll.config()
+    s.spawn("listener-drain", cfg.Name, func() {
+        ctx, cancel := context.WithTimeout(context.Background(), listenerDrainTimeout)
+        defer cancel()
+        if ll.srv.Shutdown(ctx) != nil {
+            ll.srv.Close()
+        }
+    })
+    s.log.Info("listener_closed", map[string]interface{}{"name": cfg.Name, "addr": cfg.Addr})
+}
+
+// addListener opens l and starts serving on it.
+func (s *Server) addListener(l Listener, source, remote string) error {
+    set := s.listeners
+    set.mu.Lock()
+    defer set.mu.Unlock()
+    if set.items[l.Name] != nil {
+        return errListenerExists
+    }
+    ll, err := s.openListener(l, source)
+    if err != nil {
+        return err
+    }
+    set.items[l.Name] = ll
+    s.startListener(ll)
+    s.recordAudit(remote, "listener-added", map[string]interface{}{"name": l.Name, "addr": l.Addr, "role": l.role(), "tls": l.tls(), "source": source})
+    return nil
+}
+
+// removeListener closes the listener called name, reporting false when
+// there is none.
+func (s *Server) removeListener(name, remote string) bool {
+    set := s.listeners
+    set.mu.Lock()
+    ll := set.items[name]
+    delete(set.items, name)
+    set.mu.Unlock()
+    if ll == nil {
+        return false
+    }
+    s.closeListener(ll)
+    s.recordAudit(remote, "listener-removed", map[string]interface{}{"name": name})
+    return true
+}
+
+// reconcileListeners makes the configured listeners match want. Every new
+// socket is bound and every certificate loaded before anything changes, so
+// an error leaves the listeners as they were. A listener in want that was
+// added through the admin API becomes a configured one.
+func (s *Server) reconcileListeners(want []Listener) ([]ConfigChange, error) {
+    if err := validateListeners(want); err != nil {
+        return nil, err
+    }
+    set := s.listeners
+    set.mu.Lock()
+    defer set.mu.Unlock()
+    type step struct {
+        old  *liveListener
+        next *liveListener
+        cfg  Listener
+        cert *tls.Certificate
+    }
+    steps := []step{}
+    opened := []*liveListener{}
+    fail := func(err error) ([]ConfigChange, error) {
+        for _, ll := range opened {
+            ll.ln.Close()
+        }
+        return nil, err
+    }
+    wanted := map[string]bool{}
+    for _, l := range want {
+        wanted[l.Name] = true
+        old := set.items[l.Name]
+        if old != nil {
+            cur := old.config()
+            if cur == l {
+                old.source = listenerSourceConfig
+                continue
+            }
+            if cur.Addr == l.Addr {
+                if cur.tls() != l.tls() {
+                    return fail(fmt.Errorf("listener %s: switching %s between TLS and plaintext needs a new listener name", l.Name, l.Addr))
+                }
+                cert, err := loadListenerCert(l)
+                if err != nil {
+                    return fail(err)
+                }
+                steps = append(steps, step{old: old, cfg: l, cert: cert})
+                continue
+            }
+        }
+        ll, err := s.openListener(l, listenerSourceConfig)
+        if err != nil {
+            return fail(err)
+        }
+        opened = append(opened, ll)
+        steps = append(steps, step{old: old, next: ll, cfg: l})
+    }
+    changes := []ConfigChange{}
+    for _, st := range steps {
+        var was interface{}
+        if st.old != nil {
+            was = st.old.config()
+        }
+        changes = append(changes, ConfigChange{Field: "listeners." + st.cfg.Name, Old: was, New: st.cfg})
+        if st.next == nil {
+            st.old.mu.Lock()
+            st.old.cfg, st.old.cert = st.cfg, st.cert
+            st.old.mu.Unlock()
+            st.old.source = listenerSourceConfig
+            continue
+        }
+        set.items[st.cfg.Name] = st.next
+        s.startListener(st.next)
+        if st.old != nil {
+            s.closeListener(st.old)
+        }
+    }
+    for name, ll := range set.items {
+        if ll.source == listenerSourceConfig && !wanted[name] {
+            delete(set.items, name)
+            s.closeListener(ll)
+            changes = append(changes, ConfigChange{Field: "listeners." + name, Old: ll.config(), New: nil})
+        }
+    }
+    return changes, nil
+}
+
+// closeListeners closes every extra listener, for Stop.
+func (s *Server) closeListeners() {
+    set := s.listeners
+    set.mu.Lock()
+    items := set.items
+    set.items = map[string]*liveListener{}
+    set.mu.Unlock()
+    for _, ll := range items {
+        s.closeListener(ll)
+    }
+}
+
+// listenerList describes the main listener and every extra one, by name.
+func (s *Server) listenerList() []map[string]interface{} {
+    out := []map[string]interface{}{}
+    if s.listener != nil {
+        out = append(out, map[string]interface{}{"name": mainListenerName, "addr": s.listener.Addr().String(), "role": listenerRoleAll, "tls": false, "source": listenerSourceConfig, "since": s.startTime})
+    }
+    set := s.listeners
+    set.mu.Lock()
+    extra := make([]map[string]interface{}, 0, len(set.items))
+    for _, ll := range set.items {
+        cfg := ll.config()
+        extra = append(extra, map[string]interface{}{"name": cfg.Name, "addr": ll.ln.Addr().String(), "role": cfg.role(), "tls": cfg.tls(), "source": ll.source, "since": ll.since, "requests": atomic.LoadInt64(&ll.requests), "upgrades": atomic.LoadInt64(&ll.upgrades)})
+    }
+    set.mu.Unlock()
+    sort.Slice(extra, func(i, j int) bool { return extra[i]["name"].(string) < extra[j]["name"].(string) })
+    return append(out, extra...)
+}
+
+func (s *Server) adminListListeners(c *gin.Context) {
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"listeners": s.listenerList()}, s.opts.CORSOrigin)
+}
+
+// adminAddListener opens a listener: {"name": "tls", "addr": ":8443",
+// "certFile": "...", "keyFile": "..."}.
+func (s *Server) adminAddListener(c *gin.Context) {
+    var l Listener
+    dec := json.NewDecoder(c.Request.Body)
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&l); err != nil {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "invalid JSON body"}, s.opts.CORSOrigin)
+        return
+    }
+    if err := s.addListener(l, listenerSourceAdmin, c.ClientIP()); err != nil {
+        status := http.StatusBadRequest
+        if err == errListenerExists {
+            status = http.StatusConflict
+        }
+        writeJSON(c.Writer, status, map[string]interface{}{"error": err.Error()}, s.opts.CORSOrigin)
+        return
+    }
+    writeJSON(c.Writer, http.StatusCreated, map[string]interface{}{"listeners": s.listenerList()}, s.opts.CORSOrigin)
+}
+
+func (s *Server) adminRemoveListener(c *gin.Context) {
+    if !s.removeListener(c.Param("name"), c.ClientIP()) {
+        writeJSON(c.Writer, http.StatusNotFound, map[string]interface{}{"error": "no such listener"}, s.opts.CORSOrigin)
+        return
+    }
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"removed": c.Param("name")}, s.opts.CORSOrigin)
+}
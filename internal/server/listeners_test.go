@@ -0,0 +1,112 @@
+package server
+
+import (
+    "crypto/tls"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestListenersChangeWithoutRestart(t *testing.T) {
+    certFile, keyFile := writeTestCert(t)
+    s := NewServer(Options{MaxConnections: 10, AdminToken: "adm"})
+    gin.SetMode(gin.TestMode)
+    s.running = true
+    s.routes()
+    defer s.closeListeners()
+    addr := func(name string) string {
+        for _, l := range s.listenerList() {
+            if l["name"] == name {
+                return l["addr"].(string)
+            }
+        }
+        return ""
+    }
+    plain := Listener{Name: "plain", Addr: "127.0.0.1:0"}
+    secure := Listener{Name: "tls", Addr: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile}
+    if changes, err := s.Reconfigure(ConfigUpdate{Listeners: &[]Listener{plain, secure}}, "test", ""); err != nil || len(changes) != 2 {
+        t.Fatalf("opening listeners: %v %v", changes, err)
+    }
+    a, b := randomPeerId(), randomPeerId()
+    ca, _, err := websocket.DefaultDialer.Dial("ws://"+addr("plain")+"/ws?peerId="+a, nil)
+    if err != nil {
+        t.Fatalf("dial plain: %v", err)
+    }
+    defer ca.Close()
+    tlsDialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+    cb, _, err := tlsDialer.Dial("wss://"+addr("tls")+"/ws?peerId="+b, nil)
+    if err != nil {
+        t.Fatalf("dial tls: %v", err)
+    }
+    defer cb.Close()
+    waitFor(t, "both peers", func() bool { return s.getConn(a) != nil && s.getConn(b) != nil })
+
+    // A role change takes effect in place, on the same address.
+    before := addr("plain")
+    meshOnly := Listener{Name: "plain", Addr: "127.0.0.1:0", Role: listenerRoleMesh}
+    if changes, err := s.Reconfigure(ConfigUpdate{Listeners: &[]Listener{meshOnly, secure}}, "test", ""); err != nil || len(changes) != 1 || changes[0].Field != "listeners.plain" {
+        t.Fatalf("changing role: %v %v", changes, err)
+    }
+    if addr("plain") != before {
+        t.Fatalf("a role change should not rebind")
+    }
+    if _, res, err := websocket.DefaultDialer.Dial("ws://"+before+"/ws?peerId="+randomPeerId(), nil); err == nil || res == nil || res.StatusCode != http.StatusNotFound {
+        t.Fatalf("a mesh listener should not serve /ws")
+    }
+    if res, err := http.Get("http://" + before + "/health"); err != nil || res.StatusCode != http.StatusOK {
+        t.Fatalf("a mesh listener should serve /health: %v", err)
+    }
+
+    // Listeners added through the admin API survive reloads.
+    call := func(method, path, body string) int {
+        req := httptest.NewRequest(method, path, strings.NewReader(body))
+        req.Header.Set("Authorization", "Bearer adm")
+        rec := httptest.NewRecorder()
+        s.engine.ServeHTTP(rec, req)
+        return rec.Code
+    }
+    if code := call("POST", "/admin/listeners", `{"name":"extra","addr":"127.0.0.1:0"}`); code != http.StatusCreated {
+        t.Fatalf("adding a listener: %d", code)
+    }
+    if code := call("POST", "/admin/listeners", `{"name":"extra","addr":"127.0.0.1:0"}`); code != http.StatusConflict {
+        t.Fatalf("a duplicate name should be refused, got %d", code)
+    }
+
+    // A bind failure changes nothing.
+    busy := Listener{Name: "busy", Addr: before}
+    if _, err := s.Reconfigure(ConfigUpdate{Listeners: &[]Listener{meshOnly, busy}}, "test", ""); err == nil {
+        t.Fatalf("binding a busy address should fail")
+    }
+    if addr("tls") == "" || addr("busy") != "" {
+        t.Fatalf("a failed reload should leave listeners alone: %v", s.listenerList())
+    }
+
+    // Dropping the TLS listener stops it accepting but keeps its peer.
+    tlsAddr := addr("tls")
+    if _, err := s.Reconfigure(ConfigUpdate{Listeners: &[]Listener{meshOnly}}, "test", ""); err != nil {
+        t.Fatalf("closing tls: %v", err)
+    }
+    if _, _, err := tlsDialer.Dial("wss://"+tlsAddr+"/ws?peerId="+randomPeerId(), nil); err == nil {
+        t.Fatalf("a closed listener should refuse connections")
+    }
+    if addr("extra") == "" {
+        t.Fatalf("a reload should not close admin listeners")
+    }
+    cb.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "moved", "data": map[string]interface{}{}})
+    waitFor(t, "announce over the closed listener's connection", func() bool { pi := s.getPeerInfo(b); return pi != nil && pi.Announced })
+
+    if code := call("DELETE", "/admin/listeners/extra", ""); code != http.StatusOK {
+        t.Fatalf("removing a listener: %d", code)
+    }
+    if code := call("DELETE", "/admin/listeners/extra", ""); code != http.StatusNotFound {
+        t.Fatalf("removing it twice: %d", code)
+    }
+    for _, l := range s.listenerList() {
+        if l["name"] == "plain" && l["upgrades"].(int64) < 1 {
+            t.Fatalf("upgrades should be counted per listener: %v", l)
+        }
+    }
+}
@@ -0,0 +1,93 @@
+package server
+
+import "sync/atomic"
+
+// Every message a hub forwards across the mesh carries the hub it originated
+// on and the hubs it has already passed through. A hub drops messages that
+// list itself and never forwards toward a hub already on the list, so meshes
+// of three or more hubs do not echo discoveries back and forth.
+//
+// Discoveries and disconnects also carry a message ID, which each hub
+// remembers for a while and drops when it comes round again by another path,
+// so each one reaches every hub once. Every message counts the links it has
+// crossed in "hops" and stops being forwarded after MeshMaxHops. Drops are
+// counted under "mesh_dedup" in /metrics.
+
+// meshDedup counts mesh messages dropped as repeats or for running out of
+// hops.
+type meshDedup struct {
+    duplicates int64
+    expired    int64
+}
+
+func stampSeen(seen []string, hubId string) []string {
+    out := append([]string{}, seen...)
+    if hubId != "" && !containsHub(seen, hubId) {
+        out = append(out, hubId)
+    }
+    return out
+}
+
+func containsHub(seen []string, hubId string) bool {
+    if hubId == "" {
+        return false
+    }
+    for _, id := range seen {
+        if id == hubId {
+            return true
+        }
+    }
+    return false
+}
+
+// firstSighting reports whether this hub has not yet handled the mesh
+// message kind with msg's ID, counting the repeats. Messages from hubs that
+// predate message IDs carry none and are let through.
+func (s *Server) firstSighting(kind string, msg inboundMessage) bool {
+    if msg.MessageId == "" || s.markRelayed(kind+":"+msg.MessageId) {
+        return true
+    }
+    atomic.AddInt64(&s.meshDedup.duplicates, 1)
+    return false
+}
+
+func (s *Server) meshDedupSnapshot() map[string]interface{} {
+    return map[string]interface{}{"duplicates": atomic.LoadInt64(&s.meshDedup.duplicates), "ttl_expired": atomic.LoadInt64(&s.meshDedup.expired), "max_hops": s.opts.MeshMaxHops}
+}
+
+// alreadyVisited reports whether a mesh message has passed through this hub.
+func (s *Server) alreadyVisited(msg inboundMessage) bool {
+    return (s.hubPeerId != "" && msg.OriginHub == s.hubPeerId) || containsHub(msg.SeenHubs, s.hubPeerId)
+}
+
+// forwardToMesh stamps msg with this hub and another hop and sends it to every
+// bootstrap link and inbound hub not already on its path. excludeUri/excludeHubPeerId name the
+// link it arrived on, for peers that predate stamping.
+func (s *Server) forwardToMesh(msg outboundMessage, excludeUri, excludeHubPeerId string) {
+    if msg.OriginHub == "" {
+        msg.OriginHub = s.hubPeerId
+    }
+    msg.Hops++
+    if msg.Hops > s.opts.MeshMaxHops {
+        atomic.AddInt64(&s.meshDedup.expired, 1)
+        return
+    }
+    msg.SeenHubs = stampSeen(msg.SeenHubs, s.hubPeerId)
+
+    s.bootstrapMu.Lock()
+    for uri, b := range s.bootstrapConns {
+        if uri == excludeUri || !b.connected || b.ws == nil || containsHub(msg.SeenHubs, b.hubId) {
+            continue
+        }
+        s.sendToHub(b.ws, b.features, msg)
+    }
+    s.bootstrapMu.Unlock()
+
+    // Also send to hubs that are connected inbound (not represented in bootstrapConns).
+    for _, h := range s.getHubPeerLinks(excludeHubPeerId) {
+        if containsHub(msg.SeenHubs, h.id) {
+            continue
+        }
+        s.sendToHub(h.conn, h.features, msg)
+    }
+}
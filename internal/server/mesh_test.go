@@ -0,0 +1,96 @@
+package server
+
+import (
+    "encoding/json"
+    "testing"
+    "time"
+)
+
+func TestMeshStampingStopsLoops(t *testing.T) {
+    s := NewServer(Options{})
+    s.hubPeerId = "hub-b"
+    seen := stampSeen([]string{"hub-a"}, s.hubPeerId)
+    if len(seen) != 2 || !containsHub(seen, "hub-b") {
+        t.Fatalf("expected hub-b appended, got %v", seen)
+    }
+    if len(stampSeen(seen, "hub-b")) != 2 {
+        t.Fatalf("stamping twice should not duplicate")
+    }
+    if s.alreadyVisited(inboundMessage{OriginHub: "hub-a", SeenHubs: []string{"hub-a"}}) {
+        t.Fatalf("message from hub-a has not visited hub-b")
+    }
+    if !s.alreadyVisited(inboundMessage{OriginHub: "hub-a", SeenHubs: seen}) {
+        t.Fatalf("message that passed through hub-b should be dropped")
+    }
+}
+
+func TestMeshDeliversEachDiscoveryOnceWithinHopLimit(t *testing.T) {
+    s := NewServer(Options{IsHub: true, MeshMaxHops: 3})
+    s.hubPeerId = "hub-b"
+    local, hubA, hubC, origin := randomPeerId(), randomPeerId(), randomPeerId(), randomPeerId()
+    conns := attachTestPeers(t, s, local, hubA, hubC)
+    for _, id := range []string{local, hubA, hubC} {
+        s.peerData[id].IsHub = id != local
+        if id != local {
+            s.hubs[id] = &hubInfo{PeerId: id}
+        }
+    }
+    s.handleMessage(local, []byte(`{"type":"announce","networkName":"n","data":{}}`))
+    for _, c := range conns {
+        c.take(20 * time.Millisecond)
+    }
+    count := func(id, typ string) []map[string]interface{} {
+        msgs, _ := conns[id].take(20 * time.Millisecond)
+        out := []map[string]interface{}{}
+        for _, raw := range msgs {
+            var m map[string]interface{}
+            json.Unmarshal(raw, &m)
+            if m["type"] == typ {
+                out = append(out, m)
+            }
+        }
+        return out
+    }
+    discovered := func(peerId, msgId string, hops int, seen ...string) inboundMessage {
+        return inboundMessage{Type: "peer-discovered", NetworkName: "n", Data: map[string]interface{}{"peerId": peerId}, MessageId: msgId, OriginHub: origin, SeenHubs: seen, Hops: hops}
+    }
+
+    // The first copy is delivered locally and forwarded with another hop.
+    remote := randomPeerId()
+    s.handlePeerDiscovered(hubA, discovered(remote, "m1", 1, origin))
+    if got := count(local, "peer-discovered"); len(got) != 1 {
+        t.Fatalf("local peer should be told once, got %d", len(got))
+    }
+    if fwd := count(hubC, "peer-discovered"); len(fwd) != 1 || fwd[0]["hops"] != float64(2) || fwd[0]["messageId"] != "m1" {
+        t.Fatalf("discovery should be forwarded with its ID and a hop added, got %v", fwd)
+    }
+    // The same discovery arriving by another path is dropped, even though
+    // its path does not include this hub.
+    s.bootstrapMu.Lock()
+    delete(s.crossHubCache["n"], remote)
+    s.bootstrapMu.Unlock()
+    s.handlePeerDiscovered(hubC, discovered(remote, "m1", 2, origin, "hub-d"))
+    if len(count(local, "peer-discovered")) != 0 || len(count(hubA, "peer-discovered")) != 0 {
+        t.Fatalf("a repeated discovery should go nowhere")
+    }
+
+    // A discovery that has used up its hops is delivered but not forwarded.
+    s.handlePeerDiscovered(hubA, discovered(randomPeerId(), "m2", 3, origin))
+    if len(count(local, "peer-discovered")) != 1 || len(count(hubC, "peer-discovered")) != 0 {
+        t.Fatalf("a discovery at the hop limit should stop here")
+    }
+
+    // Disconnects are deduplicated the same way.
+    gone := inboundMessage{Type: "peer-disconnected", NetworkName: "n", Data: map[string]interface{}{"peerId": remote, "reason": reasonClientGoodbye}, MessageId: "m3", OriginHub: origin, SeenHubs: []string{origin}, Hops: 1}
+    s.bootstrapMu.Lock()
+    s.crossHubCache["n"][remote] = map[string]interface{}{}
+    s.bootstrapMu.Unlock()
+    s.handleRemoteDisconnect(hubA, "", gone)
+    s.handleRemoteDisconnect(hubC, "", gone)
+    if len(count(local, "peer-disconnected")) != 1 || len(count(hubC, "peer-disconnected")) != 1 {
+        t.Fatalf("a disconnect should be delivered and forwarded once")
+    }
+    if snap := s.meshDedupSnapshot(); snap["duplicates"] != int64(2) || snap["ttl_expired"] != int64(1) {
+        t.Fatalf("unexpected dedup counts %v", snap)
+    }
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+    "sync/atomic"
+    "github.com/gorilla/websocket"
+)
+
+// Mesh link encoding. Go hubs advertise featureMsgpackMesh, and a hub link
+// where both ends do switches to MessagePack binary frames once the feature
+// sets have been exchanged; links to JS hubs, which do not advertise it, stay
+// JSON. The choice is made per link. The dialing hub switches when the
+// connected greeting arrives, the accepting one when the dialer's hub
+// announce registers it; the dialer's announce is written before anything it
+// sends after the greeting, so binary frames never arrive before the other
+// end expects them. A hub with an identity key (HubKeyPath) does not
+// advertise the feature, since mesh signatures cover the exact JSON bytes of
+// data, which a MessagePack round trip does not keep. Each link's encoding
+// is shown in /hubstats, and frames and bytes sent and received per encoding
+// are under "mesh_encoding" in /metrics.
+const (
+    featureMsgpackMesh = "msgpack-mesh"
+
+    meshEncodingJSON    = "json"
+    meshEncodingMsgpack = "msgpack"
+)
+
+type meshEncodingStats struct {
+    jsonSent      int64
+    jsonSentBytes int64
+    jsonRecv      int64
+    jsonRecvBytes int64
+    binSent       int64
+    binSentBytes  int64
+    binRecv       int64
+    binRecvBytes  int64
+}
+
+// isMeshLink reports whether conn is a link to another hub.
+func isMeshLink(conn peerConn) bool {
+    wc, ok := conn.(*wsPeerConn)
+    return ok && (wc.bootstrap || atomic.LoadInt32(&wc.hub) == 1)
+}
+
+// linkEncoding names the encoding a hub link writes.
+func linkEncoding(conn peerConn) string {
+    if isBinaryConn(conn) {
+        return meshEncodingMsgpack
+    }
+    return meshEncodingJSON
+}
+
+// upgradeMeshLink marks conn as a hub link and switches it to MessagePack
+// when shared includes featureMsgpackMesh.
+func (s *Server) upgradeMeshLink(conn peerConn, shared []string) {
+    wc, ok := conn.(*wsPeerConn)
+    if !ok {
+        return
+    }
+    atomic.StoreInt32(&wc.hub, 1)
+    if hasFeature(shared, featureMsgpackMesh) && atomic.SwapInt32(&wc.binary, 1) == 0 && s.verbose() {
+        s.log.Info("mesh_link_binary", map[string]interface{}{"link": wc.owner})
+    }
+}
+
+// countMeshFrame records a frame sent or received on a hub link.
+func (s *Server) countMeshFrame(sent bool, messageType, n int) {
+    m := s.meshEncoding
+    frames, bytes := &m.jsonRecv, &m.jsonRecvBytes
+    switch {
+    case sent && messageType == websocket.BinaryMessage:
+        frames, bytes = &m.binSent, &m.binSentBytes
+    case sent:
+        frames, bytes = &m.jsonSent, &m.jsonSentBytes
+    case messageType == websocket.BinaryMessage:
+        frames, bytes = &m.binRecv, &m.binRecvBytes
+    }
+    atomic.AddInt64(frames, 1)
+    atomic.AddInt64(bytes, int64(n))
+}
+
+func (s *Server) meshEncodingSnapshot() map[string]interface{} {
+    m := s.meshEncoding
+    links := map[string]int{meshEncodingJSON: 0, meshEncodingMsgpack: 0}
+    s.bootstrapMu.Lock()
+    for _, b := range s.bootstrapConns {
+        if b.connected && b.ws != nil {
+            links[linkEncoding(b.ws)]++
+        }
+    }
+    s.bootstrapMu.Unlock()
+    for _, h := range s.getConnectedHubs() {
+        if conn := s.getConn(h.PeerId); conn != nil {
+            links[linkEncoding(conn)]++
+        }
+    }
+    return map[string]interface{}{
+        "links": links,
+        meshEncodingJSON: map[string]interface{}{
+            "frames_sent":     atomic.LoadInt64(&m.jsonSent),
+            "bytes_sent":      atomic.LoadInt64(&m.jsonSentBytes),
+            "frames_received": atomic.LoadInt64(&m.jsonRecv),
+            "bytes_received":  atomic.LoadInt64(&m.jsonRecvBytes),
+        },
+        meshEncodingMsgpack: map[string]interface{}{
+            "frames_sent":     atomic.LoadInt64(&m.binSent),
+            "bytes_sent":      atomic.LoadInt64(&m.binSentBytes),
+            "frames_received": atomic.LoadInt64(&m.binRecv),
+            "bytes_received":  atomic.LoadInt64(&m.binRecvBytes),
+        },
+    }
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestMeshLinksUpgradeToMsgpackOnlyBetweenGoHubs(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    a := NewServer(Options{IsHub: true, MaxConnections: 10, MeshToken: "mesh-secret"})
+    a.running = true
+    a.routes()
+    ts := httptest.NewServer(a.engine)
+    defer ts.Close()
+    base := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+    b := NewServer(Options{IsHub: true, MaxConnections: 10, MeshToken: "mesh-secret"})
+    b.running = true
+    b.connectToHub(base+"/mesh", 0)
+    defer b.disconnectBootstrap()
+    waitFor(t, "a to register b", func() bool { pi := a.getPeerInfo(b.hubPeerId); return pi != nil && pi.Announced })
+
+    // A JS hub announces without msgpack-mesh and must keep getting JSON.
+    jsHub := randomPeerId()
+    js, _, err := websocket.DefaultDialer.Dial(base+"/ws?peerId="+jsHub+"&meshToken=mesh-secret", nil)
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    defer js.Close()
+    js.WriteJSON(map[string]interface{}{"type": "announce", "networkName": a.opts.HubMeshNamespace, "data": map[string]interface{}{"isHub": true, "features": []string{featureSignaling, featureRelay}}})
+    waitFor(t, "a to register the JS hub", func() bool { pi := a.getPeerInfo(jsHub); return pi != nil && pi.IsHub && pi.Announced })
+
+    peer := randomPeerId()
+    c, _, err := websocket.DefaultDialer.Dial(base+"/ws?peerId="+peer, nil)
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    defer c.Close()
+    c.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "lobby", "data": map[string]interface{}{"nick": "ada"}})
+    waitFor(t, "gossip over the msgpack link", func() bool { return b.isCrossHubPeerCached("lobby", peer) })
+
+    js.SetReadDeadline(time.Now().Add(2 * time.Second))
+    for {
+        kind, data, err := js.ReadMessage()
+        if err != nil {
+            t.Fatalf("JS hub never heard of %s: %v", peer, err)
+        }
+        if kind != websocket.TextMessage {
+            t.Fatalf("JS hub got a binary frame")
+        }
+        if strings.Contains(string(data), peer) {
+            break
+        }
+    }
+
+    bs := b.getHubStats()["bootstrapHubs"].([]map[string]interface{})
+    if len(bs) != 1 || bs[0]["encoding"] != meshEncodingMsgpack {
+        t.Fatalf("b's bootstrap link should be msgpack, got %v", bs)
+    }
+    encodings := map[string]string{}
+    for _, h := range a.getHubStats()["hubs"].([]hubInfo) {
+        encodings[h.PeerId] = h.Encoding
+    }
+    if encodings[b.hubPeerId] != meshEncodingMsgpack || encodings[jsHub] != meshEncodingJSON {
+        t.Fatalf("unexpected link encodings on a %v", encodings)
+    }
+
+    snap := a.meshEncodingSnapshot()
+    links := snap["links"].(map[string]int)
+    sent := snap[meshEncodingMsgpack].(map[string]interface{})
+    if links[meshEncodingMsgpack] != 1 || links[meshEncodingJSON] != 1 || sent["frames_sent"].(int64) == 0 || sent["bytes_sent"].(int64) == 0 {
+        t.Fatalf("unexpected mesh encoding stats on a %v", snap)
+    }
+    if recv := b.meshEncodingSnapshot()[meshEncodingMsgpack].(map[string]interface{}); recv["frames_received"].(int64) == 0 {
+        t.Fatalf("b should count the msgpack frames it read %v", recv)
+    }
+    if a.binarySnapshot()["sent"] != int64(0) {
+        t.Fatalf("hub links should not count as binary clients")
+    }
+
+    signer := NewServer(Options{IsHub: true, HubKeyPath: "hub-key.json", Store: &memStore{docs: map[string][]byte{}}})
+    if hasFeature(signer.features(), featureMsgpackMesh) || !hasFeature(a.features(), featureMsgpackMesh) {
+        t.Fatalf("only hubs that do not sign should offer msgpack-mesh")
+    }
+}
@@ -0,0 +1,316 @@
+package server
+
+import (
+    "net"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "sync"
+    "github.com/gin-gonic/gin"
+)
+
+// Mesh membership. Every hub keeps a table of the other hubs it has heard
+// of: its bootstrap links, hubs linked to it, hubs announced to it in
+// peer-discovered (isHub) gossip and hubs whose hub-summary reached it. The
+// summary, gossiped every 15 seconds, carries the hub's URL (PublicURL, or
+// ws://Host:Port/mesh when Host is a concrete address), and so does its
+// announce. A member is alive while it is linked to this hub or its summary
+// keeps arriving; one not heard from for a minute expires. A hub that shuts
+// down floods mesh-leave first, so the others drop it at once.
+//
+// With MeshAutoDial set, the hub also dials the members it learns about, up
+// to MeshMaxDialed links, so the mesh grows beyond the static BootstrapHubs
+// list and heals when hubs come and go. To avoid two hubs dialing each other
+// at once, a hub only dials members whose hub peer ID sorts above its own, so
+// enable it on every hub. Auto-dialed links reconnect like bootstrap links
+// and are closed when their member leaves or expires. The table is at
+// /admin/mesh-members and its counts under "mesh_membership" in /metrics.
+const (
+    memberSourceBootstrap  = "bootstrap"
+    memberSourceLink       = "link"
+    memberSourceDiscovered = "discovered"
+    memberSourceGossip     = "gossip"
+)
+
+// MeshMember is one hub in this hub's membership table.
+type MeshMember struct {
+    HubId     string `json:"hubId"`
+    URL       string `json:"url,omitempty"`
+    Source    string `json:"source"`
+    FirstSeen int64  `json:"firstSeen"`
+    LastSeen  int64  `json:"lastSeen"`
+    Dialed    bool   `json:"dialed"`
+    Linked    bool   `json:"linked"`
+}
+
+type meshMembership struct {
+    mu      sync.Mutex
+    members map[string]*MeshMember
+    joined  int64
+    left    int64
+    expired int64
+    dials   int64
+}
+
+func newMeshMembership() *meshMembership {
+    return &meshMembership{members: map[string]*MeshMember{}}
+}
+
+// advertisedURL is the URL other hubs should dial to reach this one, or ""
+// when it has none.
+func (s *Server) advertisedURL() string {
+    if s.opts.PublicURL != "" {
+        return s.opts.PublicURL
+    }
+    return meshURL(s.opts.Host, s.port)
+}
+
+// meshURL builds a /mesh URL from a host and port, refusing wildcard
+// addresses nobody can dial.
+func meshURL(host string, port int) string {
+    if host == "" || port <= 0 {
+        return ""
+    }
+    if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+        return ""
+    }
+    return "ws://" + net.JoinHostPort(host, strconv.Itoa(port)) + "/mesh"
+}
+
+// memberURL reads the URL a hub advertised in its announce data.
+func memberURL(data map[string]interface{}) string {
+    if raw, ok := data["url"].(string); ok {
+        if u, err := url.Parse(raw); err == nil && (u.Scheme == "ws" || u.Scheme == "wss") && u.Host != "" {
+            return raw
+        }
+        return ""
+    }
+    host, _ := data["host"].(string)
+    port, _ := data["port"].(float64)
+    return meshURL(host, int(port))
+}
+
+// learnMember records that hubId is part of the mesh, reachable at uri if
+// that is known, and dials it when it should.
+func (s *Server) learnMember(hubId, uri, source string) {
+    if hubId == "" || hubId == s.hubPeerId {
+        return
+    }
+    m := s.members
+    now := nowMs()
+    m.mu.Lock()
+    mem := m.members[hubId]
+    joined := mem == nil
+    if joined {
+        mem = &MeshMember{HubId: hubId, Source: source, FirstSeen: now}
+        m.members[hubId] = mem
+        m.joined++
+    }
+    mem.LastSeen = now
+    if uri != "" {
+        mem.URL = uri
+    }
+    m.mu.Unlock()
+    if joined {
+        s.log.Info("mesh_member_joined", map[string]interface{}{"hubPeerId": hubId, "url": uri, "source": source})
+        s.emitMeshEvent("mesh.member-joined", map[string]interface{}{"hubId": hubId, "url": uri, "source": source})
+    }
+    s.dialMembers()
+}
+
+// forgetMember drops a hub that left or expired and closes the link this
+// hub dialed to it, if any.
+func (s *Server) forgetMember(hubId, reason string) {
+    m := s.members
+    m.mu.Lock()
+    mem := m.members[hubId]
+    if mem == nil {
+        m.mu.Unlock()
+        return
+    }
+    delete(m.members, hubId)
+    if reason == reasonHubShutdown {
+        m.left++
+    } else {
+        m.expired++
+    }
+    dialed, uri := mem.Dialed, mem.URL
+    m.mu.Unlock()
+    s.meshStats.mu.Lock()
+    delete(s.meshStats.hubs, hubId)
+    s.meshStats.mu.Unlock()
+    if dialed {
+        s.bootstrapMu.Lock()
+        b := s.bootstrapConns[uri]
+        delete(s.bootstrapConns, uri)
+        s.bootstrapMu.Unlock()
+        if b != nil {
+            if b.reconnectTimer != nil {
+                b.reconnectTimer.Stop()
+            }
+            if b.ws != nil {
+                b.ws.Close()
+            }
+        }
+    }
+    s.log.Info("mesh_member_left", map[string]interface{}{"hubPeerId": hubId, "url": uri, "reason": reason})
+    s.emitMeshEvent("mesh.member-left", map[string]interface{}{"hubId": hubId, "url": uri, "reason": reason})
+}
+
+// linkedHubs returns the hubs this hub has a link to, by hub peer ID, and
+// the URIs it dials.
+func (s *Server) linkedHubs() (map[string]bool, map[string]bool) {
+    ids, uris := map[string]bool{}, map[string]bool{}
+    s.bootstrapMu.Lock()
+    for uri, b := range s.bootstrapConns {
+        uris[uri] = true
+        if b.connected && b.hubId != "" {
+            ids[b.hubId] = true
+        }
+    }
+    s.bootstrapMu.Unlock()
+    s.hubsMu.Lock()
+    for id := range s.hubs {
+        ids[id] = true
+    }
+    s.hubsMu.Unlock()
+    return ids, uris
+}
+
+// dialMembers dials members this hub should link to but has no link with.
+func (s *Server) dialMembers() {
+    if !s.opts.MeshAutoDial || !s.running {
+        return
+    }
+    ids, uris := s.linkedHubs()
+    m := s.members
+    m.mu.Lock()
+    candidates := make([]*MeshMember, 0, len(m.members))
+    dialed := 0
+    for _, mem := range m.members {
+        if mem.Dialed && s.hasBootstrap(mem.URL) {
+            dialed++
+            continue
+        }
+        mem.Dialed = false
+        if mem.URL != "" && mem.HubId > s.hubPeerId && !ids[mem.HubId] && !uris[mem.URL] {
+            candidates = append(candidates, mem)
+        }
+    }
+    sort.Slice(candidates, func(i, j int) bool { return candidates[i].HubId < candidates[j].HubId })
+    dial := []string{}
+    for _, mem := range candidates {
+        if dialed >= s.opts.MeshMaxDialed {
+            break
+        }
+        if !s.claimBootstrap(mem.URL) {
+            continue
+        }
+        mem.Dialed = true
+        dialed++
+        m.dials++
+        dial = append(dial, mem.URL)
+    }
+    m.mu.Unlock()
+    for _, uri := range dial {
+        uri := uri
+        s.spawn("mesh-dial", uri, func() { s.connectToHub(uri, 0) })
+    }
+}
+
+func (s *Server) hasBootstrap(uri string) bool {
+    s.bootstrapMu.Lock()
+    defer s.bootstrapMu.Unlock()
+    return s.bootstrapConns[uri] != nil
+}
+
+// claimBootstrap adds a placeholder link for uri, so a second pass does not
+// dial it again while the first is still connecting. It reports false when
+// there already is one.
+func (s *Server) claimBootstrap(uri string) bool {
+    s.bootstrapMu.Lock()
+    defer s.bootstrapMu.Unlock()
+    if s.bootstrapConns[uri] != nil {
+        return false
+    }
+    s.bootstrapConns[uri] = &bootstrapConn{uri: uri, lastAttempt: nowMs()}
+    return true
+}
+
+// maintainMesh refreshes linked members, expires the ones not heard from
+// and dials any that are missing.
+func (s *Server) maintainMesh() {
+    ids, _ := s.linkedHubs()
+    now := nowMs()
+    expired := []string{}
+    m := s.members
+    m.mu.Lock()
+    for id, mem := range m.members {
+        if ids[id] {
+            mem.LastSeen = now
+        } else if now-mem.LastSeen > meshStatsTTL.Milliseconds() {
+            expired = append(expired, id)
+        }
+    }
+    m.mu.Unlock()
+    for _, id := range expired {
+        s.forgetMember(id, "expired")
+    }
+    s.dialMembers()
+}
+
+// announceMeshLeave tells the mesh this hub is going away.
+func (s *Server) announceMeshLeave() {
+    id := newMessageId()
+    s.markRelayed("mesh-leave:" + id)
+    s.forwardToMesh(outboundMessage{Type: "mesh-leave", Data: map[string]interface{}{"hubId": s.hubPeerId}, FromPeerId: "system", Timestamp: nowMs(), MessageId: id}, "", "")
+}
+
+// handleMeshLeave drops a hub that announced it is shutting down and passes
+// the news on.
+func (s *Server) handleMeshLeave(fromHub, fromUri string, msg inboundMessage) {
+    if msg.MessageId == "" || s.alreadyVisited(msg) || !s.markRelayed("mesh-leave:"+msg.MessageId) {
+        return
+    }
+    m, _ := msg.Data.(map[string]interface{})
+    hubId, _ := m["hubId"].(string)
+    if hubId == "" || hubId == s.hubPeerId {
+        return
+    }
+    s.forgetMember(hubId, reasonHubShutdown)
+    s.forwardToMesh(outboundMessage{Type: "mesh-leave", Data: msg.Data, FromPeerId: "system", Timestamp: nowMs(), MessageId: msg.MessageId, OriginHub: msg.OriginHub, SeenHubs: msg.SeenHubs, Hops: msg.Hops}, fromUri, fromHub)
+}
+
+// meshMembers lists the membership table, sorted by hub peer ID.
+func (s *Server) meshMembers() []MeshMember {
+    ids, _ := s.linkedHubs()
+    m := s.members
+    m.mu.Lock()
+    out := make([]MeshMember, 0, len(m.members))
+    for id, mem := range m.members {
+        cp := *mem
+        cp.Linked = ids[id]
+        out = append(out, cp)
+    }
+    m.mu.Unlock()
+    sort.Slice(out, func(i, j int) bool { return out[i].HubId < out[j].HubId })
+    return out
+}
+
+func (s *Server) adminMeshMembers(c *gin.Context) {
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"hubPeerId": s.hubPeerId, "url": s.advertisedURL(), "members": s.meshMembers()}, s.opts.CORSOrigin)
+}
+
+func (s *Server) membershipSnapshot() map[string]interface{} {
+    m := s.members
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    dialed := 0
+    for _, mem := range m.members {
+        if mem.Dialed {
+            dialed++
+        }
+    }
+    return map[string]interface{}{"auto_dial": s.opts.MeshAutoDial, "members": len(m.members), "dialed": dialed, "joined": m.joined, "left": m.left, "expired": m.expired, "dials": m.dials}
+}
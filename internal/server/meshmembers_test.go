@@ -0,0 +1,75 @@
+package server
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/gin-gonic/gin"
+)
+
+func TestMeshGrowsFromDiscoveredHubs(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    start := func() (*Server, string) {
+        s := NewServer(Options{IsHub: true, MaxConnections: 10, MeshAutoDial: true, MeshToken: "mesh-secret"})
+        s.running = true
+        s.routes()
+        ts := httptest.NewServer(s.engine)
+        t.Cleanup(ts.Close)
+        s.opts.PublicURL = "ws" + strings.TrimPrefix(ts.URL, "http") + "/mesh"
+        return s, s.opts.PublicURL
+    }
+    a, uriA := start()
+    b, _ := start()
+    c, _ := start()
+    defer b.disconnectBootstrap()
+    defer c.disconnectBootstrap()
+    b.connectToHub(uriA, 0)
+    c.connectToHub(uriA, 0)
+
+    // b and c only know a, but learn each other from a's discovery gossip
+    // and the lower hub ID dials the higher one.
+    low, high := b, c
+    if high.hubPeerId < low.hubPeerId {
+        low, high = high, low
+    }
+    waitFor(t, "b and c to link directly", func() bool {
+        pi := high.getPeerInfo(low.hubPeerId)
+        return pi != nil && pi.IsHub
+    })
+    if high.hasBootstrap(low.opts.PublicURL) {
+        t.Fatalf("only the lower hub ID should dial")
+    }
+    for _, s := range []*Server{a, b, c} {
+        if n := len(s.meshMembers()); n != 2 {
+            t.Fatalf("every hub should know the other two, %s knows %d", s.hubPeerId, n)
+        }
+    }
+    if snap := low.membershipSnapshot(); snap["dialed"] != 1 {
+        t.Fatalf("unexpected membership counts %v", snap)
+    }
+
+    // A hub that leaves is dropped everywhere at once, and the link dialed
+    // to it is closed.
+    high.announceMeshLeave()
+    waitFor(t, "the leaving hub to be forgotten", func() bool {
+        return len(a.meshMembers()) == 1 && len(low.meshMembers()) == 1 && !low.hasBootstrap(high.opts.PublicURL)
+    })
+    if a.membershipSnapshot()["left"] != int64(1) {
+        t.Fatalf("leave should be counted")
+    }
+
+    // A member not heard from within the TTL expires; a linked one stays.
+    low.learnMember(randomPeerId(), "", memberSourceGossip)
+    low.members.mu.Lock()
+    for _, mem := range low.members.members {
+        mem.LastSeen = nowMs() - meshStatsTTL.Milliseconds() - 1
+    }
+    low.members.mu.Unlock()
+    low.maintainMesh()
+    if members := low.meshMembers(); len(members) != 1 || members[0].HubId != a.hubPeerId || !members[0].Linked {
+        t.Fatalf("only the silent unlinked member should expire, got %+v", members)
+    }
+    if snap := low.membershipSnapshot(); snap["expired"] != int64(1) {
+        t.Fatalf("unexpected expiry counts %v", snap)
+    }
+}
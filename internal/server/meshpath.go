@@ -0,0 +1,129 @@
+package server
+
+import (
+    "net/http"
+    "net/url"
+    "strings"
+    "sync/atomic"
+    "github.com/gin-gonic/gin"
+)
+
+// Connection paths. Hub links may use /mesh, which has its own token and
+// connection limit, so operators can firewall mesh traffic separately and the
+// hub knows a link is a hub before it announces.
+const (
+    pathWS   = "ws"
+    pathPoll = "poll"
+    pathMesh = "mesh"
+    pathGRPC = "grpc"
+)
+
+type pathStats struct {
+    active   int64
+    opened   int64
+    rejected int64
+    messages int64
+}
+
+func newPathStats() map[string]*pathStats {
+    return map[string]*pathStats{pathWS: {}, pathPoll: {}, pathMesh: {}, pathGRPC: {}}
+}
+
+// connPath names the path an HTTP connection request arrived on.
+func connPath(c *gin.Context) string {
+    switch c.FullPath() {
+    case "/mesh":
+        return pathMesh
+    case "/poll/connect":
+        return pathPoll
+    }
+    return pathWS
+}
+
+func (s *Server) pathSnapshot() map[string]interface{} {
+    out := map[string]interface{}{}
+    for name, st := range s.paths {
+        out[name] = map[string]interface{}{"active": atomic.LoadInt64(&st.active), "opened": atomic.LoadInt64(&st.opened), "rejected": atomic.LoadInt64(&st.rejected), "messages": atomic.LoadInt64(&st.messages)}
+    }
+    return out
+}
+
+// meshToken is the token hub links must present. It is never the client
+// AuthToken: every client holds that one, and a hub link may relay for
+// other peers.
+func (s *Server) meshToken() string {
+    return s.opts.MeshToken
+}
+
+// handleMeshWS accepts a hub link on /mesh. It skips client admission control
+// but is bounded by MaxMeshConnections. Every /mesh link is trusted as a hub,
+// so without a mesh token the path stays shut unless AllowUnauthenticatedMesh
+// opts in.
+func (s *Server) handleMeshWS(c *gin.Context) {
+    peerId := c.Query("peerId")
+    token := s.meshToken()
+    if token == "" && !s.opts.AllowUnauthenticatedMesh {
+        atomic.AddInt64(&s.paths[pathMesh].rejected, 1)
+        http.Error(c.Writer, "mesh token not configured", http.StatusForbidden)
+        return
+    }
+    if token != "" {
+        auth := c.GetHeader("Authorization")
+        if strings.TrimPrefix(auth, "Bearer ") != token || !strings.HasPrefix(auth, "Bearer ") {
+            if c.Query("token") != token {
+                atomic.AddInt64(&s.paths[pathMesh].rejected, 1)
+                http.Error(c.Writer, "unauthorized", http.StatusUnauthorized)
+                return
+            }
+        }
+    }
+    if !validatePeerId(peerId) {
+        http.Error(c.Writer, "invalid peerId", http.StatusForbidden)
+        return
+    }
+    s.acceptWS(c, httpConnRequest(c), peerId)
+}
+
+// hubLinkRequest reports whether a connection request proves it is a hub
+// link: it arrived on /mesh, which checks the mesh token, or it presents the
+// mesh token as meshToken (unless MeshPathOnly). Only such links, and ones whose announce is signed
+// by a key in PinnedHubKeys, are trusted as hubs; an isHub flag in an
+// announce is not enough.
+func (s *Server) hubLinkRequest(r *connRequest) bool {
+    if r.path == pathMesh {
+        return true
+    }
+    token := s.meshToken()
+    if s.opts.MeshPathOnly {
+        return false
+    }
+    return token != "" && r.Query("meshToken") == token
+}
+
+// trustUnauthenticatedHub makes peerId a hub link on its hub announce when
+// AllowUnauthenticatedMesh is set and no mesh token is configured. This is
+// how hubs linked over /ws before links needed a credential; with it on, any
+// connection can claim to be a hub, so it is for closed deployments only.
+func (s *Server) trustUnauthenticatedHub(peerId string) {
+    if s.opts.AllowUnauthenticatedMesh && s.meshToken() == "" && !s.opts.MeshPathOnly {
+        s.markHubLink(peerId)
+    }
+}
+
+// isMeshURI reports whether a bootstrap URI points at a hub's /mesh path.
+func isMeshURI(u *url.URL) bool {
+    return strings.TrimSuffix(u.Path, "/") == "/mesh"
+}
+
+// atPathLimit reports whether path is full. Called with wsMu held. Without a
+// MaxMeshConnections, hub links share the client limit as before.
+func (s *Server) atPathLimit(path string) bool {
+    if s.opts.MaxMeshConnections <= 0 {
+        return len(s.wsConns) >= s.maxConnections()
+    }
+    mesh := int(atomic.LoadInt64(&s.paths[pathMesh].active))
+    if path == pathMesh {
+        return mesh >= s.opts.MaxMeshConnections
+    }
+    return len(s.wsConns)-mesh >= s.maxConnections()
+}
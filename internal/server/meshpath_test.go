@@ -0,0 +1,192 @@
+package server
+
+import (
+    "crypto/ed25519"
+    "encoding/base64"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestMeshPathAuthLimitsAndHubIdentity(t *testing.T) {
+    s := NewServer(Options{MaxConnections: 10, MaxMeshConnections: 1, MeshToken: "mesh-secret", MeshPathOnly: true, HubMeshNamespace: "pigeonhub-mesh"})
+    gin.SetMode(gin.TestMode)
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    base := "ws" + strings.TrimPrefix(ts.URL, "http")
+    hubA, hubB := randomPeerId(), randomPeerId()
+    if _, res, err := websocket.DefaultDialer.Dial(base+"/mesh?peerId="+hubA, nil); err == nil || res.StatusCode != http.StatusUnauthorized {
+        t.Fatalf("mesh link without token should be rejected")
+    }
+    auth := http.Header{"Authorization": {"Bearer mesh-secret"}}
+    a, _, err := websocket.DefaultDialer.Dial(base+"/mesh?peerId="+hubA, auth)
+    if err != nil {
+        t.Fatalf("mesh dial: %v", err)
+    }
+    defer a.Close()
+    if pi := s.getPeerInfo(hubA); pi == nil || !pi.IsHub || pi.Path != pathMesh {
+        t.Fatalf("mesh link should be a hub before announcing: %+v", pi)
+    }
+    if b, _, err := websocket.DefaultDialer.Dial(base+"/mesh?peerId="+hubB, auth); err == nil {
+        b.SetReadDeadline(time.Now().Add(time.Second))
+        if _, _, err := b.ReadMessage(); err == nil {
+            t.Fatalf("second mesh link should exceed MaxMeshConnections")
+        }
+        b.Close()
+    }
+    client, _, err := websocket.DefaultDialer.Dial(base+"/ws?peerId="+hubB, nil)
+    if err != nil {
+        t.Fatalf("client dial should not count against the mesh limit: %v", err)
+    }
+    defer client.Close()
+    client.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "pigeonhub-mesh", "data": map[string]interface{}{"isHub": true}})
+    waitFor(t, "hub announce on /ws rejected", func() bool {
+        pi := s.getPeerInfo(hubB)
+        return pi != nil && !pi.IsHub && !pi.Announced
+    })
+    stats := s.pathSnapshot()[pathMesh].(map[string]interface{})
+    if stats["active"] != int64(1) || stats["rejected"] != int64(2) {
+        t.Fatalf("unexpected mesh path stats %v", stats)
+    }
+}
+
+func TestMeshPathRefusedWithoutCredentialUnlessOptedIn(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    for _, allow := range []bool{false, true} {
+        s := NewServer(Options{MaxConnections: 10, AllowUnauthenticatedMesh: allow})
+        s.running = true
+        s.routes()
+        ts := httptest.NewServer(s.engine)
+        hub := randomPeerId()
+        conn, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/mesh?peerId="+hub, nil)
+        if !allow {
+            if err == nil || res.StatusCode != http.StatusForbidden || s.getPeerInfo(hub) != nil {
+                t.Fatalf("unauthenticated /mesh link should be refused")
+            }
+        } else if err != nil {
+            t.Fatalf("opted-in /mesh dial: %v", err)
+        } else {
+            if pi := s.getPeerInfo(hub); pi == nil || !pi.IsHub {
+                t.Fatalf("opted-in /mesh link should be a hub: %+v", pi)
+            }
+            conn.Close()
+        }
+        ts.Close()
+    }
+}
+
+func TestClientTokenDoesNotOpenTheMesh(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    s := NewServer(Options{MaxConnections: 10, AuthToken: "client-secret", HubMeshNamespace: "pigeonhub-mesh"})
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    base := "ws" + strings.TrimPrefix(ts.URL, "http")
+    hub := randomPeerId()
+    auth := http.Header{"Authorization": {"Bearer client-secret"}}
+    if _, res, err := websocket.DefaultDialer.Dial(base+"/mesh?peerId="+hub, auth); err == nil || res.StatusCode != http.StatusForbidden {
+        t.Fatalf("the client token should not open /mesh")
+    }
+    c, _, err := websocket.DefaultDialer.Dial(base+"/ws?peerId="+hub+"&token=client-secret&meshToken=client-secret", nil)
+    if err != nil {
+        t.Fatalf("client dial: %v", err)
+    }
+    defer c.Close()
+    c.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "pigeonhub-mesh", "data": map[string]interface{}{"isHub": true}})
+    waitFor(t, "the hub announce to be refused", func() bool {
+        pi := s.getPeerInfo(hub)
+        return pi != nil && !pi.IsHub && !pi.Announced
+    })
+}
+
+func TestHubTrustComesFromTheLinkNotTheAnnounce(t *testing.T) {
+    pub, key, _ := ed25519.GenerateKey(nil)
+    spoofer, victim, target, pinned := randomPeerId(), randomPeerId(), randomPeerId(), randomPeerId()
+    s := NewServer(Options{MaxConnections: 10, MeshToken: "mesh-secret", HubMeshNamespace: "pigeonhub-mesh", PinnedHubKeys: []string{pinned + "=" + base64.StdEncoding.EncodeToString(pub)}})
+    conns := attachTestPeers(t, s, spoofer, target, pinned)
+    refusals := func(id string) []string {
+        msgs, _ := conns[id].take(20 * time.Millisecond)
+        var out []string
+        for _, raw := range msgs {
+            var m outboundMessage
+            json.Unmarshal(raw, &m)
+            if m.Type == "error" {
+                d, _ := m.Data.(map[string]interface{})
+                out = append(out, fmt.Sprint(d["code"], d["message"]))
+            }
+        }
+        return out
+    }
+    for _, raw := range []string{
+        `{"type":"announce","networkName":"lobby","data":{"isHub":true}}`,
+        `{"type":"announce","networkName":"pigeonhub-mesh","data":{}}`,
+    } {
+        s.handleMessage(spoofer, []byte(raw))
+        if pi := s.getPeerInfo(spoofer); pi.IsHub || pi.Announced || len(refusals(spoofer)) != 1 {
+            t.Fatalf("unverified hub announce %s should be refused: %+v", raw, pi)
+        }
+    }
+
+    s.handleMessage(spoofer, []byte(`{"type":"announce","networkName":"lobby","data":{}}`))
+    s.handleMessage(target, []byte(`{"type":"announce","networkName":"lobby","data":{}}`))
+    conns[target].take(20 * time.Millisecond)
+    s.handleMessage(spoofer, []byte(`{"type":"offer","networkName":"lobby","fromPeerId":"`+victim+`","targetPeerId":"`+target+`","data":{"sdp":"x"}}`))
+    if got := refusals(spoofer); len(got) != 1 || !strings.HasPrefix(got[0], errSenderMismatch) {
+        t.Fatalf("spoofed offer should be refused, got %v", got)
+    }
+    if msgs, _ := conns[target].take(20 * time.Millisecond); len(msgs) != 0 {
+        t.Fatalf("spoofed offer must not be delivered")
+    }
+
+    data := []byte(`{"isHub":true}`)
+    sig := base64.StdEncoding.EncodeToString(ed25519.Sign(key, meshSigningInput("announce", "", "", "pigeonhub-mesh", "", "", "", data)))
+    s.handleMessage(pinned, []byte(`{"type":"announce","networkName":"pigeonhub-mesh","data":`+string(data)+`,"meshSignature":"`+sig+`"}`))
+    if pi := s.getPeerInfo(pinned); !pi.IsHub || !pi.Announced {
+        t.Fatalf("announce signed with a pinned key should make a hub: %+v", pi)
+    }
+}
+
+func TestDefaultHubMeshNeedsACredential(t *testing.T) {
+    // The default deploy (IS_HUB plus BOOTSTRAP_HUBS, no token or key)
+    // cannot link, so it fails validation instead of starting half-meshed.
+    err := Options{IsHub: true, BootstrapHubs: []string{"wss://hub-c.example.com"}}.Validate()
+    if err == nil || !strings.Contains(err.Error(), "BootstrapHubs needs MeshToken") {
+        t.Fatalf("bootstrap hubs without a mesh credential should be refused, got %v", err)
+    }
+
+    // With ALLOW_UNAUTHENTICATED_MESH on both hubs, a /ws link is still
+    // trusted as a hub and its traffic is not treated as spoofed.
+    gin.SetMode(gin.TestMode)
+    start := func() *Server {
+        s := NewServer(Options{IsHub: true, MaxConnections: 10, AllowUnauthenticatedMesh: true})
+        s.running = true
+        s.routes()
+        ts := httptest.NewServer(s.engine)
+        t.Cleanup(ts.Close)
+        s.opts.PublicURL = "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+        return s
+    }
+    a, b := start(), start()
+    if err := (Options{IsHub: true, BootstrapHubs: []string{a.opts.PublicURL}, AllowUnauthenticatedMesh: true}).Validate(); err != nil {
+        t.Fatalf("opted-in unauthenticated mesh rejected: %v", err)
+    }
+    defer b.disconnectBootstrap()
+    b.connectToHub(a.opts.PublicURL, 0)
+    waitFor(t, "a to trust b as a hub", func() bool {
+        pi := a.getPeerInfo(b.hubPeerId)
+        return pi != nil && pi.IsHub
+    })
+    time.Sleep(100 * time.Millisecond)
+    if total := a.spoofSnapshot()["total"]; total != int64(0) {
+        t.Fatalf("hub traffic counted as spoofed: %v", a.spoofSnapshot())
+    }
+}
@@ -0,0 +1,386 @@
+package server
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+// Signed hub mesh. With HubKeyPath set a hub keeps an ed25519 identity key in
+// the Store, derives its hub peer ID from it so the ID survives restarts, and
+// signs every envelope it writes to another hub, gossip it originates and
+// messages it relays alike, so each hop vouches for what it hands on. The
+// public key is published as hubKey in the connected greeting and in the
+// hub's mesh announce, both of which are signed themselves.
+//
+// A receiving hub pins the key of each link, by bootstrap URI or hub peer ID:
+// from PinnedHubKeys, or else on first contact, saved under HubKeyPinsPath
+// when set. From then on every message on the link must carry a valid
+// meshSignature from the pinned key. Unsigned messages and bad signatures are
+// dropped, and a link presenting a different key is closed. With
+// RequireSignedMesh, hub messages on links with no pinned key are dropped
+// too, so only signing hubs can take part in the mesh.
+const (
+    featureSignedMesh = "signed-mesh"
+
+    meshSigningDomain = "peerpigeon-mesh/1\n"
+
+    meshRejectUnsigned     = "unsigned"
+    meshRejectBadSignature = "bad-signature"
+    meshRejectKeyMismatch  = "key-mismatch"
+)
+
+type hubKeyring struct {
+    priv ed25519.PrivateKey
+
+    store      Store
+    pinsKey    string
+    mu         sync.Mutex
+    configured map[string]string
+    learned    map[string]string
+    signed     int64
+    verified   int64
+    rejected   map[string]int64
+}
+
+// newHubKeyring loads (or creates) this hub's identity key and its pins.
+// Without HubKeyPath the hub does not sign but still checks pinned links.
+func (s *Server) newHubKeyring() *hubKeyring {
+    o := s.opts
+    k := &hubKeyring{store: o.Store, pinsKey: o.HubKeyPinsPath, configured: map[string]string{}, learned: map[string]string{}, rejected: map[string]int64{}}
+    for _, entry := range o.PinnedHubKeys {
+        link, key, ok := strings.Cut(entry, "=")
+        if !ok || decodeHubKey(key) == nil {
+            s.log.Warn("pinned_hub_key_invalid", map[string]interface{}{"entry": entry})
+            continue
+        }
+        k.configured[strings.TrimSpace(link)] = strings.TrimSpace(key)
+    }
+    if k.pinsKey != "" {
+        if b, err := o.Store.Load(k.pinsKey); err == nil && b != nil {
+            json.Unmarshal(b, &k.learned)
+        }
+    }
+    if o.IsHub && o.HubKeyPath != "" {
+        k.priv = s.loadHubKey(o.HubKeyPath)
+    }
+    return k
+}
+
+func (s *Server) loadHubKey(path string) ed25519.PrivateKey {
+    var saved struct {
+        Seed string `json:"seed"`
+    }
+    if b, err := s.opts.Store.Load(path); err == nil && b != nil && json.Unmarshal(b, &saved) == nil {
+        if seed, err := base64.StdEncoding.DecodeString(saved.Seed); err == nil && len(seed) == ed25519.SeedSize {
+            return ed25519.NewKeyFromSeed(seed)
+        }
+        s.log.Warn("hub_key_invalid", map[string]interface{}{"path": path})
+        return nil
+    }
+    _, priv, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return nil
+    }
+    b, _ := json.Marshal(map[string]string{"seed": base64.StdEncoding.EncodeToString(priv.Seed())})
+    if err := s.opts.Store.Save(path, b); err != nil {
+        s.log.Warn("hub_key_unsaved", map[string]interface{}{"path": path, "error": err.Error()})
+    }
+    return priv
+}
+
+func decodeHubKey(enc string) ed25519.PublicKey {
+    k, err := base64.StdEncoding.DecodeString(strings.TrimSpace(enc))
+    if err != nil || len(k) != ed25519.PublicKeySize {
+        return nil
+    }
+    return ed25519.PublicKey(k)
+}
+
+// publicKey is this hub's key as published in hubKey, or "" if it does not
+// sign.
+func (k *hubKeyring) publicKey() string {
+    if k.priv == nil {
+        return ""
+    }
+    return base64.StdEncoding.EncodeToString(k.priv.Public().(ed25519.PublicKey))
+}
+
+// hubId derives a stable hub peer ID from the identity key.
+func (k *hubKeyring) hubId() string {
+    sum := sha256.Sum256(k.priv.Public().(ed25519.PublicKey))
+    return hex.EncodeToString(sum[:20])
+}
+
+// pinned returns the key pinned for the first of links that has one.
+func (k *hubKeyring) pinned(links ...string) string {
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    for _, l := range links {
+        if l == "" {
+            continue
+        }
+        if key := k.configured[l]; key != "" {
+            return key
+        }
+        if key := k.learned[l]; key != "" {
+            return key
+        }
+    }
+    return ""
+}
+
+func (k *hubKeyring) learn(link, key string) {
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    k.learned[link] = key
+    k.saveLocked()
+}
+
+// unpin forgets a learned key so the link is pinned afresh on its next
+// contact, e.g. after the remote hub rotated its key. Configured pins stay.
+func (k *hubKeyring) unpin(link string) bool {
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    if _, ok := k.learned[link]; !ok {
+        return false
+    }
+    delete(k.learned, link)
+    k.saveLocked()
+    return true
+}
+
+func (k *hubKeyring) saveLocked() {
+    if k.pinsKey == "" {
+        return
+    }
+    if b, err := json.MarshalIndent(k.learned, "", "  "); err == nil {
+        k.store.Save(k.pinsKey, b)
+    }
+}
+
+// meshSigningInput is what a hub signs: a domain tag, then type, fromPeerId,
+// targetPeerId, networkName, originHubId, messageId and encoding on separate
+// lines, followed by the exact bytes of the "data" field.
+func meshSigningInput(typ, from, target, netName, origin, messageId, encoding string, data []byte) []byte {
+    head := meshSigningDomain + typ + "\n" + from + "\n" + target + "\n" + netName + "\n" + origin + "\n" + messageId + "\n" + encoding + "\n"
+    return append([]byte(head), data...)
+}
+
+// signMesh compresses msg as writeMessage would and signs the result. Hubs
+// without an identity key send msg unchanged.
+func (s *Server) signMesh(msg outboundMessage, threshold int) outboundMessage {
+    k := s.hubKeys
+    if k.priv == nil {
+        return msg
+    }
+    if msg.Encoding == "" {
+        msg.Data, msg.Encoding = compressData(msg.Data, threshold)
+    }
+    data, err := json.Marshal(msg.Data)
+    if err != nil {
+        return msg
+    }
+    sig := ed25519.Sign(k.priv, meshSigningInput(msg.Type, msg.FromPeerId, msg.TargetPeer, msg.NetworkName, msg.OriginHub, msg.MessageId, msg.Encoding, data))
+    msg.MeshSignature = base64.StdEncoding.EncodeToString(sig)
+    k.mu.Lock()
+    k.signed++
+    k.mu.Unlock()
+    return msg
+}
+
+// checkMeshSignature verifies a message received from another hub. links
+// name the link it arrived on, the first being where a first-contact pin is
+// recorded; advertised is the hubKey the message itself carries, if any.
+// raw is the frame as received, so the signature is checked over the data
+// bytes actually sent. It returns "" to accept or the reason for rejecting.
+func (s *Server) checkMeshSignature(raw []byte, msg inboundMessage, advertised string, links ...string) string {
+    k := s.hubKeys
+    key := k.pinned(links...)
+    first := key == ""
+    switch {
+    case first && advertised == "" && s.opts.RequireSignedMesh:
+        return s.rejectMesh(links[0], msg.Type, meshRejectUnsigned)
+    case first && advertised == "":
+        return ""
+    case first:
+        key = advertised
+    case advertised != "" && advertised != key:
+        return s.rejectMesh(links[0], msg.Type, meshRejectKeyMismatch)
+    }
+    pub := decodeHubKey(key)
+    if msg.MeshSignature == "" {
+        return s.rejectMesh(links[0], msg.Type, meshRejectUnsigned)
+    }
+    sig, err := base64.StdEncoding.DecodeString(msg.MeshSignature)
+    var env struct {
+        Data json.RawMessage `json:"data"`
+    }
+    if pub == nil || err != nil || json.Unmarshal(raw, &env) != nil || !ed25519.Verify(pub, meshSigningInput(msg.Type, msg.FromPeerId, msg.TargetPeer, msg.NetworkName, msg.OriginHub, msg.MessageId, msg.Encoding, env.Data), sig) {
+        return s.rejectMesh(links[0], msg.Type, meshRejectBadSignature)
+    }
+    if first {
+        k.learn(links[0], key)
+        s.log.Info("hub_key_pinned", map[string]interface{}{"link": links[0], "hubKey": key})
+    }
+    k.mu.Lock()
+    k.verified++
+    k.mu.Unlock()
+    return ""
+}
+
+func (s *Server) rejectMesh(link, msgType, reason string) string {
+    s.hubKeys.mu.Lock()
+    s.hubKeys.rejected[reason]++
+    s.hubKeys.mu.Unlock()
+    s.log.Warn("mesh_signature_rejected", map[string]interface{}{"link": link, "type": msgType, "reason": reason})
+    return reason
+}
+
+// advertisedHubKey is the hubKey a connected greeting or hub announce
+// carries.
+func advertisedHubKey(msg inboundMessage) string {
+    if msg.Type != "connected" && msg.Type != "announce" {
+        return ""
+    }
+    m, _ := msg.Data.(map[string]interface{})
+    key, _ := m["hubKey"].(string)
+    return key
+}
+
+// isHubAnnounce reports whether msg is a hub announcing itself on a
+// connection that is not yet known to be a hub link.
+func (s *Server) isHubAnnounce(msg inboundMessage) bool {
+    if msg.Type != "announce" {
+        return false
+    }
+    m, _ := msg.Data.(map[string]interface{})
+    isHub, _ := m["isHub"].(bool)
+    return isHub || msg.NetworkName == s.opts.HubMeshNamespace
+}
+
+// verifyHubLink checks a message from an inbound hub connection, closing the
+// connection if it presents a key other than the one pinned for it.
+func (s *Server) verifyHubLink(peerId string, raw []byte, msg inboundMessage) bool {
+    reason := s.checkMeshSignature(raw, msg, advertisedHubKey(msg), peerId)
+    if reason == meshRejectKeyMismatch {
+        if conn := s.getConn(peerId); conn != nil {
+            s.handleDisconnect(peerId, reasonHubKeyMismatch, "")
+            closeWithReason(conn, websocket.ClosePolicyViolation, reasonHubKeyMismatch)
+        }
+    }
+    return reason == ""
+}
+
+// trustPinnedHub makes peerId a hub link once its hub announce has verified
+// against a key in PinnedHubKeys. Keys pinned on first contact do not count,
+// since any client can sign with a key of its own.
+func (s *Server) trustPinnedHub(peerId string) {
+    s.hubKeys.mu.Lock()
+    configured := s.hubKeys.configured[peerId] != ""
+    s.hubKeys.mu.Unlock()
+    if configured {
+        s.markHubLink(peerId)
+    }
+}
+
+// markHubLink records peerId as a hub link, both for routing and for the
+// network ACL.
+func (s *Server) markHubLink(peerId string) {
+    s.peersMu.Lock()
+    if pi := s.peerData[peerId]; pi != nil {
+        pi.IsHub = true
+    }
+    s.peersMu.Unlock()
+    s.acl.mu.Lock()
+    if id, ok := s.acl.identities[peerId]; ok {
+        id.hubLink = true
+        s.acl.identities[peerId] = id
+    }
+    s.acl.mu.Unlock()
+}
+
+// verifyBootstrapLink checks a message from a bootstrap hub, closing the
+// link if it presents a key other than the one pinned for its URI or hub ID.
+func (s *Server) verifyBootstrapLink(uri string, raw []byte, msg inboundMessage) bool {
+    s.bootstrapMu.Lock()
+    b := s.bootstrapConns[uri]
+    hubId, attempt := "", 0
+    if b != nil {
+        hubId, attempt = b.hubId, b.attemptNum
+    }
+    s.bootstrapMu.Unlock()
+    if msg.Type == "connected" {
+        m, _ := msg.Data.(map[string]interface{})
+        if id, _ := m["hubPeerId"].(string); id != "" {
+            hubId = id
+        }
+    }
+    reason := s.checkMeshSignature(raw, msg, advertisedHubKey(msg), uri, hubId)
+    if reason == meshRejectKeyMismatch && b != nil && b.ws != nil {
+        s.markBootstrapIncompatible(uri, attempt, "hub key does not match the pinned key")
+        b.ws.Close()
+    }
+    return reason == ""
+}
+
+func (s *Server) meshSigningSnapshot() map[string]interface{} {
+    k := s.hubKeys
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    rejected := make(map[string]int64, len(k.rejected))
+    for r, n := range k.rejected {
+        rejected[r] = n
+    }
+    return map[string]interface{}{
+        "signing":        k.priv != nil,
+        "require_signed": s.opts.RequireSignedMesh,
+        "pinned":         len(k.configured) + len(k.learned),
+        "signed":         k.signed,
+        "verified":       k.verified,
+        "rejected":       rejected,
+    }
+}
+
+// adminHubKeys lists this hub's key and every pinned link.
+func (s *Server) adminHubKeys(c *gin.Context) {
+    k := s.hubKeys
+    k.mu.Lock()
+    pins := make([]map[string]interface{}, 0, len(k.configured)+len(k.learned))
+    for link, key := range k.configured {
+        pins = append(pins, map[string]interface{}{"link": link, "hubKey": key, "source": "configured"})
+    }
+    for link, key := range k.learned {
+        if _, ok := k.configured[link]; !ok {
+            pins = append(pins, map[string]interface{}{"link": link, "hubKey": key, "source": "first-contact"})
+        }
+    }
+    k.mu.Unlock()
+    sort.Slice(pins, func(i, j int) bool { return pins[i]["link"].(string) < pins[j]["link"].(string) })
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"hubPeerId": s.hubPeerId, "hubKey": k.publicKey(), "pins": pins}, s.opts.CORSOrigin)
+}
+
+// adminUnpinHubKey forgets the key learned for ?link= so a hub that rotated
+// its key can be pinned again.
+func (s *Server) adminUnpinHubKey(c *gin.Context) {
+    link := c.Query("link")
+    if link == "" {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "link required"}, s.opts.CORSOrigin)
+        return
+    }
+    if !s.hubKeys.unpin(link) {
+        writeJSON(c.Writer, http.StatusNotFound, map[string]interface{}{"error": "no learned key for link"}, s.opts.CORSOrigin)
+        return
+    }
+    s.audit(c, "unpin-hub-key", map[string]interface{}{"link": link})
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"unpinned": link}, s.opts.CORSOrigin)
+}
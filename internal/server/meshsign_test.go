@@ -0,0 +1,78 @@
+package server
+
+import (
+    "crypto/ed25519"
+    "encoding/base64"
+    "encoding/json"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestSignedMeshPinsKeysAndRejectsForgeries(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    storeA := &memStore{docs: map[string][]byte{}}
+    a := NewServer(Options{IsHub: true, MaxConnections: 10, MeshToken: "mesh-secret", HubKeyPath: "hub-key.json", Store: storeA})
+    if again := NewServer(Options{IsHub: true, HubKeyPath: "hub-key.json", Store: storeA}); again.hubPeerId != a.hubPeerId || !validatePeerId(a.hubPeerId) {
+        t.Fatalf("hub peer ID should be derived from the stored key: %q vs %q", a.hubPeerId, again.hubPeerId)
+    }
+    a.running = true
+    a.routes()
+    ts := httptest.NewServer(a.engine)
+    defer ts.Close()
+    uri := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+
+    storeB := &memStore{docs: map[string][]byte{}}
+    b := NewServer(Options{IsHub: true, MaxConnections: 10, MeshToken: "mesh-secret", HubKeyPinsPath: "hub-pins.json", Store: storeB})
+    b.running = true
+    b.connectToHub(uri, 0)
+    defer b.disconnectBootstrap()
+    waitFor(t, "b to pin a's key", func() bool { return b.hubKeys.pinned(uri) == a.hubKeys.publicKey() })
+    if storeB.docs["hub-pins.json"] == nil {
+        t.Fatalf("first-contact pin should be persisted")
+    }
+    waitFor(t, "a to accept b's unsigned announce", func() bool { pi := a.getPeerInfo(b.hubPeerId); return pi != nil && pi.IsHub })
+
+    peer := randomPeerId()
+    c, _, err := websocket.DefaultDialer.Dial(uri+"?peerId="+peer, nil)
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    defer c.Close()
+    c.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "lobby", "data": map[string]interface{}{}})
+    waitFor(t, "signed gossip to reach b", func() bool { return b.isCrossHubPeerCached("lobby", peer) })
+
+    forge := func(key ed25519.PrivateKey, msg outboundMessage) {
+        if key != nil {
+            data, _ := json.Marshal(msg.Data)
+            msg.MeshSignature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, meshSigningInput(msg.Type, msg.FromPeerId, msg.TargetPeer, msg.NetworkName, msg.OriginHub, msg.MessageId, msg.Encoding, data)))
+        }
+        raw, _ := json.Marshal(msg)
+        b.handleBootstrapMessage(uri, raw)
+    }
+    _, other, _ := ed25519.GenerateKey(nil)
+    fakeA, fakeB := randomPeerId(), randomPeerId()
+    forge(nil, outboundMessage{Type: "peer-discovered", Data: map[string]interface{}{"peerId": fakeA}, FromPeerId: "system", NetworkName: "lobby"})
+    forge(other, outboundMessage{Type: "peer-discovered", Data: map[string]interface{}{"peerId": fakeB}, FromPeerId: "system", NetworkName: "lobby"})
+    if b.isCrossHubPeerCached("lobby", fakeA) || b.isCrossHubPeerCached("lobby", fakeB) {
+        t.Fatalf("unsigned or wrongly signed gossip should be dropped")
+    }
+
+    otherKey := base64.StdEncoding.EncodeToString(other.Public().(ed25519.PublicKey))
+    forge(other, outboundMessage{Type: "connected", Data: map[string]interface{}{"hubPeerId": a.hubPeerId, "hubKey": otherKey}, FromPeerId: "system", NetworkName: "global"})
+    waitFor(t, "a link presenting another key to be closed", func() bool { return a.getPeerInfo(b.hubPeerId) == nil })
+    if b.hubKeys.pinned(uri) != a.hubKeys.publicKey() {
+        t.Fatalf("a mismatched key must not replace the pin")
+    }
+
+    snap := b.meshSigningSnapshot()
+    rejected := snap["rejected"].(map[string]int64)
+    if rejected[meshRejectUnsigned] != 1 || rejected[meshRejectBadSignature] != 1 || rejected[meshRejectKeyMismatch] != 1 || snap["verified"].(int64) < 2 {
+        t.Fatalf("unexpected mesh signing counts %v", snap)
+    }
+    if a.meshSigningSnapshot()["signed"].(int64) < 2 || !hasFeature(a.features(), featureSignedMesh) || hasFeature(b.features(), featureSignedMesh) {
+        t.Fatalf("a should sign and advertise signed-mesh, b should not")
+    }
+}
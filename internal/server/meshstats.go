@@ -0,0 +1,165 @@
+package server
+
+import (
+    "encoding/json"
+    "os"
+    "sort"
+    "sync"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+const (
+    meshStatsInterval = 15 * time.Second
+    meshStatsTTL      = 4 * meshStatsInterval
+)
+
+// hubSummary is the load report each hub gossips across the mesh.
+type hubSummary struct {
+    HubId          string  `json:"hubId"`
+    URL            string  `json:"url,omitempty"`
+    Region         string  `json:"region,omitempty"`
+    AppName        string  `json:"appName,omitempty"`
+    Version        string  `json:"version"`
+    Role           string  `json:"role"`
+    Peers          int     `json:"peers"`
+    Connections    int     `json:"connections"`
+    MaxConnections int     `json:"maxConnections"`
+    Networks       int     `json:"networks"`
+    Load           float64 `json:"load"`
+    UptimeMs       int64   `json:"uptimeMs"`
+    ReportedAt     int64   `json:"reportedAt"`
+}
+
+// meshStats keeps the latest summary heard from every other hub.
+type meshStats struct {
+    mu   sync.Mutex
+    hubs map[string]hubSummary
+}
+
+func newMeshStats() *meshStats {
+    return &meshStats{hubs: map[string]hubSummary{}}
+}
+
+func (m *meshStats) record(sum hubSummary) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if cur, ok := m.hubs[sum.HubId]; ok && cur.ReportedAt > sum.ReportedAt {
+        return
+    }
+    m.hubs[sum.HubId] = sum
+}
+
+// live returns summaries reported within meshStatsTTL, dropping the rest.
+func (m *meshStats) live(now int64) []hubSummary {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    out := []hubSummary{}
+    for id, sum := range m.hubs {
+        if now-sum.ReportedAt > meshStatsTTL.Milliseconds() {
+            delete(m.hubs, id)
+            continue
+        }
+        out = append(out, sum)
+    }
+    return out
+}
+
+func (s *Server) localSummary() hubSummary {
+    peers := 0
+    s.peersMu.Lock()
+    for _, pi := range s.peerData {
+        if pi.Announced && !pi.IsHub {
+            peers++
+        }
+    }
+    s.peersMu.Unlock()
+    s.networkMu.Lock()
+    networks := len(s.networkPeers)
+    s.networkMu.Unlock()
+    conns := s.connectionsSize()
+    load := 0.0
+    if s.maxConnections() > 0 {
+        load = float64(conns) / float64(s.maxConnections())
+    }
+    return hubSummary{HubId: firstNonEmpty(s.hubPeerId, "local"), URL: s.advertisedURL(), Region: os.Getenv("FLY_REGION"), AppName: os.Getenv("FLY_APP_NAME"), Version: Version, Role: s.role(), Peers: peers, Connections: conns, MaxConnections: s.maxConnections(), Networks: networks, Load: load, UptimeMs: s.uptime(), ReportedAt: nowMs()}
+}
+
+// gossipHubSummary floods this hub's summary across the mesh.
+func (s *Server) gossipHubSummary() {
+    sum := s.localSummary()
+    id := newMessageId()
+    s.markRelayed("hub-summary:" + id)
+    s.forwardToMesh(outboundMessage{Type: "hub-summary", Data: sum, FromPeerId: "system", Timestamp: nowMs(), MessageId: id}, "", "")
+}
+
+func (s *Server) runMeshStatsGossip() {
+    ticker := time.NewTicker(meshStatsInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        if !s.running {
+            return
+        }
+        s.maintainMesh()
+        if s.shedding(shedStats) {
+            continue
+        }
+        s.gossipHubSummary()
+    }
+}
+
+// handleHubSummary records a summary gossiped by another hub and passes it on.
+func (s *Server) handleHubSummary(fromHub, fromUri string, msg inboundMessage) {
+    if msg.MessageId == "" || s.alreadyVisited(msg) || !s.markRelayed("hub-summary:"+msg.MessageId) {
+        return
+    }
+    raw, err := json.Marshal(msg.Data)
+    if err != nil {
+        return
+    }
+    var sum hubSummary
+    if decodeJSON(raw, &sum) != nil || sum.HubId == "" || sum.HubId == s.hubPeerId {
+        return
+    }
+    s.meshStats.record(sum)
+    s.learnMember(sum.HubId, sum.URL, memberSourceGossip)
+    s.forwardToMesh(outboundMessage{Type: "hub-summary", Data: msg.Data, FromPeerId: "system", Timestamp: nowMs(), MessageId: msg.MessageId, OriginHub: msg.OriginHub, SeenHubs: msg.SeenHubs, Hops: msg.Hops}, fromUri, fromHub)
+}
+
+// getMeshStats combines this hub's summary with the gossiped ones into a
+// fleet-wide view of capacity and distribution.
+func (s *Server) getMeshStats() map[string]interface{} {
+    hubs := append([]hubSummary{s.localSummary()}, s.meshStats.live(nowMs())...)
+    sort.Slice(hubs, func(i, j int) bool { return hubs[i].HubId < hubs[j].HubId })
+    peers, conns, capacity := 0, 0, 0
+    byRegion := map[string]map[string]int{}
+    byVersion := map[string]int{}
+    for _, h := range hubs {
+        peers += h.Peers
+        conns += h.Connections
+        capacity += h.MaxConnections
+        region := firstNonEmpty(h.Region, "unknown")
+        if byRegion[region] == nil {
+            byRegion[region] = map[string]int{}
+        }
+        byRegion[region]["hubs"]++
+        byRegion[region]["peers"] += h.Peers
+        byRegion[region]["connections"] += h.Connections
+        byVersion[h.Version]++
+    }
+    utilization := 0.0
+    if capacity > 0 {
+        utilization = float64(conns) / float64(capacity)
+    }
+    return map[string]interface{}{
+        "timestamp": time.Now().Format(time.RFC3339),
+        "hubs":      hubs,
+        "totals":    map[string]interface{}{"hubs": len(hubs), "peers": peers, "connections": conns, "capacity": capacity, "utilization": utilization},
+        "regions":   byRegion,
+        "versions":  byVersion,
+    }
+}
+
+func (s *Server) handleMeshStats(c *gin.Context) {
+    writeJSON(c.Writer, 200, s.getMeshStats(), s.opts.CORSOrigin)
+}
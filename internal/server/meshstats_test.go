@@ -0,0 +1,21 @@
+package server
+
+import "testing"
+
+func TestMeshStatsAggregatesGossip(t *testing.T) {
+    s := NewServer(Options{IsHub: true, MaxConnections: 100})
+    sum := map[string]interface{}{"hubId": "hub-b", "region": "ams", "version": "9.9.9", "peers": 7, "connections": 8, "maxConnections": 100, "reportedAt": nowMs()}
+    msg := inboundMessage{Type: "hub-summary", Data: sum, MessageId: "m1", OriginHub: "hub-b"}
+    s.handleHubSummary("", "ws://hub-b", msg)
+    s.handleHubSummary("", "ws://hub-b", msg)
+    stale := map[string]interface{}{"hubId": "hub-c", "version": Version, "reportedAt": nowMs() - meshStatsTTL.Milliseconds() - 1}
+    s.handleHubSummary("", "ws://hub-c", inboundMessage{Type: "hub-summary", Data: stale, MessageId: "m2", OriginHub: "hub-c"})
+    stats := s.getMeshStats()
+    totals := stats["totals"].(map[string]interface{})
+    if totals["hubs"] != 2 || totals["peers"] != 7 || totals["capacity"] != 200 {
+        t.Fatalf("unexpected totals %v", totals)
+    }
+    if stats["regions"].(map[string]map[string]int)["ams"]["connections"] != 8 {
+        t.Fatalf("expected ams region, got %v", stats["regions"])
+    }
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+    "path"
+    "sort"
+    "sync"
+)
+
+// Network monitors. A peer that connects with ?monitorToken= matching
+// MonitorToken may subscribe to discovery events on every network whose name
+// matches a glob pattern, e.g. "game-*", instead of announcing into each one:
+//
+//     {"type": "monitor-subscribe", "data": {"patterns": ["game-*"], "snapshot": true}}
+//
+// Each peer-discovered and peer-disconnected this hub sees on a matching
+// network, local or from the mesh, then arrives as a monitor-event carrying
+// the event, the networkName and the peerId. With snapshot the peers already
+// known on matching networks are sent first. MonitorNetworks limits which
+// networks monitors can see at all; events outside it are never delivered,
+// whatever the pattern.
+const (
+    errMonitorUnauthorized = "monitor-unauthorized"
+    errMonitorPattern      = "invalid-pattern"
+)
+
+type monitorRegistry struct {
+    mu        sync.Mutex
+    subs      map[string][]string
+    delivered int64
+}
+
+func newMonitorRegistry() *monitorRegistry {
+    return &monitorRegistry{subs: map[string][]string{}}
+}
+
+func matchesAny(patterns []string, netName string) bool {
+    for _, p := range patterns {
+        if ok, _ := path.Match(p, netName); ok {
+            return true
+        }
+    }
+    return false
+}
+
+// monitorScope reports whether monitors may see netName.
+func (s *Server) monitorScope(netName string) bool {
+    return len(s.opts.MonitorNetworks) == 0 || matchesAny(s.opts.MonitorNetworks, netName)
+}
+
+// isMonitor reports whether the connection was authorized as a monitor.
+func (s *Server) isMonitor(peerId string) bool {
+    pi := s.getPeerInfo(peerId)
+    return pi != nil && pi.Monitor
+}
+
+func (s *Server) rejectMonitor(peerId, code, message string) {
+    s.sendToConn(s.getConn(peerId), outboundMessage{Type: "error", Data: map[string]interface{}{"code": code, "message": message}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+}
+
+// handleMonitorSubscribe adds patterns to a monitor's subscription.
+func (s *Server) handleMonitorSubscribe(peerId string, msg inboundMessage) {
+    if !s.isMonitor(peerId) {
+        s.rejectMonitor(peerId, errMonitorUnauthorized, "connection is not authorized as a monitor")
+        return
+    }
+    m, _ := msg.Data.(map[string]interface{})
+    patterns := featureList(m["patterns"])
+    if len(patterns) == 0 {
+        s.rejectMonitor(peerId, errMonitorPattern, "patterns required")
+        return
+    }
+    for _, p := range patterns {
+        if _, err := path.Match(p, ""); err != nil || p == "" {
+            s.rejectMonitor(peerId, errMonitorPattern, "invalid pattern "+p)
+            return
+        }
+    }
+    r := s.monitors
+    r.mu.Lock()
+    cur := r.subs[peerId]
+    have := map[string]bool{}
+    for _, p := range cur {
+        have[p] = true
+    }
+    for _, p := range patterns {
+        if !have[p] {
+            have[p] = true
+            cur = append(cur, p)
+        }
+    }
+    r.subs[peerId] = cur
+    all := append([]string{}, cur...)
+    r.mu.Unlock()
+    s.sendToConn(s.getConn(peerId), outboundMessage{Type: "monitor-subscribed", Data: map[string]interface{}{"patterns": all}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+    if snap, _ := m["snapshot"].(bool); snap {
+        s.sendMonitorSnapshot(peerId, patterns)
+    }
+}
+
+// handleMonitorUnsubscribe drops the given patterns, or all of them when
+// none are given.
+func (s *Server) handleMonitorUnsubscribe(peerId string, msg inboundMessage) {
+    m, _ := msg.Data.(map[string]interface{})
+    drop := map[string]bool{}
+    for _, p := range featureList(m["patterns"]) {
+        drop[p] = true
+    }
+    r := s.monitors
+    r.mu.Lock()
+    kept := []string{}
+    if len(drop) > 0 {
+        for _, p := range r.subs[peerId] {
+            if !drop[p] {
+                kept = append(kept, p)
+            }
+        }
+    }
+    if len(kept) == 0 {
+        delete(r.subs, peerId)
+    } else {
+        r.subs[peerId] = kept
+    }
+    r.mu.Unlock()
+    s.sendToConn(s.getConn(peerId), outboundMessage{Type: "monitor-subscribed", Data: map[string]interface{}{"patterns": kept}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+}
+
+// sendMonitorSnapshot sends the announced local peers and cached mesh peers
+// on every network matching patterns as snapshot monitor-events.
+func (s *Server) sendMonitorSnapshot(peerId string, patterns []string) {
+    type entry struct {
+        netName, id string
+        data        map[string]interface{}
+    }
+    entries := []entry{}
+    s.peersMu.Lock()
+    for id, pi := range s.peerData {
+        if pi.Announced && !pi.IsHub && !hiddenPeer(pi.Data) && id != peerId && s.monitorScope(pi.NetworkName) && matchesAny(patterns, pi.NetworkName) {
+            entries = append(entries, entry{pi.NetworkName, id, pi.Data})
+        }
+    }
+    s.peersMu.Unlock()
+    s.bootstrapMu.Lock()
+    for netName, cache := range s.crossHubCache {
+        if !s.monitorScope(netName) || !matchesAny(patterns, netName) {
+            continue
+        }
+        for id, data := range cache {
+            entries = append(entries, entry{netName, id, data})
+        }
+    }
+    s.bootstrapMu.Unlock()
+    conn := s.getConn(peerId)
+    for _, e := range entries {
+        s.sendToConn(conn, monitorEvent(peerId, e.netName, "peer-discovered", e.id, e.data, true))
+    }
+}
+
+func monitorEvent(target, netName, event, peerId string, data map[string]interface{}, snapshot bool) outboundMessage {
+    d := map[string]interface{}{"event": event, "networkName": netName, "peerId": peerId, "data": data}
+    if snapshot {
+        d["snapshot"] = true
+    }
+    return outboundMessage{Type: "monitor-event", Data: d, FromPeerId: "system", TargetPeer: target, NetworkName: netName, Timestamp: nowMs()}
+}
+
+// recordEvent records a discovery or disconnect event for replay and hands
+// it to the monitors subscribed to its network.
+func (s *Server) recordEvent(netName, typ, peerId string, data map[string]interface{}) {
+    s.events.record(netName, typ, peerId, data)
+    if !s.monitorScope(netName) {
+        return
+    }
+    r := s.monitors
+    r.mu.Lock()
+    targets := []string{}
+    for id, patterns := range r.subs {
+        if id != peerId && matchesAny(patterns, netName) {
+            targets = append(targets, id)
+        }
+    }
+    r.delivered += int64(len(targets))
+    r.mu.Unlock()
+    for _, id := range targets {
+        s.sendToConn(s.getConn(id), monitorEvent(id, netName, typ, peerId, data, false))
+    }
+}
+
+func (s *Server) forgetMonitor(peerId string) {
+    s.monitors.mu.Lock()
+    delete(s.monitors.subs, peerId)
+    s.monitors.mu.Unlock()
+}
+
+func (s *Server) monitorSnapshot() map[string]interface{} {
+    r := s.monitors
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    patterns := map[string]int{}
+    for _, ps := range r.subs {
+        for _, p := range ps {
+            patterns[p]++
+        }
+    }
+    names := make([]string, 0, len(patterns))
+    for p := range patterns {
+        names = append(names, p)
+    }
+    sort.Strings(names)
+    return map[string]interface{}{"subscribers": len(r.subs), "patterns": names, "delivered": r.delivered}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "testing"
+    "time"
+)
+
+func TestMonitorWildcardSubscription(t *testing.T) {
+    s := NewServer(Options{MonitorToken: "watch", MonitorNetworks: []string{"game-*", "lobby"}})
+    mon, plain, early, late, other := randomPeerId(), randomPeerId(), randomPeerId(), randomPeerId(), randomPeerId()
+    conns := attachTestPeers(t, s, mon, plain, early, late, other)
+    for _, id := range []string{mon, plain, early, late, other} {
+        s.peerData[id].Monitor = id == mon
+    }
+    events := func(id string) []map[string]interface{} {
+        msgs, _ := conns[id].take(20 * time.Millisecond)
+        var out []map[string]interface{}
+        for _, raw := range msgs {
+            var m outboundMessage
+            json.Unmarshal(raw, &m)
+            d, _ := m.Data.(map[string]interface{})
+            if m.Type == "monitor-event" {
+                out = append(out, d)
+            } else if m.Type == "error" {
+                out = append(out, map[string]interface{}{"error": d["code"]})
+            }
+        }
+        return out
+    }
+    announce := func(id, netName string) {
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"`+netName+`","data":{}}`))
+    }
+    announce(early, "game-1")
+    s.cacheCrossHubPeer("game-2", "remote-peer", map[string]interface{}{"peerId": "remote-peer"})
+
+    s.handleMessage(plain, []byte(`{"type":"monitor-subscribe","data":{"patterns":["game-*"]}}`))
+    if got := events(plain); len(got) != 1 || got[0]["error"] != errMonitorUnauthorized {
+        t.Fatalf("a connection without the monitor token should be refused, got %v", got)
+    }
+    s.handleMessage(mon, []byte(`{"type":"monitor-subscribe","data":{"patterns":["["]}}`))
+    if got := events(mon); len(got) != 1 || got[0]["error"] != errMonitorPattern {
+        t.Fatalf("a malformed pattern should be refused, got %v", got)
+    }
+
+    s.handleMessage(mon, []byte(`{"type":"monitor-subscribe","data":{"patterns":["game-*","*"],"snapshot":true}}`))
+    snap := map[string]string{}
+    for _, e := range events(mon) {
+        if e["snapshot"] == true {
+            snap[e["peerId"].(string)] = e["networkName"].(string)
+        }
+    }
+    if len(snap) != 2 || snap[early] != "game-1" || snap["remote-peer"] != "game-2" {
+        t.Fatalf("snapshot should list local and mesh peers on matching networks, got %v", snap)
+    }
+
+    announce(late, "game-3")
+    announce(other, "secret")
+    got := events(mon)
+    if len(got) != 1 || got[0]["event"] != "peer-discovered" || got[0]["peerId"] != late || got[0]["networkName"] != "game-3" {
+        t.Fatalf("monitor should see game-3 but never networks outside MONITOR_NETWORKS, got %v", got)
+    }
+    s.handleDisconnect(late, reasonClientGoodbye, "")
+    if got := events(mon); len(got) != 1 || got[0]["event"] != "peer-disconnected" || got[0]["peerId"] != late {
+        t.Fatalf("monitor should see the disconnect, got %v", got)
+    }
+
+    s.handleMessage(mon, []byte(`{"type":"monitor-unsubscribe","data":{"patterns":["game-*"]}}`))
+    if snap := s.monitorSnapshot(); snap["subscribers"] != 1 || fmt.Sprint(snap["patterns"]) != "[*]" {
+        t.Fatalf("unsubscribe should drop only the named pattern, got %v", snap)
+    }
+    s.cleanupPeer(mon)
+    if snap := s.monitorSnapshot(); snap["subscribers"] != 0 || snap["delivered"] != int64(2) {
+        t.Fatalf("a closed monitor should be forgotten, got %v", snap)
+    }
+}
@@ -0,0 +1,24 @@
+package server
+
+// Same-network hints. Two peers on this hub whose connections come from the
+// same public IP are most likely behind the same NAT, so peer-discovered
+// between them carries "sameNetworkHint": true and clients can try host
+// candidates first and skip TURN. The address itself is never sent, and
+// peers on other hubs are never hinted. The hint is only as good as the
+// client IP the hub sees, so behind a proxy it depends on forwarded headers.
+const sameNetworkHintKey = "sameNetworkHint"
+
+// sameNetwork reports whether a and b should get a same-network hint.
+func (s *Server) sameNetwork(a, b *peerInfo) bool {
+    return s.opts.SameNetworkHints && a != nil && b != nil && !a.IsHub && !b.IsHub && a.RemoteAddress != "" && a.RemoteAddress == b.RemoteAddress
+}
+
+// discoveredData is the peer-discovered payload describing about for
+// recipient.
+func (s *Server) discoveredData(about string, aboutInfo *peerInfo, data map[string]interface{}, isHub bool, recipient *peerInfo) map[string]interface{} {
+    extra := map[string]interface{}{"peerId": about, "isHub": isHub}
+    if s.sameNetwork(aboutInfo, recipient) {
+        extra[sameNetworkHintKey] = true
+    }
+    return mergeMap(data, extra)
+}
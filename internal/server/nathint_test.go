@@ -0,0 +1,45 @@
+package server
+
+import (
+    "encoding/json"
+    "testing"
+    "time"
+)
+
+func TestSameNetworkHintBetweenPeersSharingAnAddress(t *testing.T) {
+    s := NewServer(Options{SameNetworkHints: true})
+    home1, home2, away := randomPeerId(), randomPeerId(), randomPeerId()
+    conns := map[string]*pollConn{}
+    for id, addr := range map[string]string{home1: "203.0.113.7", home2: "203.0.113.7", away: "198.51.100.1"} {
+        conns[id] = attachTestPeer(t, s, id)
+        s.peerData[id].RemoteAddress = addr
+    }
+    // hints returns, for each peer id learns about, whether it was hinted.
+    hints := func(id string) map[string]bool {
+        msgs, _ := conns[id].take(20 * time.Millisecond)
+        out := map[string]bool{}
+        for _, raw := range msgs {
+            var m struct {
+                Type string                 `json:"type"`
+                Data map[string]interface{} `json:"data"`
+            }
+            if json.Unmarshal(raw, &m) == nil && m.Type == "peer-discovered" {
+                hinted, _ := m.Data[sameNetworkHintKey].(bool)
+                out[m.Data["peerId"].(string)] = hinted
+            }
+        }
+        return out
+    }
+    for _, id := range []string{home1, away, home2} {
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"lobby","data":{}}`))
+    }
+    if got := hints(home2); len(got) != 2 || !got[home1] || got[away] {
+        t.Fatalf("newcomer should be hinted about its housemate only, got %v", got)
+    }
+    if got := hints(home1); !got[home2] || got[away] {
+        t.Fatalf("existing peer should be hinted about the newcomer only, got %v", got)
+    }
+    if got := hints(away); got[home1] || got[home2] {
+        t.Fatalf("a peer elsewhere should never be hinted, got %v", got)
+    }
+}
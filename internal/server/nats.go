@@ -0,0 +1,224 @@
+package server
+
+import (
+    "bufio"
+    "bytes"
+    "crypto/tls"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// natsTransport speaks the NATS client protocol over one connection:
+// CONNECT once, then PUB, SUB and PING. The event bridge publishes batches
+// on it and the backplane also subscribes.
+type natsTransport struct {
+    u    *url.URL
+    name string
+
+    // mu guards conn and serializes writes. r is only read by the
+    // goroutine that connected.
+    mu   sync.Mutex
+    conn net.Conn
+    r    *bufio.Reader
+}
+
+func (t *natsTransport) connect() error {
+    host := t.u.Host
+    if t.u.Port() == "" {
+        host = net.JoinHostPort(t.u.Hostname(), "4222")
+    }
+    conn, err := net.DialTimeout("tcp", host, integrationTimeout)
+    if err != nil {
+        return err
+    }
+    conn.SetDeadline(time.Now().Add(integrationTimeout))
+    r := bufio.NewReader(conn)
+    line, err := r.ReadString('\n')
+    if err != nil || !strings.HasPrefix(line, "INFO ") {
+        conn.Close()
+        return fmt.Errorf("nats: expected INFO, got %q", strings.TrimSpace(line))
+    }
+    if t.u.Scheme == "tls" {
+        tc := tls.Client(conn, &tls.Config{ServerName: t.u.Hostname()})
+        if err := tc.Handshake(); err != nil {
+            conn.Close()
+            return err
+        }
+        conn, r = tc, bufio.NewReader(tc)
+    }
+    opts := map[string]interface{}{"verbose": false, "pedantic": false, "name": t.name, "lang": "go", "version": Version}
+    if t.u.User != nil {
+        if pass, ok := t.u.User.Password(); ok {
+            opts["user"], opts["pass"] = t.u.User.Username(), pass
+        } else {
+            opts["auth_token"] = t.u.User.Username()
+        }
+    }
+    b, _ := json.Marshal(opts)
+    t.mu.Lock()
+    t.conn, t.r = conn, r
+    t.mu.Unlock()
+    if err := t.write([]byte("CONNECT " + string(b) + "\r\nPING\r\n")); err != nil {
+        t.close()
+        return err
+    }
+    return t.awaitPong()
+}
+
+func (t *natsTransport) write(b []byte) error {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.conn == nil {
+        return errors.New("nats: not connected")
+    }
+    t.conn.SetWriteDeadline(time.Now().Add(integrationTimeout))
+    _, err := t.conn.Write(b)
+    return err
+}
+
+func (t *natsTransport) setReadDeadline(d time.Time) error {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.conn == nil {
+        return errors.New("nats: not connected")
+    }
+    return t.conn.SetReadDeadline(d)
+}
+
+// appendPub appends a PUB of payload on subject to buf.
+func appendPub(buf *bytes.Buffer, subject string, payload []byte) {
+    fmt.Fprintf(buf, "PUB %s %d\r\n", subject, len(payload))
+    buf.Write(payload)
+    buf.WriteString("\r\n")
+}
+
+// natsMsg is a MSG delivered on a subscription.
+type natsMsg struct {
+    subject string
+    payload []byte
+}
+
+// next reads up to the server's next PONG or MSG, answering its PINGs. A
+// PONG is returned as a nil message.
+func (t *natsTransport) next() (*natsMsg, error) {
+    for {
+        line, err := t.r.ReadString('\n')
+        if err != nil {
+            return nil, err
+        }
+        line = strings.TrimSpace(line)
+        switch {
+        case line == "PONG":
+            return nil, nil
+        case line == "PING":
+            t.write([]byte("PONG\r\n"))
+        case strings.HasPrefix(line, "-ERR"):
+            return nil, errors.New("nats: " + strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+        case strings.HasPrefix(line, "MSG "):
+            // MSG <subject> <sid> [reply-to] <#bytes>
+            f := strings.Fields(line)
+            size, err := strconv.Atoi(f[len(f)-1])
+            if err != nil || len(f) < 4 {
+                return nil, fmt.Errorf("nats: bad MSG %q", line)
+            }
+            buf := make([]byte, size+2)
+            if _, err := io.ReadFull(t.r, buf); err != nil {
+                return nil, err
+            }
+            return &natsMsg{subject: f[1], payload: buf[:size]}, nil
+        }
+    }
+}
+
+// awaitPong reads until the server's PONG, closing the connection on a
+// failure.
+func (t *natsTransport) awaitPong() error {
+    for {
+        m, err := t.next()
+        if err != nil {
+            t.close()
+            return err
+        }
+        if m == nil {
+            return nil
+        }
+    }
+}
+
+// publish sends each record and a PING, so the PONG confirms the server
+// processed the batch. It connects first if needed.
+func (t *natsTransport) publish(batch []bridgeRecord) error {
+    t.mu.Lock()
+    connected := t.conn != nil
+    t.mu.Unlock()
+    if !connected {
+        if err := t.connect(); err != nil {
+            return err
+        }
+    }
+    var buf bytes.Buffer
+    for _, rec := range batch {
+        appendPub(&buf, rec.topic, rec.value)
+    }
+    buf.WriteString("PING\r\n")
+    t.setReadDeadline(time.Now().Add(integrationTimeout))
+    if err := t.write(buf.Bytes()); err != nil {
+        t.close()
+        return err
+    }
+    return t.awaitPong()
+}
+
+// pub sends one message without waiting for the server to confirm it.
+func (t *natsTransport) pub(subject string, payload []byte) error {
+    var buf bytes.Buffer
+    appendPub(&buf, subject, payload)
+    return t.write(buf.Bytes())
+}
+
+// subscribe subscribes to subjects on a connected transport and passes
+// each message to deliver until the connection fails or is closed. ready
+// runs once the server has confirmed the subscriptions.
+func (t *natsTransport) subscribe(subjects []string, ready func(), deliver func(subject string, payload []byte)) error {
+    if err := t.setReadDeadline(time.Time{}); err != nil {
+        return err
+    }
+    var cmd strings.Builder
+    for i, subject := range subjects {
+        fmt.Fprintf(&cmd, "SUB %s %d\r\n", subject, i+1)
+    }
+    cmd.WriteString("PING\r\n")
+    if err := t.write([]byte(cmd.String())); err != nil {
+        return err
+    }
+    subscribed := false
+    for {
+        m, err := t.next()
+        if err != nil {
+            return err
+        }
+        if m != nil {
+            deliver(m.subject, m.payload)
+        } else if !subscribed {
+            subscribed = true
+            ready()
+        }
+    }
+}
+
+func (t *natsTransport) close() {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.conn != nil {
+        t.conn.Close()
+        t.conn = nil
+    }
+}
@@ -0,0 +1,117 @@
+package server
+
+import "sync/atomic"
+
+const maxNetworkNameLen = 64
+
+// validNetworkName reports whether name is safe to use as a map key, metric
+// label and log field: 1-64 characters of letters, digits and . _ - : @ /.
+func validNetworkName(name string) bool {
+    if name == "" || len(name) > maxNetworkNameLen {
+        return false
+    }
+    for _, r := range name {
+        switch {
+        case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+        case r == '.', r == '_', r == '-', r == ':', r == '@', r == '/':
+        default:
+            return false
+        }
+    }
+    return true
+}
+
+// resolveNetwork maps a message's networkName to the network it addresses:
+// empty means DefaultNetwork. ok is false for malformed names and, when
+// AllowedNetworks is set, for networks not on it. The hub mesh namespace and
+// the default network are always permitted.
+func (s *Server) resolveNetwork(name string) (string, bool) {
+    if name == "" {
+        return s.opts.DefaultNetwork, true
+    }
+    if !validNetworkName(name) {
+        return "", false
+    }
+    if len(s.opts.AllowedNetworks) == 0 || name == s.opts.HubMeshNamespace || name == s.opts.DefaultNetwork {
+        return name, true
+    }
+    for _, n := range s.opts.AllowedNetworks {
+        if n == name || n == "*" {
+            return name, true
+        }
+    }
+    return "", false
+}
+
+// Network caps. Announces that would create a network beyond MaxNetworks, or
+// add a peer to a network already holding MaxPeersPerNetwork, are refused
+// with a typed error:
+//
+//     {"type": "error", "data": {"code": "network-limit-reached" | "network-full",
+//      "message": "...", "networkName": "...", "limit": 1000}}
+//
+// Hub links and the hub mesh namespace are never capped. Zero disables a cap.
+const (
+    errNetworkLimit = "network-limit-reached"
+    errNetworkFull  = "network-full"
+)
+
+// checkNetworkCaps reports the typed error code that refuses peerId joining
+// netName, or "" when it may join. The caller holds peersMu, which every
+// announce takes, so the answer stays true until it adds the peer.
+func (s *Server) checkNetworkCaps(peerId, netName string, isHub bool) (string, int) {
+    if isHub || netName == s.opts.HubMeshNamespace {
+        return "", 0
+    }
+    s.networkMu.Lock()
+    defer s.networkMu.Unlock()
+    set, exists := s.networkPeers[netName]
+    if !exists && s.opts.MaxNetworks > 0 && s.capCountedNetworks() >= s.opts.MaxNetworks {
+        atomic.AddInt64(&s.networkCapRejects, 1)
+        return errNetworkLimit, s.opts.MaxNetworks
+    }
+    if _, member := set[peerId]; !member && s.opts.MaxPeersPerNetwork > 0 && len(set) >= s.opts.MaxPeersPerNetwork {
+        atomic.AddInt64(&s.peerCapRejects, 1)
+        return errNetworkFull, s.opts.MaxPeersPerNetwork
+    }
+    return "", 0
+}
+
+// capCountedNetworks is the number of networks that count toward
+// MaxNetworks. The caller holds networkMu.
+func (s *Server) capCountedNetworks() int {
+    n := len(s.networkPeers)
+    if _, ok := s.networkPeers[s.opts.HubMeshNamespace]; ok {
+        n--
+    }
+    return n
+}
+
+// networkCapsSnapshot reports how close the hub is to its network caps.
+func (s *Server) networkCapsSnapshot() map[string]interface{} {
+    s.networkMu.Lock()
+    networks := s.capCountedNetworks()
+    largest, largestPeers := "", 0
+    for name, set := range s.networkPeers {
+        if name != s.opts.HubMeshNamespace && len(set) > largestPeers {
+            largest, largestPeers = name, len(set)
+        }
+    }
+    s.networkMu.Unlock()
+    out := map[string]interface{}{
+        "networks": networks,
+        "max_networks": s.opts.MaxNetworks,
+        "max_peers_per_network": s.opts.MaxPeersPerNetwork,
+        "largest_network": sanitizeLabel(largest),
+        "largest_network_peers": largestPeers,
+        "rejected_network_limit": atomic.LoadInt64(&s.networkCapRejects),
+        "rejected_network_full": atomic.LoadInt64(&s.peerCapRejects),
+    }
+    if s.opts.MaxNetworks > 0 {
+        out["network_utilization"] = float64(networks) / float64(s.opts.MaxNetworks)
+    }
+    if s.opts.MaxPeersPerNetwork > 0 {
+        out["peer_utilization"] = float64(largestPeers) / float64(s.opts.MaxPeersPerNetwork)
+    }
+    return out
+}
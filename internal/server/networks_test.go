@@ -0,0 +1,81 @@
+package server
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestNetworkNameValidationAndAllowlist(t *testing.T) {
+    for name, want := range map[string]bool{"lobby": true, "team-a/room_1": true, "": false, "bad name": false, "evil\x00": false, strings.Repeat("x", maxNetworkNameLen+1): false} {
+        if validNetworkName(name) != want {
+            t.Fatalf("validNetworkName(%q) = %v", name, !want)
+        }
+    }
+    s := NewServer(Options{DefaultNetwork: "lobby", AllowedNetworks: []string{"game"}, HubMeshNamespace: "pigeonhub-mesh"})
+    for name, want := range map[string]string{"": "lobby", "game": "game", "pigeonhub-mesh": "pigeonhub-mesh", "other": ""} {
+        if got, _ := s.resolveNetwork(name); got != want {
+            t.Fatalf("resolveNetwork(%q) = %q, want %q", name, got, want)
+        }
+    }
+    id := "0123456789abcdef0123456789abcdef01234567"
+    p := attachTestPeer(t, s, id)
+    s.handleMessage(id, []byte(`{"type":"announce","networkName":"other","data":{}}`))
+    if msgs, _ := p.take(time.Second); len(msgs) != 1 || !strings.Contains(string(msgs[0]), "unpermitted networkName") {
+        t.Fatalf("expected an error for a disallowed network, got %s", msgs)
+    }
+    s.handleMessage(id, []byte(`{"type":"announce","data":{}}`))
+    if pi := s.getPeerInfo(id); pi == nil || pi.NetworkName != "lobby" {
+        t.Fatalf("announce without networkName should join the default network: %+v", pi)
+    }
+}
+
+func TestNetworkCapsRejectAnnounces(t *testing.T) {
+    s := NewServer(Options{MaxNetworks: 1, MaxPeersPerNetwork: 2, HubMeshNamespace: "pigeonhub-mesh"})
+    a, b, c, hub := randomPeerId(), randomPeerId(), randomPeerId(), randomPeerId()
+    conns := attachTestPeers(t, s, a, b, c, hub)
+    // errorCode drains id's queue and returns the code of any error in it.
+    errorCode := func(id string) string {
+        msgs, _ := conns[id].take(20 * time.Millisecond)
+        for _, raw := range msgs {
+            var m struct {
+                Type string `json:"type"`
+                Data struct {
+                    Code string `json:"code"`
+                } `json:"data"`
+            }
+            if json.Unmarshal(raw, &m) == nil && m.Type == "error" {
+                return m.Data.Code
+            }
+        }
+        return ""
+    }
+    for _, id := range []string{a, b} {
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"lobby","data":{}}`))
+        if code := errorCode(id); code != "" {
+            t.Fatalf("announce under the caps was refused with %s", code)
+        }
+    }
+    s.handleMessage(c, []byte(`{"type":"announce","networkName":"lobby","data":{}}`))
+    if code := errorCode(c); code != errNetworkFull {
+        t.Fatalf("third peer in lobby got %q, want %s", code, errNetworkFull)
+    }
+    s.handleMessage(c, []byte(`{"type":"announce","networkName":"game","data":{}}`))
+    if code := errorCode(c); code != errNetworkLimit {
+        t.Fatalf("second network got %q, want %s", code, errNetworkLimit)
+    }
+    if s.getPeerInfo(c).Announced {
+        t.Fatalf("a refused peer should stay unannounced")
+    }
+    s.handleMessage(a, []byte(`{"type":"announce","networkName":"lobby","data":{"name":"again"}}`))
+    s.handleMessage(hub, []byte(`{"type":"announce","networkName":"pigeonhub-mesh","data":{"isHub":true}}`))
+    if code := errorCode(a) + errorCode(hub); code != "" {
+        t.Fatalf("re-announces and hub links should not be capped, got %s", code)
+    }
+
+    caps := s.networkCapsSnapshot()
+    if caps["networks"] != 1 || caps["largest_network"] != "lobby" || caps["peer_utilization"] != 1.0 || caps["rejected_network_full"] != int64(1) || caps["rejected_network_limit"] != int64(1) {
+        t.Fatalf("unexpected network_caps %v", caps)
+    }
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+    "sync"
+    "time"
+)
+
+const (
+    discoveryPaceInterval = 200 * time.Millisecond
+    discoveryBatchMax     = 100
+)
+
+// discoveryPacer limits how fast cross-hub discoveries reach local clients.
+// Each network gets a token bucket of CrossHubDiscoveryRatePerSec events;
+// discoveries that arrive faster than that queue up and go out as peer-list
+// batches, so a hub rejoining with thousands of peers does not flood clients.
+type discoveryPacer struct {
+    mu   sync.Mutex
+    rate float64
+    nets map[string]*pacedNetwork
+}
+
+type pacedNetwork struct {
+    tokens float64
+    last   time.Time
+    queue  []map[string]interface{}
+    queued map[string]int
+}
+
+func newDiscoveryPacer(rate int) *discoveryPacer {
+    return &discoveryPacer{rate: float64(rate), nets: map[string]*pacedNetwork{}}
+}
+
+func (p *discoveryPacer) refill(n *pacedNetwork, now time.Time) {
+    n.tokens += now.Sub(n.last).Seconds() * p.rate
+    if n.tokens > p.rate {
+        n.tokens = p.rate
+    }
+    n.last = now
+}
+
+// admit reports whether a discovery may go out immediately. If not, it is
+// queued (replacing an earlier queued entry for the same peer).
+func (p *discoveryPacer) admit(netName, peerId string, data map[string]interface{}, now time.Time) bool {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    n := p.nets[netName]
+    if n == nil {
+        n = &pacedNetwork{tokens: p.rate, last: now, queued: map[string]int{}}
+        p.nets[netName] = n
+    }
+    p.refill(n, now)
+    if len(n.queue) == 0 && n.tokens >= 1 {
+        n.tokens--
+        return true
+    }
+    if i, ok := n.queued[peerId]; ok {
+        n.queue[i] = data
+        return false
+    }
+    n.queued[peerId] = len(n.queue)
+    n.queue = append(n.queue, data)
+    return false
+}
+
+// drain returns, per network, the batches the bucket allows right now.
+func (p *discoveryPacer) drain(now time.Time) map[string][][]map[string]interface{} {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    out := map[string][][]map[string]interface{}{}
+    for name, n := range p.nets {
+        p.refill(n, now)
+        for len(n.queue) > 0 && n.tokens >= 1 {
+            k := len(n.queue)
+            if k > discoveryBatchMax {
+                k = discoveryBatchMax
+            }
+            out[name] = append(out[name], n.queue[:k])
+            n.queue = n.queue[k:]
+            n.tokens--
+        }
+        if len(n.queue) == 0 {
+            if n.tokens >= p.rate {
+                delete(p.nets, name)
+            } else {
+                n.queue, n.queued = nil, map[string]int{}
+            }
+            continue
+        }
+        n.queued = map[string]int{}
+        for i, d := range n.queue {
+            id, _ := d["peerId"].(string)
+            n.queued[id] = i
+        }
+    }
+    return out
+}
+
+func (p *discoveryPacer) backlog() map[string]int {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    out := map[string]int{}
+    for name, n := range p.nets {
+        if len(n.queue) > 0 {
+            out[name] = len(n.queue)
+        }
+    }
+    return out
+}
+
+// deliverCrossHubDiscovery hands a discovery from another hub to local peers,
+// subject to pacing when CrossHubDiscoveryRatePerSec is set.
+func (s *Server) deliverCrossHubDiscovery(netName, id string, m map[string]interface{}) {
+    s.metrics.PeerDiscovered()
+    if s.opts.CrossHubDiscoveryRatePerSec <= 0 || s.pacer.admit(netName, id, m, time.Now()) {
+        s.forwardDiscovery(netName, []map[string]interface{}{m})
+    }
+}
+
+// runDiscoveryPacer flushes queued discoveries as the per-network budget
+// allows. Peers that left the cross-hub cache while queued are dropped.
+func (s *Server) runDiscoveryPacer() {
+    ticker := time.NewTicker(discoveryPaceInterval)
+    defer ticker.Stop()
+    for range ticker.C {
+        if !s.running {
+            return
+        }
+        for netName, batches := range s.pacer.drain(time.Now()) {
+            for _, batch := range batches {
+                peers := make([]map[string]interface{}, 0, len(batch))
+                for _, d := range batch {
+                    if id, _ := d["peerId"].(string); s.isCrossHubPeerCached(netName, id) {
+                        peers = append(peers, d)
+                    }
+                }
+                if len(peers) > 0 {
+                    s.forwardDiscovery(netName, peers)
+                }
+            }
+        }
+    }
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+    "fmt"
+    "testing"
+    "time"
+)
+
+func TestDiscoveryPacerCoalescesBursts(t *testing.T) {
+    p := newDiscoveryPacer(2)
+    now := time.Now()
+    sent := 0
+    for i := 0; i < 250; i++ {
+        id := fmt.Sprintf("peer-%03d", i)
+        if p.admit("global", id, map[string]interface{}{"peerId": id}, now) {
+            sent++
+        }
+    }
+    if sent != 2 || p.backlog()["global"] != 248 {
+        t.Fatalf("expected 2 immediate and 248 queued, got %d and %v", sent, p.backlog())
+    }
+    out := p.drain(now.Add(time.Second))
+    if len(out["global"]) != 2 || len(out["global"][0]) != discoveryBatchMax {
+        t.Fatalf("expected two full batches after one second, got %d", len(out["global"]))
+    }
+    if p.backlog()["global"] != 48 {
+        t.Fatalf("expected 48 still queued, got %v", p.backlog())
+    }
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+    "fmt"
+    "runtime/debug"
+    "sync/atomic"
+    "github.com/gorilla/websocket"
+)
+
+// ErrorReporter receives recovered panics, e.g. to forward them to Sentry.
+// fields carries the goroutine kind, owner and stack trace.
+type ErrorReporter func(err error, fields map[string]interface{})
+
+// recoverPanic is deferred at the top of every long-lived goroutine. It logs
+// the stack, counts the panic, notifies the configured reporter and tears
+// down only the connection the goroutine belonged to.
+func (s *Server) recoverPanic(kind, owner string) {
+    r := recover()
+    if r == nil {
+        return
+    }
+    atomic.AddInt64(&s.panics, 1)
+    err, ok := r.(error)
+    if !ok {
+        err = fmt.Errorf("%v", r)
+    }
+    fields := map[string]interface{}{"kind": kind, "owner": owner, "error": err.Error(), "stack": string(debug.Stack())}
+    s.log.Error("goroutine_panic", fields)
+    if s.opts.ErrorReporter != nil {
+        func() {
+            defer func() { recover() }()
+            s.opts.ErrorReporter(err, fields)
+        }()
+    }
+    s.teardownAfterPanic(kind, owner)
+}
+
+func (s *Server) teardownAfterPanic(kind, owner string) {
+    switch kind {
+    case "conn-reader":
+        conn := s.getConn(owner)
+        s.handleDisconnect(owner, reasonError, "internal error")
+        if conn != nil {
+            closeWithReason(conn, websocket.CloseInternalServerErr, reasonError)
+        }
+    case "bootstrap-reader":
+        s.bootstrapMu.Lock()
+        b := s.bootstrapConns[owner]
+        s.bootstrapMu.Unlock()
+        if b != nil {
+            if b.ws != nil {
+                b.ws.Close()
+            }
+            s.handleBootstrapClose(b)
+        }
+    }
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+    "sync/atomic"
+    "testing"
+    "time"
+)
+
+func TestSpawnRecoversPanicAndReports(t *testing.T) {
+    reported := make(chan map[string]interface{}, 1)
+    s := NewServer(Options{ErrorReporter: func(err error, fields map[string]interface{}) { reported <- fields }})
+    s.spawn("conn-reader", "peer-1", func() { panic("boom") })
+    select {
+    case fields := <-reported:
+        if fields["kind"] != "conn-reader" || fields["error"] != "boom" || fields["stack"] == "" {
+            t.Fatalf("unexpected report %v", fields)
+        }
+    case <-time.After(time.Second):
+        t.Fatalf("panic was not reported")
+    }
+    if atomic.LoadInt64(&s.panics) != 1 {
+        t.Fatalf("expected panic counter 1, got %d", s.panics)
+    }
+}
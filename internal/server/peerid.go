@@ -0,0 +1,51 @@
+package server
+
+import "regexp"
+
+// Client peer IDs default to 40 hex characters, the format hubs use for
+// their own IDs. Operators with an existing identity scheme (UUIDs, base58)
+// can set PeerIdPattern to another regular expression, or embedders can set
+// PeerIdValidator, which replaces the pattern. PeerIdMinLength and
+// PeerIdMaxLength bound the length either way; the maximum defaults to 256
+// so a permissive pattern cannot let unbounded IDs into every map and log
+// line. Hub links on /mesh are always checked against the 40-hex format; a
+// hub bootstrapping over /ws must pass the client policy, so point
+// BOOTSTRAP_HUBS at /mesh when the policy would reject hub IDs.
+
+const defaultPeerIdMaxLength = 256
+
+type peerIdPolicy struct {
+    re       *regexp.Regexp
+    validate func(string) bool
+    min      int
+    max      int
+}
+
+// newPeerIdPolicy builds the policy from Options. Options.Validate reports an
+// invalid PeerIdPattern as a config error; an embedder that skips it gets a
+// logged warning and the default format, so a typo cannot open the hub to
+// any ID.
+func (s *Server) newPeerIdPolicy() *peerIdPolicy {
+    p := &peerIdPolicy{re: peerIdRe, validate: s.opts.PeerIdValidator, min: s.opts.PeerIdMinLength, max: s.opts.PeerIdMaxLength}
+    if pattern := s.opts.PeerIdPattern; pattern != "" {
+        re, err := regexp.Compile(pattern)
+        if err != nil {
+            s.log.Warn("peer_id_pattern_invalid", map[string]interface{}{"pattern": pattern, "error": err.Error()})
+        } else {
+            p.re = re
+        }
+    }
+    return p
+}
+
+// validPeerId reports whether a client may use id.
+func (s *Server) validPeerId(id string) bool {
+    p := s.peerIds
+    if id == "" || len(id) < p.min || len(id) > p.max {
+        return false
+    }
+    if p.validate != nil {
+        return p.validate(id)
+    }
+    return p.re.MatchString(id)
+}
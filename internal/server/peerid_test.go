@@ -0,0 +1,46 @@
+package server
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestPeerIdPolicyIsConfigurable(t *testing.T) {
+    uuid := NewServer(Options{PeerIdPattern: `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`})
+    if !uuid.validPeerId("3b241101-e2bb-4255-8caf-4136c566a962") || uuid.validPeerId("0123456789abcdef0123456789abcdef01234567") {
+        t.Fatalf("pattern should admit UUIDv4 and only UUIDv4")
+    }
+    base58 := NewServer(Options{PeerIdValidator: func(id string) bool { return strings.Trim(id, "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz") == "" }, PeerIdMinLength: 20, PeerIdMaxLength: 44})
+    if base58.validPeerId("5HueCGU8rMjxEXxiPuD5BDku4MkFqeZyd4dZ1jvhTVqvbTLvyTJ") {
+        t.Fatalf("max length should apply on top of the validator")
+    }
+    if !base58.validPeerId("3yZe7d4pRu5vKH1tM9bxqN2sWcLfGjA8") || base58.validPeerId("3yZe7d4pRu5vKH1tM9b0") || base58.validPeerId("3yZe7d4pRu5vK") {
+        t.Fatalf("validator and min length should both apply")
+    }
+    if err := (Options{PeerIdPattern: "(["}).Validate(); err == nil || !strings.Contains(err.Error(), "PeerIdPattern") {
+        t.Fatalf("an invalid pattern should be a config error, got %v", err)
+    }
+    typo := NewServer(Options{PeerIdPattern: "(["})
+    if typo.validPeerId("anything") || !typo.validPeerId("0123456789abcdef0123456789abcdef01234567") {
+        t.Fatalf("without Validate, an invalid pattern should keep the default format")
+    }
+
+    gin.SetMode(gin.TestMode)
+    uuid.running = true
+    uuid.routes()
+    srv := httptest.NewServer(uuid.engine)
+    defer srv.Close()
+    base := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?peerId="
+    if _, resp, err := websocket.DefaultDialer.Dial(base+"0123456789abcdef0123456789abcdef01234567", nil); err == nil || resp.StatusCode != http.StatusForbidden {
+        t.Fatalf("hex ID should be refused under a UUID policy, err=%v", err)
+    }
+    ws, _, err := websocket.DefaultDialer.Dial(base+"3b241101-e2bb-4255-8caf-4136c566a962", nil)
+    if err != nil {
+        t.Fatalf("UUID peer should connect: %v", err)
+    }
+    ws.Close()
+}
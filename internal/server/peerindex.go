@@ -0,0 +1,415 @@
+package server
+
+import (
+    "fmt"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "github.com/gin-gonic/gin"
+)
+
+// Peer metadata indexes. Capability and label queries, find-peers and
+// capability: signaling, look peers up in inverted indexes instead of
+// scanning every peer's announce data. Each network keeps capability ->
+// peers and "key=value" label -> peers, built from data.capabilities (a list
+// of strings) and data.labels (an object of plain values). The hub keeps one
+// index for its own peers, updated on announce and disconnect, and one for
+// peers in the cross-hub cache, updated as gossip adds and removes them.
+// Index sizes and query counts are under "peer_index" in /metrics.
+//
+// presence-summary, and /admin/presence-summary for dashboards, answers with
+// counts instead of peers: how many peers a network has and how many have
+// each capability and each value of the asked-for label keys, read off the
+// posting set sizes without touching peer records.
+
+const (
+    defaultFoundPeers = 100
+    maxFoundPeers     = 500
+    maxSummaryTerms   = 100
+)
+
+type indexedPeer struct {
+    network string
+    caps    []string
+    labels  []string
+}
+
+type peerIndex struct {
+    mu      sync.Mutex
+    caps    map[string]map[string]map[string]struct{}
+    labels  map[string]map[string]map[string]struct{}
+    peers   map[string]indexedPeer
+    queries int64
+}
+
+func newPeerIndex() *peerIndex {
+    return &peerIndex{caps: map[string]map[string]map[string]struct{}{}, labels: map[string]map[string]map[string]struct{}{}, peers: map[string]indexedPeer{}}
+}
+
+// peerCapabilities returns the capability names in announce data.
+func peerCapabilities(data map[string]interface{}) []string {
+    var out []string
+    switch caps := data["capabilities"].(type) {
+    case []interface{}:
+        for _, c := range caps {
+            if v, ok := c.(string); ok && v != "" {
+                out = append(out, v)
+            }
+        }
+    case []string:
+        for _, v := range caps {
+            if v != "" {
+                out = append(out, v)
+            }
+        }
+    }
+    return out
+}
+
+// peerLabels returns announce data's labels as "key=value" terms. Values
+// that are not strings, numbers or booleans are not indexed.
+func peerLabels(data map[string]interface{}) []string {
+    var out []string
+    switch labels := data["labels"].(type) {
+    case map[string]interface{}:
+        for k, v := range labels {
+            switch v.(type) {
+            case string, float64, bool:
+                out = append(out, labelTerm(k, v))
+            }
+        }
+    case map[string]string:
+        for k, v := range labels {
+            out = append(out, labelTerm(k, v))
+        }
+    }
+    return out
+}
+
+func labelTerm(key string, value interface{}) string {
+    return key + "=" + fmt.Sprint(value)
+}
+
+func addPosting(idx map[string]map[string]map[string]struct{}, netName, term, peerId string) {
+    byTerm := idx[netName]
+    if byTerm == nil {
+        byTerm = map[string]map[string]struct{}{}
+        idx[netName] = byTerm
+    }
+    set := byTerm[term]
+    if set == nil {
+        set = map[string]struct{}{}
+        byTerm[term] = set
+    }
+    set[peerId] = struct{}{}
+}
+
+func removePosting(idx map[string]map[string]map[string]struct{}, netName, term, peerId string) {
+    byTerm := idx[netName]
+    if set := byTerm[term]; set != nil {
+        delete(set, peerId)
+        if len(set) == 0 {
+            delete(byTerm, term)
+        }
+    }
+    if len(byTerm) == 0 {
+        delete(idx, netName)
+    }
+}
+
+// put indexes a peer's announce data on netName, replacing what was
+// indexed for it before.
+func (x *peerIndex) put(netName, peerId string, data map[string]interface{}) {
+    caps, labels := peerCapabilities(data), peerLabels(data)
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.removeLocked(peerId)
+    if len(caps) == 0 && len(labels) == 0 {
+        return
+    }
+    for _, c := range caps {
+        addPosting(x.caps, netName, c, peerId)
+    }
+    for _, l := range labels {
+        addPosting(x.labels, netName, l, peerId)
+    }
+    x.peers[peerId] = indexedPeer{network: netName, caps: caps, labels: labels}
+}
+
+// drop removes a peer from the index; with netName set, only if that is
+// the network it was indexed on.
+func (x *peerIndex) drop(netName, peerId string) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    if p, ok := x.peers[peerId]; ok && (netName == "" || p.network == netName) {
+        x.removeLocked(peerId)
+    }
+}
+
+// dropNetwork removes every peer indexed on netName.
+func (x *peerIndex) dropNetwork(netName string) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    for id, p := range x.peers {
+        if p.network == netName {
+            delete(x.peers, id)
+        }
+    }
+    delete(x.caps, netName)
+    delete(x.labels, netName)
+}
+
+func (x *peerIndex) removeLocked(peerId string) {
+    p, ok := x.peers[peerId]
+    if !ok {
+        return
+    }
+    for _, c := range p.caps {
+        removePosting(x.caps, p.network, c, peerId)
+    }
+    for _, l := range p.labels {
+        removePosting(x.labels, p.network, l, peerId)
+    }
+    delete(x.peers, peerId)
+}
+
+// query returns the peers on netName that have every capability and every
+// label term, sorted by peer ID. Posting sets are intersected smallest
+// first, so a query costs the size of its rarest term.
+func (x *peerIndex) query(netName string, caps, labels []string) []string {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.queries++
+    sets := make([]map[string]struct{}, 0, len(caps)+len(labels))
+    for _, c := range caps {
+        sets = append(sets, x.caps[netName][c])
+    }
+    for _, l := range labels {
+        sets = append(sets, x.labels[netName][l])
+    }
+    if len(sets) == 0 {
+        return nil
+    }
+    sort.Slice(sets, func(i, j int) bool { return len(sets[i]) < len(sets[j]) })
+    out := []string{}
+    for id := range sets[0] {
+        match := true
+        for _, set := range sets[1:] {
+            if _, ok := set[id]; !ok {
+                match = false
+                break
+            }
+        }
+        if match {
+            out = append(out, id)
+        }
+    }
+    sort.Strings(out)
+    return out
+}
+
+// counts adds to capCounts the number of peers on netName with each
+// capability in caps, or with every capability when caps is empty, and to
+// labelCounts the number with each value of the label keys.
+func (x *peerIndex) counts(netName string, caps, keys []string, capCounts map[string]int, labelCounts map[string]map[string]int) {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    x.queries++
+    if len(caps) == 0 {
+        for c, set := range x.caps[netName] {
+            capCounts[c] += len(set)
+        }
+    }
+    for _, c := range caps {
+        capCounts[c] += len(x.caps[netName][c])
+    }
+    if len(keys) == 0 {
+        return
+    }
+    wanted := map[string]bool{}
+    for _, k := range keys {
+        wanted[k] = true
+    }
+    for term, set := range x.labels[netName] {
+        k, v, ok := strings.Cut(term, "=")
+        if !ok || !wanted[k] {
+            continue
+        }
+        if labelCounts[k] == nil {
+            labelCounts[k] = map[string]int{}
+        }
+        labelCounts[k][v] += len(set)
+    }
+}
+
+func (x *peerIndex) snapshot() map[string]interface{} {
+    x.mu.Lock()
+    defer x.mu.Unlock()
+    capTerms, labelTerms, postings := 0, 0, 0
+    for _, byTerm := range x.caps {
+        capTerms += len(byTerm)
+        for _, set := range byTerm {
+            postings += len(set)
+        }
+    }
+    for _, byTerm := range x.labels {
+        labelTerms += len(byTerm)
+        for _, set := range byTerm {
+            postings += len(set)
+        }
+    }
+    return map[string]interface{}{"peers": len(x.peers), "capabilities": capTerms, "labels": labelTerms, "postings": postings, "queries": x.queries}
+}
+
+func (s *Server) peerIndexSnapshot() map[string]interface{} {
+    return map[string]interface{}{"local": s.localIndex.snapshot(), "remote": s.remoteIndex.snapshot()}
+}
+
+// findPeerQuery reads the capabilities and labels a query asks for.
+func findPeerQuery(m map[string]interface{}) (caps, labels []string) {
+    caps = peerCapabilities(m)
+    if c, ok := m["capability"].(string); ok && c != "" {
+        caps = append(caps, c)
+    }
+    return caps, peerLabels(m)
+}
+
+// handleFindPeers answers find-peers, {"capabilities": [...], "labels":
+// {...}, "limit": 50, "queryId": "..."}, with peers-found: the matching peers
+// on the network, local ones first, each with its announce data.
+func (s *Server) handleFindPeers(peerId string, msg inboundMessage) {
+    netName := firstNonEmpty(msg.NetworkName, s.opts.DefaultNetwork)
+    m, _ := msg.Data.(map[string]interface{})
+    caps, labels := findPeerQuery(m)
+    queryId, _ := m["queryId"].(string)
+    if len(caps) == 0 && len(labels) == 0 {
+        s.sendError(s.getConn(peerId), peerId, "find-peers requires capabilities or labels")
+        return
+    }
+    limit := defaultFoundPeers
+    if v, ok := m["limit"].(float64); ok && v > 0 {
+        limit = int(v)
+    }
+    if limit > maxFoundPeers {
+        limit = maxFoundPeers
+    }
+    found := []map[string]interface{}{}
+    seen := map[string]bool{peerId: true}
+    total := 0
+    for _, id := range s.localIndex.query(netName, caps, labels) {
+        pi := s.getPeerInfo(id)
+        if seen[id] || pi == nil || !pi.Announced || pi.NetworkName != netName {
+            continue
+        }
+        seen[id] = true
+        if total++; len(found) < limit {
+            found = append(found, map[string]interface{}{"peerId": id, "local": true, "data": pi.Data})
+        }
+    }
+    remote := s.remoteIndex.query(netName, caps, labels)
+    s.bootstrapMu.Lock()
+    for _, id := range remote {
+        data, ok := s.crossHubCache[netName][id]
+        if seen[id] || !ok {
+            continue
+        }
+        seen[id] = true
+        if total++; len(found) < limit {
+            found = append(found, map[string]interface{}{"peerId": id, "local": false, "data": data})
+        }
+    }
+    s.bootstrapMu.Unlock()
+    s.forwardToLocalTarget(peerId, outboundMessage{Type: "peers-found", Data: map[string]interface{}{"queryId": queryId, "peers": found, "total": total, "truncated": total > len(found)}, FromPeerId: "system", TargetPeer: peerId, NetworkName: netName, Timestamp: nowMs()})
+}
+
+// presenceSummary counts the listed peers on netName, local and remote, by
+// capability and by the values of the label keys. Without caps it counts
+// every capability, keeping the maxSummaryTerms most common.
+func (s *Server) presenceSummary(netName string, caps, keys []string) map[string]interface{} {
+    local := 0
+    for _, id := range s.getActivePeers("", netName) {
+        if pi := s.getPeerInfo(id); pi != nil && pi.Announced && !pi.IsHub && !hiddenPeer(pi.Data) {
+            local++
+        }
+    }
+    s.bootstrapMu.Lock()
+    remote := len(s.crossHubCache[netName])
+    s.bootstrapMu.Unlock()
+    capCounts, labelCounts := map[string]int{}, map[string]map[string]int{}
+    s.localIndex.counts(netName, caps, keys, capCounts, labelCounts)
+    s.remoteIndex.counts(netName, caps, keys, capCounts, labelCounts)
+    truncated := trimCounts(capCounts)
+    for _, values := range labelCounts {
+        truncated = trimCounts(values) || truncated
+    }
+    return map[string]interface{}{"networkName": netName, "peers": local + remote, "local": local, "remote": remote, "capabilities": capCounts, "labels": labelCounts, "truncated": truncated}
+}
+
+// trimCounts keeps the maxSummaryTerms largest counts, reporting whether
+// it dropped any.
+func trimCounts(counts map[string]int) bool {
+    if len(counts) <= maxSummaryTerms {
+        return false
+    }
+    terms := make([]string, 0, len(counts))
+    for t := range counts {
+        terms = append(terms, t)
+    }
+    sort.Slice(terms, func(i, j int) bool {
+        if counts[terms[i]] != counts[terms[j]] {
+            return counts[terms[i]] > counts[terms[j]]
+        }
+        return terms[i] < terms[j]
+    })
+    for _, t := range terms[maxSummaryTerms:] {
+        delete(counts, t)
+    }
+    return true
+}
+
+// summaryKeys reads the label keys a presence-summary asks for, a list of
+// strings.
+func summaryKeys(v interface{}) []string {
+    var out []string
+    switch keys := v.(type) {
+    case []interface{}:
+        for _, k := range keys {
+            if s, ok := k.(string); ok && s != "" {
+                out = append(out, s)
+            }
+        }
+    case []string:
+        out = keys
+    }
+    return out
+}
+
+// handlePresenceSummary answers presence-summary, {"capabilities": [...],
+// "labels": ["region"], "queryId": "..."}, with the counts for the network.
+func (s *Server) handlePresenceSummary(peerId string, msg inboundMessage) {
+    netName := firstNonEmpty(msg.NetworkName, s.opts.DefaultNetwork)
+    m, _ := msg.Data.(map[string]interface{})
+    queryId, _ := m["queryId"].(string)
+    summary := s.presenceSummary(netName, peerCapabilities(m), summaryKeys(m["labels"]))
+    summary["queryId"] = queryId
+    s.forwardToLocalTarget(peerId, outboundMessage{Type: "presence-summary", Data: summary, FromPeerId: "system", TargetPeer: peerId, NetworkName: netName, Timestamp: nowMs()})
+}
+
+func (s *Server) adminPresenceSummary(c *gin.Context) {
+    netName := firstNonEmpty(c.Query("network"), s.opts.DefaultNetwork)
+    writeJSON(c.Writer, http.StatusOK, s.presenceSummary(netName, splitQuery(c.QueryArray("capability")), splitQuery(c.QueryArray("label"))), s.opts.CORSOrigin)
+}
+
+// splitQuery flattens repeated and comma-separated query values.
+func splitQuery(values []string) []string {
+    var out []string
+    for _, v := range values {
+        for _, part := range strings.Split(v, ",") {
+            if part = strings.TrimSpace(part); part != "" {
+                out = append(out, part)
+            }
+        }
+    }
+    return out
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func TestFindPeersUsesMetadataIndexes(t *testing.T) {
+    s := NewServer(Options{})
+    a, b, c := randomPeerId(), randomPeerId(), randomPeerId()
+    announce := func(id, data string) {
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"game","data":`+data+`}`))
+    }
+    conns := attachTestPeers(t, s, a, b, c)
+    announce(a, `{}`)
+    announce(b, `{"capabilities":["gpu","relay"],"labels":{"region":"eu","tier":2}}`)
+    announce(c, `{"capabilities":["gpu"],"labels":{"region":"us"}}`)
+    remote := randomPeerId()
+    s.cacheCrossHubPeer("game", remote, map[string]interface{}{"peerId": remote, "capabilities": []interface{}{"gpu"}, "labels": map[string]interface{}{"region": "eu"}})
+    find := func(query string) map[string]interface{} {
+        conns[a].take(20 * time.Millisecond)
+        s.handleMessage(a, []byte(`{"type":"find-peers","networkName":"game","data":`+query+`}`))
+        msgs, _ := conns[a].take(20 * time.Millisecond)
+        for _, raw := range msgs {
+            var m outboundMessage
+            json.Unmarshal(raw, &m)
+            if m.Type == "peers-found" {
+                return m.Data.(map[string]interface{})
+            }
+        }
+        t.Fatalf("no peers-found for %s", query)
+        return nil
+    }
+    ids := func(res map[string]interface{}) []string {
+        out := []string{}
+        for _, p := range res["peers"].([]interface{}) {
+            out = append(out, p.(map[string]interface{})["peerId"].(string))
+        }
+        return out
+    }
+
+    if got := ids(find(`{"capabilities":["gpu"],"labels":{"region":"eu"},"queryId":"q1"}`)); len(got) != 2 || got[0] != b || got[1] != remote {
+        t.Fatalf("expected local b then remote peer, got %v", got)
+    }
+    if got := ids(find(`{"labels":{"tier":2}}`)); len(got) != 1 || got[0] != b {
+        t.Fatalf("numeric labels should match, got %v", got)
+    }
+    if res := find(`{"capability":"gpu","limit":1}`); len(ids(res)) != 1 || res["total"].(float64) != 3 || res["truncated"] != true {
+        t.Fatalf("limit should truncate, got %v", res)
+    }
+
+    announce(b, `{"capabilities":["relay"],"labels":{"region":"eu"}}`)
+    if got := ids(find(`{"capabilities":["gpu"],"labels":{"region":"eu"}}`)); len(got) != 1 || got[0] != remote {
+        t.Fatalf("re-announce should reindex b, got %v", got)
+    }
+    s.handleRemoteDisconnect("", "ws://hub-b", inboundMessage{Type: "peer-disconnected", Data: map[string]interface{}{"peerId": remote}, NetworkName: "game", MessageId: "m1", OriginHub: "hub-b"})
+    s.cleanupPeer(c)
+    if got := ids(find(`{"capability":"gpu"}`)); len(got) != 0 {
+        t.Fatalf("departed peers should leave the index, got %v", got)
+    }
+    idx := s.peerIndexSnapshot()
+    if local := idx["local"].(map[string]interface{}); local["peers"] != 1 || local["queries"].(int64) != 5 {
+        t.Fatalf("unexpected index stats %v", idx)
+    }
+}
+
+func TestPresenceSummaryCountsByCapabilityAndLabel(t *testing.T) {
+    s := NewServer(Options{AdminToken: "adm"})
+    conns := map[string]*pollConn{}
+    announce := func(data string) string {
+        id := randomPeerId()
+        conns[id] = attachTestPeer(t, s, id)
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"stage","data":`+data+`}`))
+        return id
+    }
+    for i := 0; i < 3; i++ {
+        announce(`{"capabilities":["viewer"],"labels":{"region":"eu"}}`)
+    }
+    announce(`{"capabilities":["broadcaster"],"labels":{"region":"us","tier":"pro"}}`)
+    announce(`{"capabilities":["viewer"],"visibility":"hidden"}`)
+    asker := announce(`{}`)
+    s.cacheCrossHubPeer("stage", "remote-1", map[string]interface{}{"peerId": "remote-1", "capabilities": []interface{}{"viewer"}, "labels": map[string]interface{}{"region": "us"}})
+
+    conns[asker].take(20 * time.Millisecond)
+    s.handleMessage(asker, []byte(`{"type":"presence-summary","networkName":"stage","data":{"capabilities":["viewer","broadcaster","editor"],"labels":["region"],"queryId":"q1"}}`))
+    msgs, _ := conns[asker].take(20 * time.Millisecond)
+    var reply struct {
+        Type string
+        Data struct {
+            QueryId      string                    `json:"queryId"`
+            Peers        int                       `json:"peers"`
+            Local        int                       `json:"local"`
+            Remote       int                       `json:"remote"`
+            Capabilities map[string]int            `json:"capabilities"`
+            Labels       map[string]map[string]int `json:"labels"`
+        }
+    }
+    if len(msgs) != 1 || json.Unmarshal(msgs[0], &reply) != nil || reply.Type != "presence-summary" {
+        t.Fatalf("expected one presence-summary, got %s", msgs)
+    }
+    d := reply.Data
+    if d.QueryId != "q1" || d.Peers != 6 || d.Local != 5 || d.Remote != 1 {
+        t.Fatalf("unexpected totals %+v", d)
+    }
+    if d.Capabilities["viewer"] != 4 || d.Capabilities["broadcaster"] != 1 || d.Capabilities["editor"] != 0 || len(d.Capabilities) != 3 {
+        t.Fatalf("unexpected capability counts %v", d.Capabilities)
+    }
+    if d.Labels["region"]["eu"] != 3 || d.Labels["region"]["us"] != 2 || d.Labels["tier"] != nil {
+        t.Fatalf("unexpected label counts %v", d.Labels)
+    }
+
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    req, _ := http.NewRequest("GET", ts.URL+"/admin/presence-summary?network=stage&label=region,tier", nil)
+    req.Header.Set("Authorization", "Bearer adm")
+    res, err := http.DefaultClient.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer res.Body.Close()
+    var admin struct {
+        Capabilities map[string]int            `json:"capabilities"`
+        Labels       map[string]map[string]int `json:"labels"`
+    }
+    json.NewDecoder(res.Body).Decode(&admin)
+    if admin.Capabilities["viewer"] != 4 || len(admin.Capabilities) != 2 || admin.Labels["tier"]["pro"] != 1 {
+        t.Fatalf("unexpected admin summary %+v", admin)
+    }
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+    "encoding/json"
+    "strconv"
+    "sync/atomic"
+)
+
+// Peer presence. Besides free-form announce data, every peer has a
+// Presence: a display name, capabilities, an app version and string tags,
+// sent as data.presence in announce:
+//
+//     {"type": "announce", "data": {"presence": {"displayName": "alice",
+//      "capabilities": ["video"], "appVersion": "2.1.0",
+//      "tags": {"region": "eu"}}}}
+//
+// The hub validates it and stamps updatedAt, and it travels with the peer's
+// data in peer-discovered, to local peers and across the mesh. A top-level
+// data.capabilities list, the older way to advertise capabilities, fills in
+// presence capabilities when the presence has none; the presence list is
+// copied back to data.capabilities so capability signaling and find-peers
+// keep working, including on older hubs. An announce with an invalid
+// presence is refused with an invalid-presence error.
+//
+// A peer changes its presence without re-announcing with
+//
+//     {"type": "presence-update", "data": {"displayName": "alice (away)",
+//      "tags": {"status": "away", "region": null}}}
+//
+// Fields present replace the current ones, and tags merge, with null
+// removing a tag. The network, and the hubs caching the peer, get
+// {"type": "presence-update", "fromPeerId": ..., "data": {"peerId": ...,
+// "presence": {...}}} with the whole new presence. Hidden peers update
+// silently. Counts are under "presence" in /metrics.
+const (
+    errInvalidPresence = "invalid-presence"
+
+    maxDisplayNameLen       = 64
+    maxAppVersionLen        = 64
+    maxPresenceCapabilities = 32
+    maxCapabilityLen        = 64
+    maxPresenceTags         = 32
+    maxTagKeyLen            = 64
+    maxTagValueLen          = 256
+)
+
+// Presence is a peer's self-description.
+type Presence struct {
+    DisplayName  string            `json:"displayName,omitempty"`
+    Capabilities []string          `json:"capabilities,omitempty"`
+    AppVersion   string            `json:"appVersion,omitempty"`
+    Tags         map[string]string `json:"tags,omitempty"`
+    UpdatedAt    int64             `json:"updatedAt"`
+}
+
+// presencePatch is the data of a presence-update. Nil fields are left as
+// they are; a nil tag value removes the tag.
+type presencePatch struct {
+    DisplayName  *string            `json:"displayName"`
+    Capabilities *[]string          `json:"capabilities"`
+    AppVersion   *string            `json:"appVersion"`
+    Tags         map[string]*string `json:"tags"`
+}
+
+type presenceMetaStats struct {
+    updates  int64
+    relayed  int64
+    rejected int64
+}
+
+// parsePresence decodes a presence, whether it came straight off a client
+// socket or out of gossip.
+func parsePresence(v interface{}) (Presence, bool) {
+    var p Presence
+    b, err := json.Marshal(v)
+    if err != nil || json.Unmarshal(b, &p) != nil {
+        return Presence{}, false
+    }
+    return p, true
+}
+
+// checkPresence returns what is wrong with p, or "".
+func checkPresence(p Presence) string {
+    switch {
+    case len(p.DisplayName) > maxDisplayNameLen:
+        return "displayName must be at most " + strconv.Itoa(maxDisplayNameLen) + " bytes"
+    case len(p.AppVersion) > maxAppVersionLen:
+        return "appVersion must be at most " + strconv.Itoa(maxAppVersionLen) + " bytes"
+    case len(p.Capabilities) > maxPresenceCapabilities:
+        return "at most " + strconv.Itoa(maxPresenceCapabilities) + " capabilities"
+    case len(p.Tags) > maxPresenceTags:
+        return "at most " + strconv.Itoa(maxPresenceTags) + " tags"
+    }
+    for _, c := range p.Capabilities {
+        if c == "" || len(c) > maxCapabilityLen {
+            return "capabilities must be 1-" + strconv.Itoa(maxCapabilityLen) + " bytes"
+        }
+    }
+    for k, v := range p.Tags {
+        if k == "" || len(k) > maxTagKeyLen || len(v) > maxTagValueLen {
+            return "tag keys must be 1-" + strconv.Itoa(maxTagKeyLen) + " bytes and values at most " + strconv.Itoa(maxTagValueLen)
+        }
+    }
+    return ""
+}
+
+// peerPresence returns the presence stored in peer data.
+func peerPresence(data map[string]interface{}) Presence {
+    switch p := data["presence"].(type) {
+    case Presence:
+        return p
+    case nil:
+        return Presence{}
+    default:
+        out, _ := parsePresence(p)
+        return out
+    }
+}
+
+// withPresence returns a copy of data carrying p.
+func withPresence(data map[string]interface{}, p Presence) map[string]interface{} {
+    out := make(map[string]interface{}, len(data)+2)
+    for k, v := range data {
+        out[k] = v
+    }
+    out["presence"] = p
+    if len(p.Capabilities) > 0 {
+        out["capabilities"] = p.Capabilities
+    }
+    return out
+}
+
+// samePresence reports whether a and b differ in nothing but their stamps.
+func samePresence(a, b Presence) bool {
+    a.UpdatedAt, b.UpdatedAt = 0, 0
+    x, _ := json.Marshal(a)
+    y, _ := json.Marshal(b)
+    return string(x) == string(y)
+}
+
+func (s *Server) rejectPresence(peerId, problem string) {
+    atomic.AddInt64(&s.presenceMeta.rejected, 1)
+    s.sendToConn(s.getConn(peerId), outboundMessage{Type: "error", Data: map[string]interface{}{"code": errInvalidPresence, "message": problem}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+}
+
+// normalizePresence validates data["presence"] in place and stamps it,
+// keeping the previous stamp when a re-announce leaves the presence as it
+// was. It reports false, after sending the peer an invalid-presence error,
+// when the presence is malformed.
+func (s *Server) normalizePresence(peerId string, data map[string]interface{}) bool {
+    var p Presence
+    if raw, ok := data["presence"]; ok && raw != nil {
+        var valid bool
+        if p, valid = parsePresence(raw); !valid {
+            s.rejectPresence(peerId, "presence must be an object of displayName, capabilities, appVersion and tags")
+            return false
+        }
+    }
+    if len(p.Capabilities) == 0 {
+        p.Capabilities = peerCapabilities(data)
+    }
+    if problem := checkPresence(p); problem != "" {
+        s.rejectPresence(peerId, problem)
+        return false
+    }
+    p.UpdatedAt = nowMs()
+    if pi := s.getPeerInfo(peerId); pi != nil && pi.Announced {
+        if prev := peerPresence(pi.Data); samePresence(prev, p) {
+            p.UpdatedAt = prev.UpdatedAt
+        }
+    }
+    data["presence"] = p
+    if len(p.Capabilities) > 0 {
+        data["capabilities"] = p.Capabilities
+    }
+    return true
+}
+
+// handlePresenceUpdate applies a peer's presence-update and tells its
+// network and the mesh.
+func (s *Server) handlePresenceUpdate(peerId string, msg inboundMessage) {
+    var patch presencePatch
+    b, _ := json.Marshal(msg.Data)
+    if json.Unmarshal(b, &patch) != nil {
+        s.rejectPresence(peerId, "presence-update must be an object of displayName, capabilities, appVersion and tags")
+        return
+    }
+    s.peersMu.Lock()
+    pi := s.peerData[peerId]
+    if pi == nil || !pi.Announced || pi.IsHub {
+        s.peersMu.Unlock()
+        s.sendError(s.getConn(peerId), peerId, "presence-update requires an announced peer")
+        return
+    }
+    p := peerPresence(pi.Data)
+    if patch.DisplayName != nil {
+        p.DisplayName = *patch.DisplayName
+    }
+    if patch.Capabilities != nil {
+        p.Capabilities = *patch.Capabilities
+    }
+    if patch.AppVersion != nil {
+        p.AppVersion = *patch.AppVersion
+    }
+    if len(patch.Tags) > 0 {
+        tags := make(map[string]string, len(p.Tags)+len(patch.Tags))
+        for k, v := range p.Tags {
+            tags[k] = v
+        }
+        for k, v := range patch.Tags {
+            if v == nil {
+                delete(tags, k)
+            } else {
+                tags[k] = *v
+            }
+        }
+        p.Tags = tags
+    }
+    if problem := checkPresence(p); problem != "" {
+        s.peersMu.Unlock()
+        s.rejectPresence(peerId, problem)
+        return
+    }
+    p.UpdatedAt = nowMs()
+    data := withPresence(pi.Data, p)
+    if patch.Capabilities != nil && len(p.Capabilities) == 0 {
+        delete(data, "capabilities")
+    }
+    pi.Data = data
+    netName := firstNonEmpty(pi.NetworkName, s.opts.DefaultNetwork)
+    s.peersMu.Unlock()
+    atomic.AddInt64(&s.presenceMeta.updates, 1)
+    s.indexAnnounced(netName, peerId, false, data)
+    if hiddenPeer(data) {
+        return
+    }
+    s.changes.publish(changeUpdated, netName, peerId, data, "")
+    update := outboundMessage{Type: "presence-update", Data: map[string]interface{}{"peerId": peerId, "presence": p}, FromPeerId: peerId, NetworkName: netName, Timestamp: nowMs(), MessageId: newMessageId()}
+    s.deliverPresenceUpdate(peerId, update)
+    s.markRelayed("presence-update:" + update.MessageId)
+    s.forwardToMesh(update, "", "")
+}
+
+// relayPresenceUpdate applies a presence-update from another hub to the
+// cross-hub cache, tells local peers and passes it on. An update from a hub
+// other than the one the cached peer lives on is stale and dropped.
+func (s *Server) relayPresenceUpdate(fromHub, fromUri string, msg inboundMessage) {
+    netName := firstNonEmpty(msg.NetworkName, s.opts.DefaultNetwork)
+    m, _ := msg.Data.(map[string]interface{})
+    id, _ := m["peerId"].(string)
+    if id == "" || msg.MessageId == "" || s.alreadyVisited(msg) || !s.markRelayed("presence-update:"+msg.MessageId) {
+        return
+    }
+    p, ok := parsePresence(m["presence"])
+    if !ok || checkPresence(p) != "" {
+        return
+    }
+    s.bootstrapMu.Lock()
+    cached, isCached := s.crossHubCache[netName][id]
+    current := isCached && (msg.OriginHub == "" || claimOf(cached).hub == "" || claimOf(cached).hub == msg.OriginHub)
+    var data map[string]interface{}
+    if current {
+        data = withPresence(cached, p)
+        s.crossHubCache[netName][id] = data
+    }
+    s.bootstrapMu.Unlock()
+    if current {
+        atomic.AddInt64(&s.presenceMeta.relayed, 1)
+        s.remoteIndex.put(netName, id, data)
+        if s.getConn(id) == nil {
+            s.deliverPresenceUpdate(id, outboundMessage{Type: "presence-update", Data: map[string]interface{}{"peerId": id, "presence": p}, FromPeerId: id, NetworkName: netName, Timestamp: nowMs()})
+        }
+    }
+    s.forwardToMesh(outboundMessage{Type: "presence-update", Data: msg.Data, FromPeerId: id, NetworkName: netName, Timestamp: nowMs(), MessageId: msg.MessageId, OriginHub: msg.OriginHub, SeenHubs: msg.SeenHubs, Hops: msg.Hops}, fromUri, fromHub)
+}
+
+// deliverPresenceUpdate sends msg to the local peers in its network other
+// than sender.
+func (s *Server) deliverPresenceUpdate(sender string, msg outboundMessage) {
+    for _, id := range s.getActivePeers(sender, msg.NetworkName) {
+        if pi := s.getPeerInfo(id); pi != nil && pi.IsHub {
+            continue
+        }
+        m := msg
+        m.TargetPeer = id
+        s.forwardToLocalTarget(id, m)
+    }
+}
+
+func (s *Server) presenceMetaSnapshot() map[string]interface{} {
+    return map[string]interface{}{"updates": atomic.LoadInt64(&s.presenceMeta.updates), "relayed": atomic.LoadInt64(&s.presenceMeta.relayed), "rejected": atomic.LoadInt64(&s.presenceMeta.rejected)}
+}
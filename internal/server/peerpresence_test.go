@@ -0,0 +1,99 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestPeerPresenceUpdatesReachNetworkAndMesh(t *testing.T) {
+    s := NewServer(Options{IsHub: true})
+    s.hubPeerId = "hub-m"
+    watcher, alice, bad, hubA := randomPeerId(), randomPeerId(), randomPeerId(), "hub-a"
+    conns := attachTestPeers(t, s, watcher, alice, bad, hubA)
+    for _, id := range []string{watcher, alice, bad, hubA} {
+        s.peerData[id].IsHub = id == hubA
+    }
+    s.hubs[hubA] = &hubInfo{PeerId: hubA}
+    read := func(id, typ string) []map[string]interface{} {
+        msgs, _ := conns[id].take(20 * time.Millisecond)
+        out := []map[string]interface{}{}
+        for _, raw := range msgs {
+            var m map[string]interface{}
+            json.Unmarshal(raw, &m)
+            if m["type"] == typ {
+                out = append(out, m)
+            }
+        }
+        return out
+    }
+
+    s.handleMessage(watcher, []byte(`{"type":"announce","networkName":"n","data":{}}`))
+    s.handleMessage(alice, []byte(`{"type":"announce","networkName":"n","data":{"capabilities":["relay"],"presence":{"displayName":"alice","appVersion":"2.1.0","tags":{"region":"eu"}}}}`))
+    got := read(watcher, "peer-discovered")
+    if len(got) != 1 {
+        t.Fatalf("expected alice discovered, got %v", got)
+    }
+    p, _ := got[0]["data"].(map[string]interface{})["presence"].(map[string]interface{})
+    if p["displayName"] != "alice" || p["updatedAt"] == nil || fmt.Sprint(p["capabilities"]) != "[relay]" {
+        t.Fatalf("peer-discovered should carry the stamped presence, got %v", p)
+    }
+
+    s.handleMessage(bad, []byte(`{"type":"announce","networkName":"n","data":{"presence":{"displayName":"`+strings.Repeat("x", 65)+`"}}}`))
+    if errs := read(bad, "error"); len(errs) != 1 || errs[0]["data"].(map[string]interface{})["code"] != errInvalidPresence || s.getPeerInfo(bad).Announced {
+        t.Fatalf("an invalid presence should refuse the announce, got %v", errs)
+    }
+
+    // An update merges into the stored presence and reaches the network and
+    // the mesh, but not the sender.
+    for _, c := range conns {
+        c.take(20 * time.Millisecond)
+    }
+    s.handleMessage(alice, []byte(`{"type":"presence-update","data":{"displayName":"alice (away)","capabilities":["relay","video"],"tags":{"status":"away","region":null}}}`))
+    got = read(watcher, "presence-update")
+    if len(got) != 1 || got[0]["fromPeerId"] != alice {
+        t.Fatalf("watcher should get one presence-update, got %v", got)
+    }
+    p, _ = got[0]["data"].(map[string]interface{})["presence"].(map[string]interface{})
+    if p["displayName"] != "alice (away)" || p["appVersion"] != "2.1.0" || fmt.Sprint(p["tags"]) != "map[status:away]" {
+        t.Fatalf("unexpected presence %v", p)
+    }
+    if mesh := read(hubA, "presence-update"); len(mesh) != 1 || mesh[0]["messageId"] == "" {
+        t.Fatalf("the update should be gossiped, got %v", mesh)
+    }
+    if len(read(alice, "presence-update")) != 0 {
+        t.Fatalf("the sender should not get its own update")
+    }
+    if caps := peerCapabilities(s.getPeerInfo(alice).Data); len(caps) != 2 || caps[1] != "video" {
+        t.Fatalf("capabilities should follow the presence, got %v", caps)
+    }
+    s.handleMessage(alice, []byte(`{"type":"presence-update","data":{"tags":{"k":"`+strings.Repeat("v", 257)+`"}}}`))
+    if errs := read(alice, "error"); len(errs) != 1 || len(read(watcher, "presence-update")) != 0 {
+        t.Fatalf("an invalid update should be refused and not broadcast, got %v", errs)
+    }
+
+    // Updates from the mesh refresh the cached peer, and are dropped when
+    // they come from a hub the peer no longer lives on.
+    bob := randomPeerId()
+    s.cacheCrossHubPeer("n", bob, map[string]interface{}{"peerId": bob, "homeHub": hubA, "announcedAt": float64(nowMs())})
+    update := func(origin, msgId, name string) inboundMessage {
+        return inboundMessage{Type: "presence-update", NetworkName: "n", Data: map[string]interface{}{"peerId": bob, "presence": map[string]interface{}{"displayName": name}}, MessageId: msgId, OriginHub: origin, SeenHubs: []string{origin}, Hops: 1}
+    }
+    s.relayPresenceUpdate(hubA, "", update(hubA, "u1", "bob"))
+    s.relayPresenceUpdate(hubA, "", update(hubA, "u1", "bob again"))
+    s.relayPresenceUpdate(hubA, "", update("hub-z", "u2", "impostor"))
+    if got := read(watcher, "presence-update"); len(got) != 1 {
+        t.Fatalf("watcher should hear one update about bob, got %v", got)
+    }
+    s.bootstrapMu.Lock()
+    name := peerPresence(s.crossHubCache["n"][bob]).DisplayName
+    s.bootstrapMu.Unlock()
+    if name != "bob" {
+        t.Fatalf("cached presence should be bob's latest from its hub, got %q", name)
+    }
+    if m := s.presenceMetaSnapshot(); m["updates"] != int64(1) || m["relayed"] != int64(1) || m["rejected"] != int64(2) {
+        t.Fatalf("unexpected presence metrics %v", m)
+    }
+}
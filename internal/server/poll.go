@@ -0,0 +1,247 @@
+package server
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "sync"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+const (
+    pollWait        = 25 * time.Second
+    pollIdleTimeout = 60 * 1000
+    pollMaxQueue    = 1000
+    pollMaxBatch    = 16
+)
+
+// pollConn is a long-polling session for peers whose network blocks
+// WebSockets. Messages queue until the client picks them up with GET /poll.
+type pollConn struct {
+    s        *Server
+    peerId   string
+    token    string
+    mu       sync.Mutex
+    queue    []json.RawMessage
+    signals  []*signalMeta
+    notify   chan struct{}
+    closed   bool
+    lastPoll int64
+    gzip     int32
+}
+
+func (p *pollConn) WriteMessage(messageType int, data []byte) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.closed {
+        return errors.New("poll session closed")
+    }
+    p.queue = append(p.queue, json.RawMessage(append([]byte(nil), data...)))
+    if p.s.journal != nil {
+        p.s.journal.append(p.peerId, data)
+    }
+    var meta *signalMeta
+    if m, ok := parseSignalMeta(data); ok {
+        meta = &m
+    }
+    p.signals = append(p.signals, meta)
+    if len(p.queue) > pollMaxQueue {
+        p.queue = p.queue[len(p.queue)-pollMaxQueue:]
+        p.signals = p.signals[len(p.signals)-pollMaxQueue:]
+    }
+    select {
+    case p.notify <- struct{}{}:
+    default:
+    }
+    return nil
+}
+
+func (p *pollConn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+    if messageType == websocket.CloseMessage {
+        return p.closeWith(reasonError)
+    }
+    return nil
+}
+
+// Close ends the session. If it is still the peer's registered connection
+// the peer is disconnected as a WebSocket read error would.
+func (p *pollConn) Close() error {
+    return p.closeWith(reasonError)
+}
+
+// closeWith ends the session, reporting reason if this disconnects the peer.
+func (p *pollConn) closeWith(reason string) error {
+    p.mu.Lock()
+    if p.closed {
+        p.mu.Unlock()
+        return nil
+    }
+    p.closed = true
+    p.mu.Unlock()
+    select {
+    case p.notify <- struct{}{}:
+    default:
+    }
+    s := p.s
+    s.pollMu.Lock()
+    delete(s.pollSessions, p.token)
+    s.pollMu.Unlock()
+    s.spawn("poll-close", p.peerId, func() {
+        if s.getConn(p.peerId) == peerConn(p) {
+            s.handleDisconnect(p.peerId, reason, "poll session closed")
+        }
+    })
+    return nil
+}
+
+// take waits up to wait for queued messages and drains them. Signals whose
+// deadline passed while queued are purged; the rest are acked to their
+// origin on the way out.
+func (p *pollConn) take(wait time.Duration) ([]json.RawMessage, bool) {
+    deadline := time.NewTimer(wait)
+    defer deadline.Stop()
+    for {
+        p.mu.Lock()
+        p.lastPoll = nowMs()
+        if p.closed {
+            p.mu.Unlock()
+            return nil, false
+        }
+        if len(p.queue) > 0 {
+            out, signals := p.queue, p.signals
+            p.queue, p.signals = nil, nil
+            if p.s.journal != nil {
+                p.s.journal.done(p.peerId)
+            }
+            p.mu.Unlock()
+            if out = p.s.settleSignals(out, signals); len(out) > 0 {
+                return out, true
+            }
+            continue
+        }
+        p.mu.Unlock()
+        select {
+        case <-p.notify:
+        case <-deadline.C:
+            return []json.RawMessage{}, true
+        }
+    }
+}
+
+func (s *Server) registerPollRoutes() {
+    s.engine.POST("/poll/connect", s.handlePollConnect)
+    s.engine.GET("/poll", s.handlePollReceive)
+    s.engine.POST("/poll", s.handlePollSend)
+    s.engine.DELETE("/poll", s.handlePollClose)
+}
+
+// handlePollConnect opens a long-polling session, subject to the same checks
+// as a WebSocket upgrade.
+func (s *Server) handlePollConnect(c *gin.Context) {
+    r := httpConnRequest(c)
+    peerId := r.Query("peerId")
+    if !s.admitPeer(r, peerId) {
+        s.writeRefusal(c.Writer, r.refusal)
+        return
+    }
+    // The ownership challenge needs a synchronous round trip, so reserved
+    // IDs must use WebSocket.
+    if s.identities != nil && s.identities.lookup(peerId) != nil {
+        writeJSON(c.Writer, http.StatusForbidden, map[string]interface{}{"error": "reserved peerId requires WebSocket"}, s.opts.CORSOrigin)
+        return
+    }
+    b := make([]byte, 24)
+    rand.Read(b)
+    p := &pollConn{s: s, peerId: peerId, token: hex.EncodeToString(b), notify: make(chan struct{}, 1), lastPoll: nowMs()}
+    s.pollMu.Lock()
+    s.pollSessions[p.token] = p
+    s.pollMu.Unlock()
+    if !s.registerConn(r, peerId, p) {
+        s.pollMu.Lock()
+        delete(s.pollSessions, p.token)
+        s.pollMu.Unlock()
+        writeJSON(c.Writer, http.StatusServiceUnavailable, map[string]interface{}{"error": "max connections"}, s.opts.CORSOrigin)
+        return
+    }
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"session": p.token, "peerId": peerId, "pollTimeoutMs": pollWait.Milliseconds()}, s.opts.CORSOrigin)
+}
+
+func (s *Server) pollSession(c *gin.Context) *pollConn {
+    s.pollMu.Lock()
+    p := s.pollSessions[c.Query("session")]
+    s.pollMu.Unlock()
+    if p == nil {
+        writeJSON(c.Writer, http.StatusGone, map[string]interface{}{"error": "unknown or expired session"}, s.opts.CORSOrigin)
+    }
+    return p
+}
+
+func (s *Server) handlePollReceive(c *gin.Context) {
+    p := s.pollSession(c)
+    if p == nil {
+        return
+    }
+    msgs, ok := p.take(pollWait)
+    if !ok {
+        writeJSON(c.Writer, http.StatusGone, map[string]interface{}{"error": "session closed"}, s.opts.CORSOrigin)
+        return
+    }
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"messages": msgs}, s.opts.CORSOrigin)
+}
+
+// handlePollSend accepts a batch of protocol messages from the client.
+func (s *Server) handlePollSend(c *gin.Context) {
+    p := s.pollSession(c)
+    if p == nil {
+        return
+    }
+    var body struct {
+        Messages []json.RawMessage `json:"messages"`
+    }
+    limit := int64(s.opts.MaxMessageBytes) * pollMaxBatch
+    if limit <= 0 {
+        limit = 16 << 20
+    }
+    dec := json.NewDecoder(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
+    if err := dec.Decode(&body); err != nil {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "invalid JSON body"}, s.opts.CORSOrigin)
+        return
+    }
+    for _, raw := range body.Messages {
+        s.handleMessage(p.peerId, raw)
+    }
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"accepted": len(body.Messages)}, s.opts.CORSOrigin)
+}
+
+func (s *Server) handlePollClose(c *gin.Context) {
+    p := s.pollSession(c)
+    if p == nil {
+        return
+    }
+    p.closeWith(reasonClientGoodbye)
+    if s.journal != nil {
+        s.journal.done(p.peerId)
+    }
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"closed": true}, s.opts.CORSOrigin)
+}
+
+// expirePollSessions closes sessions whose client stopped polling.
+func (s *Server) expirePollSessions(now int64) {
+    s.pollMu.Lock()
+    idle := []*pollConn{}
+    for _, p := range s.pollSessions {
+        p.mu.Lock()
+        if now-p.lastPoll > pollIdleTimeout {
+            idle = append(idle, p)
+        }
+        p.mu.Unlock()
+    }
+    s.pollMu.Unlock()
+    for _, p := range idle {
+        p.closeWith(reasonIdleTimeout)
+    }
+}
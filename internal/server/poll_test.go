@@ -0,0 +1,47 @@
+package server
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+func TestPollSessionQueuesAndExpires(t *testing.T) {
+    s := NewServer(Options{MaxConnections: 10})
+    id := "0123456789abcdef0123456789abcdef01234567"
+    p := &pollConn{s: s, peerId: id, token: "tok", notify: make(chan struct{}, 1), lastPoll: nowMs()}
+    s.pollSessions[p.token] = p
+    s.wsConns[id] = p
+    s.sendToConn(p, outboundMessage{Type: "pong", FromPeerId: "system"})
+    msgs, ok := p.take(time.Second)
+    if !ok || len(msgs) != 1 || !strings.Contains(string(msgs[0]), `"pong"`) {
+        t.Fatalf("expected queued pong, got %v %v", ok, msgs)
+    }
+    s.expirePollSessions(nowMs() + pollIdleTimeout + 1)
+    if _, ok := p.take(0); ok {
+        t.Fatalf("idle session should be closed")
+    }
+    if len(s.pollSessions) != 0 {
+        t.Fatalf("expired session should be removed")
+    }
+}
+
+func TestPollConnectOverLimitLeavesNoSession(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    s := NewServer(Options{MaxConnections: 1})
+    s.running = true
+    s.routes()
+    held := randomPeerId()
+    attachTestPeer(t, s, held)
+    rec := httptest.NewRecorder()
+    s.engine.ServeHTTP(rec, httptest.NewRequest("POST", "/poll/connect?peerId="+randomPeerId(), nil))
+    s.pollMu.Lock()
+    sessions := len(s.pollSessions)
+    s.pollMu.Unlock()
+    if rec.Code != http.StatusServiceUnavailable || sessions != 0 {
+        t.Fatalf("refused poll connect should leave no session: %d, %d sessions", rec.Code, sessions)
+    }
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "sync"
+    "syscall"
+)
+
+// Start binds Port, moving up one port at a time for up to MaxPortRetries
+// more when it is taken. The ports tried and why each failed are kept for
+// /stats, so instances colliding on one machine can be told apart.
+
+var (
+    // ErrPortInUse means every port in the retry range was taken.
+    ErrPortInUse = errors.New("port in use")
+    // ErrBindPermission means the OS refused the bind, e.g. a port below
+    // 1024 without the privilege to use it. Later ports are not tried.
+    ErrBindPermission = errors.New("permission denied binding port")
+)
+
+// PortError is returned by Start when the hub could not bind. It wraps
+// ErrPortInUse, ErrBindPermission or the listener's own error.
+type PortError struct {
+    Host     string
+    First    int
+    Last     int
+    Attempts []PortAttempt
+    Err      error
+}
+
+func (e *PortError) Error() string {
+    if e.First == e.Last {
+        return fmt.Sprintf("bind %s:%d: %v", e.Host, e.First, e.Err)
+    }
+    return fmt.Sprintf("bind %s ports %d-%d: %v", e.Host, e.First, e.Last, e.Err)
+}
+
+func (e *PortError) Unwrap() error { return e.Err }
+
+// PortAttempt is one bind Start made. Error is empty for the port it got.
+type PortAttempt struct {
+    Port  int    `json:"port"`
+    Error string `json:"error,omitempty"`
+    At    int64  `json:"at"`
+}
+
+type portHistory struct {
+    mu        sync.Mutex
+    requested int
+    attempts  []PortAttempt
+}
+
+// bindError classifies a failed net.Listen.
+func bindError(err error) error {
+    switch {
+    case errors.Is(err, syscall.EADDRINUSE):
+        return ErrPortInUse
+    case errors.Is(err, syscall.EACCES), errors.Is(err, os.ErrPermission):
+        return ErrBindPermission
+    }
+    return err
+}
+
+// listen binds the first free port from port to port+maxRetries and
+// returns the listener, so nothing can take the port between choosing and
+// serving it.
+func (s *Server) listen(port, maxRetries int) (net.Listener, error) {
+    h := s.ports
+    h.mu.Lock()
+    h.requested, h.attempts = port, nil
+    h.mu.Unlock()
+    perr := &PortError{Host: s.opts.Host, First: port, Last: port}
+    for i := 0; i <= maxRetries; i++ {
+        p := port + i
+        ln, err := net.Listen("tcp", s.opts.Host+":"+itoa(p))
+        a := PortAttempt{Port: p, At: nowMs()}
+        if err != nil {
+            a.Error = err.Error()
+        }
+        h.mu.Lock()
+        h.attempts = append(h.attempts, a)
+        perr.Attempts = append(perr.Attempts, a)
+        h.mu.Unlock()
+        perr.Last = p
+        if err == nil {
+            if p != port {
+                s.log.Warn("port_shifted", map[string]interface{}{"requested": port, "port": p, "attempts": i + 1})
+            }
+            s.log.Info("port_selected", map[string]interface{}{"host": s.opts.Host, "port": p})
+            return ln, nil
+        }
+        perr.Err = bindError(err)
+        if perr.Err != ErrPortInUse {
+            break
+        }
+    }
+    s.log.Warn("port_bind_failed", map[string]interface{}{"host": s.opts.Host, "first": perr.First, "last": perr.Last, "error": perr.Err.Error()})
+    return nil, perr
+}
+
+func (s *Server) portSnapshot() map[string]interface{} {
+    h := s.ports
+    h.mu.Lock()
+    defer h.mu.Unlock()
+    return map[string]interface{}{"requested": h.requested, "bound": s.port, "attempts": append([]PortAttempt{}, h.attempts...)}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+    "errors"
+    "net"
+    "strings"
+    "testing"
+)
+
+func TestStartReportsPortConflicts(t *testing.T) {
+    busy := []net.Listener{}
+    defer func() {
+        for _, ln := range busy {
+            ln.Close()
+        }
+    }()
+    first, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    busy = append(busy, first)
+    base := first.Addr().(*net.TCPAddr).Port
+    if ln, err := net.Listen("tcp", "127.0.0.1:"+itoa(base+1)); err == nil {
+        busy = append(busy, ln)
+    } else {
+        t.Skipf("port %d not available for the test", base+1)
+    }
+
+    s := NewServer(Options{Host: "127.0.0.1", Port: base})
+    err = s.Start()
+    var perr *PortError
+    if !errors.As(err, &perr) || !errors.Is(err, ErrPortInUse) {
+        t.Fatalf("expected a PortError wrapping ErrPortInUse, got %v", err)
+    }
+    if perr.First != base || perr.Last != base || len(perr.Attempts) != 1 {
+        t.Fatalf("without retries only the requested port should be tried, got %+v", perr)
+    }
+
+    s = NewServer(Options{Host: "127.0.0.1", Port: base, MaxPortRetries: 1})
+    err = s.Start()
+    if !errors.As(err, &perr) || !errors.Is(err, ErrPortInUse) || perr.Last != base+1 {
+        t.Fatalf("expected the whole range to be reported, got %v", err)
+    }
+    if !strings.Contains(err.Error(), itoa(base)+"-"+itoa(base+1)) {
+        t.Fatalf("error should name the range tried: %v", err)
+    }
+
+    s = NewServer(Options{Host: "127.0.0.1", Port: base, MaxPortRetries: 5})
+    ln, err := s.listen(base, 5)
+    if err != nil {
+        t.Fatalf("a free port in range should be bound: %v", err)
+    }
+    defer ln.Close()
+    s.port = ln.Addr().(*net.TCPAddr).Port
+    pb := s.getStats()["portBinding"].(map[string]interface{})
+    attempts := pb["attempts"].([]PortAttempt)
+    if pb["requested"] != base || pb["bound"] != s.port || len(attempts) < 3 {
+        t.Fatalf("unexpected port binding stats %v", pb)
+    }
+    if attempts[0].Error == "" || attempts[len(attempts)-1].Error != "" {
+        t.Fatalf("attempt history should record failures and the bound port, got %+v", attempts)
+    }
+}
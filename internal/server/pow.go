@@ -0,0 +1,131 @@
+package server
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/hex"
+    "math/bits"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "github.com/gin-gonic/gin"
+)
+
+// Proof of work makes throwaway peers cost CPU on open hubs. With
+// PowDifficulty set, a client first fetches GET /pow/challenge, then looks
+// for a nonce such that sha256("<challenge>:<peerId>:<nonce>") starts with
+// PowDifficulty zero bits, and connects with ?pow=<challenge>&powNonce=<nonce>
+// on /ws or /poll/connect. Each challenge is signed by the hub, expires after
+// PowChallengeTTLMs and admits one connection, and only on the hub that
+// issued it. Hub links on /mesh are exempt. Each extra bit doubles the
+// expected work: 20 bits is about a million hashes, well under a second for
+// a browser. The Go client SDK solves challenges with Options.ProofOfWork.
+
+type powStats struct {
+    mu       sync.Mutex
+    secret   []byte
+    used     map[string]int64
+    issued   int64
+    verified int64
+    missing  int64
+    invalid  int64
+    expired  int64
+    reused   int64
+}
+
+func newPowStats() *powStats {
+    secret := make([]byte, 32)
+    rand.Read(secret)
+    return &powStats{secret: secret, used: map[string]int64{}}
+}
+
+func (p *powStats) sign(payload string) string {
+    mac := hmac.New(sha256.New, p.secret)
+    mac.Write([]byte("pow|" + payload))
+    return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// powLeadingZeros counts the leading zero bits of sum.
+func powLeadingZeros(sum [32]byte) int {
+    n := 0
+    for _, b := range sum {
+        if b != 0 {
+            return n + bits.LeadingZeros8(b)
+        }
+        n += 8
+    }
+    return n
+}
+
+func (s *Server) handlePowChallenge(c *gin.Context) {
+    if s.opts.PowDifficulty <= 0 {
+        writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"difficulty": 0}, s.opts.CORSOrigin)
+        return
+    }
+    b := make([]byte, 12)
+    rand.Read(b)
+    expiresAt := nowMs() + int64(s.opts.PowChallengeTTLMs)
+    payload := strconv.FormatInt(expiresAt, 10) + "." + hex.EncodeToString(b)
+    p := s.pow
+    p.mu.Lock()
+    p.issued++
+    p.mu.Unlock()
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"challenge": payload + "." + p.sign(payload), "difficulty": s.opts.PowDifficulty, "expiresAt": expiresAt}, s.opts.CORSOrigin)
+}
+
+// checkPow verifies the proof a connecting peer presents and reports why it
+// was refused, or "" when it may connect.
+func (s *Server) checkPow(challenge, nonce, peerId string) string {
+    if s.opts.PowDifficulty <= 0 {
+        return ""
+    }
+    p := s.pow
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if challenge == "" || nonce == "" {
+        p.missing++
+        return "proof of work required"
+    }
+    parts := strings.Split(challenge, ".")
+    if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(p.sign(parts[0]+"."+parts[1]))) {
+        p.invalid++
+        return "invalid proof of work"
+    }
+    expiresAt, _ := strconv.ParseInt(parts[0], 10, 64)
+    if nowMs() > expiresAt {
+        p.expired++
+        return "proof of work challenge expired"
+    }
+    if _, ok := p.used[challenge]; ok {
+        p.reused++
+        return "proof of work challenge already used"
+    }
+    if powLeadingZeros(sha256.Sum256([]byte(challenge+":"+peerId+":"+nonce))) < s.opts.PowDifficulty {
+        p.invalid++
+        return "invalid proof of work"
+    }
+    p.used[challenge] = expiresAt
+    p.verified++
+    return ""
+}
+
+// expirePow forgets used challenges once they could no longer be replayed.
+func (s *Server) expirePow(now int64) {
+    p := s.pow
+    p.mu.Lock()
+    for c, exp := range p.used {
+        if now > exp {
+            delete(p.used, c)
+        }
+    }
+    p.mu.Unlock()
+}
+
+func (s *Server) powSnapshot() map[string]interface{} {
+    p := s.pow
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    return map[string]interface{}{"difficulty": s.opts.PowDifficulty, "issued": p.issued, "verified": p.verified, "missing": p.missing, "invalid": p.invalid, "expired": p.expired, "reused": p.reused}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+    "crypto/sha256"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestProofOfWorkGatesConnections(t *testing.T) {
+    s := NewServer(Options{MaxConnections: 10, PowDifficulty: 8})
+    gin.SetMode(gin.TestMode)
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    base := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?peerId="
+    peer := randomPeerId()
+    if _, resp, err := websocket.DefaultDialer.Dial(base+peer, nil); err == nil || resp.StatusCode != http.StatusForbidden {
+        t.Fatalf("a connection without proof should be refused, err=%v", err)
+    }
+
+    res, err := http.Get(ts.URL + "/pow/challenge")
+    if err != nil {
+        t.Fatal(err)
+    }
+    var ch struct {
+        Challenge  string `json:"challenge"`
+        Difficulty int    `json:"difficulty"`
+    }
+    json.NewDecoder(res.Body).Decode(&ch)
+    res.Body.Close()
+    if ch.Difficulty != 8 || ch.Challenge == "" {
+        t.Fatalf("unexpected challenge %+v", ch)
+    }
+    nonce := 0
+    for powLeadingZeros(sha256.Sum256([]byte(ch.Challenge+":"+peer+":"+itoa(nonce)))) < 8 {
+        nonce++
+    }
+    proof := "&pow=" + url.QueryEscape(ch.Challenge) + "&powNonce=" + itoa(nonce)
+    if _, resp, err := websocket.DefaultDialer.Dial(base+randomPeerId()+proof, nil); err == nil || resp.StatusCode != http.StatusForbidden {
+        t.Fatalf("a proof is bound to its peer ID, err=%v", err)
+    }
+    ws, _, err := websocket.DefaultDialer.Dial(base+peer+proof, nil)
+    if err != nil {
+        t.Fatalf("a valid proof should connect: %v", err)
+    }
+    ws.Close()
+    if _, resp, err := websocket.DefaultDialer.Dial(base+peer+proof, nil); err == nil || resp.StatusCode != http.StatusForbidden {
+        t.Fatalf("a challenge should admit one connection, err=%v", err)
+    }
+    snap := s.powSnapshot()
+    if snap["issued"].(int64) != 1 || snap["verified"].(int64) != 1 || snap["missing"].(int64) != 1 || snap["invalid"].(int64) != 1 || snap["reused"].(int64) != 1 {
+        t.Fatalf("unexpected counters %v", snap)
+    }
+}
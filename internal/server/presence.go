@@ -0,0 +1,136 @@
+package server
+
+import (
+    "sync/atomic"
+    "github.com/gorilla/websocket"
+)
+
+// Duplicate presence. A peer ID should be connected to one hub at a time,
+// but after a flaky failover a client can be announced on two, and both
+// hubs would gossip it. Every peer-discovered a hub sends the mesh about its
+// own peer carries the peer's announcedAt and the hub as homeHub, which
+// together are that hub's claim on the peer. When a hub hears another hub
+// claim a peer it has connected, the later announce wins, and on a tie the
+// higher hub peer ID. A losing hub closes its connection with reason
+// duplicate-session without telling the mesh the peer left, then treats the
+// peer as remote. A winning hub ignores the claim and gossips its own again,
+// so the loser and the hubs in between converge. Hubs that only cache the
+// peer replace a cached claim with a winning one from another hub, and
+// ignore a peer-disconnected from a hub whose claim they no longer hold.
+// Counts are under "duplicate_presence" in /metrics.
+
+type presenceStats struct {
+    evicted  int64
+    kept     int64
+    replaced int64
+    stale    int64
+}
+
+// presenceClaim is a hub's claim on a peer: the hub and when the peer
+// announced there.
+type presenceClaim struct {
+    hub string
+    at  int64
+}
+
+// beats reports whether c wins over other.
+func (c presenceClaim) beats(other presenceClaim) bool {
+    if c.at != other.at {
+        return c.at > other.at
+    }
+    return c.hub > other.hub
+}
+
+// claimOf reads the claim in peer-discovered data; hub is empty when the
+// data carries none.
+func claimOf(m map[string]interface{}) presenceClaim {
+    hub, _ := m["homeHub"].(string)
+    c := presenceClaim{hub: hub}
+    switch at := m["announcedAt"].(type) {
+    case float64:
+        c.at = int64(at)
+    case int64:
+        c.at = at
+    case int:
+        c.at = int64(at)
+    }
+    return c
+}
+
+// stampClaim adds this hub's claim on a local peer to gossip about it.
+func (s *Server) stampClaim(data map[string]interface{}, pi *peerInfo) {
+    data["announcedAt"] = pi.AnnouncedAt
+    data["homeHub"] = s.hubPeerId
+}
+
+// resolvePresence decides whether a peer-discovered from another hub should
+// be cached and passed on. It evicts the local connection when the remote
+// claim wins, and reasserts this hub's claim when it does not.
+func (s *Server) resolvePresence(netName, id string, m map[string]interface{}) bool {
+    claim := claimOf(m)
+    if claim.hub == s.hubPeerId {
+        return false
+    }
+    if pi := s.getPeerInfo(id); pi != nil && pi.Announced && !pi.IsHub && claim.hub != "" {
+        local := presenceClaim{hub: s.hubPeerId, at: pi.AnnouncedAt}
+        if local.beats(claim) {
+            atomic.AddInt64(&s.presence.kept, 1)
+            if !hiddenPeer(pi.Data) {
+                s.announceToBootstrap(id, firstNonEmpty(pi.NetworkName, s.opts.DefaultNetwork), false, pi.Data)
+            }
+            return false
+        }
+        s.evictDuplicate(id, pi, netName, claim)
+        return true
+    }
+    s.bootstrapMu.Lock()
+    cached, ok := s.crossHubCache[netName][id]
+    s.bootstrapMu.Unlock()
+    if !ok {
+        return true
+    }
+    old := claimOf(cached)
+    if claim.hub == "" || old.hub == "" || claim.hub == old.hub || !claim.beats(old) {
+        return false
+    }
+    atomic.AddInt64(&s.presence.replaced, 1)
+    s.signalRoutes.forget(id)
+    return true
+}
+
+// evictDuplicate drops a local peer whose winning session, on winnerNet,
+// is on another hub. The mesh is not told it left, since it has not; its
+// old network hears of it only if the winning session is on another one.
+func (s *Server) evictDuplicate(peerId string, pi *peerInfo, winnerNet string, winner presenceClaim) {
+    atomic.AddInt64(&s.presence.evicted, 1)
+    netName := firstNonEmpty(pi.NetworkName, s.opts.DefaultNetwork)
+    s.log.Info("duplicate_session_evicted", map[string]interface{}{"peerId": peerId, "networkName": netName, "homeHub": winner.hub, "announcedAt": winner.at})
+    s.emitEvent("peer_disconnected", func() map[string]interface{} {
+        return map[string]interface{}{"peerId": peerId, "networkName": netName, "isHub": false, "reason": reasonDuplicateSession, "detail": winner.hub}
+    })
+    s.changes.publish(changeRemoved, netName, peerId, nil, reasonDuplicateSession)
+    conn := s.getConn(peerId)
+    s.cleanupPeer(peerId)
+    if conn != nil {
+        closeWithReason(conn, websocket.ClosePolicyViolation, reasonDuplicateSession)
+    }
+    if netName != winnerNet && !hiddenPeer(pi.Data) {
+        s.forwardToLocalPeers(netName, outboundMessage{Type: "peer-disconnected", Data: map[string]interface{}{"peerId": peerId, "isHub": false, "reason": reasonDuplicateSession, "timestamp": nowMs()}, FromPeerId: "system", NetworkName: netName, Timestamp: nowMs()})
+    }
+}
+
+// staleDisconnect reports whether a peer-disconnected from originHub is
+// about a session this hub no longer caches, because another hub's claim
+// replaced it.
+func (s *Server) staleDisconnect(cached map[string]interface{}, originHub string) bool {
+    home := claimOf(cached).hub
+    if home == "" || originHub == "" || home == originHub {
+        return false
+    }
+    atomic.AddInt64(&s.presence.stale, 1)
+    return true
+}
+
+func (s *Server) presenceSnapshot() map[string]interface{} {
+    return map[string]interface{}{"evicted": atomic.LoadInt64(&s.presence.evicted), "kept": atomic.LoadInt64(&s.presence.kept), "replaced": atomic.LoadInt64(&s.presence.replaced), "stale_disconnects": atomic.LoadInt64(&s.presence.stale)}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestDuplicatePresenceConvergesOnLatestAnnounce(t *testing.T) {
+    s := NewServer(Options{IsHub: true})
+    s.hubPeerId = "hub-m"
+    watcher, early, late, hubA, hubZ := randomPeerId(), randomPeerId(), randomPeerId(), "hub-a", "hub-z"
+    conns := attachTestPeers(t, s, watcher, early, late, hubA, hubZ)
+    for _, id := range []string{watcher, early, late, hubA, hubZ} {
+        s.peerData[id].IsHub = strings.HasPrefix(id, "hub-")
+        if strings.HasPrefix(id, "hub-") {
+            s.hubs[id] = &hubInfo{PeerId: id}
+        }
+    }
+    for _, id := range []string{watcher, early, late} {
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"n","data":{}}`))
+    }
+    // Local announces are gossiped with this hub's claim.
+    var claimed map[string]interface{}
+    msgs, _ := conns[hubA].take(20 * time.Millisecond)
+    for _, raw := range msgs {
+        var m map[string]interface{}
+        json.Unmarshal(raw, &m)
+        if d, _ := m["data"].(map[string]interface{}); m["type"] == "peer-discovered" && d["peerId"] == late {
+            claimed = d
+        }
+    }
+    if claimed == nil || claimed["homeHub"] != "hub-m" || claimed["announcedAt"] == nil {
+        t.Fatalf("gossip should carry the claim, got %v", claimed)
+    }
+    for _, c := range conns {
+        c.take(20 * time.Millisecond)
+    }
+    types := func(id string) []string {
+        msgs, _ := conns[id].take(20 * time.Millisecond)
+        out := []string{}
+        for _, raw := range msgs {
+            var m map[string]interface{}
+            json.Unmarshal(raw, &m)
+            out = append(out, m["type"].(string))
+        }
+        return out
+    }
+    claim := func(peerId, hub, msgId string, at int64) inboundMessage {
+        return inboundMessage{Type: "peer-discovered", NetworkName: "n", Data: map[string]interface{}{"peerId": peerId, "homeHub": hub, "announcedAt": float64(at)}, MessageId: msgId, OriginHub: hub, SeenHubs: []string{hub}, Hops: 1}
+    }
+
+    // An older claim elsewhere loses: the local session stays and this hub
+    // reasserts its own claim.
+    s.handlePeerDiscovered(hubA, claim(early, hubA, "c1", s.getPeerInfo(early).AnnouncedAt-1000))
+    if s.getConn(early) == nil {
+        t.Fatalf("the newer local session should be kept")
+    }
+    if got := types(hubZ); len(got) != 1 || got[0] != "peer-discovered" {
+        t.Fatalf("the winning hub should reassert its claim, got %v", got)
+    }
+    if len(types(watcher)) != 0 {
+        t.Fatalf("local peers should not hear of a losing claim")
+    }
+
+    // A newer claim wins: the local session is closed without telling the
+    // mesh it left, and the peer becomes remote.
+    at := s.getPeerInfo(late).AnnouncedAt + 1000
+    s.handlePeerDiscovered(hubA, claim(late, hubA, "c2", at))
+    if s.getConn(late) != nil || !s.isCrossHubPeerCached("n", late) {
+        t.Fatalf("the older local session should be evicted and the peer cached as remote")
+    }
+    if got := types(hubZ); len(got) != 1 || got[0] != "peer-discovered" {
+        t.Fatalf("only the winning claim should be forwarded, got %v", got)
+    }
+    if got := types(watcher); len(got) != 1 || got[0] != "peer-discovered" {
+        t.Fatalf("local peers should see the peer move, not leave, got %v", got)
+    }
+
+    // A cached claim is replaced only by a winning one from another hub, and
+    // a disconnect from the replaced hub is ignored.
+    s.handlePeerDiscovered(hubZ, claim(late, hubZ, "c3", at-1))
+    if d := s.crossHubCache["n"][late]; d["homeHub"] != hubA {
+        t.Fatalf("an older claim should not replace the cached one")
+    }
+    s.handlePeerDiscovered(hubZ, claim(late, hubZ, "c4", at))
+    if d := s.crossHubCache["n"][late]; d["homeHub"] != hubZ {
+        t.Fatalf("a tie should go to the higher hub peer ID")
+    }
+    types(watcher)
+    s.handleRemoteDisconnect(hubA, "", inboundMessage{Type: "peer-disconnected", NetworkName: "n", Data: map[string]interface{}{"peerId": late, "reason": reasonDuplicateSession}, MessageId: "c5", OriginHub: hubA, SeenHubs: []string{hubA}, Hops: 1})
+    if !s.isCrossHubPeerCached("n", late) || len(types(watcher)) != 0 {
+        t.Fatalf("a disconnect from the losing hub should not remove the peer")
+    }
+    if snap := s.presenceSnapshot(); snap["evicted"] != int64(1) || snap["kept"] != int64(1) || snap["replaced"] != int64(1) || snap["stale_disconnects"] != int64(1) {
+        t.Fatalf("unexpected presence counts %v", snap)
+    }
+}
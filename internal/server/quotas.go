@@ -0,0 +1,169 @@
+package server
+
+import (
+    "sort"
+    "sync"
+    "time"
+)
+
+// hubQuotaStrikes is how many consecutive throttled seconds suspend a link.
+const hubQuotaStrikes = 5
+
+const (
+    quotaGossip    = "gossip"
+    quotaSignaling = "signaling"
+)
+
+// hubQuotas meters what each hub link (bootstrap URI or inbound hub peer ID)
+// sends us. Gossip and signaling each get a token bucket per link; messages
+// over the quota are dropped, and a link that stays over quota for
+// hubQuotaStrikes seconds in a row is suspended so one misbehaving hub cannot
+// flood every other hub's clients.
+type hubQuotas struct {
+    mu            sync.Mutex
+    gossipRate    float64
+    signalingRate float64
+    suspendFor    time.Duration
+    links         map[string]*linkQuota
+}
+
+type linkQuota struct {
+    buckets        map[string]*quotaBucket
+    window         time.Time
+    overInWindow   bool
+    strikes        int
+    throttled      int64
+    dropped        int64
+    suspensions    int64
+    suspendedUntil time.Time
+    lastSeen       time.Time
+}
+
+type quotaBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+func newHubQuotas(gossipPerSec, signalingPerSec, suspendMs int) *hubQuotas {
+    return &hubQuotas{gossipRate: float64(gossipPerSec), signalingRate: float64(signalingPerSec), suspendFor: time.Duration(suspendMs) * time.Millisecond, links: map[string]*linkQuota{}}
+}
+
+// quotaClass sorts mesh traffic into metered classes. Link control messages
+// are never metered.
+func quotaClass(msgType string) string {
+    switch msgType {
+    case "announce", "connected", "goodbye", "ping", "pong", "register", "cleanup", "erase-peer", "erase-report":
+        return ""
+    case "offer", "answer", "ice-candidate":
+        return quotaSignaling
+    }
+    return quotaGossip
+}
+
+func (q *hubQuotas) rate(class string) float64 {
+    if class == quotaSignaling {
+        return q.signalingRate
+    }
+    return q.gossipRate
+}
+
+// allow reports whether a message of msgType from link may be processed.
+// event is "throttled" the first time a link goes over quota in a second and
+// "suspended" when it is cut off, so callers can log without flooding.
+func (q *hubQuotas) allow(link, msgType string, now time.Time) (ok bool, event string) {
+    class := quotaClass(msgType)
+    if class == "" {
+        return true, ""
+    }
+    rate := q.rate(class)
+    if rate <= 0 {
+        return true, ""
+    }
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    l := q.links[link]
+    if l == nil {
+        l = &linkQuota{buckets: map[string]*quotaBucket{}, window: now}
+        q.links[link] = l
+    }
+    l.lastSeen = now
+    if now.Before(l.suspendedUntil) {
+        l.dropped++
+        return false, ""
+    }
+    if gap := now.Sub(l.window); gap >= time.Second {
+        if l.overInWindow && gap < 2*time.Second {
+            l.strikes++
+        } else {
+            l.strikes = 0
+        }
+        l.window = now
+        l.overInWindow = false
+    }
+    b := l.buckets[class]
+    if b == nil {
+        b = &quotaBucket{tokens: rate, last: now}
+        l.buckets[class] = b
+    }
+    b.tokens += now.Sub(b.last).Seconds() * rate
+    if b.tokens > rate {
+        b.tokens = rate
+    }
+    b.last = now
+    if b.tokens >= 1 {
+        b.tokens--
+        return true, ""
+    }
+    l.throttled++
+    if l.overInWindow {
+        return false, ""
+    }
+    l.overInWindow = true
+    if l.strikes+1 >= hubQuotaStrikes && q.suspendFor > 0 {
+        l.suspendedUntil = now.Add(q.suspendFor)
+        l.suspensions++
+        l.strikes = 0
+        return false, "suspended"
+    }
+    return false, "throttled"
+}
+
+// resume lifts a suspension early. It reports whether link was known.
+func (q *hubQuotas) resume(link string) bool {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    l := q.links[link]
+    if l == nil {
+        return false
+    }
+    l.suspendedUntil = time.Time{}
+    l.strikes = 0
+    return true
+}
+
+func (q *hubQuotas) snapshot(now time.Time) []map[string]interface{} {
+    q.mu.Lock()
+    out := make([]map[string]interface{}, 0, len(q.links))
+    for link, l := range q.links {
+        entry := map[string]interface{}{"link": link, "throttled": l.throttled, "dropped": l.dropped, "suspensions": l.suspensions, "suspended": now.Before(l.suspendedUntil), "lastSeen": l.lastSeen.UnixMilli()}
+        if now.Before(l.suspendedUntil) {
+            entry["suspendedUntil"] = l.suspendedUntil.UnixMilli()
+        }
+        out = append(out, entry)
+    }
+    q.mu.Unlock()
+    sort.Slice(out, func(i, j int) bool { return out[i]["link"].(string) < out[j]["link"].(string) })
+    return out
+}
+
+// admitFromHub applies the link quota to an inbound mesh message.
+func (s *Server) admitFromHub(link, msgType string) bool {
+    ok, event := s.hubQuotas.allow(link, msgType, time.Now())
+    switch event {
+    case "throttled":
+        s.log.Warn("hub_link_throttled", map[string]interface{}{"link": link, "type": msgType})
+    case "suspended":
+        s.log.Warn("hub_link_suspended", map[string]interface{}{"link": link, "type": msgType, "suspendMs": s.opts.HubQuotaSuspendMs})
+    }
+    return ok
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+    "testing"
+    "time"
+)
+
+func TestHubQuotasThrottleThenSuspend(t *testing.T) {
+    q := newHubQuotas(2, 0, 60000)
+    now := time.Unix(1000, 0)
+    if ok, _ := q.allow("ws://hub-b", "announce", now); !ok {
+        t.Fatalf("control messages must not be metered")
+    }
+    if ok, _ := q.allow("ws://hub-b", "offer", now); !ok {
+        t.Fatalf("signaling quota is disabled")
+    }
+    var event string
+    for sec := 0; sec < hubQuotaStrikes && event != "suspended"; sec++ {
+        at := now.Add(time.Duration(sec) * time.Second)
+        for i := 0; i < 4; i++ {
+            if _, ev := q.allow("ws://hub-b", "peer-discovered", at); ev != "" {
+                event = ev
+            }
+        }
+    }
+    if event != "suspended" {
+        t.Fatalf("expected link to be suspended after %d throttled seconds, got %q", hubQuotaStrikes, event)
+    }
+    later := now.Add(10 * time.Second)
+    if ok, _ := q.allow("ws://hub-b", "peer-discovered", later); ok {
+        t.Fatalf("suspended link should be dropped")
+    }
+    if ok, _ := q.allow("ws://hub-c", "peer-discovered", later); !ok {
+        t.Fatalf("other links must be unaffected")
+    }
+    if !q.resume("ws://hub-b") {
+        t.Fatalf("resume should find the link")
+    }
+    if ok, _ := q.allow("ws://hub-b", "peer-discovered", later); !ok {
+        t.Fatalf("resumed link should be admitted")
+    }
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+    "time"
+    "github.com/gorilla/websocket"
+)
+
+// Disconnect reasons carried in peer-disconnected events, both to local
+// peers and across the mesh. Anything unexpected is reported as reasonError
+// with the underlying message in "detail".
+const (
+    reasonClientGoodbye = "client-goodbye"
+    reasonIdleTimeout   = "idle-timeout"
+    reasonRateLimit     = "rate-limit"
+    reasonReplaced      = "replaced"
+    reasonHubShutdown   = "hub-shutdown"
+    reasonError         = "error"
+    reasonKicked        = "kicked"
+    reasonNetworkSwitch = "network-switch"
+    reasonBanned        = "banned"
+    reasonHubKeyMismatch = "hub-key-mismatch"
+    reasonGuestExpired  = "guest-expired"
+    reasonSlowConsumer  = "slow-consumer"
+    reasonPingTimeout   = "ping-timeout"
+    reasonHubRejected   = "hub-rejected"
+    reasonTokenExpired  = "token-expired"
+    reasonUnlisted      = "unlisted"
+    reasonDuplicateSession = "duplicate-session"
+)
+
+// readErrorReason maps a WebSocket read error to a disconnect reason: a
+// clean close from the client is a goodbye, anything else an error.
+func readErrorReason(err error) string {
+    if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+        return reasonClientGoodbye
+    }
+    return reasonError
+}
+
+// closeWithReason sends a close frame carrying reason before closing conn.
+func closeWithReason(conn peerConn, code int, reason string) {
+    conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+    conn.Close()
+}
+
+// announceDisconnectToMesh tells other hubs that a local peer has left
+// netName so they drop it from their cross-hub caches.
+func (s *Server) announceDisconnectToMesh(peerId, netName, reason string) {
+    id := newMessageId()
+    s.markRelayed("peer-disconnected:" + id)
+    s.forwardToMesh(outboundMessage{Type: "peer-disconnected", Data: map[string]interface{}{"peerId": peerId, "isHub": false, "reason": reason}, FromPeerId: "system", NetworkName: netName, Timestamp: nowMs(), MessageId: id}, "", "")
+}
+
+// handleRemoteDisconnect applies a peer-disconnected message from another
+// hub: local peers that were told about the peer learn it has gone, and the
+// message continues across the mesh.
+func (s *Server) handleRemoteDisconnect(fromHub, fromUri string, msg inboundMessage) {
+    m, _ := msg.Data.(map[string]interface{})
+    id, _ := m["peerId"].(string)
+    if id == "" || s.alreadyVisited(msg) || !s.firstSighting("peer-disconnected", msg) {
+        return
+    }
+    netName := firstNonEmpty(msg.NetworkName, s.opts.DefaultNetwork)
+    reason, _ := m["reason"].(string)
+    reason = firstNonEmpty(reason, reasonError)
+    s.bootstrapMu.Lock()
+    data, cached := s.crossHubCache[netName][id]
+    stale := cached && s.staleDisconnect(data, msg.OriginHub)
+    if cached && !stale {
+        delete(s.crossHubCache[netName], id)
+    }
+    s.bootstrapMu.Unlock()
+    cached = cached && !stale
+    if cached {
+        s.remoteIndex.drop(netName, id)
+    }
+    if !stale {
+        s.signalRoutes.forget(id)
+    }
+    if cached && s.getConn(id) == nil {
+        s.forwardToLocalPeers(netName, outboundMessage{Type: "peer-disconnected", Data: map[string]interface{}{"peerId": id, "isHub": false, "reason": reason, "timestamp": nowMs()}, FromPeerId: "system", NetworkName: netName, Timestamp: nowMs()})
+        s.recordEvent(netName, "peer-disconnected", id, map[string]interface{}{"reason": reason})
+    }
+    s.forwardToMesh(outboundMessage{Type: "peer-disconnected", Data: m, FromPeerId: "system", NetworkName: netName, Timestamp: nowMs(), MessageId: msg.MessageId, OriginHub: msg.OriginHub, SeenHubs: msg.SeenHubs, Hops: msg.Hops}, fromUri, fromHub)
+}
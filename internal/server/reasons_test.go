@@ -0,0 +1,24 @@
+package server
+
+import (
+    "io"
+    "testing"
+    "github.com/gorilla/websocket"
+)
+
+func TestRemoteDisconnectDropsCachedPeer(t *testing.T) {
+    s := NewServer(Options{EventReplaySize: 10})
+    id := "0123456789abcdef0123456789abcdef01234567"
+    s.cacheCrossHubPeer("global", id, map[string]interface{}{"peerId": id})
+    s.handleRemoteDisconnect("", "ws://hub-a", inboundMessage{Type: "peer-disconnected", NetworkName: "global", Data: map[string]interface{}{"peerId": id, "reason": reasonHubShutdown}, OriginHub: "hub-a"})
+    if s.isCrossHubPeerCached("global", id) {
+        t.Fatalf("remote disconnect should drop the cached peer")
+    }
+    events, _, _ := s.events.since("global", 0)
+    if len(events) != 1 || events[0].Data["reason"] != reasonHubShutdown {
+        t.Fatalf("expected hub-shutdown event, got %v", events)
+    }
+    if readErrorReason(&websocket.CloseError{Code: websocket.CloseNormalClosure}) != reasonClientGoodbye || readErrorReason(io.ErrUnexpectedEOF) != reasonError {
+        t.Fatalf("read errors should map to client-goodbye or error")
+    }
+}
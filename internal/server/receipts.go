@@ -0,0 +1,88 @@
+package server
+
+import "encoding/json"
+
+const (
+    receiptDelivered = "delivered"
+    receiptRead      = "read"
+)
+
+// handlePeerMessage routes a peer-message or message-receipt from a local
+// client. peer-message is the generic relay channel between two peers; the
+// sender sets messageId and, to ask for receipts, receipts: true. The
+// destination answers with message-receipt {messageId, status} addressed back
+// to the sender, which the hub routes the same way.
+func (s *Server) handlePeerMessage(peerId string, msg inboundMessage, resp outboundMessage) {
+    if msg.TargetPeer == "" {
+        s.sendError(s.getConn(peerId), peerId, msg.Type+" requires targetPeerId")
+        return
+    }
+    if msg.MessageId == "" {
+        if msg.Type == "message-receipt" || msg.Receipts {
+            s.sendError(s.getConn(peerId), peerId, msg.Type+" requires messageId")
+            return
+        }
+        msg.MessageId = newMessageId()
+    }
+    if b, _ := json.Marshal(msg.Data); s.opts.PeerMessageMaxBytes > 0 && len(b) > s.opts.PeerMessageMaxBytes {
+        s.sendError(s.getConn(peerId), peerId, msg.Type+" payload too large")
+        return
+    }
+    // Receipts have their own limiter at twice the rate, since a peer
+    // acknowledges each message it is sent and may later mark it read too.
+    limiter, rate := s.peerMessages, s.peerMessageRate()
+    if msg.Type == "message-receipt" {
+        limiter, rate = s.peerReceipts, 2*rate
+    }
+    if !limiter.allow(peerId, rate) {
+        s.sendError(s.getConn(peerId), peerId, msg.Type+" rate limit exceeded")
+        s.penalize(peerId, offenceRateLimit, msg.Type)
+        return
+    }
+    if msg.Type == "message-receipt" {
+        m, _ := msg.Data.(map[string]interface{})
+        status, _ := m["status"].(string)
+        if status != receiptDelivered && status != receiptRead {
+            s.sendError(s.getConn(peerId), peerId, "message-receipt status must be delivered or read")
+            return
+        }
+        // A receipt carries nothing else, so it cannot relay data past the
+        // peer-message limits.
+        msg.Data = map[string]interface{}{"messageId": msg.MessageId, "status": status}
+        resp.Data = msg.Data
+    }
+    // Receipts are only meaningful if they name the real sender.
+    resp.FromPeerId = peerId
+    resp.MessageId = msg.MessageId
+    resp.Receipts = msg.Receipts
+    s.routePeerMessage("", "", msg, resp)
+}
+
+// handleMeshPeerMessage continues routing a peer-message or receipt that
+// arrived from another hub.
+func (s *Server) handleMeshPeerMessage(fromHub, fromUri string, msg inboundMessage) {
+    if msg.TargetPeer == "" || msg.MessageId == "" || s.alreadyVisited(msg) {
+        return
+    }
+    resp := outboundMessage{Type: msg.Type, Data: msg.Data, FromPeerId: msg.FromPeerId, TargetPeer: msg.TargetPeer, NetworkName: firstNonEmpty(msg.NetworkName, s.opts.DefaultNetwork), Timestamp: nowMs(), MessageId: msg.MessageId, Receipts: msg.Receipts, OriginHub: msg.OriginHub, SeenHubs: msg.SeenHubs, Hops: msg.Hops}
+    s.routePeerMessage(fromHub, fromUri, msg, resp)
+}
+
+// routePeerMessage delivers resp to a local target on the same network, or
+// forwards it once across the mesh.
+func (s *Server) routePeerMessage(fromHub, fromUri string, msg inboundMessage, resp outboundMessage) {
+    target := msg.TargetPeer
+    if s.getConn(target) != nil {
+        if tp := s.getPeerInfo(target); tp == nil || firstNonEmpty(tp.NetworkName, s.opts.DefaultNetwork) != resp.NetworkName {
+            return
+        }
+        s.forwardToLocalTarget(target, resp)
+        return
+    }
+    // A receipt reuses the messageId it acknowledges, so the payload is part
+    // of the dedupe key.
+    if !s.markRelayed(msg.Type + ":" + resp.FromPeerId + ":" + msg.MessageId + ":" + hashSignalData(msg.Data)) {
+        return
+    }
+    s.forwardToMesh(resp, fromUri, fromHub)
+}
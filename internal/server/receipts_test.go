@@ -0,0 +1,66 @@
+package server
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestPeerMessageReceiptsRouteBackToSender(t *testing.T) {
+    s := NewServer(Options{MaxConnections: 10})
+    a := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+    b := "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+    conns := attachTestPeers(t, s, a, b)
+    for _, id := range []string{a, b} {
+        s.peerData[id].Announced = true
+        s.peerData[id].NetworkName = "global"
+    }
+    next := func(id string) outboundMessage {
+        msgs, _ := conns[id].take(time.Second)
+        if len(msgs) != 1 {
+            t.Fatalf("expected one message for %s, got %d", id[:4], len(msgs))
+        }
+        var m outboundMessage
+        json.Unmarshal(msgs[0], &m)
+        return m
+    }
+    s.handleMessage(a, []byte(`{"type":"peer-message","targetPeerId":"`+b+`","messageId":"m1","receipts":true,"data":{"text":"hi"}}`))
+    got := next(b)
+    if got.Type != "peer-message" || got.FromPeerId != a || got.MessageId != "m1" || !got.Receipts {
+        t.Fatalf("unexpected delivery %+v", got)
+    }
+    s.handleMessage(b, []byte(`{"type":"message-receipt","targetPeerId":"`+a+`","messageId":"m1","data":{"messageId":"m1","status":"read","payload":"smuggled"}}`))
+    receipt := next(a)
+    if receipt.Type != "message-receipt" || receipt.FromPeerId != b || receipt.Data.(map[string]interface{})["status"] != receiptRead {
+        t.Fatalf("unexpected receipt %+v", receipt)
+    }
+    if data := receipt.Data.(map[string]interface{}); len(data) != 2 || data["messageId"] != "m1" {
+        t.Fatalf("receipt data should be stripped to messageId and status, got %v", data)
+    }
+    s.handleMessage(b, []byte(`{"type":"message-receipt","targetPeerId":"`+a+`","data":{"status":"read"}}`))
+    if next(b).Type != "error" {
+        t.Fatalf("receipt without messageId should be rejected")
+    }
+
+    s.opts.PeerMessageMaxBytes, s.live.peerMessageRate = 64, 1
+    s.handleMessage(a, []byte(`{"type":"peer-message","targetPeerId":"`+b+`","data":{"text":"`+strings.Repeat("x", 64)+`"}}`))
+    if next(a).Type != "error" {
+        t.Fatalf("oversize peer-message should be rejected")
+    }
+    s.handleMessage(a, []byte(`{"type":"peer-message","targetPeerId":"`+b+`","data":{"n":1}}`))
+    next(b)
+    s.handleMessage(a, []byte(`{"type":"peer-message","targetPeerId":"`+b+`","data":{"n":2}}`))
+    if next(a).Type != "error" {
+        t.Fatalf("second peer-message in a second should be rate limited")
+    }
+    s.handleMessage(b, []byte(`{"type":"message-receipt","targetPeerId":"`+a+`","messageId":"m2","data":{"messageId":"m2","status":"delivered"}}`))
+    s.handleMessage(b, []byte(`{"type":"message-receipt","targetPeerId":"`+a+`","messageId":"m3","data":{"messageId":"m3","status":"delivered"}}`))
+    if msgs, _ := conns[a].take(time.Second); len(msgs) != 2 {
+        t.Fatalf("receipts should have twice the peer-message rate, got %d", len(msgs))
+    }
+    s.handleMessage(b, []byte(`{"type":"message-receipt","targetPeerId":"`+a+`","messageId":"m4","data":{"messageId":"m4","status":"delivered"}}`))
+    if next(b).Type != "error" {
+        t.Fatalf("a third receipt in a second should be rate limited")
+    }
+}
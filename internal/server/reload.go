@@ -0,0 +1,179 @@
+package server
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "sort"
+    "sync"
+    "sync/atomic"
+    "github.com/gin-gonic/gin"
+    "peerpigeon/internal/logging"
+)
+
+// Live configuration. A few options can change while the hub runs:
+// MaxConnections, MaxUpgradesPerSec, AppBroadcastRatePerSec,
+// PeerMessageRatePerSec, GuestRatePerSec (for guest links minted from then
+// on), the log level and the extra listeners (see listeners.go). POST /admin/config takes a JSON object of the ones
+// to change, and the hub binary re-reads its settings on SIGHUP and passes
+// them to Reconfigure. Fields whose value is unchanged are skipped; each one
+// that changes gets its own audit entry with the old and new value and where
+// the change came from, and the reply lists them. Any other option needs a
+// restart, so a body naming one is refused with 400 and nothing is applied.
+// Lowering MaxConnections never drops connected peers; it only refuses new
+// ones until the hub is back under the cap.
+
+// ConfigUpdate holds new values for the options that can change live. Nil
+// fields are left as they are.
+type ConfigUpdate struct {
+    MaxConnections         *int    `json:"maxConnections,omitempty"`
+    MaxUpgradesPerSec      *int    `json:"maxUpgradesPerSec,omitempty"`
+    AppBroadcastRatePerSec *int    `json:"appBroadcastRatePerSec,omitempty"`
+    PeerMessageRatePerSec  *int    `json:"peerMessageRatePerSec,omitempty"`
+    GuestRatePerSec        *int    `json:"guestRatePerSec,omitempty"`
+    LogLevel               *string `json:"logLevel,omitempty"`
+    // Listeners, when set, replaces the configured extra listeners.
+    Listeners              *[]Listener `json:"listeners,omitempty"`
+}
+
+// ConfigChange is one option Reconfigure changed.
+type ConfigChange struct {
+    Field string      `json:"field"`
+    Old   interface{} `json:"old"`
+    New   interface{} `json:"new"`
+}
+
+const configSourceAdmin = "admin"
+
+// liveConfig holds the current values of the options that can change live;
+// the rest of the hub reads them through the accessors below instead of
+// s.opts.
+type liveConfig struct {
+    maxConnections   int64
+    appBroadcastRate int64
+    peerMessageRate  int64
+    guestRate        int64
+    verbose          int32
+
+    mu         sync.Mutex
+    reloads    int64
+    lastReload int64
+}
+
+func newLiveConfig(o Options) *liveConfig {
+    l := &liveConfig{maxConnections: int64(o.MaxConnections), appBroadcastRate: int64(o.AppBroadcastRatePerSec), peerMessageRate: int64(o.PeerMessageRatePerSec), guestRate: int64(o.GuestRatePerSec)}
+    if o.VerboseLogging {
+        l.verbose = 1
+    }
+    return l
+}
+
+func (s *Server) maxConnections() int { return int(atomic.LoadInt64(&s.live.maxConnections)) }
+func (s *Server) appBroadcastRate() int { return int(atomic.LoadInt64(&s.live.appBroadcastRate)) }
+func (s *Server) peerMessageRate() int { return int(atomic.LoadInt64(&s.live.peerMessageRate)) }
+func (s *Server) guestRate() int { return int(atomic.LoadInt64(&s.live.guestRate)) }
+func (s *Server) verbose() bool { return atomic.LoadInt32(&s.live.verbose) == 1 }
+
+// liveSettings returns the current values of the live options.
+func (s *Server) liveSettings() map[string]interface{} {
+    return map[string]interface{}{
+        "maxConnections":         s.maxConnections(),
+        "maxUpgradesPerSec":      s.admission.currentRate(),
+        "appBroadcastRatePerSec": s.appBroadcastRate(),
+        "peerMessageRatePerSec":  s.peerMessageRate(),
+        "guestRatePerSec":        s.guestRate(),
+        "logLevel":               string(logging.Level()),
+    }
+}
+
+// Reconfigure applies u and returns what changed. source says where the
+// change came from for the audit log and remote who asked, if anyone. An
+// invalid value fails the whole update.
+func (s *Server) Reconfigure(u ConfigUpdate, source, remote string) ([]ConfigChange, error) {
+    var level logging.LogLevel
+    if u.LogLevel != nil {
+        var ok bool
+        if level, ok = logging.ParseLevel(*u.LogLevel); !ok {
+            return nil, errors.New("logLevel must be debug, info, warn or error")
+        }
+    }
+    for name, v := range map[string]*int{"maxConnections": u.MaxConnections, "maxUpgradesPerSec": u.MaxUpgradesPerSec, "appBroadcastRatePerSec": u.AppBroadcastRatePerSec, "peerMessageRatePerSec": u.PeerMessageRatePerSec, "guestRatePerSec": u.GuestRatePerSec} {
+        if v != nil && *v < 0 {
+            return nil, errors.New(name + " must not be negative")
+        }
+    }
+    l := s.live
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    changes := []ConfigChange{}
+    if u.Listeners != nil {
+        var err error
+        if changes, err = s.reconcileListeners(*u.Listeners); err != nil {
+            return nil, err
+        }
+    }
+    before := s.liveSettings()
+    setInt := func(field *int64, v *int) {
+        if v != nil {
+            atomic.StoreInt64(field, int64(*v))
+        }
+    }
+    setInt(&l.maxConnections, u.MaxConnections)
+    setInt(&l.appBroadcastRate, u.AppBroadcastRatePerSec)
+    setInt(&l.peerMessageRate, u.PeerMessageRatePerSec)
+    setInt(&l.guestRate, u.GuestRatePerSec)
+    if u.MaxUpgradesPerSec != nil {
+        s.admission.setRate(*u.MaxUpgradesPerSec)
+    }
+    if u.LogLevel != nil {
+        logging.SetLevel(level)
+        verbose := int32(0)
+        if level == logging.DEBUG {
+            verbose = 1
+        }
+        atomic.StoreInt32(&l.verbose, verbose)
+    }
+    after := s.liveSettings()
+    for field, old := range before {
+        if after[field] != old {
+            changes = append(changes, ConfigChange{Field: field, Old: old, New: after[field]})
+        }
+    }
+    sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+    for _, c := range changes {
+        s.recordAudit(remote, "config-change", map[string]interface{}{"field": c.Field, "old": c.Old, "new": c.New, "source": source})
+    }
+    l.reloads++
+    l.lastReload = nowMs()
+    s.log.Info("config_reloaded", map[string]interface{}{"source": source, "changed": len(changes)})
+    return changes, nil
+}
+
+// adminGetConfig returns the current values of the live options.
+func (s *Server) adminGetConfig(c *gin.Context) {
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"config": s.liveSettings()}, s.opts.CORSOrigin)
+}
+
+// adminSetConfig changes live options: {"maxConnections": 2000, "logLevel":
+// "debug"}. It answers with the changes and the resulting values.
+func (s *Server) adminSetConfig(c *gin.Context) {
+    var u ConfigUpdate
+    dec := json.NewDecoder(c.Request.Body)
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&u); err != nil {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "invalid config update (only live options can change without a restart): " + err.Error()}, s.opts.CORSOrigin)
+        return
+    }
+    changes, err := s.Reconfigure(u, configSourceAdmin, c.ClientIP())
+    if err != nil {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": err.Error()}, s.opts.CORSOrigin)
+        return
+    }
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"updated": changes, "config": s.liveSettings()}, s.opts.CORSOrigin)
+}
+
+func (s *Server) reloadSnapshot() map[string]interface{} {
+    s.live.mu.Lock()
+    defer s.live.mu.Unlock()
+    return map[string]interface{}{"reloads": s.live.reloads, "last_reload": s.live.lastReload}
+}
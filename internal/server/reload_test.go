@@ -0,0 +1,55 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/gin-gonic/gin"
+    "peerpigeon/internal/logging"
+)
+
+func TestReconfigureChangesLiveOptions(t *testing.T) {
+    defer logging.SetLevel(logging.INFO)
+    s := NewServer(Options{AdminToken: "admin-secret", MaxConnections: 1, PeerMessageRatePerSec: 20})
+    s.engine = gin.New()
+    s.registerAdminRoutes()
+    s.wsConns["peer"] = &pollConn{}
+    post := func(body string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest("POST", "/admin/config", strings.NewReader(body))
+        req.Header.Set("Authorization", "Bearer admin-secret")
+        rec := httptest.NewRecorder()
+        s.engine.ServeHTTP(rec, req)
+        return rec
+    }
+    if !s.atPathLimit(pathWS) {
+        t.Fatal("hub should start full")
+    }
+    rec := post(`{"maxConnections": 2, "peerMessageRatePerSec": 20, "logLevel": "debug"}`)
+    var out struct {
+        Updated []ConfigChange `json:"updated"`
+    }
+    if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &out) != nil {
+        t.Fatalf("reconfigure failed: %d %s", rec.Code, rec.Body.String())
+    }
+    if len(out.Updated) != 2 || out.Updated[0].Field != "logLevel" || out.Updated[1].Field != "maxConnections" {
+        t.Fatalf("only changed fields should be reported, got %+v", out.Updated)
+    }
+    if s.atPathLimit(pathWS) || !s.verbose() || logging.Level() != logging.DEBUG {
+        t.Fatal("new values were not applied")
+    }
+    if len(s.auditLog) != 2 || s.auditLog[1].Details["field"] != "maxConnections" || s.auditLog[1].Details["source"] != "admin" {
+        t.Fatalf("expected one audit entry per change, got %+v", s.auditLog)
+    }
+
+    // Restart-only options and bad values are refused as a whole.
+    for _, body := range []string{`{"maxConnections": 5, "port": 1}`, `{"maxConnections": 5, "logLevel": "loud"}`, `{"maxConnections": -1}`} {
+        if rec := post(body); rec.Code != http.StatusBadRequest {
+            t.Fatalf("%s: expected 400, got %d", body, rec.Code)
+        }
+    }
+    if s.maxConnections() != 2 || len(s.auditLog) != 2 {
+        t.Fatal("a refused update changed the hub")
+    }
+}
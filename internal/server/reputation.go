@@ -0,0 +1,523 @@
+package server
+
+import (
+    "encoding/json"
+    "net"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+// Peer reputation. Each client connected to this hub collects penalty
+// points for misbehaving: malformed or undecodable messages, rate-limit
+// hits, spoofed fromPeerId and signaling failures reported by other peers.
+// Points drain at reputationDecayPerMin, so an occasional slip is forgotten.
+// Crossing ReputationWarnAt sends the peer a reputation-warning error,
+// ReputationThrottleAt limits it to reputationThrottlePerSec messages a
+// second (pings and goodbyes always pass), and ReputationBanAt disconnects
+// it and refuses it for ReputationBanMs. Bans are kept in the Store under
+// ReputationStorePath so they survive restarts. Hub links are never scored.
+// Operators can also ban an address or CIDR range: connections from it are
+// refused, and peers already connected from it are dropped.
+const (
+    offenceProtocol        = "protocol-violation"
+    offenceRateLimit       = "rate-limit"
+    offenceSpoof           = "spoof"
+    offenceSignalingFailed = "signaling-failed"
+
+    errReputationWarning   = "reputation-warning"
+    errReputationThrottled = "reputation-throttled"
+
+    reputationDecayPerMin    = 2.0
+    reputationThrottlePerSec = 5
+    reportCooldownMs         = 60000
+
+    // ipBanPrefix keys address bans in the same table as peer ID bans, so
+    // they are saved and listed together.
+    ipBanPrefix = "ip:"
+)
+
+var offenceWeights = map[string]float64{
+    offenceProtocol:        5,
+    offenceRateLimit:       2,
+    offenceSpoof:           20,
+    offenceSignalingFailed: 10,
+}
+
+type reputationRecord struct {
+    score     float64
+    updatedAt int64
+    offences  map[string]int64
+    window    int64
+    sent      int
+}
+
+// PeerBan is a ban on a peer ID, issued automatically or by an operator, or
+// on an address or CIDR range (IP).
+type PeerBan struct {
+    PeerId   string  `json:"peerId,omitempty"`
+    IP       string  `json:"ip,omitempty"`
+    Reason   string  `json:"reason"`
+    Score    float64 `json:"score,omitempty"`
+    BannedAt int64   `json:"bannedAt"`
+    Until    int64   `json:"until"`
+}
+
+type reputationTracker struct {
+    store   Store
+    key     string
+    mu      sync.Mutex
+    peers   map[string]*reputationRecord
+    bans    map[string]*PeerBan
+    reports map[string]int64
+
+    warnings  int64
+    throttled int64
+    banned    int64
+}
+
+func newReputationTracker(store Store, key string) *reputationTracker {
+    t := &reputationTracker{store: store, key: key, peers: map[string]*reputationRecord{}, bans: map[string]*PeerBan{}, reports: map[string]int64{}}
+    if key != "" {
+        if b, err := store.Load(key); err == nil && b != nil {
+            json.Unmarshal(b, &t.bans)
+        }
+    }
+    return t
+}
+
+func (t *reputationTracker) saveLocked() error {
+    if t.key == "" {
+        return nil
+    }
+    b, _ := json.Marshal(t.bans)
+    return t.store.Save(t.key, b)
+}
+
+// decay drains the points earned since the record was last touched.
+func (r *reputationRecord) decay(now int64) {
+    r.score -= float64(now-r.updatedAt) / 60000 * reputationDecayPerMin
+    if r.score < 0 {
+        r.score = 0
+    }
+    r.updatedAt = now
+}
+
+func (s *Server) reputationEnabled() bool {
+    return s.opts.ReputationWarnAt > 0 || s.opts.ReputationThrottleAt > 0 || s.opts.ReputationBanAt > 0
+}
+
+// reputationLevel names the highest threshold score has reached.
+func (s *Server) reputationLevel(score float64) string {
+    switch {
+    case s.opts.ReputationBanAt > 0 && score >= float64(s.opts.ReputationBanAt):
+        return "banned"
+    case s.opts.ReputationThrottleAt > 0 && score >= float64(s.opts.ReputationThrottleAt):
+        return "throttled"
+    case s.opts.ReputationWarnAt > 0 && score >= float64(s.opts.ReputationWarnAt):
+        return "warned"
+    }
+    return ""
+}
+
+// penalize adds an offence to peerId's score and applies whichever sanction
+// the new score calls for. detail says what happened, for the logs.
+func (s *Server) penalize(peerId, offence, detail string) {
+    if !s.reputationEnabled() {
+        return
+    }
+    pi := s.getPeerInfo(peerId)
+    if pi == nil || pi.IsHub {
+        return
+    }
+    t := s.reputation
+    now := nowMs()
+    t.mu.Lock()
+    r := t.peers[peerId]
+    if r == nil {
+        r = &reputationRecord{updatedAt: now, offences: map[string]int64{}}
+        t.peers[peerId] = r
+    }
+    r.decay(now)
+    prev := s.reputationLevel(r.score)
+    r.score += offenceWeights[offence]
+    r.offences[offence]++
+    score := r.score
+    // Scores only rise here, so a different level is always a worse one.
+    level := s.reputationLevel(score)
+    escalated := level != prev
+    if escalated {
+        switch level {
+        case "warned":
+            t.warnings++
+        case "throttled":
+            t.throttled++
+        }
+    }
+    t.mu.Unlock()
+    s.connLog(peerId).Warn("peer_offence", map[string]interface{}{"offence": offence, "detail": detail, "score": score})
+    if !escalated {
+        return
+    }
+    switch level {
+    case "banned":
+        s.banPeer(peerId, "reputation: "+offence, score, time.Duration(s.opts.ReputationBanMs)*time.Millisecond)
+    case "throttled":
+        s.sendToConn(s.getConn(peerId), outboundMessage{Type: "error", Data: map[string]interface{}{"code": errReputationThrottled, "message": "too many offences, messages are now rate limited", "score": score, "limitPerSec": reputationThrottlePerSec}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+    case "warned":
+        s.sendToConn(s.getConn(peerId), outboundMessage{Type: "error", Data: map[string]interface{}{"code": errReputationWarning, "message": "further offences will get this peer rate limited or banned", "score": score}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+    }
+}
+
+// allowFromPeer applies the throttle to a peer past ReputationThrottleAt.
+// Pings and goodbyes are never throttled so the peer can stay connected
+// and leave cleanly.
+func (s *Server) allowFromPeer(peerId, msgType string) bool {
+    if s.opts.ReputationThrottleAt <= 0 || msgType == "ping" || msgType == "goodbye" {
+        return true
+    }
+    t := s.reputation
+    now := nowMs()
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    r := t.peers[peerId]
+    if r == nil {
+        return true
+    }
+    r.decay(now)
+    if r.score < float64(s.opts.ReputationThrottleAt) {
+        return true
+    }
+    if now-r.window >= 1000 {
+        r.window, r.sent = now, 0
+    }
+    r.sent++
+    return r.sent <= reputationThrottlePerSec
+}
+
+// banPeer records a ban, persists it and disconnects the peer if it is
+// here. A zero duration bans until an operator lifts it.
+func (s *Server) banPeer(peerId, reason string, score float64, d time.Duration) *PeerBan {
+    t := s.reputation
+    now := nowMs()
+    b := &PeerBan{PeerId: peerId, Reason: reason, Score: score, BannedAt: now}
+    if d > 0 {
+        b.Until = now + d.Milliseconds()
+    }
+    t.mu.Lock()
+    t.bans[peerId] = b
+    t.banned++
+    err := t.saveLocked()
+    t.mu.Unlock()
+    if err != nil {
+        s.log.Warn("reputation_save_failed", map[string]interface{}{"key": t.key, "error": err.Error()})
+    }
+    s.log.Warn("peer_banned", map[string]interface{}{"peerId": peerId, "reason": reason, "until": b.Until})
+    if conn := s.getConn(peerId); conn != nil {
+        s.handleDisconnect(peerId, reasonBanned, reason)
+        closeWithReason(conn, websocket.ClosePolicyViolation, reasonBanned)
+    }
+    return b
+}
+
+// pardon lifts peerId's ban and clears its score. It reports whether there
+// was anything to clear.
+func (s *Server) pardon(peerId string) bool {
+    t := s.reputation
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    _, banned := t.bans[peerId]
+    _, scored := t.peers[peerId]
+    delete(t.bans, peerId)
+    delete(t.peers, peerId)
+    if banned {
+        if err := t.saveLocked(); err != nil {
+            s.log.Warn("reputation_save_failed", map[string]interface{}{"key": t.key, "error": err.Error()})
+        }
+    }
+    return banned || scored
+}
+
+// forgetReputation drops peerId's score, its ban and the report cooldowns
+// it is part of, for erasure. It returns how many records went.
+func (s *Server) forgetReputation(peerId string) int {
+    t := s.reputation
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    n := 0
+    if _, ok := t.peers[peerId]; ok {
+        delete(t.peers, peerId)
+        n++
+    }
+    if _, ok := t.bans[peerId]; ok {
+        delete(t.bans, peerId)
+        n++
+        if err := t.saveLocked(); err != nil {
+            s.log.Warn("reputation_save_failed", map[string]interface{}{"key": t.key, "error": err.Error()})
+        }
+    }
+    for key := range t.reports {
+        if from, to, _ := strings.Cut(key, ">"); from == peerId || to == peerId {
+            delete(t.reports, key)
+            n++
+        }
+    }
+    return n
+}
+
+// isBanned reports whether peerId is currently banned.
+func (s *Server) isBanned(peerId string) bool {
+    t := s.reputation
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    b := t.bans[peerId]
+    return b != nil && (b.Until == 0 || b.Until > nowMs())
+}
+
+// normalizeBanIP returns ip, an address or CIDR range, in canonical form.
+func normalizeBanIP(ip string) (string, bool) {
+    if _, n, err := net.ParseCIDR(ip); err == nil {
+        return n.String(), true
+    }
+    if a := net.ParseIP(ip); a != nil {
+        return a.String(), true
+    }
+    return "", false
+}
+
+// banIP bans an address or range and disconnects the peers connected from
+// it, returning them. Hub links are left alone. A zero duration bans until
+// an operator lifts it.
+func (s *Server) banIP(ip, reason string, d time.Duration) (*PeerBan, []string) {
+    t := s.reputation
+    now := nowMs()
+    b := &PeerBan{IP: ip, Reason: reason, BannedAt: now}
+    if d > 0 {
+        b.Until = now + d.Milliseconds()
+    }
+    t.mu.Lock()
+    t.bans[ipBanPrefix+ip] = b
+    t.banned++
+    err := t.saveLocked()
+    t.mu.Unlock()
+    if err != nil {
+        s.log.Warn("reputation_save_failed", map[string]interface{}{"key": t.key, "error": err.Error()})
+    }
+    s.log.Warn("ip_banned", map[string]interface{}{"ip": ip, "reason": reason, "until": b.Until})
+    s.peersMu.Lock()
+    ids := []string{}
+    for id, pi := range s.peerData {
+        if !pi.IsHub && banCovers(ip, net.ParseIP(pi.RemoteAddress)) {
+            ids = append(ids, id)
+        }
+    }
+    s.peersMu.Unlock()
+    sort.Strings(ids)
+    for _, id := range ids {
+        if conn := s.getConn(id); conn != nil {
+            s.handleDisconnect(id, reasonBanned, reason)
+            closeWithReason(conn, websocket.ClosePolicyViolation, reasonBanned)
+        }
+    }
+    return b, ids
+}
+
+// pardonIP lifts a ban on an address or range, reporting whether there was
+// one.
+func (s *Server) pardonIP(ip string) bool {
+    t := s.reputation
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if _, ok := t.bans[ipBanPrefix+ip]; !ok {
+        return false
+    }
+    delete(t.bans, ipBanPrefix+ip)
+    if err := t.saveLocked(); err != nil {
+        s.log.Warn("reputation_save_failed", map[string]interface{}{"key": t.key, "error": err.Error()})
+    }
+    return true
+}
+
+func banCovers(ban string, addr net.IP) bool {
+    if addr == nil {
+        return false
+    }
+    if _, n, err := net.ParseCIDR(ban); err == nil {
+        return n.Contains(addr)
+    }
+    return addr.Equal(net.ParseIP(ban))
+}
+
+// isIPBanned reports whether addr falls under a current address ban.
+func (s *Server) isIPBanned(addr string) bool {
+    ip := net.ParseIP(addr)
+    t := s.reputation
+    now := nowMs()
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for key, b := range t.bans {
+        if strings.HasPrefix(key, ipBanPrefix) && (b.Until == 0 || b.Until > now) && banCovers(b.IP, ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// handleReportPeer takes a peer's report that signaling with another local
+// peer failed. Only a peer the hub saw signaling with the target in the last
+// minute may report it, and each reporter, and each reporter address, counts
+// once per target per minute, so neither one client nor a crowd of fresh
+// peer IDs from one address can ban another peer.
+func (s *Server) handleReportPeer(peerId string, msg inboundMessage) {
+    m, _ := msg.Data.(map[string]interface{})
+    target, _ := m["peerId"].(string)
+    reason, _ := m["reason"].(string)
+    if reason != offenceSignalingFailed || target == "" || target == peerId {
+        s.sendError(s.getConn(peerId), peerId, "report-peer requires a peerId and reason signaling-failed")
+        return
+    }
+    pi := s.getPeerInfo(peerId)
+    if pi == nil || !pi.Announced || pi.IsHub || !s.reputationEnabled() {
+        return
+    }
+    now := nowMs()
+    if !s.signaling.signaled(firstNonEmpty(pi.NetworkName, s.opts.DefaultNetwork), peerId, target, now) {
+        return
+    }
+    key, ipKey := peerId+">"+target, ipBanPrefix+pi.RemoteAddress+">"+target
+    t := s.reputation
+    t.mu.Lock()
+    if now-t.reports[key] < reportCooldownMs || (pi.RemoteAddress != "" && now-t.reports[ipKey] < reportCooldownMs) {
+        t.mu.Unlock()
+        return
+    }
+    t.reports[key] = now
+    if pi.RemoteAddress != "" {
+        t.reports[ipKey] = now
+    }
+    t.mu.Unlock()
+    s.penalize(target, offenceSignalingFailed, "reported by "+peerId)
+}
+
+// pruneReputation forgets scores that have drained away, expired bans and
+// old report cooldowns.
+func (s *Server) pruneReputation(now int64) {
+    t := s.reputation
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    for id, r := range t.peers {
+        if r.decay(now); r.score == 0 {
+            delete(t.peers, id)
+        }
+    }
+    expired := false
+    for id, b := range t.bans {
+        if b.Until != 0 && b.Until <= now {
+            delete(t.bans, id)
+            expired = true
+        }
+    }
+    if expired {
+        t.saveLocked()
+    }
+    for key, at := range t.reports {
+        if now-at >= reportCooldownMs {
+            delete(t.reports, key)
+        }
+    }
+}
+
+func (s *Server) reputationSnapshot() map[string]interface{} {
+    t := s.reputation
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return map[string]interface{}{"enabled": s.reputationEnabled(), "tracked": len(t.peers), "bans": len(t.bans), "warnings": t.warnings, "throttled": t.throttled, "banned": t.banned}
+}
+
+// adminReputation lists scored peers, worst first, and current bans.
+func (s *Server) adminReputation(c *gin.Context) {
+    t := s.reputation
+    now := nowMs()
+    t.mu.Lock()
+    peers := make([]map[string]interface{}, 0, len(t.peers))
+    for id, r := range t.peers {
+        r.decay(now)
+        offences := make(map[string]int64, len(r.offences))
+        for k, v := range r.offences {
+            offences[k] = v
+        }
+        peers = append(peers, map[string]interface{}{"peerId": id, "score": r.score, "level": s.reputationLevel(r.score), "offences": offences})
+    }
+    bans := make([]PeerBan, 0, len(t.bans))
+    for _, b := range t.bans {
+        if b.Until == 0 || b.Until > now {
+            bans = append(bans, *b)
+        }
+    }
+    t.mu.Unlock()
+    sort.Slice(peers, func(i, j int) bool { return peers[i]["score"].(float64) > peers[j]["score"].(float64) })
+    sort.Slice(bans, func(i, j int) bool { return bans[i].BannedAt > bans[j].BannedAt })
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"peers": peers, "bans": bans}, s.opts.CORSOrigin)
+}
+
+func (s *Server) adminBanPeer(c *gin.Context) {
+    peerId := c.Param("peerId")
+    var body struct {
+        Reason     string `json:"reason"`
+        DurationMs int64  `json:"durationMs"`
+    }
+    json.NewDecoder(c.Request.Body).Decode(&body)
+    if !s.validPeerId(peerId) || body.DurationMs < 0 {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "a valid peerId and a non-negative durationMs are required"}, s.opts.CORSOrigin)
+        return
+    }
+    reason := firstNonEmpty(body.Reason, "banned by operator")
+    b := s.banPeer(peerId, reason, 0, time.Duration(body.DurationMs)*time.Millisecond)
+    s.audit(c, "ban", map[string]interface{}{"peerId": peerId, "reason": reason, "until": b.Until})
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"ban": b}, s.opts.CORSOrigin)
+}
+
+// adminBanIP bans an address or CIDR range: {"ip": "203.0.113.7",
+// "durationMs": 3600000, "reason": "..."}.
+func (s *Server) adminBanIP(c *gin.Context) {
+    var body struct {
+        IP         string `json:"ip"`
+        Reason     string `json:"reason"`
+        DurationMs int64  `json:"durationMs"`
+    }
+    json.NewDecoder(c.Request.Body).Decode(&body)
+    ip, ok := normalizeBanIP(body.IP)
+    if !ok || body.DurationMs < 0 {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "a valid ip or CIDR range and a non-negative durationMs are required"}, s.opts.CORSOrigin)
+        return
+    }
+    reason := firstNonEmpty(body.Reason, "banned by operator")
+    b, disconnected := s.banIP(ip, reason, time.Duration(body.DurationMs)*time.Millisecond)
+    s.audit(c, "ban-ip", map[string]interface{}{"ip": ip, "reason": reason, "until": b.Until, "disconnected": len(disconnected)})
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"ban": b, "disconnected": disconnected}, s.opts.CORSOrigin)
+}
+
+// adminPardonIP lifts an address ban: ?ip=203.0.113.7 or ?ip=10.0.0.0/8.
+func (s *Server) adminPardonIP(c *gin.Context) {
+    ip, ok := normalizeBanIP(c.Query("ip"))
+    if !ok || !s.pardonIP(ip) {
+        writeJSON(c.Writer, http.StatusNotFound, map[string]interface{}{"error": "no ban on that ip"}, s.opts.CORSOrigin)
+        return
+    }
+    s.audit(c, "pardon-ip", map[string]interface{}{"ip": ip})
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"pardoned": ip}, s.opts.CORSOrigin)
+}
+
+func (s *Server) adminPardonPeer(c *gin.Context) {
+    peerId := c.Param("peerId")
+    if !s.pardon(peerId) {
+        writeJSON(c.Writer, http.StatusNotFound, map[string]interface{}{"error": "peer has no score or ban"}, s.opts.CORSOrigin)
+        return
+    }
+    s.audit(c, "pardon", map[string]interface{}{"peerId": peerId})
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"pardoned": peerId}, s.opts.CORSOrigin)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "testing"
+    "time"
+)
+
+func TestReputationEscalatesToPersistentBan(t *testing.T) {
+    st := &memStore{docs: map[string][]byte{}}
+    s := NewServer(Options{ReputationWarnAt: 9, ReputationThrottleAt: 25, ReputationBanAt: 42, ReputationBanMs: 60000, ReputationStorePath: "bans", Store: st, SignalingTimeoutMs: 30000})
+    bad, good, hub := randomPeerId(), randomPeerId(), randomPeerId()
+    conns := attachTestPeers(t, s, bad, good, hub)
+    for _, id := range []string{bad, good, hub} {
+        s.peerData[id].IsHub = id == hub
+    }
+    codes := func(id string) []string {
+        msgs, _ := conns[id].take(20 * time.Millisecond)
+        var out []string
+        for _, raw := range msgs {
+            var m outboundMessage
+            json.Unmarshal(raw, &m)
+            if d, ok := m.Data.(map[string]interface{}); ok && m.Type == "error" && d["code"] != nil {
+                out = append(out, d["code"].(string))
+            }
+        }
+        return out
+    }
+    s.handleMessage(hub, []byte(`{not json`))
+    s.handleMessage(hub, []byte(`{not json`))
+    if s.reputationSnapshot()["tracked"] != 0 {
+        t.Fatalf("hub links should never be scored")
+    }
+
+    s.handleMessage(bad, []byte(`{not json`))
+    s.handleMessage(bad, []byte(`{not json`))
+    if got := codes(bad); fmt.Sprint(got) != "["+errReputationWarning+"]" {
+        t.Fatalf("second violation should warn, got %v", got)
+    }
+    s.handleMessage(bad, []byte(`{"type":"offer","fromPeerId":"`+good+`","targetPeerId":"`+good+`","data":{}}`))
+    if got := codes(bad); fmt.Sprint(got) != "["+errSenderMismatch+" "+errReputationThrottled+"]" {
+        t.Fatalf("a spoof should push the peer into the throttle, got %v", got)
+    }
+    conns[good].take(20 * time.Millisecond)
+    for i := 0; i < 10; i++ {
+        s.handleMessage(bad, []byte(`{"type":"offer","targetPeerId":"`+good+`","data":{}}`))
+    }
+    if msgs, _ := conns[good].take(20 * time.Millisecond); len(msgs) != reputationThrottlePerSec {
+        t.Fatalf("throttled peer should get %d messages a second through, got %d", reputationThrottlePerSec, len(msgs))
+    }
+
+    // Reports count once per reporter per target.
+    s.peerData[good].Announced = true
+    s.handleMessage(good, []byte(`{"type":"report-peer","data":{"peerId":"`+bad+`","reason":"signaling-failed"}}`))
+    s.handleMessage(good, []byte(`{"type":"report-peer","data":{"peerId":"`+bad+`","reason":"signaling-failed"}}`))
+    if s.isBanned(bad) {
+        t.Fatalf("a repeated report should not count twice")
+    }
+    s.handleMessage(bad, []byte(`{not json`))
+    if !s.isBanned(bad) || s.getConn(bad) != nil {
+        t.Fatalf("crossing the ban threshold should ban and disconnect the peer")
+    }
+    if restarted := NewServer(Options{ReputationBanAt: 42, ReputationStorePath: "bans", Store: st}); !restarted.isBanned(bad) {
+        t.Fatalf("bans should survive a restart")
+    }
+    snap := s.reputationSnapshot()
+    if snap["warnings"] != int64(1) || snap["throttled"] != int64(1) || snap["banned"] != int64(1) {
+        t.Fatalf("unexpected reputation counters %v", snap)
+    }
+    if !s.pardon(bad) || s.isBanned(bad) {
+        t.Fatalf("pardon should lift the ban")
+    }
+}
+
+func TestReportPeerNeedsSignalingAndCountsOncePerAddress(t *testing.T) {
+    s := NewServer(Options{ReputationBanAt: 1000, SignalingTimeoutMs: 30000})
+    target, r1, r2, r3, stranger := randomPeerId(), randomPeerId(), randomPeerId(), randomPeerId(), randomPeerId()
+    addrs := map[string]string{target: "10.0.0.9", r1: "10.0.0.1", r2: "10.0.0.1", r3: "10.0.0.2", stranger: "10.0.0.3"}
+    for id, addr := range addrs {
+        attachTestPeer(t, s, id)
+        s.peerData[id].Announced = true
+        s.peerData[id].RemoteAddress = addr
+    }
+    for _, id := range []string{r1, r2, r3} {
+        s.handleMessage(id, []byte(`{"type":"offer","targetPeerId":"`+target+`","data":{}}`))
+    }
+    score := func() int {
+        s.reputation.mu.Lock()
+        defer s.reputation.mu.Unlock()
+        if r := s.reputation.peers[target]; r != nil {
+            return int(r.score + 0.5)
+        }
+        return 0
+    }
+    report := []byte(`{"type":"report-peer","data":{"peerId":"` + target + `","reason":"signaling-failed"}}`)
+    s.handleMessage(stranger, report)
+    if got := score(); got != 0 {
+        t.Fatalf("a peer that never signaled the target should not count, score %d", got)
+    }
+    s.handleMessage(r1, report)
+    s.handleMessage(r2, report)
+    if got := score(); got != 10 {
+        t.Fatalf("reporters sharing an address should count once, score %d", got)
+    }
+    s.handleMessage(r3, report)
+    if got := score(); got != 20 {
+        t.Fatalf("a reporter from another address should count, score %d", got)
+    }
+}
@@ -0,0 +1,28 @@
+package server
+
+// Hub roles let operators split responsibilities across machines. A full hub
+// does everything; a signaling hub handles discovery and WebRTC signaling but
+// no generic relay; a relay hub accepts relay traffic (blobs, app-broadcast)
+// and leaves discovery and signaling to other hubs.
+const (
+    RoleFull      = "full"
+    RoleSignaling = "signaling"
+    RoleRelay     = "relay"
+)
+
+func (s *Server) role() string {
+    switch s.opts.HubRole {
+    case RoleSignaling, RoleRelay:
+        return s.opts.HubRole
+    }
+    return RoleFull
+}
+
+func (s *Server) servesSignaling() bool { return s.role() != RoleRelay }
+
+func (s *Server) servesRelay() bool { return s.role() != RoleSignaling }
+
+// rejectForRole tells the peer its message type is not served here.
+func (s *Server) rejectForRole(peerId, msgType string) {
+    s.sendError(s.getConn(peerId), peerId, msgType+" not served by "+s.role()+" hub")
+}
@@ -0,0 +1,17 @@
+package server
+
+import "testing"
+
+func TestHubRoleFeatures(t *testing.T) {
+    sig := NewServer(Options{HubRole: RoleSignaling, BlobMaxBytes: 1024})
+    if hasFeature(sig.features(), featureRelay) || hasFeature(sig.features(), featureBlobRelay) || !hasFeature(sig.features(), featureSignaling) {
+        t.Fatalf("signaling hub advertised %v", sig.features())
+    }
+    relay := NewServer(Options{HubRole: RoleRelay, BlobMaxBytes: 1024})
+    if hasFeature(relay.features(), featureSignaling) || !hasFeature(relay.features(), featureBlobRelay) {
+        t.Fatalf("relay hub advertised %v", relay.features())
+    }
+    if NewServer(Options{HubRole: "bogus"}).role() != RoleFull {
+        t.Fatalf("unknown role should fall back to full")
+    }
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+    "encoding/json"
+    "sort"
+    "sync"
+)
+
+// Rooms subdivide a network. An announced peer joins and leaves named rooms
+// within its network:
+//
+//     {"type": "subscribe", "data": {"rooms": ["lobby", "match-7"]}}
+//     {"type": "unsubscribe", "data": {"rooms": ["lobby"]}}
+//
+// and is answered with "subscribed" listing every room it is in. Joining
+// sends a peer-discovered carrying "room" to the other members and to the
+// joiner for each of them; leaving, by unsubscribe, disconnect or switching
+// network, sends room-left to the members left behind. room-broadcast {"room", "payload"}
+// reaches the other members, and room-members {"room"} lists them. Room
+// names follow the network name rules, a peer may be in MaxRoomsPerPeer
+// rooms, and rooms only span the peers of this hub.
+const (
+    errInvalidRoom  = "invalid-room"
+    errRoomLimit    = "room-limit"
+    errNotAnnounced = "not-announced"
+    errNotInRoom    = "not-in-room"
+
+    // room-left reasons besides the disconnect reasons.
+    roomUnsubscribed = "unsubscribed"
+    roomDisconnected = "disconnected"
+)
+
+type roomRegistry struct {
+    mu sync.Mutex
+    // rooms maps network, then room, to its members; joined maps a peer to
+    // its network and rooms.
+    rooms      map[string]map[string]map[string]struct{}
+    joined     map[string]*roomMembership
+    broadcasts int64
+}
+
+type roomMembership struct {
+    netName string
+    rooms   map[string]struct{}
+}
+
+func newRoomRegistry() *roomRegistry {
+    return &roomRegistry{rooms: map[string]map[string]map[string]struct{}{}, joined: map[string]*roomMembership{}}
+}
+
+// join adds peerId to room and returns the members that were already there,
+// or ok false when the room limit is reached.
+func (r *roomRegistry) join(peerId, netName, room string, limit int) (others []string, added, ok bool) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    m := r.joined[peerId]
+    if m == nil {
+        m = &roomMembership{netName: netName, rooms: map[string]struct{}{}}
+        r.joined[peerId] = m
+    }
+    if _, in := m.rooms[room]; in {
+        return nil, false, true
+    }
+    if limit > 0 && len(m.rooms) >= limit {
+        return nil, false, false
+    }
+    if r.rooms[netName] == nil {
+        r.rooms[netName] = map[string]map[string]struct{}{}
+    }
+    members := r.rooms[netName][room]
+    if members == nil {
+        members = map[string]struct{}{}
+        r.rooms[netName][room] = members
+    }
+    for id := range members {
+        others = append(others, id)
+    }
+    sort.Strings(others)
+    members[peerId] = struct{}{}
+    m.rooms[room] = struct{}{}
+    return others, true, true
+}
+
+// leave removes peerId from room and returns the members left behind, or
+// ok false when it was not in the room.
+func (r *roomRegistry) leave(peerId, room string) (netName string, others []string, ok bool) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    m := r.joined[peerId]
+    if m == nil {
+        return "", nil, false
+    }
+    if _, in := m.rooms[room]; !in {
+        return "", nil, false
+    }
+    delete(m.rooms, room)
+    if len(m.rooms) == 0 {
+        delete(r.joined, peerId)
+    }
+    members := r.rooms[m.netName][room]
+    delete(members, peerId)
+    for id := range members {
+        others = append(others, id)
+    }
+    sort.Strings(others)
+    if len(members) == 0 {
+        delete(r.rooms[m.netName], room)
+        if len(r.rooms[m.netName]) == 0 {
+            delete(r.rooms, m.netName)
+        }
+    }
+    return m.netName, others, true
+}
+
+// roomsOf returns the sorted rooms peerId is in.
+func (r *roomRegistry) roomsOf(peerId string) []string {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    out := []string{}
+    if m := r.joined[peerId]; m != nil {
+        for room := range m.rooms {
+            out = append(out, room)
+        }
+    }
+    sort.Strings(out)
+    return out
+}
+
+// members returns the sorted members of a room and whether peerId is one.
+func (r *roomRegistry) members(netName, room, peerId string) ([]string, bool) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    out := []string{}
+    _, in := r.rooms[netName][room][peerId]
+    for id := range r.rooms[netName][room] {
+        out = append(out, id)
+    }
+    sort.Strings(out)
+    return out, in
+}
+
+func (s *Server) rejectRoom(peerId, code, message string) {
+    s.sendToConn(s.getConn(peerId), outboundMessage{Type: "error", Data: map[string]interface{}{"code": code, "message": message}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+}
+
+// roomNames reads "rooms", or a single "room", from a message and checks
+// each name.
+func (s *Server) roomNames(peerId string, msg inboundMessage) ([]string, bool) {
+    m, _ := msg.Data.(map[string]interface{})
+    rooms := featureList(m["rooms"])
+    if room, ok := m["room"].(string); ok {
+        rooms = append(rooms, room)
+    }
+    if len(rooms) == 0 {
+        s.rejectRoom(peerId, errInvalidRoom, "room required")
+        return nil, false
+    }
+    for _, room := range rooms {
+        if !validNetworkName(room) {
+            s.rejectRoom(peerId, errInvalidRoom, "invalid room name "+room)
+            return nil, false
+        }
+    }
+    return rooms, true
+}
+
+// roomPeer returns the network of an announced, non-hub peer.
+func (s *Server) roomPeer(peerId string) (*peerInfo, bool) {
+    pi := s.getPeerInfo(peerId)
+    if pi == nil || !pi.Announced || pi.IsHub {
+        s.rejectRoom(peerId, errNotAnnounced, "announce before joining rooms")
+        return nil, false
+    }
+    pi.NetworkName = firstNonEmpty(pi.NetworkName, s.opts.DefaultNetwork)
+    return pi, true
+}
+
+func (s *Server) sendSubscribed(peerId, netName string) {
+    s.sendToConn(s.getConn(peerId), outboundMessage{Type: "subscribed", Data: map[string]interface{}{"rooms": s.rooms.roomsOf(peerId)}, FromPeerId: "system", TargetPeer: peerId, NetworkName: netName, Timestamp: nowMs()})
+}
+
+// roomDiscovery is the peer-discovered sent about peerId within room.
+func (s *Server) roomDiscovery(peerId, netName, room, target string) outboundMessage {
+    data := map[string]interface{}{}
+    if pi := s.getPeerInfo(peerId); pi != nil {
+        for k, v := range pi.Data {
+            data[k] = v
+        }
+    }
+    data["peerId"] = peerId
+    data["room"] = room
+    return outboundMessage{Type: "peer-discovered", Data: data, FromPeerId: "system", TargetPeer: target, NetworkName: netName, Timestamp: nowMs()}
+}
+
+func (s *Server) handleSubscribe(peerId string, msg inboundMessage) {
+    pi, ok := s.roomPeer(peerId)
+    if !ok {
+        return
+    }
+    rooms, ok := s.roomNames(peerId, msg)
+    if !ok {
+        return
+    }
+    netName := pi.NetworkName
+    for _, room := range rooms {
+        others, added, ok := s.rooms.join(peerId, netName, room, s.opts.MaxRoomsPerPeer)
+        if !ok {
+            s.rejectRoom(peerId, errRoomLimit, "room limit reached")
+            break
+        }
+        if !added {
+            continue
+        }
+        conn := s.getConn(peerId)
+        for _, id := range others {
+            s.sendToConn(s.getConn(id), s.roomDiscovery(peerId, netName, room, id))
+            s.sendToConn(conn, s.roomDiscovery(id, netName, room, peerId))
+        }
+    }
+    s.sendSubscribed(peerId, netName)
+}
+
+// handleUnsubscribe leaves the given rooms, or every room when none are
+// given.
+func (s *Server) handleUnsubscribe(peerId string, msg inboundMessage) {
+    m, _ := msg.Data.(map[string]interface{})
+    rooms := featureList(m["rooms"])
+    if room, ok := m["room"].(string); ok {
+        rooms = append(rooms, room)
+    }
+    if len(rooms) == 0 {
+        rooms = s.rooms.roomsOf(peerId)
+    }
+    netName := ""
+    for _, room := range rooms {
+        netName = firstNonEmpty(s.leaveRoom(peerId, room, roomUnsubscribed), netName)
+    }
+    s.sendSubscribed(peerId, firstNonEmpty(netName, msg.NetworkName))
+}
+
+// leaveRoom removes peerId from room, telling the remaining members, and
+// returns the room's network.
+func (s *Server) leaveRoom(peerId, room, reason string) string {
+    netName, others, ok := s.rooms.leave(peerId, room)
+    if !ok {
+        return ""
+    }
+    for _, id := range others {
+        s.sendToConn(s.getConn(id), outboundMessage{Type: "room-left", Data: map[string]interface{}{"peerId": peerId, "room": room, "reason": reason}, FromPeerId: "system", TargetPeer: id, NetworkName: netName, Timestamp: nowMs()})
+    }
+    return netName
+}
+
+// forgetRooms takes a departing peer out of all its rooms.
+func (s *Server) forgetRooms(peerId, reason string) {
+    for _, room := range s.rooms.roomsOf(peerId) {
+        s.leaveRoom(peerId, room, reason)
+    }
+}
+
+// handleRoomBroadcast relays a payload to the other members of a room the
+// sender is in, under the app-broadcast size and rate limits.
+func (s *Server) handleRoomBroadcast(peerId string, msg inboundMessage) {
+    pi, ok := s.roomPeer(peerId)
+    if !ok {
+        return
+    }
+    m, _ := msg.Data.(map[string]interface{})
+    room, _ := m["room"].(string)
+    members, in := s.rooms.members(pi.NetworkName, room, peerId)
+    if !in {
+        s.rejectRoom(peerId, errNotInRoom, "not subscribed to room "+room)
+        return
+    }
+    conn := s.getConn(peerId)
+    if b, _ := json.Marshal(m["payload"]); s.opts.AppBroadcastMaxBytes > 0 && len(b) > s.opts.AppBroadcastMaxBytes {
+        s.sendError(conn, peerId, "room-broadcast payload too large")
+        return
+    }
+    if !s.appBroadcasts.allow(peerId, s.appBroadcastRate()) {
+        s.sendError(conn, peerId, "room-broadcast rate limit exceeded")
+        s.penalize(peerId, offenceRateLimit, "room-broadcast")
+        return
+    }
+    messageId := newMessageId()
+    for _, id := range members {
+        if id == peerId {
+            continue
+        }
+        s.sendToConn(s.getConn(id), outboundMessage{Type: "room-broadcast", Data: map[string]interface{}{"room": room, "payload": m["payload"]}, FromPeerId: peerId, TargetPeer: id, NetworkName: pi.NetworkName, MessageId: messageId, Timestamp: nowMs()})
+    }
+    s.rooms.mu.Lock()
+    s.rooms.broadcasts++
+    s.rooms.mu.Unlock()
+}
+
+// handleRoomMembers answers with the members of a room in the peer's
+// network.
+func (s *Server) handleRoomMembers(peerId string, msg inboundMessage) {
+    pi, ok := s.roomPeer(peerId)
+    if !ok {
+        return
+    }
+    m, _ := msg.Data.(map[string]interface{})
+    room, _ := m["room"].(string)
+    if !validNetworkName(room) {
+        s.rejectRoom(peerId, errInvalidRoom, "invalid room name "+room)
+        return
+    }
+    members, _ := s.rooms.members(pi.NetworkName, room, peerId)
+    s.sendToConn(s.getConn(peerId), outboundMessage{Type: "room-members", Data: map[string]interface{}{"room": room, "members": members, "queryId": m["queryId"]}, FromPeerId: "system", TargetPeer: peerId, NetworkName: pi.NetworkName, Timestamp: nowMs()})
+}
+
+// roomSnapshot reports member counts per room and network for /stats.
+func (s *Server) roomSnapshot() map[string]interface{} {
+    r := s.rooms
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    total := 0
+    networks := map[string]map[string]int{}
+    for netName, rooms := range r.rooms {
+        counts := map[string]int{}
+        for room, members := range rooms {
+            counts[room] = len(members)
+        }
+        total += len(rooms)
+        networks[netName] = counts
+    }
+    return map[string]interface{}{"rooms": total, "members": len(r.joined), "broadcasts": r.broadcasts, "networks": networks}
+}
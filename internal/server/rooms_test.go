@@ -0,0 +1,74 @@
+package server
+
+import (
+    "encoding/json"
+    "testing"
+    "time"
+)
+
+func TestRoomsScopeDiscoveryAndBroadcast(t *testing.T) {
+    s := NewServer(Options{MaxRoomsPerPeer: 2, AppBroadcastRatePerSec: 100})
+    a, b, c := randomPeerId(), randomPeerId(), randomPeerId()
+    conns := map[string]*pollConn{}
+    for _, id := range []string{a, b, c} {
+        conns[id] = attachTestPeer(t, s, id)
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"game","data":{}}`))
+    }
+    received := func(id string) []outboundMessage {
+        msgs, _ := conns[id].take(20 * time.Millisecond)
+        var out []outboundMessage
+        for _, raw := range msgs {
+            var m outboundMessage
+            json.Unmarshal(raw, &m)
+            if m.Type != "peer-discovered" || m.Data.(map[string]interface{})["room"] != nil {
+                out = append(out, m)
+            }
+        }
+        return out
+    }
+    for _, id := range []string{a, b, c} {
+        received(id)
+    }
+
+    s.handleMessage(a, []byte(`{"type":"subscribe","data":{"rooms":["lobby"]}}`))
+    s.handleMessage(b, []byte(`{"type":"subscribe","data":{"rooms":["lobby","match-1"]}}`))
+    if got := received(a); len(got) != 2 || got[0].Type != "subscribed" || got[1].Type != "peer-discovered" || got[1].Data.(map[string]interface{})["peerId"] != b {
+        t.Fatalf("a should hear b join the lobby, got %+v", got)
+    }
+    if got := received(b); len(got) != 2 || got[0].Data.(map[string]interface{})["peerId"] != a || got[1].Data.(map[string]interface{})["rooms"].([]interface{})[1] != "match-1" {
+        t.Fatalf("b should discover a and be in two rooms, got %+v", got)
+    }
+    s.handleMessage(b, []byte(`{"type":"subscribe","data":{"room":"third"}}`))
+    if got := received(b); len(got) != 2 || got[0].Data.(map[string]interface{})["code"] != errRoomLimit {
+        t.Fatalf("a third room should be refused, got %+v", got)
+    }
+
+    s.handleMessage(a, []byte(`{"type":"room-broadcast","data":{"room":"lobby","payload":{"text":"hi"}}}`))
+    if got := received(b); len(got) != 1 || got[0].Type != "room-broadcast" || got[0].FromPeerId != a {
+        t.Fatalf("b should get the lobby broadcast, got %+v", got)
+    }
+    if got := received(c); len(got) != 0 {
+        t.Fatalf("c is in no room and should hear nothing, got %+v", got)
+    }
+    s.handleMessage(c, []byte(`{"type":"room-broadcast","data":{"room":"lobby","payload":{}}}`))
+    if got := received(c); len(got) != 1 || got[0].Data.(map[string]interface{})["code"] != errNotInRoom {
+        t.Fatalf("a non-member broadcast should be refused, got %+v", got)
+    }
+
+    s.handleMessage(c, []byte(`{"type":"room-members","data":{"room":"lobby"}}`))
+    if got := received(c); len(got) != 1 || len(got[0].Data.(map[string]interface{})["members"].([]interface{})) != 2 {
+        t.Fatalf("room-members should list a and b, got %+v", got)
+    }
+    rooms := s.roomSnapshot()
+    if rooms["rooms"] != 2 || rooms["networks"].(map[string]map[string]int)["game"]["lobby"] != 2 {
+        t.Fatalf("unexpected room stats: %v", rooms)
+    }
+
+    s.handleDisconnect(b, reasonClientGoodbye, "")
+    if got := received(a); len(got) != 2 || got[1].Type != "room-left" || got[1].Data.(map[string]interface{})["reason"] != roomDisconnected {
+        t.Fatalf("a should see b leave the lobby, got %+v", got)
+    }
+    if rooms := s.roomSnapshot(); rooms["rooms"] != 1 || rooms["members"] != 1 {
+        t.Fatalf("b's rooms should be gone, got %v", rooms)
+    }
+}
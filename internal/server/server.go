@@ -2,13 +2,13 @@ package server
 
 import (
     "encoding/json"
-    "log"
     "net"
     "net/http"
     "os"
     "sort"
     "strings"
     "sync"
+    "sync/atomic"
     "time"
     "github.com/gin-gonic/gin"
     "github.com/gorilla/websocket"
@@ -21,7 +21,7 @@ type Server struct {
     startTime int64
     upgrader websocket.Upgrader
     engine *gin.Engine
-    wsConns map[string]*websocket.Conn
+    wsConns map[string]peerConn
     wsMu sync.Mutex
     peerData map[string]*peerInfo
     peersMu sync.Mutex
@@ -36,34 +36,309 @@ type Server struct {
     bootstrapConns map[string]*bootstrapConn
     bootstrapMu sync.Mutex
     crossHubCache map[string]map[string]map[string]interface{}
+    identities *identityStore
+    envelopes *signedEnvelopes
+    admission *admissionController
+    adminMu sync.Mutex
+    authToken string
+    maintenance bool
+    auditLog []auditEntry
+    auditSeq int64
+    drain *drainState
+    goroutines *goroutineTracker
+    blobs *blobRelay
+    panics int64
+    appBroadcasts *appBroadcastLimiter
+    peerMessages *appBroadcastLimiter
+    peerReceipts *appBroadcastLimiter
+    events *eventLog
+    pollSessions map[string]*pollConn
+    pollMu sync.Mutex
+    signaling *signalingTracker
+    erasures []*eraseReport
+    pacer *discoveryPacer
+    integrations *integrationRegistry
+    meshStats *meshStats
+    hubQuotas *hubQuotas
+    log Logger
+    metrics MetricsRecorder
+    paths map[string]*pathStats
+    churn *churnTracker
+    gossipDelta *gossipDelta
+    signalDeadlines *signalDeadlines
+    spoofMu sync.Mutex
+    spoofAttempts map[string]int64
+    listener net.Listener
+    changes *changeFeed
+    tail *logTail
+    networkCapRejects int64
+    peerCapRejects int64
+    debouncer *disconnectDebouncer
+    shedder *loadShedder
+    reputation *reputationTracker
+    compaction *storeCompaction
+    hubKeys *hubKeyring
+    monitors *monitorRegistry
+    guests *guestRegistry
+    ports *portHistory
+    signalRoutes *signalRoutes
+    transforms *transformRegistry
+    writes *writeStats
+    peerIds *peerIdPolicy
+    journal *pollJournal
+    pow *powStats
+    restored *restoredState
+    rooms *roomRegistry
+    connDebug *connDebug
+    analytics *analyticsHistory
+    keepalive *keepaliveStats
+    hubApprovals *hubApprovals
+    localIndex *peerIndex
+    remoteIndex *peerIndex
+    ice *iceStats
+    jwt *jwtAuth
+    faults *faultInjector
+    guard *guardrails
+    acl *networkACL
+    live *liveConfig
+    members *meshMembership
+    bridge *eventBridge
+    meshDedup *meshDedup
+    binary *binaryStats
+    meshEncoding *meshEncodingStats
+    grpc *grpcTransport
+    watches *watchRegistry
+    listeners *listenerSet
+    presence *presenceStats
+    presenceMeta *presenceMetaStats
+    discoveryFilter *discoveryFilterStats
+    fanout *fanoutPool
+    backplane *backplane
+    // announceFault, when set by a test, fails an announce after the named
+    // commit step so the rollback can be exercised.
+    announceFault func(step string) error
 }
 
 func NewServer(o Options) *Server {
-    s := &Server{opts: o, port: o.Port}
-    s.wsConns = map[string]*websocket.Conn{}
+    o = o.withDefaults()
+    s := &Server{opts: o, port: o.Port, authToken: o.AuthToken, log: o.Logger, metrics: o.Metrics}
+    s.wsConns = map[string]peerConn{}
     s.peerData = map[string]*peerInfo{}
     s.networkPeers = map[string]map[string]struct{}{}
     s.hubs = map[string]*hubInfo{}
     s.relayed = map[string]int64{}
+    s.envelopes = newSignedEnvelopes()
     s.bootstrapConns = map[string]*bootstrapConn{}
     s.crossHubCache = map[string]map[string]map[string]interface{}{}
+    s.pollSessions = map[string]*pollConn{}
+    s.goroutines = newGoroutineTracker()
+    s.blobs = newBlobRelay()
+    s.appBroadcasts = newAppBroadcastLimiter()
+    s.peerMessages = newAppBroadcastLimiter()
+    s.peerReceipts = newAppBroadcastLimiter()
+    s.events = newEventLog(o.EventReplaySize)
+    s.signaling = newSignalingTracker()
+    s.pacer = newDiscoveryPacer(o.CrossHubDiscoveryRatePerSec)
+    s.integrations = newIntegrationRegistry(o.Store, o.IntegrationsStorePath)
+    s.meshStats = newMeshStats()
+    s.paths = newPathStats()
+    s.churn = newChurnTracker()
+    s.gossipDelta = newGossipDelta()
+    s.signalDeadlines = newSignalDeadlines()
+    s.spoofAttempts = map[string]int64{}
+    s.changes = newChangeFeed(o.ChangeFeedSize)
+    s.tail = newLogTail()
+    s.debouncer = newDisconnectDebouncer()
+    s.shedder = newLoadShedder()
+    s.reputation = newReputationTracker(o.Store, o.ReputationStorePath)
+    s.compaction = &storeCompaction{}
+    s.monitors = newMonitorRegistry()
+    s.guests = newGuestRegistry()
+    s.ports = &portHistory{}
+    s.signalRoutes = newSignalRoutes()
+    s.transforms = newTransformRegistry(o.Store, o.TransformsStorePath, o.MessageTransforms)
+    s.writes = &writeStats{}
+    s.keepalive = &keepaliveStats{}
+    s.hubApprovals = newHubApprovals(o.Store, o.HubApprovalStorePath)
+    s.localIndex = newPeerIndex()
+    s.remoteIndex = newPeerIndex()
+    s.ice = &iceStats{}
+    s.jwt = newJWTAuth(o)
+    s.faults = newFaultInjector(o.Faults)
+    s.guard = &guardrails{}
+    s.acl = newNetworkACL()
+    s.live = newLiveConfig(s.opts)
+    s.members = newMeshMembership()
+    s.meshDedup = &meshDedup{}
+    s.binary = &binaryStats{}
+    s.meshEncoding = &meshEncodingStats{}
+    s.grpc = &grpcTransport{}
+    s.listeners = newListenerSet()
+    s.presence = &presenceStats{}
+    s.presenceMeta = &presenceMetaStats{}
+    s.discoveryFilter = &discoveryFilterStats{}
+    s.fanout = newFanoutPool()
+    s.rooms = newRoomRegistry()
+    s.watches = newWatchRegistry()
+    s.connDebug = newConnDebug()
+    s.analytics = newAnalyticsHistory()
+    s.log = tailLogger{next: o.Logger, tail: s.tail}
+    s.peerIds = s.newPeerIdPolicy()
+    s.pow = newPowStats()
+    if o.PollJournalPath != "" {
+        s.journal = s.newPollJournal()
+    }
+    s.hubKeys = s.newHubKeyring()
+    s.hubQuotas = newHubQuotas(o.HubGossipQuotaPerSec, o.HubSignalingQuotaPerSec, o.HubQuotaSuspendMs)
     s.upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
-    if s.opts.IsHub {
+    s.admission = newAdmissionController(s.opts.MaxUpgradesPerSec)
+    if s.opts.IdentityStorePath != "" {
+        s.identities = newIdentityStore(o.Store, o.IdentityStorePath)
+    }
+    if s.hubKeys.priv != nil {
+        s.hubPeerId = s.hubKeys.hubId()
+    } else if s.opts.IsHub {
         s.hubPeerId = s.generatePeerId()
     }
+    if o.EventBridgeURL != "" {
+        if b, err := newEventBridge(o, s.hubPeerId); err != nil {
+            s.log.Error("event_bridge_invalid", map[string]interface{}{"error": err.Error()})
+        } else {
+            s.bridge = b
+            s.opts.ChangeSinks = append(s.opts.ChangeSinks[:len(s.opts.ChangeSinks):len(s.opts.ChangeSinks)], b)
+        }
+    }
+    if o.BackplaneURL != "" {
+        if b, err := newBackplane(s, o); err != nil {
+            s.log.Error("backplane_invalid", map[string]interface{}{"error": err.Error()})
+        } else {
+            s.backplane = b
+            s.opts.ChangeSinks = append(s.opts.ChangeSinks[:len(s.opts.ChangeSinks):len(s.opts.ChangeSinks)], b)
+        }
+    }
+    s.restoreCounters()
+    s.restoreState()
+    s.restoreAnalytics()
     return s
 }
 
+// Start binds a port (see listen) and serves on it. A bind failure is
+// returned as a *PortError.
 func (s *Server) Start() error {
-    p, err := s.tryPort(s.port, s.opts.MaxPortRetries)
+    ln, err := s.listen(s.port, s.opts.MaxPortRetries)
     if err != nil {
         return err
     }
-    s.port = p
+    return s.Serve(ln)
+}
+
+// Serve runs the hub on an existing listener, which lets embedders and
+// tests pick the address (e.g. 127.0.0.1:0) before the hub starts. It blocks
+// until the listener is closed.
+func (s *Server) Serve(ln net.Listener) error {
+    if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+        s.port = addr.Port
+    }
+    s.listener = ln
+    s.routes()
+    for _, l := range s.opts.Listeners {
+        if err := s.addListener(l, listenerSourceConfig, ""); err != nil {
+            s.closeListeners()
+            ln.Close()
+            return err
+        }
+    }
+    if s.opts.GRPCAddr != "" {
+        creds, err := s.grpcCredentials()
+        if err != nil {
+            s.closeListeners()
+            ln.Close()
+            return err
+        }
+        gl, err := net.Listen("tcp", s.opts.GRPCAddr)
+        if err != nil {
+            s.closeListeners()
+            ln.Close()
+            return err
+        }
+        s.startGRPC(gl, creds)
+    }
+    s.running = true
+    s.startTime = nowMs()
+    if s.opts.AllowUnauthenticatedMesh && s.meshToken() == "" {
+        s.log.Warn("unauthenticated_mesh", map[string]interface{}{"message": "any connection announcing itself as a hub is trusted as one; set MESH_TOKEN"})
+    }
+    s.cleanupTicker = time.NewTicker(time.Duration(s.opts.CleanupIntervalMs) * time.Millisecond)
+    s.spawn("cleanup", "server", func() {
+        for range s.cleanupTicker.C {
+            func() {
+                defer s.recoverPanic("cleanup", "server")
+                s.performCleanup()
+            }()
+        }
+    })
+    if s.opts.SignalingTimeoutMs > 0 {
+        s.spawn("signaling-sweeper", "server", s.runSignalingSweeper)
+    }
+    if s.opts.SignalDeadlineMs > 0 {
+        s.spawn("signal-deadlines", "server", s.runSignalDeadlines)
+    }
+    if s.opts.PeerIdleMs > 0 {
+        s.spawn("idle-sweeper", "server", s.runIdleSweeper)
+    }
+    if s.opts.MetricsStorePath != "" && s.opts.MetricsPersistIntervalMs > 0 {
+        s.spawn("metrics-persist", "server", s.runCounterPersistence)
+    }
+    if s.opts.StateStorePath != "" && s.opts.StatePersistIntervalMs > 0 {
+        s.spawn("state-persist", "server", s.runStatePersistence)
+    }
+    if s.opts.CrossHubDiscoveryRatePerSec > 0 {
+        s.spawn("discovery-pacer", "server", s.runDiscoveryPacer)
+    }
+    if s.opts.IsHub {
+        s.spawn("mesh-stats", "server", s.runMeshStatsGossip)
+    }
+    if s.opts.ShedCPUPercent > 0 || s.opts.ShedQueueDepth > 0 {
+        s.spawn("load-shedder", "server", s.runLoadShedder)
+    }
+    if s.guardrailsEnabled() {
+        s.spawn("guardrails", "server", s.runGuardrails)
+    }
+    if s.opts.StoreCompactIntervalMs > 0 {
+        s.spawn("store-compaction", "server", s.runStoreCompaction)
+    }
+    if len(s.opts.ChangeSinks) > 0 {
+        s.spawn("change-sinks", "server", s.runChangeSinks)
+    }
+    if s.bridge != nil {
+        s.spawn("event-bridge", "server", s.bridge.run)
+    }
+    if s.backplane != nil {
+        s.startBackplane()
+    }
+    s.spawn("bootstrap-dial", "server", func() {
+        if s.opts.IsHub && len(s.opts.BootstrapHubs) > 0 {
+            time.Sleep(1 * time.Second)
+            s.connectToBootstrapHubs()
+        }
+    })
+    return http.Serve(ln, s.engine)
+}
+
+// Port returns the port the hub listens on.
+func (s *Server) Port() int { return s.port }
+
+// routes builds the gin engine with every HTTP and WebSocket endpoint.
+func (s *Server) routes() {
     s.engine = gin.New()
     s.engine.Use(gin.Recovery())
     s.engine.GET("/health", func(c *gin.Context) {
-        writeJSON(c.Writer, 200, map[string]interface{}{"status": "healthy", "timestamp": time.Now().Format(time.RFC3339), "uptime": s.uptime(), "isHub": s.opts.IsHub, "connections": s.connectionsSize(), "peers": len(s.peerData), "hubs": len(s.hubs), "networks": len(s.networkPeers)}, s.opts.CORSOrigin)
+        status, tripped := s.healthStatus()
+        health := map[string]interface{}{"status": status, "timestamp": time.Now().Format(time.RFC3339), "uptime": s.uptime(), "isHub": s.opts.IsHub, "protocolVersion": ProtocolVersion, "version": Version, "role": s.role(), "features": s.features(), "hubMeshNamespace": s.opts.HubMeshNamespace, "connections": s.connectionsSize(), "maxConnections": s.maxConnections(), "peers": len(s.peerData), "hubs": len(s.hubs), "networks": len(s.networkPeers), "maintenance": s.inMaintenance(), "degraded": s.degraded()}
+        if tripped != nil {
+            health["guardrails"] = tripped
+        }
+        writeJSON(c.Writer, 200, health, s.opts.CORSOrigin)
     })
     s.engine.GET("/hubs", func(c *gin.Context) {
         writeJSON(c.Writer, 200, map[string]interface{}{"timestamp": time.Now().Format(time.RFC3339), "totalHubs": len(s.hubs), "hubs": s.getConnectedHubs()}, s.opts.CORSOrigin)
@@ -74,231 +349,619 @@ func (s *Server) Start() error {
     s.engine.GET("/hubstats", func(c *gin.Context) {
         writeJSON(c.Writer, 200, s.getHubStats(), s.opts.CORSOrigin)
     })
-    s.engine.GET("/metrics", func(c *gin.Context) {
-        writeJSON(c.Writer, 200, s.getMetrics(), s.opts.CORSOrigin)
-    })
+    s.engine.GET("/meshstats", s.handleMeshStats)
+    s.engine.GET("/metrics", s.handleMetrics)
+    s.engine.GET("/pow/challenge", s.handlePowChallenge)
+    s.registerAdminRoutes()
+    s.registerPollRoutes()
+    s.engine.GET("/mesh", s.handleMeshWS)
     s.engine.GET("/ws", s.handleWS)
     s.engine.GET("/", s.handleWS)
-    go func() {
-        s.running = true
-        s.startTime = nowMs()
-        s.cleanupTicker = time.NewTicker(time.Duration(s.opts.CleanupIntervalMs) * time.Millisecond)
-        for range s.cleanupTicker.C {
-            s.performCleanup()
-        }
-    }()
-    go func() {
-        if s.opts.IsHub && len(s.opts.BootstrapHubs) > 0 {
-            time.Sleep(1 * time.Second)
-            s.connectToBootstrapHubs()
-        }
-    }()
-    addr := s.opts.Host + ":" + itoa(s.port)
-    return s.engine.Run(addr)
 }
 
 func (s *Server) Stop() error {
+    if s.opts.IsHub && s.running {
+        s.announceMeshLeave()
+    }
     s.running = false
+    s.saveState()
+    s.wsMu.Lock()
+    ids := make([]string, 0, len(s.wsConns))
+    for id := range s.wsConns {
+        ids = append(ids, id)
+    }
+    s.wsMu.Unlock()
+    for _, id := range ids {
+        if conn := s.getConn(id); conn != nil {
+            s.handleDisconnect(id, reasonHubShutdown, "")
+            closeWithReason(conn, websocket.CloseGoingAway, reasonHubShutdown)
+        }
+    }
+    s.stopGRPC()
+    s.flushDisconnects()
+    s.sampleAnalytics(nowMs())
+    s.saveAnalytics()
     if s.cleanupTicker != nil {
         s.cleanupTicker.Stop()
     }
     s.disconnectBootstrap()
+    if s.bridge != nil {
+        s.bridge.close()
+    }
+    if s.backplane != nil {
+        s.backplane.close()
+    }
+    s.saveCounters()
+    s.closeListeners()
+    if s.listener != nil {
+        s.listener.Close()
+    }
+    s.stopFanout()
     return nil
 }
 
-func (s *Server) tryPort(port, maxRetries int) (int, error) {
-    for i := 0; i <= maxRetries; i++ {
-        p := port + i
-        ln, err := net.Listen("tcp", s.opts.Host+":"+itoa(p))
-        if err == nil {
-            ln.Close()
-            return p, nil
-        }
+func (s *Server) handleWS(c *gin.Context) {
+    r := httpConnRequest(c)
+    peerId := r.Query("peerId")
+    if !s.admitPeer(r, peerId) {
+        s.writeRefusal(c.Writer, r.refusal)
+        return
     }
-    return 0, http.ErrServerClosed
+    s.acceptWS(c, r, peerId)
 }
 
-func (s *Server) handleWS(c *gin.Context) {
-    peerId := c.Query("peerId")
-    if s.opts.AuthToken != "" {
-        auth := c.GetHeader("Authorization")
-        if !strings.HasPrefix(auth, "Bearer ") || strings.TrimPrefix(auth, "Bearer ") != s.opts.AuthToken {
-            token := c.Query("token")
-            if token != s.opts.AuthToken {
-                http.Error(c.Writer, "unauthorized", http.StatusUnauthorized)
-                return
-            }
-        }
+// acceptWS upgrades an admitted request and starts the peer's reader.
+func (s *Server) acceptWS(c *gin.Context, r *connRequest, peerId string) {
+    upgrader := s.upgrader
+    if r.path == pathMesh {
+        // Hub links may negotiate permessage-deflate; client links never do.
+        upgrader.EnableCompression = s.opts.MeshCompression
     }
-    if !validatePeerId(peerId) {
-        http.Error(c.Writer, "invalid peerId", http.StatusForbidden)
-        return
+    binary, subprotocol := s.negotiateBinary(c)
+    var header http.Header
+    if subprotocol != "" {
+        header = http.Header{"Sec-WebSocket-Protocol": {subprotocol}}
     }
-    conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
+    conn, err := upgrader.Upgrade(c.Writer, c.Request, header)
     if err != nil {
         return
     }
-    s.wsMu.Lock()
-    if _, ok := s.wsConns[peerId]; ok {
-        old := s.wsConns[peerId]
-        if old != nil {
-            old.Close()
+    if !s.verifyPeerOwnership(peerId, conn) {
+        conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "ownership proof failed"), time.Now().Add(time.Second))
+        conn.Close()
+        return
+    }
+    pc := s.newWSPeerConn(conn, "conn-writer", peerId)
+    pc.legacy = s.negotiateProtocol(c) == legacyProtocolVersion
+    if binary && !pc.legacy {
+        pc.binary = 1
+        atomic.AddInt64(&s.binary.conns, 1)
+    }
+    if r.path == pathMesh {
+        pc.hub = 1
+    }
+    if !s.registerConn(r, peerId, pc) {
+        return
+    }
+    s.spawn("conn-reader", peerId, func() { s.readLoop(peerId, pc) })
+}
+
+// admitPeer runs the checks shared by every transport before a peer may
+// connect, recording the refusal on r when it may not.
+func (s *Server) admitPeer(r *connRequest, peerId string) bool {
+    // A guest link stands in for the AuthToken.
+    guest := r.Query("guestToken") != ""
+    if guest && !s.admitGuest(r, peerId) {
+        return false
+    }
+    if s.jwtEnabled() && !guest {
+        if !s.admitJWT(r, peerId) {
+            return false
+        }
+    } else if authToken := s.currentAuthToken(); authToken != "" && !guest {
+        auth := r.GetHeader("Authorization")
+        if !strings.HasPrefix(auth, "Bearer ") || strings.TrimPrefix(auth, "Bearer ") != authToken {
+            token := r.Query("token")
+            if token != authToken {
+                r.refuse(http.StatusUnauthorized, "unauthorized")
+                return false
+            }
+        }
+    }
+    if !s.validPeerId(peerId) {
+        r.refuse(http.StatusForbidden, "invalid peerId")
+        return false
+    }
+    if s.isBanned(peerId) || s.isIPBanned(r.ClientIP()) {
+        r.refuse(http.StatusForbidden, "banned")
+        return false
+    }
+    if s.inMaintenance() {
+        r.refuseJSON(http.StatusServiceUnavailable, map[string]interface{}{"error": "hub in maintenance"}, 0)
+        return false
+    }
+    if s.refusePressure(r) {
+        return false
+    }
+    if reason := s.checkPow(r.Query("pow"), r.Query("powNonce"), peerId); reason != "" {
+        r.refuseJSON(http.StatusForbidden, map[string]interface{}{"error": reason, "difficulty": s.opts.PowDifficulty, "challengeUrl": "/pow/challenge"}, 0)
+        return false
+    }
+    // Peers handed off by a draining hub skip admission control.
+    if !s.validMigrationToken(r.Query("migrationToken"), peerId) {
+        if ok, retry := s.admission.admit(); !ok {
+            r.refuseJSON(http.StatusServiceUnavailable, map[string]interface{}{"error": "reconnect storm, retry later", "retryAfterMs": retry.Milliseconds()}, retry)
+            return false
         }
-        delete(s.wsConns, peerId)
     }
-    if len(s.wsConns) >= s.opts.MaxConnections {
+    return true
+}
+
+// registerConn records an accepted connection for peerId and greets it.
+func (s *Server) registerConn(r *connRequest, peerId string, conn peerConn) bool {
+    path := r.path
+    if hasFeature(queryFeatures(r.Query("features")), featureCompression) {
+        markGzip(conn)
+    }
+    // wsConns and peerData are written together so a concurrent replacement
+    // or cleanup never sees one without the other.
+    for {
+        if old := s.getConn(peerId); old != nil {
+            s.handleDisconnect(peerId, reasonReplaced, "")
+            closeWithReason(old, websocket.ClosePolicyViolation, reasonReplaced)
+        }
+        s.wsMu.Lock()
+        if s.wsConns[peerId] != nil {
+            s.wsMu.Unlock()
+            continue
+        }
+        if s.atPathLimit(path) {
+            s.wsMu.Unlock()
+            atomic.AddInt64(&s.paths[path].rejected, 1)
+            conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "max connections"), time.Now().Add(time.Second))
+            conn.Close()
+            return false
+        }
+        s.wsConns[peerId] = conn
+        s.peersMu.Lock()
+        s.peerData[peerId] = &peerInfo{PeerId: peerId, ConnectedAt: nowMs(), LastActivity: nowMs(), RemoteAddress: r.ClientIP(), Connected: true, ClientVersion: r.Query("clientVersion"), ProtocolVersion: connProtocol(conn), UserAgent: r.GetHeader("User-Agent"), Path: path, IsHub: s.hubLinkRequest(r), Monitor: s.opts.MonitorToken != "" && r.Query("monitorToken") == s.opts.MonitorToken}
+        s.peersMu.Unlock()
+        atomic.AddInt64(&s.paths[path].active, 1)
         s.wsMu.Unlock()
-        conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "max connections"), time.Now().Add(time.Second))
-        conn.Close()
-        return
+        break
     }
-    s.wsConns[peerId] = conn
-    s.wsMu.Unlock()
-    s.peersMu.Lock()
-    s.peerData[peerId] = &peerInfo{PeerId: peerId, ConnectedAt: nowMs(), LastActivity: nowMs(), RemoteAddress: c.ClientIP(), Connected: true}
-    s.peersMu.Unlock()
-    s.sendToConn(conn, outboundMessage{Type: "connected", Data: map[string]interface{}{"peerId": peerId}, FromPeerId: "system", NetworkName: "global", Timestamp: nowMs()})
-    go s.readLoop(peerId, conn)
+    atomic.AddInt64(&s.paths[path].opened, 1)
+    s.attachGuest(r, peerId)
+    s.attachJWT(r, peerId)
+    s.attachACL(r, peerId)
+    s.metrics.ConnectionOpened()
+    s.emitEvent("peer_connected", func() map[string]interface{} {
+        return map[string]interface{}{"peerId": peerId, "path": path, "remoteAddress": r.ClientIP(), "clientVersion": r.Query("clientVersion")}
+    })
+    greeting := map[string]interface{}{"peerId": peerId, "hubVersion": Version, "protocolVersion": ProtocolVersion, "features": s.features(), "hubPeerId": s.hubPeerId}
+    if key := s.hubKeys.publicKey(); key != "" {
+        greeting["hubKey"] = key
+    }
+    if path != pathMesh {
+        if servers, expiresAt := s.iceServersFor(peerId); servers != nil {
+            greeting["iceServers"] = servers
+            if expiresAt > 0 {
+                greeting["iceServersExpireAt"] = expiresAt
+            }
+        }
+    }
+    s.sendToConn(conn, s.signMesh(outboundMessage{Type: "connected", Data: greeting, FromPeerId: "system", NetworkName: "global", Timestamp: nowMs()}, s.clientThreshold(conn)))
+    s.replayJournal(peerId, conn)
+    return true
 }
 
-func (s *Server) readLoop(peerId string, conn *websocket.Conn) {
+func (s *Server) readLoop(peerId string, conn *wsPeerConn) {
+    defer conn.Close()
+    log := s.connLog(peerId)
     for {
-        _, data, err := conn.ReadMessage()
+        messageType, data, err := conn.ReadMessage()
         if err != nil {
-            s.handleDisconnect(peerId, websocket.CloseAbnormalClosure, err.Error())
+            // A reconnect under the same peerId replaces this conn; leave
+            // the new connection's state alone.
+            if s.getConn(peerId) == peerConn(conn) {
+                reason := readErrorReason(err)
+                if conn.isSlow() {
+                    reason = reasonSlowConsumer
+                } else if conn.isStale() {
+                    reason = reasonPingTimeout
+                }
+                log.Debug("conn_read_closed", map[string]interface{}{"reason": reason, "error": err.Error()})
+                s.handleDisconnect(peerId, reason, err.Error())
+            }
+            return
+        }
+        conn.touch()
+        if s.getConn(peerId) != peerConn(conn) {
+            log.Debug("conn_superseded", nil)
+            conn.Close()
             return
         }
+        data, ok := s.readFrame(conn, messageType, data)
+        if !ok {
+            s.metrics.MessageFailed()
+            s.penalize(peerId, offenceProtocol, "malformed MessagePack")
+            continue
+        }
         s.handleMessage(peerId, data)
     }
 }
 
 func (s *Server) handleMessage(peerId string, data []byte) {
+    atomic.AddInt64(&s.shedder.inflight, 1)
+    defer atomic.AddInt64(&s.shedder.inflight, -1)
     var msg inboundMessage
+    log := s.connLog(peerId)
     if err := json.Unmarshal(data, &msg); err != nil {
+        s.metrics.MessageFailed()
+        log.Debug("message_malformed", map[string]interface{}{"bytes": len(data), "error": err.Error()})
+        s.penalize(peerId, offenceProtocol, "malformed JSON")
         return
     }
+    if log.debugging() {
+        log.Debug("message_received", map[string]interface{}{"type": msg.Type, "targetPeerId": msg.TargetPeer, "bytes": len(data)})
+    }
+    if isLegacyConn(s.getConn(peerId)) {
+        fromLegacyEnvelope(&msg)
+    }
+    if msg.Encoding != encodingDelta {
+        d, err := decompressData(msg.Data, msg.Encoding)
+        if err != nil {
+            s.metrics.MessageFailed()
+            s.penalize(peerId, offenceProtocol, "undecodable payload")
+            return
+        }
+        msg.Data = d
+    }
+    s.metrics.MessageProcessed()
+    fromHub := false
+    var resumed func()
     s.peersMu.Lock()
     if pi, ok := s.peerData[peerId]; ok {
-        pi.LastActivity = nowMs()
+        resumed = s.markActive(pi, msg.Type)
+        fromHub = pi.IsHub
+        if st := s.paths[pi.Path]; st != nil {
+            atomic.AddInt64(&st.messages, 1)
+        }
     }
     s.peersMu.Unlock()
-    resp := outboundMessage{Type: msg.Type, Data: msg.Data, FromPeerId: firstNonEmpty(msg.FromPeerId, peerId), TargetPeer: msg.TargetPeer, NetworkName: firstNonEmpty(msg.NetworkName, "global"), Timestamp: nowMs()}
+    if resumed != nil {
+        resumed()
+    }
+    if (fromHub || s.isHubAnnounce(msg)) && !s.verifyHubLink(peerId, data, msg) {
+        return
+    }
+    if !fromHub && s.isHubAnnounce(msg) {
+        s.trustPinnedHub(peerId)
+        s.trustUnauthenticatedHub(peerId)
+    }
+    if fromHub && (!s.admitFromHub(peerId, msg.Type) || s.holdPendingHub(peerId, msg.Type)) {
+        return
+    }
+    if !fromHub && !s.allowFromPeer(peerId, msg.Type) {
+        return
+    }
+    if !fromHub && msg.NetworkName == "" {
+        msg.NetworkName = s.guestNetwork(peerId)
+    }
+    netName, ok := s.resolveNetwork(msg.NetworkName)
+    if !ok {
+        if !fromHub {
+            s.sendError(s.getConn(peerId), peerId, "invalid or unpermitted networkName")
+            s.penalize(peerId, offenceProtocol, "invalid networkName")
+        }
+        return
+    }
+    msg.NetworkName = netName
+    if !fromHub && !s.allowGuest(peerId, msg) {
+        return
+    }
+    if !fromHub && routedTypes[msg.Type] && !s.jwtAllowsNetwork(peerId, msg.NetworkName) {
+        s.sendError(s.getConn(peerId), peerId, msg.Type+" not authorized for network "+msg.NetworkName)
+        return
+    }
+    if !fromHub && routedTypes[msg.Type] {
+        if reason := s.checkNetworkACL(peerId, msg.NetworkName, false); reason != "" {
+            s.rejectACL(peerId, msg.NetworkName, reason)
+            return
+        }
+    }
+    if (msg.Encoding == encodingDelta && !fromHub) || (fromHub && !s.expandMeshGossip(peerId, s.getConn(peerId), &msg)) {
+        return
+    }
+    // Hubs relay other peers' messages; clients may only speak for
+    // themselves.
+    if !fromHub && !s.checkSender(peerId, data, msg) {
+        return
+    }
+    if !fromHub {
+        s.applyTransforms(&msg)
+    }
+    resp := outboundMessage{Type: msg.Type, Data: msg.Data, FromPeerId: firstNonEmpty(msg.FromPeerId, peerId), TargetPeer: msg.TargetPeer, NetworkName: firstNonEmpty(msg.NetworkName, s.opts.DefaultNetwork), Timestamp: nowMs()}
     switch msg.Type {
     case "announce":
         s.handleAnnounce(peerId, msg, resp)
     case "goodbye":
-        s.broadcastToOthers(peerId, resp)
+        pi := s.getPeerInfo(peerId)
+        hidden := pi != nil && hiddenPeer(pi.Data)
+        if !hidden {
+            s.broadcastToOthers(peerId, resp)
+        }
+        if pi != nil && pi.Announced {
+            netName := firstNonEmpty(pi.NetworkName, s.opts.DefaultNetwork)
+            if !hidden {
+                s.recordEvent(netName, "peer-disconnected", peerId, map[string]interface{}{"reason": reasonClientGoodbye})
+            }
+            s.notifyIntegrations(integrationWebhook, netName, "peer-disconnected", map[string]interface{}{"peerId": peerId, "reason": reasonClientGoodbye})
+            if !pi.IsHub {
+                s.announceDisconnectToMesh(peerId, netName, reasonClientGoodbye)
+                s.changes.publish(changeRemoved, netName, peerId, nil, reasonClientGoodbye)
+            }
+        }
         s.cleanupPeer(peerId)
     case "offer", "answer", "ice-candidate":
+        if !s.servesSignaling() {
+            s.rejectForRole(peerId, msg.Type)
+            return
+        }
         s.handleSignaling(peerId, msg, resp)
     case "peer-discovered":
         s.handlePeerDiscovered(peerId, msg)
     case "ping":
         s.handlePing(peerId)
-    case "cleanup":
-    default:
-    }
-}
-
-func (s *Server) handleAnnounce(peerId string, msg inboundMessage, resp outboundMessage) {
-    netName := firstNonEmpty(msg.NetworkName, "global")
-    isHub := false
-    if m, ok := msg.Data.(map[string]interface{}); ok {
-        if v, ok := m["isHub"].(bool); ok && v {
-            isHub = true
+    case "register":
+        s.handleRegister(peerId, msg)
+    case "blob-start", "blob-chunk", "blob-end":
+        if !s.servesRelay() {
+            s.rejectForRole(peerId, msg.Type)
+            return
         }
-    }
-    s.peersMu.Lock()
-    pi := s.peerData[peerId]
-    if pi != nil {
-        pi.Announced = true
-        pi.AnnouncedAt = nowMs()
-        pi.NetworkName = netName
-        pi.IsHub = isHub || netName == s.opts.HubMeshNamespace
-        if m, ok := msg.Data.(map[string]interface{}); ok {
-            pi.Data = m
+        s.handleBlob(peerId, msg)
+    case "app-broadcast":
+        if !s.servesRelay() {
+            s.rejectForRole(peerId, msg.Type)
+            return
         }
+        s.handleAppBroadcast(peerId, msg, resp)
+    case "peer-message", "message-receipt":
+        if fromHub {
+            s.handleMeshPeerMessage(peerId, "", msg)
+            return
+        }
+        if !s.servesRelay() {
+            s.rejectForRole(peerId, msg.Type)
+            return
+        }
+        s.handlePeerMessage(peerId, msg, resp)
+    case "events-since":
+        s.handleEventsSince(peerId, msg)
+    case "resolve-service":
+        s.handleResolveService(peerId, msg)
+    case "find-peers":
+        if !s.servesSignaling() {
+            s.rejectForRole(peerId, msg.Type)
+            return
+        }
+        s.handleFindPeers(peerId, msg)
+    case "presence-summary":
+        if !s.servesSignaling() {
+            s.rejectForRole(peerId, msg.Type)
+            return
+        }
+        s.handlePresenceSummary(peerId, msg)
+    case "report-peer":
+        s.handleReportPeer(peerId, msg)
+    case "monitor-subscribe":
+        s.handleMonitorSubscribe(peerId, msg)
+    case "monitor-unsubscribe":
+        s.handleMonitorUnsubscribe(peerId, msg)
+    case "watch-peers":
+        s.handleWatchPeers(peerId, msg)
+    case "unwatch-peers":
+        s.handleUnwatchPeers(peerId, msg)
+    case "subscribe":
+        s.handleSubscribe(peerId, msg)
+    case "unsubscribe":
+        s.handleUnsubscribe(peerId, msg)
+    case "room-members":
+        s.handleRoomMembers(peerId, msg)
+    case "room-broadcast":
+        if !s.servesRelay() {
+            s.rejectForRole(peerId, msg.Type)
+            return
+        }
+        s.handleRoomBroadcast(peerId, msg)
+    case "peer-disconnected":
+        if pi := s.getPeerInfo(peerId); pi != nil && pi.IsHub {
+            s.handleRemoteDisconnect(peerId, "", msg)
+        }
+    case "erase-peer", "erase-report":
+        if pi := s.getPeerInfo(peerId); pi == nil || !pi.IsHub {
+            return
+        }
+        if msg.Type == "erase-peer" {
+            s.handleMeshErase(peerId, "", msg)
+        } else {
+            s.handleMeshEraseReport(peerId, "", msg)
+        }
+    case "hub-summary":
+        if pi := s.getPeerInfo(peerId); pi != nil && pi.IsHub {
+            s.handleHubSummary(peerId, "", msg)
+        }
+    case "signal-ack":
+        if fromHub {
+            s.handleSignalAck(peerId, "", msg)
+        }
+    case "mesh-leave":
+        if fromHub {
+            s.handleMeshLeave(peerId, "", msg)
+        }
+    case "presence-update":
+        if fromHub {
+            s.relayPresenceUpdate(peerId, "", msg)
+            return
+        }
+        s.handlePresenceUpdate(peerId, msg)
+    case "gossip-resync":
+        if fromHub {
+            s.hubsMu.Lock()
+            var features []string
+            if h := s.hubs[peerId]; h != nil {
+                features = h.SharedFeatures
+            }
+            s.hubsMu.Unlock()
+            s.handleGossipResync(s.getConn(peerId), features, msg)
+        }
+    case "cleanup":
+    default:
     }
-    s.peersMu.Unlock()
-    if pi != nil && pi.IsHub {
-        s.registerHub(peerId, netName, pi.Data)
-    }
-    s.networkMu.Lock()
-    if _, ok := s.networkPeers[netName]; !ok {
-        s.networkPeers[netName] = map[string]struct{}{}
-    }
-    s.networkPeers[netName][peerId] = struct{}{}
-    s.networkMu.Unlock()
-    s.broadcastPeerDiscovered(peerId, netName, isHub, pi.Data)
-    s.sendExistingPeersToNew(peerId, netName)
-    s.sendCachedCrossHubPeersToNew(peerId, netName)
-    s.announceToBootstrap(peerId, netName, isHub, pi.Data)
 }
 
 func (s *Server) registerHub(peerId, netName string, data map[string]interface{}) {
     s.hubsMu.Lock()
-    s.hubs[peerId] = &hubInfo{PeerId: peerId, RegisteredAt: nowMs(), LastActivity: nowMs(), NetworkName: netName, Data: data}
+    features := featureList(data["features"])
+    version, _ := data["version"].(string)
+    shared := s.sharedFeatures(features)
+    s.hubs[peerId] = &hubInfo{PeerId: peerId, RegisteredAt: nowMs(), LastActivity: nowMs(), NetworkName: netName, Data: data, Version: version, Features: features, SharedFeatures: shared}
     s.hubsMu.Unlock()
+    conn := s.getConn(peerId)
+    if hasFeature(shared, featureCompression) {
+        markGzip(conn)
+    }
+    s.upgradeMeshLink(conn, shared)
 }
 
 func (s *Server) broadcastPeerDiscovered(peerId, netName string, isHub bool, data map[string]interface{}) {
     peers := s.getActivePeers("", netName)
+    self := s.getPeerInfo(peerId)
     for _, other := range peers {
         if other == peerId {
             continue
         }
-        s.forwardToLocalTarget(other, outboundMessage{Type: "peer-discovered", Data: mergeMap(data, map[string]interface{}{"peerId": peerId, "isHub": isHub}), FromPeerId: "system", TargetPeer: other, NetworkName: netName, Timestamp: nowMs()})
+        recipient := s.getPeerInfo(other)
+        d := s.discoveredData(peerId, self, data, isHub, recipient)
+        if !s.wants(recipient, d) {
+            continue
+        }
+        s.forwardToLocalTarget(other, outboundMessage{Type: "peer-discovered", Data: d, FromPeerId: "system", TargetPeer: other, NetworkName: netName, Timestamp: nowMs()})
     }
 }
 
-func (s *Server) sendExistingPeersToNew(peerId, netName string) {
+// sendPeersToNew sends a newly announced peer the peers on its network, the
+// ones on this hub first.
+func (s *Server) sendPeersToNew(peerId, netName string) {
+    sent := s.sendExistingPeersToNew(peerId, netName)
+    s.sendCachedCrossHubPeersToNew(peerId, netName, sent)
+}
+
+// sendExistingPeersToNew returns how many peers it sent.
+func (s *Server) sendExistingPeersToNew(peerId, netName string) int {
     peers := s.getActivePeers(peerId, netName)
     conn := s.getConn(peerId)
+    self := s.getPeerInfo(peerId)
+    sent := 0
     for _, p := range peers {
         pi := s.getPeerInfo(p)
-        if conn != nil && pi != nil {
-            s.sendToConn(conn, outboundMessage{Type: "peer-discovered", Data: mergeMap(pi.Data, map[string]interface{}{"peerId": p, "isHub": pi.IsHub}), FromPeerId: "system", TargetPeer: peerId, NetworkName: netName, Timestamp: nowMs()})
+        if conn == nil || pi == nil || hiddenPeer(pi.Data) {
+            continue
+        }
+        if self != nil && self.Filter.full(sent) {
+            break
+        }
+        d := s.discoveredData(p, pi, pi.Data, pi.IsHub, self)
+        if !s.wants(self, d) {
+            continue
         }
+        s.sendToConn(conn, outboundMessage{Type: "peer-discovered", Data: d, FromPeerId: "system", TargetPeer: peerId, NetworkName: netName, Timestamp: nowMs()})
+        sent++
     }
+    return sent
 }
 
-func (s *Server) sendCachedCrossHubPeersToNew(peerId, netName string) {
-    s.bootstrapMu.Lock()
-    cache := s.crossHubCache[netName]
-    s.bootstrapMu.Unlock()
-    if cache == nil {
+// sendCachedCrossHubPeersToNew sends the peers cached from other hubs, after
+// sent local ones.
+func (s *Server) sendCachedCrossHubPeersToNew(peerId, netName string, sent int) {
+    conn := s.getConn(peerId)
+    if conn == nil {
         return
     }
-    conn := s.getConn(peerId)
-    count := 0
-    for id, data := range cache {
-        if _, ok := s.wsConns[id]; ok {
+    self := s.getPeerInfo(peerId)
+    s.bootstrapMu.Lock()
+    cached := make(map[string]map[string]interface{}, len(s.crossHubCache[netName]))
+    for id, data := range s.crossHubCache[netName] {
+        cached[id] = data
+    }
+    s.bootstrapMu.Unlock()
+    for id, data := range cached {
+        if s.getConn(id) != nil {
             continue
         }
-        if conn != nil {
-            s.sendToConn(conn, outboundMessage{Type: "peer-discovered", Data: mergeMap(data, map[string]interface{}{"peerId": id}), FromPeerId: "system", TargetPeer: peerId, NetworkName: netName, Timestamp: nowMs()})
-            count++
+        if self != nil && self.Filter.full(sent) {
+            break
+        }
+        if !s.wants(self, data) {
+            continue
         }
+        s.sendToConn(conn, outboundMessage{Type: "peer-discovered", Data: mergeMap(data, map[string]interface{}{"peerId": id}), FromPeerId: "system", TargetPeer: peerId, NetworkName: netName, Timestamp: nowMs()})
+        sent++
     }
-    if count > 0 {}
 }
 
 func (s *Server) handleSignaling(peerId string, msg inboundMessage, resp outboundMessage) {
     target := msg.TargetPeer
-    netName := firstNonEmpty(msg.NetworkName, "global")
+    netName := firstNonEmpty(msg.NetworkName, s.opts.DefaultNetwork)
     if target == "" {
         return
     }
-    if s.getConn(target) != nil {
+    if strings.HasPrefix(target, capabilityPrefix) {
+        s.handleCapabilitySignal(peerId, msg, resp)
+        return
+    }
+    if s.opts.SignalingTimeoutMs > 0 {
+        s.signaling.observe(msg.Type, peerId, target, netName)
+    }
+    // Signals relayed by another hub keep the deadline their origin hub set.
+    tracked, fromHub := false, false
+    if pi := s.getPeerInfo(peerId); pi != nil && pi.IsHub {
+        fromHub = true
+        resp.MessageId, resp.Deadline = msg.MessageId, msg.Deadline
+    } else {
+        tracked = s.stampSignalDeadline(msg, &resp)
+    }
+    if resp.Deadline > 0 && nowMs() > resp.Deadline {
+        s.signalDeadlines.droppedLate()
+        return
+    }
+    pending := &pendingSignal{from: peerId, target: target, signalType: msg.Type, networkName: netName, deadline: resp.Deadline}
+    if conn := s.getConn(target); conn != nil {
         tp := s.getPeerInfo(target)
-        tn := "global"
+        tn := s.opts.DefaultNetwork
         if tp != nil && tp.NetworkName != "" {
             tn = tp.NetworkName
         }
         if netName != tn {
             return
         }
-        s.forwardToLocalTarget(target, resp)
+        if fromHub {
+            s.learnSignalRoute(resp.FromPeerId, signalRoute{hubPeerId: peerId})
+        }
+        if _, polling := conn.(*pollConn); polling && tracked {
+            s.signalDeadlines.track(resp.MessageId, pending)
+        }
+        delivered := s.deliverSignal(target, resp)
+        s.emitEvent("signal_relayed", func() map[string]interface{} {
+            return map[string]interface{}{"type": msg.Type, "fromPeerId": peerId, "targetPeerId": target, "networkName": netName, "route": "local", "delivered": delivered}
+        })
+        return
+    }
+    if s.backplane != nil && s.backplane.route(target, netName, resp) {
+        s.emitEvent("signal_relayed", func() map[string]interface{} {
+            return map[string]interface{}{"type": msg.Type, "fromPeerId": peerId, "targetPeerId": target, "networkName": netName, "route": "backplane"}
+        })
         return
     }
     dataHash := hashSignalData(msg.Data)
@@ -310,51 +973,48 @@ func (s *Server) handleSignaling(peerId string, msg inboundMessage, resp outboun
     }
     s.relayed[id] = nowMs()
     s.relayMu.Unlock()
+    if tracked {
+        s.signalDeadlines.track(resp.MessageId, pending)
+    }
+    s.emitEvent("signal_relayed", func() map[string]interface{} {
+        return map[string]interface{}{"type": msg.Type, "fromPeerId": peerId, "targetPeerId": target, "networkName": netName, "route": "mesh"}
+    })
     s.forwardSignalToBootstrap(target, resp)
 }
 
 func (s *Server) forwardSignalToBootstrap(target string, resp outboundMessage) {
-    s.bootstrapMu.Lock()
-    for _, b := range s.bootstrapConns {
-        if b.connected && b.ws != nil {
-            b.ws.WriteJSON(resp)
-        }
-    }
-    s.bootstrapMu.Unlock()
-
-    // Also forward to hubs connected inbound to us (not represented as bootstrapConns).
-    for _, conn := range s.getHubPeerConns("") {
-        s.sendToConn(conn, resp)
+    if s.sendSignalRouted(target, resp) {
+        return
     }
+    s.forwardToMesh(resp, "", "")
 }
 
 func (s *Server) handlePeerDiscovered(fromHub string, msg inboundMessage) {
     // Receives peer-discovered messages from other hubs.
     if m, ok := msg.Data.(map[string]interface{}); ok {
-        netName := firstNonEmpty(msg.NetworkName, "global")
+        netName := firstNonEmpty(msg.NetworkName, s.opts.DefaultNetwork)
         id, _ := m["peerId"].(string)
-        if id == "" {
+        if isHub, _ := m["isHub"].(bool); isHub {
+            s.learnMember(id, memberURL(m), memberSourceDiscovered)
+        }
+        if id == "" || hiddenPeer(m) || s.alreadyVisited(msg) || !s.firstSighting("peer-discovered", msg) {
             return
         }
 
-        // Deduplicate to avoid mesh loops.
-        if s.isCrossHubPeerCached(netName, id) {
+        // Deduplicate to avoid mesh loops; a winning claim on a peer from
+        // another hub replaces the cached one.
+        if !s.resolvePresence(netName, id, m) {
             return
         }
         s.cacheCrossHubPeer(netName, id, m)
+        s.recordEvent(netName, "peer-discovered", id, m)
 
         // Forward to local peers
-        s.forwardToLocalPeers(netName, outboundMessage{
-            Type: "peer-discovered",
-            Data: m,
-            FromPeerId: "system",
-            NetworkName: netName,
-            Timestamp: nowMs(),
-        })
+        s.deliverCrossHubDiscovery(netName, id, m)
 
         // If this came from a hub connection, propagate further across the mesh.
         if pi := s.getPeerInfo(fromHub); pi != nil && pi.IsHub {
-            s.announceToBootstrapExcept(id, netName, false, m, "", fromHub)
+            s.announceToBootstrapExcept(id, netName, false, m, "", fromHub, msg)
         }
     }
 }
@@ -371,21 +1031,32 @@ func (s *Server) isCrossHubPeerCached(netName, id string) bool {
     return ok
 }
 
-func (s *Server) getHubPeerConns(excludePeerId string) []*websocket.Conn {
+type hubLink struct {
+    id       string
+    conn     peerConn
+    features []string
+}
+
+// getHubPeerLinks returns the inbound hub connections together with the
+// features negotiated with each hub.
+func (s *Server) getHubPeerLinks(excludePeerId string) []hubLink {
     s.hubsMu.Lock()
-    hubIds := make([]string, 0, len(s.hubs))
-    for id := range s.hubs {
+    features := make(map[string][]string, len(s.hubs))
+    for id, h := range s.hubs {
         if id == excludePeerId {
             continue
         }
-        hubIds = append(hubIds, id)
+        features[id] = h.SharedFeatures
     }
     s.hubsMu.Unlock()
 
-    out := make([]*websocket.Conn, 0, len(hubIds))
-    for _, id := range hubIds {
+    out := make([]hubLink, 0, len(features))
+    for id, f := range features {
+        if !s.hubApproved(id) {
+            continue
+        }
         if conn := s.getConn(id); conn != nil {
-            out = append(out, conn)
+            out = append(out, hubLink{id: id, conn: conn, features: f})
         }
     }
     return out
@@ -398,30 +1069,89 @@ func (s *Server) handlePing(peerId string) {
     }
 }
 
-func (s *Server) handleDisconnect(peerId string, code int, reason string) {
+// handleDisconnect removes peerId and tells its network, the event log,
+// webhooks and the mesh why it left. reason is one of the reason* constants;
+// detail is free text such as the underlying read error.
+func (s *Server) handleDisconnect(peerId, reason, detail string) {
     pi := s.getPeerInfo(peerId)
-    netName := "global"
+    netName := s.opts.DefaultNetwork
     isHub := false
     if pi != nil {
-        netName = firstNonEmpty(pi.NetworkName, "global")
+        netName = firstNonEmpty(pi.NetworkName, s.opts.DefaultNetwork)
         isHub = pi.IsHub
     }
-    s.broadcastToOthers(peerId, outboundMessage{Type: "peer-disconnected", Data: map[string]interface{}{"peerId": peerId, "isHub": isHub, "reason": reason, "timestamp": nowMs()}, FromPeerId: "system", NetworkName: netName, Timestamp: nowMs()})
+    s.emitEvent("peer_disconnected", func() map[string]interface{} {
+        return map[string]interface{}{"peerId": peerId, "networkName": netName, "isHub": isHub, "reason": reason, "detail": detail}
+    })
+    if !s.deferDisconnect(peerId, pi, reason, detail) {
+        s.publishDisconnect(peerId, netName, isHub, pi != nil && pi.Announced, pi != nil && hiddenPeer(pi.Data), reason, detail)
+    }
     s.cleanupPeer(peerId)
 }
 
+// publishDisconnect tells peerId's network, and for announced peers the
+// event log, webhooks, the mesh and the change feed, that it has left. A
+// hidden peer leaves without its network or the event log hearing of it.
+func (s *Server) publishDisconnect(peerId, netName string, isHub, announced, hidden bool, reason, detail string) {
+    data := map[string]interface{}{"peerId": peerId, "isHub": isHub, "reason": reason, "timestamp": nowMs()}
+    if detail != "" {
+        data["detail"] = detail
+    }
+    if !hidden {
+        s.broadcastToOthers(peerId, outboundMessage{Type: "peer-disconnected", Data: data, FromPeerId: "system", NetworkName: netName, Timestamp: nowMs()})
+    }
+    if announced {
+        if !hidden {
+            s.recordEvent(netName, "peer-disconnected", peerId, map[string]interface{}{"reason": reason})
+        }
+        s.notifyIntegrations(integrationWebhook, netName, "peer-disconnected", map[string]interface{}{"peerId": peerId, "reason": reason, "detail": detail})
+        if !isHub {
+            s.announceDisconnectToMesh(peerId, netName, reason)
+            s.changes.publish(changeRemoved, netName, peerId, nil, reason)
+        }
+    }
+}
+
 func (s *Server) cleanupPeer(peerId string) {
+    if log := s.connLog(peerId); log.debugging() {
+        log.Debug("conn_cleanup", nil)
+    }
+    s.appBroadcasts.forget(peerId)
+    s.peerMessages.forget(peerId)
+    s.peerReceipts.forget(peerId)
+    s.forgetMonitor(peerId)
+    s.forgetGuest(peerId)
+    s.forgetJWT(peerId)
+    s.forgetACL(peerId)
+    s.forgetRooms(peerId, roomDisconnected)
+    s.watches.unwatch(peerId, nil)
     s.wsMu.Lock()
+    conn, hadConn := s.wsConns[peerId]
     delete(s.wsConns, peerId)
-    s.wsMu.Unlock()
     s.peersMu.Lock()
     pi := s.peerData[peerId]
     delete(s.peerData, peerId)
     s.peersMu.Unlock()
+    s.wsMu.Unlock()
+    if hadConn {
+        s.metrics.ConnectionClosed()
+        if pi != nil && s.paths[pi.Path] != nil {
+            atomic.AddInt64(&s.paths[pi.Path].active, -1)
+        }
+    }
+    if pi != nil && pi.Announced {
+        s.metrics.PeerRemoved()
+        if !pi.IsHub {
+            now := time.Now()
+            s.churn.disconnected(firstNonEmpty(pi.NetworkName, s.opts.DefaultNetwork), now.Sub(time.UnixMilli(pi.AnnouncedAt)), now)
+        }
+    }
     if pi != nil && pi.IsHub {
         s.hubsMu.Lock()
         delete(s.hubs, peerId)
         s.hubsMu.Unlock()
+        s.gossipDelta.forgetLink(conn, peerId)
+        s.forgetPendingHub(peerId)
     }
     if pi != nil && pi.NetworkName != "" {
         s.networkMu.Lock()
@@ -437,16 +1167,36 @@ func (s *Server) cleanupPeer(peerId string) {
             delete(cache, peerId)
         }
         s.bootstrapMu.Unlock()
+        s.localIndex.drop("", peerId)
+        s.remoteIndex.drop(pi.NetworkName, peerId)
     }
+    s.forgetFanout(peerId)
+}
+
+func (s *Server) sendToConn(conn peerConn, msg outboundMessage) bool {
+    return s.writeMessage(conn, msg, s.clientThreshold(conn))
 }
 
-func (s *Server) sendToConn(conn *websocket.Conn, msg outboundMessage) bool {
+func (s *Server) writeMessage(conn peerConn, msg outboundMessage, threshold int) bool {
     if conn == nil {
         return false
     }
+    if isLegacyConn(conn) {
+        b, err := legacyEnvelope(msg)
+        if err != nil {
+            return false
+        }
+        return s.deliver(conn, msg.Type, websocket.TextMessage, b)
+    }
+    // A signed message is already compressed as signed.
+    if msg.Encoding == "" && msg.MeshSignature == "" {
+        msg.Data, msg.Encoding = compressData(msg.Data, threshold)
+    }
+    if isBinaryConn(conn) {
+        return s.writeBinary(conn, msg)
+    }
     b, _ := json.Marshal(msg)
-    conn.WriteMessage(websocket.TextMessage, b)
-    return true
+    return s.deliver(conn, msg.Type, websocket.TextMessage, b)
 }
 
 func (s *Server) broadcastToOthers(sender string, msg outboundMessage) int {
@@ -458,16 +1208,7 @@ func (s *Server) broadcastToOthers(sender string, msg outboundMessage) int {
         }
     }
     s.wsMu.Unlock()
-    count := 0
-    for _, id := range ids {
-        conn := s.getConn(id)
-        m := msg
-        m.TargetPeer = id
-        if s.sendToConn(conn, m) {
-            count++
-        }
-    }
-    return count
+    return s.fanoutTo(ids, msg, true)
 }
 
 func (s *Server) forwardToLocalTarget(target string, msg outboundMessage) bool {
@@ -475,29 +1216,35 @@ func (s *Server) forwardToLocalTarget(target string, msg outboundMessage) bool {
     return s.sendToConn(conn, msg)
 }
 
-func (s *Server) getConn(id string) *websocket.Conn {
+func (s *Server) getConn(id string) peerConn {
     s.wsMu.Lock()
     c := s.wsConns[id]
     s.wsMu.Unlock()
     return c
 }
 
+// getPeerInfo returns a copy of the peer's info, or nil. Entries are only
+// modified under peersMu, so callers must not hold on to the live pointer.
 func (s *Server) getPeerInfo(id string) *peerInfo {
     s.peersMu.Lock()
+    defer s.peersMu.Unlock()
     pi := s.peerData[id]
-    s.peersMu.Unlock()
-    return pi
+    if pi == nil {
+        return nil
+    }
+    cp := *pi
+    return &cp
 }
 
 func (s *Server) getActivePeers(exclude, netName string) []string {
     s.networkMu.Lock()
-    set := s.networkPeers[netName]
-    s.networkMu.Unlock()
-    if set == nil {
-        return []string{}
+    ids := make([]string, 0, len(s.networkPeers[netName]))
+    for id := range s.networkPeers[netName] {
+        ids = append(ids, id)
     }
-    out := make([]string, 0, len(set))
-    for id := range set {
+    s.networkMu.Unlock()
+    out := make([]string, 0, len(ids))
+    for _, id := range ids {
         if id != exclude && s.getConn(id) != nil {
             out = append(out, id)
         }
@@ -507,11 +1254,7 @@ func (s *Server) getActivePeers(exclude, netName string) []string {
 }
 
 func (s *Server) forwardToLocalPeers(netName string, msg outboundMessage) {
-    peers := s.getActivePeers("", netName)
-    for _, id := range peers {
-        conn := s.getConn(id)
-        s.sendToConn(conn, msg)
-    }
+    s.fanoutTo(s.getActivePeers("", netName), msg, false)
 }
 
 func (s *Server) cacheCrossHubPeer(netName, id string, data map[string]interface{}) {
@@ -521,13 +1264,20 @@ func (s *Server) cacheCrossHubPeer(netName, id string, data map[string]interface
     }
     s.crossHubCache[netName][id] = data
     s.bootstrapMu.Unlock()
+    s.remoteIndex.put(netName, id, data)
 }
 
 func (s *Server) performCleanup() {
     s.wsMu.Lock()
     total := len(s.wsConns)
     s.wsMu.Unlock()
+    s.networkMu.Lock()
+    names := make([]string, 0, len(s.networkPeers))
     for netName := range s.networkPeers {
+        names = append(names, netName)
+    }
+    s.networkMu.Unlock()
+    for _, netName := range names {
         s.getActivePeers("", netName)
     }
     cleaned := total - s.connectionsSize()
@@ -540,6 +1290,26 @@ func (s *Server) performCleanup() {
         }
     }
     s.relayMu.Unlock()
+    s.envelopes.expire(now)
+    s.blobs.expire(now)
+    s.expirePollSessions(now)
+    s.reapIdle(now)
+    if s.journal != nil {
+        if err := s.journal.expire(now); err != nil {
+            s.log.Warn("poll_journal_compact_failed", map[string]interface{}{"path": s.opts.PollJournalPath, "error": err.Error()})
+        }
+    }
+    s.applyRetention(now)
+    s.pruneReputation(now)
+    s.expireGuests(now)
+    s.expirePow(now)
+    s.connDebug.expire(now)
+    s.sampleAnalytics(now)
+    if s.opts.SignalRouteTTLMs > 0 {
+        s.signalRoutes.expire(now, int64(s.opts.SignalRouteTTLMs))
+    }
+    s.checkLeaks()
+    s.metrics.CleanupPerformed()
 }
 
 func (s *Server) connectionsSize() int {
@@ -568,10 +1338,13 @@ func (s *Server) getStats() map[string]interface{} {
         "hubs": len(s.hubs),
         "networks": len(s.networkPeers),
         "bootstrapHubs": map[string]interface{}{"total": len(s.opts.BootstrapHubs), "connected": connected},
-        "maxConnections": s.opts.MaxConnections,
+        "maxConnections": s.maxConnections(),
         "uptime": s.uptime(),
         "host": s.opts.Host,
         "port": s.port,
+        "portBinding": s.portSnapshot(),
+        "restoredState": s.restored,
+        "rooms": s.roomSnapshot(),
     }
 }
 
@@ -611,20 +1384,29 @@ func mergeMap(a, b map[string]interface{}) map[string]interface{} {
 }
 
 func (s *Server) emitBootstrapConnected(uri string) {
-    if s.opts.VerboseLogging {
-        log.Printf("bootstrap connected: %s", uri)
+    s.metrics.HubConnected()
+    if s.verbose() {
+        s.log.Info("bootstrap_connected", map[string]interface{}{"uri": uri})
     }
 }
 
 func (s *Server) emitHubDiscovered(hubPeerId, fromURI string) {
-    if s.opts.VerboseLogging {
-        log.Printf("hub discovered: %s via %s", hubPeerId, fromURI)
+    if s.verbose() {
+        s.log.Info("hub_discovered", map[string]interface{}{"hubPeerId": hubPeerId, "via": fromURI})
     }
 }
 
 func (s *Server) getMetrics() map[string]interface{} {
     s.peersMu.Lock()
     peers := len(s.peerData)
+    versions := make(map[string]int)
+    legacy := 0
+    for _, pi := range s.peerData {
+        versions[firstNonEmpty(pi.ClientVersion, "unknown")]++
+        if !pi.IsHub && pi.ProtocolVersion == legacyProtocolVersion {
+            legacy++
+        }
+    }
     s.peersMu.Unlock()
 
     s.networkMu.Lock()
@@ -648,6 +1430,10 @@ func (s *Server) getMetrics() map[string]interface{} {
     }
     s.bootstrapMu.Unlock()
 
+    networkDetails, foldedNetworks := capSeries(networkDetails, s.opts.MetricsMaxSeries)
+    versions, foldedVersions := capSeries(versions, s.opts.MetricsMaxSeries)
+    churn, foldedChurn := capChurn(s.churn.snapshot(time.Now()), s.opts.MetricsMaxSeries)
+
     return map[string]interface{}{
         "timestamp":          time.Now().Format(time.RFC3339),
         "uptime_ms":          s.uptime(),
@@ -659,7 +1445,7 @@ func (s *Server) getMetrics() map[string]interface{} {
         },
         "connections": map[string]interface{}{
             "active": s.connectionsSize(),
-            "max":    s.opts.MaxConnections,
+            "max":    s.maxConnections(),
         },
         "peers": map[string]interface{}{
             "total":   peers,
@@ -670,6 +1456,71 @@ func (s *Server) getMetrics() map[string]interface{} {
             "bootstrap_connected": bootstrapConns,
         },
         "networks": networks,
+        "clients": map[string]interface{}{
+            "versions": versions,
+            "legacy_envelope": legacy,
+        },
+        "admission": s.admission.snapshot(),
+        "goroutines": s.goroutineSnapshot(),
+        "panics": atomic.LoadInt64(&s.panics),
+        "signaling_sessions": s.signaling.snapshot(),
+        "discovery_backlog": s.pacer.backlog(),
+        "hub_links": s.hubQuotas.snapshot(time.Now()),
+        "counters": s.metricsCounters(),
+        "paths": s.pathSnapshot(),
+        "churn": churn,
+        "cardinality": map[string]interface{}{
+            "max_series": s.opts.MetricsMaxSeries,
+            "folded": map[string]int{"networks": foldedNetworks, "client_versions": foldedVersions, "churn": foldedChurn},
+        },
+        "changes": s.changes.snapshot(),
+        "gossip_delta": s.gossipDelta.snapshot(),
+        "signal_deadlines": s.signalDeadlines.snapshot(),
+        "spoof_attempts": s.spoofSnapshot(),
+        "tail": s.tail.snapshot(),
+        "network_caps": s.networkCapsSnapshot(),
+        "disconnect_debounce": s.debouncer.snapshot(),
+        "load_shedding": s.shedSnapshot(),
+        "reputation": s.reputationSnapshot(),
+        "store": s.storeSnapshot(),
+        "mesh_signing": s.meshSigningSnapshot(),
+        "monitors": s.monitorSnapshot(),
+        "guests": s.guestSnapshot(),
+        "signal_routes": s.signalRouteSnapshot(),
+        "transforms": s.transformSnapshot(),
+        "write_queues": s.writeQueueSnapshot(),
+        "poll_journal": s.pollJournalSnapshot(),
+        "proof_of_work": s.powSnapshot(),
+        "keepalive": s.keepaliveSnapshot(),
+        "hub_approvals": s.hubApprovalSnapshot(),
+        "peer_index": s.peerIndexSnapshot(),
+        "ice_servers": s.iceSnapshot(),
+        "jwt": s.jwtSnapshot(),
+        "faults": s.faultSnapshot(),
+        "guardrails": s.guardrailSnapshot(),
+        "network_acl": s.aclSnapshot(),
+        "config": s.reloadSnapshot(),
+        "mesh_membership": s.membershipSnapshot(),
+        "event_bridge": s.bridgeSnapshot(),
+        "mesh_dedup": s.meshDedupSnapshot(),
+        "binary_framing": s.binarySnapshot(),
+        "listeners": s.listenerList(),
+        "duplicate_presence": s.presenceSnapshot(),
+        "presence": s.presenceMetaSnapshot(),
+        "discovery_filter": s.discoveryFilterSnapshot(),
+        "fanout": s.fanoutSnapshot(),
+        "backplane": s.backplaneSnapshot(),
+        "mesh_encoding": s.meshEncodingSnapshot(),
+        "grpc": s.grpcSnapshot(),
+        "peer_idle": s.idleSnapshot(),
     }
 }
 
+// metricsCounters returns the recorder's own snapshot when it has one.
+func (s *Server) metricsCounters() map[string]interface{} {
+    if sn, ok := s.metrics.(interface{ Snapshot() map[string]interface{} }); ok {
+        return sn.Snapshot()
+    }
+    return nil
+}
+
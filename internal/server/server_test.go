@@ -1,6 +1,22 @@
 package server
 
-import "testing"
+import (
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/hex"
+    "encoding/pem"
+    "math/big"
+    "net"
+    "os"
+    "path/filepath"
+    "sync"
+    "testing"
+    "time"
+)
 
 func TestValidatePeerId(t *testing.T) {
     if !validatePeerId("0123456789abcdef0123456789abcdef01234567") {
@@ -19,3 +35,143 @@ func TestXORDistance(t *testing.T) {
     }
 }
 
+type memStore struct {
+    mu   sync.Mutex
+    docs map[string][]byte
+}
+
+func (m *memStore) Load(key string) ([]byte, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    return m.docs[key], nil
+}
+
+func (m *memStore) Save(key string, data []byte) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.docs[key] = data
+    return nil
+}
+
+type recordingMetrics struct {
+    mu     sync.Mutex
+    counts map[string]int64
+}
+
+func (r *recordingMetrics) add(name string, n int64) {
+    r.mu.Lock()
+    r.counts[name] += n
+    r.mu.Unlock()
+}
+
+func (r *recordingMetrics) ConnectionOpened()        { r.add("connectionOpened", 1) }
+func (r *recordingMetrics) ConnectionClosed()        { r.add("connectionClosed", 1) }
+func (r *recordingMetrics) PeerAnnounced()           { r.add("peerAnnounced", 1) }
+func (r *recordingMetrics) PeerRemoved()             { r.add("peerRemoved", 1) }
+func (r *recordingMetrics) PeerDiscovered()          { r.add("peerDiscovered", 1) }
+func (r *recordingMetrics) HubConnected()            { r.add("hubConnected", 1) }
+func (r *recordingMetrics) CrossHubMessageSent()     { r.add("crossHubMessageSent", 1) }
+func (r *recordingMetrics) MessageProcessed()        { r.add("messageProcessed", 1) }
+func (r *recordingMetrics) MessageFailed()           { r.add("messageFailed", 1) }
+func (r *recordingMetrics) MessageBroadcast(n int64) { r.add("messageBroadcast", n) }
+func (r *recordingMetrics) CleanupPerformed()        { r.add("cleanupPerformed", 1) }
+
+type recordingLogger struct {
+    mu       sync.Mutex
+    messages []string
+}
+
+func (l *recordingLogger) record(message string) {
+    l.mu.Lock()
+    l.messages = append(l.messages, message)
+    l.mu.Unlock()
+}
+
+func (l *recordingLogger) Debug(message string, fields map[string]interface{}) { l.record(message) }
+func (l *recordingLogger) Info(message string, fields map[string]interface{})  { l.record(message) }
+func (l *recordingLogger) Warn(message string, fields map[string]interface{})  { l.record(message) }
+func (l *recordingLogger) Error(message string, fields map[string]interface{}) { l.record(message) }
+
+func TestInjectedLoggerMetricsAndStore(t *testing.T) {
+    st := &memStore{docs: map[string][]byte{}}
+    rec := &recordingMetrics{counts: map[string]int64{}}
+    lg := &recordingLogger{}
+    s := NewServer(Options{IdentityStorePath: "identities", HubGossipQuotaPerSec: 1, Store: st, Metrics: rec, Logger: lg})
+    id := "0123456789abcdef0123456789abcdef01234567"
+    pub, _, _ := ed25519.GenerateKey(nil)
+    if err := s.identities.bind(id, pub); err != nil || len(st.docs["identities"]) == 0 {
+        t.Fatalf("identity binding should be saved to the injected store: %v", err)
+    }
+    if newIdentityStore(st, "identities").lookup(id) == nil {
+        t.Fatalf("identity binding should load back from the store")
+    }
+    s.peerData[id] = &peerInfo{PeerId: id, Connected: true}
+    s.handleMessage(id, []byte(`{"type":"announce","networkName":"global","data":{}}`))
+    s.handleMessage(id, []byte(`{`))
+    if rec.counts["peerAnnounced"] != 1 || rec.counts["messageProcessed"] != 1 || rec.counts["messageFailed"] != 1 {
+        t.Fatalf("unexpected metrics %v", rec.counts)
+    }
+    s.admitFromHub("ws://hub-b", "peer-discovered")
+    s.admitFromHub("ws://hub-b", "peer-discovered")
+    if len(lg.messages) != 1 || lg.messages[0] != "hub_link_throttled" {
+        t.Fatalf("expected throttle to be logged through the injected logger, got %v", lg.messages)
+    }
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key.
+func writeTestCert(t *testing.T) (string, string) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "hub"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour)}
+    der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keyDer, _ := x509.MarshalECPrivateKey(key)
+    dir := t.TempDir()
+    certFile, keyFile := filepath.Join(dir, "hub.crt"), filepath.Join(dir, "hub.key")
+    os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+    os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+    return certFile, keyFile
+}
+
+func randomPeerId() string {
+    b := make([]byte, 20)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+    deadline := time.Now().Add(5 * time.Second)
+    for !cond() {
+        if time.Now().After(deadline) {
+            t.Fatalf("timed out waiting for %s", what)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+// attachTestPeers registers a polling connection and a connected peer record
+// for each id, the way registerConn would, and returns the connections by id.
+func attachTestPeers(t *testing.T, s *Server, ids ...string) map[string]*pollConn {
+    t.Helper()
+    conns := make(map[string]*pollConn, len(ids))
+    for _, id := range ids {
+        conns[id] = attachTestPeer(t, s, id)
+    }
+    return conns
+}
+
+func attachTestPeer(t *testing.T, s *Server, id string) *pollConn {
+    t.Helper()
+    c := &pollConn{s: s, peerId: id, notify: make(chan struct{}, 1), lastPoll: nowMs()}
+    s.wsMu.Lock()
+    s.wsConns[id] = c
+    s.peersMu.Lock()
+    s.peerData[id] = &peerInfo{PeerId: id, Connected: true}
+    s.peersMu.Unlock()
+    s.wsMu.Unlock()
+    return c
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+    "encoding/json"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+)
+
+// Service records. Besides WebRTC signaling, a peer may advertise plain
+// network services (a TCP game server, an HTTPS API) in its announce data:
+//
+//     {"type": "announce", "data": {"services": [
+//         {"name": "match-api", "protocol": "https", "host": "10.0.0.5",
+//          "port": 8443, "tls": true, "path": "/v1"}]}}
+//
+// The hub validates and normalizes the records before storing or gossiping
+// them; an announce with a malformed record is refused with an
+// invalid-service-record error. Peers then find services with
+//
+//     {"type": "resolve-service", "data": {"name": "match-api",
+//      "protocol": "https", "queryId": "q1"}}
+//
+// and get a service-records reply listing matching records from local peers
+// and from peers on other hubs this hub has heard about.
+const (
+    errInvalidServiceRecord = "invalid-service-record"
+
+    maxServicesPerPeer  = 16
+    maxServiceHostLen   = 253
+    maxServicePathLen   = 256
+    maxResolvedServices = 100
+)
+
+// ServiceRecord is one non-WebRTC service a peer advertises.
+type ServiceRecord struct {
+    Name     string `json:"name"`
+    Protocol string `json:"protocol"`
+    Host     string `json:"host"`
+    Port     int    `json:"port"`
+    TLS      bool   `json:"tls"`
+    Path     string `json:"path,omitempty"`
+}
+
+type resolvedService struct {
+    PeerId string `json:"peerId"`
+    Local  bool   `json:"local"`
+    ServiceRecord
+}
+
+// validServiceProtocol accepts URI-scheme style names such as tcp, https or
+// grpc+tls.
+func validServiceProtocol(p string) bool {
+    if p == "" || len(p) > 16 || p[0] < 'a' || p[0] > 'z' {
+        return false
+    }
+    for _, r := range p {
+        if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '+' || r == '-' || r == '.') {
+            return false
+        }
+    }
+    return true
+}
+
+// validServiceHost accepts an IP address or a DNS hostname.
+func validServiceHost(h string) bool {
+    if h == "" || len(h) > maxServiceHostLen {
+        return false
+    }
+    if net.ParseIP(strings.Trim(h, "[]")) != nil {
+        return true
+    }
+    for _, label := range strings.Split(strings.TrimSuffix(h, "."), ".") {
+        if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+            return false
+        }
+        for _, r := range label {
+            if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+// parseServiceRecords decodes and validates the services field of announce
+// data, whether it came straight off a client socket or out of gossip.
+func parseServiceRecords(v interface{}) ([]ServiceRecord, string) {
+    b, err := json.Marshal(v)
+    if err != nil {
+        return nil, "services must be a list of records"
+    }
+    var recs []ServiceRecord
+    if err := json.Unmarshal(b, &recs); err != nil {
+        return nil, "services must be a list of {name, protocol, host, port, tls, path} records"
+    }
+    if len(recs) > maxServicesPerPeer {
+        return nil, "at most " + strconv.Itoa(maxServicesPerPeer) + " services per peer"
+    }
+    for i := range recs {
+        r := &recs[i]
+        r.Protocol = strings.ToLower(r.Protocol)
+        r.Host = strings.ToLower(r.Host)
+        at := "service " + strconv.Itoa(i) + ": "
+        switch {
+        case !validNetworkName(r.Name):
+            return nil, at + "name must be 1-64 characters of letters, digits and . _ - : @ /"
+        case !validServiceProtocol(r.Protocol):
+            return nil, at + "protocol must be a scheme such as tcp, udp or https"
+        case !validServiceHost(r.Host):
+            return nil, at + "host must be an IP address or hostname"
+        case r.Port < 1 || r.Port > 65535:
+            return nil, at + "port must be 1-65535"
+        case r.Path != "" && (r.Path[0] != '/' || len(r.Path) > maxServicePathLen):
+            return nil, at + "path must start with / and be at most 256 characters"
+        }
+    }
+    return recs, ""
+}
+
+// normalizeServices validates data["services"] in place. It reports false,
+// after sending the peer an invalid-service-record error, when a record is
+// malformed.
+func (s *Server) normalizeServices(peerId string, data map[string]interface{}) bool {
+    raw, ok := data["services"]
+    if !ok {
+        return true
+    }
+    recs, problem := parseServiceRecords(raw)
+    if problem != "" {
+        s.sendToConn(s.getConn(peerId), outboundMessage{Type: "error", Data: map[string]interface{}{"code": errInvalidServiceRecord, "message": problem}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+        return false
+    }
+    data["services"] = recs
+    return true
+}
+
+func matchServices(peerId string, local bool, data map[string]interface{}, name, protocol string, tls *bool, out []resolvedService) []resolvedService {
+    raw, ok := data["services"]
+    if !ok {
+        return out
+    }
+    recs, problem := parseServiceRecords(raw)
+    if problem != "" {
+        return out
+    }
+    for _, r := range recs {
+        if r.Name != name || (protocol != "" && r.Protocol != protocol) || (tls != nil && r.TLS != *tls) {
+            continue
+        }
+        out = append(out, resolvedService{PeerId: peerId, Local: local, ServiceRecord: r})
+    }
+    return out
+}
+
+// handleResolveService answers a resolve-service query with the matching
+// records of local peers first, then of peers seen through the mesh.
+func (s *Server) handleResolveService(peerId string, msg inboundMessage) {
+    netName := firstNonEmpty(msg.NetworkName, s.opts.DefaultNetwork)
+    m, _ := msg.Data.(map[string]interface{})
+    name, _ := m["name"].(string)
+    protocol, _ := m["protocol"].(string)
+    queryId, _ := m["queryId"].(string)
+    var tls *bool
+    if v, ok := m["tls"].(bool); ok {
+        tls = &v
+    }
+    if name == "" {
+        s.sendError(s.getConn(peerId), peerId, "resolve-service requires a name")
+        return
+    }
+    protocol = strings.ToLower(protocol)
+
+    records := []resolvedService{}
+    localIds := map[string]bool{}
+    for _, p := range s.localDirectory(netName) {
+        localIds[p.PeerId] = true
+        if hiddenPeer(p.Data) {
+            continue
+        }
+        records = matchServices(p.PeerId, true, p.Data, name, protocol, tls, records)
+    }
+    s.bootstrapMu.Lock()
+    remote := make(map[string]map[string]interface{}, len(s.crossHubCache[netName]))
+    for id, data := range s.crossHubCache[netName] {
+        if !localIds[id] {
+            remote[id] = data
+        }
+    }
+    s.bootstrapMu.Unlock()
+    for id, data := range remote {
+        records = matchServices(id, false, data, name, protocol, tls, records)
+    }
+    sort.SliceStable(records, func(i, j int) bool {
+        if records[i].Local != records[j].Local {
+            return records[i].Local
+        }
+        return records[i].PeerId < records[j].PeerId
+    })
+    truncated := len(records) > maxResolvedServices
+    if truncated {
+        records = records[:maxResolvedServices]
+    }
+    s.forwardToLocalTarget(peerId, outboundMessage{Type: "service-records", Data: map[string]interface{}{"name": name, "protocol": protocol, "queryId": queryId, "records": records, "truncated": truncated}, FromPeerId: "system", TargetPeer: peerId, NetworkName: netName, Timestamp: nowMs()})
+}
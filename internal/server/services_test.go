@@ -0,0 +1,54 @@
+package server
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestServiceRecordsValidateAndResolve(t *testing.T) {
+    s := NewServer(Options{})
+    a, bad, asker, remote := randomPeerId(), randomPeerId(), randomPeerId(), randomPeerId()
+    conns := attachTestPeers(t, s, a, bad, asker)
+    s.handleMessage(a, []byte(`{"type":"announce","networkName":"lobby","data":{"services":[{"name":"match-api","protocol":"HTTPS","host":"API.example.com","port":8443,"tls":true,"path":"/v1"},{"name":"match-api","protocol":"tcp","host":"10.0.0.5","port":7000}]}}`))
+    s.handleMessage(bad, []byte(`{"type":"announce","networkName":"lobby","data":{"services":[{"name":"x","protocol":"tcp","host":"bad host","port":70000}]}}`))
+    if msgs, _ := conns[bad].take(time.Second); len(msgs) != 1 || !strings.Contains(string(msgs[0]), errInvalidServiceRecord) {
+        t.Fatalf("malformed record should be refused with %s, got %s", errInvalidServiceRecord, msgs)
+    }
+    if s.getPeerInfo(bad).Announced {
+        t.Fatalf("announce with a malformed record should not be stored")
+    }
+    s.cacheCrossHubPeer("lobby", remote, map[string]interface{}{"peerId": remote, "services": []interface{}{map[string]interface{}{"name": "match-api", "protocol": "https", "host": "10.1.0.9", "port": 443.0, "tls": true}}})
+    conns[asker].take(20 * time.Millisecond)
+
+    resolve := func(query string) (recs []resolvedService) {
+        s.handleMessage(asker, []byte(`{"type":"resolve-service","networkName":"lobby","data":`+query+`}`))
+        msgs, _ := conns[asker].take(time.Second)
+        if len(msgs) != 1 {
+            t.Fatalf("expected one service-records reply, got %s", msgs)
+        }
+        var reply struct {
+            Type string `json:"type"`
+            Data struct {
+                QueryId string            `json:"queryId"`
+                Records []resolvedService `json:"records"`
+            } `json:"data"`
+        }
+        json.Unmarshal(msgs[0], &reply)
+        if reply.Type != "service-records" || reply.Data.QueryId != "q" {
+            t.Fatalf("unexpected reply %s", msgs[0])
+        }
+        return reply.Data.Records
+    }
+    recs := resolve(`{"name":"match-api","protocol":"https","queryId":"q"}`)
+    if len(recs) != 2 || !recs[0].Local || recs[0].PeerId != a || recs[0].Host != "api.example.com" || recs[0].Path != "/v1" || recs[1].Local || recs[1].PeerId != remote || recs[1].Port != 443 {
+        t.Fatalf("unexpected https records %+v", recs)
+    }
+    if recs := resolve(`{"name":"match-api","tls":false,"queryId":"q"}`); len(recs) != 1 || recs[0].Protocol != "tcp" {
+        t.Fatalf("tls=false should match only the tcp record, got %+v", recs)
+    }
+    if recs := resolve(`{"name":"other","queryId":"q"}`); len(recs) != 0 {
+        t.Fatalf("unknown service should resolve to nothing, got %+v", recs)
+    }
+}
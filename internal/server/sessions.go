@@ -0,0 +1,186 @@
+package server
+
+import (
+    "sync"
+    "time"
+)
+
+// Signaling session states.
+const (
+    sessionOffered    = "offered"
+    sessionAnswered   = "answered"
+    sessionConnecting = "connecting"
+    sessionConnected  = "connected"
+)
+
+// signalingTracker follows offer/answer/candidate exchanges between peer
+// pairs. A session completes once it has been answered and both peers have
+// sent ICE candidates; any other session fails after the timeout and both
+// peers get a signaling-timeout notice.
+type signalingTracker struct {
+    mu       sync.Mutex
+    sessions map[string]*signalingSession
+    stats    map[string]*sessionStats
+    // ended keeps finished sessions for reportCooldownMs, with lastAt set
+    // to when they ended, so a peer can still report one that failed.
+    ended map[string]*signalingSession
+}
+
+type signalingSession struct {
+    a, b        string
+    initiator   string
+    networkName string
+    state       string
+    startedAt   int64
+    lastAt      int64
+    // candidatesA and candidatesB are set once a and b have sent an ICE
+    // candidate after the answer.
+    candidatesA bool
+    candidatesB bool
+}
+
+type sessionStats struct {
+    Started   int64 `json:"started"`
+    Completed int64 `json:"completed"`
+    Failed    int64 `json:"failed"`
+}
+
+func newSignalingTracker() *signalingTracker {
+    return &signalingTracker{sessions: map[string]*signalingSession{}, stats: map[string]*sessionStats{}, ended: map[string]*signalingSession{}}
+}
+
+func sessionKey(netName, from, to string) (string, string, string) {
+    if to < from {
+        from, to = to, from
+    }
+    return netName + ":" + from + ":" + to, from, to
+}
+
+func (t *signalingTracker) statsFor(netName string) *sessionStats {
+    st := t.stats[netName]
+    if st == nil {
+        st = &sessionStats{}
+        t.stats[netName] = st
+    }
+    return st
+}
+
+// observe advances the session between from and to for a signaling message.
+func (t *signalingTracker) observe(msgType, from, to, netName string) {
+    key, a, b := sessionKey(netName, from, to)
+    now := nowMs()
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    ss := t.sessions[key]
+    if msgType == "offer" && (ss == nil || ss.initiator != from || ss.state != sessionOffered) {
+        if ss == nil {
+            t.statsFor(netName).Started++
+        }
+        ss = &signalingSession{a: a, b: b, initiator: from, networkName: netName, state: sessionOffered, startedAt: now}
+        t.sessions[key] = ss
+    }
+    if ss == nil {
+        return
+    }
+    ss.lastAt = now
+    switch msgType {
+    case "answer":
+        if ss.state == sessionOffered {
+            ss.state = sessionAnswered
+        }
+    case "ice-candidate":
+        if ss.state == sessionOffered {
+            return
+        }
+        if from == ss.a {
+            ss.candidatesA = true
+        } else {
+            ss.candidatesB = true
+        }
+        ss.state = sessionConnecting
+        if ss.candidatesA && ss.candidatesB {
+            ss.state = sessionConnected
+        }
+    }
+}
+
+// sweep completes sessions where both peers exchanged candidates and
+// returns those that timed out short of that.
+func (t *signalingTracker) sweep(now, timeoutMs int64) []*signalingSession {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    failed := []*signalingSession{}
+    for key, ss := range t.sessions {
+        switch {
+        case ss.state == sessionConnected:
+            t.statsFor(ss.networkName).Completed++
+            t.endLocked(key, ss, now)
+        case now-ss.startedAt >= timeoutMs:
+            t.statsFor(ss.networkName).Failed++
+            t.endLocked(key, ss, now)
+            failed = append(failed, ss)
+        }
+    }
+    for key, ss := range t.ended {
+        if now-ss.lastAt >= reportCooldownMs {
+            delete(t.ended, key)
+        }
+    }
+    return failed
+}
+
+func (t *signalingTracker) endLocked(key string, ss *signalingSession, now int64) {
+    delete(t.sessions, key)
+    t.ended[key] = &signalingSession{a: ss.a, b: ss.b, initiator: ss.initiator, networkName: ss.networkName, state: ss.state, startedAt: ss.startedAt, lastAt: now}
+}
+
+// signaled reports whether from and to have a signaling session on netName,
+// or had one that ended within reportCooldownMs.
+func (t *signalingTracker) signaled(netName, from, to string, now int64) bool {
+    key, _, _ := sessionKey(netName, from, to)
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if t.sessions[key] != nil {
+        return true
+    }
+    ss := t.ended[key]
+    return ss != nil && now-ss.lastAt < reportCooldownMs
+}
+
+func (t *signalingTracker) snapshot() map[string]interface{} {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    active := map[string]int{}
+    for _, ss := range t.sessions {
+        active[ss.networkName]++
+    }
+    networks := map[string]interface{}{}
+    for name, st := range t.stats {
+        rate := 0.0
+        if done := st.Completed + st.Failed; done > 0 {
+            rate = float64(st.Completed) / float64(done)
+        }
+        networks[name] = map[string]interface{}{"active": active[name], "started": st.Started, "completed": st.Completed, "failed": st.Failed, "completion_rate": rate}
+    }
+    return map[string]interface{}{"active": len(t.sessions), "networks": networks}
+}
+
+// runSignalingSweeper checks for stalled sessions once a second.
+func (s *Server) runSignalingSweeper() {
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+    for range ticker.C {
+        if !s.running {
+            return
+        }
+        for _, ss := range s.signaling.sweep(nowMs(), int64(s.opts.SignalingTimeoutMs)) {
+            for _, id := range []string{ss.a, ss.b} {
+                other := ss.b
+                if id == ss.b {
+                    other = ss.a
+                }
+                s.forwardToLocalTarget(id, outboundMessage{Type: "signaling-timeout", Data: map[string]interface{}{"peerId": other, "initiator": ss.initiator, "state": ss.state, "startedAt": ss.startedAt}, FromPeerId: "system", TargetPeer: id, NetworkName: ss.networkName, Timestamp: nowMs()})
+            }
+        }
+    }
+}
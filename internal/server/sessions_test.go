@@ -0,0 +1,35 @@
+package server
+
+import "testing"
+
+func TestSignalingSessionsCompleteOrTimeOut(t *testing.T) {
+    tr := newSignalingTracker()
+    tr.observe("offer", "a", "b", "global")
+    tr.observe("answer", "b", "a", "global")
+    tr.observe("ice-candidate", "a", "b", "global")
+    tr.observe("ice-candidate", "b", "a", "global")
+    tr.observe("offer", "a", "c", "global")
+    // a<->d is answered but only one side ever sends candidates.
+    tr.observe("offer", "a", "d", "global")
+    tr.observe("answer", "d", "a", "global")
+    tr.observe("ice-candidate", "a", "d", "global")
+    tr.observe("ice-candidate", "a", "d", "global")
+    if failed := tr.sweep(nowMs(), 30000); len(failed) != 0 {
+        t.Fatalf("nothing should fail yet, got %d", len(failed))
+    }
+    if active := tr.snapshot()["active"].(int); active != 2 {
+        t.Fatalf("a<->b should have completed, leaving 2 active, got %d", active)
+    }
+    failed := tr.sweep(nowMs()+30000, 30000)
+    stalled := map[string]string{}
+    for _, ss := range failed {
+        stalled[ss.b] = ss.state
+    }
+    if len(failed) != 2 || stalled["c"] != sessionOffered || stalled["d"] != sessionConnecting {
+        t.Fatalf("expected a<->c and the one-sided a<->d to time out, got %v", stalled)
+    }
+    net := tr.snapshot()["networks"].(map[string]interface{})["global"].(map[string]interface{})
+    if net["completed"].(int64) != 1 || net["failed"].(int64) != 2 || net["completion_rate"].(float64) != 1.0/3 {
+        t.Fatalf("unexpected stats %v", net)
+    }
+}
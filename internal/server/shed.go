@@ -0,0 +1,175 @@
+package server
+
+import (
+    "net/http"
+    "runtime/metrics"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+// Load shedding. With ShedCPUPercent or ShedQueueDepth set, the hub samples
+// its CPU use and work queue once a second. When either crosses its
+// threshold the hub turns degraded and stops doing the work it can skip
+// without breaking connectivity:
+//
+//     stats          new /admin/tail subscriptions and mesh stats gossip
+//     app-broadcast  app-broadcast messages from local peers
+//     discovery      re-announces on the same network (the rebroadcast and
+//                    peer list resend) and events-since replays
+//
+// Signaling, pings, first announces, network switches and disconnects are
+// never shed. The hub recovers once both readings fall below 80% of their
+// thresholds, so it does not flap around the line.
+const (
+    shedStats        = "stats"
+    shedAppBroadcast = "app-broadcast"
+    shedDiscovery    = "discovery"
+
+    errHubOverloaded = "hub-overloaded"
+
+    shedSampleInterval = time.Second
+    shedRecoverRatio   = 0.8
+)
+
+type loadShedder struct {
+    degraded int32
+    inflight int64
+
+    mu       sync.Mutex
+    cpu      float64
+    queue    int
+    since    int64
+    episodes int64
+    shed     map[string]int64
+    lastBusy float64
+    lastAll  float64
+}
+
+func newLoadShedder() *loadShedder {
+    return &loadShedder{shed: map[string]int64{}}
+}
+
+// cpuPercent is the share of the process's available CPU time spent busy
+// since the previous call, from the runtime's own accounting.
+func (l *loadShedder) cpuPercent() float64 {
+    samples := []metrics.Sample{{Name: "/cpu/classes/total:cpu-seconds"}, {Name: "/cpu/classes/idle:cpu-seconds"}}
+    metrics.Read(samples)
+    if samples[0].Value.Kind() != metrics.KindFloat64 || samples[1].Value.Kind() != metrics.KindFloat64 {
+        return 0
+    }
+    all := samples[0].Value.Float64()
+    busy := all - samples[1].Value.Float64()
+    dAll, dBusy := all-l.lastAll, busy-l.lastBusy
+    l.lastAll, l.lastBusy = all, busy
+    if dAll <= 0 {
+        return 0
+    }
+    return 100 * dBusy / dAll
+}
+
+// queueDepth is the number of inbound messages being handled plus the
+// cross-hub discoveries waiting for pacing.
+func (s *Server) queueDepth() int {
+    n := int(atomic.LoadInt64(&s.shedder.inflight))
+    for _, q := range s.pacer.backlog() {
+        n += q
+    }
+    return n
+}
+
+// updateLoad records a sample and moves the hub in or out of degraded mode.
+func (s *Server) updateLoad(cpu float64, queue int) {
+    l := s.shedder
+    cpuLimit, queueLimit := float64(s.opts.ShedCPUPercent), s.opts.ShedQueueDepth
+    over := (cpuLimit > 0 && cpu >= cpuLimit) || (queueLimit > 0 && queue >= queueLimit)
+    clear := (cpuLimit <= 0 || cpu < cpuLimit*shedRecoverRatio) && (queueLimit <= 0 || float64(queue) < float64(queueLimit)*shedRecoverRatio)
+    l.mu.Lock()
+    l.cpu, l.queue = cpu, queue
+    degraded := atomic.LoadInt32(&l.degraded) == 1
+    switch {
+    case over && !degraded:
+        atomic.StoreInt32(&l.degraded, 1)
+        l.since = nowMs()
+        l.episodes++
+    case clear && degraded:
+        atomic.StoreInt32(&l.degraded, 0)
+        l.since = 0
+    default:
+        l.mu.Unlock()
+        return
+    }
+    l.mu.Unlock()
+    if over {
+        s.log.Warn("load_shedding_started", map[string]interface{}{"cpuPercent": cpu, "queueDepth": queue})
+    } else {
+        s.log.Info("load_shedding_stopped", map[string]interface{}{"cpuPercent": cpu, "queueDepth": queue})
+    }
+}
+
+func (s *Server) runLoadShedder() {
+    ticker := time.NewTicker(shedSampleInterval)
+    defer ticker.Stop()
+    s.shedder.cpuPercent()
+    for range ticker.C {
+        if !s.running {
+            return
+        }
+        s.updateLoad(s.shedder.cpuPercent(), s.queueDepth())
+    }
+}
+
+// degraded reports whether low-priority work is being shed, for load or
+// for resource pressure.
+func (s *Server) degraded() bool {
+    return atomic.LoadInt32(&s.shedder.degraded) == 1 || s.underPressure()
+}
+
+// shedding reports whether work of class should be skipped now, counting it
+// if so.
+func (s *Server) shedding(class string) bool {
+    if !s.degraded() {
+        return false
+    }
+    s.shedder.mu.Lock()
+    s.shedder.shed[class]++
+    s.shedder.mu.Unlock()
+    return true
+}
+
+// rejectShed tells a peer its message was shed so it can retry later.
+func (s *Server) rejectShed(peerId, msgType string) {
+    s.sendToConn(s.getConn(peerId), outboundMessage{Type: "error", Data: map[string]interface{}{"code": errHubOverloaded, "message": "hub overloaded, " + msgType + " shed", "retryAfterMs": shedSampleInterval.Milliseconds()}, FromPeerId: "system", TargetPeer: peerId, NetworkName: "global", Timestamp: nowMs()})
+}
+
+// refuseShedStats answers an HTTP stats subscription while degraded.
+func (s *Server) refuseShedStats(c *gin.Context) bool {
+    if !s.shedding(shedStats) {
+        return false
+    }
+    c.Writer.Header().Set("Retry-After", "5")
+    writeJSON(c.Writer, http.StatusServiceUnavailable, map[string]interface{}{"error": "hub overloaded"}, s.opts.CORSOrigin)
+    return true
+}
+
+func (s *Server) shedSnapshot() map[string]interface{} {
+    l := s.shedder
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    shed := make(map[string]int64, len(l.shed))
+    for k, v := range l.shed {
+        shed[k] = v
+    }
+    return map[string]interface{}{
+        "enabled":         s.opts.ShedCPUPercent > 0 || s.opts.ShedQueueDepth > 0,
+        "degraded":        atomic.LoadInt32(&l.degraded) == 1,
+        "degraded_since":  l.since,
+        "episodes":        l.episodes,
+        "cpu_percent":     l.cpu,
+        "queue_depth":     l.queue,
+        "cpu_threshold":   s.opts.ShedCPUPercent,
+        "queue_threshold": s.opts.ShedQueueDepth,
+        "shed":            shed,
+    }
+}
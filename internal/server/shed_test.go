@@ -0,0 +1,71 @@
+package server
+
+import (
+    "encoding/json"
+    "fmt"
+    "testing"
+    "time"
+)
+
+func TestLoadSheddingKeepsSignaling(t *testing.T) {
+    s := NewServer(Options{ShedQueueDepth: 10, AppBroadcastNetworks: []string{"*"}, EventReplaySize: 10})
+    a, b := randomPeerId(), randomPeerId()
+    conns := map[string]*pollConn{}
+    for _, id := range []string{a, b} {
+        conns[id] = attachTestPeer(t, s, id)
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"lobby","data":{}}`))
+    }
+    // received returns the types id was sent, with error codes inline.
+    received := func(id string) []string {
+        msgs, _ := conns[id].take(20 * time.Millisecond)
+        var out []string
+        for _, raw := range msgs {
+            var m outboundMessage
+            json.Unmarshal(raw, &m)
+            if d, ok := m.Data.(map[string]interface{}); ok && m.Type == "error" {
+                out = append(out, "error:"+fmt.Sprint(d["code"]))
+                continue
+            }
+            out = append(out, m.Type)
+        }
+        return out
+    }
+    received(a)
+    received(b)
+
+    s.updateLoad(0, 12)
+    if !s.degraded() {
+        t.Fatalf("queue over the threshold should degrade the hub")
+    }
+    s.handleMessage(a, []byte(`{"type":"app-broadcast","networkName":"lobby","data":{"x":1}}`))
+    s.handleMessage(a, []byte(`{"type":"events-since","networkName":"lobby","data":{"cursor":0}}`))
+    s.handleMessage(a, []byte(`{"type":"announce","networkName":"lobby","data":{"status":"busy"}}`))
+    s.handleMessage(a, []byte(`{"type":"offer","targetPeerId":"`+b+`","networkName":"lobby","data":{"sdp":"v=0"}}`))
+    s.handleMessage(a, []byte(`{"type":"ping"}`))
+    if got := received(a); fmt.Sprint(got) != "[error:hub-overloaded error:hub-overloaded pong]" {
+        t.Fatalf("sender should see two shed errors and its pong, got %v", got)
+    }
+    if got := received(b); fmt.Sprint(got) != "[offer]" {
+        t.Fatalf("only the offer should reach b while degraded, got %v", got)
+    }
+    if pi := s.getPeerInfo(a); pi.Data["status"] != "busy" {
+        t.Fatalf("a shed re-announce should still update the peer's data")
+    }
+
+    s.updateLoad(0, 9)
+    if !s.degraded() {
+        t.Fatalf("hub should stay degraded until the queue falls below 80%% of the threshold")
+    }
+    s.updateLoad(0, 7)
+    if s.degraded() {
+        t.Fatalf("hub should recover once the queue drains")
+    }
+    s.handleMessage(a, []byte(`{"type":"app-broadcast","networkName":"lobby","data":{"x":2}}`))
+    if got := received(b); fmt.Sprint(got) != "[app-broadcast]" {
+        t.Fatalf("app-broadcast should flow again after recovery, got %v", got)
+    }
+    shed := s.shedSnapshot()
+    if counts := shed["shed"].(map[string]int64); counts[shedAppBroadcast] != 1 || counts[shedDiscovery] != 2 || shed["episodes"] != int64(1) {
+        t.Fatalf("unexpected shed counters %v", shed)
+    }
+}
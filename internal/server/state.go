@@ -0,0 +1,171 @@
+package server
+
+import (
+    "encoding/json"
+    "time"
+)
+
+// Hub state persistence. Peers, hub registrations and the cross-hub cache
+// live in memory, so a restarted hub knows no remote peers until gossip
+// refills its cache, and peers joining in the meantime discover nobody on
+// other hubs. With StateStorePath set, the hub saves a snapshot of that
+// state to the Store every StatePersistIntervalMs and on Stop, and restores
+// the cross-hub cache from it at startup when the snapshot is younger than
+// StateMaxAgeMs. Its own former local peers are not restored: they reconnect
+// and announce again. Replicas sharing a Store (e.g. Redis) save under their
+// own keys and can warm-start from each other with StateSeedKeys: the local
+// peers and cache in each seed snapshot are loaded as cross-hub peers.
+// Restored entries are replaced or removed by gossip as usual.
+
+// hubState is the snapshot saved under StateStorePath.
+type hubState struct {
+    SavedAt       int64                                        `json:"savedAt"`
+    HubPeerId     string                                       `json:"hubPeerId"`
+    Peers         []savedPeer                                  `json:"peers"`
+    Hubs          []hubInfo                                    `json:"hubs"`
+    CrossHubCache map[string]map[string]map[string]interface{} `json:"crossHubCache"`
+}
+
+type savedPeer struct {
+    PeerId      string                 `json:"peerId"`
+    NetworkName string                 `json:"networkName"`
+    Data        map[string]interface{} `json:"data,omitempty"`
+    AnnouncedAt int64                  `json:"announcedAt"`
+}
+
+// restoredState records what startup restored, for /stats. Hubs lists the
+// hub links registered when the hub's own snapshot was taken; they are
+// expected to reconnect.
+type restoredState struct {
+    SavedAt     int64    `json:"savedAt"`
+    CachedPeers int      `json:"cachedPeers"`
+    Seeds       int      `json:"seeds"`
+    Hubs        []string `json:"hubs"`
+}
+
+func (s *Server) snapshotState() hubState {
+    st := hubState{SavedAt: nowMs(), HubPeerId: s.hubPeerId, Peers: []savedPeer{}, Hubs: []hubInfo{}, CrossHubCache: map[string]map[string]map[string]interface{}{}}
+    s.peersMu.Lock()
+    for _, pi := range s.peerData {
+        if pi.Announced && !pi.IsHub && !pi.Monitor && !hiddenPeer(pi.Data) {
+            st.Peers = append(st.Peers, savedPeer{PeerId: pi.PeerId, NetworkName: pi.NetworkName, Data: pi.Data, AnnouncedAt: pi.AnnouncedAt})
+        }
+    }
+    s.peersMu.Unlock()
+    s.hubsMu.Lock()
+    for _, h := range s.hubs {
+        st.Hubs = append(st.Hubs, *h)
+    }
+    s.hubsMu.Unlock()
+    s.bootstrapMu.Lock()
+    for netName, cache := range s.crossHubCache {
+        st.CrossHubCache[netName] = make(map[string]map[string]interface{}, len(cache))
+        for id, data := range cache {
+            st.CrossHubCache[netName][id] = data
+        }
+    }
+    s.bootstrapMu.Unlock()
+    return st
+}
+
+func (s *Server) saveState() {
+    if s.opts.StateStorePath == "" {
+        return
+    }
+    b, err := json.Marshal(s.snapshotState())
+    if err == nil {
+        err = s.opts.Store.Save(s.opts.StateStorePath, b)
+    }
+    if err != nil {
+        s.log.Warn("state_save_failed", map[string]interface{}{"key": s.opts.StateStorePath, "error": err.Error()})
+    }
+}
+
+func (s *Server) loadState(key string) (hubState, bool) {
+    var st hubState
+    b, err := s.opts.Store.Load(key)
+    if err == nil && b != nil {
+        err = json.Unmarshal(b, &st)
+    }
+    if err != nil {
+        s.log.Warn("state_restore_failed", map[string]interface{}{"key": key, "error": err.Error()})
+        return st, false
+    }
+    if b == nil || nowMs()-st.SavedAt > int64(s.opts.StateMaxAgeMs) {
+        return st, false
+    }
+    return st, true
+}
+
+// restoreState fills the cross-hub cache from the hub's own snapshot and
+// any seed snapshots.
+func (s *Server) restoreState() {
+    if s.opts.StateStorePath == "" && len(s.opts.StateSeedKeys) == 0 {
+        return
+    }
+    r := &restoredState{Hubs: []string{}}
+    add := func(netName, id string, data map[string]interface{}) {
+        if id == s.hubPeerId {
+            return
+        }
+        if _, ok := s.crossHubCache[netName]; !ok {
+            s.crossHubCache[netName] = map[string]map[string]interface{}{}
+        }
+        if _, ok := s.crossHubCache[netName][id]; !ok {
+            r.CachedPeers++
+        }
+        s.crossHubCache[netName][id] = data
+        s.remoteIndex.put(netName, id, data)
+    }
+    merge := func(st hubState, withPeers bool) {
+        if st.SavedAt > r.SavedAt {
+            r.SavedAt = st.SavedAt
+        }
+        for netName, cache := range st.CrossHubCache {
+            for id, data := range cache {
+                add(netName, id, data)
+            }
+        }
+        if withPeers {
+            for _, p := range st.Peers {
+                add(p.NetworkName, p.PeerId, p.Data)
+            }
+        }
+    }
+    s.bootstrapMu.Lock()
+    if key := s.opts.StateStorePath; key != "" {
+        if st, ok := s.loadState(key); ok {
+            merge(st, false)
+            for _, h := range st.Hubs {
+                r.Hubs = append(r.Hubs, h.PeerId)
+            }
+        }
+    }
+    for _, key := range s.opts.StateSeedKeys {
+        if key == s.opts.StateStorePath {
+            continue
+        }
+        if st, ok := s.loadState(key); ok {
+            merge(st, true)
+            r.Seeds++
+        }
+    }
+    s.bootstrapMu.Unlock()
+    s.restored = r
+    if r.CachedPeers > 0 {
+        s.log.Info("state_restored", map[string]interface{}{"key": s.opts.StateStorePath, "cachedPeers": r.CachedPeers, "seeds": r.Seeds, "savedAt": r.SavedAt})
+    }
+}
+
+// runStatePersistence saves the state every StatePersistIntervalMs; Stop
+// saves it once more before disconnecting peers.
+func (s *Server) runStatePersistence() {
+    ticker := time.NewTicker(time.Duration(s.opts.StatePersistIntervalMs) * time.Millisecond)
+    defer ticker.Stop()
+    for range ticker.C {
+        if !s.running {
+            return
+        }
+        s.saveState()
+    }
+}
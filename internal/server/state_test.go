@@ -0,0 +1,38 @@
+package server
+
+import (
+    "testing"
+    "time"
+)
+
+func TestHubStateRestoresCrossHubCache(t *testing.T) {
+    st := &memStore{docs: map[string][]byte{}}
+    a := NewServer(Options{MaxConnections: 10, Store: st, StateStorePath: "state-a"})
+    local, remote := randomPeerId(), randomPeerId()
+    attachTestPeer(t, a, local)
+    a.handleMessage(local, []byte(`{"type":"announce","networkName":"game","data":{"name":"local"}}`))
+    a.cacheCrossHubPeer("game", remote, map[string]interface{}{"name": "remote"})
+    a.Stop()
+
+    // The same hub after a restart: the cache is back, its own peers are not.
+    b := NewServer(Options{MaxConnections: 10, Store: st, StateStorePath: "state-a"})
+    if _, ok := b.crossHubCache["game"][remote]; !ok || len(b.crossHubCache["game"]) != 1 {
+        t.Fatalf("expected only the remote peer restored, got %v", b.crossHubCache)
+    }
+    if b.restored == nil || b.restored.CachedPeers != 1 {
+        t.Fatalf("unexpected restore report %+v", b.restored)
+    }
+
+    // A replica seeded from a's snapshot also learns a's local peers.
+    c := NewServer(Options{MaxConnections: 10, Store: st, StateStorePath: "state-c", StateSeedKeys: []string{"state-a"}})
+    if data := c.crossHubCache["game"][local]; data["name"] != "local" || len(c.crossHubCache["game"]) != 2 || c.restored.Seeds != 1 {
+        t.Fatalf("expected both peers from the seed, got %v", c.crossHubCache)
+    }
+
+    // Stale snapshots are ignored.
+    time.Sleep(5 * time.Millisecond)
+    stale := NewServer(Options{MaxConnections: 10, Store: st, StateStorePath: "state-a", StateMaxAgeMs: 1})
+    if len(stale.crossHubCache) != 0 {
+        t.Fatalf("a stale snapshot should not be restored, got %v", stale.crossHubCache)
+    }
+}
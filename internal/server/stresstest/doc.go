@@ -0,0 +1,8 @@
+// Package stresstest hammers an in-process hub with concurrent announces,
+// network switches, disconnects, reconnects and mesh churn, driving it only
+// through its public API: server.NewServer, Serve and the HTTP, WebSocket
+// and admin endpoints. The tests are behind the stress build tag; run them
+// under the race detector:
+//
+//	go test -race -tags stress ./internal/server/stresstest/
+package stresstest
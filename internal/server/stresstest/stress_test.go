@@ -0,0 +1,387 @@
+//go:build stress
+
+package stresstest
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"math/rand"
+	"net"
+	"net/http"
+	"peerpigeon/internal/server"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	adminToken = "stress-admin"
+	meshToken  = "stress-mesh"
+)
+
+type hub struct {
+	s    *server.Server
+	http string
+	ws   string
+}
+
+func startHub(t *testing.T) *hub {
+	gin.SetMode(gin.TestMode)
+	s := server.NewServer(server.Options{MaxConnections: 1000, PeerTimeoutMs: 60000, CleanupIntervalMs: 100, CORSOrigin: "*", EventReplaySize: 50, AdminToken: adminToken, MeshToken: meshToken})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Stop() })
+	h := &hub{s: s, http: "http://" + ln.Addr().String(), ws: "ws://" + ln.Addr().String()}
+	waitFor(t, "the hub to serve /health", func() bool {
+		resp, err := http.Get(h.http + "/health")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+	return h
+}
+
+// admin calls the admin API and decodes its answer into out.
+func (h *hub) admin(t *testing.T, method, path string, out interface{}) {
+	req, _ := http.NewRequest(method, h.http+path, nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("%s %s: %v", method, path, err)
+		return
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		json.NewDecoder(resp.Body).Decode(out)
+	}
+}
+
+type adminPeers struct {
+	Peers []struct {
+		PeerId      string `json:"peerId"`
+		NetworkName string `json:"networkName"`
+		Announced   bool   `json:"announced"`
+	} `json:"peers"`
+}
+
+type adminNetworks struct {
+	Networks []struct {
+		Name  string `json:"name"`
+		Peers int    `json:"peers"`
+	} `json:"networks"`
+}
+
+func (h *hub) peers(t *testing.T) adminPeers {
+	var out adminPeers
+	h.admin(t, http.MethodGet, "/admin/peers", &out)
+	return out
+}
+
+func (h *hub) networks(t *testing.T) adminNetworks {
+	var out adminNetworks
+	h.admin(t, http.MethodGet, "/admin/networks", &out)
+	return out
+}
+
+func (h *hub) hasPeer(t *testing.T, id string) bool {
+	for _, p := range h.peers(t).Peers {
+		if p.PeerId == id {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNetworkInvariants verifies, while the hub is quiet, that every
+// network's member count matches the announced peers that name it, so no
+// peer is in two networks or in one its peer info does not say.
+func checkNetworkInvariants(t *testing.T, h *hub) {
+	claimed := map[string]int{}
+	for _, p := range h.peers(t).Peers {
+		if p.Announced {
+			claimed[p.NetworkName]++
+		}
+	}
+	for _, n := range h.networks(t).Networks {
+		if claimed[n.Name] != n.Peers {
+			t.Errorf("network %s has %d members but %d announced peers name it", n.Name, n.Peers, claimed[n.Name])
+		}
+		delete(claimed, n.Name)
+	}
+	for name, n := range claimed {
+		if name != "" {
+			t.Errorf("%d announced peers name network %s, which has no members", n, name)
+		}
+	}
+}
+
+func randomPeerId() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func stressRounds(n int) int {
+	if testing.Short() {
+		return n / 5
+	}
+	return n
+}
+
+type stressPeer struct {
+	id   string
+	conn *websocket.Conn
+	wmu  sync.Mutex
+
+	mu         sync.Mutex
+	discovered []stressDiscovery
+	pongs      int
+}
+
+type stressDiscovery struct {
+	peerId string
+	at     time.Time
+}
+
+func dialPeer(t *testing.T, h *hub) *stressPeer {
+	p := &stressPeer{id: randomPeerId()}
+	c, _, err := websocket.DefaultDialer.Dial(h.ws+"/ws?peerId="+p.id, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	p.conn = c
+	go func() {
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg struct {
+				Type string                 `json:"type"`
+				Data map[string]interface{} `json:"data"`
+			}
+			if json.Unmarshal(data, &msg) != nil {
+				continue
+			}
+			if msg.Type == "pong" {
+				p.mu.Lock()
+				p.pongs++
+				p.mu.Unlock()
+				continue
+			}
+			if msg.Type != "peer-discovered" {
+				continue
+			}
+			id, _ := msg.Data["peerId"].(string)
+			p.mu.Lock()
+			p.discovered = append(p.discovered, stressDiscovery{id, time.Now()})
+			p.mu.Unlock()
+		}
+	}()
+	return p
+}
+
+func (p *stressPeer) send(msg map[string]interface{}) {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	p.conn.WriteJSON(msg)
+}
+
+func (p *stressPeer) announce(netName string) {
+	p.send(map[string]interface{}{"type": "announce", "networkName": netName, "data": map[string]interface{}{"peerId": p.id}})
+}
+
+// roundTrip pings the hub and waits for the pong. Since the hub handles a
+// peer's messages in order and the read loop is sequential, everything the
+// hub wrote to this peer before answering has been read once it returns.
+func (p *stressPeer) roundTrip(t *testing.T) {
+	p.mu.Lock()
+	n := p.pongs
+	p.mu.Unlock()
+	p.send(map[string]interface{}{"type": "ping"})
+	waitFor(t, "pong", func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.pongs > n
+	})
+}
+
+func (p *stressPeer) discoveredAfter(peerId string, t time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, d := range p.discovered {
+		if d.peerId == peerId && d.at.After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialHubLink opens a /mesh link the way another hub would and announces
+// it on the hub namespace.
+func dialHubLink(t *testing.T, h *hub) *websocket.Conn {
+	c, _, err := websocket.DefaultDialer.Dial(h.ws+"/mesh?peerId="+randomPeerId(), http.Header{"Authorization": {"Bearer " + meshToken}})
+	if err != nil {
+		t.Fatalf("dial mesh: %v", err)
+	}
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	c.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "pigeonhub-mesh", "data": map[string]interface{}{"isHub": true}})
+	return c
+}
+
+func TestStressAnnounceSwitchDisconnect(t *testing.T) {
+	h := startHub(t)
+	networks := []string{"global", "net-a", "net-b"}
+	rounds := stressRounds(50)
+
+	peers := make([]*stressPeer, 20)
+	for i := range peers {
+		peers[i] = dialPeer(t, h)
+	}
+	link := dialHubLink(t, h)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	// Mesh churn: remote discoveries, erasures and cleanup passes race the
+	// local peers.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			id := randomPeerId()
+			netName := networks[rand.Intn(len(networks))]
+			link.WriteJSON(map[string]interface{}{"type": "peer-discovered", "networkName": netName, "data": map[string]interface{}{"peerId": id}})
+			h.admin(t, http.MethodPost, "/admin/erase/"+id, nil)
+		}
+	}()
+	for i, p := range peers {
+		wg.Add(1)
+		// Only peers that are about to leave say goodbye; survivors must
+		// still be registered for the checks below.
+		go func(p *stressPeer, leaving bool) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				p.announce(networks[rand.Intn(len(networks))])
+				if leaving && rand.Intn(10) == 0 {
+					p.send(map[string]interface{}{"type": "goodbye"})
+					p.announce(networks[0])
+				}
+			}
+		}(p, i < 10)
+	}
+	for _, p := range peers[:10] {
+		wg.Add(1)
+		go func(p *stressPeer) {
+			defer wg.Done()
+			time.Sleep(time.Duration(rand.Intn(20)) * time.Millisecond)
+			p.conn.Close()
+		}(p)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	gone := peers[:10]
+	waitFor(t, "closed peers to be cleaned up", func() bool {
+		for _, p := range gone {
+			if h.hasPeer(t, p.id) {
+				return false
+			}
+		}
+		return true
+	})
+	// Two ping rounds flush what the hub was still writing to survivors.
+	for round := 0; round < 2; round++ {
+		for _, p := range peers[10:] {
+			p.roundTrip(t)
+		}
+	}
+	checkNetworkInvariants(t, h)
+
+	// No discovery after disconnect: survivors keep announcing but must never
+	// learn about a peer that has already been cleaned up.
+	cleanedAt := time.Now()
+	for _, p := range peers[10:] {
+		for _, netName := range networks {
+			p.announce(netName)
+		}
+	}
+	for _, p := range peers[10:] {
+		p.roundTrip(t)
+	}
+	for _, p := range peers[10:] {
+		for _, g := range gone {
+			if p.discoveredAfter(g.id, cleanedAt) {
+				t.Errorf("peer %s discovered %s after it disconnected", p.id[:8], g.id[:8])
+			}
+		}
+	}
+	checkNetworkInvariants(t, h)
+
+	for _, p := range peers[10:] {
+		p.conn.Close()
+	}
+	link.Close()
+	// No map writes after cleanup: once every connection is gone, the hub
+	// must list no peers and no networks, and keep it that way.
+	waitFor(t, "all peers to be cleaned up", func() bool { return len(h.peers(t).Peers) == 0 })
+	time.Sleep(200 * time.Millisecond)
+	if peers, nets := h.peers(t), h.networks(t); len(peers.Peers) != 0 || len(nets.Networks) != 0 {
+		t.Fatalf("expected empty tables after cleanup, got %d peers and %d networks", len(peers.Peers), len(nets.Networks))
+	}
+}
+
+func TestStressReconnectSamePeerId(t *testing.T) {
+	h := startHub(t)
+	id := randomPeerId()
+	var wg sync.WaitGroup
+	for i := 0; i < stressRounds(20); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, _, err := websocket.DefaultDialer.Dial(h.ws+"/ws?peerId="+id, nil)
+			if err != nil {
+				return
+			}
+			c.WriteJSON(map[string]interface{}{"type": "announce", "networkName": fmt.Sprintf("net-%d", rand.Intn(3))})
+			time.Sleep(time.Duration(rand.Intn(10)) * time.Millisecond)
+			c.Close()
+		}()
+	}
+	wg.Wait()
+	waitFor(t, "the reconnecting peer to be cleaned up", func() bool { return !h.hasPeer(t, id) })
+	time.Sleep(50 * time.Millisecond)
+	checkNetworkInvariants(t, h)
+	if nets := h.networks(t); len(nets.Networks) != 0 {
+		t.Fatalf("networks outlived every connection for %s: %+v", id[:8], nets.Networks)
+	}
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+// Live tail. Every structured log line the hub writes, plus a handful of
+// lifecycle events that are too frequent to log (peer_connected,
+// peer_announced, peer_disconnected, signal_relayed, admin_action), is fanned
+// out to /admin/tail subscribers. Filtering happens on the hub so a tail of
+// one peer on a busy hub only costs the matching frames:
+//
+//     GET /admin/tail?level=warn&event=peer_disconnected,sender_mismatch
+//                    &peerId=3fa1&network=game
+//
+// A subscriber that falls behind loses entries rather than slowing the hub;
+// the next frame it gets is a tail_dropped notice with the count.
+const (
+    tailKindLog   = "log"
+    tailKindEvent = "event"
+
+    tailSubBuffer = 512
+)
+
+var tailLevels = map[string]int{"DEBUG": 0, "INFO": 1, "WARN": 2, "ERROR": 3}
+
+// TailEntry is one frame of the live tail.
+type TailEntry struct {
+    Timestamp int64                  `json:"timestamp"`
+    Level     string                 `json:"level"`
+    Kind      string                 `json:"kind"`
+    Message   string                 `json:"message"`
+    Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// tailFilter selects entries for one subscriber. Empty fields match
+// everything; peerId matches any peer-ish field by prefix.
+type tailFilter struct {
+    minLevel int
+    events   map[string]bool
+    peerId   string
+    network  string
+}
+
+var tailPeerFields = []string{"peerId", "fromPeerId", "targetPeerId", "hubPeerId", "claimedFromPeerId"}
+
+func (f tailFilter) match(e TailEntry) bool {
+    if tailLevels[e.Level] < f.minLevel {
+        return false
+    }
+    if len(f.events) > 0 && !f.events[e.Message] {
+        return false
+    }
+    if f.network != "" {
+        n, _ := e.Fields["networkName"].(string)
+        if n == "" {
+            n, _ = e.Fields["network"].(string)
+        }
+        if n != f.network {
+            return false
+        }
+    }
+    if f.peerId != "" {
+        for _, k := range tailPeerFields {
+            if v, _ := e.Fields[k].(string); v != "" && strings.HasPrefix(v, f.peerId) {
+                return true
+            }
+        }
+        return false
+    }
+    return true
+}
+
+type tailSub struct {
+    filter  tailFilter
+    ch      chan TailEntry
+    dropped int64
+}
+
+type logTail struct {
+    mu     sync.Mutex
+    subs   map[*tailSub]struct{}
+    active int32
+
+    published int64
+    dropped   int64
+}
+
+func newLogTail() *logTail {
+    return &logTail{subs: map[*tailSub]struct{}{}}
+}
+
+// watching reports whether anyone is tailing, so callers can skip building
+// event fields on an idle hub.
+func (t *logTail) watching() bool {
+    return atomic.LoadInt32(&t.active) > 0
+}
+
+func (t *logTail) publish(e TailEntry) {
+    if !t.watching() {
+        return
+    }
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    t.published++
+    for sub := range t.subs {
+        if !sub.filter.match(e) {
+            continue
+        }
+        select {
+        case sub.ch <- e:
+        default:
+            atomic.AddInt64(&sub.dropped, 1)
+            t.dropped++
+        }
+    }
+}
+
+func (t *logTail) subscribe(f tailFilter) *tailSub {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    sub := &tailSub{filter: f, ch: make(chan TailEntry, tailSubBuffer)}
+    t.subs[sub] = struct{}{}
+    atomic.StoreInt32(&t.active, int32(len(t.subs)))
+    return sub
+}
+
+func (t *logTail) unsubscribe(sub *tailSub) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    delete(t.subs, sub)
+    atomic.StoreInt32(&t.active, int32(len(t.subs)))
+}
+
+func (t *logTail) snapshot() map[string]interface{} {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return map[string]interface{}{"subscribers": len(t.subs), "published": t.published, "dropped": t.dropped}
+}
+
+// tailLogger passes log calls through to the configured Logger and copies
+// them to the live tail.
+type tailLogger struct {
+    next Logger
+    tail *logTail
+}
+
+func (l tailLogger) emit(level, message string, fields map[string]interface{}) {
+    l.tail.publish(TailEntry{Timestamp: nowMs(), Level: level, Kind: tailKindLog, Message: message, Fields: fields})
+}
+
+func (l tailLogger) Debug(message string, fields map[string]interface{}) {
+    l.next.Debug(message, fields)
+    l.emit("DEBUG", message, fields)
+}
+
+func (l tailLogger) Info(message string, fields map[string]interface{}) {
+    l.next.Info(message, fields)
+    l.emit("INFO", message, fields)
+}
+
+func (l tailLogger) Warn(message string, fields map[string]interface{}) {
+    l.next.Warn(message, fields)
+    l.emit("WARN", message, fields)
+}
+
+func (l tailLogger) Error(message string, fields map[string]interface{}) {
+    l.next.Error(message, fields)
+    l.emit("ERROR", message, fields)
+}
+
+// emitEvent publishes a lifecycle event to the live tail only. fields is
+// built lazily because most hubs have nobody tailing.
+func (s *Server) emitEvent(name string, fields func() map[string]interface{}) {
+    if !s.tail.watching() {
+        return
+    }
+    s.tail.publish(TailEntry{Timestamp: nowMs(), Level: "INFO", Kind: tailKindEvent, Message: name, Fields: fields()})
+}
+
+// parseTailFilter reads the /admin/tail query. An unknown level is an error
+// rather than silently matching everything.
+func parseTailFilter(c *gin.Context) (tailFilter, bool) {
+    f := tailFilter{peerId: c.Query("peerId"), network: c.Query("network")}
+    if lv := strings.ToUpper(c.Query("level")); lv != "" {
+        n, ok := tailLevels[lv]
+        if !ok {
+            return f, false
+        }
+        f.minLevel = n
+    }
+    if ev := c.Query("event"); ev != "" {
+        f.events = map[string]bool{}
+        for _, name := range strings.Split(ev, ",") {
+            if name = strings.TrimSpace(name); name != "" {
+                f.events[name] = true
+            }
+        }
+    }
+    return f, true
+}
+
+// adminTail upgrades to a WebSocket streaming TailEntry frames that match
+// the ?level=, ?event=, ?peerId= and ?network= filters.
+func (s *Server) adminTail(c *gin.Context) {
+    f, ok := parseTailFilter(c)
+    if !ok {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "level must be debug, info, warn or error"}, s.opts.CORSOrigin)
+        return
+    }
+    if s.refuseShedStats(c) {
+        return
+    }
+    conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
+    if err != nil {
+        return
+    }
+    defer conn.Close()
+    sub := s.tail.subscribe(f)
+    defer s.tail.unsubscribe(sub)
+    write := func(e TailEntry) bool {
+        b, _ := json.Marshal(e)
+        conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+        return conn.WriteMessage(websocket.TextMessage, b) == nil
+    }
+    closed := make(chan struct{})
+    s.spawn("tail-reader", c.ClientIP(), func() {
+        defer close(closed)
+        for {
+            if _, _, err := conn.ReadMessage(); err != nil {
+                return
+            }
+        }
+    })
+    for {
+        select {
+        case <-closed:
+            return
+        case e := <-sub.ch:
+            if n := atomic.SwapInt64(&sub.dropped, 0); n > 0 {
+                if !write(TailEntry{Timestamp: nowMs(), Level: "WARN", Kind: tailKindEvent, Message: "tail_dropped", Fields: map[string]interface{}{"dropped": n}}) {
+                    return
+                }
+            }
+            if !write(e) {
+                return
+            }
+        }
+    }
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestAdminTailFiltersLogsAndEvents(t *testing.T) {
+    s := NewServer(Options{AdminToken: "adm", Logger: &recordingLogger{}})
+    gin.SetMode(gin.TestMode)
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    dial := func(query string) *websocket.Conn {
+        c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/admin/tail"+query, http.Header{"Authorization": {"Bearer adm"}})
+        if err != nil {
+            t.Fatalf("dial tail: %v", err)
+        }
+        return c
+    }
+    read := func(c *websocket.Conn) TailEntry {
+        var e TailEntry
+        c.SetReadDeadline(time.Now().Add(time.Second))
+        if err := c.ReadJSON(&e); err != nil {
+            t.Fatalf("read tail frame: %v", err)
+        }
+        return e
+    }
+    if _, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/admin/tail?level=loud", http.Header{"Authorization": {"Bearer adm"}}); err == nil || res == nil || res.StatusCode != http.StatusBadRequest {
+        t.Fatalf("an unknown level should be rejected before upgrading")
+    }
+    byPeer := dial("?peerId=aaaa")
+    defer byPeer.Close()
+    warnings := dial("?level=warn&event=sender_mismatch")
+    defer warnings.Close()
+    lobby := dial("?network=lobby&event=peer_announced,peer_connected")
+    defer lobby.Close()
+    waitFor(t, "the tails to subscribe", func() bool { return s.tail.snapshot()["subscribers"] == 3 })
+
+    a := "aaaa456789abcdef0123456789abcdef01234567"
+    b := "bbbb456789abcdef0123456789abcdef01234567"
+    for _, id := range []string{a, b} {
+        s.peerData[id] = &peerInfo{PeerId: id, Connected: true}
+        s.handleMessage(id, []byte(`{"type":"announce","networkName":"lobby","data":{}}`))
+    }
+    s.handleMessage(b, []byte(`{"type":"ping","fromPeerId":"`+a+`"}`))
+    s.log.Warn("hub_link_throttled", map[string]interface{}{"link": "x"})
+
+    if e := read(byPeer); e.Kind != tailKindEvent || e.Message != "peer_announced" || e.Fields["peerId"] != a {
+        t.Fatalf("peer tail should see only %s's announce first, got %+v", a, e)
+    }
+    if e := read(byPeer); e.Kind != tailKindLog || e.Message != "sender_mismatch" || e.Fields["claimedFromPeerId"] != a {
+        t.Fatalf("peer tail should match the claimed sender by prefix, got %+v", e)
+    }
+    if e := read(warnings); e.Level != "WARN" || e.Message != "sender_mismatch" || e.Fields["peerId"] != b {
+        t.Fatalf("warning tail got %+v", e)
+    }
+    for _, id := range []string{a, b} {
+        if e := read(lobby); e.Message != "peer_announced" || e.Fields["networkName"] != "lobby" || e.Fields["peerId"] != id {
+            t.Fatalf("network tail got %+v, want %s's announce", e, id)
+        }
+    }
+    byPeer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+    if _, data, err := byPeer.ReadMessage(); err == nil {
+        t.Fatalf("peer tail received an unfiltered frame: %s", data)
+    }
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "os"
+    "path"
+    "sync"
+    "github.com/gin-gonic/gin"
+)
+
+// MessageTransform rewrites the data of messages local clients send on
+// matching networks before the hub handles them, so one hub can serve
+// client versions that disagree on field names. Network is a glob such as
+// "game-*"; Types limits it to some message types (all when empty). Fields
+// are top-level keys of data and are applied in order: Rename moves a value
+// to a new key (a legacy "name" to "displayName"), Strip deletes keys, and
+// Inject sets keys to a literal or to server metadata: "$region" (FLY_REGION),
+// "$hubPeerId", "$hubVersion" or "$receivedAt" (milliseconds since the epoch).
+// Every matching transform applies, in configuration order. Messages relayed
+// by other hubs were already transformed where they entered the mesh.
+type MessageTransform struct {
+    Network string            `json:"network"`
+    Types   []string          `json:"types,omitempty"`
+    Rename  map[string]string `json:"rename,omitempty"`
+    Strip   []string          `json:"strip,omitempty"`
+    Inject  map[string]string `json:"inject,omitempty"`
+}
+
+// transformRegistry holds the active transforms and, when key is set,
+// persists admin changes to the Store so they survive hub restarts.
+type transformRegistry struct {
+    store   Store
+    key     string
+    mu      sync.Mutex
+    list    []MessageTransform
+    applied int64
+}
+
+func newTransformRegistry(store Store, key string, initial []MessageTransform) *transformRegistry {
+    r := &transformRegistry{store: store, key: key, list: initial}
+    if key != "" {
+        var saved []MessageTransform
+        if b, err := store.Load(key); err == nil && b != nil && json.Unmarshal(b, &saved) == nil {
+            r.list = saved
+        }
+    }
+    return r
+}
+
+func validateTransforms(list []MessageTransform) error {
+    for _, t := range list {
+        if t.Network == "" {
+            return errors.New("each transform needs a network pattern")
+        }
+        if _, err := path.Match(t.Network, ""); err != nil {
+            return errors.New("invalid network pattern " + t.Network)
+        }
+        for from, to := range t.Rename {
+            if from == "" || to == "" {
+                return errors.New("rename needs non-empty field names")
+            }
+        }
+    }
+    return nil
+}
+
+// replace swaps in a new transform list and saves it.
+func (r *transformRegistry) replace(list []MessageTransform) error {
+    if err := validateTransforms(list); err != nil {
+        return err
+    }
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    r.list = list
+    if r.key == "" {
+        return nil
+    }
+    b, err := json.MarshalIndent(list, "", "  ")
+    if err != nil {
+        return err
+    }
+    return r.store.Save(r.key, b)
+}
+
+func (r *transformRegistry) matching(netName, typ string) []MessageTransform {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    var out []MessageTransform
+    for _, t := range r.list {
+        if ok, _ := path.Match(t.Network, netName); !ok {
+            continue
+        }
+        if len(t.Types) == 0 || containsType(t.Types, typ) {
+            out = append(out, t)
+        }
+    }
+    return out
+}
+
+func containsType(types []string, typ string) bool {
+    for _, t := range types {
+        if t == typ {
+            return true
+        }
+    }
+    return false
+}
+
+// transformValue resolves an Inject value.
+func (s *Server) transformValue(v string) interface{} {
+    switch v {
+    case "$region":
+        return os.Getenv("FLY_REGION")
+    case "$hubPeerId":
+        return s.hubPeerId
+    case "$hubVersion":
+        return Version
+    case "$receivedAt":
+        return nowMs()
+    }
+    return v
+}
+
+// applyTransforms rewrites msg.Data in place with every transform matching
+// its network and type. Data that is not an object is left alone.
+func (s *Server) applyTransforms(msg *inboundMessage) {
+    ts := s.transforms.matching(msg.NetworkName, msg.Type)
+    if len(ts) == 0 {
+        return
+    }
+    m, ok := msg.Data.(map[string]interface{})
+    if !ok {
+        if msg.Data != nil {
+            return
+        }
+        m = map[string]interface{}{}
+    }
+    for _, t := range ts {
+        for from, to := range t.Rename {
+            if v, ok := m[from]; ok {
+                delete(m, from)
+                m[to] = v
+            }
+        }
+        for _, k := range t.Strip {
+            delete(m, k)
+        }
+        for k, v := range t.Inject {
+            m[k] = s.transformValue(v)
+        }
+    }
+    msg.Data = m
+    s.transforms.mu.Lock()
+    s.transforms.applied++
+    s.transforms.mu.Unlock()
+}
+
+func (s *Server) transformSnapshot() map[string]interface{} {
+    r := s.transforms
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    return map[string]interface{}{"configured": len(r.list), "applied": r.applied}
+}
+
+func (s *Server) adminListTransforms(c *gin.Context) {
+    s.transforms.mu.Lock()
+    list := append([]MessageTransform{}, s.transforms.list...)
+    s.transforms.mu.Unlock()
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"transforms": list}, s.opts.CORSOrigin)
+}
+
+// adminReplaceTransforms swaps the whole transform list for the one in the
+// body, {"transforms": [...]}; an empty list turns transforms off.
+func (s *Server) adminReplaceTransforms(c *gin.Context) {
+    var body struct {
+        Transforms []MessageTransform `json:"transforms"`
+    }
+    if err := json.NewDecoder(c.Request.Body).Decode(&body); err != nil {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": "invalid JSON body"}, s.opts.CORSOrigin)
+        return
+    }
+    if err := validateTransforms(body.Transforms); err != nil {
+        writeJSON(c.Writer, http.StatusBadRequest, map[string]interface{}{"error": err.Error()}, s.opts.CORSOrigin)
+        return
+    }
+    if err := s.transforms.replace(body.Transforms); err != nil {
+        writeJSON(c.Writer, http.StatusInternalServerError, map[string]interface{}{"error": err.Error()}, s.opts.CORSOrigin)
+        return
+    }
+    s.audit(c, "transforms-replace", map[string]interface{}{"count": len(body.Transforms)})
+    writeJSON(c.Writer, http.StatusOK, map[string]interface{}{"transforms": body.Transforms}, s.opts.CORSOrigin)
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "strings"
+    "testing"
+    "github.com/gin-gonic/gin"
+)
+
+func TestMessageTransformsRewriteClientData(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "transforms.json")
+    s := NewServer(Options{TransformsStorePath: path, MessageTransforms: []MessageTransform{
+        {Network: "game-*", Types: []string{"announce"}, Rename: map[string]string{"name": "displayName"}, Strip: []string{"debug"}, Inject: map[string]string{"hub": "$hubVersion", "tier": "free"}},
+    }})
+    a, b := randomPeerId(), randomPeerId()
+    attachTestPeers(t, s, a, b)
+    s.handleMessage(b, []byte(`{"type":"announce","networkName":"game-1","data":{}}`))
+    s.handleMessage(a, []byte(`{"type":"announce","networkName":"game-1","data":{"name":"ann","debug":true}}`))
+    waitFor(t, "announce with transformed data", func() bool {
+        pi := s.getPeerInfo(a)
+        return pi != nil && pi.Announced
+    })
+    data := s.getPeerInfo(a).Data
+    if data["displayName"] != "ann" || data["name"] != nil || data["debug"] != nil || data["hub"] != Version || data["tier"] != "free" {
+        t.Fatalf("announce data not transformed: %v", data)
+    }
+
+    // Other networks and types are untouched.
+    s.handleMessage(b, []byte(`{"type":"announce","networkName":"chat","data":{"name":"bob","debug":true}}`))
+    if data := s.getPeerInfo(b).Data; data["name"] != "bob" || data["debug"] != true {
+        t.Fatalf("transform applied outside its network: %v", data)
+    }
+
+    gin.SetMode(gin.TestMode)
+    s.opts.AdminToken = "admin"
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    req, _ := http.NewRequest("PUT", ts.URL+"/admin/transforms", strings.NewReader(`{"transforms":[{"network":"[bad"}]}`))
+    req.Header.Set("Authorization", "Bearer admin")
+    if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != http.StatusBadRequest {
+        t.Fatalf("invalid pattern should be rejected")
+    }
+    req, _ = http.NewRequest("PUT", ts.URL+"/admin/transforms", strings.NewReader(`{"transforms":[{"network":"chat","strip":["debug"]}]}`))
+    req.Header.Set("Authorization", "Bearer admin")
+    if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != http.StatusOK {
+        t.Fatalf("replacing transforms failed")
+    }
+    if got := newTransformRegistry(fileStore{}, path, nil).matching("chat", "announce"); len(got) != 1 || got[0].Strip[0] != "debug" {
+        t.Fatalf("transforms should be persisted, got %v", got)
+    }
+    if snap := s.transformSnapshot(); snap["configured"] != 1 || snap["applied"] != int64(2) {
+        t.Fatalf("unexpected transform counters %v", snap)
+    }
+}
@@ -16,6 +16,135 @@ type Options struct {
     ReconnectIntervalMs int
     MaxReconnectAttempts int
     AuthToken           string
+    BootstrapHealthCheck bool
+    IdentityStorePath   string
+    MaxUpgradesPerSec   int
+    CompressThresholdBytes int
+    AdminToken          string
+    BlobMaxBytes        int
+    BlobQuotaBytes      int
+    ErrorReporter       ErrorReporter
+    AppBroadcastNetworks []string
+    AppBroadcastMaxBytes int
+    AppBroadcastRatePerSec int
+    EventReplaySize     int
+    HubRole             string
+    MigrationSecret     string
+    SignalingTimeoutMs  int
+    DataRetentionMs     int
+    CrossHubDiscoveryRatePerSec int
+    IntegrationsStorePath string
+    HubGossipQuotaPerSec int
+    HubSignalingQuotaPerSec int
+    HubQuotaSuspendMs   int
+    MeshToken           string
+    AllowUnauthenticatedMesh bool
+    MaxMeshConnections  int
+    MeshPathOnly        bool
+    MeshCompression     bool
+    SignalDeadlineMs    int
+    DisconnectDebounceMs int
+    SameNetworkHints    bool
+    LegacyEnvelopeDefault bool
+    ShedCPUPercent      int
+    ShedQueueDepth      int
+    ReputationWarnAt    int
+    ReputationThrottleAt int
+    ReputationBanAt     int
+    ReputationBanMs     int
+    ReputationStorePath string
+    StoreCompactIntervalMs int
+    StoreCompactFragmentationPct int
+    HubKeyPath          string
+    HubKeyPinsPath      string
+    PinnedHubKeys       []string
+    RequireSignedMesh   bool
+    MonitorToken        string
+    MonitorNetworks     []string
+    GuestLinkSecret     string
+    GuestRatePerSec     int
+    SignalRouteTTLMs    int
+    MessageTransforms   []MessageTransform
+    TransformsStorePath string
+    WriteQueueSize      int
+    WriteTimeoutMs      int
+    SlowConsumerPolicy  string
+    FanoutWorkers       int
+    FanoutMinPeers      int
+    FanoutQueueSize     int
+    PeerIdPattern       string
+    PeerIdMinLength     int
+    PeerIdMaxLength     int
+    PeerIdValidator     func(peerId string) bool
+    PollJournalPath     string
+    PollJournalMaxBytes int
+    PollJournalRetentionMs int
+    PowDifficulty       int
+    PowChallengeTTLMs   int
+    StateStorePath      string
+    StatePersistIntervalMs int
+    StateMaxAgeMs       int
+    StateSeedKeys       []string
+    MaxRoomsPerPeer     int
+    PeerMessageMaxBytes int
+    PeerMessageRatePerSec int
+    AnalyticsStorePath  string
+    AnalyticsRetentionMs int
+    PingIntervalMs      int
+    MaxMissedPongs      int
+    HubApprovalRequired bool
+    HubAutoApproveKeys  []string
+    HubAutoApproveNamespaces []string
+    HubApprovalStorePath string
+    ICEServers          []ICEServer
+    TURNSecret          string
+    TURNCredentialTTLMs int
+    JWTSecret           string
+    JWTPublicKey        string
+    JWKSURL             string
+    JWKSRefreshMs       int
+    JWTIssuer           string
+    JWTAudience         string
+    JWTPeerIdClaim      string
+    JWTNetworksClaim    string
+    Faults              *FaultOptions
+    MaxRSSMB            int
+    MaxHeapMB           int
+    MaxGoroutines       int
+    GuardrailWarnPercent int
+    NetworkACL          []ACLRule
+    ProtectedNetworks   []string
+    MeshAutoDial        bool
+    MeshMaxDialed       int
+    PublicURL           string
+    MeshMaxHops         int
+    EventBridgeURL      string
+    EventBridgeTopic    string
+    EventBridgeTopics   []string
+    EventBridgeBatchSize int
+    EventBridgeFlushMs  int
+    EventBridgeQueueSize int
+    EventBridgeDelivery string
+    BackplaneURL        string
+    BackplanePrefix     string
+    BackplaneHeartbeatMs int
+    GRPCAddr            string
+    GRPCCertFile        string
+    GRPCKeyFile         string
+    PeerIdleMs          int
+    Listeners           []Listener
+    MetricsStorePath    string
+    MetricsPersistIntervalMs int
+    MetricsMaxSeries    int
+    DefaultNetwork      string
+    AllowedNetworks     []string
+    MaxNetworks         int
+    MaxPeersPerNetwork  int
+    ChangeFeedSize      int
+    ChangeSinks         []ChangeSink
+    Logger              Logger
+    Metrics             MetricsRecorder
+    Store               Store
 }
 
 type inboundMessage struct {
@@ -24,6 +153,16 @@ type inboundMessage struct {
     TargetPeer  string      `json:"targetPeerId"`
     NetworkName string      `json:"networkName"`
     FromPeerId  string      `json:"fromPeerId"`
+    Strategy    string      `json:"strategy"`
+    Encoding    string      `json:"encoding"`
+    MessageId   string      `json:"messageId"`
+    Receipts    bool        `json:"receipts"`
+    OriginHub   string      `json:"originHubId"`
+    SeenHubs    []string    `json:"seenHubs"`
+    Hops        int         `json:"hops"`
+    Deadline    int64       `json:"deadline"`
+    Signature   string      `json:"signature"`
+    MeshSignature string    `json:"meshSignature"`
 }
 
 type outboundMessage struct {
@@ -33,6 +172,14 @@ type outboundMessage struct {
     TargetPeer  string      `json:"targetPeerId,omitempty"`
     NetworkName string      `json:"networkName"`
     Timestamp   int64       `json:"timestamp"`
+    Encoding    string      `json:"encoding,omitempty"`
+    MessageId   string      `json:"messageId,omitempty"`
+    Receipts    bool        `json:"receipts,omitempty"`
+    OriginHub   string      `json:"originHubId,omitempty"`
+    SeenHubs    []string    `json:"seenHubs,omitempty"`
+    Hops        int         `json:"hops,omitempty"`
+    Deadline    int64       `json:"deadline,omitempty"`
+    MeshSignature string    `json:"meshSignature,omitempty"`
 }
 
 type peerInfo struct {
@@ -46,4 +193,11 @@ type peerInfo struct {
     NetworkName   string
     Data          map[string]interface{}
     IsHub         bool
+    ClientVersion string
+    ProtocolVersion int
+    UserAgent     string
+    Path          string
+    Monitor       bool
+    Filter        *discoveryFilter
+    Idle          bool
 }
@@ -12,6 +12,8 @@ import (
 
 var peerIdRe = regexp.MustCompile(`^[a-fA-F0-9]{40}$`)
 
+// validatePeerId checks the 40-hex format of hub peer IDs. Client peer IDs
+// go through the configurable s.validPeerId.
 func validatePeerId(id string) bool {
     return peerIdRe.MatchString(id)
 }
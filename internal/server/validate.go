@@ -0,0 +1,145 @@
+package server
+
+import (
+    "errors"
+    "net"
+    "net/url"
+    "path"
+    "reflect"
+    "regexp"
+    "strings"
+)
+
+// Validate reports every setting in o that cannot work, such as an unknown
+// HubRole, a malformed bootstrap URI or a negative limit, joined into one
+// error. NewServer does not call it, so embedders keep the forgiving
+// defaults; the hub binary refuses to start on a failed check.
+func (o Options) Validate() error {
+    var problems []string
+    add := func(msg string) { problems = append(problems, msg) }
+    if o.Port < 0 || o.Port > 65535 {
+        add("Port must be between 0 and 65535")
+    }
+    v := reflect.ValueOf(o)
+    for i := 0; i < v.NumField(); i++ {
+        if f := v.Field(i); f.Kind() == reflect.Int && f.Int() < 0 {
+            add(v.Type().Field(i).Name + " must not be negative")
+        }
+    }
+    switch o.HubRole {
+    case "", RoleFull, RoleSignaling, RoleRelay:
+    default:
+        add("HubRole must be full, signaling or relay")
+    }
+    switch o.SlowConsumerPolicy {
+    case "", slowConsumerDisconnect, slowConsumerDrop:
+    default:
+        add("SlowConsumerPolicy must be disconnect or drop")
+    }
+    if o.FanoutWorkers > 1024 {
+        add("FanoutWorkers must be at most 1024")
+    }
+    for _, uri := range o.BootstrapHubs {
+        if u, err := url.Parse(uri); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+            add("bootstrap hub " + uri + " is not a ws:// or wss:// URL")
+        }
+    }
+    if len(o.BootstrapHubs) > 0 && o.MeshToken == "" && o.HubKeyPath == "" && !o.AllowUnauthenticatedMesh {
+        add("BootstrapHubs needs MeshToken or HubKeyPath, or the bootstrap hubs will refuse the link as a hub")
+    }
+    if o.DefaultNetwork != "" && !validNetworkName(o.DefaultNetwork) {
+        add("DefaultNetwork " + o.DefaultNetwork + " is not a valid network name")
+    }
+    for _, n := range o.AllowedNetworks {
+        if n != "*" && !validNetworkName(n) {
+            add("allowed network " + n + " is not a valid network name")
+        }
+    }
+    if o.PeerIdPattern != "" {
+        if _, err := regexp.Compile(o.PeerIdPattern); err != nil {
+            add("PeerIdPattern: " + err.Error())
+        }
+    }
+    if o.PeerIdMaxLength > 0 && o.PeerIdMinLength > o.PeerIdMaxLength {
+        add("PeerIdMinLength exceeds PeerIdMaxLength")
+    }
+    for _, entry := range o.PinnedHubKeys {
+        if _, key, ok := strings.Cut(entry, "="); !ok || decodeHubKey(key) == nil {
+            add("pinned hub key " + entry + " is not link=base64key")
+        }
+    }
+    for _, key := range o.HubAutoApproveKeys {
+        if decodeHubKey(key) == nil {
+            add("auto-approve hub key " + key + " is not a base64 ed25519 key")
+        }
+    }
+    for _, pattern := range o.HubAutoApproveNamespaces {
+        if _, err := path.Match(pattern, ""); err != nil {
+            add("auto-approve namespace " + pattern + " is not a valid pattern")
+        }
+    }
+    if err := validateTransforms(o.MessageTransforms); err != nil {
+        add(err.Error())
+    }
+    if err := validateICEServers(o.ICEServers); err != nil {
+        add(err.Error())
+    }
+    if o.GuardrailWarnPercent > 100 {
+        add("GuardrailWarnPercent must be at most 100")
+    }
+    if err := validateACL(o.NetworkACL, o.ProtectedNetworks); err != nil {
+        add(err.Error())
+    }
+    if o.PublicURL != "" {
+        if u, err := url.Parse(o.PublicURL); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+            add("PublicURL " + o.PublicURL + " is not a ws:// or wss:// URL")
+        }
+    }
+    if o.EventBridgeURL != "" {
+        if _, _, err := newBridgeTransport(o.EventBridgeURL, ""); err != nil {
+            add(err.Error())
+        }
+    }
+    if o.BackplaneURL != "" {
+        if _, _, err := newBackplaneTransport(o.BackplaneURL, ""); err != nil {
+            add(err.Error())
+        }
+    }
+    if strings.ContainsAny(o.BackplanePrefix, " *>\t\r\n") {
+        add("BackplanePrefix must not contain spaces or wildcards")
+    }
+    if o.GRPCAddr != "" {
+        if _, _, err := net.SplitHostPort(o.GRPCAddr); err != nil {
+            add("GRPCAddr must be host:port")
+        }
+    }
+    if (o.GRPCCertFile == "") != (o.GRPCKeyFile == "") {
+        add("GRPCCertFile and GRPCKeyFile must be set together")
+    }
+    if _, err := parseTopicRules(o.EventBridgeTopics); err != nil {
+        add(err.Error())
+    }
+    if o.EventBridgeDelivery != "" && o.EventBridgeDelivery != deliveryAtLeastOnce && o.EventBridgeDelivery != deliveryAtMostOnce {
+        add("EventBridgeDelivery must be at-least-once or at-most-once")
+    }
+    if err := validateListeners(o.Listeners); err != nil {
+        add(err.Error())
+    }
+    if msg := validateFaults(o.Faults); msg != "" {
+        add(msg)
+    }
+    if o.JWTPublicKey != "" {
+        if _, err := parseRSAPublicKey(o.JWTPublicKey); err != nil {
+            add(err.Error())
+        }
+    }
+    if o.JWKSURL != "" {
+        if u, err := url.Parse(o.JWKSURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+            add("JWKSURL " + o.JWKSURL + " is not an http:// or https:// URL")
+        }
+    }
+    if len(problems) == 0 {
+        return nil
+    }
+    return errors.New(strings.Join(problems, "; "))
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestOptionsValidateReportsEveryProblem(t *testing.T) {
+    if err := (Options{Port: 8080, HubRole: RoleRelay, BootstrapHubs: []string{"wss://hub-b.example.com"}, MeshToken: "mesh-secret", AllowedNetworks: []string{"*"}}).Validate(); err != nil {
+        t.Fatalf("valid options rejected: %v", err)
+    }
+    err := Options{Port: 70000, HubRole: "edge", BootstrapHubs: []string{"http://hub-b"}, MaxPeersPerNetwork: -1, PeerIdPattern: "(", SlowConsumerPolicy: "block"}.Validate()
+    if err == nil {
+        t.Fatalf("invalid options accepted")
+    }
+    for _, want := range []string{"Port", "HubRole", "http://hub-b", "MaxPeersPerNetwork must not be negative", "PeerIdPattern", "SlowConsumerPolicy"} {
+        if !strings.Contains(err.Error(), want) {
+            t.Fatalf("expected %q in %v", want, err)
+        }
+    }
+}
@@ -0,0 +1,41 @@
+package server
+
+// Discovery visibility. A peer announces with "visibility": "hidden" to stay
+// out of discovery: no peer-discovered about it goes to its network, it is
+// left out of the peer list new peers receive, find-peers, capability
+// routing, resolve-service, monitors and event replay, it is never gossiped
+// to other hubs and its departure is not broadcast. Peers that already know
+// its peerId can still signal it, here or across the mesh. "listed", the
+// default, is the usual behavior. A listed peer that re-announces as hidden
+// is reported to its network and the mesh as disconnected with reason
+// "unlisted". Hubs are always listed. Operators still see hidden peers in
+// the admin API and the change feed.
+const (
+    visibilityListed = "listed"
+    visibilityHidden = "hidden"
+)
+
+// hiddenPeer reports whether announce data asks for the peer to be hidden.
+func hiddenPeer(data map[string]interface{}) bool {
+    v, _ := data["visibility"].(string)
+    return v == visibilityHidden
+}
+
+// checkVisibility validates data["visibility"], sending the peer an error
+// and reporting false when it is unusable.
+func (s *Server) checkVisibility(peerId string, isHub bool, data map[string]interface{}) bool {
+    raw, ok := data["visibility"]
+    if !ok {
+        return true
+    }
+    v, _ := raw.(string)
+    switch {
+    case v != visibilityListed && v != visibilityHidden:
+        s.sendError(s.getConn(peerId), peerId, "visibility must be listed or hidden")
+        return false
+    case v == visibilityHidden && isHub:
+        s.sendError(s.getConn(peerId), peerId, "hubs cannot be hidden")
+        return false
+    }
+    return true
+}
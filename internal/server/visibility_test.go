@@ -0,0 +1,108 @@
+package server
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/gorilla/websocket"
+)
+
+func TestHiddenPeersStayOutOfDiscovery(t *testing.T) {
+    s := NewServer(Options{MaxConnections: 10})
+    gin.SetMode(gin.TestMode)
+    s.running = true
+    s.routes()
+    ts := httptest.NewServer(s.engine)
+    defer ts.Close()
+    type frame struct {
+        Type       string                 `json:"type"`
+        Data       map[string]interface{} `json:"data"`
+        FromPeerId string                 `json:"fromPeerId"`
+    }
+    type peer struct {
+        *websocket.Conn
+        frames chan frame
+    }
+    dial := func(id string) peer {
+        ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?peerId="+id, nil)
+        if err != nil {
+            t.Fatalf("dial: %v", err)
+        }
+        var greeting map[string]interface{}
+        ws.ReadJSON(&greeting)
+        p := peer{ws, make(chan frame, 16)}
+        go func() {
+            for {
+                var f frame
+                if err := ws.ReadJSON(&f); err != nil {
+                    return
+                }
+                p.frames <- f
+            }
+        }()
+        return p
+    }
+    drain := func(p peer) []frame {
+        out := []frame{}
+        for {
+            select {
+            case f := <-p.frames:
+                out = append(out, f)
+            case <-time.After(200 * time.Millisecond):
+                return out
+            }
+        }
+    }
+    announce := func(p peer, data map[string]interface{}) {
+        p.WriteJSON(map[string]interface{}{"type": "announce", "networkName": "global", "data": data})
+    }
+    listedId, hiddenId, newId := randomPeerId(), randomPeerId(), randomPeerId()
+    listed, hidden, newcomer := dial(listedId), dial(hiddenId), dial(newId)
+    defer listed.Close()
+    defer newcomer.Close()
+    announce(listed, map[string]interface{}{})
+    drain(listed)
+    announce(hidden, map[string]interface{}{"visibility": "hidden"})
+    if got := drain(listed); len(got) != 0 {
+        t.Fatalf("listed peer heard about a hidden peer: %+v", got)
+    }
+    if pi := s.getPeerInfo(hiddenId); pi == nil || !pi.Announced {
+        t.Fatal("hidden peer was not announced")
+    }
+
+    // A newcomer is told about the listed peer only, but can still signal
+    // the hidden one by its peerId.
+    announce(newcomer, map[string]interface{}{})
+    got := drain(newcomer)
+    if len(got) != 1 || got[0].Type != "peer-discovered" || got[0].Data["peerId"] != listedId {
+        t.Fatalf("newcomer should only discover the listed peer, got %+v", got)
+    }
+    drain(hidden)
+    newcomer.WriteJSON(map[string]interface{}{"type": "offer", "targetPeerId": hiddenId, "networkName": "global", "data": map[string]interface{}{"sdp": "x"}})
+    if got := drain(hidden); len(got) != 1 || got[0].Type != "offer" || got[0].FromPeerId != newId {
+        t.Fatalf("hidden peer should still receive signals, got %+v", got)
+    }
+
+    // Going hidden reads as leaving; a hidden peer leaves silently.
+    announce(listed, map[string]interface{}{"visibility": "hidden"})
+    if got := drain(newcomer); len(got) != 1 || got[0].Type != "peer-disconnected" || got[0].Data["reason"] != reasonUnlisted {
+        t.Fatalf("expected an unlisted disconnect, got %+v", got)
+    }
+    hidden.Close()
+    if got := drain(newcomer); len(got) != 0 {
+        t.Fatalf("hidden peer's departure was broadcast: %+v", got)
+    }
+    announce(newcomer, map[string]interface{}{"visibility": "secret"})
+    if got := drain(newcomer); len(got) != 1 || got[0].Type != "error" {
+        t.Fatalf("expected an error for an unknown visibility, got %+v", got)
+    }
+
+    // Hidden peers gossiped by a hub that does not enforce visibility are
+    // not cached or passed on.
+    s.handlePeerDiscovered("", inboundMessage{Type: "peer-discovered", NetworkName: "global", Data: map[string]interface{}{"peerId": randomPeerId(), "visibility": "hidden"}})
+    if len(s.crossHubCache["global"]) != 0 {
+        t.Fatal("a gossiped hidden peer was cached")
+    }
+}
@@ -0,0 +1,127 @@
+// Package store provides server.Store backends other than the default
+// files: a bbolt database for single-host deployments and Redis for state
+// shared between hub replicas.
+package store
+
+import (
+    "os"
+    "sync"
+    "time"
+    "go.etcd.io/bbolt"
+    "peerpigeon/internal/server"
+)
+
+var boltBucket = []byte("peerpigeon")
+
+// Bolt keeps every document in one bbolt file. It implements
+// server.Compactor, so the hub reports and reclaims its free pages.
+type Bolt struct {
+    path string
+    mu   sync.RWMutex
+    db   *bbolt.DB
+}
+
+// OpenBolt opens or creates the database at path.
+func OpenBolt(path string) (*Bolt, error) {
+    db, err := openBoltDB(path)
+    if err != nil {
+        return nil, err
+    }
+    return &Bolt{path: path, db: db}, nil
+}
+
+func openBoltDB(path string) (*bbolt.DB, error) {
+    db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+    if err != nil {
+        return nil, err
+    }
+    err = db.Update(func(tx *bbolt.Tx) error {
+        _, err := tx.CreateBucketIfNotExists(boltBucket)
+        return err
+    })
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    return db, nil
+}
+
+func (b *Bolt) Load(key string) ([]byte, error) {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    var out []byte
+    err := b.db.View(func(tx *bbolt.Tx) error {
+        if v := tx.Bucket(boltBucket).Get([]byte(key)); v != nil {
+            out = append([]byte(nil), v...)
+        }
+        return nil
+    })
+    return out, err
+}
+
+func (b *Bolt) Save(key string, data []byte) error {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    return b.db.Update(func(tx *bbolt.Tx) error {
+        return tx.Bucket(boltBucket).Put([]byte(key), data)
+    })
+}
+
+// Append rewrites the document with data added; bbolt has no in-place
+// append.
+func (b *Bolt) Append(key string, data []byte) error {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    return b.db.Update(func(tx *bbolt.Tx) error {
+        bk := tx.Bucket(boltBucket)
+        cur := bk.Get([]byte(key))
+        return bk.Put([]byte(key), append(append(make([]byte, 0, len(cur)+len(data)), cur...), data...))
+    })
+}
+
+func (b *Bolt) StoreStats() (server.StoreStats, error) {
+    b.mu.RLock()
+    defer b.mu.RUnlock()
+    fi, err := os.Stat(b.path)
+    if err != nil {
+        return server.StoreStats{}, err
+    }
+    st := b.db.Stats()
+    return server.StoreStats{SizeBytes: fi.Size(), FreeBytes: int64(st.FreeAlloc)}, nil
+}
+
+// Compact copies the live data into a fresh file and swaps it in. Loads and
+// saves wait while it runs.
+func (b *Bolt) Compact() error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    tmp := b.path + ".compact"
+    os.Remove(tmp)
+    dst, err := bbolt.Open(tmp, 0600, &bbolt.Options{Timeout: time.Second})
+    if err != nil {
+        return err
+    }
+    if err := bbolt.Compact(dst, b.db, 0); err != nil {
+        dst.Close()
+        os.Remove(tmp)
+        return err
+    }
+    dst.Close()
+    b.db.Close()
+    if err := os.Rename(tmp, b.path); err != nil {
+        return err
+    }
+    db, err := openBoltDB(b.path)
+    if err != nil {
+        return err
+    }
+    b.db = db
+    return nil
+}
+
+// Close closes the database.
+func (b *Bolt) Close() error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.db.Close()
+}
@@ -0,0 +1,148 @@
+package store
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "net"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+    "peerpigeon/internal/resp"
+)
+
+// Redis keeps documents as Redis strings, so hub replicas can share state.
+// It speaks just enough RESP for GET, SET and APPEND over one connection,
+// redialed after a failure.
+type Redis struct {
+    addr     string
+    password string
+    db       int
+    prefix   string
+    timeout  time.Duration
+
+    mu   sync.Mutex
+    conn net.Conn
+    rd   *bufio.Reader
+}
+
+// DialRedis connects to redis://[:password@]host:port[/db][?prefix=p]. Keys
+// are stored as prefix+key.
+func DialRedis(rawURL string) (*Redis, error) {
+    u, err := url.Parse(rawURL)
+    if err != nil || u.Scheme != "redis" || u.Host == "" {
+        return nil, fmt.Errorf("invalid redis URL %q", rawURL)
+    }
+    r := &Redis{addr: u.Host, prefix: u.Query().Get("prefix"), timeout: 5 * time.Second}
+    if !strings.Contains(r.addr, ":") {
+        r.addr += ":6379"
+    }
+    if pw, ok := u.User.Password(); ok {
+        r.password = pw
+    }
+    if db := strings.Trim(u.Path, "/"); db != "" {
+        if r.db, err = strconv.Atoi(db); err != nil {
+            return nil, fmt.Errorf("invalid redis database %q", db)
+        }
+    }
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if err := r.connectLocked(); err != nil {
+        return nil, err
+    }
+    return r, nil
+}
+
+func (r *Redis) connectLocked() error {
+    conn, err := net.DialTimeout("tcp", r.addr, r.timeout)
+    if err != nil {
+        return err
+    }
+    r.conn, r.rd = conn, bufio.NewReader(conn)
+    if r.password != "" {
+        if _, err := r.roundTripLocked("AUTH", r.password); err != nil {
+            conn.Close()
+            return err
+        }
+    }
+    if r.db != 0 {
+        if _, err := r.roundTripLocked("SELECT", itoa(r.db)); err != nil {
+            conn.Close()
+            return err
+        }
+    }
+    return nil
+}
+
+// do runs one command, reconnecting and retrying once if the connection
+// failed.
+func (r *Redis) do(args ...string) ([]byte, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    for attempt := 0; ; attempt++ {
+        if r.conn == nil {
+            if err := r.connectLocked(); err != nil {
+                return nil, err
+            }
+        }
+        reply, err := r.roundTripLocked(args...)
+        // An error reply does not call for a reconnect.
+        var re resp.Error
+        if err == nil || errors.As(err, &re) || attempt == 1 {
+            return reply, err
+        }
+        r.conn.Close()
+        r.conn = nil
+    }
+}
+
+func (r *Redis) roundTripLocked(args ...string) ([]byte, error) {
+    r.conn.SetDeadline(time.Now().Add(r.timeout))
+    if _, err := r.conn.Write(resp.Command(args...)); err != nil {
+        return nil, err
+    }
+    v, err := resp.Read(r.rd)
+    if err != nil {
+        return nil, err
+    }
+    switch v := v.(type) {
+    case nil:
+        return nil, nil
+    case string:
+        return []byte(v), nil
+    case int64:
+        return []byte(strconv.FormatInt(v, 10)), nil
+    }
+    return nil, fmt.Errorf("redis: unexpected reply %v", v)
+}
+
+// Load returns nil for a missing key.
+func (r *Redis) Load(key string) ([]byte, error) {
+    return r.do("GET", r.prefix+key)
+}
+
+func (r *Redis) Save(key string, data []byte) error {
+    _, err := r.do("SET", r.prefix+key, string(data))
+    return err
+}
+
+func (r *Redis) Append(key string, data []byte) error {
+    _, err := r.do("APPEND", r.prefix+key, string(data))
+    return err
+}
+
+// Close closes the connection.
+func (r *Redis) Close() error {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if r.conn == nil {
+        return nil
+    }
+    err := r.conn.Close()
+    r.conn = nil
+    return err
+}
+
+func itoa(i int) string { return strconv.Itoa(i) }
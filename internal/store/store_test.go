@@ -0,0 +1,135 @@
+package store
+
+import (
+    "bufio"
+    "fmt"
+    "io"
+    "net"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+)
+
+func TestBoltStoresAndCompacts(t *testing.T) {
+    b, err := OpenBolt(filepath.Join(t.TempDir(), "hub.db"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer b.Close()
+    if v, err := b.Load("missing"); v != nil || err != nil {
+        t.Fatalf("a missing key should load as nil, got %q %v", v, err)
+    }
+    big := strings.Repeat("x", 1<<20)
+    b.Save("blob", []byte(big))
+    b.Save("blob", []byte("small"))
+    b.Append("journal", []byte("a\n"))
+    b.Append("journal", []byte("b\n"))
+    if v, _ := b.Load("journal"); string(v) != "a\nb\n" {
+        t.Fatalf("unexpected journal %q", v)
+    }
+    before, err := b.StoreStats()
+    if err != nil || before.FreeBytes == 0 {
+        t.Fatalf("overwriting a large value should leave free pages: %+v %v", before, err)
+    }
+    if err := b.Compact(); err != nil {
+        t.Fatal(err)
+    }
+    after, _ := b.StoreStats()
+    if after.SizeBytes >= before.SizeBytes {
+        t.Fatalf("compaction should shrink the file: %d -> %d", before.SizeBytes, after.SizeBytes)
+    }
+    if v, _ := b.Load("blob"); string(v) != "small" {
+        t.Fatalf("data should survive compaction, got %q", v)
+    }
+}
+
+// fakeRedis answers GET, SET, APPEND and AUTH from a map.
+func fakeRedis(t *testing.T) (string, func()) {
+    ln, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    var mu sync.Mutex
+    data := map[string]string{}
+    go func() {
+        for {
+            conn, err := ln.Accept()
+            if err != nil {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                rd := bufio.NewReader(conn)
+                for {
+                    line, err := rd.ReadString('\n')
+                    if err != nil {
+                        return
+                    }
+                    n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+                    args := make([]string, n)
+                    for i := range args {
+                        l, _ := rd.ReadString('\n')
+                        size, _ := strconv.Atoi(strings.TrimSpace(l[1:]))
+                        buf := make([]byte, size+2)
+                        io.ReadFull(rd, buf)
+                        args[i] = string(buf[:size])
+                    }
+                    mu.Lock()
+                    switch strings.ToUpper(args[0]) {
+                    case "GET":
+                        if v, ok := data[args[1]]; ok {
+                            fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+                        } else {
+                            fmt.Fprint(conn, "$-1\r\n")
+                        }
+                    case "SET":
+                        data[args[1]] = args[2]
+                        fmt.Fprint(conn, "+OK\r\n")
+                    case "APPEND":
+                        data[args[1]] += args[2]
+                        fmt.Fprintf(conn, ":%d\r\n", len(data[args[1]]))
+                    case "AUTH":
+                        if args[1] != "secret" {
+                            fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+                        } else {
+                            fmt.Fprint(conn, "+OK\r\n")
+                        }
+                    default:
+                        fmt.Fprint(conn, "-ERR unknown command\r\n")
+                    }
+                    mu.Unlock()
+                }
+            }()
+        }
+    }()
+    return ln.Addr().String(), func() { ln.Close() }
+}
+
+func TestRedisStoresDocuments(t *testing.T) {
+    addr, stop := fakeRedis(t)
+    defer stop()
+    if _, err := DialRedis("redis://:wrong@" + addr); err == nil {
+        t.Fatalf("a bad password should fail to dial")
+    }
+    r, err := DialRedis("redis://:secret@" + addr + "?prefix=hub-a:")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer r.Close()
+    if v, err := r.Load("state"); v != nil || err != nil {
+        t.Fatalf("a missing key should load as nil, got %q %v", v, err)
+    }
+    r.Save("state", []byte("{\"a\":1}\r\n"))
+    r.Append("journal", []byte("x\n"))
+    r.Append("journal", []byte("y\n"))
+    if v, _ := r.Load("state"); string(v) != "{\"a\":1}\r\n" {
+        t.Fatalf("unexpected state %q", v)
+    }
+    // A dropped connection is redialed.
+    r.conn.Close()
+    if v, err := r.Load("journal"); string(v) != "x\ny\n" || err != nil {
+        t.Fatalf("unexpected journal %q %v", v, err)
+    }
+}
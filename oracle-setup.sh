@@ -23,6 +23,7 @@ PORT="${PORT:-3000}"
 IS_HUB="${IS_HUB:-false}"
 BOOTSTRAP_HUBS="${BOOTSTRAP_HUBS:-}"
 AUTH_TOKEN="${AUTH_TOKEN:-}"
+MESH_TOKEN="${MESH_TOKEN:-}"
 HUB_MESH_NAMESPACE="${HUB_MESH_NAMESPACE:-pigeonhub-mesh}"
 
 show_usage() {
@@ -33,14 +34,15 @@ show_usage() {
     echo "  IS_HUB=true                  Enable hub mode (default: false)"
     echo "  BOOTSTRAP_HUBS='ws://...'    Comma-separated bootstrap hub URLs"
     echo "  AUTH_TOKEN='token'           Optional authentication token"
+    echo "  MESH_TOKEN='token'           Token shared by every hub; required with BOOTSTRAP_HUBS"
     echo "  HUB_MESH_NAMESPACE='ns'      Hub mesh namespace (default: pigeonhub-mesh)"
     echo ""
     echo "Examples:"
     echo "  # Bootstrap hub on first instance:"
-    echo "  sudo PORT=3000 IS_HUB=true ./oracle-setup.sh"
+    echo "  sudo PORT=3000 IS_HUB=true MESH_TOKEN='mesh-secret' ./oracle-setup.sh"
     echo ""
     echo "  # Secondary hub connecting to bootstrap:"
-    echo "  sudo PORT=3000 IS_HUB=true BOOTSTRAP_HUBS='ws://instance1-ip:3000' ./oracle-setup.sh"
+    echo "  sudo PORT=3000 IS_HUB=true MESH_TOKEN='mesh-secret' BOOTSTRAP_HUBS='ws://instance1-ip:3000' ./oracle-setup.sh"
 }
 
 if [[ "$1" == "--help" ]] || [[ "$1" == "-h" ]]; then
@@ -159,6 +161,7 @@ Environment="IS_HUB=$IS_HUB"
 Environment="HUB_MESH_NAMESPACE=$HUB_MESH_NAMESPACE"
 Environment="BOOTSTRAP_HUBS=$BOOTSTRAP_HUBS"
 Environment="AUTH_TOKEN=$AUTH_TOKEN"
+Environment="MESH_TOKEN=$MESH_TOKEN"
 
 [Install]
 WantedBy=multi-user.target
@@ -0,0 +1,33 @@
+package client
+
+import "encoding/json"
+
+// WatchPeers asks the hub to report when any of peerIds, on this client's
+// network and hub, goes idle or becomes active again; see PeerActivity.
+// Watches last until UnwatchPeers or the connection closes, and are not
+// restored on reconnect.
+func (c *Client) WatchPeers(peerIds ...string) error {
+	return c.Send(Message{Type: "watch-peers", NetworkName: c.network()}, map[string]interface{}{"peerIds": peerIds})
+}
+
+// UnwatchPeers stops watching peerIds, or every peer when none are given.
+func (c *Client) UnwatchPeers(peerIds ...string) error {
+	return c.Send(Message{Type: "unwatch-peers", NetworkName: c.network()}, map[string]interface{}{"peerIds": peerIds})
+}
+
+// PeerActivity decodes a peer-idle or peer-active about a watched peer.
+// idleMs is how long the peer had been quiet. ok is false for any other
+// message type.
+func (m Message) PeerActivity() (peerId string, idle bool, idleMs int64, ok bool) {
+	if m.Type != "peer-idle" && m.Type != "peer-active" {
+		return "", false, 0, false
+	}
+	var d struct {
+		PeerId string `json:"peerId"`
+		IdleMs int64  `json:"idleMs"`
+	}
+	if err := json.Unmarshal(m.Data, &d); err != nil || d.PeerId == "" {
+		return "", false, 0, false
+	}
+	return d.PeerId, m.Type == "peer-idle", d.IdleMs, true
+}
@@ -0,0 +1,413 @@
+// Package client is a Go SDK for connecting to a PeerPigeon hub.
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Message is a protocol envelope as sent and received over the hub socket.
+type Message struct {
+	Type         string          `json:"type"`
+	Data         json.RawMessage `json:"data,omitempty"`
+	FromPeerId   string          `json:"fromPeerId,omitempty"`
+	TargetPeerId string          `json:"targetPeerId,omitempty"`
+	NetworkName  string          `json:"networkName,omitempty"`
+	Timestamp    int64           `json:"timestamp,omitempty"`
+	Encoding     string          `json:"encoding,omitempty"`
+	MessageId    string          `json:"messageId,omitempty"`
+	// Receipts on a peer-message asks the destination for message-receipts.
+	Receipts bool `json:"receipts,omitempty"`
+}
+
+// Options configures a Client.
+type Options struct {
+	// PeerId is the 40-hex peer ID; a random one is generated when empty.
+	PeerId string
+	// NetworkName is announced on connect and on every reconnect.
+	NetworkName string
+	// AnnounceData is sent as the announce payload.
+	AnnounceData map[string]interface{}
+	// AutoReconnect redials with backoff when the connection drops.
+	AutoReconnect bool
+	// MaxBackoff caps the reconnect delay (default 30s).
+	MaxBackoff time.Duration
+	// Transport selects "websocket", "poll", or, when empty, WebSocket with
+	// automatic fallback to HTTP long polling if the upgrade fails.
+	Transport string
+	// PingInterval is how often the client pings the hub (default 25s;
+	// negative disables). A connection that has received nothing for two
+	// intervals is dropped, and redialed with AutoReconnect.
+	PingInterval time.Duration
+	// DiscardMessages stops delivery on Messages(), for applications that
+	// only use the On* callbacks and would otherwise have to drain it.
+	DiscardMessages bool
+	// ProofOfWork solves the hub's /pow/challenge before every dial, for
+	// hubs that set POW_DIFFICULTY.
+	ProofOfWork bool
+	// Token, when set, is called before every dial and its result sent as
+	// the hub's token, so a hub using JWT authentication gets a fresh one
+	// after closing a connection with ReasonTokenExpired.
+	Token func() (string, error)
+	// Hidden announces with visibility "hidden": the hub tells no one about
+	// the peer, and only peers that already know its peer ID can reach it.
+	Hidden bool
+	// Binary asks the hub to send MessagePack frames instead of JSON text
+	// over WebSocket. Messages are delivered the same way either way; long
+	// polling always uses JSON.
+	Binary bool
+	// Identity is the ed25519 key the peer ID is registered to (see
+	// Register). On a hub with an identity store, connections claiming a
+	// registered peer ID must sign the hub's challenge with it.
+	Identity ed25519.PrivateKey
+}
+
+// Client is a connection to a hub. Incoming messages are delivered on
+// Messages(); the channel is closed when the client is closed or the
+// connection is lost without AutoReconnect.
+type Client struct {
+	hubURL  string
+	opts    Options
+	peerId  string
+	metrics *Metrics
+
+	mu       sync.Mutex
+	ws       transport
+	closed   bool
+	messages chan Message
+	handlers handlers
+	peers    *Directory
+	ice      []ICEServer
+	lastSeen int64
+	done     chan struct{}
+	// held is a message read while answering the hub's challenge, for the
+	// read loop to deliver first.
+	held *Message
+
+	// onLink, when set before the read loop starts, is told when the hub
+	// connection drops (false) and comes back (true).
+	onLink func(up bool)
+}
+
+// Dial connects to hubURL (ws:// or wss://) and announces the peer.
+func Dial(hubURL string, opts Options) (*Client, error) {
+	return dial(hubURL, opts, nil)
+}
+
+// Connect dials hubURL as peerId (random when empty) on the global network
+// with AutoReconnect. Register callbacks, then call AnnounceOn to join
+// another network. Messages() delivers nothing, so callers need not drain
+// it; use Dial to read the channel instead.
+func Connect(hubURL, peerId string) (*Client, error) {
+	return Dial(hubURL, Options{PeerId: peerId, AutoReconnect: true, DiscardMessages: true})
+}
+
+func dial(hubURL string, opts Options, onLink func(up bool)) (*Client, error) {
+	if opts.PeerId == "" {
+		opts.PeerId = NewPeerId()
+	}
+	if opts.NetworkName == "" {
+		opts.NetworkName = "global"
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = 30 * time.Second
+	}
+	if opts.PingInterval == 0 {
+		opts.PingInterval = 25 * time.Second
+	}
+	c := &Client{hubURL: hubURL, opts: opts, peerId: opts.PeerId, metrics: newMetrics(), messages: make(chan Message, 256), done: make(chan struct{}), peers: newDirectory(), onLink: onLink}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	go c.readLoop()
+	if opts.PingInterval > 0 {
+		go c.keepalive()
+	}
+	return c, nil
+}
+
+// NewPeerId returns a random 40-hex peer ID.
+func NewPeerId() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// PeerId returns the client's peer ID.
+func (c *Client) PeerId() string { return c.peerId }
+
+// Messages returns the channel of messages received from the hub.
+func (c *Client) Messages() <-chan Message { return c.messages }
+
+// Peers returns the client's directory of discovered peers.
+func (c *Client) Peers() *Directory { return c.peers }
+
+// Metrics returns the client's connectivity metrics.
+func (c *Client) Metrics() *Metrics { return c.metrics }
+
+func (c *Client) connect() error {
+	u, err := url.Parse(c.hubURL)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("peerId", c.peerId)
+	// payload decodes gzip data, so let the hub compress for us.
+	q.Set("features", "compression")
+	if c.opts.Token != nil {
+		token, err := c.opts.Token()
+		if err != nil {
+			return err
+		}
+		q.Set("token", token)
+	}
+	if c.opts.ProofOfWork {
+		proof, err := solveProofOfWork(u, c.peerId)
+		if err != nil {
+			return err
+		}
+		for k, v := range proof {
+			q[k] = v
+		}
+	}
+	if c.opts.Binary {
+		q.Set("proto", "msgpack")
+	}
+	u.RawQuery = q.Encode()
+	ws, err := dialTransport(u, c.opts.Transport)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	key := c.opts.Identity
+	c.mu.Unlock()
+	if key != nil && ws.Name() == TransportWebSocket {
+		if err := c.answerChallenge(ws, key); err != nil {
+			ws.Close()
+			return err
+		}
+	}
+	c.metrics.connected(ws.Name())
+	c.mu.Lock()
+	c.ws = ws
+	c.mu.Unlock()
+	atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
+	return c.Announce()
+}
+
+// Announce (re)announces the peer on its network.
+func (c *Client) Announce() error {
+	c.metrics.announced()
+	c.mu.Lock()
+	data, network := c.opts.AnnounceData, c.opts.NetworkName
+	c.mu.Unlock()
+	if c.opts.Hidden {
+		hidden := map[string]interface{}{"visibility": "hidden"}
+		for k, v := range data {
+			if k != "visibility" {
+				hidden[k] = v
+			}
+		}
+		data = hidden
+	}
+	return c.Send(Message{Type: "announce", NetworkName: network}, data)
+}
+
+// AnnounceOn moves the peer to network with data as its announce payload.
+// Both are kept for reconnects and for later signals.
+func (c *Client) AnnounceOn(network string, data map[string]interface{}) error {
+	c.mu.Lock()
+	c.opts.NetworkName, c.opts.AnnounceData = network, data
+	c.mu.Unlock()
+	return c.Announce()
+}
+
+func (c *Client) network() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.opts.NetworkName
+}
+
+// setAnnounceData replaces the announce payload used from now on, including
+// on reconnects.
+func (c *Client) setAnnounceData(data map[string]interface{}) {
+	c.mu.Lock()
+	c.opts.AnnounceData = data
+	c.mu.Unlock()
+}
+
+// Signal sends an offer, answer or ice-candidate to targetPeerId.
+func (c *Client) Signal(signalType, targetPeerId string, data interface{}) error {
+	if signalType == "offer" {
+		c.metrics.offerSent(targetPeerId)
+	}
+	return c.Send(Message{Type: signalType, TargetPeerId: targetPeerId, NetworkName: c.network()}, data)
+}
+
+// Send writes msg to the hub, encoding data as its payload when non-nil.
+func (c *Client) Send(msg Message, data interface{}) error {
+	if data != nil {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		msg.Data = b
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ws == nil {
+		return errors.New("not connected")
+	}
+	if err := c.ws.WriteJSON(msg); err != nil {
+		return err
+	}
+	c.metrics.sent()
+	return nil
+}
+
+// Close disconnects from the hub and stops reconnecting.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	ws := c.ws
+	c.mu.Unlock()
+	if ws == nil {
+		return nil
+	}
+	return ws.Close()
+}
+
+func (c *Client) readLoop() {
+	defer close(c.messages)
+	defer close(c.done)
+	for {
+		c.mu.Lock()
+		ws, held := c.ws, c.held
+		c.held = nil
+		c.mu.Unlock()
+		var msg Message
+		if held != nil {
+			msg = *held
+		} else if err := ws.ReadJSON(&msg); err != nil {
+			c.mu.Lock()
+			if c.ws == ws {
+				c.ws = nil
+			}
+			c.mu.Unlock()
+			if c.onLink != nil {
+				c.onLink(false)
+			}
+			if !c.reconnect() {
+				return
+			}
+			if c.onLink != nil {
+				c.onLink(true)
+			}
+			continue
+		}
+		atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
+		if data, err := msg.payload(); err == nil {
+			msg.Data, msg.Encoding = data, ""
+		}
+		c.metrics.received(msg)
+		if msg.Type == "peer-message" && msg.Receipts && msg.MessageId != "" {
+			c.sendReceipt(msg, ReceiptDelivered)
+		}
+		c.dispatch(msg)
+		if !c.opts.DiscardMessages {
+			c.messages <- msg
+		}
+	}
+}
+
+// keepalive pings the hub every PingInterval and drops a connection that
+// has gone quiet for two, so the read loop notices and reconnects.
+func (c *Client) keepalive() {
+	ticker := time.NewTicker(c.opts.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		c.mu.Lock()
+		ws := c.ws
+		c.mu.Unlock()
+		if ws == nil {
+			continue
+		}
+		if time.Since(time.Unix(0, atomic.LoadInt64(&c.lastSeen))) > 2*c.opts.PingInterval {
+			ws.Close()
+			continue
+		}
+		c.Send(Message{Type: "ping"}, nil)
+	}
+}
+
+// reconnect redials with exponential backoff. It reports false when the
+// client is closed or AutoReconnect is off.
+func (c *Client) reconnect() bool {
+	backoff := 500 * time.Millisecond
+	for {
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		if closed || !c.opts.AutoReconnect {
+			return false
+		}
+		time.Sleep(backoff)
+		if err := c.connect(); err == nil {
+			// Close may have run while connect was dialing.
+			c.mu.Lock()
+			ws := c.ws
+			if c.closed {
+				c.ws = nil
+			}
+			closed := c.closed
+			c.mu.Unlock()
+			if closed {
+				ws.Close()
+				return false
+			}
+			c.metrics.reconnected()
+			return true
+		}
+		c.metrics.reconnectFailed()
+		if backoff *= 2; backoff > c.opts.MaxBackoff {
+			backoff = c.opts.MaxBackoff
+		}
+	}
+}
+
+// payload returns the message data, undoing hub-side gzip compression.
+func (m Message) payload() (json.RawMessage, error) {
+	if m.Encoding != "gzip" {
+		return m.Data, nil
+	}
+	var enc string
+	if err := json.Unmarshal(m.Data, &enc); err != nil {
+		return nil, err
+	}
+	b, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
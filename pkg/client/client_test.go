@@ -0,0 +1,465 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"peerpigeon/internal/server"
+)
+
+func TestMetricsTrackSignalingRoundTrip(t *testing.T) {
+	m := newMetrics()
+	m.announced()
+	m.received(Message{Type: "peer-discovered"})
+	m.offerSent("peer-b")
+	m.received(Message{Type: "answer", FromPeerId: "peer-b"})
+	snap := m.Snapshot()
+	if snap["signaling_round_trips"].(int64) != 1 || snap["signaling_pending"].(int) != 0 {
+		t.Fatalf("expected one completed round trip, got %v", snap)
+	}
+	if snap["received_by_type"].(map[string]int64)["answer"] != 1 {
+		t.Fatalf("expected answer counted by type, got %v", snap["received_by_type"])
+	}
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), `peerpigeon_client_received_by_type{type="answer"} 1`) {
+		t.Fatalf("unexpected exposition:\n%s", rec.Body.String())
+	}
+}
+
+func TestPeerDisconnectedReason(t *testing.T) {
+	msg := Message{Type: "peer-disconnected", Data: []byte(`{"peerId":"abc","reason":"client-goodbye"}`)}
+	id, reason, ok := msg.PeerDisconnected()
+	if !ok || id != "abc" || reason != ReasonClientGoodbye || !reason.Voluntary() {
+		t.Fatalf("unexpected decode: %q %q %v", id, reason, ok)
+	}
+	if ReasonKicked.Voluntary() {
+		t.Fatalf("kicked is not voluntary")
+	}
+	if _, _, ok := (Message{Type: "pong"}).PeerDisconnected(); ok {
+		t.Fatalf("only peer-disconnected should decode")
+	}
+}
+
+func TestReceiptDecode(t *testing.T) {
+	msg := Message{Type: "message-receipt", MessageId: "m1", Data: []byte(`{"messageId":"m1","status":"read"}`)}
+	id, status, ok := msg.Receipt()
+	if !ok || id != "m1" || status != ReceiptRead {
+		t.Fatalf("unexpected decode: %q %q %v", id, status, ok)
+	}
+	if _, _, ok := (Message{Type: "peer-message"}).Receipt(); ok {
+		t.Fatalf("only message-receipt should decode")
+	}
+}
+
+func TestServiceRecordsDecode(t *testing.T) {
+	msg := Message{Type: "service-records", Data: []byte(`{"queryId":"q1","records":[{"peerId":"p","local":true,"name":"api","protocol":"https","host":"10.0.0.5","port":8443,"tls":true}]}`)}
+	id, recs, ok := msg.ServiceRecords()
+	if !ok || id != "q1" || len(recs) != 1 || recs[0].Port != 8443 || !recs[0].TLS || !recs[0].Local {
+		t.Fatalf("unexpected decode: %q %+v %v", id, recs, ok)
+	}
+}
+
+func TestPeerActivityDecode(t *testing.T) {
+	id, idle, idleMs, ok := Message{Type: "peer-idle", Data: []byte(`{"peerId":"p","lastActivity":1000,"idleMs":61000}`)}.PeerActivity()
+	if !ok || id != "p" || !idle || idleMs != 61000 {
+		t.Fatalf("unexpected decode: %q %v %d %v", id, idle, idleMs, ok)
+	}
+	if _, idle, _, ok := (Message{Type: "peer-active", Data: []byte(`{"peerId":"p","idleMs":5}`)}).PeerActivity(); !ok || idle {
+		t.Fatalf("peer-active should decode as not idle")
+	}
+	if _, _, _, ok := (Message{Type: "pong"}).PeerActivity(); ok {
+		t.Fatalf("only peer-idle and peer-active should decode")
+	}
+}
+
+func TestPoolReassignsIdentitiesWhenAConnectionDrops(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := server.NewServer(server.Options{Host: "127.0.0.1", MaxConnections: 100, CleanupIntervalMs: 30000, PeerTimeoutMs: 300000, MaxMessageBytes: 1 << 20})
+	go hub.Serve(ln)
+	defer ln.Close()
+
+	var mu sync.Mutex
+	moves := map[string][]string{}
+	p, err := DialPool(fmt.Sprintf("ws://%s/ws", ln.Addr()), PoolOptions{Size: 3, Options: Options{NetworkName: "pool"}, AnnounceIdentities: true, OnReassign: func(id, from, to string) {
+		mu.Lock()
+		moves[id] = append(moves[id], to)
+		mu.Unlock()
+	}})
+	if err != nil {
+		t.Fatalf("dial pool: %v", err)
+	}
+	defer p.Close()
+	ids := []string{}
+	for i := 0; i < 30; i++ {
+		ids = append(ids, fmt.Sprintf("user-%d", i))
+	}
+	p.Add(ids...)
+	before := p.Assignments()
+	perShard := map[string]int{}
+	for _, shard := range before {
+		perShard[shard]++
+	}
+	if len(perShard) < 2 || perShard[""] != 0 {
+		t.Fatalf("identities should spread over live connections, got %v", perShard)
+	}
+	if err := p.Send(Message{Type: "ping"}, nil); err != nil {
+		t.Fatalf("balanced send: %v", err)
+	}
+
+	dropped := p.Clients()[0]
+	dropped.mu.Lock()
+	ws := dropped.ws
+	dropped.mu.Unlock()
+	ws.Close()
+	waitUntil := func(what string, cond func() bool) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	onDropped := func() int {
+		n := 0
+		for _, shard := range p.Assignments() {
+			if shard == dropped.PeerId() {
+				n++
+			}
+		}
+		return n
+	}
+	waitUntil("identities to leave the dropped connection", func() bool { return onDropped() == 0 })
+	if c := p.For(ids[0]); c == nil || c == dropped {
+		t.Fatalf("For should return a live connection while one is down")
+	}
+	waitUntil("identities to return after reconnect", func() bool { return onDropped() == perShard[dropped.PeerId()] })
+	after := p.Assignments()
+	for id, shard := range before {
+		if after[id] != shard {
+			t.Fatalf("%s should be back on %s, is on %s", id, shard, after[id])
+		}
+		mu.Lock()
+		n := len(moves[id])
+		mu.Unlock()
+		if want := 1; shard == dropped.PeerId() {
+			want = 3
+			if n != want {
+				t.Fatalf("%s moved %d times, want %d", id, n, want)
+			}
+		} else if n != want {
+			t.Fatalf("%s moved %d times, want %d", id, n, want)
+		}
+	}
+}
+
+func TestCallbacksSignalingAndKeepalive(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := server.NewServer(server.Options{Host: "127.0.0.1", MaxConnections: 100, CleanupIntervalMs: 30000, PeerTimeoutMs: 300000, MaxMessageBytes: 1 << 20})
+	go hub.Serve(ln)
+	defer ln.Close()
+	hubURL := fmt.Sprintf("ws://%s/ws", ln.Addr())
+
+	a, err := Dial(hubURL, Options{AutoReconnect: true, PingInterval: 50 * time.Millisecond, DiscardMessages: true, Binary: true})
+	if err != nil {
+		t.Fatalf("dial a: %v", err)
+	}
+	defer a.Close()
+	found := make(chan string, 4)
+	left := make(chan DisconnectReason, 4)
+	a.OnPeerDiscovered(func(peerId string, data json.RawMessage) { found <- peerId })
+	a.OnPeerDisconnected(func(peerId string, reason DisconnectReason) { left <- reason })
+	if err := a.AnnounceOn("callbacks", nil); err != nil {
+		t.Fatalf("announce: %v", err)
+	}
+
+	b, err := Connect(hubURL, "")
+	if err != nil {
+		t.Fatalf("connect b: %v", err)
+	}
+	signals := make(chan Message, 4)
+	b.OnSignal(func(msg Message) { signals <- msg })
+	b.AnnounceOn("callbacks", map[string]interface{}{"name": "b"})
+	select {
+	case id := <-found:
+		if id != b.PeerId() {
+			t.Fatalf("discovered %s, want %s", id, b.PeerId())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("a never discovered b")
+	}
+
+	a.SendOffer(b.PeerId(), map[string]interface{}{"type": "offer", "sdp": "v=0"})
+	select {
+	case msg := <-signals:
+		if msg.Type != "offer" || msg.FromPeerId != a.PeerId() {
+			t.Fatalf("unexpected signal %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("b never received the offer")
+	}
+
+	// A connection that has heard nothing for two ping intervals is dropped
+	// and redialed.
+	atomic.StoreInt64(&a.lastSeen, time.Now().Add(-time.Second).UnixNano())
+	deadline := time.Now().Add(5 * time.Second)
+	for a.Metrics().Snapshot()["reconnects"].(int64) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("stale connection was not redialed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b.Close()
+	select {
+	case reason := <-left:
+		if reason != ReasonClientGoodbye {
+			t.Fatalf("unexpected reason %q", reason)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("a never saw b leave")
+	}
+}
+
+func TestCloseDuringReconnectDropsTheNewConnection(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := server.NewServer(server.Options{Host: "127.0.0.1", MaxConnections: 100, CleanupIntervalMs: 30000, PeerTimeoutMs: 300000, MaxMessageBytes: 1 << 20})
+	go hub.Serve(ln)
+	defer ln.Close()
+	hubURL := fmt.Sprintf("ws://%s/ws", ln.Addr())
+
+	var c *Client
+	var dials int32
+	c, err = Dial(hubURL, Options{AutoReconnect: true, PingInterval: -1, Token: func() (string, error) {
+		// The redial races a Close.
+		if atomic.AddInt32(&dials, 1) == 2 {
+			c.Close()
+		}
+		return "", nil
+	}})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	c.mu.Lock()
+	c.ws.Close()
+	c.mu.Unlock()
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the read loop should stop once closed")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if atomic.LoadInt32(&dials) != 2 || c.ws != nil {
+		t.Fatalf("a connection made after Close should be dropped (dials %d)", dials)
+	}
+}
+
+func TestDirectoryTracksAndQueriesPeers(t *testing.T) {
+	c := &Client{peerId: "self", peers: newDirectory()}
+	c.dispatch(Message{Type: "peer-discovered", NetworkName: "game", Data: []byte(`{"peerId":"a","capabilities":["relay"]}`)})
+	c.dispatch(Message{Type: "peer-list", NetworkName: "game", Data: []byte(`{"peers":[{"peerId":"b"},{"peerId":"self"},{"peerId":"a","capabilities":["relay","storage"]}]}`)})
+	c.dispatch(Message{Type: "peer-discovered", NetworkName: "chat", Data: []byte(`{"peerId":"c"}`)})
+	d := c.Peers()
+	if d.Len() != 3 {
+		t.Fatalf("expected 3 peers, got %v", d.All())
+	}
+	if a, _ := d.Get("a"); a.Seen != 2 || len(a.Capabilities) != 2 || a.Staleness() > time.Second {
+		t.Fatalf("unexpected entry for a: %+v", a)
+	}
+	if got := d.ByNetwork("game"); len(got) != 2 || got[0].PeerId != "a" || got[1].PeerId != "b" {
+		t.Fatalf("unexpected game peers: %+v", got)
+	}
+	if got := d.ByCapability("storage"); len(got) != 1 || got[0].PeerId != "a" {
+		t.Fatalf("unexpected storage peers: %+v", got)
+	}
+	if got := d.Random(2); len(got) != 2 || got[0].PeerId == got[1].PeerId {
+		t.Fatalf("unexpected random sample: %+v", got)
+	}
+
+	c.dispatch(Message{Type: "presence-update", Data: []byte(`{"peerId":"a","presence":{"displayName":"Ada","capabilities":["video"],"tags":{"region":"eu"}}}`)})
+	if a, _ := d.Get("a"); a.Presence.DisplayName != "Ada" || a.Presence.Tags["region"] != "eu" {
+		t.Fatalf("presence-update not applied to a: %+v", a)
+	}
+	if got := d.ByCapability("video"); len(got) != 1 || got[0].PeerId != "a" {
+		t.Fatalf("unexpected video peers: %+v", got)
+	}
+
+	c.dispatch(Message{Type: "peer-disconnected", Data: []byte(`{"peerId":"b","reason":"idle-timeout"}`)})
+	if _, ok := d.Get("b"); ok {
+		t.Fatalf("b should be pruned on disconnect")
+	}
+	d.peers["c"].LastSeen = time.Now().Add(-time.Minute)
+	if n := d.Prune(30 * time.Second); n != 1 || d.Len() != 1 {
+		t.Fatalf("expected c pruned as stale, dropped %d, left %v", n, d.All())
+	}
+}
+
+func TestDialSolvesProofOfWork(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := server.NewServer(server.Options{Host: "127.0.0.1", MaxConnections: 100, CleanupIntervalMs: 30000, PeerTimeoutMs: 300000, MaxMessageBytes: 1 << 20, PowDifficulty: 10})
+	go hub.Serve(ln)
+	defer ln.Close()
+	hubURL := fmt.Sprintf("ws://%s/ws", ln.Addr())
+
+	if _, err := Dial(hubURL, Options{Transport: TransportWebSocket}); err == nil {
+		t.Fatalf("dial without proof of work should be refused")
+	}
+	c, err := Dial(hubURL, Options{ProofOfWork: true})
+	if err != nil {
+		t.Fatalf("dial with proof of work: %v", err)
+	}
+	c.Close()
+}
+
+func TestRegisteredPeerAnswersOwnershipChallenge(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := server.NewServer(server.Options{Host: "127.0.0.1", MaxConnections: 100, CleanupIntervalMs: 30000, PeerTimeoutMs: 300000, MaxMessageBytes: 1 << 20, IdentityStorePath: filepath.Join(t.TempDir(), "identities.json")})
+	go hub.Serve(ln)
+	defer ln.Close()
+	hubURL := fmt.Sprintf("ws://%s/ws", ln.Addr())
+	next := func(c *Client, typ string) bool {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case msg, ok := <-c.Messages():
+				if !ok {
+					return false
+				}
+				if msg.Type == typ {
+					return true
+				}
+			case <-timeout:
+				return false
+			}
+		}
+	}
+
+	// Before the ID is registered there is no challenge, and the greeting
+	// read while waiting for one is still delivered.
+	_, key, _ := ed25519.GenerateKey(nil)
+	c, err := Dial(hubURL, Options{Transport: TransportWebSocket, Identity: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := c.PeerId()
+	if !next(c, "connected") {
+		t.Fatalf("greeting should be delivered")
+	}
+	if err := c.Register(key); err != nil || !next(c, "registered") {
+		t.Fatalf("register failed: %v", err)
+	}
+	c.Close()
+
+	// The reserved ID is only usable by a client holding the key.
+	_, other, _ := ed25519.GenerateKey(nil)
+	for name, k := range map[string]ed25519.PrivateKey{"no key": nil, "wrong key": other} {
+		if c, err := Dial(hubURL, Options{PeerId: id, Transport: TransportWebSocket, Identity: k}); err == nil {
+			c.Send(Message{Type: "ping"}, nil)
+			if next(c, "pong") {
+				t.Fatalf("%s: hub should refuse the reserved ID", name)
+			}
+			c.Close()
+		}
+	}
+	c, err = Dial(hubURL, Options{PeerId: id, Transport: TransportWebSocket, Identity: key})
+	if err != nil {
+		t.Fatalf("dial with the registered key: %v", err)
+	}
+	defer c.Close()
+	if !next(c, "connected") {
+		t.Fatalf("greeting should follow the answered challenge")
+	}
+	if err := c.Send(Message{Type: "ping"}, nil); err != nil || !next(c, "pong") {
+		t.Fatalf("registered peer should stay connected: %v", err)
+	}
+}
+
+func TestHubSelectorPrefersReachableHub(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := server.NewServer(server.Options{Host: "127.0.0.1", MaxConnections: 100, CleanupIntervalMs: 30000, PeerTimeoutMs: 300000, MaxMessageBytes: 1 << 20})
+	go hub.Serve(ln)
+	defer ln.Close()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadURL := fmt.Sprintf("ws://%s/ws", dead.Addr())
+	dead.Close()
+	hubURL := fmt.Sprintf("ws://%s/ws", ln.Addr())
+
+	var changed atomic.Value
+	sel := NewHubSelector([]string{deadURL, hubURL}, SelectorOptions{Timeout: 2 * time.Second, OnChange: func(best HubCandidate) { changed.Store(best.URL) }})
+	ranked := sel.Probe()
+	if len(ranked) != 2 || ranked[0].URL != hubURL || !ranked[0].Healthy || ranked[1].Healthy || ranked[1].Error == "" {
+		t.Fatalf("unexpected ranking: %+v", ranked)
+	}
+	if best, ok := sel.Best(); !ok || best.ConnectLatency <= 0 || best.Score < best.ConnectLatency {
+		t.Fatalf("unexpected best hub: %+v", best)
+	}
+	if changed.Load() != hubURL {
+		t.Fatalf("OnChange not called with the best hub")
+	}
+	c, err := sel.Dial(Options{Transport: TransportWebSocket})
+	if err != nil {
+		t.Fatalf("dial best hub: %v", err)
+	}
+	c.Close()
+}
+
+func TestICEServersDecode(t *testing.T) {
+	msg := Message{Type: "connected", Data: []byte(`{"peerId":"abc","iceServers":[{"urls":["stun:stun.example.com"]},{"urls":["turn:turn.example.com"],"username":"1700000000:abc","credential":"c2VjcmV0"}],"iceServersExpireAt":1700000000000}`)}
+	servers, expiresAt, ok := msg.ICEServers()
+	if !ok || len(servers) != 2 || servers[1].Username != "1700000000:abc" || expiresAt != 1700000000000 {
+		t.Fatalf("unexpected decode: %+v %d %v", servers, expiresAt, ok)
+	}
+	if _, _, ok := (Message{Type: "connected", Data: []byte(`{"peerId":"abc"}`)}).ICEServers(); ok {
+		t.Fatalf("a greeting without servers should not decode")
+	}
+
+	c := &Client{peerId: "abc", peers: newDirectory()}
+	c.dispatch(msg)
+	if got := c.ICEServers(); len(got) != 2 || got[0].URLs[0] != "stun:stun.example.com" {
+		t.Fatalf("client should keep the greeting's servers, got %+v", got)
+	}
+	c.dispatch(Message{Type: "connected", Data: []byte(`{"peerId":"abc"}`)})
+	if c.ICEServers() != nil {
+		t.Fatalf("a later greeting without servers should clear them")
+	}
+}
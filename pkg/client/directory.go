@@ -0,0 +1,157 @@
+package client
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PeerEntry is what a client knows about one peer the hub reported.
+type PeerEntry struct {
+	PeerId  string
+	Network string
+	// Data is the peer's announce payload as last discovered.
+	Data         json.RawMessage
+	Capabilities []string
+	// Presence is the peer's presence, kept current by presence-update.
+	Presence  Presence
+	FirstSeen time.Time
+	// LastSeen is the time of the latest discovery event for the peer.
+	LastSeen time.Time
+	// Seen counts the discovery events that reported the peer.
+	Seen int
+}
+
+// Staleness is how long ago the peer was last reported.
+func (e PeerEntry) Staleness() time.Duration { return time.Since(e.LastSeen) }
+
+// Directory is a client's cache of discovered peers. The client fills it
+// from peer-discovered and peer-list messages and removes peers when their
+// peer-disconnected arrives; entries whose disconnect was missed can be
+// dropped with Prune. Query results are copies.
+type Directory struct {
+	mu    sync.Mutex
+	peers map[string]*PeerEntry
+}
+
+func newDirectory() *Directory {
+	return &Directory{peers: map[string]*PeerEntry{}}
+}
+
+func (d *Directory) seen(peerId, network string, data json.RawMessage) {
+	var announce struct {
+		Capabilities []string `json:"capabilities"`
+		Presence     Presence `json:"presence"`
+	}
+	json.Unmarshal(data, &announce)
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e := d.peers[peerId]
+	if e == nil {
+		e = &PeerEntry{PeerId: peerId, FirstSeen: now}
+		d.peers[peerId] = e
+	}
+	e.Network, e.Data, e.Capabilities, e.Presence, e.LastSeen = network, data, announce.Capabilities, announce.Presence, now
+	if len(e.Capabilities) == 0 {
+		e.Capabilities = announce.Presence.Capabilities
+	}
+	e.Seen++
+}
+
+// presenceChanged applies a presence-update to a cached peer.
+func (d *Directory) presenceChanged(peerId string, p Presence) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e := d.peers[peerId]; e != nil {
+		e.Presence, e.Capabilities, e.LastSeen = p, p.Capabilities, time.Now()
+	}
+}
+
+func (d *Directory) remove(peerId string) {
+	d.mu.Lock()
+	delete(d.peers, peerId)
+	d.mu.Unlock()
+}
+
+// Get returns the entry for peerId.
+func (d *Directory) Get(peerId string) (PeerEntry, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e, ok := d.peers[peerId]
+	if !ok {
+		return PeerEntry{}, false
+	}
+	return *e, true
+}
+
+// Len returns the number of cached peers.
+func (d *Directory) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.peers)
+}
+
+func (d *Directory) filter(keep func(*PeerEntry) bool) []PeerEntry {
+	d.mu.Lock()
+	out := []PeerEntry{}
+	for _, e := range d.peers {
+		if keep(e) {
+			out = append(out, *e)
+		}
+	}
+	d.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].PeerId < out[j].PeerId })
+	return out
+}
+
+// All returns every cached peer, ordered by peer ID.
+func (d *Directory) All() []PeerEntry {
+	return d.filter(func(*PeerEntry) bool { return true })
+}
+
+// ByNetwork returns the peers discovered on network.
+func (d *Directory) ByNetwork(network string) []PeerEntry {
+	return d.filter(func(e *PeerEntry) bool { return e.Network == network })
+}
+
+// ByCapability returns the peers that list capability in the
+// "capabilities" array of their announce data or presence.
+func (d *Directory) ByCapability(capability string) []PeerEntry {
+	return d.filter(func(e *PeerEntry) bool {
+		for _, c := range e.Capabilities {
+			if c == capability {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Random returns up to n peers chosen at random.
+func (d *Directory) Random(n int) []PeerEntry {
+	all := d.All()
+	rand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+	if n < len(all) {
+		all = all[:n]
+	}
+	return all
+}
+
+// Prune drops peers not reported for longer than maxAge and returns how
+// many it dropped.
+func (d *Directory) Prune(maxAge time.Duration) int {
+	cutoff := time.Now().Add(-maxAge)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for id, e := range d.peers {
+		if e.LastSeen.Before(cutoff) {
+			delete(d.peers, id)
+			n++
+		}
+	}
+	return n
+}
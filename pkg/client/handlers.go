@@ -0,0 +1,100 @@
+package client
+
+import "encoding/json"
+
+// handlers are the callbacks registered with the On* methods. They run on
+// the client's read loop, before the message is put on Messages(), so they
+// should return quickly.
+type handlers struct {
+	discovered   func(peerId string, data json.RawMessage)
+	disconnected func(peerId string, reason DisconnectReason)
+	signal       func(msg Message)
+}
+
+// OnPeerDiscovered calls fn with each peer the hub reports on the client's
+// network, from peer-discovered and batched peer-list messages. The peer is
+// already in Peers() when fn runs.
+func (c *Client) OnPeerDiscovered(fn func(peerId string, data json.RawMessage)) {
+	c.mu.Lock()
+	c.handlers.discovered = fn
+	c.mu.Unlock()
+}
+
+// OnPeerDisconnected calls fn when a peer on the client's network leaves.
+func (c *Client) OnPeerDisconnected(fn func(peerId string, reason DisconnectReason)) {
+	c.mu.Lock()
+	c.handlers.disconnected = fn
+	c.mu.Unlock()
+}
+
+// OnSignal calls fn with each offer, answer and ice-candidate sent to the
+// client; msg.FromPeerId is the sender.
+func (c *Client) OnSignal(fn func(msg Message)) {
+	c.mu.Lock()
+	c.handlers.signal = fn
+	c.mu.Unlock()
+}
+
+func (c *Client) dispatch(msg Message) {
+	c.mu.Lock()
+	h := c.handlers
+	c.mu.Unlock()
+	switch msg.Type {
+	case "connected":
+		servers, _, _ := msg.ICEServers()
+		c.mu.Lock()
+		c.ice = servers
+		c.mu.Unlock()
+	case "peer-discovered", "peer-list":
+		peers := []json.RawMessage{msg.Data}
+		if msg.Type == "peer-list" {
+			var d struct {
+				Peers []json.RawMessage `json:"peers"`
+			}
+			json.Unmarshal(msg.Data, &d)
+			peers = d.Peers
+		}
+		for _, p := range peers {
+			var d struct {
+				PeerId string `json:"peerId"`
+			}
+			if json.Unmarshal(p, &d) != nil || d.PeerId == "" || d.PeerId == c.peerId {
+				continue
+			}
+			c.peers.seen(d.PeerId, msg.NetworkName, p)
+			if h.discovered != nil {
+				h.discovered(d.PeerId, p)
+			}
+		}
+	case "presence-update":
+		if id, p, ok := msg.PresenceUpdate(); ok {
+			c.peers.presenceChanged(id, p)
+		}
+	case "peer-disconnected":
+		if id, reason, ok := msg.PeerDisconnected(); ok {
+			c.peers.remove(id)
+			if h.disconnected != nil {
+				h.disconnected(id, reason)
+			}
+		}
+	case "offer", "answer", "ice-candidate":
+		if h.signal != nil {
+			h.signal(msg)
+		}
+	}
+}
+
+// SendOffer sends an SDP offer to targetPeerId.
+func (c *Client) SendOffer(targetPeerId string, sdp interface{}) error {
+	return c.Signal("offer", targetPeerId, sdp)
+}
+
+// SendAnswer sends an SDP answer to targetPeerId.
+func (c *Client) SendAnswer(targetPeerId string, sdp interface{}) error {
+	return c.Signal("answer", targetPeerId, sdp)
+}
+
+// SendICE sends an ICE candidate to targetPeerId.
+func (c *Client) SendICE(targetPeerId string, candidate interface{}) error {
+	return c.Signal("ice-candidate", targetPeerId, candidate)
+}
@@ -0,0 +1,37 @@
+package client
+
+import "encoding/json"
+
+// ICEServer is a STUN or TURN server the hub offers, in the shape WebRTC
+// libraries take (RTCIceServer / pion's webrtc.ICEServer).
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICEServers decodes the ICE servers in the hub's connected greeting, with
+// the time (milliseconds since the epoch) their generated TURN credentials
+// expire, or 0 if none were generated. ok is false for any other message
+// type or a hub that offers no servers.
+func (m Message) ICEServers() (servers []ICEServer, expiresAt int64, ok bool) {
+	if m.Type != "connected" {
+		return nil, 0, false
+	}
+	var d struct {
+		ICEServers []ICEServer `json:"iceServers"`
+		ExpiresAt  int64       `json:"iceServersExpireAt"`
+	}
+	if err := json.Unmarshal(m.Data, &d); err != nil || len(d.ICEServers) == 0 {
+		return nil, 0, false
+	}
+	return d.ICEServers, d.ExpiresAt, true
+}
+
+// ICEServers returns the ICE servers the hub offered in its latest
+// connected greeting, or nil if it offered none.
+func (c *Client) ICEServers() []ICEServer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ice
+}
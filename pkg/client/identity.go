@@ -0,0 +1,51 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// ErrBadChallenge is returned by Dial when the hub's ownership challenge
+// cannot be decoded.
+var ErrBadChallenge = errors.New("client: malformed challenge")
+
+// Register binds the client's peer ID to key on a hub with an identity
+// store. The hub answers with a "registered" message, or an error. key is
+// kept as Options.Identity, so later dials and reconnects answer the hub's
+// ownership challenge with it.
+func (c *Client) Register(key ed25519.PrivateKey) error {
+	c.mu.Lock()
+	c.opts.Identity = key
+	c.mu.Unlock()
+	pub := key.Public().(ed25519.PublicKey)
+	return c.Send(Message{Type: "register"}, map[string]string{
+		"publicKey": base64.StdEncoding.EncodeToString(pub),
+		"signature": base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(c.peerId))),
+	})
+}
+
+// answerChallenge reads the hub's first message on a new connection. A
+// challenge for a registered peer ID is answered by signing its nonce with
+// key; any other message is held for the read loop.
+func (c *Client) answerChallenge(ws transport, key ed25519.PrivateKey) error {
+	var msg Message
+	if err := ws.ReadJSON(&msg); err != nil {
+		return err
+	}
+	if msg.Type != "challenge" {
+		c.mu.Lock()
+		c.held = &msg
+		c.mu.Unlock()
+		return nil
+	}
+	var challenge struct {
+		Nonce string `json:"nonce"`
+	}
+	if json.Unmarshal(msg.Data, &challenge) != nil || challenge.Nonce == "" {
+		return ErrBadChallenge
+	}
+	data, _ := json.Marshal(map[string]string{"signature": base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(challenge.Nonce)))})
+	return ws.WriteJSON(Message{Type: "challenge-response", Data: data})
+}
@@ -0,0 +1,190 @@
+package client
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metrics records the client's view of its connectivity health.
+type Metrics struct {
+	mu sync.Mutex
+
+	Transport         string
+	Reconnects        int64
+	ReconnectFailures int64
+	MessagesSent      int64
+	MessagesReceived  int64
+	ReceivedByType    map[string]int64
+
+	// Discovery latency: announce to first peer-discovered.
+	announceAt         time.Time
+	DiscoveryLatencyMs int64
+
+	// Signaling round trips: offer sent to answer received, per peer.
+	pendingOffers      map[string]time.Time
+	SignalingRTTs      int64
+	SignalingRTTMsSum  int64
+	LastSignalingRTTMs int64
+}
+
+// maxReceivedTypes bounds ReceivedByType; message types beyond it are
+// counted under "other" so a misbehaving hub cannot grow it without limit.
+const maxReceivedTypes = 64
+
+func newMetrics() *Metrics {
+	return &Metrics{ReceivedByType: map[string]int64{}, pendingOffers: map[string]time.Time{}}
+}
+
+func (m *Metrics) sent() {
+	m.mu.Lock()
+	m.MessagesSent++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) announced() {
+	m.mu.Lock()
+	m.announceAt = time.Now()
+	m.mu.Unlock()
+}
+
+func (m *Metrics) offerSent(target string) {
+	m.mu.Lock()
+	m.pendingOffers[target] = time.Now()
+	m.mu.Unlock()
+}
+
+func (m *Metrics) connected(transport string) {
+	m.mu.Lock()
+	m.Transport = transport
+	m.mu.Unlock()
+}
+
+func (m *Metrics) reconnected() {
+	m.mu.Lock()
+	m.Reconnects++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) reconnectFailed() {
+	m.mu.Lock()
+	m.ReconnectFailures++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) received(msg Message) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.MessagesReceived++
+	if _, ok := m.ReceivedByType[msg.Type]; ok || len(m.ReceivedByType) < maxReceivedTypes {
+		m.ReceivedByType[msg.Type]++
+	} else {
+		m.ReceivedByType["other"]++
+	}
+	switch msg.Type {
+	case "peer-discovered", "peer-list":
+		if !m.announceAt.IsZero() {
+			m.DiscoveryLatencyMs = time.Since(m.announceAt).Milliseconds()
+			m.announceAt = time.Time{}
+		}
+	case "answer":
+		if at, ok := m.pendingOffers[msg.FromPeerId]; ok {
+			rtt := time.Since(at).Milliseconds()
+			delete(m.pendingOffers, msg.FromPeerId)
+			m.SignalingRTTs++
+			m.SignalingRTTMsSum += rtt
+			m.LastSignalingRTTMs = rtt
+		}
+	}
+}
+
+// Snapshot returns a point-in-time copy of the metrics.
+func (m *Metrics) Snapshot() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	byType := make(map[string]int64, len(m.ReceivedByType))
+	for k, v := range m.ReceivedByType {
+		byType[k] = v
+	}
+	avg := int64(0)
+	if m.SignalingRTTs > 0 {
+		avg = m.SignalingRTTMsSum / m.SignalingRTTs
+	}
+	return map[string]interface{}{
+		"transport":             m.Transport,
+		"reconnects":            m.Reconnects,
+		"reconnect_failures":    m.ReconnectFailures,
+		"messages_sent":         m.MessagesSent,
+		"messages_received":     m.MessagesReceived,
+		"received_by_type":      byType,
+		"discovery_latency_ms":  m.DiscoveryLatencyMs,
+		"signaling_round_trips": m.SignalingRTTs,
+		"signaling_rtt_avg_ms":  avg,
+		"signaling_rtt_last_ms": m.LastSignalingRTTMs,
+		"signaling_pending":     len(m.pendingOffers),
+	}
+}
+
+// Handler serves the metrics in the Prometheus text exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		snap := m.Snapshot()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		keys := make([]string, 0, len(snap))
+		for k := range snap {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if byType, ok := snap[k].(map[string]int64); ok {
+				clean := make(map[string]int64, len(byType))
+				for t, n := range byType {
+					clean[sanitizeLabel(t)] += n
+				}
+				types := make([]string, 0, len(clean))
+				for t := range clean {
+					types = append(types, t)
+				}
+				sort.Strings(types)
+				for _, t := range types {
+					fmt.Fprintf(w, "peerpigeon_client_%s{type=%q} %d\n", k, t, clean[t])
+				}
+				continue
+			}
+			if str, ok := snap[k].(string); ok {
+				fmt.Fprintf(w, "peerpigeon_client_%s{name=%q} 1\n", k, sanitizeLabel(str))
+				continue
+			}
+			fmt.Fprintf(w, "peerpigeon_client_%s %v\n", k, snap[k])
+		}
+	})
+}
+
+// sanitizeLabel replaces characters outside letters, digits and . _ - : @ /
+// so hub-supplied strings are valid Prometheus label values.
+func sanitizeLabel(v string) string {
+	if v == "" {
+		return "unknown"
+	}
+	if len(v) > 64 {
+		v = v[:64]
+	}
+	b := []byte(v)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == '-', c == ':', c == '@', c == '/':
+		default:
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// PublishExpvar exposes the metrics under name in /debug/vars.
+func (m *Metrics) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} { return m.Snapshot() }))
+}
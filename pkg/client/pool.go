@@ -0,0 +1,302 @@
+package client
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// PoolOptions configures a Pool.
+type PoolOptions struct {
+	// Size is the number of hub connections (default 4).
+	Size int
+	// Options is the template for every connection. PeerId is ignored: each
+	// connection gets its own, and AutoReconnect is always on.
+	Options Options
+	// AnnounceIdentities adds "poolIdentities", the identities a connection
+	// currently serves, to its announce data so other peers can tell which
+	// peer ID to reach an identity at. Connections re-announce whenever their
+	// set changes.
+	AnnounceIdentities bool
+	// OnReassign is called when an identity moves to another connection,
+	// with the old and new connections' peer IDs. from is empty for a newly
+	// added identity.
+	OnReassign func(identity, from, to string)
+}
+
+// Pool spreads the signaling of many virtual identities (e.g. the users a
+// backend acts for) over several hub connections. Each identity is pinned to
+// one live connection by rendezvous hashing, so identities only move when
+// the connection they were on drops, and move back when it returns. Sends
+// that are not tied to an identity are balanced round-robin across live
+// connections.
+type Pool struct {
+	opts     PoolOptions
+	shards   []*poolShard
+	messages chan Message
+	next     uint32
+	ready    int32
+
+	// rebalanceMu orders rebalances so re-announces are not reordered.
+	rebalanceMu sync.Mutex
+	mu          sync.Mutex
+	identities  map[string]int
+}
+
+type poolShard struct {
+	c  *Client
+	up int32
+}
+
+// DialPool opens opts.Size connections to hubURL. It fails, closing any
+// connections already made, if one cannot be dialed.
+func DialPool(hubURL string, opts PoolOptions) (*Pool, error) {
+	if opts.Size <= 0 {
+		opts.Size = 4
+	}
+	p := &Pool{opts: opts, messages: make(chan Message, 256*opts.Size), identities: map[string]int{}}
+	for i := 0; i < opts.Size; i++ {
+		o := opts.Options
+		o.PeerId = ""
+		o.AutoReconnect = true
+		sh := &poolShard{up: 1}
+		c, err := dial(hubURL, o, func(up bool) { p.setLink(sh, up) })
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		sh.c = c
+		p.shards = append(p.shards, sh)
+	}
+	var wg sync.WaitGroup
+	for _, sh := range p.shards {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			for msg := range c.Messages() {
+				p.messages <- msg
+			}
+		}(sh.c)
+	}
+	go func() {
+		wg.Wait()
+		close(p.messages)
+	}()
+	atomic.StoreInt32(&p.ready, 1)
+	p.rebalance(nil)
+	return p, nil
+}
+
+// Messages returns the messages received on every connection. A message's
+// TargetPeerId tells which connection it arrived on.
+func (p *Pool) Messages() <-chan Message { return p.messages }
+
+// Clients returns the pool's connections.
+func (p *Pool) Clients() []*Client {
+	out := make([]*Client, len(p.shards))
+	for i, sh := range p.shards {
+		out[i] = sh.c
+	}
+	return out
+}
+
+// Close closes every connection.
+func (p *Pool) Close() error {
+	var first error
+	for _, sh := range p.shards {
+		if err := sh.c.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// shardFor picks the live connection with the highest hash for identity, or
+// -1 when every connection is down.
+func (p *Pool) shardFor(identity string) int {
+	best, bestScore := -1, uint64(0)
+	for i, sh := range p.shards {
+		if atomic.LoadInt32(&sh.up) == 0 {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(identity))
+		h.Write([]byte{0})
+		h.Write([]byte(sh.c.peerId))
+		if score := h.Sum64(); best < 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// Add registers identities with the pool and assigns each to a connection.
+func (p *Pool) Add(identities ...string) {
+	p.mu.Lock()
+	for _, id := range identities {
+		if _, ok := p.identities[id]; !ok {
+			p.identities[id] = -1
+		}
+	}
+	p.mu.Unlock()
+	p.rebalance(nil)
+}
+
+// Remove forgets identities.
+func (p *Pool) Remove(identities ...string) {
+	dirty := map[int]bool{}
+	p.mu.Lock()
+	for _, id := range identities {
+		if i, ok := p.identities[id]; ok {
+			dirty[i] = true
+			delete(p.identities, id)
+		}
+	}
+	p.mu.Unlock()
+	p.rebalance(dirty)
+}
+
+// Assignments returns each identity's connection peer ID ("" while every
+// connection is down).
+func (p *Pool) Assignments() map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make(map[string]string, len(p.identities))
+	for id, i := range p.identities {
+		out[id] = ""
+		if i >= 0 {
+			out[id] = p.shards[i].c.peerId
+		}
+	}
+	return out
+}
+
+// For returns the connection identity is assigned to, registering it first
+// if needed. It returns nil while every connection is down.
+func (p *Pool) For(identity string) *Client {
+	p.mu.Lock()
+	i, ok := p.identities[identity]
+	p.mu.Unlock()
+	if !ok {
+		p.Add(identity)
+		p.mu.Lock()
+		i = p.identities[identity]
+		p.mu.Unlock()
+	}
+	if i < 0 {
+		return nil
+	}
+	return p.shards[i].c
+}
+
+// SendAs sends msg on the connection identity is assigned to.
+func (p *Pool) SendAs(identity string, msg Message, data interface{}) error {
+	c := p.For(identity)
+	if c == nil {
+		return errors.New("no pool connection is up")
+	}
+	return c.Send(msg, data)
+}
+
+// SignalAs sends an offer, answer or ice-candidate for identity.
+func (p *Pool) SignalAs(identity, signalType, targetPeerId string, data interface{}) error {
+	c := p.For(identity)
+	if c == nil {
+		return errors.New("no pool connection is up")
+	}
+	return c.Signal(signalType, targetPeerId, data)
+}
+
+// Send writes msg on the next live connection, trying the others if that
+// write fails.
+func (p *Pool) Send(msg Message, data interface{}) error {
+	err := errors.New("no pool connection is up")
+	start := int(atomic.AddUint32(&p.next, 1))
+	for n := 0; n < len(p.shards); n++ {
+		sh := p.shards[(start+n)%len(p.shards)]
+		if atomic.LoadInt32(&sh.up) == 0 {
+			continue
+		}
+		if err = sh.c.Send(msg, data); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (p *Pool) setLink(sh *poolShard, up bool) {
+	v := int32(0)
+	if up {
+		v = 1
+	}
+	if atomic.SwapInt32(&sh.up, v) != v && atomic.LoadInt32(&p.ready) == 1 {
+		p.rebalance(nil)
+	}
+}
+
+// rebalance reassigns every identity to its current best connection and,
+// with AnnounceIdentities, re-announces the connections whose set changed.
+// dirty marks connections that changed for other reasons, such as Remove.
+func (p *Pool) rebalance(dirty map[int]bool) {
+	type move struct{ id, from, to string }
+	var moves []move
+	p.rebalanceMu.Lock()
+	p.mu.Lock()
+	changed := map[int]bool{}
+	for i := range dirty {
+		changed[i] = true
+	}
+	for id, old := range p.identities {
+		i := p.shardFor(id)
+		if i == old {
+			continue
+		}
+		p.identities[id] = i
+		changed[old], changed[i] = true, true
+		m := move{id: id}
+		if old >= 0 {
+			m.from = p.shards[old].c.peerId
+		}
+		if i >= 0 {
+			m.to = p.shards[i].c.peerId
+		}
+		moves = append(moves, m)
+	}
+	served := make([][]string, len(p.shards))
+	for id, i := range p.identities {
+		if i >= 0 {
+			served[i] = append(served[i], id)
+		}
+	}
+	p.mu.Unlock()
+
+	if p.opts.AnnounceIdentities {
+		for i, sh := range p.shards {
+			if !changed[i] {
+				continue
+			}
+			ids := append([]string{}, served[i]...)
+			sort.Strings(ids)
+			data := make(map[string]interface{}, len(p.opts.Options.AnnounceData)+1)
+			for k, v := range p.opts.Options.AnnounceData {
+				data[k] = v
+			}
+			data["poolIdentities"] = ids
+			sh.c.setAnnounceData(data)
+			if atomic.LoadInt32(&sh.up) == 1 {
+				sh.c.Announce()
+			}
+		}
+	}
+	// Callbacks run unlocked so they may call back into the pool.
+	p.rebalanceMu.Unlock()
+	if p.opts.OnReassign != nil {
+		for _, m := range moves {
+			if m.from != "" || m.to != "" {
+				p.opts.OnReassign(m.id, m.from, m.to)
+			}
+		}
+	}
+}
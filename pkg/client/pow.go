@@ -0,0 +1,55 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// solveProofOfWork fetches a challenge from the hub behind u and returns
+// the query parameters that prove the work for peerId. It returns nil when
+// the hub does not ask for proof of work.
+func solveProofOfWork(u *url.URL, peerId string) (url.Values, error) {
+	cu := pollBase(u)
+	cu.Path = strings.TrimSuffix(cu.Path, "/poll") + "/pow/challenge"
+	cu.RawQuery = ""
+	res, err := (&http.Client{Timeout: 10 * time.Second}).Get(cu.String())
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var body struct {
+		Challenge  string `json:"challenge"`
+		Difficulty int    `json:"difficulty"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil || res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proof of work challenge: status %d", res.StatusCode)
+	}
+	if body.Difficulty <= 0 {
+		return nil, nil
+	}
+	prefix := body.Challenge + ":" + peerId + ":"
+	for i := uint64(0); ; i++ {
+		nonce := strconv.FormatUint(i, 36)
+		if leadingZeroBits(sha256.Sum256([]byte(prefix+nonce))) >= body.Difficulty {
+			return url.Values{"pow": {body.Challenge}, "powNonce": {nonce}}, nil
+		}
+	}
+}
+
+func leadingZeroBits(sum [32]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
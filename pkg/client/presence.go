@@ -0,0 +1,79 @@
+package client
+
+import "encoding/json"
+
+// Presence is a peer's self-description. Put it under "presence" in
+// Options.AnnounceData; the hub validates it, stamps UpdatedAt and passes it
+// on with the peer in peer-discovered. Capabilities listed here are also
+// what Directory.ByCapability matches.
+type Presence struct {
+	DisplayName  string            `json:"displayName,omitempty"`
+	Capabilities []string          `json:"capabilities,omitempty"`
+	AppVersion   string            `json:"appVersion,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+	UpdatedAt    int64             `json:"updatedAt,omitempty"`
+}
+
+// UpdatePresence changes this peer's presence without re-announcing. changes
+// holds the fields to replace, by their JSON names; "tags" merges into the
+// current tags, with a nil value removing a tag. The change is kept for
+// reconnects.
+func (c *Client) UpdatePresence(changes map[string]interface{}) error {
+	if err := c.Send(Message{Type: "presence-update", NetworkName: c.network()}, changes); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data := make(map[string]interface{}, len(c.opts.AnnounceData)+1)
+	for k, v := range c.opts.AnnounceData {
+		data[k] = v
+	}
+	current := map[string]interface{}{}
+	if b, err := json.Marshal(data["presence"]); err == nil {
+		json.Unmarshal(b, &current)
+	}
+	if current == nil {
+		current = map[string]interface{}{}
+	}
+	for k, v := range changes {
+		if k != "tags" {
+			current[k] = v
+			continue
+		}
+		tags, _ := current["tags"].(map[string]interface{})
+		if tags == nil {
+			tags = map[string]interface{}{}
+		}
+		var patch map[string]interface{}
+		if b, err := json.Marshal(v); err == nil {
+			json.Unmarshal(b, &patch)
+		}
+		for tk, tv := range patch {
+			if tv == nil {
+				delete(tags, tk)
+			} else {
+				tags[tk] = tv
+			}
+		}
+		current["tags"] = tags
+	}
+	data["presence"] = current
+	c.opts.AnnounceData = data
+	return nil
+}
+
+// PresenceUpdate decodes a presence-update. ok is false for any other
+// message type.
+func (m Message) PresenceUpdate() (peerId string, p Presence, ok bool) {
+	if m.Type != "presence-update" {
+		return "", Presence{}, false
+	}
+	var d struct {
+		PeerId   string   `json:"peerId"`
+		Presence Presence `json:"presence"`
+	}
+	if err := json.Unmarshal(m.Data, &d); err != nil || d.PeerId == "" {
+		return "", Presence{}, false
+	}
+	return d.PeerId, d.Presence, true
+}
@@ -0,0 +1,52 @@
+package client
+
+import "encoding/json"
+
+// DisconnectReason says why a peer left, as carried in peer-disconnected
+// messages and in the close frame the hub sends when it drops a connection.
+type DisconnectReason string
+
+const (
+	ReasonClientGoodbye DisconnectReason = "client-goodbye"
+	ReasonIdleTimeout   DisconnectReason = "idle-timeout"
+	ReasonRateLimit     DisconnectReason = "rate-limit"
+	ReasonReplaced      DisconnectReason = "replaced"
+	ReasonHubShutdown   DisconnectReason = "hub-shutdown"
+	ReasonError         DisconnectReason = "error"
+	ReasonKicked        DisconnectReason = "kicked"
+	ReasonNetworkSwitch DisconnectReason = "network-switch"
+	ReasonBanned        DisconnectReason = "banned"
+	ReasonGuestExpired  DisconnectReason = "guest-expired"
+	ReasonSlowConsumer  DisconnectReason = "slow-consumer"
+	ReasonPingTimeout   DisconnectReason = "ping-timeout"
+	ReasonTokenExpired  DisconnectReason = "token-expired"
+	ReasonUnlisted      DisconnectReason = "unlisted"
+	// ReasonDuplicateSession means the peer ID announced more recently on
+	// another hub, which now holds it.
+	ReasonDuplicateSession DisconnectReason = "duplicate-session"
+)
+
+// Voluntary reports whether the peer chose to leave, as opposed to being
+// removed by the hub or losing its connection.
+func (r DisconnectReason) Voluntary() bool {
+	return r == ReasonClientGoodbye || r == ReasonNetworkSwitch
+}
+
+// PeerDisconnected decodes a peer-disconnected message. ok is false for any
+// other message type.
+func (m Message) PeerDisconnected() (peerId string, reason DisconnectReason, ok bool) {
+	if m.Type != "peer-disconnected" {
+		return "", "", false
+	}
+	var d struct {
+		PeerId string           `json:"peerId"`
+		Reason DisconnectReason `json:"reason"`
+	}
+	if err := json.Unmarshal(m.Data, &d); err != nil {
+		return "", "", false
+	}
+	if d.Reason == "" {
+		d.Reason = ReasonError
+	}
+	return d.PeerId, d.Reason, true
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+)
+
+// ReceiptStatus is the state a message-receipt acknowledges.
+type ReceiptStatus string
+
+const (
+	ReceiptDelivered ReceiptStatus = "delivered"
+	ReceiptRead      ReceiptStatus = "read"
+)
+
+// SendMessage relays data to targetPeerId through the hub as a peer-message
+// and returns its messageId. With receipts set, the destination SDK answers
+// with a delivered receipt as soon as the message arrives, and the
+// application there may follow with MarkRead.
+func (c *Client) SendMessage(targetPeerId string, data interface{}, receipts bool) (string, error) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	err := c.Send(Message{Type: "peer-message", TargetPeerId: targetPeerId, NetworkName: c.opts.NetworkName, MessageId: id, Receipts: receipts}, data)
+	return id, err
+}
+
+// MarkRead sends a read receipt for a peer-message that asked for receipts.
+func (c *Client) MarkRead(msg Message) error {
+	if msg.Type != "peer-message" || !msg.Receipts {
+		return errors.New("message did not request receipts")
+	}
+	return c.sendReceipt(msg, ReceiptRead)
+}
+
+func (c *Client) sendReceipt(msg Message, status ReceiptStatus) error {
+	return c.Send(Message{Type: "message-receipt", TargetPeerId: msg.FromPeerId, NetworkName: c.opts.NetworkName, MessageId: msg.MessageId}, map[string]interface{}{"messageId": msg.MessageId, "status": status})
+}
+
+// Receipt decodes a message-receipt into the messageId it acknowledges. ok
+// is false for any other message type.
+func (m Message) Receipt() (messageId string, status ReceiptStatus, ok bool) {
+	if m.Type != "message-receipt" {
+		return "", "", false
+	}
+	var d struct {
+		MessageId string        `json:"messageId"`
+		Status    ReceiptStatus `json:"status"`
+	}
+	if err := json.Unmarshal(m.Data, &d); err != nil {
+		return "", "", false
+	}
+	return firstNonEmpty(d.MessageId, m.MessageId), d.Status, true
+}
+
+func firstNonEmpty(a, b string) string {
+	if a != "" {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,473 @@
+// Package rtc makes a hub client a full mesh peer. A PeerConnectionManager
+// answers the offers, answers and ICE candidates the hub relays to the
+// client, opens a WebRTC data channel to every peer it discovers and hands
+// what arrives on them to OnDataChannelMessage, so the hub only carries
+// signaling and peers talk to each other directly:
+//
+//	c, _ := client.Dial(hubURL, client.Options{NetworkName: "demo", DiscardMessages: true})
+//	m := rtc.NewPeerConnectionManager(c, rtc.Options{})
+//	m.OnDataChannelMessage(func(peerId string, msg webrtc.DataChannelMessage) { ... })
+//	m.SendText(peerId, "hello")
+//
+// This package is its own module, so that the client SDK and the hub do not
+// depend on pion.
+package rtc
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+	"peerpigeon/pkg/client"
+)
+
+// DefaultLabel names the data channel opened to each peer.
+const DefaultLabel = "peerpigeon"
+
+var (
+	// ErrNotConnected is returned when sending to a peer whose data channel
+	// is not open.
+	ErrNotConnected = errors.New("rtc: peer not connected")
+	// ErrClosed is returned once the manager has been closed.
+	ErrClosed = errors.New("rtc: manager closed")
+)
+
+// Options configures a PeerConnectionManager.
+type Options struct {
+	// Config is used for every peer connection. When it names no ICE
+	// servers, the ones the hub offered in its greeting are used.
+	Config webrtc.Configuration
+	// Label names the data channel opened to each peer (default
+	// DefaultLabel).
+	Label string
+	// Manual stops the manager connecting to peers as they are discovered;
+	// call Connect instead. Offers from other peers are still answered.
+	Manual bool
+}
+
+// PeerConnectionManager keeps a peer connection and data channel to each
+// peer on the client's network.
+//
+// Of two peers that discover each other, the one with the lower peer ID
+// makes the offer. When both offer at once, as after two Connect calls, the
+// lower ID's offer wins and the other side answers it instead. A peer is
+// dropped when its data channel closes or its connection fails; leaving the
+// hub alone does not drop it, since the link does not pass through the hub.
+type PeerConnectionManager struct {
+	c    *client.Client
+	opts Options
+
+	// negotiating serialises offers made by Connect with the signals the
+	// manager handles, so each sees the other's link settled.
+	negotiating sync.Mutex
+
+	mu       sync.Mutex
+	links    map[string]*link
+	closed   bool
+	handlers handlers
+
+	events chan event
+	done   chan struct{}
+}
+
+type handlers struct {
+	message      func(peerId string, msg webrtc.DataChannelMessage)
+	connected    func(peerId string)
+	disconnected func(peerId string)
+}
+
+// link is the connection to one remote peer. Candidates that arrive before
+// the remote description are held until it is set.
+type link struct {
+	pc        *webrtc.PeerConnection
+	dc        *webrtc.DataChannel
+	offering  bool
+	open      bool
+	remoteSet bool
+	pending   []webrtc.ICECandidateInit
+}
+
+// event is a discovery or signal from the hub, handled in order on the
+// manager's own goroutine since the client's callbacks must return quickly.
+type event struct {
+	discovered string
+	signal     client.Message
+}
+
+// NewPeerConnectionManager takes over c's OnPeerDiscovered and OnSignal
+// callbacks; peers c already knows are connected to as well, unless
+// opts.Manual is set.
+func NewPeerConnectionManager(c *client.Client, opts Options) *PeerConnectionManager {
+	if opts.Label == "" {
+		opts.Label = DefaultLabel
+	}
+	m := &PeerConnectionManager{c: c, opts: opts, links: map[string]*link{}, events: make(chan event, 256), done: make(chan struct{})}
+	c.OnPeerDiscovered(func(peerId string, data json.RawMessage) { m.post(event{discovered: peerId}) })
+	c.OnSignal(func(msg client.Message) { m.post(event{signal: msg}) })
+	go m.run()
+	for _, p := range c.Peers().All() {
+		m.post(event{discovered: p.PeerId})
+	}
+	return m
+}
+
+// OnDataChannelMessage calls fn with each message a peer sends on its data
+// channel.
+func (m *PeerConnectionManager) OnDataChannelMessage(fn func(peerId string, msg webrtc.DataChannelMessage)) {
+	m.mu.Lock()
+	m.handlers.message = fn
+	m.mu.Unlock()
+}
+
+// OnPeerConnected calls fn when the data channel to a peer opens.
+func (m *PeerConnectionManager) OnPeerConnected(fn func(peerId string)) {
+	m.mu.Lock()
+	m.handlers.connected = fn
+	m.mu.Unlock()
+}
+
+// OnPeerDisconnected calls fn when a peer whose data channel was open is
+// dropped.
+func (m *PeerConnectionManager) OnPeerDisconnected(fn func(peerId string)) {
+	m.mu.Lock()
+	m.handlers.disconnected = fn
+	m.mu.Unlock()
+}
+
+// Connect offers a connection to peerId unless there already is one.
+func (m *PeerConnectionManager) Connect(peerId string) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrClosed
+	}
+	m.mu.Unlock()
+	m.negotiating.Lock()
+	defer m.negotiating.Unlock()
+	m.mu.Lock()
+	exists := m.links[peerId] != nil
+	m.mu.Unlock()
+	if exists {
+		return nil
+	}
+	return m.offer(peerId)
+}
+
+// Send writes data to peerId's data channel as a binary message.
+func (m *PeerConnectionManager) Send(peerId string, data []byte) error {
+	dc, err := m.channel(peerId)
+	if err != nil {
+		return err
+	}
+	return dc.Send(data)
+}
+
+// SendText writes text to peerId's data channel as a string message.
+func (m *PeerConnectionManager) SendText(peerId, text string) error {
+	dc, err := m.channel(peerId)
+	if err != nil {
+		return err
+	}
+	return dc.SendText(text)
+}
+
+// BufferedAmount returns how many bytes are queued on peerId's data channel
+// and not yet sent, so a sender streaming large data can pace itself.
+func (m *PeerConnectionManager) BufferedAmount(peerId string) (uint64, error) {
+	dc, err := m.channel(peerId)
+	if err != nil {
+		return 0, err
+	}
+	return dc.BufferedAmount(), nil
+}
+
+// Broadcast sends data to every connected peer and returns how many it was
+// written to.
+func (m *PeerConnectionManager) Broadcast(data []byte) int {
+	sent := 0
+	for _, id := range m.Peers() {
+		if m.Send(id, data) == nil {
+			sent++
+		}
+	}
+	return sent
+}
+
+// Peers returns the peers whose data channel is open, sorted.
+func (m *PeerConnectionManager) Peers() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := []string{}
+	for id, l := range m.links {
+		if l.open {
+			out = append(out, id)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Close tears down every peer connection. The hub client is left open.
+func (m *PeerConnectionManager) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.done)
+	links := m.links
+	m.links = map[string]*link{}
+	m.mu.Unlock()
+	for _, l := range links {
+		l.pc.Close()
+	}
+	return nil
+}
+
+func (m *PeerConnectionManager) post(e event) {
+	select {
+	case m.events <- e:
+	case <-m.done:
+	}
+}
+
+func (m *PeerConnectionManager) run() {
+	for {
+		select {
+		case e := <-m.events:
+			if e.discovered != "" {
+				if !m.opts.Manual && m.c.PeerId() < e.discovered {
+					if err := m.Connect(e.discovered); err != nil && err != ErrClosed {
+						log.Printf("rtc: connect %s: %v", e.discovered, err)
+					}
+				}
+				continue
+			}
+			m.negotiating.Lock()
+			err := m.signal(e.signal)
+			m.negotiating.Unlock()
+			if err != nil {
+				log.Printf("rtc: %s from %s: %v", e.signal.Type, e.signal.FromPeerId, err)
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *PeerConnectionManager) channel(peerId string) (*webrtc.DataChannel, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	l := m.links[peerId]
+	if l == nil || !l.open {
+		return nil, ErrNotConnected
+	}
+	return l.dc, nil
+}
+
+// config is opts.Config, with the hub's ICE servers when it names none.
+func (m *PeerConnectionManager) config() webrtc.Configuration {
+	config := m.opts.Config
+	if len(config.ICEServers) == 0 {
+		for _, s := range m.c.ICEServers() {
+			config.ICEServers = append(config.ICEServers, webrtc.ICEServer{URLs: s.URLs, Username: s.Username, Credential: s.Credential})
+		}
+	}
+	return config
+}
+
+// newLink creates the connection to remote, replacing any there was.
+// Candidates the old one was holding are kept, since they came from the
+// remote's side of the negotiation the new one takes over.
+func (m *PeerConnectionManager) newLink(remote string, offering bool) (*link, error) {
+	pc, err := webrtc.NewPeerConnection(m.config())
+	if err != nil {
+		return nil, err
+	}
+	pc.OnICECandidate(func(cand *webrtc.ICECandidate) {
+		if cand != nil {
+			m.c.SendICE(remote, cand.ToJSON())
+		}
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			m.forget(remote, pc)
+		}
+	})
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) { m.attach(remote, pc, dc) })
+	l := &link{pc: pc, offering: offering}
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		pc.Close()
+		return nil, ErrClosed
+	}
+	old := m.links[remote]
+	if old != nil && !old.remoteSet {
+		l.pending = old.pending
+	}
+	m.links[remote] = l
+	m.mu.Unlock()
+	if old != nil {
+		old.pc.Close()
+	}
+	return l, nil
+}
+
+// attach wires dc as the data channel of remote's connection pc.
+func (m *PeerConnectionManager) attach(remote string, pc *webrtc.PeerConnection, dc *webrtc.DataChannel) {
+	dc.OnOpen(func() {
+		m.mu.Lock()
+		l := m.links[remote]
+		if l == nil || l.pc != pc {
+			m.mu.Unlock()
+			return
+		}
+		l.dc, l.open = dc, true
+		fn := m.handlers.connected
+		m.mu.Unlock()
+		if fn != nil {
+			fn(remote)
+		}
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		m.mu.Lock()
+		fn := m.handlers.message
+		m.mu.Unlock()
+		if fn != nil {
+			fn(remote, msg)
+		}
+	})
+	dc.OnClose(func() { m.forget(remote, pc) })
+}
+
+// forget drops the link to remote if it is still pc.
+func (m *PeerConnectionManager) forget(remote string, pc *webrtc.PeerConnection) {
+	m.mu.Lock()
+	l := m.links[remote]
+	if l == nil || l.pc != pc {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.links, remote)
+	fn := m.handlers.disconnected
+	m.mu.Unlock()
+	pc.Close()
+	if l.open && fn != nil {
+		fn(remote)
+	}
+}
+
+func (m *PeerConnectionManager) offer(remote string) error {
+	l, err := m.newLink(remote, true)
+	if err != nil {
+		return err
+	}
+	dc, err := l.pc.CreateDataChannel(m.opts.Label, nil)
+	if err != nil {
+		return err
+	}
+	m.attach(remote, l.pc, dc)
+	offer, err := l.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	if err := l.pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	return m.c.SendOffer(remote, offer)
+}
+
+// remoteDescription sets l's remote description and adds the candidates
+// that were waiting for it.
+func (m *PeerConnectionManager) remoteDescription(l *link, desc webrtc.SessionDescription) error {
+	if err := l.pc.SetRemoteDescription(desc); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	pending := l.pending
+	l.pending, l.remoteSet = nil, true
+	m.mu.Unlock()
+	for _, cand := range pending {
+		if err := l.pc.AddICECandidate(cand); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signal handles an offer, answer or ice-candidate from the hub.
+func (m *PeerConnectionManager) signal(msg client.Message) error {
+	remote := msg.FromPeerId
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	l := m.links[remote]
+	m.mu.Unlock()
+	switch msg.Type {
+	case "offer":
+		var offer webrtc.SessionDescription
+		if err := json.Unmarshal(msg.Data, &offer); err != nil {
+			return err
+		}
+		if l != nil && l.offering && m.c.PeerId() < remote {
+			// Both offered; ours wins and theirs is dropped.
+			return nil
+		}
+		if l == nil || l.offering || l.remoteSet {
+			var err error
+			if l, err = m.newLink(remote, false); err != nil {
+				return err
+			}
+		}
+		if err := m.remoteDescription(l, offer); err != nil {
+			return err
+		}
+		answer, err := l.pc.CreateAnswer(nil)
+		if err != nil {
+			return err
+		}
+		if err := l.pc.SetLocalDescription(answer); err != nil {
+			return err
+		}
+		return m.c.SendAnswer(remote, answer)
+	case "answer":
+		if l == nil || !l.offering {
+			return errors.New("no offer outstanding")
+		}
+		var answer webrtc.SessionDescription
+		if err := json.Unmarshal(msg.Data, &answer); err != nil {
+			return err
+		}
+		return m.remoteDescription(l, answer)
+	case "ice-candidate":
+		var cand webrtc.ICECandidateInit
+		if err := json.Unmarshal(msg.Data, &cand); err != nil {
+			return err
+		}
+		if l == nil {
+			var err error
+			if l, err = m.newLink(remote, false); err != nil {
+				return err
+			}
+		}
+		m.mu.Lock()
+		if !l.remoteSet {
+			l.pending = append(l.pending, cand)
+			m.mu.Unlock()
+			return nil
+		}
+		m.mu.Unlock()
+		return l.pc.AddICECandidate(cand)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package rtc
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"peerpigeon/examples/hubfixture"
+	"peerpigeon/internal/server"
+	"peerpigeon/pkg/client"
+)
+
+type received struct {
+	from string
+	msg  webrtc.DataChannelMessage
+}
+
+func newManager(t *testing.T, hub *hubfixture.Hub) (*PeerConnectionManager, chan string, chan string, chan received) {
+	t.Helper()
+	m := NewPeerConnectionManager(hub.Dial(t, client.Options{NetworkName: "rtc", DiscardMessages: true}), Options{})
+	t.Cleanup(func() { m.Close() })
+	connected, disconnected, msgs := make(chan string, 8), make(chan string, 8), make(chan received, 8)
+	m.OnPeerConnected(func(peerId string) { connected <- peerId })
+	m.OnPeerDisconnected(func(peerId string) { disconnected <- peerId })
+	m.OnDataChannelMessage(func(peerId string, msg webrtc.DataChannelMessage) { msgs <- received{peerId, msg} })
+	return m, connected, disconnected, msgs
+}
+
+func waitPeers(t *testing.T, ch chan string, n int) []string {
+	t.Helper()
+	var got []string
+	for len(got) < n {
+		select {
+		case id := <-ch:
+			got = append(got, id)
+		case <-time.After(15 * time.Second):
+			t.Fatalf("saw %v, want %d peers", got, n)
+		}
+	}
+	sort.Strings(got)
+	return got
+}
+
+func knows(c *client.Client, peerId string) bool {
+	for _, p := range c.Peers().All() {
+		if p.PeerId == peerId {
+			return true
+		}
+	}
+	return false
+}
+
+func TestManagersConnectDiscoveredPeersOverDataChannels(t *testing.T) {
+	hub := hubfixture.New(t, server.Options{})
+	a, aConnected, _, aMsgs := newManager(t, hub)
+	b, bConnected, bDisconnected, bMsgs := newManager(t, hub)
+	aId, bId := a.c.PeerId(), b.c.PeerId()
+
+	if got := waitPeers(t, aConnected, 1); got[0] != bId {
+		t.Fatalf("a connected to %v, want %s", got, bId)
+	}
+	if got := waitPeers(t, bConnected, 1); got[0] != aId {
+		t.Fatalf("b connected to %v, want %s", got, aId)
+	}
+
+	if err := a.SendText(bId, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Send(aId, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-bMsgs:
+		if r.from != aId || !r.msg.IsString || string(r.msg.Data) != "hello" {
+			t.Fatalf("b received %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("b received nothing")
+	}
+	select {
+	case r := <-aMsgs:
+		if r.from != bId || r.msg.IsString || string(r.msg.Data) != "\x01\x02\x03" {
+			t.Fatalf("a received %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a received nothing")
+	}
+
+	c, cConnected, _, _ := newManager(t, hub)
+	want := []string{aId, bId}
+	sort.Strings(want)
+	if got := waitPeers(t, cConnected, 2); got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("c connected to %v, want %v", got, want)
+	}
+	if got := waitPeers(t, bConnected, 1); got[0] != c.c.PeerId() {
+		t.Fatalf("b connected to %v, want %s", got, c.c.PeerId())
+	}
+	if n := c.Broadcast([]byte("all")); n != 2 {
+		t.Fatalf("broadcast reached %d peers, want 2", n)
+	}
+
+	c.Close()
+	select {
+	case id := <-bDisconnected:
+		if id != c.c.PeerId() {
+			t.Fatalf("b dropped %s, want %s", id, c.c.PeerId())
+		}
+	case <-time.After(15 * time.Second):
+		t.Fatal("b never dropped the closed peer")
+	}
+	if got := b.Peers(); len(got) != 1 || got[0] != aId {
+		t.Fatalf("b peers = %v, want [%s]", got, aId)
+	}
+	if err := b.SendText(c.c.PeerId(), "gone"); err != ErrNotConnected {
+		t.Fatalf("send to dropped peer = %v, want ErrNotConnected", err)
+	}
+	if _, err := b.BufferedAmount(c.c.PeerId()); err != ErrNotConnected {
+		t.Fatalf("buffered amount of dropped peer = %v, want ErrNotConnected", err)
+	}
+	if _, err := b.BufferedAmount(aId); err != nil {
+		t.Fatalf("buffered amount of connected peer: %v", err)
+	}
+}
+
+func TestSimultaneousConnectSettlesOnOneLink(t *testing.T) {
+	hub := hubfixture.New(t, server.Options{})
+	a := NewPeerConnectionManager(hub.Dial(t, client.Options{NetworkName: "rtc", DiscardMessages: true}), Options{Manual: true})
+	defer a.Close()
+	b := NewPeerConnectionManager(hub.Dial(t, client.Options{NetworkName: "rtc", DiscardMessages: true}), Options{Manual: true})
+	defer b.Close()
+	aConnected, bConnected := make(chan string, 4), make(chan string, 4)
+	a.OnPeerConnected(func(peerId string) { aConnected <- peerId })
+	b.OnPeerConnected(func(peerId string) { bConnected <- peerId })
+
+	// The hub relays signals only once b's announce has reached it.
+	for deadline := time.Now().Add(5 * time.Second); !knows(a.c, b.c.PeerId()); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("a never discovered b")
+		}
+	}
+	if err := a.Connect(b.c.PeerId()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Connect(a.c.PeerId()); err != nil {
+		t.Fatal(err)
+	}
+	waitPeers(t, aConnected, 1)
+	waitPeers(t, bConnected, 1)
+	if err := a.SendText(b.c.PeerId(), "x"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SendText(a.c.PeerId(), "y"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,242 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// HubCandidate is the result of probing one hub.
+type HubCandidate struct {
+	URL string
+	// HealthLatency is the round trip of GET /health; ConnectLatency is the
+	// time to open (and then close) a WebSocket.
+	HealthLatency  time.Duration
+	ConnectLatency time.Duration
+	// Load is connections/maxConnections as reported by /health.
+	Load float64
+	// Healthy is false when a probe failed or the hub reported maintenance
+	// or overload; Error says why.
+	Healthy  bool
+	Error    string
+	Score    time.Duration
+	ProbedAt time.Time
+}
+
+// SelectorOptions configures a HubSelector.
+type SelectorOptions struct {
+	// Interval is how often Start re-probes the hubs (default 1m).
+	Interval time.Duration
+	// Timeout bounds each probe (default 5s).
+	Timeout time.Duration
+	// LoadPenalty is added to a hub's score at full load, in proportion to
+	// its load (default 250ms), so a fast but crowded hub loses to a
+	// slightly slower idle one.
+	LoadPenalty time.Duration
+	// OnChange is called when a probe round picks a different best hub.
+	OnChange func(best HubCandidate)
+}
+
+// HubSelector ranks candidate hubs by latency and load. Each probe round
+// checks every hub's /health and times a WebSocket connect, all
+// concurrently; a hub's score is its connect latency plus LoadPenalty times
+// its load, and unhealthy hubs rank last.
+type HubSelector struct {
+	urls []string
+	opts SelectorOptions
+
+	mu     sync.Mutex
+	ranked []HubCandidate
+	stop   chan struct{}
+}
+
+// NewHubSelector returns a selector over hub URLs (ws:// or wss://). Call
+// Probe or Start before Best.
+func NewHubSelector(urls []string, opts SelectorOptions) *HubSelector {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.LoadPenalty <= 0 {
+		opts.LoadPenalty = 250 * time.Millisecond
+	}
+	return &HubSelector{urls: append([]string(nil), urls...), opts: opts}
+}
+
+// Probe probes every hub now and returns them best first.
+func (h *HubSelector) Probe() []HubCandidate {
+	out := make([]HubCandidate, len(h.urls))
+	var wg sync.WaitGroup
+	for i, u := range h.urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			out[i] = h.probe(u)
+		}(i, u)
+	}
+	wg.Wait()
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Healthy != out[j].Healthy {
+			return out[i].Healthy
+		}
+		return out[i].Score < out[j].Score
+	})
+	h.mu.Lock()
+	var prev string
+	if len(h.ranked) > 0 {
+		prev = h.ranked[0].URL
+	}
+	h.ranked = out
+	h.mu.Unlock()
+	if len(out) > 0 && out[0].Healthy && out[0].URL != prev && h.opts.OnChange != nil {
+		h.opts.OnChange(out[0])
+	}
+	return append([]HubCandidate(nil), out...)
+}
+
+func (h *HubSelector) probe(hubURL string) HubCandidate {
+	c := HubCandidate{URL: hubURL, ProbedAt: time.Now()}
+	u, err := url.Parse(hubURL)
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	hu := pollBase(u)
+	hu.Path = strings.TrimSuffix(hu.Path, "/poll") + "/health"
+	hu.RawQuery = ""
+	start := time.Now()
+	res, err := (&http.Client{Timeout: h.opts.Timeout}).Get(hu.String())
+	if err != nil {
+		c.Error = err.Error()
+		return c
+	}
+	var health struct {
+		Connections    int  `json:"connections"`
+		MaxConnections int  `json:"maxConnections"`
+		Maintenance    bool `json:"maintenance"`
+		Degraded       bool `json:"degraded"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&health)
+	res.Body.Close()
+	c.HealthLatency = time.Since(start)
+	if err != nil || res.StatusCode != http.StatusOK {
+		c.Error = fmt.Sprintf("health: status %d", res.StatusCode)
+		return c
+	}
+	if health.MaxConnections > 0 {
+		c.Load = float64(health.Connections) / float64(health.MaxConnections)
+	}
+
+	wu := *u
+	q := wu.Query()
+	q.Set("peerId", NewPeerId())
+	wu.RawQuery = q.Encode()
+	dialer := websocket.Dialer{HandshakeTimeout: h.opts.Timeout, Proxy: http.ProxyFromEnvironment}
+	start = time.Now()
+	ws, _, err := dialer.Dial(wu.String(), nil)
+	if err != nil {
+		c.Error = "connect: " + err.Error()
+		return c
+	}
+	c.ConnectLatency = time.Since(start)
+	wsTransport{ws}.Close()
+
+	c.Score = c.ConnectLatency + time.Duration(c.Load*float64(h.opts.LoadPenalty))
+	switch {
+	case health.Maintenance:
+		c.Error = "hub in maintenance"
+	case health.Degraded:
+		c.Error = "hub degraded"
+	case health.MaxConnections > 0 && health.Connections >= health.MaxConnections:
+		c.Error = "hub full"
+	default:
+		c.Healthy = true
+	}
+	return c
+}
+
+// Ranked returns the last probe results, best first.
+func (h *HubSelector) Ranked() []HubCandidate {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]HubCandidate(nil), h.ranked...)
+}
+
+// Best returns the best healthy hub from the last probe.
+func (h *HubSelector) Best() (HubCandidate, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.ranked) == 0 || !h.ranked[0].Healthy {
+		return HubCandidate{}, false
+	}
+	return h.ranked[0], true
+}
+
+// Start probes now and then every Interval until Stop.
+func (h *HubSelector) Start() {
+	h.mu.Lock()
+	if h.stop != nil {
+		h.mu.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	h.stop = stop
+	h.mu.Unlock()
+	h.Probe()
+	go func() {
+		ticker := time.NewTicker(h.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				h.Probe()
+			}
+		}
+	}()
+}
+
+// Stop ends periodic probing.
+func (h *HubSelector) Stop() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+}
+
+// Dial connects to the best healthy hub, trying the others in rank order if
+// it fails. It probes first when nothing has been probed yet.
+func (h *HubSelector) Dial(opts Options) (*Client, error) {
+	ranked := h.Ranked()
+	if len(ranked) == 0 {
+		ranked = h.Probe()
+	}
+	var errs []error
+	for _, c := range ranked {
+		if !c.Healthy {
+			continue
+		}
+		cl, err := Dial(c.URL, opts)
+		if err == nil {
+			return cl, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", c.URL, err))
+	}
+	if len(errs) == 0 {
+		return nil, errors.New("no healthy hub")
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// ServiceRecord advertises a non-WebRTC service, such as a TCP game server
+// or an HTTPS API. Put records under "services" in Options.AnnounceData; the
+// hub validates them and refuses the announce with an invalid-service-record
+// error if one is malformed.
+type ServiceRecord struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	TLS      bool   `json:"tls"`
+	Path     string `json:"path,omitempty"`
+}
+
+// ResolvedService is a service record together with the peer advertising
+// it. Local is true when the peer is on the same hub as this client.
+type ResolvedService struct {
+	PeerId string `json:"peerId"`
+	Local  bool   `json:"local"`
+	ServiceRecord
+}
+
+// ResolveService asks the hub for the records named name on this client's
+// network, optionally limited to one protocol, and returns the query ID the
+// service-records reply will carry.
+func (c *Client) ResolveService(name, protocol string) (string, error) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	err := c.Send(Message{Type: "resolve-service", NetworkName: c.opts.NetworkName}, map[string]interface{}{"name": name, "protocol": protocol, "queryId": id})
+	return id, err
+}
+
+// ServiceRecords decodes a service-records reply. ok is false for any other
+// message type.
+func (m Message) ServiceRecords() (queryId string, records []ResolvedService, ok bool) {
+	if m.Type != "service-records" {
+		return "", nil, false
+	}
+	var d struct {
+		QueryId string            `json:"queryId"`
+		Records []ResolvedService `json:"records"`
+	}
+	if err := json.Unmarshal(m.Data, &d); err != nil {
+		return "", nil, false
+	}
+	return d.QueryId, d.Records, true
+}
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"peerpigeon/internal/msgpack"
+)
+
+// Transport names accepted in Options.Transport.
+const (
+	TransportAuto      = ""
+	TransportWebSocket = "websocket"
+	TransportPoll      = "poll"
+)
+
+// transport carries protocol messages to and from the hub.
+type transport interface {
+	WriteJSON(v interface{}) error
+	ReadJSON(v interface{}) error
+	Close() error
+	Name() string
+}
+
+type wsTransport struct{ *websocket.Conn }
+
+func (t wsTransport) Name() string { return TransportWebSocket }
+
+// ReadJSON reads the next message, decoding a binary frame as MessagePack.
+func (t wsTransport) ReadJSON(v interface{}) error {
+	messageType, data, err := t.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if messageType == websocket.BinaryMessage {
+		if data, err = msgpack.ToJSON(data); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (t wsTransport) Close() error {
+	t.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	return t.Conn.Close()
+}
+
+func dialWebSocket(u *url.URL) (transport, error) {
+	ws, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return wsTransport{ws}, nil
+}
+
+// pollTransport speaks the hub's HTTP long-polling protocol for networks
+// that block WebSockets.
+type pollTransport struct {
+	base    string
+	session string
+	http    http.Client
+
+	mu      sync.Mutex
+	pending []json.RawMessage
+}
+
+func (t *pollTransport) Name() string { return TransportPoll }
+
+// pollBase maps a ws(s)://host/ws hub URL to http(s)://host/poll.
+func pollBase(u *url.URL) *url.URL {
+	pu := *u
+	if pu.Scheme == "wss" {
+		pu.Scheme = "https"
+	} else {
+		pu.Scheme = "http"
+	}
+	pu.Path = strings.TrimSuffix(strings.TrimSuffix(pu.Path, "/"), "/ws") + "/poll"
+	return &pu
+}
+
+func dialPoll(u *url.URL) (transport, error) {
+	pu := pollBase(u)
+	connectURL := *pu
+	connectURL.Path += "/connect"
+	t := &pollTransport{http: http.Client{Timeout: 35 * time.Second}}
+	res, err := t.http.Post(connectURL.String(), "application/json", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var body struct {
+		Session string `json:"session"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil || res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("poll connect: status %d %s", res.StatusCode, body.Error)
+	}
+	pu.RawQuery = url.Values{"session": {body.Session}}.Encode()
+	t.base, t.session = pu.String(), body.Session
+	return t, nil
+}
+
+func (t *pollTransport) WriteJSON(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	batch, _ := json.Marshal(map[string]interface{}{"messages": []json.RawMessage{b}})
+	res, err := t.http.Post(t.base, "application/json", bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("poll send: status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// ReadJSON returns the next queued message, long-polling the hub for a new
+// batch when none are buffered.
+func (t *pollTransport) ReadJSON(v interface{}) error {
+	for {
+		t.mu.Lock()
+		if len(t.pending) > 0 {
+			next := t.pending[0]
+			t.pending = t.pending[1:]
+			t.mu.Unlock()
+			return json.Unmarshal(next, v)
+		}
+		t.mu.Unlock()
+		res, err := t.http.Get(t.base)
+		if err != nil {
+			return err
+		}
+		var body struct {
+			Messages []json.RawMessage `json:"messages"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("poll receive: status %d", res.StatusCode)
+		}
+		if err != nil {
+			return err
+		}
+		t.mu.Lock()
+		t.pending = append(t.pending, body.Messages...)
+		t.mu.Unlock()
+	}
+}
+
+func (t *pollTransport) Close() error {
+	req, _ := http.NewRequest(http.MethodDelete, t.base, nil)
+	res, err := t.http.Do(req)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// dialTransport connects with the requested transport. In auto mode a failed
+// WebSocket upgrade falls back to long polling.
+func dialTransport(u *url.URL, mode string) (transport, error) {
+	switch mode {
+	case TransportWebSocket:
+		return dialWebSocket(u)
+	case TransportPoll:
+		return dialPoll(u)
+	}
+	t, wsErr := dialWebSocket(u)
+	if wsErr == nil {
+		return t, nil
+	}
+	t, err := dialPoll(u)
+	if err != nil {
+		return nil, errors.Join(wsErr, err)
+	}
+	return t, nil
+}